@@ -0,0 +1,97 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+// Package audit provides audit events of token issuance and logout and sends
+// them to external systems like a SIEM.
+package audit
+
+import (
+	"time"
+
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect/geoip"
+)
+
+// Audit event types.
+const (
+	EventTypeTokenIssued        = "token_issued"
+	EventTypeLogout             = "logout"
+	EventTypeAuthorityFallback  = "authority_fallback"
+	EventTypeFederationDenied   = "federation_denied"
+	EventTypeLogonDenied        = "logon_denied"
+	EventTypeRefreshTokenReused = "refresh_token_reused"
+	EventTypeTokenRejected      = "token_rejected"
+)
+
+// Token type names of issued tokens.
+const (
+	TokenAccessToken  = "access_token"
+	TokenIDToken      = "id_token"
+	TokenRefreshToken = "refresh_token"
+)
+
+// An Event is an audit event. Events never contain token values, Tokens holds
+// the names of the issued tokens or the kind of the rejected token.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	Issuer    string `json:"iss,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+
+	Endpoint     string   `json:"endpoint,omitempty"`
+	GrantType    string   `json:"grant_type,omitempty"`
+	ResponseType string   `json:"response_type,omitempty"`
+	Tokens       []string `json:"tokens,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+
+	AuthorityID string `json:"authority_id,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+
+	GeoCountry string `json:"geo_country,omitempty"`
+	GeoASN     uint64 `json:"geo_asn,omitempty"`
+	GeoASOrg   string `json:"geo_as_org,omitempty"`
+}
+
+// NewEvent creates a new Event of the provided type with a random ID and the
+// current time. The ID stays the same when the event is sent again, so
+// receivers can detect duplicates.
+func NewEvent(eventType string) *Event {
+	return &Event{
+		ID:   rndm.GenerateRandomString(24),
+		Type: eventType,
+		Time: time.Now(),
+	}
+}
+
+// SetRemoteAddr sets the provided remote address of the accociated Event
+// together with its country and autonomous system information looked up with
+// the provided GeoIP, which can be nil.
+func (e *Event) SetRemoteAddr(remoteAddr string, g *geoip.GeoIP) {
+	e.RemoteAddr = remoteAddr
+	if location := g.Lookup(remoteAddr); location != nil {
+		e.GeoCountry = location.Country
+		e.GeoASN = location.ASN
+		e.GeoASOrg = location.ASOrg
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Webhook request headers.
+const (
+	WebhookHeaderEventType = "X-Konnect-Event-Type"
+	WebhookHeaderSignature = "X-Konnect-Signature"
+)
+
+// webhookSignaturePrefix is the prefix of the hex encoded HMAC-SHA256
+// signature value of webhook requests.
+const webhookSignaturePrefix = "sha256="
+
+// Delivery settings.
+const (
+	webhookQueueSize      = 1024
+	webhookMaxAttempts    = 5
+	webhookTimeout        = 10 * time.Second
+	webhookRetryDelay     = time.Second
+	webhookMaxRetryDelay  = 30 * time.Second
+	webhookShutdownPeriod = 10 * time.Second
+)
+
+// Webhook delivery results recorded in metrics.
+const (
+	webhookResultSent    = "sent"
+	webhookResultFailed  = "failed"
+	webhookResultDropped = "dropped"
+)
+
+var webhookEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "konnect",
+		Subsystem: "audit",
+		Name:      "webhook_events_total",
+		Help:      "Number of audit events handled by the webhook, by result (sent, failed or dropped when the queue is full).",
+	},
+	[]string{"result"},
+)
+
+// RegisterMetrics registers the audit metrics with the provided prometheus
+// registerer. It is safe to call multiple times with the same registerer.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	if err := registerer.Register(webhookEvents); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A Webhook posts audit events as JSON to a HTTP endpoint. Each request body
+// is signed with HMAC-SHA256 using the configured secret, the hex encoded
+// signature is sent with sha256= prefix in the X-Konnect-Signature header.
+// Events are queued and delivered in the background with retries, so
+// emitting never blocks. Events are dropped when the queue is full. All
+// methods are safe to be called on a nil Webhook, which sends nothing.
+type Webhook struct {
+	endpoint string
+	secret   []byte
+
+	client *http.Client
+	queue  chan *Event
+
+	retryDelay time.Duration
+
+	logger logrus.FieldLogger
+}
+
+// NewWebhook creates a new Webhook which posts audit events to the provided
+// endpoint URL, signed with the provided secret. The provided client is used
+// for requests, if nil a default client is used.
+func NewWebhook(endpoint string, secret []byte, client *http.Client, logger logrus.FieldLogger) (*Webhook, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint, must be a http or https URL: %v", endpoint)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret must not be empty")
+	}
+	if client == nil {
+		client = &http.Client{
+			Timeout: webhookTimeout,
+		}
+	}
+
+	return &Webhook{
+		endpoint: u.String(),
+		secret:   secret,
+
+		client: client,
+		queue:  make(chan *Event, webhookQueueSize),
+
+		retryDelay: webhookRetryDelay,
+
+		logger: logger,
+	}, nil
+}
+
+// Emit queues the provided event for delivery. Events are dropped if the
+// queue is full, to never block the caller.
+func (w *Webhook) Emit(event *Event) {
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		webhookEvents.WithLabelValues(webhookResultDropped).Inc()
+		w.logger.WithField("type", event.Type).Debugln("audit webhook queue full, event dropped")
+	}
+}
+
+// Run delivers queued events until the provided context is done, then tries
+// to deliver the remaining events once each and returns.
+func (w *Webhook) Run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), webhookShutdownPeriod)
+			defer cancel()
+			for {
+				select {
+				case event := <-w.queue:
+					w.deliver(shutdownCtx, event, 1)
+				default:
+					return
+				}
+			}
+		case event := <-w.queue:
+			w.deliver(ctx, event, webhookMaxAttempts)
+		}
+	}
+}
+
+// deliver sends the provided event, retrying with exponential backoff up to
+// the provided number of attempts.
+func (w *Webhook) deliver(ctx context.Context, event *Event, attempts int) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		webhookEvents.WithLabelValues(webhookResultFailed).Inc()
+		w.logger.WithError(err).Errorln("failed to encode audit event")
+		return
+	}
+
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, sendErr := w.send(ctx, event.Type, body)
+		if sendErr == nil {
+			webhookEvents.WithLabelValues(webhookResultSent).Inc()
+			return
+		}
+		if retry && attempt < attempts {
+			select {
+			case <-ctx.Done():
+				// NOTE: Stop retrying when shutting down.
+			case <-time.After(delay):
+				delay *= 2
+				if delay > webhookMaxRetryDelay {
+					delay = webhookMaxRetryDelay
+				}
+				continue
+			}
+		}
+
+		webhookEvents.WithLabelValues(webhookResultFailed).Inc()
+		w.logger.WithError(sendErr).WithFields(logrus.Fields{
+			"type":     event.Type,
+			"attempts": attempt,
+		}).Warnln("failed to send audit event to webhook")
+		return
+	}
+}
+
+// send posts the provided body to the accociated endpoint. It returns true if
+// a failed request should be retried.
+func (w *Webhook) send(ctx context.Context, eventType string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEventType, eventType)
+	req.Header.Set(WebhookHeaderSignature, webhookSignaturePrefix+Sign(w.secret, body))
+
+	response, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", response.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the provided body with the
+// provided secret, as sent with webhook requests.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewWebhook(t *testing.T) {
+	for _, test := range []struct {
+		endpoint string
+		secret   []byte
+		ok       bool
+	}{
+		{"https://siem.example.com/events", []byte("secret"), true},
+		{"http://127.0.0.1:8080", []byte("secret"), true},
+		{"https://siem.example.com/events", nil, false},
+		{"ftp://siem.example.com/events", []byte("secret"), false},
+		{"/events", []byte("secret"), false},
+	} {
+		_, err := NewWebhook(test.endpoint, test.secret, nil, logrus.New())
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("NewWebhook(%#v) error %v, expected ok %v", test.endpoint, err, test.ok)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	secret := []byte("unittest-secret")
+
+	var requests int32
+	received := make(chan *Event, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// NOTE: Fail the first request, to check retries.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("failed to read request: %v", err)
+		}
+		if signature := req.Header.Get(WebhookHeaderSignature); signature != webhookSignaturePrefix+Sign(secret, body) {
+			t.Errorf("wrong signature: %v", signature)
+		}
+		if eventType := req.Header.Get(WebhookHeaderEventType); eventType != EventTypeTokenIssued {
+			t.Errorf("wrong event type header: %v", eventType)
+		}
+		event := &Event{}
+		if err = json.Unmarshal(body, event); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	webhook, err := NewWebhook(receiver.URL, secret, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook.retryDelay = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go webhook.Run(ctx)
+
+	event := NewEvent(EventTypeTokenIssued)
+	event.ClientID = "unittest-client"
+	event.Tokens = []string{TokenAccessToken, TokenIDToken}
+	webhook.Emit(event)
+
+	select {
+	case delivered := <-received:
+		if delivered.ID != event.ID || delivered.ClientID != event.ClientID || len(delivered.Tokens) != 2 {
+			t.Errorf("wrong event delivered: %#v", delivered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("wrong number of requests: got %d want 2", n)
+	}
+}
+
+func TestWebhookEmitNeverBlocks(t *testing.T) {
+	webhook, err := NewWebhook("http://127.0.0.1:1", []byte("secret"), nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: The webhook is not running, so the queue fills up.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < webhookQueueSize+10; i++ {
+			webhook.Emit(NewEvent(EventTypeLogout))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit blocked with full queue")
+	}
+	if n := len(webhook.queue); n != webhookQueueSize {
+		t.Errorf("wrong queue length: got %d want %d", n, webhookQueueSize)
+	}
+
+	var nilWebhook *Webhook
+	nilWebhook.Emit(NewEvent(EventTypeLogout))
+}
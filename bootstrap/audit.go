@@ -0,0 +1,217 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package bootstrap
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identifier"
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+)
+
+// Security warning severities, ordered from most to least severe.
+const (
+	securitySeverityHigh   = "high"
+	securitySeverityMedium = "medium"
+	securitySeverityLow    = "low"
+)
+
+var securitySeverityRanks = map[string]int{
+	securitySeverityHigh:   0,
+	securitySeverityMedium: 1,
+	securitySeverityLow:    2,
+}
+
+// minimumRSAKeyBits is the RSA key size below which keys are reported as
+// insecure.
+const minimumRSAKeyBits = 2048
+
+var securityWarningsGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "konnect",
+		Subsystem: "config",
+		Name:      "security_warnings",
+		Help:      "Number of security warnings found in the effective configuration at startup.",
+	},
+	[]string{"severity"},
+)
+
+// securityWarning is a finding of the configuration audit.
+type securityWarning struct {
+	Severity string
+	Check    string
+	Message  string
+
+	Fields logrus.Fields
+}
+
+// audit inspects the effective configuration of the accociated bootstrap and
+// returns the found security warnings ranked by severity.
+func (bs *Bootstrap) audit(ctx context.Context) []*securityWarning {
+	var warnings []*securityWarning
+	add := func(severity, check, message string, fields logrus.Fields) {
+		warnings = append(warnings, &securityWarning{
+			Severity: severity,
+			Check:    check,
+			Message:  message,
+			Fields:   fields,
+		})
+	}
+
+	if bs.tlsInsecureSkipVerify {
+		add(securitySeverityHigh, "insecure", "TLS verification is disabled for ALL outbound connections including all authorities, which are thus susceptible to man-in-the-middle attacks - never use this in production, mark single authorities as insecure instead", nil)
+	}
+	if bs.cfg.AllowDynamicClientRegistration && bs.registrationInitialAccessToken == "" && len(bs.registrationInitialAccessTokenKeys) == 0 {
+		add(securitySeverityHigh, "open-dynamic-client-registration", "dynamic client registration is open to everyone, use --registration-initial-access-token or --registration-initial-access-token-jwks to restrict it", nil)
+	}
+	for id, signer := range bs.signers {
+		if bits, ok := rsaKeyBits(signer.Public()); ok && bits < minimumRSAKeyBits {
+			add(securitySeverityHigh, "small-rsa-signing-key", fmt.Sprintf("RSA signing key is smaller than %d bits", minimumRSAKeyBits), logrus.Fields{
+				"kid":  id,
+				"bits": bits,
+			})
+		}
+	}
+	for id, publicKey := range bs.validators {
+		if bits, ok := rsaKeyBits(publicKey); ok && bits < minimumRSAKeyBits {
+			add(securitySeverityMedium, "small-rsa-validation-key", fmt.Sprintf("RSA validation key is smaller than %d bits", minimumRSAKeyBits), logrus.Fields{
+				"kid":  id,
+				"bits": bits,
+			})
+		}
+	}
+	keyFiles := make([]string, 0, len(bs.insecureKeyFiles))
+	for fn := range bs.insecureKeyFiles {
+		keyFiles = append(keyFiles, fn)
+	}
+	sort.Strings(keyFiles)
+	for _, fn := range keyFiles {
+		add(securitySeverityHigh, "insecure-key-file-permissions", fmt.Sprintf("key or secret file is not protected well enough (%s), restrict its ownership and permissions", bs.insecureKeyFiles[fn]), logrus.Fields{
+			"path": fn,
+		})
+	}
+	if bs.cfg.CookieInsecure {
+		add(securitySeverityMedium, "insecure-cookies", "insecure cookies are enabled, cookies are sent over unencrypted connections", nil)
+	}
+	if bs.issuerIdentifierURI != nil && bs.issuerIdentifierURI.Scheme == "https" {
+		// NOTE: konnectd serves plain HTTP only, so https issuers require a TLS
+		// terminating proxy which forwards the original request scheme.
+		fields := logrus.Fields{
+			"iss":    bs.issuerIdentifierURI.String(),
+			"listen": bs.cfg.ListenAddrs,
+		}
+		if len(bs.cfg.TrustedProxyIPs) == 0 && len(bs.cfg.TrustedProxyNets) == 0 {
+			add(securitySeverityMedium, "issuer-scheme-mismatch", "issuer identifier uses https but konnectd listens with plain HTTP and no --trusted-proxy is configured, make sure a TLS terminating proxy is in front of konnectd and add it with --trusted-proxy so the scheme of the original request is known", fields)
+		} else if bs.cfg.TrustedProxyProtoHeader == "" {
+			add(securitySeverityMedium, "issuer-scheme-mismatch", "issuer identifier uses https but konnectd listens with plain HTTP and --trusted-proxy-proto-header is empty, the scheme of requests forwarded by trusted proxies is unknown", fields)
+		}
+	}
+	if bs.encryptionSecretRandom {
+		add(securitySeverityMedium, "random-encryption-secret", "missing --encryption-secret parameter, using random encryption secret which changes on every restart", nil)
+	}
+	if bs.signingKeyRandom {
+		add(securitySeverityMedium, "random-signing-key", "missing --signing-private-key parameter, using random signing key which changes on every restart", nil)
+	}
+	if bs.authorityFallback == identifier.AuthorityFallbackLocal {
+		add(securitySeverityLow, "authority-fallback", "local sign-in is used when the default authority is unavailable, bypassing the authentication enforced by the authority", nil)
+	}
+	if bs.allowClaimsPreview {
+		add(securitySeverityLow, "claims-preview", "claims preview admin endpoint is enabled, do not use in production", nil)
+	}
+
+	if authorities, ok := bs.managers.Get("authorities"); ok {
+		registry := authorities.(*identityAuthorities.Registry)
+		for _, snapshot := range registry.Snapshot(ctx).Authorities {
+			authority, found := registry.Get(ctx, snapshot.ID)
+			if !found {
+				continue
+			}
+			if authority.Insecure {
+				add(securitySeverityMedium, "insecure-authority", "TLS verification is disabled for connections to authority", logrus.Fields{
+					"authority_id": authority.ID,
+				})
+			}
+			if authority.CodeChallengeMethod == oidc.PlainCodeChallengeMethod {
+				add(securitySeverityMedium, "plain-pkce-authority", "authority uses plain PKCE code challenge method, use S256 instead", logrus.Fields{
+					"authority_id": authority.ID,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return securitySeverityRanks[warnings[i].Severity] < securitySeverityRanks[warnings[j].Severity]
+	})
+
+	return warnings
+}
+
+// reportSecurityWarnings logs the provided security warnings as a security
+// report and updates the security warnings metric if metrics are enabled.
+func (bs *Bootstrap) reportSecurityWarnings(warnings []*securityWarning) error {
+	logger := bs.cfg.Logger
+
+	if bs.cfg.WithMetrics {
+		if err := bs.cfg.Registerer().Register(securityWarningsGauge); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return fmt.Errorf("failed to register security warnings metrics: %v", err)
+			}
+		}
+		counts := make(map[string]int)
+		for _, warning := range warnings {
+			counts[warning.Severity]++
+		}
+		for severity := range securitySeverityRanks {
+			securityWarningsGauge.WithLabelValues(severity).Set(float64(counts[severity]))
+		}
+	}
+
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	logger.WithField("count", len(warnings)).Warnln("security report: configuration is not suitable for production")
+	for idx, warning := range warnings {
+		fields := logrus.Fields{
+			"rank":     idx + 1,
+			"severity": warning.Severity,
+			"check":    warning.Check,
+		}
+		for k, v := range warning.Fields {
+			fields[k] = v
+		}
+		logger.WithFields(fields).Warnln(warning.Message)
+	}
+
+	return nil
+}
+
+func rsaKeyBits(publicKey crypto.PublicKey) (int, bool) {
+	if rsaPublicKey, ok := publicKey.(*rsa.PublicKey); ok {
+		return rsaPublicKey.N.BitLen(), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identifier"
+	"stash.kopano.io/kc/konnect/managers"
+)
+
+func TestBootstrapAudit(t *testing.T) {
+	smallRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsIssuer, _ := url.Parse("https://konnect.example.com")
+	httpIssuer, _ := url.Parse("http://konnect.example.com")
+	trustedProxyIP := net.ParseIP("192.0.2.1")
+
+	for _, test := range []struct {
+		name     string
+		setup    func(bs *Bootstrap)
+		expected []string
+	}{
+		{"secure", func(bs *Bootstrap) {
+			bs.signers = map[string]crypto.Signer{"ec": ecdsaKey}
+		}, nil},
+		{"plain issuer", func(bs *Bootstrap) {
+			bs.issuerIdentifierURI = httpIssuer
+		}, nil},
+		{"insecure", func(bs *Bootstrap) {
+			bs.tlsInsecureSkipVerify = true
+		}, []string{"insecure"}},
+		{"open dynamic client registration", func(bs *Bootstrap) {
+			bs.cfg.AllowDynamicClientRegistration = true
+		}, []string{"open-dynamic-client-registration"}},
+		{"restricted dynamic client registration", func(bs *Bootstrap) {
+			bs.cfg.AllowDynamicClientRegistration = true
+			bs.registrationInitialAccessToken = "unittest-token"
+		}, nil},
+		{"small rsa keys", func(bs *Bootstrap) {
+			bs.signers = map[string]crypto.Signer{"rsa": smallRSAKey}
+			bs.validators = map[string]crypto.PublicKey{"rsa": smallRSAKey.Public(), "ec": ecdsaKey.Public()}
+		}, []string{"small-rsa-signing-key", "small-rsa-validation-key"}},
+		{"insecure key files", func(bs *Bootstrap) {
+			bs.insecureKeyFiles = map[string]string{"/b.pem": "mode", "/a.pem": "owner"}
+		}, []string{"insecure-key-file-permissions", "insecure-key-file-permissions"}},
+		{"https issuer without trusted proxy", func(bs *Bootstrap) {
+			bs.issuerIdentifierURI = httpsIssuer
+		}, []string{"issuer-scheme-mismatch"}},
+		{"https issuer without proto header", func(bs *Bootstrap) {
+			bs.issuerIdentifierURI = httpsIssuer
+			bs.cfg.TrustedProxyIPs = []*net.IP{&trustedProxyIP}
+		}, []string{"issuer-scheme-mismatch"}},
+		{"https issuer with trusted proxy", func(bs *Bootstrap) {
+			bs.issuerIdentifierURI = httpsIssuer
+			bs.cfg.TrustedProxyIPs = []*net.IP{&trustedProxyIP}
+			bs.cfg.TrustedProxyProtoHeader = "X-Forwarded-Proto"
+		}, nil},
+		{"ranked by severity", func(bs *Bootstrap) {
+			bs.allowClaimsPreview = true
+			bs.authorityFallback = identifier.AuthorityFallbackLocal
+			bs.signingKeyRandom = true
+			bs.encryptionSecretRandom = true
+			bs.cfg.CookieInsecure = true
+			bs.tlsInsecureSkipVerify = true
+		}, []string{"insecure", "insecure-cookies", "random-encryption-secret", "random-signing-key", "authority-fallback", "claims-preview"}},
+	} {
+		bs := &Bootstrap{
+			cfg: &config.Config{
+				Logger: logrus.New(),
+			},
+			managers: managers.New(),
+		}
+		test.setup(bs)
+
+		var checks []string
+		for _, warning := range bs.audit(context.Background()) {
+			checks = append(checks, warning.Check)
+		}
+		if !reflect.DeepEqual(checks, test.expected) {
+			t.Errorf("%s: got security warnings %v want %v", test.name, checks, test.expected)
+		}
+	}
+}
@@ -0,0 +1,1478 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package bootstrap sets up konnect with the settings of the flags of the
+// konnectd serve command, so konnect can also be started in process.
+package bootstrap
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect/audit"
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/encryption"
+	"stash.kopano.io/kc/konnect/geoip"
+	"stash.kopano.io/kc/konnect/identifier"
+	"stash.kopano.io/kc/konnect/identifier/backends"
+	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
+	"stash.kopano.io/kc/konnect/identity"
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+	"stash.kopano.io/kc/konnect/managers"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	oidcProvider "stash.kopano.io/kc/konnect/oidc/provider"
+	"stash.kopano.io/kc/konnect/server"
+	"stash.kopano.io/kc/konnect/tracing"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Identity managers.
+const (
+	identityManagerNameCookie = "cookie"
+	identityManagerNameDummy  = "dummy"
+	identityManagerNameKC     = "kc"
+	identityManagerNameLDAP   = "ldap"
+)
+
+// API types.
+const (
+	apiTypeKonnect = "konnect"
+	apiTypeSignin  = "signin"
+)
+
+// Bootstrap is a data structure to hold configuration required to start
+// konnectd.
+type Bootstrap struct {
+	flags *pflag.FlagSet
+	args  []string
+
+	signInFormURI            *url.URL
+	signedOutURI             *url.URL
+	authorizationEndpointURI *url.URL
+	endSessionEndpointURI    *url.URL
+
+	discoveryClaimsSupported     []string
+	discoveryGrantTypesSupported []string
+	discoveryACRValuesSupported  []string
+	allowOpaqueACRValues         bool
+
+	clientAssertionSigningAlgs []string
+
+	registrationInitialAccessToken     string
+	registrationInitialAccessTokenKeys map[string]crypto.PublicKey
+
+	tlsClientConfig       *tls.Config
+	tlsInsecureSkipVerify bool
+
+	issuerIdentifierURI        *url.URL
+	identifierClientPath       string
+	identifierStaticMaxAge     time.Duration
+	identifierStaticCompress   bool
+	identifierRegistrationConf string
+	identifierAuthoritiesConf  string
+	identifierScopesConf       string
+
+	clientsMax int
+
+	profileClaimsMapping map[string]string
+	subjectAttribute     string
+
+	scopeClaimsResolver identity.ScopeClaimsResolver
+
+	acrPolicies identity.ACRPolicies
+
+	additionalIssuerIdentifiers []string
+
+	errorURIBase string
+
+	clientErrorLogLimit int
+
+	templatesPath string
+
+	webFingerResources []string
+	faviconPath        string
+	securityTxtPath    string
+
+	encryptionSecret []byte
+	signingMethod    jwt.SigningMethod
+	signingKeyBits   int
+	signingKeyID     string
+	signers          map[string]crypto.Signer
+	validators       map[string]crypto.PublicKey
+	keyIDs           map[string]*keyIDRecord
+
+	insecureKeyFiles map[string]string
+
+	activeSigningKeyID string
+
+	signingKeyNotAfter      map[string]time.Time
+	signingKeyExpiryWarning time.Duration
+	failOnExpiredSigningKey bool
+
+	encryptionSecretRandom bool
+	signingKeyRandom       bool
+
+	pkcs11ModulePath string
+	pkcs11PIN        string
+
+	accessTokenDurationSeconds uint64
+	uriBasePath                string
+	wellKnownRoot              bool
+
+	adminToken         string
+	allowClaimsPreview bool
+
+	codeMaxRecords int
+	codeDuration   time.Duration
+
+	requestLimits *payload.RequestLimits
+
+	refreshTokenRotation   string
+	refreshTokenReuseGrace time.Duration
+	refreshTokenStore      string
+	refreshTokenStorePath  string
+
+	revokedTokensStore     string
+	revokedTokensStorePath string
+	accessTokenType        string
+
+	tokenBinding *identityClients.TokenBinding
+
+	unknownScopeBehavior string
+
+	claimsInIDToken   string
+	claimsPlacement   map[string]string
+	accessTokenClaims map[string][]string
+
+	userInfoRequireAudience bool
+
+	allowEndSessionWithoutIDTokenHint bool
+
+	allowRequestURI bool
+
+	registeredClientsOnly bool
+
+	clockSkew time.Duration
+
+	sessionMaxLifetime time.Duration
+	sessionIdleTimeout time.Duration
+
+	authorityFallback         string
+	authorityFallbackDuration time.Duration
+	authorityChooser          bool
+
+	identifierBackendTimeout          time.Duration
+	identifierBackendRetries          int
+	identifierBackendBreakerThreshold int
+	identifierBackendBreakerDuration  time.Duration
+	identifierAmbiguousUserPolicy     string
+
+	identifierCredentialPolicy *backends.CredentialPolicy
+	identifierConsentStore     identifier.ConsentStore
+
+	authoritiesStrictDefault       bool
+	authoritiesStore               string
+	authoritiesMax                 int
+	authoritiesDiscoverSync        bool
+	authoritiesDiscoverSyncTimeout time.Duration
+
+	disallowPlainPKCE bool
+
+	authorityDiscoveryMaxStale time.Duration
+
+	failOnInsecure bool
+
+	authorityHTTPClientConfig *utils.HTTPClientConfig
+	authorityCAData           []byte
+
+	cfg      *config.Config
+	managers *managers.Managers
+}
+
+// New creates a Bootstrap which reads its settings from the provided flags,
+// which must have been added with AddFlags. The first of the provided args
+// names the identity manager, the others are passed to it. The provided
+// config must have a logger.
+func New(flags *pflag.FlagSet, args []string, cfg *config.Config) *Bootstrap {
+	return &Bootstrap{
+		flags: flags,
+		args:  args,
+
+		cfg: cfg,
+	}
+}
+
+// Boot initializes the accociated Bootstrap from its flags, sets up the
+// managers and checks the configuration for security warnings and expired
+// signing keys. Background tasks run until the provided context is done.
+func (bs *Bootstrap) Boot(ctx context.Context) error {
+	err := bs.initialize()
+	if err != nil {
+		return err
+	}
+	go bs.cfg.Tracer.Run(ctx)
+	go bs.cfg.AuditWebhook.Run(ctx)
+	err = bs.setup(ctx)
+	if err != nil {
+		return err
+	}
+	securityWarnings := bs.audit(ctx)
+	err = bs.reportSecurityWarnings(securityWarnings)
+	if err != nil {
+		return err
+	}
+	if bs.failOnInsecure && len(securityWarnings) > 0 {
+		return fmt.Errorf("refusing to start with %d security warnings, since --fail-on-insecure is set", len(securityWarnings))
+	}
+
+	return bs.runSigningKeyExpiryCheck(ctx)
+}
+
+// InitializeKeys only initializes the signing and validation keys of the
+// accociated Bootstrap from its flags, without generating a random signing
+// key.
+func (bs *Bootstrap) InitializeKeys() error {
+	return bs.initializeKeys(false)
+}
+
+// Config returns the config of the accociated Bootstrap.
+func (bs *Bootstrap) Config() *config.Config {
+	return bs.cfg
+}
+
+// Managers returns the managers of the accociated Bootstrap, which are set
+// up by Boot.
+func (bs *Bootstrap) Managers() *managers.Managers {
+	return bs.managers
+}
+
+// IssuerIdentifierURI returns the issuer identifier of the accociated
+// Bootstrap.
+func (bs *Bootstrap) IssuerIdentifierURI() *url.URL {
+	return bs.issuerIdentifierURI
+}
+
+// SigningMethod returns the default signing method of the accociated
+// Bootstrap.
+func (bs *Bootstrap) SigningMethod() jwt.SigningMethod {
+	return bs.signingMethod
+}
+
+// ActiveSigningKeyID returns the kid of the signing key which signs by
+// default.
+func (bs *Bootstrap) ActiveSigningKeyID() string {
+	return bs.activeSigningKeyID
+}
+
+// PublicKeys returns the public keys of the signing and validation keys of
+// the accociated Bootstrap by kid, the same way as they are published with
+// the JWKS.
+func (bs *Bootstrap) PublicKeys() map[string]crypto.PublicKey {
+	publicKeys := make(map[string]crypto.PublicKey)
+	for kid, signer := range bs.signers {
+		publicKeys[kid] = signer.Public()
+	}
+	for kid, publicKey := range bs.validators {
+		publicKeys[kid] = publicKey
+	}
+	if signer, ok := bs.signers[bs.activeSigningKeyID]; ok {
+		publicKeys[defaultSigningKeyID] = signer.Public()
+	}
+
+	return publicKeys
+}
+
+func init() {
+	// NOTE(longsleep): Ensure to use same salt length as the hash size.
+	// See https://www.ietf.org/mail-archive/web/jose/current/msg02901.html for
+	// reference and https://github.com/dgrijalva/jwt-go/issues/285 for
+	// the issue in upstream jwt-go.
+	for _, alg := range []string{jwt.SigningMethodPS256.Name, jwt.SigningMethodPS384.Name, jwt.SigningMethodPS512.Name} {
+		sm := jwt.GetSigningMethod(alg)
+		if signingMethodRSAPSS, ok := sm.(*jwt.SigningMethodRSAPSS); ok {
+			signingMethodRSAPSS.Options.SaltLength = rsa.PSSSaltLengthEqualsHash
+		}
+	}
+}
+
+// initialize, parsed parameters from commandline with validation and adds them
+// to the accociated bootstrap data.
+func (bs *Bootstrap) initialize() error {
+	flags := bs.flags
+	logger := bs.cfg.Logger
+	var err error
+
+	if len(bs.args) == 0 {
+		return fmt.Errorf("identity-manager argument missing, use one of %s", strings.Join(append([]string{identityManagerNameKC, identityManagerNameLDAP, identityManagerNameCookie, identityManagerNameDummy}, identity.ManagerFactoryNames()...), ", "))
+	}
+
+	issuerIdentifier, _ := flags.GetString("iss")
+	bs.issuerIdentifierURI, err = url.Parse(issuerIdentifier)
+	if err != nil {
+		return fmt.Errorf("invalid iss value, iss is not a valid URL), %v", err)
+	} else if issuerIdentifier == "" {
+		return fmt.Errorf("missing iss value, did you provide the --iss parameter?")
+	} else if bs.issuerIdentifierURI.Scheme != "https" {
+		return fmt.Errorf("invalid iss value, URL must start with https://")
+	} else if bs.issuerIdentifierURI.Host == "" {
+		return fmt.Errorf("invalid iss value, URL must have a host")
+	}
+
+	additionalIssuerIdentifiers, _ := flags.GetStringArray("additional-iss")
+	for _, additionalIssuerIdentifier := range additionalIssuerIdentifiers {
+		additionalIssuerIdentifierURI, parseErr := url.Parse(additionalIssuerIdentifier)
+		if parseErr != nil || additionalIssuerIdentifierURI.Scheme != "https" || additionalIssuerIdentifierURI.Host == "" {
+			return fmt.Errorf("invalid additional-iss value %v, must be a https URL with host", additionalIssuerIdentifier)
+		}
+		if additionalIssuerIdentifierURI.String() == bs.issuerIdentifierURI.String() {
+			continue
+		}
+		bs.additionalIssuerIdentifiers = append(bs.additionalIssuerIdentifiers, additionalIssuerIdentifierURI.String())
+	}
+	if len(bs.additionalIssuerIdentifiers) > 0 {
+		logger.WithField("additional_iss", bs.additionalIssuerIdentifiers).Warnln("accepting tokens of additional issuers")
+	}
+
+	bs.errorURIBase, _ = flags.GetString("error-uri-base")
+	if bs.errorURIBase != "" {
+		if errorURIBase, parseErr := url.Parse(bs.errorURIBase); parseErr != nil || !errorURIBase.IsAbs() {
+			return fmt.Errorf("invalid error-uri-base value %v, must be an absolute URL", bs.errorURIBase)
+		}
+	}
+
+	bs.clientErrorLogLimit, _ = flags.GetInt("log-client-errors-per-minute")
+	if bs.clientErrorLogLimit < 0 {
+		return fmt.Errorf("invalid log-client-errors-per-minute value: %d", bs.clientErrorLogLimit)
+	}
+
+	bs.templatesPath, _ = flags.GetString("templates-path")
+	if bs.templatesPath != "" {
+		bs.templatesPath, _ = filepath.Abs(bs.templatesPath)
+		if fi, errStat := os.Stat(bs.templatesPath); errStat != nil || !fi.IsDir() {
+			return fmt.Errorf("templates-path directory not found or unable to access: %v", bs.templatesPath)
+		}
+	}
+
+	bs.webFingerResources, _ = flags.GetStringArray("webfinger-resource")
+	bs.faviconPath, _ = flags.GetString("favicon")
+	bs.securityTxtPath, _ = flags.GetString("security-txt")
+
+	bs.uriBasePath, _ = flags.GetString("uri-base-path")
+	bs.wellKnownRoot, _ = flags.GetBool("well-known-root")
+
+	signInFormURIString, _ := flags.GetString("sign-in-uri")
+	bs.signInFormURI, err = url.Parse(signInFormURIString)
+	if err != nil {
+		return fmt.Errorf("invalid sign-in URI, %v", err)
+	}
+
+	signedOutURIString, _ := flags.GetString("signed-out-uri")
+	bs.signedOutURI, err = url.Parse(signedOutURIString)
+	if err != nil {
+		return fmt.Errorf("invalid signed-out URI, %v", err)
+	}
+
+	authorizationEndpointURIString, _ := flags.GetString("authorization-endpoint-uri")
+	bs.authorizationEndpointURI, err = url.Parse(authorizationEndpointURIString)
+	if err != nil {
+		return fmt.Errorf("invalid authorization-endpoint-uri, %v", err)
+	}
+
+	endSessionEndpointURIString, _ := flags.GetString("endsession-endpoint-uri")
+	bs.endSessionEndpointURI, err = url.Parse(endSessionEndpointURIString)
+	if err != nil {
+		return fmt.Errorf("invalid endsession-endpoint-uri, %v", err)
+	}
+
+	bs.discoveryClaimsSupported, _ = flags.GetStringArray("discovery-claims-supported")
+	bs.discoveryGrantTypesSupported, _ = flags.GetStringArray("discovery-grant-types-supported")
+	bs.discoveryACRValuesSupported, _ = flags.GetStringArray("discovery-acr-values-supported")
+	bs.allowOpaqueACRValues, _ = flags.GetBool("allow-opaque-acr-values")
+
+	bs.clientAssertionSigningAlgs, _ = flags.GetStringArray("client-assertion-signing-alg")
+
+	bs.tlsInsecureSkipVerify, _ = flags.GetBool("insecure")
+	if bs.tlsInsecureSkipVerify {
+		// NOTE(longsleep): This disable http2 client support. See https://github.com/golang/go/issues/14275 for reasons.
+		bs.tlsClientConfig = utils.InsecureSkipVerifyTLSConfig()
+	} else {
+		bs.tlsClientConfig = utils.DefaultTLSConfig()
+	}
+
+	authorityCA, _ := flags.GetString("authority-ca")
+	if authorityCA != "" {
+		authorityCAData, readErr := utils.ReadCertificatesPEM(authorityCA)
+		if readErr != nil {
+			return fmt.Errorf("invalid authority-ca value: %v", readErr)
+		}
+		if _, poolErr := utils.NewCertPoolFromPEM(authorityCAData); poolErr != nil {
+			return fmt.Errorf("invalid authority-ca value: %v", poolErr)
+		}
+		bs.authorityCAData = authorityCAData
+		logger.WithField("source", utils.SecretSource(authorityCA, utils.SecretSchemeFile)).Infoln("using custom CA for authority connections")
+	}
+
+	trustedProxies, _ := flags.GetStringArray("trusted-proxy")
+	for _, trustedProxy := range trustedProxies {
+		if ip := net.ParseIP(trustedProxy); ip != nil {
+			bs.cfg.TrustedProxyIPs = append(bs.cfg.TrustedProxyIPs, &ip)
+			continue
+		}
+		if _, ipNet, errParseCIDR := net.ParseCIDR(trustedProxy); errParseCIDR == nil {
+			bs.cfg.TrustedProxyNets = append(bs.cfg.TrustedProxyNets, ipNet)
+			continue
+		}
+	}
+	if len(bs.cfg.TrustedProxyIPs) > 0 {
+		logger.Infoln("trusted proxy IPs", bs.cfg.TrustedProxyIPs)
+	}
+	if len(bs.cfg.TrustedProxyNets) > 0 {
+		logger.Infoln("trusted proxy networks", bs.cfg.TrustedProxyNets)
+	}
+	bs.cfg.TrustedProxyClientIPHeader, _ = flags.GetString("trusted-proxy-client-ip-header")
+	bs.cfg.TrustedProxyProtoHeader, _ = flags.GetString("trusted-proxy-proto-header")
+
+	bs.cfg.ClientCertificateHeader, _ = flags.GetString("client-certificate-header")
+	if bs.cfg.ClientCertificateHeader != "" {
+		if len(bs.cfg.TrustedProxyIPs) == 0 && len(bs.cfg.TrustedProxyNets) == 0 {
+			return fmt.Errorf("client-certificate-header requires a trusted-proxy")
+		}
+		logger.WithField("header", bs.cfg.ClientCertificateHeader).Infoln("client certificates from trusted proxies are enabled")
+	}
+
+	geoipDatabases, _ := flags.GetStringArray("geoip-database")
+	if len(geoipDatabases) > 0 {
+		bs.cfg.GeoIP, err = geoip.New(geoipDatabases...)
+		if err != nil {
+			return err
+		}
+		logger.WithField("types", bs.cfg.GeoIP.DatabaseTypes()).Infoln("geoip log and audit event enrichment is enabled")
+	}
+
+	otelEnabled, _ := flags.GetBool("otel-enabled")
+	if otelEnabled {
+		otelEndpoint, _ := flags.GetString("otel-endpoint")
+		if otelEndpoint == "" {
+			otelEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+		if otelEndpoint == "" {
+			otelEndpoint = defaultOTelEndpoint
+		}
+		otelSampler, _ := flags.GetString("otel-sampler")
+		if otelSampler == "" {
+			otelSampler = os.Getenv("OTEL_TRACES_SAMPLER")
+		}
+		otelSamplerArg, _ := flags.GetString("otel-sampler-arg")
+		if otelSamplerArg == "" {
+			otelSamplerArg = os.Getenv("OTEL_TRACES_SAMPLER_ARG")
+		}
+		sampler, samplerErr := tracing.NewSampler(otelSampler, otelSamplerArg)
+		if samplerErr != nil {
+			return fmt.Errorf("invalid otel-sampler value: %v", samplerErr)
+		}
+		bs.cfg.Tracer, err = tracing.NewTracer(otelEndpoint, os.Getenv("OTEL_SERVICE_NAME"), nil, sampler, logger)
+		if err != nil {
+			return fmt.Errorf("invalid otel-endpoint value: %v", err)
+		}
+		logger.WithFields(logrus.Fields{
+			"endpoint": otelEndpoint,
+			"sampler":  otelSampler,
+		}).Infoln("tracing is enabled")
+	}
+
+	auditWebhookURL, _ := flags.GetString("audit-webhook-url")
+	if auditWebhookURL != "" {
+		auditWebhookSecretFn, _ := flags.GetString("audit-webhook-secret")
+		if auditWebhookSecretFn == "" {
+			return fmt.Errorf("audit-webhook-url requires audit-webhook-secret")
+		}
+		bs.checkSecretValue(auditWebhookSecretFn)
+		auditWebhookSecret, secretErr := utils.ReadSecretString(auditWebhookSecretFn, utils.SecretSchemeFile)
+		if secretErr != nil {
+			return fmt.Errorf("failed to load audit webhook secret: %v", secretErr)
+		}
+		if auditWebhookSecret == "" {
+			return fmt.Errorf("invalid --audit-webhook-secret parameter value, secret is empty")
+		}
+		bs.cfg.AuditWebhook, err = audit.NewWebhook(auditWebhookURL, []byte(auditWebhookSecret), nil, logger)
+		if err != nil {
+			return fmt.Errorf("invalid audit-webhook-url value: %v", err)
+		}
+		if bs.cfg.WithMetrics {
+			if err = audit.RegisterMetrics(bs.cfg.Registerer()); err != nil {
+				return fmt.Errorf("failed to register audit metrics: %v", err)
+			}
+		}
+		logger.WithField("endpoint", auditWebhookURL).Infoln("audit webhook is enabled")
+	}
+
+	cookieSameSite, _ := flags.GetString("cookie-samesite")
+	bs.cfg.CookieSameSite, err = parseCookieSameSite(cookieSameSite)
+	if err != nil {
+		return err
+	}
+	cookieSecure, _ := flags.GetBool("cookie-secure")
+	bs.cfg.CookieInsecure = !cookieSecure
+	if bs.cfg.CookieInsecure {
+		if bs.cfg.CookieSameSite == http.SameSiteNoneMode {
+			return fmt.Errorf("cookie-samesite none requires cookie-secure")
+		}
+	}
+	bs.cfg.CookieDomain, _ = flags.GetString("cookie-domain")
+	bs.cfg.SessionCookiePath, _ = flags.GetString("session-cookie-path")
+	if bs.cfg.SessionCookiePath != "" && !strings.HasPrefix(bs.cfg.SessionCookiePath, "/") {
+		return fmt.Errorf("session-cookie-path must be an absolute path")
+	}
+
+	allowedScopes, _ := flags.GetStringArray("allow-scope")
+	if len(allowedScopes) > 0 {
+		bs.cfg.AllowedScopes = allowedScopes
+		logger.Infoln("using custom allowed OAuth 2 scopes", bs.cfg.AllowedScopes)
+	}
+
+	bs.cfg.AllowClientGuests, _ = flags.GetBool("allow-client-guests")
+	if bs.cfg.AllowClientGuests {
+		logger.Infoln("client controlled guests are enabled")
+	}
+
+	bs.cfg.AllowDynamicClientRegistration, _ = flags.GetBool("allow-dynamic-client-registration")
+	if bs.cfg.AllowDynamicClientRegistration {
+		logger.Infoln("dynamic client registration is enabled")
+	}
+
+	registrationInitialAccessTokenFn, _ := flags.GetString("registration-initial-access-token")
+	if registrationInitialAccessTokenFn != "" {
+		bs.registrationInitialAccessToken, err = utils.ReadSecretString(registrationInitialAccessTokenFn, utils.SecretSchemeFile)
+		if err != nil {
+			return fmt.Errorf("failed to load registration initial access token: %v", err)
+		}
+		if bs.registrationInitialAccessToken == "" {
+			return fmt.Errorf("invalid --registration-initial-access-token parameter value, token is empty")
+		}
+	}
+	registrationInitialAccessTokenJWKSFn, _ := flags.GetString("registration-initial-access-token-jwks")
+	if registrationInitialAccessTokenJWKSFn != "" {
+		bs.registrationInitialAccessTokenKeys, err = loadPublicKeysFromJWKSFile(registrationInitialAccessTokenJWKSFn)
+		if err != nil {
+			return fmt.Errorf("failed to load registration initial access token jwks: %v", err)
+		}
+	}
+	if bs.cfg.AllowDynamicClientRegistration {
+		if bs.registrationInitialAccessToken != "" || len(bs.registrationInitialAccessTokenKeys) > 0 {
+			logger.Infoln("dynamic client registration requires initial access token")
+		}
+	}
+
+	encryptionSecretFn, _ := flags.GetString("encryption-secret")
+	if encryptionSecretFn == "" {
+		encryptionSecretFn = os.Getenv("KONNECTD_ENCRYPTION_SECRET")
+	}
+	if encryptionSecretFn != "" {
+		logger.WithField("source", utils.SecretSource(encryptionSecretFn, utils.SecretSchemeFile)).Infoln("loading encryption secret")
+		bs.checkSecretValue(encryptionSecretFn)
+		bs.encryptionSecret, err = utils.ReadSecret(encryptionSecretFn, utils.SecretSchemeFile)
+		if err != nil {
+			return fmt.Errorf("failed to load encryption secret: %v", err)
+		}
+		if len(bs.encryptionSecret) == hex.EncodedLen(encryption.KeySize) {
+			// Allow hex encoded secrets, as binary values are not suitable for
+			// environment variables.
+			if decoded, decodeErr := hex.DecodeString(string(bs.encryptionSecret)); decodeErr == nil {
+				bs.encryptionSecret = decoded
+			}
+		}
+		if len(bs.encryptionSecret) != encryption.KeySize {
+			return fmt.Errorf("invalid encryption secret size - must be %d bytes", encryption.KeySize)
+		}
+	} else {
+		bs.encryptionSecret = rndm.GenerateRandomBytes(encryption.KeySize)
+		bs.encryptionSecretRandom = true
+	}
+
+	bs.codeMaxRecords, _ = flags.GetInt("authorization-code-max-records")
+	bs.codeDuration, _ = flags.GetDuration("authorization-code-duration")
+	if bs.codeMaxRecords <= 0 {
+		return fmt.Errorf("authorization-code-max-records must be positive")
+	}
+	if bs.codeDuration <= 0 {
+		return fmt.Errorf("authorization-code-duration must be positive")
+	}
+
+	bs.requestLimits = &payload.RequestLimits{}
+	bs.requestLimits.MaxScopes, _ = flags.GetInt("request-max-scopes")
+	bs.requestLimits.MaxScopeLength, _ = flags.GetInt("request-max-scope-length")
+	bs.requestLimits.MaxRequestLength, _ = flags.GetInt("request-max-request-object-length")
+	bs.requestLimits.MaxClaimsLength, _ = flags.GetInt("request-max-claims-length")
+	bs.requestLimits.MaxRedirectURILength, _ = flags.GetInt("request-max-redirect-uri-length")
+	bs.requestLimits.MaxStateLength, _ = flags.GetInt("request-max-state-length")
+	if bs.requestLimits.MaxScopes < 0 || bs.requestLimits.MaxScopeLength < 0 || bs.requestLimits.MaxRequestLength < 0 || bs.requestLimits.MaxClaimsLength < 0 || bs.requestLimits.MaxRedirectURILength < 0 || bs.requestLimits.MaxStateLength < 0 {
+		return fmt.Errorf("request limits must not be negative")
+	}
+
+	bs.authorityHTTPClientConfig = &utils.HTTPClientConfig{}
+	bs.authorityHTTPClientConfig.Timeout, _ = flags.GetDuration("authority-timeout")
+	bs.authorityHTTPClientConfig.DialTimeout, _ = flags.GetDuration("authority-dial-timeout")
+	bs.authorityHTTPClientConfig.TLSHandshakeTimeout, _ = flags.GetDuration("authority-tls-handshake-timeout")
+	bs.authorityHTTPClientConfig.ResponseHeaderTimeout, _ = flags.GetDuration("authority-response-header-timeout")
+	bs.authorityHTTPClientConfig.MaxIdleConns, _ = flags.GetInt("authority-max-idle-conns")
+	bs.authorityHTTPClientConfig.MaxIdleConnsPerHost, _ = flags.GetInt("authority-max-idle-conns-per-host")
+	bs.authorityHTTPClientConfig.IdleConnTimeout, _ = flags.GetDuration("authority-idle-conn-timeout")
+	if bs.authorityHTTPClientConfig.Timeout < 0 || bs.authorityHTTPClientConfig.DialTimeout < 0 || bs.authorityHTTPClientConfig.TLSHandshakeTimeout < 0 || bs.authorityHTTPClientConfig.ResponseHeaderTimeout < 0 || bs.authorityHTTPClientConfig.IdleConnTimeout < 0 {
+		return fmt.Errorf("authority timeouts must not be negative")
+	}
+	if bs.authorityHTTPClientConfig.MaxIdleConns < 0 || bs.authorityHTTPClientConfig.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("authority idle connection limits must not be negative")
+	}
+	if authorityHTTPProxy, _ := flags.GetString("authority-http-proxy"); authorityHTTPProxy != "" {
+		proxyURL, proxyErr := utils.ParseHTTPProxyURL(authorityHTTPProxy)
+		if proxyErr != nil {
+			return fmt.Errorf("invalid authority-http-proxy value: %v", proxyErr)
+		}
+		bs.authorityHTTPClientConfig.Proxy = proxyURL
+		logger.WithField("proxy_host", proxyURL.Host).Infoln("using proxy for authority connections")
+	}
+	if logAuthorityRequests, _ := flags.GetBool("log-authority-requests"); logAuthorityRequests {
+		bs.authorityHTTPClientConfig.RequestLogger = logger
+		bs.authorityHTTPClientConfig.RequestLogLevel = logrus.InfoLevel
+	} else if logLevel, _ := flags.GetString("log-level"); logLevel == "debug" {
+		bs.authorityHTTPClientConfig.RequestLogger = logger
+		bs.authorityHTTPClientConfig.RequestLogLevel = logrus.DebugLevel
+	}
+
+	bs.authoritiesStrictDefault, _ = flags.GetBool("authorities-strict-default")
+	bs.disallowPlainPKCE, _ = flags.GetBool("disallow-plain-pkce")
+	bs.authorityDiscoveryMaxStale, _ = flags.GetDuration("authority-discovery-max-stale")
+	if bs.authorityDiscoveryMaxStale < 0 {
+		return fmt.Errorf("invalid authority-discovery-max-stale value: %v", bs.authorityDiscoveryMaxStale)
+	}
+	bs.authoritiesDiscoverSync, _ = flags.GetBool("authorities-discover-sync")
+	bs.authoritiesDiscoverSyncTimeout, _ = flags.GetDuration("authorities-discover-sync-timeout")
+	if bs.authoritiesDiscoverSyncTimeout <= 0 {
+		return fmt.Errorf("invalid authorities-discover-sync-timeout value: %v", bs.authoritiesDiscoverSyncTimeout)
+	}
+	bs.authoritiesMax, _ = flags.GetInt("authorities-max")
+	if bs.authoritiesMax < 0 {
+		return fmt.Errorf("invalid authorities-max value: %v", bs.authoritiesMax)
+	}
+	bs.failOnInsecure, _ = flags.GetBool("fail-on-insecure")
+
+	bs.authoritiesStore, _ = flags.GetString("authorities-store")
+	if bs.authoritiesStore != "" {
+		bs.authoritiesStore, _ = filepath.Abs(bs.authoritiesStore)
+	}
+
+	bs.userInfoRequireAudience, _ = flags.GetBool("userinfo-require-audience")
+
+	bs.allowEndSessionWithoutIDTokenHint, _ = flags.GetBool("allow-endsession-without-id-token-hint")
+
+	bs.allowRequestURI, _ = flags.GetBool("allow-request-uri")
+
+	bs.registeredClientsOnly, _ = flags.GetBool("registered-clients-only")
+
+	bs.clockSkew, _ = flags.GetDuration("clock-skew")
+	if bs.clockSkew < 0 {
+		return fmt.Errorf("invalid clock-skew value: %v", bs.clockSkew)
+	}
+
+	bs.sessionMaxLifetime, _ = flags.GetDuration("session-max-lifetime")
+	if bs.sessionMaxLifetime < 0 {
+		return fmt.Errorf("invalid session-max-lifetime value: %v", bs.sessionMaxLifetime)
+	}
+	bs.sessionIdleTimeout, _ = flags.GetDuration("session-idle-timeout")
+	if bs.sessionIdleTimeout < 0 {
+		return fmt.Errorf("invalid session-idle-timeout value: %v", bs.sessionIdleTimeout)
+	}
+
+	bs.authorityFallback, _ = flags.GetString("identifier-authority-fallback")
+	if err = identifier.ValidateAuthorityFallback(bs.authorityFallback); err != nil {
+		return fmt.Errorf("invalid identifier-authority-fallback value: %v", bs.authorityFallback)
+	}
+	bs.authorityFallbackDuration, _ = flags.GetDuration("identifier-authority-fallback-duration")
+	if bs.authorityFallbackDuration < 0 {
+		return fmt.Errorf("invalid identifier-authority-fallback-duration value: %v", bs.authorityFallbackDuration)
+	}
+	bs.authorityChooser, _ = flags.GetBool("identifier-authority-chooser")
+
+	bs.identifierBackendTimeout, _ = flags.GetDuration("identifier-backend-timeout")
+	if bs.identifierBackendTimeout < 0 {
+		return fmt.Errorf("invalid identifier-backend-timeout value: %v", bs.identifierBackendTimeout)
+	}
+	bs.identifierBackendRetries, _ = flags.GetInt("identifier-backend-retries")
+	if bs.identifierBackendRetries < 0 {
+		return fmt.Errorf("invalid identifier-backend-retries value: %d", bs.identifierBackendRetries)
+	}
+	bs.identifierBackendBreakerThreshold, _ = flags.GetInt("identifier-backend-breaker-threshold")
+	if bs.identifierBackendBreakerThreshold < 0 {
+		return fmt.Errorf("invalid identifier-backend-breaker-threshold value: %d", bs.identifierBackendBreakerThreshold)
+	}
+	bs.identifierBackendBreakerDuration, _ = flags.GetDuration("identifier-backend-breaker-duration")
+	if bs.identifierBackendBreakerDuration <= 0 {
+		return fmt.Errorf("invalid identifier-backend-breaker-duration value: %v", bs.identifierBackendBreakerDuration)
+	}
+	bs.identifierAmbiguousUserPolicy, _ = flags.GetString("identifier-ambiguous-user-policy")
+	switch bs.identifierAmbiguousUserPolicy {
+	case backends.AmbiguousUserPolicyDeny:
+	case backends.AmbiguousUserPolicyFirst:
+		logger.Warnln("ambiguous usernames sign in the first matching user, make sure usernames are unique")
+	default:
+		return fmt.Errorf("invalid identifier-ambiguous-user-policy value: %v", bs.identifierAmbiguousUserPolicy)
+	}
+
+	bs.refreshTokenStore, _ = flags.GetString("refresh-token-store")
+	switch bs.refreshTokenStore {
+	case "memory":
+	case "file":
+		bs.refreshTokenStorePath, _ = flags.GetString("refresh-token-store-path")
+		if bs.refreshTokenStorePath == "" {
+			return fmt.Errorf("refresh-token-store-path is required with file refresh-token-store")
+		}
+	default:
+		return fmt.Errorf("unknown refresh-token-store value: %v", bs.refreshTokenStore)
+	}
+	bs.refreshTokenRotation, _ = flags.GetString("refresh-token-rotation")
+	switch bs.refreshTokenRotation {
+	case "":
+		// NOTE: Rotated refresh tokens are only usable as long as their
+		// family is stored, thus rotation is only on by default when the
+		// families survive restarts.
+		if bs.refreshTokenStore == "file" {
+			bs.refreshTokenRotation = oidcProvider.RefreshTokenRotationPublic
+		} else {
+			bs.refreshTokenRotation = oidcProvider.RefreshTokenRotationNone
+		}
+	case oidcProvider.RefreshTokenRotationNone:
+	case oidcProvider.RefreshTokenRotationPublic, oidcProvider.RefreshTokenRotationAll:
+		if bs.refreshTokenStore == "memory" {
+			logger.Warnln("refresh token rotation uses the memory refresh-token-store, rotated refresh tokens become invalid on restart")
+		}
+	default:
+		return fmt.Errorf("invalid refresh-token-rotation value: %v", bs.refreshTokenRotation)
+	}
+	bs.refreshTokenReuseGrace, _ = flags.GetDuration("refresh-token-reuse-grace")
+	if bs.refreshTokenReuseGrace < 0 || bs.refreshTokenReuseGrace > oidcProvider.MaxRefreshTokenReuseGrace {
+		return fmt.Errorf("invalid refresh-token-reuse-grace value: %v, must be between 0 and %v", bs.refreshTokenReuseGrace, oidcProvider.MaxRefreshTokenReuseGrace)
+	}
+
+	bs.revokedTokensStore, _ = flags.GetString("revoked-tokens-store")
+	switch bs.revokedTokensStore {
+	case "none", "memory":
+	case "file":
+		bs.revokedTokensStorePath, _ = flags.GetString("revoked-tokens-store-path")
+		if bs.revokedTokensStorePath == "" {
+			return fmt.Errorf("revoked-tokens-store-path is required with file revoked-tokens-store")
+		}
+	default:
+		return fmt.Errorf("unknown revoked-tokens-store value: %v", bs.revokedTokensStore)
+	}
+
+	bs.accessTokenType, _ = flags.GetString("access-token-type")
+	switch bs.accessTokenType {
+	case oidcProvider.AccessTokenTypeJWT, oidcProvider.AccessTokenTypeATJWT:
+	default:
+		return fmt.Errorf("invalid access-token-type value: %v", bs.accessTokenType)
+	}
+
+	tokenBindings, _ := flags.GetStringArray("token-binding")
+	if len(tokenBindings) > 0 {
+		bs.tokenBinding = &identityClients.TokenBinding{}
+		bs.tokenBinding.IPv4Prefix, _ = flags.GetInt("token-binding-ipv4-prefix")
+		bs.tokenBinding.IPv6Prefix, _ = flags.GetInt("token-binding-ipv6-prefix")
+		for _, tokenBinding := range tokenBindings {
+			switch tokenBinding {
+			case "ip":
+				bs.tokenBinding.IP = true
+			case "user-agent":
+				bs.tokenBinding.UserAgent = true
+			default:
+				return fmt.Errorf("invalid token-binding value: %v", tokenBinding)
+			}
+		}
+		if err = bs.tokenBinding.Validate(); err != nil {
+			return fmt.Errorf("invalid token-binding: %v", err)
+		}
+	}
+
+	bs.unknownScopeBehavior, _ = flags.GetString("unknown-scope-behavior")
+	switch bs.unknownScopeBehavior {
+	case oidcProvider.UnknownScopeBehaviorPassthrough, oidcProvider.UnknownScopeBehaviorIgnore, oidcProvider.UnknownScopeBehaviorError:
+	default:
+		return fmt.Errorf("invalid unknown-scope-behavior value: %v", bs.unknownScopeBehavior)
+	}
+
+	bs.claimsInIDToken, _ = flags.GetString("claims-in-id-token")
+	switch bs.claimsInIDToken {
+	case oidcProvider.ClaimsInIDTokenMinimal, oidcProvider.ClaimsInIDTokenFull:
+	default:
+		return fmt.Errorf("invalid claims-in-id-token value: %v", bs.claimsInIDToken)
+	}
+
+	bs.adminToken, _ = flags.GetString("admin-token")
+	if bs.adminToken == "" {
+		bs.adminToken = os.Getenv("KONNECTD_ADMIN_TOKEN")
+	}
+	if bs.adminToken != "" {
+		logger.Infoln("admin endpoints are enabled")
+	}
+	bs.allowClaimsPreview, _ = flags.GetBool("allow-claims-preview")
+	if bs.allowClaimsPreview {
+		if bs.adminToken == "" {
+			return fmt.Errorf("allow-claims-preview requires admin-token")
+		}
+	}
+
+	bs.cfg.ListenAddrs, _ = flags.GetStringArray("listen")
+	if len(bs.cfg.ListenAddrs) == 0 {
+		bs.cfg.ListenAddrs = strings.Fields(os.Getenv("KONNECTD_LISTEN"))
+	}
+	if len(bs.cfg.ListenAddrs) == 0 {
+		// NOTE: Use the sockets passed by systemd socket activation if any,
+		// and bind to the default address otherwise.
+		bs.cfg.ListenAddrs = server.SystemdListenAddrs()
+		if len(bs.cfg.ListenAddrs) > 0 {
+			logger.WithField("listen", bs.cfg.ListenAddrs).Infoln("using listening sockets passed by systemd")
+		}
+	} else {
+		var listenAddrs []string
+		for _, listenAddr := range bs.cfg.ListenAddrs {
+			if listenAddr != server.SystemdListenAddr {
+				listenAddrs = append(listenAddrs, listenAddr)
+				continue
+			}
+			systemdListenAddrs := server.SystemdListenAddrs()
+			if len(systemdListenAddrs) == 0 {
+				return fmt.Errorf("listen %v requires socket activation, but no listening sockets were passed", listenAddr)
+			}
+			listenAddrs = append(listenAddrs, systemdListenAddrs...)
+		}
+		bs.cfg.ListenAddrs = listenAddrs
+	}
+	if len(bs.cfg.ListenAddrs) == 0 {
+		bs.cfg.ListenAddrs = []string{DefaultListenAddr}
+	}
+
+	bs.identifierClientPath, _ = flags.GetString("identifier-client-path")
+	if bs.identifierClientPath == "" {
+		bs.identifierClientPath = os.Getenv("KONNECTD_IDENTIFIER_CLIENT_PATH")
+	}
+	if bs.identifierClientPath == "" {
+		bs.identifierClientPath = defaultIdentifierClientPath
+	}
+	bs.identifierStaticMaxAge, _ = flags.GetDuration("identifier-static-max-age")
+	if bs.identifierStaticMaxAge < 0 {
+		return fmt.Errorf("invalid identifier-static-max-age value: %v", bs.identifierStaticMaxAge)
+	}
+	bs.identifierStaticCompress, _ = flags.GetBool("identifier-static-compression")
+
+	bs.identifierRegistrationConf, _ = flags.GetString("identifier-registration-conf")
+	if bs.identifierRegistrationConf != "" {
+		bs.identifierRegistrationConf, _ = filepath.Abs(bs.identifierRegistrationConf)
+		if _, errStat := os.Stat(bs.identifierRegistrationConf); errStat != nil {
+			return fmt.Errorf("identifier-registration-conf file not found or unable to access: %v", errStat)
+		}
+		bs.identifierAuthoritiesConf = bs.identifierRegistrationConf
+	}
+	if identifierAuthoritiesConf, _ := flags.GetString("identifier-authorities-conf"); identifierAuthoritiesConf != "" {
+		bs.identifierAuthoritiesConf, _ = filepath.Abs(identifierAuthoritiesConf)
+		if _, errStat := os.Stat(bs.identifierAuthoritiesConf); errStat != nil {
+			return fmt.Errorf("identifier-authorities-conf not found or unable to access: %v", errStat)
+		}
+	}
+	bs.clientsMax, _ = flags.GetInt("clients-max")
+	if bs.clientsMax < 0 {
+		return fmt.Errorf("invalid clients-max value: %v", bs.clientsMax)
+	}
+	bs.acrPolicies, err = identity.LoadACRPolicies(bs.identifierRegistrationConf)
+	if err != nil {
+		return fmt.Errorf("invalid acr_policies in identifier-registration-conf: %v", err)
+	}
+
+	bs.identifierScopesConf, _ = flags.GetString("identifier-scopes-conf")
+	if bs.identifierScopesConf != "" {
+		bs.identifierScopesConf, _ = filepath.Abs(bs.identifierScopesConf)
+		if _, errStat := os.Stat(bs.identifierScopesConf); errStat != nil {
+			return fmt.Errorf("identifier-scopes-conf file not found or unable to access: %v", errStat)
+		}
+		scopesConf, scopesErr := scopes.NewScopesFromFile(bs.identifierScopesConf, logger)
+		if scopesErr != nil {
+			return fmt.Errorf("failed to load identifier-scopes-conf: %v", scopesErr)
+		}
+		bs.profileClaimsMapping, err = identity.NewProfileClaimsMapping(scopesConf.ProfileClaims)
+		if err != nil {
+			return fmt.Errorf("invalid profile_claims in identifier-scopes-conf: %v", err)
+		}
+		if err = oidcProvider.ValidateClaimsPlacement(scopesConf.ClaimsPlacement); err != nil {
+			return fmt.Errorf("invalid claims_placement in identifier-scopes-conf: %v", err)
+		}
+		bs.claimsPlacement = scopesConf.ClaimsPlacement
+		if err = oidcProvider.ValidateAccessTokenClaims(scopesConf.AccessTokenClaims); err != nil {
+			return fmt.Errorf("invalid access_token_claims in identifier-scopes-conf: %v", err)
+		}
+		bs.accessTokenClaims = scopesConf.AccessTokenClaims
+	}
+
+	credentialPolicy := &backends.CredentialPolicy{}
+	credentialPolicy.MinLength, _ = flags.GetInt("identifier-credential-min-length")
+	credentialPolicy.Complexity, _ = flags.GetStringArray("identifier-credential-complexity")
+	credentialPolicy.LockoutThreshold, _ = flags.GetInt("identifier-lockout-threshold")
+	credentialPolicy.LockoutDuration, _ = flags.GetDuration("identifier-lockout-duration")
+	credentialPolicy.RemoteLockoutThreshold, _ = flags.GetInt("identifier-lockout-remote-threshold")
+	if credentialPolicy.RemoteLockoutThreshold == 0 {
+		credentialPolicy.RemoteLockoutThreshold = 10 * credentialPolicy.LockoutThreshold
+	}
+	if credentialPolicy.MinLength != 0 || len(credentialPolicy.Complexity) > 0 || credentialPolicy.LockoutThreshold != 0 || credentialPolicy.RemoteLockoutThreshold != 0 {
+		if err = credentialPolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid identifier credential policy: %v", err)
+		}
+		bs.identifierCredentialPolicy = credentialPolicy
+	}
+
+	consentStore, _ := flags.GetString("identifier-consent-store")
+	switch consentStore {
+	case "", "none":
+	case "memory":
+		bs.identifierConsentStore = identifier.NewMemoryConsentStore()
+	case "file":
+		consentStorePath, _ := flags.GetString("identifier-consent-store-path")
+		bs.identifierConsentStore, err = identifier.NewFileConsentStore(consentStorePath)
+		if err != nil {
+			return fmt.Errorf("invalid identifier-consent-store-path value: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown identifier-consent-store value: %v", consentStore)
+	}
+
+	bs.subjectAttribute, _ = flags.GetString("identity-subject-attribute")
+	mutableSubject, err := identity.ValidateSubjectAttribute(bs.subjectAttribute)
+	if err != nil {
+		return fmt.Errorf("invalid identity-subject-attribute value: %v", err)
+	}
+	if mutableSubject {
+		logger.WithField("attribute", bs.subjectAttribute).Warnln("identity-subject-attribute is mutable, sub values change when the attribute changes (Eg. on user rename)")
+	}
+
+	if scopeClaimsResolver, _ := flags.GetString("scope-claims-resolver"); scopeClaimsResolver != "" {
+		var ok bool
+		bs.scopeClaimsResolver, ok = identity.LookupScopeClaimsResolver(scopeClaimsResolver)
+		if !ok {
+			return fmt.Errorf("unknown scope-claims-resolver value: %v (registered: %v)", scopeClaimsResolver, strings.Join(identity.ScopeClaimsResolverNames(), ", "))
+		}
+		logger.WithField("name", scopeClaimsResolver).Infoln("using registered scope claims resolver")
+	}
+
+	err = bs.initializeKeys(true)
+	if err != nil {
+		return err
+	}
+
+	bs.cfg.HTTPTransport = utils.HTTPTransportWithTLSClientConfig(bs.tlsClientConfig)
+
+	bs.accessTokenDurationSeconds = 10 * 60 // 10 Minutes.
+
+	return nil
+}
+
+// initializeKeys loads the signing and validation keys as configured by the
+// accociated bootstrap's command parameters. If generate is true, a random
+// signing key is created when no signing key was provided.
+func (bs *Bootstrap) initializeKeys(generate bool) error {
+	flags := bs.flags
+	logger := bs.cfg.Logger
+	var err error
+
+	bs.signingKeyID, _ = flags.GetString("signing-kid")
+	if bs.signingKeyID == "" {
+		bs.signingKeyID = os.Getenv("KONNECTD_SIGNING_KID")
+	}
+
+	bs.signers = make(map[string]crypto.Signer)
+	bs.validators = make(map[string]crypto.PublicKey)
+	bs.keyIDs = make(map[string]*keyIDRecord)
+	bs.signingKeyNotAfter = make(map[string]time.Time)
+
+	bs.signingKeyExpiryWarning, _ = flags.GetDuration("signing-key-expiry-warning")
+	if bs.signingKeyExpiryWarning < 0 {
+		return fmt.Errorf("invalid --signing-key-expiry-warning value: %v", bs.signingKeyExpiryWarning)
+	}
+	bs.failOnExpiredSigningKey, _ = flags.GetBool("fail-on-expired-signing-key")
+
+	signingMethodString, _ := flags.GetString("signing-method")
+	bs.signingMethod = jwt.GetSigningMethod(signingMethodString)
+	if bs.signingMethod == nil {
+		return fmt.Errorf("unknown signing method: %s", signingMethodString)
+	}
+	bs.signingKeyBits, _ = flags.GetInt("signing-key-bits")
+	if bs.signingKeyBits < 0 {
+		return fmt.Errorf("invalid --signing-key-bits value: %d", bs.signingKeyBits)
+	}
+
+	bs.pkcs11ModulePath, _ = flags.GetString("pkcs11-module")
+	pkcs11PINFn, _ := flags.GetString("pkcs11-pin")
+	if pkcs11PINFn != "" {
+		bs.pkcs11PIN, err = utils.ReadSecretString(pkcs11PINFn, utils.SecretSchemeFile)
+		if err != nil {
+			return fmt.Errorf("failed to load pkcs11 pin: %v", err)
+		}
+	}
+
+	signingKeyFns, _ := flags.GetStringArray("signing-private-key")
+	if len(signingKeyFns) == 0 {
+		for _, keyFn := range strings.Split(os.Getenv("KONNECTD_SIGNING_PRIVATE_KEY"), " ") {
+			keyFn = strings.TrimSpace(keyFn)
+			if keyFn != "" {
+				signingKeyFns = append(signingKeyFns, keyFn)
+			}
+		}
+	}
+	if len(signingKeyFns) > 0 {
+		if bs.signingKeyBits != 0 {
+			logger.Warnln("ignoring --signing-key-bits parameter, since --signing-private-key is set")
+		}
+		first := true
+		for _, signingKeyFn := range signingKeyFns {
+			logger.WithField("source", signerSource(signingKeyFn)).Infoln("loading signing key")
+			kid, addErr := addSignerWithID(signingKeyFn, "", bs)
+			if addErr != nil {
+				return addErr
+			}
+			if first {
+				// Also add key under the provided id.
+				first = false
+				if bs.signingKeyID != "" {
+					kid, addErr = addSignerWithID(signingKeyFn, bs.signingKeyID, bs)
+					if addErr != nil {
+						return addErr
+					}
+				}
+				bs.activeSigningKeyID = kid
+			}
+		}
+	} else if generate {
+		//NOTE(longsleep): remove me - create keypair a random key pair.
+		signer, bits, signerErr := generateSigner(bs.signingMethod, bs.signingKeyBits)
+		if signerErr != nil {
+			return fmt.Errorf("failed to create random signing key: %v", signerErr)
+		}
+		logger.WithField("alg", bs.signingMethod.Alg()).Infof("using random %d bit signing key", bits)
+		if _, err = registerKeyID(bs.signingKeyID, signer.Public(), "random signing key", bs); err != nil {
+			return err
+		}
+		bs.signers[bs.signingKeyID] = signer
+		bs.activeSigningKeyID = bs.signingKeyID
+		bs.signingKeyRandom = true
+	} else {
+		return fmt.Errorf("missing --signing-private-key parameter")
+	}
+
+	// Ensure we have a signer for the things we need.
+	err = validateSigners(bs)
+	if err != nil {
+		return err
+	}
+	if expired := bs.expiredSigningKeys(time.Now()); len(expired) > 0 && bs.failOnExpiredSigningKey {
+		return fmt.Errorf("refusing to start with expired signing keys %s, since --fail-on-expired-signing-key is set", strings.Join(expired, ", "))
+	}
+
+	validationKeysPath, _ := flags.GetString("validation-keys-path")
+	if validationKeysPath == "" {
+		validationKeysPath = os.Getenv("KONNECTD_VALIDATION_KEYS_PATH")
+	}
+	if validationKeysPath != "" {
+		validationKeysKID, _ := flags.GetString("validation-keys-kid")
+		if validationKeysKID == "" {
+			validationKeysKID = os.Getenv("KONNECTD_VALIDATION_KEYS_KID")
+		}
+		switch validationKeysKID {
+		case "":
+			validationKeysKID = validationKeyIDFromFilename
+		case validationKeyIDFromFilename, validationKeyIDFromThumbprint, validationKeyIDFromSidecar:
+		default:
+			return fmt.Errorf("unknown validation-keys-kid value: %v", validationKeysKID)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"path": validationKeysPath,
+			"kid":  validationKeysKID,
+		}).Infoln("loading validation keys")
+		err = addValidatorsFromPath(validationKeysPath, validationKeysKID, bs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setup takes care of setting up the managers based on the accociated
+// bootstrap's data.
+func (bs *Bootstrap) setup(ctx context.Context) error {
+	managers, err := newManagers(ctx, bs)
+	if err != nil {
+		return err
+	}
+
+	identityManager, err := bs.setupIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	managers.Set("identity", identityManager)
+
+	guestManager, err := bs.setupGuest(ctx, identityManager)
+	if err != nil {
+		return err
+	}
+	managers.Set("guest", guestManager)
+
+	oidcProvider, err := bs.setupOIDCProvider(ctx)
+	if err != nil {
+		return err
+	}
+	managers.Set("oidc", oidcProvider)
+	managers.Set("handler", oidcProvider) // Use OIDC provider as default HTTP handler.
+
+	err = managers.Apply()
+	if err != nil {
+		return fmt.Errorf("failed to apply managers: %v", err)
+	}
+
+	// Final steps
+	err = oidcProvider.InitializeMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to initialize provider metadata: %v", err)
+	}
+	for _, client := range managers.Must("clients").(*identityClients.Registry).Clients() {
+		if validateErr := oidcProvider.ValidateClientSigningAlgs(client); validateErr != nil {
+			bs.cfg.Logger.WithFields(utils.ErrorAsFields(validateErr)).WithField("client_id", client.ID).Warnln("client requests a signing alg without matching signing key, add a --signing-private-key of a matching type")
+		}
+	}
+
+	bs.managers = managers
+	bs.logSummary(ctx)
+
+	return nil
+}
+
+// logSummary logs the effective configuration of the accociated bootstrap
+// after setup. Secrets are never logged, only whether they are set.
+func (bs *Bootstrap) logSummary(ctx context.Context) {
+	bs.cfg.Logger.WithFields(bs.summaryFields(ctx)).Infoln("effective configuration")
+}
+
+// summaryFields returns the log fields of the effective configuration of the
+// accociated bootstrap.
+func (bs *Bootstrap) summaryFields(ctx context.Context) logrus.Fields {
+	authoritiesCount := 0
+	if authorities, ok := bs.managers.Get("authorities"); ok {
+		authoritiesCount = len(authorities.(*identityAuthorities.Registry).Snapshot(ctx).Authorities)
+	}
+
+	endpoints := []string{
+		bs.authorizationEndpointURI.EscapedPath(),
+		bs.makeURIPath(apiTypeKonnect, "/token"),
+		bs.makeURIPath(apiTypeKonnect, "/userinfo"),
+		bs.endSessionEndpointURI.EscapedPath(),
+		bs.makeURIPath(apiTypeKonnect, "/revoke"),
+	}
+	if bs.cfg.AllowDynamicClientRegistration {
+		endpoints = append(endpoints, bs.makeURIPath(apiTypeKonnect, "/register"))
+	}
+	if bs.adminToken != "" {
+		endpoints = append(endpoints, bs.makeURIPath(apiTypeKonnect, "/admin/"))
+	}
+
+	consentStore := "none"
+	if bs.identifierConsentStore != nil {
+		consentStore, _ = bs.flags.GetString("identifier-consent-store")
+	}
+
+	return logrus.Fields{
+		"listen_addr":        bs.cfg.ListenAddrs,
+		"iss":                bs.issuerIdentifierURI.String(),
+		"identity_manager":   bs.args[0],
+		"signing_method":     bs.signingMethod.Alg(),
+		"kid":                bs.activeSigningKeyID,
+		"endpoints":          endpoints,
+		"authorities":        authoritiesCount,
+		"client_guests":      bs.cfg.AllowClientGuests,
+		"dynamic_clients":    bs.cfg.AllowDynamicClientRegistration,
+		"metrics":            bs.cfg.WithMetrics,
+		"tracing":            bs.cfg.Tracer != nil,
+		"admin_token":        bs.adminToken != "",
+		"registration_token": bs.registrationInitialAccessToken != "" || len(bs.registrationInitialAccessTokenKeys) > 0,
+		"claims_preview":     bs.allowClaimsPreview,
+		"refresh_rotation":   bs.refreshTokenRotation,
+		"unknown_scopes":     bs.unknownScopeBehavior,
+		"claims_in_id_token": bs.claimsInIDToken,
+		"token_binding":      bs.tokenBinding.Enabled(),
+		"consent_store":      consentStore,
+	}
+}
+
+func (bs *Bootstrap) makeURIPath(api string, subpath string) string {
+	subpath = strings.TrimPrefix(subpath, "/")
+
+	switch api {
+	case apiTypeKonnect:
+		return fmt.Sprintf("%s/konnect/v1/%s", strings.TrimSuffix(bs.uriBasePath, "/"), subpath)
+	case apiTypeSignin:
+		return fmt.Sprintf("%s/signin/v1/%s", strings.TrimSuffix(bs.uriBasePath, "/"), subpath)
+	default:
+		panic("unknown api type")
+	}
+}
+
+// makeCookieName returns the provided cookie name with the __Secure- prefix
+// unless cookies are configured as insecure, since browsers reject cookies
+// with that prefix which are not secure.
+func (bs *Bootstrap) makeCookieName(name string) string {
+	if bs.cfg.CookieInsecure {
+		return name
+	}
+
+	return "__Secure-" + name
+}
+
+func (bs *Bootstrap) setupIdentity(ctx context.Context) (identity.Manager, error) {
+	var err error
+	logger := bs.cfg.Logger
+
+	if len(bs.args) == 0 {
+		return nil, fmt.Errorf("identity-manager argument missing")
+	}
+
+	identityManagerName := bs.args[0]
+
+	// Identity manager.
+	var identityManager identity.Manager
+	switch identityManagerName {
+	case identityManagerNameCookie:
+		identityManager, err = newCookieIdentityManager(bs)
+
+	case identityManagerNameKC:
+		identityManager, err = newKCIdentityManager(bs)
+
+	case identityManagerNameLDAP:
+		identityManager, err = newLDAPIdentityManager(bs)
+
+	case identityManagerNameDummy:
+		identityManager, err = newDummyIdentityManager(bs)
+
+	default:
+		// NOTE: Built-in identity managers take precedence over registered
+		// identity managers with the same name.
+		if factory, ok := identity.LookupManagerFactory(identityManagerName); ok {
+			identityManager, err = newRegisteredIdentityManager(ctx, bs, identityManagerName, factory)
+		} else {
+			err = fmt.Errorf("unknown identity manager %v", identityManagerName)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.WithFields(logrus.Fields{
+		"name":   identityManagerName,
+		"scopes": identityManager.ScopesSupported(nil),
+		"claims": identityManager.ClaimsSupported(nil),
+	}).Infoln("identity manager set up")
+
+	return identityManager, nil
+}
+
+func (bs *Bootstrap) setupGuest(ctx context.Context, identityManager identity.Manager) (identity.Manager, error) {
+	if !bs.cfg.AllowClientGuests {
+		return nil, nil
+	}
+
+	var err error
+	logger := bs.cfg.Logger
+
+	guestManager, err := newGuestIdentityManager(bs)
+	if err != nil {
+		return nil, err
+	}
+
+	if guestManager != nil {
+		logger.Infoln("identity guest manager set up")
+	}
+	return guestManager, nil
+}
+
+func (bs *Bootstrap) setupOIDCProvider(ctx context.Context) (*oidcProvider.Provider, error) {
+	var err error
+	logger := bs.cfg.Logger
+
+	sessionCookiePath, err := getCommonURLPathPrefix(bs.authorizationEndpointURI.EscapedPath(), bs.endSessionEndpointURI.EscapedPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find common URL prefix for authorize and endsession: %v", err)
+	}
+
+	var registrationPath = ""
+	if bs.cfg.AllowDynamicClientRegistration {
+		registrationPath = bs.makeURIPath(apiTypeKonnect, "/register")
+	}
+
+	// NOTE: The discovery document is served relative to the base path and
+	// at the location of RFC 8414 with the base path inserted after the
+	// well-known prefix.
+	basePath := strings.TrimSuffix(bs.uriBasePath, "/")
+	wellKnownPaths := []string{
+		"/.well-known/oauth-authorization-server" + basePath,
+	}
+	if basePath != "" && bs.wellKnownRoot {
+		wellKnownPaths = append(wellKnownPaths, "/.well-known/openid-configuration")
+	}
+
+	provider, err := oidcProvider.NewProvider(&oidcProvider.Config{
+		Config: bs.cfg,
+
+		IssuerIdentifier:       bs.issuerIdentifierURI.String(),
+		WellKnownPath:          basePath + "/.well-known/openid-configuration",
+		JwksPath:               bs.makeURIPath(apiTypeKonnect, "/jwks.json"),
+		AuthorizationPath:      bs.authorizationEndpointURI.EscapedPath(),
+		TokenPath:              bs.makeURIPath(apiTypeKonnect, "/token"),
+		UserInfoPath:           bs.makeURIPath(apiTypeKonnect, "/userinfo"),
+		EndSessionPath:         bs.endSessionEndpointURI.EscapedPath(),
+		CheckSessionIframePath: bs.makeURIPath(apiTypeKonnect, "/session/check-session.html"),
+		RegistrationPath:       registrationPath,
+		RevocationPath:         bs.makeURIPath(apiTypeKonnect, "/revoke"),
+
+		AdditionalWellKnownPaths: wellKnownPaths,
+
+		AdditionalIssuerIdentifiers: bs.additionalIssuerIdentifiers,
+
+		BrowserStateCookiePath: bs.makeURIPath(apiTypeKonnect, "/session/"),
+		BrowserStateCookieName: bs.makeCookieName("KKBS"), // Kopano-Konnect-Browser-State
+
+		SessionCookiePath: sessionCookiePath,
+		SessionCookieName: bs.makeCookieName("KKCS"), // Kopano-Konnect-Client-Session
+
+		AccessTokenDuration:  time.Duration(bs.accessTokenDurationSeconds) * time.Second,
+		IDTokenDuration:      1 * time.Hour,            // 1 Hour, must be consumed by then.
+		RefreshTokenDuration: 24 * 365 * 3 * time.Hour, // 3 Years.
+
+		RefreshTokenRotation: bs.refreshTokenRotation,
+		AccessTokenType:      bs.accessTokenType,
+
+		TokenBinding: bs.tokenBinding,
+
+		UnknownScopeBehavior: bs.unknownScopeBehavior,
+
+		ClaimsInIDToken:   bs.claimsInIDToken,
+		ClaimsPlacement:   bs.claimsPlacement,
+		AccessTokenClaims: bs.accessTokenClaims,
+
+		UserInfoRequireAudience: bs.userInfoRequireAudience,
+
+		AllowEndSessionWithoutIDTokenHint: bs.allowEndSessionWithoutIDTokenHint,
+
+		AllowRequestURI: bs.allowRequestURI,
+
+		RegisteredClientsOnly: bs.registeredClientsOnly,
+
+		ErrorURIBase: bs.errorURIBase,
+
+		ClientErrorLogLimit: bs.clientErrorLogLimit,
+
+		TemplatesPath: bs.templatesPath,
+
+		RequestLimits: bs.requestLimits,
+
+		ClaimsSupported:     bs.discoveryClaimsSupported,
+		GrantTypesSupported: bs.discoveryGrantTypesSupported,
+		ACRValuesSupported:  bs.discoveryACRValuesSupported,
+
+		AllowOpaqueACRValues: bs.allowOpaqueACRValues,
+
+		ClientAssertionSigningAlgs: bs.clientAssertionSigningAlgs,
+
+		RegistrationInitialAccessToken:     bs.registrationInitialAccessToken,
+		RegistrationInitialAccessTokenKeys: bs.registrationInitialAccessTokenKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider: %v", err)
+	}
+	if bs.signingMethod != nil {
+		err = provider.SetSigningMethod(bs.signingMethod)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set provider signing method: %v", err)
+		}
+	}
+
+	// All add signers.
+	for id, signer := range bs.signers {
+		if id == bs.activeSigningKeyID {
+			// Active signer is set last, see below.
+			continue
+		}
+		// Set non default signers as well.
+		err = provider.SetSigningKey(id, signer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if signer, ok := bs.signers[bs.activeSigningKeyID]; ok {
+		// NOTE: Set the active signer last, so it replaces other signers of the
+		// same type.
+		err = provider.SetSigningKey(bs.activeSigningKeyID, signer)
+		if err != nil {
+			return nil, err
+		}
+		if bs.signingKeyID != "" && bs.signingKeyID != defaultSigningKeyID {
+			// Always set default key.
+			provider.SetValidationKey(defaultSigningKeyID, signer.Public())
+		}
+	}
+	// Add all validators.
+	for id, publicKey := range bs.validators {
+		err = provider.SetValidationKey(id, publicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sk, ok := provider.GetSigningKey(bs.signingMethod)
+	if !ok {
+		return nil, fmt.Errorf("no signing key for selected signing method")
+	}
+	if bs.signingKeyID == "" {
+		// Ensure that there is a default signing Key ID even if none was set.
+		provider.SetValidationKey(defaultSigningKeyID, sk.PrivateKey.Public())
+	}
+	logger.WithFields(logrus.Fields{
+		"id":     sk.ID,
+		"method": fmt.Sprintf("%T", sk.SigningMethod),
+		"alg":    sk.SigningMethod.Alg(),
+	}).Infoln("oidc token signing default set up")
+
+	return provider, nil
+}
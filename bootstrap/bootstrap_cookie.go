@@ -15,7 +15,7 @@
  *
  */
 
-package main
+package bootstrap
 
 import (
 	"fmt"
@@ -29,7 +29,7 @@ import (
 	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
 )
 
-func newCookieIdentityManager(bs *bootstrap) (identity.Manager, error) {
+func newCookieIdentityManager(bs *Bootstrap) (identity.Manager, error) {
 	logger := bs.cfg.Logger
 
 	if bs.authorizationEndpointURI.EscapedPath() == "" {
@@ -57,12 +57,18 @@ func newCookieIdentityManager(bs *bootstrap) (identity.Manager, error) {
 		cookieNames = bs.args[2:]
 	}
 
+	if bs.subjectAttribute != "" {
+		logger.Warnln("ignoring --identity-subject-attribute parameter, since it is not supported by this identity manager")
+	}
+
 	identityManagerConfig := &identity.Config{
 		SignInFormURI: bs.signInFormURI,
 
 		Logger: logger,
 
-		ScopesSupported: bs.cfg.AllowedScopes,
+		ScopesSupported:      bs.cfg.AllowedScopes,
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
 	}
 
 	cookieIdentityManager := identityManagers.NewCookieIdentityManager(identityManagerConfig, backendURI, cookieNames, 30*time.Second, bs.cfg.HTTPTransport)
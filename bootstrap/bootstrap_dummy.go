@@ -15,20 +15,26 @@
  *
  */
 
-package main
+package bootstrap
 
 import (
 	"stash.kopano.io/kc/konnect/identity"
 	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
 )
 
-func newDummyIdentityManager(bs *bootstrap) (identity.Manager, error) {
+func newDummyIdentityManager(bs *Bootstrap) (identity.Manager, error) {
 	logger := bs.cfg.Logger
 
+	if bs.subjectAttribute != "" {
+		logger.Warnln("ignoring --identity-subject-attribute parameter, since it is not supported by this identity manager")
+	}
+
 	identityManagerConfig := &identity.Config{
 		Logger: logger,
 
-		ScopesSupported: bs.cfg.AllowedScopes,
+		ScopesSupported:      bs.cfg.AllowedScopes,
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
 	}
 
 	sub := "dummy"
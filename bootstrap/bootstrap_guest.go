@@ -15,18 +15,21 @@
  *
  */
 
-package main
+package bootstrap
 
 import (
 	"stash.kopano.io/kc/konnect/identity"
 	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
 )
 
-func newGuestIdentityManager(bs *bootstrap) (identity.Manager, error) {
+func newGuestIdentityManager(bs *Bootstrap) (identity.Manager, error) {
 	logger := bs.cfg.Logger
 
 	identityManagerConfig := &identity.Config{
 		Logger: logger,
+
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
 	}
 
 	guestIdentityManager := identityManagers.NewGuestIdentityManager(identityManagerConfig)
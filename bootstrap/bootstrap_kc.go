@@ -15,7 +15,7 @@
  *
  */
 
-package main
+package bootstrap
 
 import (
 	"fmt"
@@ -35,7 +35,7 @@ import (
 	"stash.kopano.io/kc/konnect/version"
 )
 
-func newKCIdentityManager(bs *bootstrap) (identity.Manager, error) {
+func newKCIdentityManager(bs *Bootstrap) (identity.Manager, error) {
 	logger := bs.cfg.Logger
 
 	if bs.authorizationEndpointURI.String() != "" {
@@ -130,10 +130,33 @@ func newKCIdentityManager(bs *bootstrap) (identity.Manager, error) {
 		BaseURI:         bs.issuerIdentifierURI,
 		PathPrefix:      strings.TrimSuffix(bs.makeURIPath(apiTypeSignin, ""), "/"),
 		StaticFolder:    bs.identifierClientPath,
-		LogonCookieName: "__Secure-KKT", // Kopano-Konnect-Token
+		LogonCookieName: bs.makeCookieName("KKT"), // Kopano-Konnect-Token
 		ScopesConf:      bs.identifierScopesConf,
 
+		StaticMaxAge:      bs.identifierStaticMaxAge,
+		StaticCompression: bs.identifierStaticCompress,
+
 		AuthorizationEndpointURI: fullAuthorizationEndpointURL,
+		ClockSkew:                bs.clockSkew,
+
+		SessionMaxLifetime: bs.sessionMaxLifetime,
+		SessionIdleTimeout: bs.sessionIdleTimeout,
+
+		SubjectAttribute: bs.subjectAttribute,
+
+		AuthorityFallback:         bs.authorityFallback,
+		AuthorityFallbackDuration: bs.authorityFallbackDuration,
+		AuthorityChooser:          bs.authorityChooser,
+
+		TemplatesPath: bs.templatesPath,
+
+		CredentialPolicy: bs.identifierCredentialPolicy,
+		ConsentStore:     bs.identifierConsentStore,
+
+		BackendTimeout:          bs.identifierBackendTimeout,
+		BackendRetries:          bs.identifierBackendRetries,
+		BackendBreakerThreshold: bs.identifierBackendBreakerThreshold,
+		BackendBreakerDuration:  bs.identifierBackendBreakerDuration,
 
 		Backend: identifierBackend,
 	})
@@ -151,7 +174,12 @@ func newKCIdentityManager(bs *bootstrap) (identity.Manager, error) {
 
 		Logger: logger,
 
-		ScopesSupported: bs.cfg.AllowedScopes,
+		ScopesSupported:      bs.cfg.AllowedScopes,
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
+		SubjectAttribute:     bs.subjectAttribute,
+
+		ACRPolicies: bs.acrPolicies,
 	}
 
 	identifierIdentityManager := identityManagers.NewIdentifierIdentityManager(identityManagerConfig, activeIdentifier)
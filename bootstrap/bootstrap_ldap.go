@@ -15,7 +15,7 @@
  *
  */
 
-package main
+package bootstrap
 
 import (
 	"fmt"
@@ -29,7 +29,7 @@ import (
 	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
 )
 
-func newLDAPIdentityManager(bs *bootstrap) (identity.Manager, error) {
+func newLDAPIdentityManager(bs *Bootstrap) (identity.Manager, error) {
 	logger := bs.cfg.Logger
 
 	if bs.authorizationEndpointURI.String() != "" {
@@ -79,6 +79,7 @@ func newLDAPIdentityManager(bs *bootstrap) (identity.Manager, error) {
 		os.Getenv("LDAP_BASEDN"),
 		os.Getenv("LDAP_SCOPE"),
 		os.Getenv("LDAP_FILTER"),
+		bs.identifierAmbiguousUserPolicy,
 		subMapping,
 		attributeMapping,
 	)
@@ -94,10 +95,33 @@ func newLDAPIdentityManager(bs *bootstrap) (identity.Manager, error) {
 		BaseURI:         bs.issuerIdentifierURI,
 		PathPrefix:      strings.TrimSuffix(bs.makeURIPath(apiTypeSignin, ""), "/"),
 		StaticFolder:    bs.identifierClientPath,
-		LogonCookieName: "__Secure-KKT", // Kopano-Konnect-Token
+		LogonCookieName: bs.makeCookieName("KKT"), // Kopano-Konnect-Token
 		ScopesConf:      bs.identifierScopesConf,
 
+		StaticMaxAge:      bs.identifierStaticMaxAge,
+		StaticCompression: bs.identifierStaticCompress,
+
 		AuthorizationEndpointURI: fullAuthorizationEndpointURL,
+		ClockSkew:                bs.clockSkew,
+
+		SessionMaxLifetime: bs.sessionMaxLifetime,
+		SessionIdleTimeout: bs.sessionIdleTimeout,
+
+		SubjectAttribute: bs.subjectAttribute,
+
+		AuthorityFallback:         bs.authorityFallback,
+		AuthorityFallbackDuration: bs.authorityFallbackDuration,
+		AuthorityChooser:          bs.authorityChooser,
+
+		TemplatesPath: bs.templatesPath,
+
+		CredentialPolicy: bs.identifierCredentialPolicy,
+		ConsentStore:     bs.identifierConsentStore,
+
+		BackendTimeout:          bs.identifierBackendTimeout,
+		BackendRetries:          bs.identifierBackendRetries,
+		BackendBreakerThreshold: bs.identifierBackendBreakerThreshold,
+		BackendBreakerDuration:  bs.identifierBackendBreakerDuration,
 
 		Backend: identifierBackend,
 	})
@@ -115,7 +139,12 @@ func newLDAPIdentityManager(bs *bootstrap) (identity.Manager, error) {
 
 		Logger: logger,
 
-		ScopesSupported: bs.cfg.AllowedScopes,
+		ScopesSupported:      bs.cfg.AllowedScopes,
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
+		SubjectAttribute:     bs.subjectAttribute,
+
+		ACRPolicies: bs.acrPolicies,
 	}
 
 	identifierIdentityManager := identityManagers.NewIdentifierIdentityManager(identityManagerConfig, activeIdentifier)
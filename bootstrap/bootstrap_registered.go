@@ -0,0 +1,58 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+
+	"stash.kopano.io/kc/konnect/identity"
+)
+
+func newRegisteredIdentityManager(ctx context.Context, bs *Bootstrap, name string, factory identity.ManagerFactory) (identity.Manager, error) {
+	logger := bs.cfg.Logger
+
+	if bs.authorizationEndpointURI.EscapedPath() == "" {
+		bs.authorizationEndpointURI.Path = bs.makeURIPath(apiTypeKonnect, "/authorize")
+	}
+
+	identityManagerConfig := &identity.Config{
+		SignInFormURI: withSchemeAndHost(bs.signInFormURI, bs.issuerIdentifierURI),
+		SignedOutURI:  withSchemeAndHost(bs.signedOutURI, bs.issuerIdentifierURI),
+
+		Logger: logger,
+
+		ScopesSupported:      bs.cfg.AllowedScopes,
+		ProfileClaimsMapping: bs.profileClaimsMapping,
+		ScopeClaimsResolver:  bs.scopeClaimsResolver,
+		SubjectAttribute:     bs.subjectAttribute,
+
+		ACRPolicies: bs.acrPolicies,
+	}
+
+	identityManager, err := factory(ctx, identityManagerConfig, bs.args[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s identity manager: %v", name, err)
+	}
+	if identityManager == nil {
+		return nil, fmt.Errorf("%s identity manager factory returned no identity manager", name)
+	}
+	logger.WithField("name", name).Infoln("using registered identity manager")
+
+	return identityManager, nil
+}
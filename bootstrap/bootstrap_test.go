@@ -0,0 +1,97 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/managers"
+)
+
+func TestBootstrapSummaryFields(t *testing.T) {
+	issuerIdentifierURI, _ := url.Parse("https://konnect.example.com")
+	authorizationEndpointURI, _ := url.Parse("https://konnect.example.com/signin/v1/identifier/_/authorize")
+	endSessionEndpointURI, _ := url.Parse("https://konnect.example.com/signin/v1/identifier/_/endsession")
+
+	bs := &Bootstrap{
+		args: []string{identityManagerNameLDAP},
+		cfg: &config.Config{
+			ListenAddrs:                    []string{"127.0.0.1:8777"},
+			AllowDynamicClientRegistration: true,
+			Logger:                         logrus.New(),
+		},
+		managers: managers.New(),
+
+		issuerIdentifierURI:      issuerIdentifierURI,
+		authorizationEndpointURI: authorizationEndpointURI,
+		endSessionEndpointURI:    endSessionEndpointURI,
+
+		signingMethod:      jwt.SigningMethodPS256,
+		activeSigningKeyID: "default",
+
+		adminToken:           "unittest-admin-token",
+		refreshTokenRotation: "family",
+	}
+
+	fields := bs.summaryFields(context.Background())
+	for name, want := range map[string]interface{}{
+		"listen_addr":        []string{"127.0.0.1:8777"},
+		"iss":                "https://konnect.example.com",
+		"identity_manager":   identityManagerNameLDAP,
+		"signing_method":     "PS256",
+		"kid":                "default",
+		"authorities":        0,
+		"dynamic_clients":    true,
+		"admin_token":        true,
+		"registration_token": false,
+		"refresh_rotation":   "family",
+		"token_binding":      false,
+		"consent_store":      "none",
+	} {
+		if got, ok := fields[name]; !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: wrong summary field value: got %v want %v", name, got, want)
+		}
+	}
+
+	endpoints, _ := fields["endpoints"].([]string)
+	if !reflect.DeepEqual(endpoints, []string{
+		"/signin/v1/identifier/_/authorize",
+		"/konnect/v1/token",
+		"/konnect/v1/userinfo",
+		"/signin/v1/identifier/_/endsession",
+		"/konnect/v1/revoke",
+		"/konnect/v1/register",
+		"/konnect/v1/admin/",
+	}) {
+		t.Errorf("wrong summary endpoints: %v", endpoints)
+	}
+
+	for name, value := range fields {
+		if fmt.Sprintf("%v", value) == bs.adminToken {
+			t.Errorf("%s: summary must not contain secrets", name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"stash.kopano.io/kc/konnect/encryption"
+	"stash.kopano.io/kc/konnect/identifier"
+	"stash.kopano.io/kc/konnect/identifier/backends"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+	codeManagers "stash.kopano.io/kc/konnect/oidc/code/managers"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	oidcProvider "stash.kopano.io/kc/konnect/oidc/provider"
+	"stash.kopano.io/kc/konnect/server"
+	"stash.kopano.io/kc/konnect/tracing"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Defaults.
+const (
+	DefaultListenAddr           = "127.0.0.1:8777"
+	defaultIdentifierClientPath = "./identifier-webapp"
+	defaultSigningKeyID         = "default"
+	defaultSigningKeyBits       = 2048
+	minSigningKeyBits           = 2048
+	defaultOTelEndpoint         = "http://127.0.0.1:4318"
+)
+
+// AddFlags adds the flags of all settings read by New to the provided flags.
+func AddFlags(flags *pflag.FlagSet) {
+	flags.StringArray("listen", nil, fmt.Sprintf("TCP listen address, Unix socket path with unix: prefix, inherited listening file descriptor with fd: prefix or systemd for all sockets passed by socket activation, can be used multiple times (default \"%s\" or the sockets passed by socket activation)", DefaultListenAddr))
+	flags.Duration("read-header-timeout", server.DefaultReadHeaderTimeout, "Maximum duration for reading HTTP request headers")
+	flags.Duration("read-timeout", server.DefaultReadTimeout, "Maximum duration for reading the entire HTTP request including the body")
+	flags.Duration("write-timeout", server.DefaultWriteTimeout, "Maximum duration before timing out writes of the HTTP response")
+	flags.Duration("idle-timeout", server.DefaultIdleTimeout, "Maximum duration to wait for the next HTTP request when keep-alives are enabled")
+	flags.Int("max-concurrent-requests", 0, "Maximum number of concurrently served authorize, token and userinfo requests, further requests are rejected with 503 after max-concurrent-requests-queue-timeout, 0 means no limit")
+	flags.Duration("max-concurrent-requests-queue-timeout", server.DefaultLimiterQueueTimeout, "Maximum duration requests wait for a free slot when max-concurrent-requests is reached")
+	flags.Bool("disable-security-headers", false, "Disable the security headers which are added to responses, leaving only the headers set by the single endpoints")
+	flags.String("security-header-hsts", server.DefaultStrictTransportSecurity, "Strict-Transport-Security header value for responses to https requests, including requests forwarded by trusted proxies, empty disables the header")
+	flags.String("security-header-content-type-options", server.DefaultContentTypeOptions, "X-Content-Type-Options header value, empty disables the header")
+	flags.String("security-header-frame-options", server.DefaultFrameOptions, "X-Frame-Options header value for responses which get the default Content-Security-Policy, empty disables the header")
+	flags.String("security-header-csp", server.DefaultContentSecurityPolicy, "Default Content-Security-Policy header value for responses of endpoints which do not set their own policy, empty disables the header")
+	flags.String("security-header-referrer-policy", server.DefaultReferrerPolicy, "Default Referrer-Policy header value for responses of endpoints which do not set their own policy, empty disables the header")
+	flags.Bool("enable-h2c", false, "Enable HTTP/2 cleartext (h2c) on the listener, for use behind a TLS terminating load balancer")
+	flags.String("iss", "", "OIDC issuer URL")
+	flags.StringArray("additional-iss", nil, "Additional OIDC issuer URL accepted for incoming tokens, for example during hostname migration (can be used multiple times)")
+	flags.StringArray("webfinger-resource", nil, "Enable WebFinger issuer discovery for resources matching the provided pattern, for example acct:*@example.com (can be used multiple times)")
+	flags.String("favicon", "", "Full path to an icon file served as favicon of the host and of the sign-in pages")
+	flags.String("security-txt", "", fmt.Sprintf("Full path to a security.txt file as specified by RFC 9116 which is served at %s", server.SecurityTxtPath))
+	flags.String("error-uri-base", "", "Base URL for the error_uri of OAuth2 error responses, the error code is appended to it")
+	flags.String("templates-path", "", fmt.Sprintf("Full path to a directory with HTML templates replacing the built-in server rendered pages (%s)", strings.Join([]string{oidcProvider.TemplateNameError, oidcProvider.TemplateNameFormPostResponse, oidcProvider.TemplateNameFrontchannelLogout, identifier.TemplateNameAuthorityChooser}, ", ")))
+	AddSigningKeyFlags(flags)
+	flags.Duration("signing-key-expiry-warning", defaultSigningKeyExpiryWarning, "Duration before the expiry of a signing key from which on warnings are logged, the expiry is read from a .not_after or .crt file next to the key file or from a certificate in the key")
+	flags.Bool("fail-on-expired-signing-key", false, "Refuse to start when a signing key has expired")
+	flags.String("encryption-secret", "", fmt.Sprintf("Full path to a file containing a %d bytes secret key, use env:NAME or inline:VALUE to read the (optionally hex encoded) key from an environment variable or the value directly", encryption.KeySize))
+	flags.Int("signing-key-bits", 0, fmt.Sprintf("Key size in bits of the random signing key created when no --signing-private-key is given (RSA default %d, ECDSA derived from --signing-method, not supported for EdDSA)", defaultSigningKeyBits))
+	flags.String("uri-base-path", "", "Custom base path for URI endpoints")
+	flags.Bool("well-known-root", true, "Also serve the discovery document at /.well-known/openid-configuration of the host root when a custom base path for URI endpoints is set")
+	flags.String("sign-in-uri", "", "Custom redirection URI to sign-in form")
+	flags.String("signed-out-uri", "", "Custom redirection URI to signed-out goodbye page")
+	flags.String("authorization-endpoint-uri", "", "Custom authorization endpoint URI")
+	flags.String("endsession-endpoint-uri", "", "Custom endsession endpoint URI")
+	flags.StringArray("discovery-claims-supported", nil, "Custom claims_supported discovery value, prefix with + to extend the default (can be used multiple times)")
+	flags.StringArray("discovery-grant-types-supported", nil, "Custom grant_types_supported discovery value, prefix with + to extend the default (can be used multiple times)")
+	flags.StringArray("discovery-acr-values-supported", nil, "Custom acr_values_supported discovery value, prefix with + to extend the default, values must have an acr policy unless --allow-opaque-acr-values is set (can be used multiple times)")
+	flags.Bool("allow-opaque-acr-values", false, "Allow acr_values_supported discovery values without acr policy, which are passed along to authorities as is")
+	flags.StringArray("client-assertion-signing-alg", nil, "Allowed signing alg for client assertions and signed request objects, defaults to RS256, ES256 and PS256 (can be used multiple times)")
+	flags.String("identifier-client-path", "", fmt.Sprintf("Path to the identifier web client base folder (default \"%s\")", defaultIdentifierClientPath))
+	flags.Duration("identifier-static-max-age", identifier.DefaultStaticMaxAge, "Duration for which identifier web client assets with a content hash in their filename may be cached")
+	flags.Bool("identifier-static-compression", true, "Compress identifier web client responses if supported by the client, preferring precompressed .br and .gz asset files")
+	AddStoreFlags(flags)
+	flags.String("identifier-authorities-conf", "", "Path to an authorities configuration file or a directory of *.yaml authorities configuration files, used instead of the authorities of identifier-registration-conf")
+	flags.Int("clients-max", 0, "Maximum number of registered clients, 0 means unlimited")
+	flags.String("scope-claims-resolver", "", "Name of a registered scope claims resolver which resolves the claims released for granted scopes, defaults to the static scopes configuration")
+	flags.String("identifier-scopes-conf", "", "Path to a scopes.yaml configuration file")
+	flags.Int("identifier-credential-min-length", 0, "Minimum password length required by the identifier, unless the identifier backend declares its own credential policy")
+	flags.StringArray("identifier-credential-complexity", nil, "Password character class required by the identifier (one of lower, upper, digit or symbol, can be used multiple times)")
+	flags.Int("identifier-lockout-threshold", 0, "Number of failed identifier logon attempts per username after which further attempts are rejected, 0 disables lockout")
+	flags.Int("identifier-lockout-remote-threshold", 0, "Number of failed identifier logon attempts per client IP after which further attempts are rejected, 0 uses ten times the lockout threshold")
+	flags.Duration("identifier-lockout-duration", 15*time.Minute, "Duration after the last failed identifier logon attempt until a lockout expires")
+	flags.Duration("session-max-lifetime", 0, "Maximum duration since the last interactive sign-in after which identifier sessions expire and users must sign in again, 0 disables the limit")
+	flags.Duration("session-idle-timeout", 0, "Duration of inactivity after which identifier sessions expire, 0 disables the timeout")
+	flags.String("identifier-authority-fallback", identifier.AuthorityFallbackNone, "What happens when the default authority is unavailable (one of none or local, where local uses the local sign-in while the authority is not ready or after its discovery or key update failed)")
+	flags.Bool("identifier-authority-chooser", false, "Let users choose the authority to sign in with when the login hint resolves to no authority and multiple authorities are ready")
+	flags.Duration("identifier-authority-fallback-duration", identifier.DefaultAuthorityFallbackDuration, "Duration for which the local sign-in is used after the discovery or key update of the default authority failed when identifier-authority-fallback is local")
+	flags.Duration("identifier-backend-timeout", 0, "Maximum duration of requests to the kc or ldap identifier backend, 0 means no limit")
+	flags.Int("identifier-backend-retries", 0, "Number of retries of failed user lookups at the kc or ldap identifier backend, logons are never retried")
+	flags.Int("identifier-backend-breaker-threshold", 0, "Number of consecutive failed requests to the kc or ldap identifier backend after which requests fail immediately for identifier-backend-breaker-duration, 0 disables the circuit breaker")
+	flags.Duration("identifier-backend-breaker-duration", identifier.DefaultBackendBreakerDuration, "Duration for which requests to the identifier backend fail immediately after the circuit breaker opened, before a single request probes the backend again")
+	flags.String("identifier-ambiguous-user-policy", backends.AmbiguousUserPolicyDeny, "What to do when a username matches more than one user of the ldap identifier backend (one of deny or first), deny fails the sign-in like for an unknown user, first uses the first user ordered by DN")
+	flags.String("identity-subject-attribute", "", "User attribute the local sub is derived from (one of sub, uid, id, username or email), defaults to the identity manager's subject")
+	flags.Bool("insecure", false, "Disable TLS certificate and hostname validation for all outbound connections (development only, use per authority insecure setting instead)")
+	flags.Bool("fail-on-insecure", false, "Refuse to start when the security report of the effective configuration has warnings")
+	flags.StringArray("trusted-proxy", nil, "Trusted proxy IP or IP network (can be used multiple times)")
+	flags.String("trusted-proxy-client-ip-header", utils.DefaultTrustedProxyClientIPHeader, "Request header which is read from trusted proxies to find the client IP")
+	flags.String("trusted-proxy-proto-header", utils.DefaultTrustedProxyProtoHeader, "Request header which is read from trusted proxies to find the scheme of the original request")
+	flags.String("client-certificate-header", "", "HTTP header containing the TLS client certificate forwarded by a trusted proxy")
+	flags.StringArray("geoip-database", nil, "Full path to a MaxMind DB file (for example GeoLite2-Country or GeoLite2-ASN) used to add country and AS information of client IPs to logs and audit events (can be used multiple times)")
+	flags.Bool("otel-enabled", false, "Enable OpenTelemetry tracing, exporting spans with OTLP/HTTP")
+	flags.String("otel-endpoint", "", fmt.Sprintf("OTLP/HTTP collector endpoint URL trace spans are exported to (default \"%s\")", defaultOTelEndpoint))
+	flags.String("otel-sampler", "", fmt.Sprintf("Sampler deciding which traces get spans (one of %s), defaults to OTEL_TRACES_SAMPLER or %s", strings.Join([]string{tracing.SamplerAlwaysOn, tracing.SamplerAlwaysOff, tracing.SamplerTraceIDRatio, tracing.SamplerParentBasedAlwaysOn, tracing.SamplerParentBasedAlwaysOff, tracing.SamplerParentBasedTraceIDRatio}, ", "), tracing.SamplerParentBasedAlwaysOn))
+	flags.String("otel-sampler-arg", "", "Sampling probability between 0 and 1 of the traceidratio samplers, defaults to OTEL_TRACES_SAMPLER_ARG or 1")
+	flags.String("audit-webhook-url", "", "HTTP endpoint URL audit events of token issuance and logout are posted to as JSON")
+	flags.String("audit-webhook-secret", "", "Full path to a file containing the secret used to sign audit webhook requests with HMAC-SHA256, use env:NAME or inline:VALUE to read the secret from an environment variable or the value directly")
+	flags.String("cookie-samesite", "lax", "SameSite attribute of cookies (one of lax, strict or none)")
+	flags.Bool("cookie-secure", true, "Set the Secure attribute on cookies, disabling removes the __Secure- prefix from cookie names (development only)")
+	flags.String("cookie-domain", "", "Domain attribute of cookies, defaults to the host of the request")
+	flags.String("session-cookie-path", "", "Path of the identifier session cookie, defaults to the identifier API path")
+	flags.StringArray("allow-scope", nil, "Allow OAuth 2 scope (can be used multiple times, if not set default scopes are allowed)")
+	flags.Bool("allow-client-guests", false, "Allow sign in of client controlled guest users")
+	flags.Bool("allow-endsession-without-id-token-hint", false, "Allow end session requests with post_logout_redirect_uri which identify the client with client_id instead of id_token_hint")
+	flags.Bool("allow-dynamic-client-registration", false, "Allow dynamic OAuth2 client registration")
+	flags.Bool("allow-request-uri", false, "Allow authorize requests to fetch their request object from request_uri, only request_uris registered for the client are fetched")
+	flags.Bool("registered-clients-only", false, "Reject authorize requests of clients which are not registered, including clients which are implicitly trusted because they redirect to the origin of the issuer")
+	flags.String("registration-initial-access-token", "", "Full path to a file containing the initial access token required as Bearer token for dynamic client registration, use env:NAME or inline:VALUE to read the token from an environment variable or the value directly")
+	flags.String("registration-initial-access-token-jwks", "", "Full path to a JWKS file with public keys to validate JWT initial access tokens for dynamic client registration")
+	flags.Int("authorization-code-max-records", codeManagers.DefaultMaxRecords, "Maximum number of pending authorization codes, the oldest pending codes are dropped when reached")
+	flags.Duration("authorization-code-duration", codeManagers.DefaultCodeValidDuration, "Duration pending authorization codes are valid and kept before expiring")
+	flags.Int("request-max-scopes", payload.DefaultMaxScopes, "Maximum number of scopes accepted with authorize and token requests, 0 means no limit")
+	flags.Int("request-max-scope-length", payload.DefaultMaxScopeLength, "Maximum length in bytes of the scope parameter of authorize and token requests, 0 means no limit")
+	flags.Int("request-max-request-object-length", payload.DefaultMaxRequestLength, "Maximum length in bytes of the request parameter of authorize requests, 0 means no limit")
+	flags.Int("request-max-claims-length", payload.DefaultMaxClaimsLength, "Maximum length in bytes of the claims parameter of authorize requests, 0 means no limit")
+	flags.Int("request-max-redirect-uri-length", payload.DefaultMaxRedirectURILength, "Maximum length in bytes of the redirect_uri parameter of authorize and token requests, 0 means no limit")
+	flags.Int("request-max-state-length", payload.DefaultMaxStateLength, "Maximum length in bytes of the state parameter of authorize requests, longer states are rejected with invalid_request without returning the state, 0 means no limit")
+	flags.Bool("authorities-strict-default", false, "Fail when more than one authority is marked as default instead of using the first one")
+	flags.Bool("disallow-plain-pkce", false, "Reject authorities configured with the plain PKCE code challenge method and never use plain with authorities, even if they announce it")
+	flags.Bool("authorities-discover-sync", false, "Wait for the discovery of the default authority during startup and fail if it is not ready within authorities-discover-sync-timeout")
+	flags.Duration("authorities-discover-sync-timeout", 30*time.Second, "Maximum duration to wait for the discovery of the default authority with authorities-discover-sync")
+	flags.Duration("authority-discovery-max-stale", 0, "Maximum duration since the last successful discovery of an authority after which it is treated as not ready until discovery succeeds again, 0 means discovery results never get stale")
+	flags.Int("authorities-max", 0, "Maximum number of registered authorities including managed authorities, 0 means unlimited")
+	flags.String("authority-ca", "", "Full path to PEM encoded CA certificates trusted for authority connections in addition to the system roots, use env:NAME or inline:VALUE to read them from an environment variable or the value directly")
+	flags.Duration("authority-timeout", 30*time.Second, "Maximum duration of outbound HTTP requests to authorities including reading the response")
+	flags.Duration("authority-dial-timeout", 30*time.Second, "Maximum duration for connecting to authorities")
+	flags.Duration("authority-tls-handshake-timeout", 10*time.Second, "Maximum duration for the TLS handshake with authorities")
+	flags.Duration("authority-response-header-timeout", 0, "Maximum duration to wait for response headers of authorities, 0 means no limit other than authority-timeout")
+	flags.Int("authority-max-idle-conns", 100, "Maximum number of idle connections kept open to all authorities")
+	flags.Int("authority-max-idle-conns-per-host", 2, "Maximum number of idle connections kept open per authority host")
+	flags.Duration("authority-idle-conn-timeout", 90*time.Second, "Duration idle connections to authorities are kept open")
+	flags.String("authority-http-proxy", "", "URL of the HTTP proxy used for outbound requests to authorities instead of the HTTP_PROXY and HTTPS_PROXY environment variables (NO_PROXY is honored), the http_proxy setting of authorities overrides it")
+	flags.Bool("log-authority-requests", false, "Log outbound HTTP requests to authorities at info level with redacted values, at debug log level they are always logged")
+	flags.Int("log-client-errors-per-minute", 0, "Maximum number of logged client errors per error code and minute, further ones are counted and the count is logged with the next log of the error code, 0 means no limit (server errors are always logged)")
+	flags.Duration("clock-skew", 60*time.Second, "Allowed clock difference to authorities when validating the time claims of their ID tokens")
+	flags.Bool("userinfo-require-audience", false, "Reject access tokens at the userinfo endpoint which do not contain the issuer identifier in their aud claim")
+	flags.String("refresh-token-rotation", "", "Clients for which refresh tokens are one-time-use and rotated with reuse detection (one of none, public or all), defaults to public with the file refresh-token-store and to none otherwise")
+	flags.String("refresh-token-store", "memory", "Storage for the families of rotated refresh tokens (one of memory or file), with memory rotated refresh tokens become invalid on restart")
+	flags.String("refresh-token-store-path", "", "Full path to the folder where the file refresh-token-store keeps refresh token families, can be shared between instances")
+	flags.Duration("refresh-token-reuse-grace", 0, "Duration after a rotation in which the previous refresh token can still be used, to tolerate concurrent and retried refreshes, kept in the refresh-token-store, 0 disables it")
+	flags.StringArray("token-binding", nil, "Bind access and refresh tokens to the client of the request they are issued for (one of ip or user-agent, can be used multiple times), clients can replace this with token_binding in their registration")
+	flags.Int("token-binding-ipv4-prefix", identityClients.DefaultTokenBindingIPv4Prefix, "Prefix length of the IPv4 network of the client IP to which tokens are bound")
+	flags.Int("token-binding-ipv6-prefix", identityClients.DefaultTokenBindingIPv6Prefix, "Prefix length of the IPv6 network of the client IP to which tokens are bound")
+	flags.String("access-token-type", oidcProvider.AccessTokenTypeATJWT, "Value of the typ header of issued access tokens (one of at+jwt as defined by RFC 9068 or JWT for clients expecting the old value)")
+	flags.String("revoked-tokens-store", "memory", "Storage for the jti of tokens revoked at the revocation endpoint until they expire (one of none, memory or file), with none only refresh token families can be revoked")
+	flags.String("revoked-tokens-store-path", "", "Full path to the folder where the file revoked-tokens-store keeps revoked tokens, can be shared between instances")
+	flags.String("claims-in-id-token", oidcProvider.ClaimsInIDTokenMinimal, "Which claims released for the granted scopes are included in ID tokens (one of minimal, where they are only included when no access token is issued, or full), use claims_placement in identifier-scopes-conf to configure single scopes")
+	flags.String("unknown-scope-behavior", oidcProvider.UnknownScopeBehaviorPassthrough, "How requested scopes which are not supported are handled (one of passthrough, ignore or error)")
+	flags.Bool("allow-claims-preview", false, "Enable the admin endpoint which shows the claims issued to a client for a user (development only, requires admin-token)")
+	flags.String("admin-token", "", "Bearer token required to access admin endpoints, admin endpoints are disabled when not set")
+}
+
+// AddSigningKeyFlags adds the flags selecting the signing and validation keys
+// to the provided flags, shared between the serve and the keys command.
+func AddSigningKeyFlags(flags *pflag.FlagSet) {
+	flags.StringArray("signing-private-key", nil, "Full path to PEM encoded private key file (must match the --signing-method algorithm), use env:NAME or inline:VALUE to read the key from an environment variable or the value directly, or a pkcs11: URI referencing a key in a PKCS#11 module (can be used multiple times, the first key signs by default and keys of other types sign for clients registered with a matching id_token_signed_response_alg)")
+	flags.String("signing-kid", "", "Value of kid field to use in created tokens (uniquely identifying the signing-private-key)")
+	flags.String("pkcs11-module", "", "Full path to the PKCS#11 module used for pkcs11: signing keys (requires a build with pkcs11 support)")
+	flags.String("pkcs11-pin", "", "Full path to a file containing the PIN of the PKCS#11 token, use env:NAME or inline:VALUE to read the PIN from an environment variable or the value directly")
+	flags.String("validation-keys-path", "", "Full path to a folder containg PEM encoded private or public key files used for token validaton (file name without extension is used as kid)")
+	flags.String("validation-keys-kid", "", "How the kid of validation keys without kid is derived (one of filename, thumbprint or sidecar, where sidecar reads the kid from a file with .kid extension next to the key file), defaults to filename")
+	flags.String("signing-method", "PS256", "JWT default signing method")
+}
+
+// AddStoreFlags adds the flags selecting the persistent stores to the provided
+// flags, shared between the serve and the store command.
+func AddStoreFlags(flags *pflag.FlagSet) {
+	flags.String("identifier-registration-conf", "", "Path to a identifier-registration.yaml configuration file")
+	flags.String("authorities-store", "", "Full path to a file where authorities managed with the admin API are persisted")
+	flags.String("identifier-consent-store", "none", "Storage for consent decisions users ask to remember (one of none, memory or file)")
+	flags.String("identifier-consent-store-path", "", "Full path to the folder where the file identifier-consent-store keeps remembered consent, can be shared between instances")
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// defaultSigningKeyExpiryWarning is the duration before the expiry of a
+// signing key from which on warnings are logged, if not configured otherwise.
+const defaultSigningKeyExpiryWarning = 30 * 24 * time.Hour
+
+// signingKeyExpiryCheckInterval is the interval in which the expiry of
+// signing keys is checked while serving.
+const signingKeyExpiryCheckInterval = time.Hour
+
+var signingKeyExpiryGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "konnect",
+		Subsystem: "signing",
+		Name:      "key_expiry_seconds",
+		Help:      "Seconds until the signing key expires, negative if it has expired. Only keys with known expiry are reported.",
+	},
+	[]string{"kid"},
+)
+
+// loadSignerNotAfterFromFile returns the time after which the provided signer
+// loaded from the key file at the provided path must no longer be used. It is
+// read from a .not_after sidecar file with an RFC 3339 timestamp, from a .crt
+// sidecar file with the certificate of the key or from a certificate of the
+// key in the key file itself, in that order. Returns the zero time without
+// error if none of these is there.
+func loadSignerNotAfterFromFile(fn string, signer crypto.Signer) (time.Time, error) {
+	base := strings.TrimSuffix(fn, filepath.Ext(fn))
+
+	readBytes, err := ioutil.ReadFile(base + ".not_after")
+	switch {
+	case err == nil:
+		notAfter, parseErr := time.Parse(time.RFC3339, strings.TrimSpace(string(readBytes)))
+		if parseErr != nil {
+			return time.Time{}, fmt.Errorf("invalid not_after file: %v", parseErr)
+		}
+		return notAfter, nil
+	case !os.IsNotExist(err):
+		return time.Time{}, fmt.Errorf("failed to read not_after file: %v", err)
+	}
+
+	readBytes, err = ioutil.ReadFile(base + ".crt")
+	switch {
+	case err == nil:
+		notAfter, certErr := signerNotAfter(readBytes, ".pem", signer)
+		if certErr == nil && notAfter.IsZero() {
+			certErr = fmt.Errorf("no certificate found")
+		}
+		if certErr != nil {
+			return time.Time{}, fmt.Errorf("invalid crt file: %v", certErr)
+		}
+		return notAfter, nil
+	case !os.IsNotExist(err):
+		return time.Time{}, fmt.Errorf("failed to read crt file: %v", err)
+	}
+
+	readBytes, err = ioutil.ReadFile(fn)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	return signerNotAfter(readBytes, filepath.Ext(fn), signer)
+}
+
+// signerNotAfter returns the expiry of the certificate of the provided signer
+// found in the provided key data, which are the x5c certificates of JWK and the
+// CERTIFICATE blocks of PEM. Returns the zero time without error if the key data
+// has no certificates and error if none of the certificates is for the signer.
+func signerNotAfter(readBytes []byte, ext string, signer crypto.Signer) (time.Time, error) {
+	var certificates []*x509.Certificate
+	switch ext {
+	case ".json":
+		k, err := parseJSONWebKey(readBytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse key file as JWK: %v", err)
+		}
+		certificates = k.Certificates
+
+	default:
+		for rest := readBytes; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("failed to parse certificate: %v", err)
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if len(certificates) == 0 {
+		return time.Time{}, nil
+	}
+
+	thumbprint, err := (&jose.JSONWebKey{Key: signer.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to create thumbprint: %v", err)
+	}
+	for _, certificate := range certificates {
+		certificateThumbprint, thumbprintErr := (&jose.JSONWebKey{Key: certificate.PublicKey}).Thumbprint(crypto.SHA256)
+		if thumbprintErr == nil && bytes.Equal(certificateThumbprint, thumbprint) {
+			return certificate.NotAfter, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("no certificate matches the key")
+}
+
+// setSignerNotAfter records the provided expiry for the signer with the
+// provided kid, if not zero.
+func setSignerNotAfter(kid string, notAfter time.Time, bs *Bootstrap) {
+	if notAfter.IsZero() {
+		return
+	}
+
+	bs.signingKeyNotAfter[kid] = notAfter
+	bs.cfg.Logger.WithFields(logrus.Fields{
+		"kid":       kid,
+		"not_after": notAfter,
+	}).Debugln("signer key expires")
+}
+
+// expiredSigningKeys returns the sorted kids of the signing keys which have
+// expired at the provided time.
+func (bs *Bootstrap) expiredSigningKeys(now time.Time) []string {
+	var kids []string
+	for kid, notAfter := range bs.signingKeyNotAfter {
+		if !now.Before(notAfter) {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Strings(kids)
+
+	return kids
+}
+
+// checkSigningKeyExpiry updates the signing key expiry metric and logs the
+// signing keys which expire within the configured warning duration of the
+// provided time or have expired already.
+func (bs *Bootstrap) checkSigningKeyExpiry(now time.Time) {
+	logger := bs.cfg.Logger
+
+	for kid, notAfter := range bs.signingKeyNotAfter {
+		remaining := notAfter.Sub(now)
+		signingKeyExpiryGauge.WithLabelValues(kid).Set(remaining.Seconds())
+
+		fields := logrus.Fields{
+			"kid":       kid,
+			"not_after": notAfter,
+			"active":    kid == bs.activeSigningKeyID,
+		}
+		switch {
+		case remaining <= 0:
+			logger.WithFields(fields).Errorln("signing key has expired, rotate it")
+		case remaining <= bs.signingKeyExpiryWarning:
+			logger.WithFields(fields).WithField("remaining", remaining.Round(time.Minute)).Warnln("signing key expires soon, rotate it")
+		}
+	}
+}
+
+// runSigningKeyExpiryCheck checks the expiry of the signing keys right away
+// and then periodically until the provided context is done.
+func (bs *Bootstrap) runSigningKeyExpiryCheck(ctx context.Context) error {
+	if len(bs.signingKeyNotAfter) == 0 {
+		return nil
+	}
+
+	if bs.cfg.WithMetrics {
+		if err := bs.cfg.Registerer().Register(signingKeyExpiryGauge); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return fmt.Errorf("failed to register signing key expiry metrics: %v", err)
+			}
+		}
+	}
+
+	bs.checkSigningKeyExpiry(time.Now())
+	go func() {
+		ticker := time.NewTicker(signingKeyExpiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				bs.checkSigningKeyExpiry(now)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+
+	"stash.kopano.io/kc/konnect/managers"
+	"stash.kopano.io/kc/konnect/tracing"
+
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
+	codeManagers "stash.kopano.io/kc/konnect/oidc/code/managers"
+	oidcProvider "stash.kopano.io/kc/konnect/oidc/provider"
+	refreshManagers "stash.kopano.io/kc/konnect/oidc/refresh/managers"
+	revocationManagers "stash.kopano.io/kc/konnect/oidc/revocation/managers"
+)
+
+func newManagers(ctx context.Context, bs *Bootstrap) (*managers.Managers, error) {
+	logger := bs.cfg.Logger
+
+	var err error
+	mgrs := managers.New()
+
+	// Encryption manager.
+	encryption, err := identityManagers.NewEncryptionManager(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryption manager: %v", err)
+	}
+	encryption.SetKey(bs.encryptionSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --encryption-secret parameter value for encryption: %v", err)
+	}
+	mgrs.Set("encryption", encryption)
+	logger.Infof("encryption set up with %d key size", encryption.GetKeySize())
+
+	// OIDC code manage.
+	code := codeManagers.NewMemoryMapManager(ctx, bs.codeMaxRecords, bs.codeDuration)
+	mgrs.Set("code", code)
+
+	// OIDC refresh token family manager.
+	if bs.refreshTokenRotation != oidcProvider.RefreshTokenRotationNone {
+		switch bs.refreshTokenStore {
+		case "file":
+			refresh, fileErr := refreshManagers.NewFileManager(ctx, bs.refreshTokenStorePath, bs.refreshTokenReuseGrace)
+			if fileErr != nil {
+				return nil, fmt.Errorf("failed to create refresh token store: %v", fileErr)
+			}
+			mgrs.Set("refresh", refresh)
+		default:
+			mgrs.Set("refresh", refreshManagers.NewMemoryMapManager(ctx, 0, bs.refreshTokenReuseGrace))
+		}
+	}
+
+	// OIDC revoked token manager.
+	switch bs.revokedTokensStore {
+	case "memory":
+		mgrs.Set("revocation", revocationManagers.NewMemoryMapManager(ctx, 0))
+	case "file":
+		revocation, fileErr := revocationManagers.NewFileManager(ctx, bs.revokedTokensStorePath)
+		if fileErr != nil {
+			return nil, fmt.Errorf("failed to create revoked tokens store: %v", fileErr)
+		}
+		mgrs.Set("revocation", revocation)
+	}
+
+	// Identifier client registry manager.
+	clients, err := identityClients.NewRegistry(ctx, bs.issuerIdentifierURI, bs.identifierRegistrationConf, bs.clientsMax, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client registry: %v", err)
+	}
+	mgrs.Set("clients", clients)
+
+	// Identifier authorities registry manager.
+	authoritiesConfig := &identityAuthorities.RegistryConfig{
+		StrictDefault:                    bs.authoritiesStrictDefault,
+		DisallowPlainCodeChallengeMethod: bs.disallowPlainPKCE,
+		DiscoveryMaxStale:                bs.authorityDiscoveryMaxStale,
+		MaxAuthorities:                   bs.authoritiesMax,
+		HTTPClientConfig:                 bs.authorityHTTPClientConfig,
+		TLSClientConfig:                  bs.tlsClientConfig,
+		RootCAsPEM:                       bs.authorityCAData,
+	}
+	if bs.cfg.WithMetrics {
+		authoritiesConfig.MetricsRegisterer = bs.cfg.Registerer()
+	}
+	authorities, err := identityAuthorities.NewRegistry(tracing.NewContext(ctx, bs.cfg.Tracer), bs.identifierAuthoritiesConf, authoritiesConfig, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authorities registry: %v", err)
+	}
+	if bs.authoritiesStore != "" {
+		if err = authorities.LoadStore(tracing.NewContext(ctx, bs.cfg.Tracer), bs.authoritiesStore); err != nil {
+			return nil, fmt.Errorf("failed to load authorities store: %v", err)
+		}
+	}
+	if bs.authoritiesDiscoverSync {
+		logger.WithField("timeout", bs.authoritiesDiscoverSyncTimeout).Infoln("waiting for default authority discovery")
+		waitCtx, waitCancel := context.WithTimeout(ctx, bs.authoritiesDiscoverSyncTimeout)
+		err = authorities.WaitReady(waitCtx)
+		waitCancel()
+		if err != nil {
+			return nil, fmt.Errorf("authority discovery failed: %v", err)
+		}
+	}
+	mgrs.Set("authorities", authorities)
+
+	return mgrs, nil
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package bootstrap
+
+import (
+	"strings"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// checkKeyFile checks the permissions of the key or secret file at the
+// provided path and records it for the security report if it is not protected
+// well enough.
+func (bs *Bootstrap) checkKeyFile(fn string, public bool) {
+	reason, err := checkKeyFilePermissions(fn, public)
+	if err != nil {
+		// NOTE: Ignore, loading the file reports the error.
+		return
+	}
+	if reason != "" {
+		if bs.insecureKeyFiles == nil {
+			bs.insecureKeyFiles = make(map[string]string)
+		}
+		bs.insecureKeyFiles[fn] = reason
+	}
+}
+
+// checkSecretValue checks the permissions of the file referenced by the
+// provided secret value, if it references a file.
+func (bs *Bootstrap) checkSecretValue(value string) {
+	switch utils.SecretScheme(value) {
+	case "":
+		bs.checkKeyFile(value, false)
+	case utils.SecretSchemeFile:
+		bs.checkKeyFile(strings.TrimPrefix(value, utils.SecretSchemeFile), false)
+	}
+}
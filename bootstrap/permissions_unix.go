@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkKeyFilePermissions returns a description of why the file at the
+// provided path is not protected well enough to hold key material, or an
+// empty string if it is. Like SSH, files must be owned by the current user or
+// root. Secret files must not be accessible by others, but may be readable by
+// the group, since packaged setups commonly grant the service user access via
+// its group. Public key files may be readable by everyone, but as they are
+// trusted for token validation they must not be writable by group or others.
+func checkKeyFilePermissions(fn string, public bool) (string, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return "", err
+	}
+
+	mode := fi.Mode().Perm()
+	if public {
+		if mode&0022 != 0 {
+			return fmt.Sprintf("file is writable by group or others (mode %04o)", mode), nil
+		}
+	} else if mode&0027 != 0 {
+		return fmt.Sprintf("file is accessible by others or writable by group (mode %04o)", mode), nil
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 && int(st.Uid) != os.Geteuid() {
+		return fmt.Sprintf("file is owned by another user (uid %d)", st.Uid), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckKeyFilePermissions(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "konnectd-permissions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, test := range []struct {
+		name   string
+		mode   os.FileMode
+		public bool
+		secure bool
+	}{
+		{"private", 0600, false, true},
+		{"private group readable", 0640, false, true},
+		{"private group writable", 0660, false, false},
+		{"private world readable", 0604, false, false},
+		{"public world readable", 0644, true, true},
+		{"public group writable", 0664, true, false},
+		{"public world writable", 0646, true, false},
+	} {
+		fn := filepath.Join(tempDir, "key.pem")
+		if err = ioutil.WriteFile(fn, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: Set the mode explicitly, since the umask applies on create.
+		if err = os.Chmod(fn, test.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		reason, err := checkKeyFilePermissions(fn, test.public)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if secure := reason == ""; secure != test.secure {
+			t.Errorf("%s: got secure %v want %v: %v", test.name, secure, test.secure, reason)
+		}
+	}
+
+	if _, err = checkKeyFilePermissions(filepath.Join(tempDir, "missing.pem"), false); err == nil {
+		t.Error("missing file was checked without error")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/identity"
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	oidcProvider "stash.kopano.io/kc/konnect/oidc/provider"
+	"stash.kopano.io/kc/konnect/server"
+	"stash.kopano.io/kc/konnect/tracing"
+)
+
+// NewServer creates the server for the managers of the accociated Bootstrap,
+// which must have been set up with Boot. If listeners are provided, the
+// server serves them instead of the listen addresses. The provided auxiliary
+// servers are served next to it.
+func (bs *Bootstrap) NewServer(listeners []net.Listener, auxiliaryServers []*http.Server) (*server.Server, error) {
+	flags := bs.flags
+	logger := bs.cfg.Logger
+	var err error
+
+	readHeaderTimeout, _ := flags.GetDuration("read-header-timeout")
+	readTimeout, _ := flags.GetDuration("read-timeout")
+	writeTimeout, _ := flags.GetDuration("write-timeout")
+	idleTimeout, _ := flags.GetDuration("idle-timeout")
+	enableH2C, _ := flags.GetBool("enable-h2c")
+	maxConcurrentRequests, _ := flags.GetInt("max-concurrent-requests")
+	maxConcurrentRequestsQueueTimeout, _ := flags.GetDuration("max-concurrent-requests-queue-timeout")
+	if maxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("max-concurrent-requests must not be negative")
+	}
+
+	if len(listeners) > 0 {
+		bs.cfg.ListenAddrs = nil
+	}
+
+	maintenance := server.NewMaintenance()
+
+	var securityHeaders *server.SecurityHeaders
+	if disableSecurityHeaders, _ := flags.GetBool("disable-security-headers"); !disableSecurityHeaders {
+		securityHeaders = server.NewSecurityHeaders()
+		securityHeaders.StrictTransportSecurity, _ = flags.GetString("security-header-hsts")
+		securityHeaders.ContentTypeOptions, _ = flags.GetString("security-header-content-type-options")
+		securityHeaders.FrameOptions, _ = flags.GetString("security-header-frame-options")
+		securityHeaders.ContentSecurityPolicy, _ = flags.GetString("security-header-csp")
+		securityHeaders.ReferrerPolicy, _ = flags.GetString("security-header-referrer-policy")
+	} else {
+		logger.Warnln("security headers are disabled")
+	}
+
+	var limiter *server.Limiter
+	if maxConcurrentRequests > 0 {
+		limiter = server.NewLimiter(maxConcurrentRequests, maxConcurrentRequestsQueueTimeout)
+		limiter.Limit(bs.authorizationEndpointURI.EscapedPath())
+		limiter.Limit(bs.makeURIPath(apiTypeKonnect, "/token"))
+		limiter.Limit(bs.makeURIPath(apiTypeKonnect, "/userinfo"))
+		limiter.Limit(bs.makeURIPath(apiTypeKonnect, "/revoke"))
+		logger.WithFields(logrus.Fields{
+			"max":          maxConcurrentRequests,
+			"queueTimeout": maxConcurrentRequestsQueueTimeout,
+		}).Infoln("concurrent request limit enabled")
+	}
+
+	var routes []server.WithRoutes
+	// NOTE: Identity managers provided by in process users of the bootstrap
+	// might not have routes.
+	if withRoutes, ok := bs.managers.Must("identity").(server.WithRoutes); ok {
+		routes = append(routes, withRoutes)
+	}
+	if bs.adminToken != "" {
+		routes = append(routes, identityAuthorities.NewAdminHandler(
+			bs.makeURIPath(apiTypeKonnect, "/admin/authorities"),
+			bs.managers.Must("authorities").(*identityAuthorities.Registry),
+			bs.adminToken,
+			logger,
+		))
+		routes = append(routes, oidcProvider.NewKeysAdminHandler(
+			bs.makeURIPath(apiTypeKonnect, "/admin/keys"),
+			bs.managers.Must("oidc").(*oidcProvider.Provider),
+			bs.adminToken,
+			parseSignerAutodetect,
+			logger,
+		))
+		routes = append(routes, server.NewMaintenanceAdminHandler(
+			bs.makeURIPath(apiTypeKonnect, "/admin/maintenance"),
+			maintenance,
+			bs.adminToken,
+			logger,
+		))
+		status := server.NewStatusAdminHandler(
+			bs.makeURIPath(apiTypeKonnect, "/admin/status"),
+			bs.adminToken,
+			logger,
+		)
+		bs.addStatusSources(status, maintenance, limiter)
+		routes = append(routes, status)
+		if bs.allowClaimsPreview {
+			routes = append(routes, oidcProvider.NewClaimsPreviewAdminHandler(
+				bs.makeURIPath(apiTypeKonnect, "/admin/claims-preview"),
+				bs.managers.Must("oidc").(*oidcProvider.Provider),
+				bs.adminToken,
+				logger,
+			))
+		}
+	}
+
+	if len(bs.webFingerResources) > 0 {
+		webFinger, webFingerErr := oidcProvider.NewWebFingerHandler(
+			bs.issuerIdentifierURI.String(),
+			bs.webFingerResources,
+			logger,
+		)
+		if webFingerErr != nil {
+			return nil, fmt.Errorf("failed to create webfinger handler: %v", webFingerErr)
+		}
+		routes = append(routes, webFinger)
+	}
+
+	files := server.NewFilesHandler()
+	if bs.faviconPath != "" {
+		if err = files.AddFile(bs.faviconPath, server.FaviconPath, bs.makeURIPath(apiTypeSignin, "/static/favicon.ico")); err != nil {
+			return nil, fmt.Errorf("failed to load favicon: %v", err)
+		}
+	}
+	if bs.securityTxtPath != "" {
+		if err = files.AddSecurityTxt(bs.securityTxtPath); err != nil {
+			return nil, fmt.Errorf("failed to load security.txt: %v", err)
+		}
+	}
+	if files.Len() > 0 {
+		// NOTE: Routes match in order, so the files are added first to take
+		// precedence over the static files of the sign-in web app.
+		routes = append([]server.WithRoutes{files}, routes...)
+	}
+
+	srv, err := server.NewServer(&server.Config{
+		Config: bs.cfg,
+
+		Handler: bs.managers.Must("handler").(http.Handler),
+		Routes:  routes,
+
+		Maintenance:     maintenance,
+		Limiter:         limiter,
+		SecurityHeaders: securityHeaders,
+
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+
+		EnableH2C: enableH2C,
+
+		Listeners:        listeners,
+		AuxiliaryServers: auxiliaryServers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server: %v", err)
+	}
+
+	return srv, nil
+}
+
+// Reloadable returns true if the accociated Bootstrap has configuration
+// which is reloaded by Reload.
+func (bs *Bootstrap) Reloadable() bool {
+	return bs.identifierAuthoritiesConf != "" || bs.scopesReloader() != nil
+}
+
+// Reload reloads the authorities and scopes configuration of the accociated
+// Bootstrap. On failure the current configuration is kept.
+func (bs *Bootstrap) Reload(ctx context.Context) {
+	logger := bs.cfg.Logger
+
+	if bs.identifierAuthoritiesConf != "" {
+		authorities := bs.managers.Must("authorities").(*identityAuthorities.Registry)
+		logger.WithField("path", bs.identifierAuthoritiesConf).Infoln("reloading authorities registration conf")
+		if reloadErr := authorities.Reload(tracing.NewContext(ctx, bs.cfg.Tracer), bs.identifierAuthoritiesConf); reloadErr != nil {
+			logger.WithError(reloadErr).Errorln("failed to reload authorities registration conf, keeping current authorities")
+		}
+	}
+	if scopesReloader := bs.scopesReloader(); scopesReloader != nil {
+		logger.WithField("path", bs.identifierScopesConf).Infoln("reloading identifier scopes conf")
+		if reloadErr := scopesReloader.ReloadScopes(); reloadErr != nil {
+			logger.WithError(reloadErr).Errorln("failed to reload identifier scopes conf, keeping current scopes")
+		} else {
+			bs.managers.Must("oidc").(*oidcProvider.Provider).RefreshScopesSupported()
+		}
+	}
+}
+
+func (bs *Bootstrap) scopesReloader() identity.ManagerWithScopesReload {
+	if bs.identifierScopesConf == "" {
+		return nil
+	}
+	scopesReloader, _ := bs.managers.Must("identity").(identity.ManagerWithScopesReload)
+
+	return scopesReloader
+}
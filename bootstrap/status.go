@@ -0,0 +1,91 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"context"
+
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+	"stash.kopano.io/kc/konnect/server"
+)
+
+// statusCounter is implemented by managers which can report the number of
+// their active records.
+type statusCounter interface {
+	Count() int
+}
+
+// addStatusSources adds the status sources of the accociated bootstrap's
+// managers and of the provided maintenance and limiter to the provided status
+// handler. The limiter is optional.
+func (bs *Bootstrap) addStatusSources(status *server.StatusAdminHandler, maintenance *server.Maintenance, limiter *server.Limiter) {
+	status.AddSource("maintenance", func(ctx context.Context) interface{} {
+		return maintenance.Enabled()
+	})
+
+	if limiter != nil {
+		status.AddSource("limited_requests", func(ctx context.Context) interface{} {
+			inFlight, max := limiter.InFlight()
+			return map[string]int{
+				"in_flight": inFlight,
+				"max":       max,
+			}
+		})
+	}
+
+	if clients, ok := bs.managers.Get("clients"); ok {
+		registry := clients.(*identityClients.Registry)
+		status.AddSource("clients", func(ctx context.Context) interface{} {
+			return map[string]int{
+				"registered": registry.Count(),
+			}
+		})
+	}
+
+	if authorities, ok := bs.managers.Get("authorities"); ok {
+		registry := authorities.(*identityAuthorities.Registry)
+		status.AddSource("authorities", func(ctx context.Context) interface{} {
+			snapshot := registry.Snapshot(ctx)
+			ready := 0
+			for _, authority := range snapshot.Authorities {
+				if authority.Ready {
+					ready++
+				}
+			}
+			return map[string]interface{}{
+				"registered":  len(snapshot.Authorities),
+				"ready":       ready,
+				"default_id":  snapshot.DefaultID,
+				"authorities": snapshot.Authorities,
+			}
+		})
+	}
+
+	// NOTE: Identifier sessions are kept in cookies only, the refresh token
+	// families are the closest server side count of active sessions.
+	if refresh, ok := bs.managers.Get("refresh"); ok {
+		if counter, ok := refresh.(statusCounter); ok {
+			status.AddSource("refresh_token_families", func(ctx context.Context) interface{} {
+				return map[string]int{
+					"active": counter.Count(),
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,712 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/signing"
+	"stash.kopano.io/kc/konnect/signing/pkcs11"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+func parseJSONWebKey(jsonBytes []byte) (*jose.JSONWebKey, error) {
+	k := &jose.JSONWebKey{}
+	if err := k.UnmarshalJSON(jsonBytes); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadSignerFromFile loads the private key from the provided PEM or JWK file
+// and returns it together with the kid of the file.
+func LoadSignerFromFile(fn string) (string, crypto.Signer, error) {
+	readBytes, errRead := ioutil.ReadFile(fn)
+	if errRead != nil {
+		return "", nil, fmt.Errorf("failed to parse key file: %v", errRead)
+	}
+
+	return parseSigner(readBytes, filepath.Ext(fn))
+}
+
+func parseSigner(readBytes []byte, ext string) (string, crypto.Signer, error) {
+	switch ext {
+	case ".json":
+		k, err := parseJSONWebKey(readBytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse key file as JWK: %v", err)
+		}
+		if !k.Valid() {
+			return "", nil, fmt.Errorf("json file is not a valid JWK")
+		}
+		if k.IsPublic() {
+			return "", nil, fmt.Errorf("JWK is a public key, private key required to use as signer")
+		}
+		signer, ok := k.Key.(crypto.Signer)
+		if !ok {
+			return "", nil, fmt.Errorf("JWS key type %T is not a signer", k.Key)
+		}
+
+		return k.KeyID, signer, nil
+
+	case ".pem":
+		fallthrough
+	default:
+		// Try PEM if not otherwise detected.
+		signer, err := parsePEMSigner(readBytes)
+		return "", signer, err
+	}
+}
+
+// parseSignerAutodetect parses the provided key data as JWK if it looks like
+// JSON and as PEM otherwise.
+func parseSignerAutodetect(readBytes []byte) (string, crypto.Signer, error) {
+	ext := ".pem"
+	if bytes.HasPrefix(bytes.TrimSpace(readBytes), []byte("{")) {
+		ext = ".json"
+	}
+
+	return parseSigner(readBytes, ext)
+}
+
+func parsePEMSigner(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var signer crypto.Signer
+	for {
+		pkcs1Key, errParse1 := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if errParse1 == nil {
+			signer = pkcs1Key
+			break
+		}
+
+		pkcs8Key, errParse2 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if errParse2 == nil {
+			signerSigner, ok := pkcs8Key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("failed to use key as crypto signer")
+			}
+			signer = signerSigner
+			break
+		}
+
+		ecKey, errParse3 := x509.ParseECPrivateKey(block.Bytes)
+		if errParse3 == nil {
+			signer = ecKey
+			break
+		}
+
+		return nil, fmt.Errorf("failed to parse signer key - valid PKCS#1, PKCS#8 ...? %v, %v, %v", errParse1, errParse2, errParse3)
+	}
+
+	return signer, nil
+}
+
+// LoadValidatorFromFile loads the public key from the provided PEM or JWK
+// file and returns it together with the kid of the file.
+func LoadValidatorFromFile(fn string) (string, crypto.PublicKey, error) {
+	readBytes, errRead := ioutil.ReadFile(fn)
+	if errRead != nil {
+		return "", nil, fmt.Errorf("failed to parse key file: %v", errRead)
+	}
+
+	ext := filepath.Ext(fn)
+	switch ext {
+	case ".json":
+		k, err := parseJSONWebKey(readBytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse key file as JWK: %v", err)
+		}
+		if !k.Valid() {
+			return "", nil, fmt.Errorf("json file is not a valid JWK")
+		}
+		if !k.IsPublic() {
+			public := k.Public()
+			k = &public
+		}
+		return k.KeyID, k.Key, nil
+
+	case ".pem":
+		fallthrough
+	default:
+		// Try PEM if not otherwise detected.
+		validator, err := parsePEMValidator(readBytes)
+		return "", validator, err
+	}
+}
+
+func parsePEMValidator(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var validator crypto.PublicKey
+	for {
+		pkixPubKey, errParse0 := x509.ParsePKIXPublicKey(block.Bytes)
+		if errParse0 == nil {
+			validator = pkixPubKey
+			break
+		}
+
+		pkcs1PubKey, errParse1 := x509.ParsePKCS1PublicKey(block.Bytes)
+		if errParse1 == nil {
+			validator = pkcs1PubKey
+			break
+		}
+
+		pkcs1PrivKey, errParse2 := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if errParse2 == nil {
+			validator = pkcs1PrivKey.Public()
+			break
+		}
+
+		pkcs8Key, errParse3 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if errParse3 == nil {
+			signerSigner, ok := pkcs8Key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("failed to use key as crypto signer")
+			}
+			validator = signerSigner.Public()
+			break
+		}
+
+		ecKey, errParse4 := x509.ParseECPrivateKey(block.Bytes)
+		if errParse4 == nil {
+			validator = ecKey.Public()
+			break
+		}
+
+		return nil, fmt.Errorf("failed to parse validator key - valid PKCS#1, PKCS#8 ...? %v, %v, %v, %v, %v", errParse0, errParse1, errParse2, errParse3, errParse4)
+	}
+
+	return validator, nil
+}
+
+func addSignerWithID(value string, kid string, bs *Bootstrap) (string, error) {
+	if strings.HasPrefix(value, pkcs11.URIScheme) {
+		return addSignerWithIDFromPKCS11(value, kid, bs)
+	}
+
+	switch utils.SecretScheme(value) {
+	case "":
+		return addSignerWithIDFromFile(value, kid, bs)
+	case utils.SecretSchemeFile:
+		return addSignerWithIDFromFile(strings.TrimPrefix(value, utils.SecretSchemeFile), kid, bs)
+	}
+
+	source := utils.SecretSource(value, utils.SecretSchemeFile)
+	readBytes, err := utils.ReadSecret(value, utils.SecretSchemeFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load signer key from %s: %v", source, err)
+	}
+
+	// Detect JWK by content, since there is no file extension.
+	ext := ".pem"
+	if strings.HasPrefix(strings.TrimSpace(string(readBytes)), "{") {
+		ext = ".json"
+	}
+	signerKid, signer, err := parseSigner(readBytes, ext)
+	if err != nil {
+		return "", err
+	}
+	if kid == "" {
+		kid = signerKid
+	}
+	notAfter, err := signerNotAfter(readBytes, ext, signer)
+	if err != nil {
+		return "", fmt.Errorf("failed to get expiry of signer key from %s: %v", source, err)
+	}
+
+	kid, err = addSignerWithSource(signer, kid, source, bs)
+	if err != nil {
+		return "", err
+	}
+	setSignerNotAfter(kid, notAfter, bs)
+
+	return kid, nil
+}
+
+func addSignerWithIDFromPKCS11(uri string, kid string, bs *Bootstrap) (string, error) {
+	source := signerSource(uri)
+	signer, err := pkcs11.NewSigner(uri, bs.pkcs11ModulePath, bs.pkcs11PIN)
+	if err != nil {
+		return "", fmt.Errorf("failed to load signer key from %s: %v", source, err)
+	}
+
+	return addSignerWithSource(signer, kid, source, bs)
+}
+
+// addSignerWithSource adds the provided signer with the provided kid, using
+// the thumbprint of the signer's public key if kid is empty.
+func addSignerWithSource(signer crypto.Signer, kid string, source string, bs *Bootstrap) (string, error) {
+	if kid == "" {
+		// Use thumbprint as ID, since there is no file name.
+		thumbprint, thumbprintErr := (&jose.JSONWebKey{Key: signer.Public()}).Thumbprint(crypto.SHA256)
+		if thumbprintErr != nil {
+			return "", fmt.Errorf("failed to create signer key id: %v", thumbprintErr)
+		}
+		kid = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+
+	if duplicate, err := registerKeyID(kid, signer.Public(), source, bs); err != nil {
+		return "", err
+	} else if duplicate {
+		bs.cfg.Logger.WithFields(logrus.Fields{
+			"source": source,
+			"kid":    kid,
+		}).Debugln("skipped as signer with same kid and key already loaded")
+		return kid, nil
+	}
+	bs.cfg.Logger.WithFields(logrus.Fields{
+		"source": source,
+		"kid":    kid,
+	}).Debugln("loaded signer key")
+
+	bs.signers[kid] = signer
+	return kid, nil
+}
+
+// signerSource returns a description of the provided signing key value which
+// is safe to log.
+func signerSource(value string) string {
+	if strings.HasPrefix(value, pkcs11.URIScheme) {
+		// Strip query attributes, since these might include the PIN.
+		return strings.SplitN(value, "?", 2)[0]
+	}
+
+	return utils.SecretSource(value, utils.SecretSchemeFile)
+}
+
+func addSignerWithIDFromFile(fn string, kid string, bs *Bootstrap) (string, error) {
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		return "", fmt.Errorf("failed load load signer key: %v", err)
+	}
+
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		return "", fmt.Errorf("signer key must be a file")
+	}
+	bs.checkKeyFile(fn, false)
+
+	// Load file.
+	signerKid, signer, err := LoadSignerFromFile(fn)
+	if err != nil {
+		return "", err
+	}
+	if kid == "" {
+		kid = signerKid
+	}
+	if kid == "" {
+		// Get ID from file, following symbolic link.
+		var real string
+		if mode&os.ModeSymlink != 0 {
+			real, err = os.Readlink(fn)
+			if err != nil {
+				return "", err
+			}
+			_, real = filepath.Split(real)
+		} else {
+			real = fi.Name()
+		}
+
+		kid = getKeyIDFromFilename(real)
+	}
+
+	if duplicate, err := registerKeyID(kid, signer.Public(), fn, bs); err != nil {
+		return "", err
+	} else if duplicate {
+		bs.cfg.Logger.WithFields(logrus.Fields{
+			"path": fn,
+			"kid":  kid,
+		}).Debugln("skipped as signer with same kid and key already loaded")
+		return kid, nil
+	} else {
+		bs.cfg.Logger.WithFields(logrus.Fields{
+			"path": fn,
+			"kid":  kid,
+		}).Debugln("loaded signer key")
+	}
+
+	notAfter, err := loadSignerNotAfterFromFile(fn, signer)
+	if err != nil {
+		return "", fmt.Errorf("failed to get expiry of signer key %s: %v", fn, err)
+	}
+	setSignerNotAfter(kid, notAfter, bs)
+
+	bs.signers[kid] = signer
+	return kid, nil
+}
+
+// generateSigner creates a new random private key suitable for the provided
+// signing method. A bits value of 0 selects the default key size for the
+// signing method. Returns the signer and its actual key size in bits.
+func generateSigner(signingMethod jwt.SigningMethod, bits int) (crypto.Signer, int, error) {
+	switch sm := signingMethod.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if bits == 0 {
+			bits = defaultSigningKeyBits
+		}
+		if bits < minSigningKeyBits {
+			return nil, 0, fmt.Errorf("RSA signing key bits must be at least %d, got %d", minSigningKeyBits, bits)
+		}
+		signer, err := rsa.GenerateKey(rand.Reader, bits)
+		return signer, bits, err
+	case *jwt.SigningMethodECDSA:
+		var curve elliptic.Curve
+		switch sm.CurveBits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, 0, fmt.Errorf("unsupported curve for signing method: %s", sm.Alg())
+		}
+		if bits != 0 && bits != sm.CurveBits {
+			return nil, 0, fmt.Errorf("signing key bits %d do not match signing method %s, which requires %d", bits, sm.Alg(), sm.CurveBits)
+		}
+		signer, err := ecdsa.GenerateKey(curve, rand.Reader)
+		return signer, sm.CurveBits, err
+	case *signing.SigningMethodEdwardsCurve:
+		if bits != 0 {
+			return nil, 0, fmt.Errorf("signing key bits are not supported for signing method: %s", sm.Alg())
+		}
+		_, signer, err := ed25519.GenerateKey(rand.Reader)
+		return signer, ed25519.PublicKeySize * 8, err
+	default:
+		return nil, 0, fmt.Errorf("unsupported signing method: %s", signingMethod.Alg())
+	}
+}
+
+func validateSigners(bs *Bootstrap) error {
+	haveRSA := false
+	haveECDSA := false
+	haveEd25519 := false
+	for _, signer := range bs.signers {
+		switch s := signer.Public().(type) {
+		case *rsa.PublicKey:
+			// Ensure the private key is not vulnerable with PKCS-1.5 signatures. See
+			// https://paragonie.com/blog/2018/04/protecting-rsa-based-protocols-against-adaptive-chosen-ciphertext-attacks#rsa-anti-bb98
+			// for details.
+			if s.E < 65537 {
+				return fmt.Errorf("RSA signing key with public exponent < 65537")
+			}
+			haveRSA = true
+		case *ecdsa.PublicKey:
+			haveECDSA = true
+		case ed25519.PublicKey:
+			haveEd25519 = true
+		default:
+			return fmt.Errorf("unsupported signer public key type: %T", s)
+		}
+	}
+
+	// Validate signing method
+	switch bs.signingMethod.(type) {
+	case *jwt.SigningMethodRSA:
+		if !haveRSA {
+			return fmt.Errorf("no private key for signing method: %s", bs.signingMethod.Alg())
+		}
+	case *jwt.SigningMethodRSAPSS:
+		if !haveRSA {
+			return fmt.Errorf("no private key for signing method: %s", bs.signingMethod.Alg())
+		}
+	case *jwt.SigningMethodECDSA:
+		if !haveECDSA {
+			return fmt.Errorf("no private key for signing method: %s", bs.signingMethod.Alg())
+		}
+	case *signing.SigningMethodEdwardsCurve:
+		if !haveEd25519 {
+			return fmt.Errorf("no private key for signing method: %s", bs.signingMethod.Alg())
+		}
+	default:
+		return fmt.Errorf("unsupported signing method: %s", bs.signingMethod.Alg())
+	}
+
+	if !haveRSA {
+		bs.cfg.Logger.Warnln("no RSA signing private key, some clients might not be compatible")
+	}
+
+	return nil
+}
+
+// loadPublicKeysFromJWKSFile loads the public keys of the JWKS in the file
+// with the provided name, mapped by kid.
+func loadPublicKeysFromJWKSFile(fn string) (map[string]crypto.PublicKey, error) {
+	readBytes, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks jose.JSONWebKeySet
+	err = json.Unmarshal(readBytes, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %v", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, fmt.Errorf("jwks has no keys")
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range jwks.Keys {
+		if !key.Valid() {
+			return nil, fmt.Errorf("jwks key %#v is not valid", key.KeyID)
+		}
+		if key.KeyID == "" && len(jwks.Keys) > 1 {
+			return nil, fmt.Errorf("jwks key without kid")
+		}
+		if _, ok := keys[key.KeyID]; ok {
+			return nil, fmt.Errorf("jwks kid %#v is used by multiple keys", key.KeyID)
+		}
+		keys[key.KeyID] = key.Public().Key
+	}
+
+	return keys, nil
+}
+
+// Supported strategies to derive the kid of validation keys loaded from
+// files without kid.
+const (
+	validationKeyIDFromFilename   = "filename"
+	validationKeyIDFromThumbprint = "thumbprint"
+	validationKeyIDFromSidecar    = "sidecar"
+)
+
+// addValidatorsFromPath loads all validation keys found in the directory at
+// the provided path. Keys which do not define a kid themselves get a kid
+// derived with the provided strategy. With filename, the file name without
+// extension is used. With thumbprint, the RFC 7638 JWK thumbprint of the key
+// is used. With sidecar, the content of a file with the same name but .kid
+// extension is used, falling back to the file name if there is none.
+func addValidatorsFromPath(pn string, kidStrategy string, bs *Bootstrap) error {
+	fi, err := os.Lstat(pn)
+	if err != nil {
+		return fmt.Errorf("failed load load validator keys: %v", err)
+	}
+
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		// OK.
+	default:
+		return fmt.Errorf("validator path must be a directory")
+	}
+
+	// Load all files.
+	files := []string{}
+	if pemFiles, err := filepath.Glob(filepath.Join(pn, "*.pem")); err != nil {
+		return fmt.Errorf("validator path err: %v", err)
+	} else {
+		files = append(files, pemFiles...)
+	}
+	if jsonFiles, err := filepath.Glob(filepath.Join(pn, "*.json")); err != nil {
+		return fmt.Errorf("validator path err: %v", err)
+	} else {
+		files = append(files, jsonFiles...)
+	}
+
+	for _, file := range files {
+		kid, validator, err := LoadValidatorFromFile(file)
+		if err != nil {
+			bs.cfg.Logger.WithError(err).WithField("path", file).Warnln("failed to load validator key")
+			continue
+		}
+		// NOTE: Validation keys are trusted to validate tokens, so only check
+		// that they cannot be replaced by others.
+		bs.checkKeyFile(file, true)
+
+		if kid == "" {
+			switch kidStrategy {
+			case validationKeyIDFromThumbprint:
+				kid, err = getKeyIDFromThumbprint(validator)
+			case validationKeyIDFromSidecar:
+				kid, err = getKeyIDFromSidecar(file)
+			}
+			if err != nil {
+				bs.cfg.Logger.WithError(err).WithField("path", file).Warnln("failed to get validator key kid")
+				continue
+			}
+		}
+
+		// Get ID from file, without following symbolic links.
+		if kid == "" {
+			_, fn := filepath.Split(file)
+			kid = getKeyIDFromFilename(fn)
+		}
+		if duplicate, err := registerKeyID(kid, validator, file, bs); err != nil {
+			return err
+		} else if duplicate {
+			bs.cfg.Logger.WithFields(logrus.Fields{
+				"path": file,
+				"kid":  kid,
+			}).Debugln("skipped as key with same kid and key already loaded")
+			continue
+		} else {
+			bs.cfg.Logger.WithFields(logrus.Fields{
+				"path": file,
+				"kid":  kid,
+			}).Debugln("loaded validator key")
+		}
+		bs.validators[kid] = validator
+	}
+
+	return nil
+}
+
+// keyIDRecord holds the source and thumbprint of a loaded key to detect kid
+// collisions.
+type keyIDRecord struct {
+	source     string
+	thumbprint []byte
+}
+
+// registerKeyID records the provided public key with the provided kid and
+// source. It returns true if the same key was already registered with that kid
+// and fails when a different key was registered with that kid before, since
+// token validation would be nondeterministic otherwise.
+func registerKeyID(kid string, key crypto.PublicKey, source string, bs *Bootstrap) (bool, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return false, fmt.Errorf("failed to create thumbprint of key %s: %v", source, err)
+	}
+
+	if record, ok := bs.keyIDs[kid]; ok {
+		if !bytes.Equal(record.thumbprint, thumbprint) {
+			return false, fmt.Errorf("kid %#v is used by different keys in %s and %s", kid, record.source, source)
+		}
+		return true, nil
+	}
+
+	bs.keyIDs[kid] = &keyIDRecord{
+		source:     source,
+		thumbprint: thumbprint,
+	}
+	return false, nil
+}
+
+func withSchemeAndHost(u, base *url.URL) *url.URL {
+	if u.Host != "" && u.Scheme != "" {
+		return u
+	}
+
+	r, _ := url.Parse(u.String())
+	r.Scheme = base.Scheme
+	r.Host = base.Host
+
+	return r
+}
+
+func getKeyIDFromFilename(fn string) string {
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext)
+}
+
+// getKeyIDFromThumbprint returns the base64url encoded RFC 7638 JWK
+// thumbprint of the provided key.
+func getKeyIDFromThumbprint(key crypto.PublicKey) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: key}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to create thumbprint: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// getKeyIDFromSidecar returns the kid found in the .kid sidecar file of the
+// key file at the provided path. It returns empty without error if there is
+// no such sidecar file.
+func getKeyIDFromSidecar(fn string) (string, error) {
+	ext := filepath.Ext(fn)
+	readBytes, err := ioutil.ReadFile(strings.TrimSuffix(fn, ext) + ".kid")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read kid file: %v", err)
+	}
+	kid := strings.TrimSpace(string(readBytes))
+	if kid == "" {
+		return "", fmt.Errorf("kid file is empty")
+	}
+
+	return kid, nil
+}
+
+func getCommonURLPathPrefix(p1, p2 string) (string, error) {
+	parts1 := strings.Split(p1, "/")
+	parts2 := strings.Split(p2, "/")
+
+	common := make([]string, 0)
+	for idx, p := range parts1 {
+		if idx >= len(parts2) {
+			break
+		}
+		if p != parts2[idx] {
+			break
+		}
+		common = append(common, p)
+	}
+	if len(common) == 0 {
+		return "", errors.New("no common path prefix")
+	}
+
+	return strings.Join(common, "/"), nil
+}
+
+// parseCookieSameSite returns the http.SameSite value for the provided
+// SameSite cookie attribute name.
+func parseCookieSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+
+	return 0, fmt.Errorf("invalid cookie-samesite value: %v", value)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package bootstrap
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetKeyIDFromThumbprint(t *testing.T) {
+	// NOTE: Key and thumbprint of the example in https://tools.ietf.org/html/rfc7638#section-3.1.
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: 65537,
+	}
+
+	kid, err := getKeyIDFromThumbprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("wrong thumbprint kid: %v", kid)
+	}
+
+	if _, err = getKeyIDFromThumbprint("not a key"); err == nil {
+		t.Error("thumbprint of unsupported key was created")
+	}
+}
+
+func TestGetKeyIDFromSidecar(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "konnectd-sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, fn := range []string{"with-kid", "empty-kid", "dir-kid"} {
+		if err = ioutil.WriteFile(filepath.Join(tempDir, fn+".pem"), []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(tempDir, "with-kid.kid"), []byte(" custom-kid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tempDir, "empty-kid.kid"), []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(tempDir, "dir-kid.kid"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		fn    string
+		kid   string
+		valid bool
+	}{
+		{"with kid", "with-kid.pem", "custom-kid", true},
+		{"without kid", "without-kid.pem", "", true},
+		{"without extension", "with-kid", "custom-kid", true},
+		{"empty kid", "empty-kid.pem", "", false},
+		{"unreadable kid", "dir-kid.pem", "", false},
+	} {
+		kid, err := getKeyIDFromSidecar(filepath.Join(tempDir, test.fn))
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+			continue
+		}
+		if kid != test.kid {
+			t.Errorf("%s: got kid %v want %v", test.name, kid, test.kid)
+		}
+	}
+}
+
+func TestParseCookieSameSite(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected http.SameSite
+		valid    bool
+	}{
+		{"lax", http.SameSiteLaxMode, true},
+		{"Strict", http.SameSiteStrictMode, true},
+		{"NONE", http.SameSiteNoneMode, true},
+		{"", 0, false},
+		{"default", 0, false},
+		{" lax", 0, false},
+	} {
+		sameSite, err := parseCookieSameSite(test.value)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%#v: got valid %v want %v: %v", test.value, valid, test.valid, err)
+			continue
+		}
+		if sameSite != test.expected {
+			t.Errorf("%#v: got samesite %v want %v", test.value, sameSite, test.expected)
+		}
+	}
+}
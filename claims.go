@@ -18,6 +18,7 @@
 package konnect
 
 import (
+	"encoding/json"
 	"errors"
 
 	"github.com/dgrijalva/jwt-go"
@@ -31,8 +32,10 @@ const (
 	AuthorizedScopesClaim = "kc.authorizedScopes"
 	IsRefreshTokenClaim   = "kc.isRefreshToken"
 	RefClaim              = "kc.ref"
+	FamilyClaim           = "kc.family"
 	IdentityClaim         = "kc.identity"
 	IdentityProvider      = "kc.provider"
+	TokenBindingClaim     = "kc.bind"
 )
 
 // Identifier identity sub claims used by Konnect.
@@ -56,6 +59,95 @@ type AccessTokenClaims struct {
 
 	IdentityClaims   jwt.MapClaims `json:"kc.identity"`
 	IdentityProvider string        `json:"kc.provider,omitempty"`
+
+	Confirmation *ConfirmationClaims `json:"cnf,omitempty"`
+
+	Binding *TokenBindingClaims `json:"kc.bind,omitempty"`
+
+	AuthorizedParty string `json:"azp,omitempty"`
+
+	// AudienceList holds all values of the aud claim when decoded. The aud
+	// claim can either be a single string or an array of strings, in the
+	// latter case Audience is set to the first value. When encoded with more
+	// than one value, the aud claim is encoded as array.
+	AudienceList []string `json:"-"`
+
+	// ExtraClaims are added to the top level of the access token when
+	// encoded. They are never decoded into this field.
+	ExtraClaims map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON implements the json.Marshaler interface, adding the extra
+// claims and all audiences of the accociated access token claims.
+func (c AccessTokenClaims) MarshalJSON() ([]byte, error) {
+	type accessTokenClaims AccessTokenClaims
+	b, err := json.Marshal(accessTokenClaims(c))
+	if err != nil || (len(c.ExtraClaims) == 0 && len(c.AudienceList) <= 1) {
+		return b, err
+	}
+
+	claims := make(map[string]interface{})
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	if len(c.AudienceList) > 1 {
+		claims["aud"] = c.AudienceList
+	}
+	for claim, value := range c.ExtraClaims {
+		if _, exists := claims[claim]; !exists {
+			claims[claim] = value
+		}
+	}
+
+	return json.Marshal(claims)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, accepting both
+// string and array values for the aud claim.
+func (c *AccessTokenClaims) UnmarshalJSON(b []byte) error {
+	type accessTokenClaims AccessTokenClaims
+	aux := struct {
+		accessTokenClaims
+		Audience interface{} `json:"aud,omitempty"`
+	}{}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	*c = AccessTokenClaims(aux.accessTokenClaims)
+	switch aud := aux.Audience.(type) {
+	case nil:
+	case string:
+		c.Audience = aud
+		c.AudienceList = []string{aud}
+	case []interface{}:
+		c.AudienceList = make([]string, 0, len(aud))
+		for _, value := range aud {
+			s, ok := value.(string)
+			if !ok {
+				return errors.New("aud claim not valid")
+			}
+			c.AudienceList = append(c.AudienceList, s)
+		}
+		if len(c.AudienceList) > 0 {
+			c.Audience = c.AudienceList[0]
+		}
+	default:
+		return errors.New("aud claim not valid")
+	}
+
+	return nil
+}
+
+// ClientID returns the client ID of the client the accociated access token
+// was issued to. This is the authorized party if set and the audience
+// otherwise.
+func (c AccessTokenClaims) ClientID() string {
+	if c.AuthorizedParty != "" {
+		return c.AuthorizedParty
+	}
+
+	return c.Audience
 }
 
 // Valid implements the jwt.Claims interface.
@@ -85,6 +177,20 @@ func (c AccessTokenClaims) AuthorizedScopes() map[string]bool {
 	return authorizedScopes
 }
 
+// ConfirmationClaims define the confirmation claims of access tokens which are
+// bound to a client certificate as specified at
+// https://tools.ietf.org/html/rfc8705#section-3.1
+type ConfirmationClaims struct {
+	X5tS256 string `json:"x5t#S256,omitempty"`
+}
+
+// TokenBindingClaims define the claims of tokens which are bound to the client
+// IP network and the user agent of the request they were issued for.
+type TokenBindingClaims struct {
+	IPNet         string `json:"net,omitempty"`
+	UserAgentHash string `json:"ua,omitempty"`
+}
+
 // RefreshTokenClaims define the claims used by refresh tokens.
 type RefreshTokenClaims struct {
 	jwt.StandardClaims
@@ -94,8 +200,18 @@ type RefreshTokenClaims struct {
 	ApprovedClaimsRequest *payload.ClaimsRequest `json:"kc.approvedClaims,omitempty"`
 	Ref                   string                 `json:"kc.ref"`
 
+	// Family is set when refresh tokens are rotated and identifies the
+	// lineage of the refresh token.
+	Family string `json:"kc.family,omitempty"`
+
+	// SessionID is the sid of the session in which the refresh token lineage
+	// was issued, so refreshed ID tokens keep it.
+	SessionID string `json:"kc.sid,omitempty"`
+
 	IdentityClaims   jwt.MapClaims `json:"kc.identity"`
 	IdentityProvider string        `json:"kc.provider,omitempty"`
+
+	Binding *TokenBindingClaims `json:"kc.bind,omitempty"`
 }
 
 // Valid implements the jwt.Claims interface.
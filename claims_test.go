@@ -0,0 +1,115 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package konnect
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestAccessTokenClaimsMarshalJSON(t *testing.T) {
+	claims := AccessTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:  "sub",
+			Audience: "client",
+		},
+		IsAccessToken:        true,
+		AuthorizedScopesList: []string{"openid"},
+		ExtraClaims: map[string]interface{}{
+			"tenant": "tenant-a",
+			"roles":  []interface{}{"admin", "user"},
+			"sub":    "someone-else",
+		},
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := make(map[string]interface{})
+	if err = json.Unmarshal(b, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	if encoded["tenant"] != "tenant-a" || !reflect.DeepEqual(encoded["roles"], []interface{}{"admin", "user"}) {
+		t.Errorf("extra claims are missing: %v", encoded)
+	}
+	if encoded["sub"] != "sub" {
+		t.Errorf("extra claim replaced sub: %v", encoded["sub"])
+	}
+	if encoded[IsAccessTokenClaim] != true || encoded["aud"] != "client" {
+		t.Errorf("access token claims are missing: %v", encoded)
+	}
+
+	// Extra claims are never decoded.
+	var decoded AccessTokenClaims
+	if err = json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ExtraClaims != nil || decoded.Subject != "sub" || !decoded.IsAccessToken {
+		t.Errorf("unexpected decoded access token claims: %v", decoded)
+	}
+
+	// Multiple audiences are encoded as array.
+	claims.AudienceList = []string{"client", "https://api.example.com"}
+	b, err = json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = AccessTokenClaims{}
+	if err = json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Audience != "client" || !reflect.DeepEqual(decoded.AudienceList, claims.AudienceList) {
+		t.Errorf("unexpected decoded audiences: %v %v", decoded.Audience, decoded.AudienceList)
+	}
+	claims.AudienceList = nil
+
+	// Without extra claims, the encoding is unchanged.
+	claims.ExtraClaims = nil
+	b, err = json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type accessTokenClaims AccessTokenClaims
+	expected, _ := json.Marshal(accessTokenClaims(claims))
+	if string(b) != string(expected) {
+		t.Errorf("unexpected encoding without extra claims: got %s want %s", b, expected)
+	}
+}
+
+func TestAccessTokenClaimsClientID(t *testing.T) {
+	for _, test := range []struct {
+		audience        string
+		authorizedParty string
+		expected        string
+	}{
+		{"client", "", "client"},
+		{"https://api.example.com", "client", "client"},
+	} {
+		claims := AccessTokenClaims{
+			StandardClaims:  jwt.StandardClaims{Audience: test.audience},
+			AuthorizedParty: test.authorizedParty,
+		}
+		if clientID := claims.ClientID(); clientID != test.expected {
+			t.Errorf("%#v: got %#v want %#v", test.audience, clientID, test.expected)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"stash.kopano.io/kgol/oidc-go"
+)
+
+// Default values used for JWKS caching.
+const (
+	DefaultJWKSCacheDuration      = 5 * time.Minute
+	DefaultJWKSMinRefreshInterval = 30 * time.Second
+)
+
+const jwksSizeLimit = 1024 * 512
+
+// keySet is a cached set of public keys, fetched from a JWKS URI.
+type keySet struct {
+	mutex sync.RWMutex
+
+	uri        string
+	httpClient *http.Client
+
+	keys      map[string]interface{}
+	expires   time.Time
+	fetchedAt time.Time
+
+	cacheDuration      time.Duration
+	minRefreshInterval time.Duration
+}
+
+// Get returns the key with the provided key ID. The key set is refreshed
+// when expired or when the key ID is unknown, at most once per minimal
+// refresh interval.
+func (ks *keySet) Get(ctx context.Context, kid string) (interface{}, error) {
+	ks.mutex.RLock()
+	key, ok := ks.keys[kid]
+	expired := time.Now().After(ks.expires)
+	ks.mutex.RUnlock()
+	if ok && !expired {
+		return key, nil
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// Check again, another Go routine might have refreshed already.
+	key, ok = ks.keys[kid]
+	if ok && time.Now().Before(ks.expires) {
+		return key, nil
+	}
+	if time.Since(ks.fetchedAt) < ks.minRefreshInterval {
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown kid: %s", kid)
+	}
+
+	if err := ks.refresh(ctx); err != nil {
+		if ok {
+			// Keep using the cached key when refresh fails.
+			return key, nil
+		}
+		return nil, err
+	}
+
+	if key, ok = ks.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown kid: %s", kid)
+}
+
+// refresh fetches the keys of the accociated key set. The key set's mutex
+// must be held when calling.
+func (ks *keySet) refresh(ctx context.Context) error {
+	ks.fetchedAt = time.Now()
+
+	req, err := http.NewRequest(http.MethodGet, ks.uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	response, err := ks.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks: unexpected status %d", response.StatusCode)
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err = json.NewDecoder(io.LimitReader(response.Body, jwksSizeLimit)).Decode(&jwks); err != nil {
+		return fmt.Errorf("failed to decode jwks: %v", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if !jwk.Valid() || !jwk.IsPublic() {
+			continue
+		}
+		keys[jwk.KeyID] = jwk.Key
+	}
+	if len(keys) == 0 {
+		return errors.New("jwks contains no signing keys")
+	}
+
+	ks.keys = keys
+	ks.expires = ks.fetchedAt.Add(getCacheDuration(response.Header, ks.cacheDuration))
+
+	return nil
+}
+
+// getCacheDuration returns the duration for which a response with the
+// provided headers can be cached according to its Cache-Control and Expires
+// headers, falling back to the provided default.
+func getCacheDuration(header http.Header, fallback time.Duration) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				if seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+
+	return fallback
+}
+
+// discoverJWKSURI returns the jwks_uri of the provided issuer's discovery
+// document.
+func discoverJWKSURI(ctx context.Context, httpClient *http.Client, issuer string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	response, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch discovery document: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch discovery document: unexpected status %d", response.StatusCode)
+	}
+
+	var wellKnown oidc.WellKnown
+	if err = json.NewDecoder(io.LimitReader(response.Body, jwksSizeLimit)).Decode(&wellKnown); err != nil {
+		return "", fmt.Errorf("failed to decode discovery document: %v", err)
+	}
+	if wellKnown.Issuer != issuer {
+		return "", fmt.Errorf("discovery document issuer mismatch: %s", wellKnown.Issuer)
+	}
+	if wellKnown.JwksURI == "" {
+		return "", errors.New("discovery document has no jwks_uri")
+	}
+
+	return wellKnown.JwksURI, nil
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/signing"
+)
+
+// Config defines a Validator's configuration settings.
+type Config struct {
+	// Issuer is the issuer identifier of the konnect server. It must match
+	// the iss claim of validated tokens.
+	Issuer string
+	// AdditionalIssuers are accepted as iss claim of validated tokens in
+	// addition to Issuer, for example while migrating the issuer's hostname.
+	AdditionalIssuers []string
+	// Audience, if set, must be contained in the aud claim of validated
+	// tokens.
+	Audience string
+
+	// JWKSURI is the URI to fetch the issuer's keys from. If empty, it is
+	// discovered from the issuer's discovery document.
+	JWKSURI string
+
+	HTTPClient *http.Client
+
+	// JWKSCacheDuration is used when the JWKS response has no cache headers.
+	JWKSCacheDuration time.Duration
+	// JWKSMinRefreshInterval limits refreshing of the JWKS when tokens with
+	// unknown key IDs are seen.
+	JWKSMinRefreshInterval time.Duration
+}
+
+// Validator validates tokens issued by a konnect server. A Validator's methods
+// are safe to call from multiple Go routines.
+type Validator struct {
+	issuer   string
+	audience string
+
+	additionalIssuers []string
+
+	httpClient *http.Client
+
+	mutex   sync.Mutex
+	jwksURI string
+	keySet  *keySet
+
+	jwksCacheDuration      time.Duration
+	jwksMinRefreshInterval time.Duration
+}
+
+// NewValidator creates a new Validator with the provided configuration.
+func NewValidator(c *Config) (*Validator, error) {
+	if c.Issuer == "" {
+		return nil, errors.New("issuer is empty")
+	}
+
+	v := &Validator{
+		issuer:   c.Issuer,
+		audience: c.Audience,
+
+		additionalIssuers: c.AdditionalIssuers,
+
+		httpClient: c.HTTPClient,
+		jwksURI:    c.JWKSURI,
+
+		jwksCacheDuration:      c.JWKSCacheDuration,
+		jwksMinRefreshInterval: c.JWKSMinRefreshInterval,
+	}
+	if v.httpClient == nil {
+		v.httpClient = http.DefaultClient
+	}
+	if v.jwksCacheDuration <= 0 {
+		v.jwksCacheDuration = DefaultJWKSCacheDuration
+	}
+	if v.jwksMinRefreshInterval <= 0 {
+		v.jwksMinRefreshInterval = DefaultJWKSMinRefreshInterval
+	}
+
+	return v, nil
+}
+
+// ValidateAccessToken validates the provided access token string and returns
+// its claims.
+func (v *Validator) ValidateAccessToken(ctx context.Context, tokenString string) (*konnect.AccessTokenClaims, error) {
+	claims := &konnect.AccessTokenClaims{}
+	if err := v.Validate(ctx, tokenString, claims, &claims.StandardClaims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// ValidateIDToken validates the provided ID token string and returns its
+// claims. Tokens with a typ header other than JWT are rejected, so that access
+// tokens with typ at+jwt cannot be used as ID tokens.
+func (v *Validator) ValidateIDToken(ctx context.Context, tokenString string) (*konnectoidc.IDTokenClaims, error) {
+	claims := &konnectoidc.IDTokenClaims{}
+	if err := v.validate(ctx, tokenString, claims, &claims.StandardClaims, []string{"JWT", ""}); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Validate parses the provided token string into the provided claims,
+// verifies its signature with the issuer's keys and validates the standard
+// claims iss, aud and exp. The provided standard claims must be the ones
+// embedded in the provided claims.
+func (v *Validator) Validate(ctx context.Context, tokenString string, claims jwt.Claims, standardClaims *jwt.StandardClaims) error {
+	return v.validate(ctx, tokenString, claims, standardClaims, nil)
+}
+
+// validate implements Validate, if types is not nil only tokens with one of
+// the provided typ header values are accepted.
+func (v *Validator) validate(ctx context.Context, tokenString string, claims jwt.Claims, standardClaims *jwt.StandardClaims, types []string) error {
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		return v.getKey(ctx, token)
+	}
+	if types != nil {
+		keyfunc = signing.TypedKeyfunc(keyfunc, types...)
+	}
+	_, err := jwt.ParseWithClaims(tokenString, claims, signing.StrictKeyfunc(keyfunc, nil))
+	if err != nil {
+		return err
+	}
+
+	if !v.verifyIssuer(standardClaims) {
+		return errors.New("iss claim mismatch")
+	}
+	if v.audience != "" && !standardClaims.VerifyAudience(v.audience, true) {
+		return errors.New("aud claim mismatch")
+	}
+	if standardClaims.ExpiresAt == 0 {
+		return errors.New("exp claim missing")
+	}
+
+	return nil
+}
+
+func (v *Validator) getKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA:
+	case *jwt.SigningMethodECDSA:
+	case *jwt.SigningMethodRSAPSS:
+	case *signing.SigningMethodEdwardsCurve:
+	default:
+		return nil, fmt.Errorf("unexpected alg value: %v", token.Header[oidc.JWTHeaderAlg])
+	}
+
+	kid, _ := token.Header[oidc.JWTHeaderKeyID].(string)
+	if kid == "" {
+		return nil, errors.New("no kid header")
+	}
+
+	ks, err := v.getKeySet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks.Get(ctx, kid)
+}
+
+func (v *Validator) getKeySet(ctx context.Context) (*keySet, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.keySet != nil {
+		return v.keySet, nil
+	}
+
+	if v.jwksURI == "" {
+		jwksURI, err := discoverJWKSURI(ctx, v.httpClient, v.issuer)
+		if err != nil {
+			return nil, err
+		}
+		v.jwksURI = jwksURI
+	}
+
+	v.keySet = &keySet{
+		uri:        v.jwksURI,
+		httpClient: v.httpClient,
+
+		cacheDuration:      v.jwksCacheDuration,
+		minRefreshInterval: v.jwksMinRefreshInterval,
+	}
+
+	return v.keySet, nil
+}
+
+// verifyIssuer returns true if the iss claim of the provided standard claims
+// matches the accociated validator's issuer or one of its additional issuers.
+func (v *Validator) verifyIssuer(standardClaims *jwt.StandardClaims) bool {
+	if standardClaims.VerifyIssuer(v.issuer, true) {
+		return true
+	}
+	for _, issuer := range v.additionalIssuers {
+		if standardClaims.VerifyIssuer(issuer, true) {
+			return true
+		}
+	}
+
+	return false
+}
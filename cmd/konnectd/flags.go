@@ -0,0 +1,28 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// addLogLevelFlag adds the log-level flag with the provided default level to
+// the provided flags.
+func addLogLevelFlag(flags *pflag.FlagSet, defaultLevel string) {
+	flags.String("log-level", defaultLevel, "Log level (one of panic, fatal, error, warn, info or debug)")
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestSharedFlags(t *testing.T) {
+	serveFlags := commandServe().Flags()
+	keysFlags := commandKeys().Flags()
+	storeFlags := commandStore().PersistentFlags()
+
+	tests := []struct {
+		name   string
+		flags  *pflag.FlagSet
+		shared []string
+	}{
+		{
+			"keys",
+			keysFlags,
+			[]string{"signing-private-key", "signing-kid", "pkcs11-module", "pkcs11-pin", "validation-keys-path", "validation-keys-kid", "signing-method"},
+		},
+		{
+			"store",
+			storeFlags,
+			[]string{"identifier-registration-conf", "authorities-store", "identifier-consent-store", "identifier-consent-store-path"},
+		},
+	}
+
+	for _, test := range tests {
+		for _, name := range test.shared {
+			expected := serveFlags.Lookup(name)
+			if expected == nil {
+				t.Fatalf("%s: serve has no %s flag", test.name, name)
+			}
+			flag := test.flags.Lookup(name)
+			if flag == nil {
+				t.Errorf("%s: no %s flag", test.name, name)
+				continue
+			}
+			if flag.Usage != expected.Usage {
+				t.Errorf("%s: %s usage differs from serve: %q", test.name, name, flag.Usage)
+			}
+			if flag.DefValue != expected.DefValue {
+				t.Errorf("%s: %s default %q differs from serve %q", test.name, name, flag.DefValue, expected.DefValue)
+			}
+			if flag.Value.Type() != expected.Value.Type() {
+				t.Errorf("%s: %s type %s differs from serve %s", test.name, name, flag.Value.Type(), expected.Value.Type())
+			}
+		}
+	}
+}
+
+func TestLogLevelFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    *pflag.FlagSet
+		expected string
+	}{
+		{"serve", commandServe().Flags(), "info"},
+		{"keys", commandKeys().Flags(), "warn"},
+		{"store", commandStore().PersistentFlags(), "warn"},
+	}
+
+	for _, test := range tests {
+		flag := test.flags.Lookup("log-level")
+		if flag == nil {
+			t.Errorf("%s: no log-level flag", test.name)
+			continue
+		}
+		if flag.DefValue != test.expected {
+			t.Errorf("%s: log-level default %q, expected %q", test.name, flag.DefValue, test.expected)
+		}
+	}
+}
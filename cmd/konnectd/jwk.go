@@ -28,6 +28,8 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/spf13/cobra"
 	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/bootstrap"
 )
 
 func commandJwkFromPem() *cobra.Command {
@@ -61,14 +63,14 @@ func jwkFromPem(cmd *cobra.Command, args []string) error {
 	fn := args[0]
 
 	key, err := func() (interface{}, error) {
-		signerKid, signer, err := loadSignerFromFile(fn)
+		signerKid, signer, err := bootstrap.LoadSignerFromFile(fn)
 		if err == nil {
 			if kid == "" {
 				kid = signerKid
 			}
 			return signer, nil
 		}
-		validatorKid, validator, err := loadValidatorFromFile(fn)
+		validatorKid, validator, err := bootstrap.LoadValidatorFromFile(fn)
 		if err == nil {
 			if kid == "" {
 				kid = validatorKid
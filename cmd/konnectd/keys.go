@@ -0,0 +1,114 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/bootstrap"
+	"stash.kopano.io/kc/konnect/config"
+)
+
+func commandKeys() *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Inspect the JSON Web Key Set created from the signing and validation keys",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := keys(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	bootstrap.AddSigningKeyFlags(keysCmd.Flags())
+	keysCmd.Flags().String("export", "", "Full path to a file where the JSON Web Key Set is written to instead of printing it")
+	addLogLevelFlag(keysCmd.Flags(), "warn")
+
+	return keysCmd
+}
+
+func keys(cmd *cobra.Command, args []string) error {
+	logLevel, _ := cmd.Flags().GetString("log-level")
+
+	logger, err := newLogger(true, logLevel)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %v", err)
+	}
+
+	bs := bootstrap.New(cmd.Flags(), args, &config.Config{
+		Logger: logger,
+	})
+	err = bs.InitializeKeys()
+	if err != nil {
+		return err
+	}
+
+	// Collect public keys the same way as they are published by serve.
+	publicKeys := bs.PublicKeys()
+
+	kids := make([]string, 0, len(publicKeys))
+	for kid := range publicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := &jose.JSONWebKeySet{
+		Keys: make([]jose.JSONWebKey, 0, len(kids)),
+	}
+	for _, kid := range kids {
+		key := jose.JSONWebKey{Key: publicKeys[kid], KeyID: kid, Use: "sig"}
+		if !key.Valid() {
+			return fmt.Errorf("key %#v is not valid", kid)
+		}
+		jwks.Keys = append(jwks.Keys, key)
+	}
+
+	b, err := json.Marshal(jwks)
+	if err != nil {
+		return fmt.Errorf("failed to encode as json: %v", err)
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to format json: %v", err)
+	}
+	out.WriteString("\n")
+
+	fmt.Fprintf(os.Stderr, "Active signing kid: %s (%s)\n", bs.ActiveSigningKeyID(), bs.SigningMethod().Alg())
+
+	exportFn, _ := cmd.Flags().GetString("export")
+	if exportFn != "" {
+		err = ioutil.WriteFile(exportFn, out.Bytes(), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to export: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "JSON Web Key Set with %d keys written to %s\n", len(jwks.Keys), exportFn)
+		return nil
+	}
+
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
@@ -28,6 +28,8 @@ func main() {
 	cmd.RootCmd.AddCommand(commandServe())
 	cmd.RootCmd.AddCommand(commandUtils())
 	cmd.RootCmd.AddCommand(commandHealthcheck())
+	cmd.RootCmd.AddCommand(commandKeys())
+	cmd.RootCmd.AddCommand(commandStore())
 
 	if err := cmd.RootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
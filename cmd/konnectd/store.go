@@ -0,0 +1,328 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"stash.kopano.io/kc/konnect/bootstrap"
+	"stash.kopano.io/kc/konnect/identifier"
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+)
+
+func commandStore() *cobra.Command {
+	storeCmd := &cobra.Command{
+		Use:   "store",
+		Short: "Validate, migrate and inspect the configured stores",
+		Long:  "Validate, migrate and inspect the client registration conf, the managed authorities store and the identifier consent store. Stop all konnectd instances which use the stores before migrating them.",
+	}
+	bootstrap.AddStoreFlags(storeCmd.PersistentFlags())
+	addLogLevelFlag(storeCmd.PersistentFlags(), "warn")
+
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Validate all entries of the configured stores",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := storeCheck(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	dumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Print the entries of the configured stores as JSON, with secrets redacted",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := storeDump(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Rewrite the configured stores in the current format",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := storeMigrate(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	migrateCmd.Flags().Bool("dry-run", false, "Only report what would be migrated")
+
+	storeCmd.AddCommand(checkCmd)
+	storeCmd.AddCommand(dumpCmd)
+	storeCmd.AddCommand(migrateCmd)
+
+	return storeCmd
+}
+
+// storeTargets are the stores which are selected with the store command
+// flags.
+type storeTargets struct {
+	registrationConf string
+	authoritiesStore string
+	consentStore     identifier.ConsentStoreMaintainer
+
+	logger logrus.FieldLogger
+}
+
+func newStoreTargets(cmd *cobra.Command) (*storeTargets, error) {
+	logLevel, _ := cmd.Flags().GetString("log-level")
+	logger, err := newLogger(true, logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create logger: %v", err)
+	}
+
+	targets := &storeTargets{
+		logger: logger,
+	}
+	targets.registrationConf, _ = cmd.Flags().GetString("identifier-registration-conf")
+	targets.authoritiesStore, _ = cmd.Flags().GetString("authorities-store")
+
+	consentStore, _ := cmd.Flags().GetString("identifier-consent-store")
+	switch consentStore {
+	case "", "none", "memory":
+		// NOTE: The memory consent store keeps nothing to inspect.
+	case "file":
+		consentStorePath, _ := cmd.Flags().GetString("identifier-consent-store-path")
+		if info, statErr := os.Stat(consentStorePath); statErr != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid identifier-consent-store-path value, folder not found: %v", consentStorePath)
+		}
+		store, storeErr := identifier.NewFileConsentStore(consentStorePath)
+		if storeErr != nil {
+			return nil, fmt.Errorf("invalid identifier-consent-store-path value: %v", storeErr)
+		}
+		targets.consentStore = store.(identifier.ConsentStoreMaintainer)
+	default:
+		return nil, fmt.Errorf("unsupported identifier-consent-store value: %v", consentStore)
+	}
+
+	if targets.registrationConf == "" && targets.authoritiesStore == "" && targets.consentStore == nil {
+		return nil, fmt.Errorf("no store selected, use --identifier-registration-conf, --authorities-store or --identifier-consent-store")
+	}
+
+	return targets, nil
+}
+
+func storeCheck(cmd *cobra.Command, args []string) error {
+	targets, err := newStoreTargets(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	invalidCount := 0
+
+	if targets.registrationConf != "" {
+		clients, invalid, checkErr := identityClients.CheckRegistrationConf(targets.registrationConf, targets.logger)
+		if checkErr != nil {
+			return fmt.Errorf("failed to check identifier-registration-conf: %v", checkErr)
+		}
+		for idx, client := range clients {
+			if invalid[idx] != nil {
+				fmt.Printf("clients: entry %d (%s) is invalid: %v\n", idx, client.ID, invalid[idx])
+			}
+		}
+		fmt.Printf("clients: %d entries, %d invalid\n", len(clients), len(invalid))
+		invalidCount += len(invalid)
+	}
+
+	if targets.authoritiesStore != "" {
+		authorities, invalid, checkErr := identityAuthorities.CheckStore(targets.authoritiesStore, targets.logger)
+		if checkErr != nil {
+			return fmt.Errorf("failed to check authorities-store: %v", checkErr)
+		}
+		for idx, authority := range authorities {
+			if invalid[idx] != nil {
+				fmt.Printf("authorities: entry %d (%s) is invalid: %v\n", idx, authority.ID, invalid[idx])
+			}
+		}
+		fmt.Printf("authorities: %d entries, %d invalid\n", len(authorities), len(invalid))
+		invalidCount += len(invalid)
+	}
+
+	if targets.consentStore != nil {
+		count := 0
+		invalid := 0
+		walkErr := targets.consentStore.WalkConsent(ctx, func(key string, consent *identifier.Consent, err error) error {
+			count++
+			if err != nil {
+				fmt.Printf("consent: entry %s is invalid: %v\n", key, err)
+				invalid++
+			}
+			return nil
+		})
+		if walkErr != nil {
+			return fmt.Errorf("failed to check identifier-consent-store: %v", walkErr)
+		}
+		fmt.Printf("consent: %d entries, %d invalid\n", count, invalid)
+		invalidCount += invalid
+	}
+
+	if invalidCount > 0 {
+		return fmt.Errorf("found %d invalid entries", invalidCount)
+	}
+
+	return nil
+}
+
+func storeDump(cmd *cobra.Command, args []string) error {
+	targets, err := newStoreTargets(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	dump := make(map[string]interface{})
+
+	if targets.registrationConf != "" {
+		clients, _, checkErr := identityClients.CheckRegistrationConf(targets.registrationConf, targets.logger)
+		if checkErr != nil {
+			return fmt.Errorf("failed to read identifier-registration-conf: %v", checkErr)
+		}
+		entries := make([]map[string]interface{}, 0, len(clients))
+		for _, client := range clients {
+			// NOTE: Client registrations only encode their public metadata.
+			entries = append(entries, map[string]interface{}{
+				"id":           client.ID,
+				"trusted":      client.Trusted,
+				"insecure":     client.Insecure,
+				"registration": client,
+			})
+		}
+		dump["clients"] = entries
+	}
+
+	if targets.authoritiesStore != "" {
+		authorities, _, checkErr := identityAuthorities.CheckStore(targets.authoritiesStore, targets.logger)
+		if checkErr != nil {
+			return fmt.Errorf("failed to read authorities-store: %v", checkErr)
+		}
+		entries := make([]map[string]interface{}, 0, len(authorities))
+		for _, authority := range authorities {
+			entry, entryErr := redactedJSONMap(authority, "client_secret")
+			if entryErr != nil {
+				return entryErr
+			}
+			entries = append(entries, entry)
+		}
+		dump["authorities"] = entries
+	}
+
+	if targets.consentStore != nil {
+		entries := make([]map[string]interface{}, 0)
+		walkErr := targets.consentStore.WalkConsent(ctx, func(key string, consent *identifier.Consent, err error) error {
+			entry := map[string]interface{}{
+				"key": key,
+			}
+			if err != nil {
+				entry["error"] = err.Error()
+			} else {
+				entry["consent"] = consent
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if walkErr != nil {
+			return fmt.Errorf("failed to read identifier-consent-store: %v", walkErr)
+		}
+		dump["consent"] = entries
+	}
+
+	b, err := json.Marshal(dump)
+	if err != nil {
+		return fmt.Errorf("failed to encode as json: %v", err)
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to format json: %v", err)
+	}
+	out.WriteString("\n")
+
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
+
+func storeMigrate(cmd *cobra.Command, args []string) error {
+	targets, err := newStoreTargets(cmd)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	verb := "migrated"
+	if dryRun {
+		verb = "would be migrated"
+	}
+
+	if targets.registrationConf != "" {
+		fmt.Println("clients: identifier-registration-conf is maintained manually and never migrated")
+	}
+
+	if targets.authoritiesStore != "" {
+		changed, migrateErr := identityAuthorities.MigrateStore(targets.authoritiesStore, dryRun, targets.logger)
+		if migrateErr != nil {
+			return fmt.Errorf("failed to migrate authorities-store: %v", migrateErr)
+		}
+		if changed {
+			fmt.Printf("authorities: store %s\n", verb)
+		} else {
+			fmt.Println("authorities: store is current")
+		}
+	}
+
+	if targets.consentStore != nil {
+		migrated, migrateErr := targets.consentStore.MigrateConsent(ctx, dryRun)
+		if migrateErr != nil {
+			return fmt.Errorf("failed to migrate identifier-consent-store: %v", migrateErr)
+		}
+		fmt.Printf("consent: %d entries %s\n", migrated, verb)
+	}
+
+	return nil
+}
+
+// redactedJSONMap returns the JSON object representation of the provided
+// value with the values of the provided keys redacted.
+func redactedJSONMap(v interface{}, keys ...string) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if value, ok := m[key]; ok && value != "" {
+			m[key] = "[redacted]"
+		}
+	}
+
+	return m, nil
+}
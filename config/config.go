@@ -21,14 +21,26 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/audit"
+	"stash.kopano.io/kc/konnect/geoip"
+	"stash.kopano.io/kc/konnect/tracing"
 )
 
 // Config defines a Server's configuration settings.
 type Config struct {
-	ListenAddr string
+	// ListenAddrs are the addresses to listen on for incoming connections.
+	// Addresses with unix: prefix are Unix domain socket paths, addresses
+	// with fd: prefix are inherited listening file descriptors and all others
+	// are TCP addresses.
+	ListenAddrs []string
 
 	WithMetrics bool
+	// MetricsRegisterer is used to register metrics when WithMetrics is
+	// enabled. If nil, prometheus.DefaultRegisterer is used.
+	MetricsRegisterer prometheus.Registerer
 
 	Logger        logrus.FieldLogger
 	HTTPTransport http.RoundTripper
@@ -36,7 +48,45 @@ type Config struct {
 	TrustedProxyIPs  []*net.IP
 	TrustedProxyNets []*net.IPNet
 
+	// TrustedProxyClientIPHeader and TrustedProxyProtoHeader are the request
+	// headers read from trusted proxies to find the client IP and the scheme
+	// of the original request.
+	TrustedProxyClientIPHeader string
+	TrustedProxyProtoHeader    string
+
+	ClientCertificateHeader string
+
+	// CookieSameSite, CookieInsecure and CookieDomain define the attributes
+	// of cookies set by konnect. SessionCookiePath replaces the path of the
+	// identifier logon session cookie when not empty.
+	CookieSameSite    http.SameSite
+	CookieInsecure    bool
+	CookieDomain      string
+	SessionCookiePath string
+
+	// GeoIP is used to enrich log entries with coarse location information
+	// of client IP addresses. If nil, no location information is logged.
+	GeoIP *geoip.GeoIP
+
+	// Tracer is used to create and export tracing spans. If nil, no spans
+	// are created.
+	Tracer *tracing.Tracer
+
+	// AuditWebhook receives audit events of token issuance and logout. If
+	// nil, no audit events are sent.
+	AuditWebhook *audit.Webhook
+
 	AllowedScopes                  []string
 	AllowClientGuests              bool
 	AllowDynamicClientRegistration bool
 }
+
+// Registerer returns the registerer for metrics of the accociated Config,
+// which is MetricsRegisterer or prometheus.DefaultRegisterer if not set.
+func (c *Config) Registerer() prometheus.Registerer {
+	if c.MetricsRegisterer != nil {
+		return c.MetricsRegisterer
+	}
+
+	return prometheus.DefaultRegisterer
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"net/http"
+)
+
+// ApplyCookieAttributes sets the configured cookie attributes of the
+// accociated Config on the provided cookie.
+func (c *Config) ApplyCookieAttributes(cookie *http.Cookie) {
+	cookie.SameSite = c.CookieSameSite
+	cookie.Secure = !c.CookieInsecure
+	if c.CookieDomain != "" {
+		cookie.Domain = c.CookieDomain
+	}
+}
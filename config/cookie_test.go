@@ -0,0 +1,56 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplyCookieAttributes(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   *Config
+		domain   string
+		expected http.Cookie
+	}{
+		{"defaults", &Config{}, "", http.Cookie{Secure: true}},
+		{"same site", &Config{CookieSameSite: http.SameSiteStrictMode}, "", http.Cookie{SameSite: http.SameSiteStrictMode, Secure: true}},
+		{"insecure", &Config{CookieSameSite: http.SameSiteLaxMode, CookieInsecure: true}, "", http.Cookie{SameSite: http.SameSiteLaxMode}},
+		{"domain", &Config{CookieDomain: "example.com"}, "", http.Cookie{Secure: true, Domain: "example.com"}},
+		{"keeps domain", &Config{}, "konnect.example.com", http.Cookie{Secure: true, Domain: "konnect.example.com"}},
+		{"replaces domain", &Config{CookieDomain: "example.com"}, "konnect.example.com", http.Cookie{Secure: true, Domain: "example.com"}},
+	} {
+		cookie := &http.Cookie{
+			Name:     "test",
+			Value:    "value",
+			Path:     "/signin/",
+			HttpOnly: true,
+			Domain:   test.domain,
+			Secure:   test.config.CookieInsecure,
+		}
+		test.config.ApplyCookieAttributes(cookie)
+
+		if cookie.SameSite != test.expected.SameSite || cookie.Secure != test.expected.Secure || cookie.Domain != test.expected.Domain {
+			t.Errorf("%s: got samesite %v secure %v domain %#v want samesite %v secure %v domain %#v", test.name, cookie.SameSite, cookie.Secure, cookie.Domain, test.expected.SameSite, test.expected.Secure, test.expected.Domain)
+		}
+		if cookie.Name != "test" || cookie.Value != "value" || cookie.Path != "/signin/" || !cookie.HttpOnly {
+			t.Errorf("%s: unrelated cookie attributes were changed: %v", test.name, cookie)
+		}
+	}
+}
@@ -32,6 +32,11 @@ type key int
 // connect.FromClaimsContext instead of using this key directly.
 var claimsKey key
 
+// requestIDKey is the key for request IDs in contexts. It is unexported;
+// clients use konnect.NewRequestIDContext and konnect.FromRequestIDContext
+// instead of using this key directly.
+var requestIDKey key = 1
+
 // NewClaimsContext returns a new Context that carries value auth.
 func NewClaimsContext(ctx context.Context, claims jwt.Claims) context.Context {
 	return context.WithValue(ctx, claimsKey, claims)
@@ -42,3 +47,15 @@ func FromClaimsContext(ctx context.Context) (jwt.Claims, bool) {
 	claims, ok := ctx.Value(claimsKey).(jwt.Claims)
 	return claims, ok
 }
+
+// NewRequestIDContext returns a new Context that carries the provided request
+// ID.
+func NewRequestIDContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// FromRequestIDContext returns the request ID value stored in ctx, if any.
+func FromRequestIDContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey).(string)
+	return requestID, ok
+}
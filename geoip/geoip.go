@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package geoip provides coarse geolocation and autonomous system information
+// for IP addresses from MaxMind DB files to enrich log entries.
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// Log field names set by GeoIP.
+const (
+	FieldCountry = "geo_country"
+	FieldASN     = "geo_asn"
+	FieldASOrg   = "geo_as_org"
+)
+
+// privateNets are the networks for which no lookups are done.
+var privateNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// GeoIP looks up country and autonomous system information of IP addresses
+// in MaxMind DB files like GeoLite2-Country, GeoLite2-City and GeoLite2-ASN.
+// A nil GeoIP is valid and never returns any information.
+type GeoIP struct {
+	readers []*maxminddb.Reader
+}
+
+// A Location holds the country and autonomous system information of an IP
+// address. Values which are not known are empty.
+type Location struct {
+	Country string
+	ASN     uint64
+	ASOrg   string
+}
+
+// record holds the values of the MaxMind DB databases used by GeoIP.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint64 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// New opens the MaxMind DB files at the provided paths and returns a GeoIP
+// which looks up IP addresses in all of them.
+func New(paths ...string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("failed to open geoip database %v: %v", path, err)
+		}
+		g.readers = append(g.readers, r)
+	}
+
+	return g, nil
+}
+
+// Close closes the databases of the accociated GeoIP.
+func (g *GeoIP) Close() error {
+	if g == nil {
+		return nil
+	}
+
+	var err error
+	for _, r := range g.readers {
+		if closeErr := r.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	g.readers = nil
+
+	return err
+}
+
+// DatabaseTypes returns the database types of the accociated GeoIP's
+// databases.
+func (g *GeoIP) DatabaseTypes() []string {
+	if g == nil {
+		return nil
+	}
+
+	types := make([]string, 0, len(g.readers))
+	for _, r := range g.readers {
+		types = append(types, r.Metadata.DatabaseType)
+	}
+
+	return types
+}
+
+// Lookup returns the country and autonomous system information found for the
+// provided IP address in all databases. Nil is returned for invalid, private
+// or otherwise non public IP addresses and when nothing is found.
+func (g *GeoIP) Lookup(ipString string) *Location {
+	if g == nil || len(g.readers) == 0 {
+		return nil
+	}
+
+	ip := net.ParseIP(ipString)
+	if !isPublicIP(ip) {
+		return nil
+	}
+
+	location := &Location{}
+	for _, r := range g.readers {
+		var value record
+		if err := r.Lookup(ip, &value); err != nil {
+			continue
+		}
+		if value.Country.ISOCode != "" {
+			location.Country = value.Country.ISOCode
+		}
+		if value.ASN != 0 {
+			location.ASN = value.ASN
+		}
+		if value.ASOrg != "" {
+			location.ASOrg = value.ASOrg
+		}
+	}
+	if *location == (Location{}) {
+		return nil
+	}
+
+	return location
+}
+
+// Fields returns the log fields with country and autonomous system
+// information found for the provided IP address. Fields which are not found
+// are omitted, no fields are returned for invalid, private or otherwise non
+// public IP addresses.
+func (g *GeoIP) Fields(ipString string) logrus.Fields {
+	fields := logrus.Fields{}
+
+	location := g.Lookup(ipString)
+	if location == nil {
+		return fields
+	}
+	if location.Country != "" {
+		fields[FieldCountry] = location.Country
+	}
+	if location.ASN != 0 {
+		fields[FieldASN] = location.ASN
+	}
+	if location.ASOrg != "" {
+		fields[FieldASOrg] = location.ASOrg
+	}
+
+	return fields
+}
+
+// isPublicIP returns true if the provided IP address is a public unicast IP
+// address.
+func isPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, privateNet := range privateNets {
+		if privateNet.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
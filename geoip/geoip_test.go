@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// metadataStartMarker marks the start of the metadata section of MaxMind DB
+// files as specified at https://maxmind.github.io/MaxMind-DB/.
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparatorSize is the size of the zero bytes between the search
+// tree and the data section.
+const dataSectionSeparatorSize = 16
+
+// Data field types of the MaxMind DB format used by the tests.
+const (
+	typePointer = 1
+	typeString  = 2
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+)
+
+func encodeControl(typeNum int, size int) []byte {
+	var extra []byte
+	if size >= 29 {
+		// NOTE: Test values are always shorter than 285 bytes.
+		extra = []byte{byte(size - 29)}
+		size = 29
+	}
+	b := []byte{byte(typeNum<<5 | size)}
+	if typeNum > 7 {
+		b = []byte{byte(size), byte(typeNum - 7)}
+	}
+	return append(b, extra...)
+}
+
+func encodeString(s string) []byte {
+	return append(encodeControl(typeString, len(s)), s...)
+}
+
+func encodeUint(typeNum int, value uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	b = bytes.TrimLeft(b, "\x00")
+	return append(encodeControl(typeNum, len(b)), b...)
+}
+
+func encodePointer(offset int) []byte {
+	return []byte{byte(typePointer<<5 | (offset>>8)&0x7), byte(offset)}
+}
+
+func encodeMap(values map[string][]byte) []byte {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := encodeControl(typeMap, len(values))
+	for _, key := range keys {
+		b = append(b, encodeString(key)...)
+		b = append(b, values[key]...)
+	}
+	return b
+}
+
+func encodeNode(recordSize int, left, right uint32) []byte {
+	switch recordSize {
+	case 24:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+	case 28:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte((left>>24)<<4 | (right >> 24)), byte(right >> 16), byte(right >> 8), byte(right)}
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, left)
+		binary.BigEndian.PutUint32(b[4:], right)
+		return b
+	}
+}
+
+// makeTestDatabase returns an IPv4 MaxMind DB with a single record for
+// 81.0.0.0/8 using the provided record size.
+func makeTestDatabase(recordSize int) []byte {
+	// Data section, the country code is referenced by pointer.
+	data := encodeString("DE")
+	recordOffset := len(data)
+	data = append(data, encodeMap(map[string][]byte{
+		"country": encodeMap(map[string][]byte{
+			"iso_code": encodePointer(0),
+		}),
+		"autonomous_system_number":       encodeUint(typeUint32, 3320),
+		"autonomous_system_organization": encodeString("Example AS"),
+	})...)
+
+	// Search tree following the bits of 81 (01010001).
+	nodeCount := 8
+	record := uint32(nodeCount + dataSectionSeparatorSize + recordOffset)
+	var tree []byte
+	for i := 0; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = record
+		}
+		if (81>>(7-uint(i)))&1 == 0 {
+			tree = append(tree, encodeNode(recordSize, next, uint32(nodeCount))...)
+		} else {
+			tree = append(tree, encodeNode(recordSize, uint32(nodeCount), next)...)
+		}
+	}
+
+	buf := append(tree, make([]byte, dataSectionSeparatorSize)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataStartMarker...)
+	buf = append(buf, encodeMap(map[string][]byte{
+		"binary_format_major_version": encodeUint(typeUint16, 2),
+		"node_count":                  encodeUint(typeUint32, uint32(nodeCount)),
+		"record_size":                 encodeUint(typeUint16, uint32(recordSize)),
+		"ip_version":                  encodeUint(typeUint16, 4),
+		"database_type":               encodeString("Test"),
+	})...)
+
+	return buf
+}
+
+func TestGeoIPFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konnect-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, recordSize := range []int{24, 28, 32} {
+		path := filepath.Join(dir, fmt.Sprintf("test-%d.mmdb", recordSize))
+		if err = ioutil.WriteFile(path, makeTestDatabase(recordSize), 0600); err != nil {
+			t.Fatal(err)
+		}
+		g, err := New(path)
+		if err != nil {
+			t.Fatalf("record size %d: %v", recordSize, err)
+		}
+		defer g.Close()
+
+		if types := g.DatabaseTypes(); len(types) != 1 || types[0] != "Test" {
+			t.Errorf("record size %d: unexpected database types: %v", recordSize, types)
+		}
+		if location := g.Lookup("81.2.3.4"); location == nil || *location != (Location{Country: "DE", ASN: 3320, ASOrg: "Example AS"}) {
+			t.Errorf("record size %d: unexpected location: %v", recordSize, location)
+		}
+		if location := g.Lookup("82.2.3.4"); location != nil {
+			t.Errorf("record size %d: unexpected location for unknown ip: %v", recordSize, location)
+		}
+
+		fields := g.Fields("81.2.3.4")
+		if fields[FieldCountry] != "DE" || fields[FieldASN] != uint64(3320) || fields[FieldASOrg] != "Example AS" {
+			t.Errorf("record size %d: unexpected fields: %v", recordSize, fields)
+		}
+		for _, ip := range []string{"82.2.3.4", "10.1.2.3", "127.0.0.1", "::1", "invalid"} {
+			if fields := g.Fields(ip); len(fields) != 0 {
+				t.Errorf("record size %d: unexpected fields for %v: %v", recordSize, ip, fields)
+			}
+		}
+	}
+
+	invalid := filepath.Join(dir, "invalid.mmdb")
+	if err = ioutil.WriteFile(invalid, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = New(invalid); err == nil {
+		t.Errorf("invalid database was opened")
+	}
+
+	var g *GeoIP
+	if fields := g.Fields("81.2.3.4"); len(fields) != 0 {
+		t.Errorf("nil geoip returned fields: %v", fields)
+	}
+	if location := g.Lookup("81.2.3.4"); location != nil {
+		t.Errorf("nil geoip returned location: %v", location)
+	}
+}
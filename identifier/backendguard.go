@@ -0,0 +1,337 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/identifier/backends"
+)
+
+// DefaultBackendBreakerDuration is the duration for which requests to the
+// backend fail immediately after the circuit breaker opened, if not configured
+// otherwise.
+const DefaultBackendBreakerDuration = 30 * time.Second
+
+// backendRetryDelay is the delay before the first retry of a failed backend
+// lookup. It doubles with every further retry.
+const backendRetryDelay = 100 * time.Millisecond
+
+// Circuit breaker states of the backend.
+const (
+	backendBreakerStateClosed   = "closed"
+	backendBreakerStateOpen     = "open"
+	backendBreakerStateHalfOpen = "half_open"
+)
+
+// ErrBackendUnavailable is returned for requests to the backend while its
+// circuit breaker is open.
+var ErrBackendUnavailable = errors.New("identifier backend unavailable")
+
+// backendBreaker is a circuit breaker which opens after the threshold of
+// consecutive failed backend requests is reached. While open, requests are
+// rejected. After the duration, a single request is allowed to probe the
+// backend, closing the breaker again on success.
+type backendBreaker struct {
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	threshold int
+	duration  time.Duration
+
+	logger logrus.FieldLogger
+}
+
+func newBackendBreaker(threshold int, duration time.Duration, logger logrus.FieldLogger) *backendBreaker {
+	b := &backendBreaker{
+		threshold: threshold,
+		duration:  duration,
+
+		logger: logger,
+	}
+	b.setState(backendBreakerStateClosed)
+
+	return b
+}
+
+// Allow returns true if a request to the backend may be made now. A nil
+// breaker always allows requests.
+func (b *backendBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case backendBreakerStateOpen:
+		if time.Since(b.openedAt) < b.duration {
+			return false
+		}
+		b.setState(backendBreakerStateHalfOpen)
+		b.probing = true
+		return true
+	case backendBreakerStateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Succeed records a successful backend request, closing the breaker.
+func (b *backendBreaker) Succeed() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != backendBreakerStateClosed {
+		b.setState(backendBreakerStateClosed)
+		b.logger.Infoln("identifier backend recovered, circuit breaker closed")
+	}
+}
+
+// Fail records a failed backend request, opening the breaker when the
+// threshold is reached or when the request was probing the backend.
+func (b *backendBreaker) Fail() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	b.failures++
+	if b.state == backendBreakerStateHalfOpen || (b.state == backendBreakerStateClosed && b.failures >= b.threshold) {
+		b.setState(backendBreakerStateOpen)
+		b.openedAt = time.Now()
+		b.logger.WithFields(logrus.Fields{
+			"failures": b.failures,
+			"duration": b.duration,
+		}).Warnln("identifier backend is failing, circuit breaker opened")
+	}
+}
+
+// Release records a backend request which ended without result, for example
+// because the client went away, allowing another request to probe the
+// backend.
+func (b *backendBreaker) Release() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	b.probing = false
+	b.mutex.Unlock()
+}
+
+// State returns the current state of the accociated breaker.
+func (b *backendBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+// setState sets the provided state and updates the state metric. It must be
+// called with the accociated breaker's mutex locked.
+func (b *backendBreaker) setState(state string) {
+	b.state = state
+	for _, s := range []string{backendBreakerStateClosed, backendBreakerStateOpen, backendBreakerStateHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		backendBreakerState.WithLabelValues(s).Set(value)
+	}
+}
+
+// guardedBackend is a backends.Backend which limits the duration of requests
+// to the wrapped Backend, retries failed lookups of users and fails fast with
+// ErrBackendUnavailable while the Backend is failing.
+type guardedBackend struct {
+	backends.Backend
+
+	timeout time.Duration
+	retries int
+	breaker *backendBreaker
+}
+
+type backendLogonResult struct {
+	success    bool
+	userID     *string
+	sessionRef *string
+	claims     map[string]interface{}
+}
+
+// Logon implements the backends.Backend interface. Logons are never retried,
+// since failed attempts might count against the user at the backend.
+func (g *guardedBackend) Logon(ctx context.Context, audience, username, password string) (bool, *string, *string, map[string]interface{}, error) {
+	result, err := g.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		success, userID, sessionRef, claims, err := g.Backend.Logon(ctx, audience, username, password)
+		return &backendLogonResult{success, userID, sessionRef, claims}, err
+	})
+	if err != nil {
+		return false, nil, nil, nil, err
+	}
+
+	logon := result.(*backendLogonResult)
+	return logon.success, logon.userID, logon.sessionRef, logon.claims, nil
+}
+
+// GetUser implements the backends.Backend interface.
+func (g *guardedBackend) GetUser(ctx context.Context, userID string, sessionRef *string) (backends.UserFromBackend, error) {
+	result, err := g.do(ctx, true, func(ctx context.Context) (interface{}, error) {
+		return g.Backend.GetUser(ctx, userID, sessionRef)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := result.(backends.UserFromBackend)
+	return user, nil
+}
+
+// ResolveUserByUsername implements the backends.Backend interface.
+func (g *guardedBackend) ResolveUserByUsername(ctx context.Context, username string) (backends.UserFromBackend, error) {
+	result, err := g.do(ctx, true, func(ctx context.Context) (interface{}, error) {
+		return g.Backend.ResolveUserByUsername(ctx, username)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := result.(backends.UserFromBackend)
+	return user, nil
+}
+
+// RefreshSession implements the backends.Backend interface.
+func (g *guardedBackend) RefreshSession(ctx context.Context, userID string, sessionRef *string, claims map[string]interface{}) error {
+	_, err := g.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return nil, g.Backend.RefreshSession(ctx, userID, sessionRef, claims)
+	})
+
+	return err
+}
+
+// DestroySession implements the backends.Backend interface.
+func (g *guardedBackend) DestroySession(ctx context.Context, sessionRef *string) error {
+	_, err := g.do(ctx, false, func(ctx context.Context) (interface{}, error) {
+		return nil, g.Backend.DestroySession(ctx, sessionRef)
+	})
+
+	return err
+}
+
+// do runs the provided request against the wrapped backend, retrying it up to
+// the configured retries if retry is true.
+func (g *guardedBackend) do(ctx context.Context, retry bool, request func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	attempts := 1
+	if retry {
+		attempts += g.retries
+	}
+
+	var result interface{}
+	var err error
+	delay := backendRetryDelay
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		if !g.breaker.Allow() {
+			backendBreakerRejections.Inc()
+			return nil, ErrBackendUnavailable
+		}
+		result, err = g.call(ctx, request)
+		switch {
+		case err == nil:
+			g.breaker.Succeed()
+			return result, nil
+		case err == backends.ErrAmbiguousUser:
+			// NOTE: The backend answered, ambiguous users are a data issue
+			// which retries cannot resolve.
+			g.breaker.Succeed()
+			return nil, err
+		case ctx.Err() != nil:
+			// NOTE: The request ended since the caller is gone, which says
+			// nothing about the backend.
+			g.breaker.Release()
+			return nil, err
+		default:
+			g.breaker.Fail()
+		}
+	}
+
+	return nil, err
+}
+
+// call runs the provided request, returning an error when it does not finish
+// within the configured timeout. Results of requests which finish after the
+// timeout are discarded.
+func (g *guardedBackend) call(ctx context.Context, request func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if g.timeout <= 0 {
+		return request(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	type response struct {
+		result interface{}
+		err    error
+	}
+	responseCh := make(chan *response, 1)
+	go func() {
+		result, err := request(ctx)
+		responseCh <- &response{result, err}
+	}()
+
+	select {
+	case r := <-responseCh:
+		return r.result, r.err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("identifier backend request timed out after %v", g.timeout)
+		}
+		return nil, ctx.Err()
+	}
+}
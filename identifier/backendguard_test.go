@@ -0,0 +1,215 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/identifier/backends"
+)
+
+type flakyTestBackend struct {
+	backends.Backend
+
+	mutex  sync.Mutex
+	calls  int
+	failed int
+	delay  time.Duration
+	err    error
+}
+
+func (b *flakyTestBackend) request(ctx context.Context) error {
+	b.mutex.Lock()
+	b.calls++
+	fail := b.calls <= b.failed
+	delay := b.delay
+	b.mutex.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	if fail {
+		if b.err != nil {
+			return b.err
+		}
+		return errors.New("backend failure")
+	}
+	return nil
+}
+
+func (b *flakyTestBackend) Logon(ctx context.Context, audience, username, password string) (bool, *string, *string, map[string]interface{}, error) {
+	if err := b.request(ctx); err != nil {
+		return false, nil, nil, nil, err
+	}
+	return true, &username, nil, nil, nil
+}
+
+func (b *flakyTestBackend) GetUser(ctx context.Context, userID string, sessionRef *string) (backends.UserFromBackend, error) {
+	if err := b.request(ctx); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *flakyTestBackend) Calls() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.calls
+}
+
+func newTestBackendBreaker(threshold int, duration time.Duration) *backendBreaker {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	return newBackendBreaker(threshold, duration, logger)
+}
+
+func TestGuardedBackendRetries(t *testing.T) {
+	backend := &flakyTestBackend{failed: 2}
+	g := &guardedBackend{
+		Backend: backend,
+		retries: 2,
+	}
+
+	if _, err := g.GetUser(context.Background(), "user", nil); err != nil {
+		t.Fatalf("lookup failed despite retries: %v", err)
+	}
+	if calls := backend.Calls(); calls != 3 {
+		t.Errorf("wrong number of lookups: got %d want 3", calls)
+	}
+
+	// Logons are never retried.
+	backend = &flakyTestBackend{failed: 1}
+	g.Backend = backend
+	if success, userID, _, _, err := g.Logon(context.Background(), "", "user", "pass"); err == nil || success || userID != nil {
+		t.Errorf("logon succeeded despite failure")
+	}
+	if calls := backend.Calls(); calls != 1 {
+		t.Errorf("logon was retried: got %d calls want 1", calls)
+	}
+	if success, userID, _, _, err := g.Logon(context.Background(), "", "user", "pass"); err != nil || !success || userID == nil || *userID != "user" {
+		t.Errorf("logon failed: %v %v %v", success, userID, err)
+	}
+}
+
+func TestGuardedBackendTimeout(t *testing.T) {
+	backend := &flakyTestBackend{delay: time.Second}
+	g := &guardedBackend{
+		Backend: backend,
+		timeout: 10 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if _, err := g.GetUser(context.Background(), "user", nil); err == nil {
+		t.Errorf("lookup did not time out")
+	}
+	if elapsed := time.Since(start); elapsed >= backend.delay {
+		t.Errorf("lookup did not fail fast: took %v", elapsed)
+	}
+}
+
+func TestGuardedBackendBreaker(t *testing.T) {
+	backend := &flakyTestBackend{failed: 3}
+	g := &guardedBackend{
+		Backend: backend,
+		breaker: newTestBackendBreaker(2, 20*time.Millisecond),
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.GetUser(context.Background(), "user", nil); err == nil || err == ErrBackendUnavailable {
+			t.Fatalf("lookup %d returned wrong error: %v", i, err)
+		}
+	}
+	if state := g.breaker.State(); state != backendBreakerStateOpen {
+		t.Fatalf("breaker not open after threshold: %s", state)
+	}
+	if _, err := g.GetUser(context.Background(), "user", nil); err != ErrBackendUnavailable {
+		t.Errorf("open breaker did not fail fast: %v", err)
+	}
+	if calls := backend.Calls(); calls != 2 {
+		t.Errorf("open breaker did not reject request: got %d calls want 2", calls)
+	}
+
+	// A failing probe opens the breaker again.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := g.GetUser(context.Background(), "user", nil); err == nil || err == ErrBackendUnavailable {
+		t.Errorf("probe returned wrong error: %v", err)
+	}
+	if state := g.breaker.State(); state != backendBreakerStateOpen {
+		t.Fatalf("breaker not open after failed probe: %s", state)
+	}
+
+	// A successful probe closes the breaker.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := g.GetUser(context.Background(), "user", nil); err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+	if state := g.breaker.State(); state != backendBreakerStateClosed {
+		t.Errorf("breaker not closed after recovery: %s", state)
+	}
+}
+
+func TestGuardedBackendAmbiguousUser(t *testing.T) {
+	backend := &flakyTestBackend{failed: 3, err: backends.ErrAmbiguousUser}
+	g := &guardedBackend{
+		Backend: backend,
+		retries: 2,
+		breaker: newTestBackendBreaker(1, time.Minute),
+	}
+
+	if _, err := g.GetUser(context.Background(), "user", nil); err != backends.ErrAmbiguousUser {
+		t.Errorf("lookup returned wrong error: %v", err)
+	}
+	if calls := backend.Calls(); calls != 1 {
+		t.Errorf("ambiguous lookup was retried: got %d calls want 1", calls)
+	}
+	if state := g.breaker.State(); state != backendBreakerStateClosed {
+		t.Errorf("breaker opened for ambiguous user: %s", state)
+	}
+}
+
+func TestBackendBreakerSingleProbe(t *testing.T) {
+	b := newTestBackendBreaker(1, time.Nanosecond)
+
+	b.Fail()
+	time.Sleep(time.Millisecond)
+	if !b.Allow() {
+		t.Fatalf("breaker did not allow probe after duration")
+	}
+	if b.Allow() {
+		t.Errorf("breaker allowed second request while probing")
+	}
+	b.Release()
+	if !b.Allow() {
+		t.Errorf("breaker did not allow probe after release")
+	}
+	b.Succeed()
+	if state := b.State(); state != backendBreakerStateClosed {
+		t.Errorf("breaker not closed after success: %s", state)
+	}
+}
@@ -19,11 +19,29 @@ package backends
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode"
 
 	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
 	"stash.kopano.io/kc/konnect/identity"
 )
 
+// ErrAmbiguousUser is returned by backends when a username matches more than
+// one user and the backend's ambiguous user policy does not select one of them.
+var ErrAmbiguousUser = errors.New("ambiguous user")
+
+// Ambiguous user policies, defining what backends do when a username matches
+// more than one user.
+const (
+	// AmbiguousUserPolicyDeny fails with ErrAmbiguousUser.
+	AmbiguousUserPolicyDeny = "deny"
+	// AmbiguousUserPolicyFirst uses the first of the matching users in a
+	// deterministic, backend specific order.
+	AmbiguousUserPolicyFirst = "first"
+)
+
 // A Backend is an identifier Backend providing functionality to logon and to
 // fetch user meta data.
 type Backend interface {
@@ -50,3 +68,98 @@ type UserFromBackend interface {
 	identity.UserWithUsername
 	BackendClaims() map[string]interface{}
 }
+
+// Credential complexity classes of a CredentialPolicy.
+const (
+	CredentialComplexityLower  = "lower"
+	CredentialComplexityUpper  = "upper"
+	CredentialComplexityDigit  = "digit"
+	CredentialComplexitySymbol = "symbol"
+)
+
+// ErrCredentialPolicy is returned when a credential does not meet the
+// requirements of a CredentialPolicy.
+var ErrCredentialPolicy = errors.New("credential does not meet policy")
+
+// A CredentialPolicy describes the requirements for the credentials of users
+// of a Backend and when users get locked out after failed logon attempts. The
+// lockout threshold counts failures per username, the remote lockout threshold
+// counts failures per client IP across all usernames.
+type CredentialPolicy struct {
+	MinLength  int      `json:"minLength,omitempty"`
+	Complexity []string `json:"complexity,omitempty"`
+
+	LockoutThreshold       int           `json:"lockoutThreshold,omitempty"`
+	RemoteLockoutThreshold int           `json:"-"`
+	LockoutDuration        time.Duration `json:"-"`
+}
+
+// Validate validates the associated credential policy and returns error if
+// it is not valid.
+func (cp *CredentialPolicy) Validate() error {
+	if cp.MinLength < 0 {
+		return fmt.Errorf("invalid min length: %d", cp.MinLength)
+	}
+	for _, complexity := range cp.Complexity {
+		switch complexity {
+		case CredentialComplexityLower, CredentialComplexityUpper, CredentialComplexityDigit, CredentialComplexitySymbol:
+		default:
+			return fmt.Errorf("unknown complexity value: %s", complexity)
+		}
+	}
+	if cp.LockoutThreshold < 0 {
+		return fmt.Errorf("invalid lockout threshold: %d", cp.LockoutThreshold)
+	}
+	if cp.RemoteLockoutThreshold < 0 {
+		return fmt.Errorf("invalid remote lockout threshold: %d", cp.RemoteLockoutThreshold)
+	}
+	if (cp.LockoutThreshold > 0 || cp.RemoteLockoutThreshold > 0) && cp.LockoutDuration <= 0 {
+		return fmt.Errorf("invalid lockout duration: %v", cp.LockoutDuration)
+	}
+
+	return nil
+}
+
+// ValidateCredential checks the provided credential against the minimum length
+// and the complexity classes of the associated credential policy and returns
+// ErrCredentialPolicy if it does not meet them.
+func (cp *CredentialPolicy) ValidateCredential(credential string) error {
+	if len([]rune(credential)) < cp.MinLength {
+		return ErrCredentialPolicy
+	}
+	for _, complexity := range cp.Complexity {
+		var check func(rune) bool
+		switch complexity {
+		case CredentialComplexityLower:
+			check = unicode.IsLower
+		case CredentialComplexityUpper:
+			check = unicode.IsUpper
+		case CredentialComplexityDigit:
+			check = unicode.IsDigit
+		case CredentialComplexitySymbol:
+			check = func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+			}
+		default:
+			return ErrCredentialPolicy
+		}
+		found := false
+		for _, r := range credential {
+			if check(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrCredentialPolicy
+		}
+	}
+
+	return nil
+}
+
+// A BackendWithCredentialPolicy is a Backend which declares the
+// CredentialPolicy of its users.
+type BackendWithCredentialPolicy interface {
+	CredentialPolicy() *CredentialPolicy
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package backends
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCredentialPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *CredentialPolicy
+		valid  bool
+	}{
+		{"empty", &CredentialPolicy{}, true},
+		{"complexity", &CredentialPolicy{MinLength: 8, Complexity: []string{CredentialComplexityLower, CredentialComplexitySymbol}}, true},
+		{"lockout", &CredentialPolicy{LockoutThreshold: 5, RemoteLockoutThreshold: 50, LockoutDuration: time.Minute}, true},
+		{"negative min length", &CredentialPolicy{MinLength: -1}, false},
+		{"unknown complexity", &CredentialPolicy{Complexity: []string{"emoji"}}, false},
+		{"negative remote lockout threshold", &CredentialPolicy{RemoteLockoutThreshold: -1}, false},
+		{"remote lockout without duration", &CredentialPolicy{RemoteLockoutThreshold: 5}, false},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestCredentialPolicyValidateCredential(t *testing.T) {
+	policy := &CredentialPolicy{
+		MinLength:  8,
+		Complexity: []string{CredentialComplexityLower, CredentialComplexityUpper, CredentialComplexityDigit, CredentialComplexitySymbol},
+	}
+
+	tests := []struct {
+		name       string
+		credential string
+		valid      bool
+	}{
+		{"all classes", "Secret-42", true},
+		{"non ascii", "Größe-42x", true},
+		{"too short", "Se-42", false},
+		{"multibyte too short", "Ää-4ääa", false},
+		{"no lower", "SECRET-42", false},
+		{"no upper", "secret-42", false},
+		{"no digit", "Secret-xy", false},
+		{"no symbol", "Secret420", false},
+		{"space is no symbol", "Secret 42", false},
+	}
+
+	for _, test := range tests {
+		err := policy.ValidateCredential(test.credential)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err != ErrCredentialPolicy {
+			t.Errorf("%s: expected ErrCredentialPolicy, got %v", test.name, err)
+		}
+	}
+
+	if err := (&CredentialPolicy{}).ValidateCredential("x"); err != nil {
+		t.Errorf("empty policy rejected credential: %v", err)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -42,6 +43,10 @@ import (
 
 const ldapIdentifierBackendName = "identifier-ldap"
 
+// ldapAmbiguousUserSizeLimit is the maximum number of entries searched for a
+// username with the first ambiguous user policy.
+const ldapAmbiguousUserSizeLimit = 100
+
 var ldapSupportedScopes = []string{
 	oidc.ScopeProfile,
 	oidc.ScopeEmail,
@@ -71,6 +76,8 @@ type LDAPIdentifierBackend struct {
 
 	timeout int
 	limiter *rate.Limiter
+
+	ambiguousUserPolicy string
 }
 
 type ldapAttributeMapping map[string]string
@@ -210,7 +217,8 @@ func NewLDAPIdentifierBackend(
 	bindPassword,
 	baseDN,
 	scopeString,
-	filter string,
+	filter,
+	ambiguousUserPolicy string,
 	subAttributes []string,
 	mappedAttributes map[string]string,
 ) (*LDAPIdentifierBackend, error) {
@@ -250,6 +258,16 @@ func NewLDAPIdentifierBackend(
 		if err != nil {
 			break
 		}
+		switch ambiguousUserPolicy {
+		case "":
+			ambiguousUserPolicy = AmbiguousUserPolicyDeny
+		case AmbiguousUserPolicyDeny, AmbiguousUserPolicyFirst:
+		default:
+			err = fmt.Errorf("unknown ambiguous user policy value: %v, must be one of deny or first", ambiguousUserPolicy)
+		}
+		if err != nil {
+			break
+		}
 
 		break
 	}
@@ -334,6 +352,8 @@ func NewLDAPIdentifierBackend(
 
 		timeout: 60,                        //XXX(longsleep): make timeout configuration.
 		limiter: rate.NewLimiter(100, 200), //XXX(longsleep): make rate limits configuration.
+
+		ambiguousUserPolicy: ambiguousUserPolicy,
 	}
 
 	b.logger.WithField("ldap", fmt.Sprintf("%s://%s ", uri.Scheme, addr)).Infoln("ldap server identifier backend set up")
@@ -365,6 +385,8 @@ func (b *LDAPIdentifierBackend) Logon(ctx context.Context, audience, username, p
 	switch {
 	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
 		return false, nil, nil, nil, nil
+	case err == ErrAmbiguousUser:
+		return false, nil, nil, nil, err
 	}
 	if err != nil {
 		return false, nil, nil, nil, fmt.Errorf("ldap identifier backend logon search error: %v", err)
@@ -421,6 +443,8 @@ func (b *LDAPIdentifierBackend) ResolveUserByUsername(ctx context.Context, usern
 	switch {
 	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
 		return nil, nil
+	case err == ErrAmbiguousUser:
+		return nil, err
 	}
 	if err != nil {
 		return nil, fmt.Errorf("ldap identifier backend resolve search error: %v", err)
@@ -544,15 +568,25 @@ func (b *LDAPIdentifierBackend) connect(parentCtx context.Context) (*ldap.Conn,
 
 func (b *LDAPIdentifierBackend) searchUsername(l *ldap.Conn, username string, attributes []string) (*ldap.Entry, error) {
 	base, filter := b.baseAndSearchFilterFromUsername(username)
+	// NOTE: Search for more than one entry, to detect when the username is
+	// ambiguous. With the first policy, all entries are needed for ordering.
+	sizeLimit := 2
+	if b.ambiguousUserPolicy == AmbiguousUserPolicyFirst {
+		sizeLimit = ldapAmbiguousUserSizeLimit
+	}
 	// Search for the given username.
 	searchRequest := ldap.NewSearchRequest(
 		base,
-		b.scope, ldap.NeverDerefAliases, 1, b.timeout, false,
+		b.scope, ldap.NeverDerefAliases, sizeLimit, b.timeout, false,
 		filter,
 		attributes,
 		nil,
 	)
 	sr, err := l.Search(searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		// Too many matched to select one.
+		return nil, ErrAmbiguousUser
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -564,10 +598,24 @@ func (b *LDAPIdentifierBackend) searchUsername(l *ldap.Conn, username string, at
 	case 1:
 		// Exactly one found, success.
 		return sr.Entries[0], nil
-	default:
-		// Invalid when multiple matched.
-		return nil, fmt.Errorf("user too many entries returned")
 	}
+
+	// Multiple matched.
+	if b.ambiguousUserPolicy != AmbiguousUserPolicyFirst {
+		return nil, ErrAmbiguousUser
+	}
+	entries := make([]*ldap.Entry, len(sr.Entries))
+	copy(entries, sr.Entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].DN) < strings.ToLower(entries[j].DN)
+	})
+	b.logger.WithFields(logrus.Fields{
+		"username": username,
+		"count":    len(entries),
+		"dn":       entries[0].DN,
+	}).Warnln("ldap identifier backend username matches multiple entries, using first by DN")
+
+	return entries[0], nil
 }
 
 func (b *LDAPIdentifierBackend) getUser(l *ldap.Conn, entryID string, attributes []string) (*ldap.Entry, error) {
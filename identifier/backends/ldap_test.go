@@ -0,0 +1,158 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// serveTestLDAPSearch answers the search requests received on the provided
+// connection with the provided entries, which are returned up to the size
+// limit of the request. Returns when the connection is closed.
+func serveTestLDAPSearch(conn net.Conn, entries []*ldap.Entry) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		if len(packet.Children) < 2 || packet.Children[1].Tag != ldap.ApplicationSearchRequest {
+			continue
+		}
+		messageID := packet.Children[0].Value.(int64)
+		sizeLimit := int(packet.Children[1].Children[3].Value.(int64))
+
+		resultCode := ldap.LDAPResultSuccess
+		for idx, entry := range entries {
+			if sizeLimit > 0 && idx >= sizeLimit {
+				resultCode = ldap.LDAPResultSizeLimitExceeded
+				break
+			}
+			response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+			response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+			attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+			for _, attribute := range entry.Attributes {
+				encoded := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+				encoded.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "Name"))
+				values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+				for _, value := range attribute.Values {
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+				}
+				encoded.AppendChild(values)
+				attributes.AppendChild(encoded)
+			}
+			response.AppendChild(attributes)
+			writeTestLDAPResponse(conn, messageID, response)
+		}
+
+		done := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultDone, nil, "Search Result Done")
+		done.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(resultCode), "Result Code"))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+		writeTestLDAPResponse(conn, messageID, done)
+	}
+}
+
+func writeTestLDAPResponse(conn net.Conn, messageID int64, response *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(response)
+	conn.Write(packet.Bytes())
+}
+
+func newTestLDAPEntries(count int) []*ldap.Entry {
+	entries := make([]*ldap.Entry, 0, count)
+	// NOTE: Entries are returned in reverse DN order, to check the ordering
+	// of the first policy.
+	for idx := count; idx > 0; idx-- {
+		entries = append(entries, ldap.NewEntry(fmt.Sprintf("uid=user,ou=org-%d,dc=example,dc=com", idx), map[string][]string{
+			"uid": {"user"},
+		}))
+	}
+
+	return entries
+}
+
+func TestLDAPIdentifierBackendSearchUsername(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, test := range []struct {
+		name    string
+		policy  string
+		entries int
+		dn      string
+		err     error
+	}{
+		{"deny unique", AmbiguousUserPolicyDeny, 1, "uid=user,ou=org-1,dc=example,dc=com", nil},
+		{"deny ambiguous", AmbiguousUserPolicyDeny, 2, "", ErrAmbiguousUser},
+		{"deny size limit", AmbiguousUserPolicyDeny, 3, "", ErrAmbiguousUser},
+		{"first unique", AmbiguousUserPolicyFirst, 1, "uid=user,ou=org-1,dc=example,dc=com", nil},
+		{"first ambiguous", AmbiguousUserPolicyFirst, 3, "uid=user,ou=org-1,dc=example,dc=com", nil},
+		{"first size limit", AmbiguousUserPolicyFirst, ldapAmbiguousUserSizeLimit + 1, "", ErrAmbiguousUser},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go serveTestLDAPSearch(serverConn, newTestLDAPEntries(test.entries))
+
+		l := ldap.NewConn(clientConn, false)
+		l.Start()
+
+		b := &LDAPIdentifierBackend{
+			baseDN:       "dc=example,dc=com",
+			scope:        ldap.ScopeWholeSubtree,
+			searchFilter: "(uid=%s)",
+			logger:       logger,
+
+			ambiguousUserPolicy: test.policy,
+		}
+		entry, err := b.searchUsername(l, "user", []string{"uid"})
+		l.Close()
+
+		if err != test.err {
+			t.Errorf("%s: got error %v want %v", test.name, err, test.err)
+			continue
+		}
+		if test.dn != "" && (entry == nil || entry.DN != test.dn) {
+			t.Errorf("%s: got entry %v want %v", test.name, entry, test.dn)
+		}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go serveTestLDAPSearch(serverConn, nil)
+	l := ldap.NewConn(clientConn, false)
+	l.Start()
+	defer l.Close()
+
+	b := &LDAPIdentifierBackend{
+		baseDN:       "dc=example,dc=com",
+		scope:        ldap.ScopeWholeSubtree,
+		searchFilter: "(uid=%s)",
+		logger:       logger,
+	}
+	if _, err := b.searchUsername(l, "user", []string{"uid"}); !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		t.Errorf("unknown user: got error %v", err)
+	}
+}
@@ -19,6 +19,12 @@ package identifier
 
 // Additional claims as used by the identifier in its own tokens.
 const (
-	SessionIDClaim  = "sid"
-	UserClaimsClaim = "claims"
+	SessionIDClaim   = "sid"
+	UserClaimsClaim  = "claims"
+	ACRClaim         = "acr"
+	AMRClaim         = "amr"
+	AuthorityIDClaim = "authority_id"
+	ActiveAtClaim    = "active_at"
+
+	SubjectAttributeClaim = "subject_attribute"
 )
@@ -19,6 +19,7 @@ package identifier
 
 import (
 	"net/url"
+	"time"
 
 	"stash.kopano.io/kc/konnect/config"
 	"stash.kopano.io/kc/konnect/identifier/backends"
@@ -34,7 +35,68 @@ type Config struct {
 	LogonCookieName string
 	ScopesConf      string
 
+	// StaticMaxAge is the duration for which static web app assets with a
+	// content hash in their filename may be cached, DefaultStaticMaxAge if
+	// not set. StaticCompression enables compressed responses for static
+	// assets, preferring precompressed .br and .gz files in the StaticFolder.
+	StaticMaxAge      time.Duration
+	StaticCompression bool
+
 	AuthorizationEndpointURI *url.URL
 
+	// ClockSkew is the allowed clock difference to authorities when
+	// validating the time claims of their ID tokens.
+	ClockSkew time.Duration
+
+	// CredentialPolicy is exposed to the identifier web app and enforced
+	// when the Backend does not declare its own policy.
+	CredentialPolicy *backends.CredentialPolicy
+
+	// SessionMaxLifetime, if set, ends logon sessions when the time since the
+	// user signed in exceeds it. SessionIdleTimeout, if set, ends logon
+	// sessions which have not been used interactively within it.
+	SessionMaxLifetime time.Duration
+	SessionIdleTimeout time.Duration
+
+	// AuthorityFallback is the policy applied when the default authority is
+	// unavailable. With AuthorityFallbackLocal, the local sign-in is used
+	// instead while the default authority is not ready and for
+	// AuthorityFallbackDuration after konnect observed a failure of it like a
+	// failed discovery, otherwise the default authority is always used.
+	AuthorityFallback         string
+	AuthorityFallbackDuration time.Duration
+
+	// AuthorityChooser enables the authority chooser page, which lets users
+	// select the authority to sign in with when the sign-in request has no
+	// authority_id and its login hint resolves to no authority. It lists the
+	// ready authorities which would not fall back to the local sign-in and
+	// the local sign-in, if it can be used without authority. The page is
+	// skipped when there is nothing to choose from.
+	AuthorityChooser bool
+
+	// TemplatesPath, if set, is the directory from which templates are loaded
+	// which replace the built-in server rendered pages with the same name.
+	TemplatesPath string
+
+	// ConsentStore, if set, remembers consent decisions which users asked to
+	// be remembered.
+	ConsentStore ConsentStore
+
+	// BackendTimeout, if set, limits the duration of every request to the
+	// Backend. Failed lookups of users are retried up to BackendRetries
+	// times, logons are never retried. If BackendBreakerThreshold is set,
+	// requests to the Backend fail immediately with ErrBackendUnavailable for
+	// BackendBreakerDuration after that many consecutive requests failed.
+	// Afterwards a single request probes whether the Backend recovered.
+	BackendTimeout          time.Duration
+	BackendRetries          int
+	BackendBreakerThreshold int
+	BackendBreakerDuration  time.Duration
+
+	// SubjectAttribute is the user attribute the local subject is derived
+	// from. Its value is kept in the logon cookie, so that the user does not
+	// need to be looked up at the Backend to get the subject.
+	SubjectAttribute string
+
 	Backend backends.Backend
 }
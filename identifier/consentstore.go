@@ -0,0 +1,272 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A ConsentStore is a interface defining storage of remembered consent
+// decisions, keyed by subject and client.
+type ConsentStore interface {
+	// Get returns the remembered Consent of the provided subject for the
+	// provided client, or nil if there is none.
+	Get(ctx context.Context, sub string, clientID string) (*Consent, error)
+	// Set remembers the provided Consent of the provided subject for the
+	// provided client, replacing any previously remembered Consent.
+	Set(ctx context.Context, sub string, clientID string, consent *Consent) error
+	// Revoke forgets the remembered Consent of the provided subject for the
+	// provided client.
+	Revoke(ctx context.Context, sub string, clientID string) error
+}
+
+// A ConsentStoreMaintainer is a ConsentStore which supports maintenance of
+// its remembered consent while no other instance is using it.
+type ConsentStoreMaintainer interface {
+	// WalkConsent calls the provided function for each remembered Consent with
+	// its key. Entries which cannot be read are passed with their error.
+	WalkConsent(ctx context.Context, f func(key string, consent *Consent, err error) error) error
+	// MigrateConsent rewrites all entries which are not in the current format
+	// and removes stale temporary data. Returns the number of changed entries
+	// which, if dryRun is true, would be changed.
+	MigrateConsent(ctx context.Context, dryRun bool) (int, error)
+}
+
+// consentStoreKey returns the key of the provided subject and client. The
+// key is hashed, so it is safe to be used as file name.
+func consentStoreKey(sub string, clientID string) string {
+	h := sha256.New()
+	h.Write([]byte(sub))
+	h.Write([]byte{0})
+	h.Write([]byte(clientID))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type memoryConsentStore struct {
+	sync.RWMutex
+	table map[string]*Consent
+}
+
+// NewMemoryConsentStore creates a new ConsentStore which keeps remembered
+// consent in memory. Remembered consent is lost on restart.
+func NewMemoryConsentStore() ConsentStore {
+	return &memoryConsentStore{
+		table: make(map[string]*Consent),
+	}
+}
+
+// Get implements the ConsentStore interface.
+func (s *memoryConsentStore) Get(ctx context.Context, sub string, clientID string) (*Consent, error) {
+	s.RLock()
+	consent, _ := s.table[consentStoreKey(sub, clientID)]
+	s.RUnlock()
+
+	if consent == nil {
+		return nil, nil
+	}
+	c := *consent
+
+	return &c, nil
+}
+
+// Set implements the ConsentStore interface.
+func (s *memoryConsentStore) Set(ctx context.Context, sub string, clientID string, consent *Consent) error {
+	c := *consent
+
+	s.Lock()
+	s.table[consentStoreKey(sub, clientID)] = &c
+	s.Unlock()
+
+	return nil
+}
+
+// Revoke implements the ConsentStore interface.
+func (s *memoryConsentStore) Revoke(ctx context.Context, sub string, clientID string) error {
+	s.Lock()
+	delete(s.table, consentStoreKey(sub, clientID))
+	s.Unlock()
+
+	return nil
+}
+
+type fileConsentStore struct {
+	path string
+}
+
+// NewFileConsentStore creates a new ConsentStore which keeps remembered
+// consent as files in the folder at the provided path, creating the folder
+// if it does not exist. The folder can be shared between multiple instances.
+func NewFileConsentStore(path string) (ConsentStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("consent store path is empty")
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create consent store folder: %v", err)
+	}
+
+	return &fileConsentStore{
+		path: path,
+	}, nil
+}
+
+func (s *fileConsentStore) filename(sub string, clientID string) string {
+	return filepath.Join(s.path, consentStoreKey(sub, clientID)+".json")
+}
+
+// Get implements the ConsentStore interface.
+func (s *fileConsentStore) Get(ctx context.Context, sub string, clientID string) (*Consent, error) {
+	b, err := ioutil.ReadFile(s.filename(sub, clientID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var consent Consent
+	if err = json.Unmarshal(b, &consent); err != nil {
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+// Set implements the ConsentStore interface.
+func (s *fileConsentStore) Set(ctx context.Context, sub string, clientID string, consent *Consent) error {
+	b, err := json.Marshal(consent)
+	if err != nil {
+		return err
+	}
+
+	return s.write(s.filename(sub, clientID), b)
+}
+
+func (s *fileConsentStore) write(filename string, b []byte) error {
+	// Write to a temporary file first and rename, so readers never see
+	// partially written files.
+	f, err := ioutil.TempFile(s.path, ".consent-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Revoke implements the ConsentStore interface.
+func (s *fileConsentStore) Revoke(ctx context.Context, sub string, clientID string) error {
+	err := os.Remove(s.filename(sub, clientID))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// WalkConsent implements the ConsentStoreMaintainer interface.
+func (s *fileConsentStore) WalkConsent(ctx context.Context, f func(key string, consent *Consent, err error) error) error {
+	filenames, err := filepath.Glob(filepath.Join(s.path, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		key := strings.TrimSuffix(filepath.Base(filename), ".json")
+		consent, _, readErr := s.read(filename)
+		if err = f(key, consent, readErr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateConsent implements the ConsentStoreMaintainer interface.
+func (s *fileConsentStore) MigrateConsent(ctx context.Context, dryRun bool) (int, error) {
+	filenames, err := filepath.Glob(filepath.Join(s.path, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	// Check all entries first, so nothing is changed when there are entries
+	// which cannot be migrated.
+	migrate := make(map[string][]byte)
+	for _, filename := range filenames {
+		consent, current, readErr := s.read(filename)
+		if readErr != nil {
+			return 0, fmt.Errorf("consent store entry %v is invalid: %v", filepath.Base(filename), readErr)
+		}
+		b, marshalErr := json.Marshal(consent)
+		if marshalErr != nil {
+			return 0, marshalErr
+		}
+		if !bytes.Equal(current, b) {
+			migrate[filename] = b
+		}
+	}
+	if dryRun {
+		return len(migrate), nil
+	}
+
+	for filename, b := range migrate {
+		if err = s.write(filename, b); err != nil {
+			return 0, err
+		}
+	}
+	// Remove temporary files left behind by interrupted writes.
+	stale, _ := filepath.Glob(filepath.Join(s.path, ".consent-*"))
+	for _, filename := range stale {
+		os.Remove(filename)
+	}
+
+	return len(migrate), nil
+}
+
+func (s *fileConsentStore) read(filename string) (*Consent, []byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var consent Consent
+	if err = json.Unmarshal(b, &consent); err != nil {
+		return nil, b, err
+	}
+
+	return &consent, b, nil
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testConsentStore(t *testing.T, store ConsentStore) {
+	ctx := context.Background()
+
+	consent, err := store.Get(ctx, "user1", "client1")
+	if err != nil || consent != nil {
+		t.Fatalf("expected no consent, got %v %v", consent, err)
+	}
+
+	if err = store.Set(ctx, "user1", "client1", &Consent{Allow: true, RawScope: "openid profile"}); err != nil {
+		t.Fatal(err)
+	}
+	consent, err = store.Get(ctx, "user1", "client1")
+	if err != nil || consent == nil || !consent.Allow || consent.RawScope != "openid profile" {
+		t.Fatalf("unexpected consent, got %v %v", consent, err)
+	}
+	for _, other := range [][2]string{{"user1", "client2"}, {"user2", "client1"}, {"user1client", "1"}} {
+		if consent, _ = store.Get(ctx, other[0], other[1]); consent != nil {
+			t.Errorf("unexpected consent for %v", other)
+		}
+	}
+
+	if err = store.Revoke(ctx, "user1", "client1"); err != nil {
+		t.Fatal(err)
+	}
+	if consent, _ = store.Get(ctx, "user1", "client1"); consent != nil {
+		t.Errorf("expected no consent after revoke, got %v", consent)
+	}
+	if err = store.Revoke(ctx, "user1", "client1"); err != nil {
+		t.Errorf("revoke of unknown consent failed: %v", err)
+	}
+}
+
+func TestMemoryConsentStore(t *testing.T) {
+	testConsentStore(t, NewMemoryConsentStore())
+}
+
+func TestFileConsentStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "konnect-consent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	store, err := NewFileConsentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConsentStore(t, store)
+}
+
+func TestFileConsentStoreMaintenance(t *testing.T) {
+	ctx := context.Background()
+
+	path, err := ioutil.TempDir("", "konnect-consent-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	store, err := NewFileConsentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Set(ctx, "user1", "client1", &Consent{Allow: true, RawScope: "openid"}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(path, consentStoreKey("user2", "client1")+".json")
+	if err = ioutil.WriteFile(legacy, []byte("{\"allow\": true, \"scope\": \"openid email\", \"remember\": false}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(path, ".consent-unittest")
+	if err = ioutil.WriteFile(stale, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	maintainer := store.(ConsentStoreMaintainer)
+	count := 0
+	err = maintainer.WalkConsent(ctx, func(key string, consent *Consent, err error) error {
+		if err != nil || consent == nil || !consent.Allow {
+			t.Errorf("unexpected consent store entry %v: %v %v", key, consent, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Errorf("unexpected walk result: %v %v", count, err)
+	}
+
+	if migrated, migrateErr := maintainer.MigrateConsent(ctx, true); migrateErr != nil || migrated != 1 {
+		t.Errorf("unexpected dry run migration result: %v %v", migrated, migrateErr)
+	}
+	if migrated, migrateErr := maintainer.MigrateConsent(ctx, false); migrateErr != nil || migrated != 1 {
+		t.Errorf("unexpected migration result: %v %v", migrated, migrateErr)
+	}
+	if migrated, migrateErr := maintainer.MigrateConsent(ctx, false); migrateErr != nil || migrated != 0 {
+		t.Errorf("unexpected second migration result: %v %v", migrated, migrateErr)
+	}
+	if _, statErr := os.Stat(stale); !os.IsNotExist(statErr) {
+		t.Errorf("stale temporary file was not removed")
+	}
+	if consent, _ := store.Get(ctx, "user2", "client1"); consent == nil || consent.RawScope != "openid email" {
+		t.Errorf("unexpected migrated consent: %v", consent)
+	}
+
+	if err = ioutil.WriteFile(legacy, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = maintainer.MigrateConsent(ctx, false); err == nil {
+		t.Errorf("expected migration error for invalid entry")
+	}
+}
+
+func TestConsentCovers(t *testing.T) {
+	consent := &Consent{Allow: true, RawScope: "openid profile"}
+	for _, test := range []struct {
+		scopes map[string]bool
+		covers bool
+	}{
+		{map[string]bool{"openid": true}, true},
+		{map[string]bool{"openid": true, "profile": true}, true},
+		{map[string]bool{"openid": true, "email": false}, true},
+		{map[string]bool{"openid": true, "email": true}, false},
+	} {
+		if covers := consent.Covers(test.scopes); covers != test.covers {
+			t.Errorf("%v: got %v want %v", test.scopes, covers, test.covers)
+		}
+	}
+	if (&Consent{RawScope: "openid"}).Covers(map[string]bool{"openid": true}) {
+		t.Error("denied consent must not cover")
+	}
+}
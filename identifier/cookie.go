@@ -20,19 +20,25 @@ package identifier
 import (
 	"encoding/base64"
 	"net/http"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
-func (i *Identifier) setLogonCookie(rw http.ResponseWriter, value string) error {
+func (i *Identifier) setLogonCookie(rw http.ResponseWriter, value string, expires time.Time) error {
 	cookie := http.Cookie{
 		Name:  i.logonCookieName,
 		Value: value,
 
 		Path:     i.pathPrefix + "/identifier/_/",
-		Secure:   true,
 		HttpOnly: true,
+
+		Expires: expires,
+	}
+	if i.Config.Config.SessionCookiePath != "" {
+		cookie.Path = i.Config.Config.SessionCookiePath
 	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -47,11 +53,14 @@ func (i *Identifier) removeLogonCookie(rw http.ResponseWriter) error {
 		Name: i.logonCookieName,
 
 		Path:     i.pathPrefix + "/identifier/_/",
-		Secure:   true,
 		HttpOnly: true,
 
 		Expires: farPastExpiryTime,
 	}
+	if i.Config.Config.SessionCookiePath != "" {
+		cookie.Path = i.Config.Config.SessionCookiePath
+	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -69,9 +78,9 @@ func (i *Identifier) setConsentCookie(rw http.ResponseWriter, cr *ConsentRequest
 		MaxAge: 60,
 
 		Path:     i.pathPrefix + "/identifier/_/",
-		Secure:   true,
 		HttpOnly: true,
 	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -96,11 +105,11 @@ func (i *Identifier) removeConsentCookie(rw http.ResponseWriter, req *http.Reque
 		Name: name,
 
 		Path:     i.pathPrefix + "/identifier/_/",
-		Secure:   true,
 		HttpOnly: true,
 
 		Expires: farPastExpiryTime,
 	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -139,9 +148,9 @@ func (i *Identifier) setOAuth2Cookie(rw http.ResponseWriter, state string, value
 		MaxAge: 60,
 
 		Path:     i.pathPrefix + "/identifier/oauth2/cb",
-		Secure:   true,
 		HttpOnly: true,
 	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -166,11 +175,11 @@ func (i *Identifier) removeOAuth2Cookie(rw http.ResponseWriter, req *http.Reques
 		Name: name,
 
 		Path:     i.pathPrefix + "/identifier/oauth2/cb",
-		Secure:   true,
 		HttpOnly: true,
 
 		Expires: farPastExpiryTime,
 	}
+	i.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/audit"
+	"stash.kopano.io/kc/konnect/identity/authorities"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Authority fallback policies, controlling what happens when the default
+// authority is unavailable.
+const (
+	AuthorityFallbackNone  = "none"
+	AuthorityFallbackLocal = "local"
+)
+
+// DefaultAuthorityFallbackDuration is the duration for which the local sign-in
+// is used instead of the default authority after konnect observed a failure of
+// the authority, if not configured otherwise.
+const DefaultAuthorityFallbackDuration = time.Minute
+
+// Fallback reasons.
+const (
+	authorityFallbackReasonNotReady = "not_ready"
+	authorityFallbackReasonFailed   = "failed"
+)
+
+// ValidateAuthorityFallback returns an error if the provided authority
+// fallback policy is not supported.
+func ValidateAuthorityFallback(policy string) error {
+	switch policy {
+	case "", AuthorityFallbackNone, AuthorityFallbackLocal:
+		return nil
+	default:
+		return fmt.Errorf("unsupported authority fallback policy: %v", policy)
+	}
+}
+
+// authorityFailedRecently returns true if the provided time of the last
+// failure of an authority is less than the provided duration before the
+// provided time.
+func authorityFailedRecently(lastFailure time.Time, now time.Time, duration time.Duration) bool {
+	return !lastFailure.IsZero() && now.Sub(lastFailure) < duration
+}
+
+// isAuthorityFailure returns true if the provided error ID returned by an
+// authority signals that the authority is unavailable, rather than that the
+// sign-in was denied.
+func isAuthorityFailure(errorID string) bool {
+	switch errorID {
+	case oidc.ErrorCodeOAuth2ServerError, oidc.ErrorCodeOAuth2TemporarilyUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// authorityFallbackReason returns the reason why the local sign-in is to be
+// used instead of the provided default authority, or an empty string if the
+// authority is to be used. Without the local authority fallback policy, the
+// authority is always used.
+func (i *Identifier) authorityFallbackReason(authority *authorities.Details) string {
+	if i.Config.AuthorityFallback != AuthorityFallbackLocal {
+		return ""
+	}
+
+	switch {
+	case !authority.IsReady():
+		return authorityFallbackReasonNotReady
+	case authorityFailedRecently(authority.LastFailure(), time.Now(), i.authorityFallbackDuration):
+		return authorityFallbackReasonFailed
+	default:
+		return ""
+	}
+}
+
+// authorityChoices returns the ready authorities which can be chosen in the
+// authority chooser, leaving out those which would fall back to the local
+// sign-in.
+func (i *Identifier) authorityChoices(ctx context.Context) []*authorities.Details {
+	ready := i.authorities.Ready(ctx)
+	choices := make([]*authorities.Details, 0, len(ready))
+	for _, authority := range ready {
+		if i.authorityFallbackReason(authority) == "" {
+			choices = append(choices, authority)
+		}
+	}
+
+	return choices
+}
+
+// localSignInAllowed returns true if users can choose the local sign-in
+// instead of an authority, which is the case when there is no default
+// authority or when falling back to the local sign-in is enabled.
+func (i *Identifier) localSignInAllowed(ctx context.Context) bool {
+	return i.Config.AuthorityFallback == AuthorityFallbackLocal || i.authorities.Default(ctx) == nil
+}
+
+// auditAuthorityFallback logs and emits an audit event for the fallback to the
+// local sign-in instead of the provided authority with the provided request.
+func (i *Identifier) auditAuthorityFallback(req *http.Request, authority *authorities.Details, reason string) {
+	remote := utils.ClientIPFromRequest(req, i.Config.Config.TrustedProxyClientIPHeader, i.Config.Config.TrustedProxyIPs, i.Config.Config.TrustedProxyNets)
+	i.logger.WithFields(logrus.Fields{
+		"authority_id": authority.ID,
+		"reason":       reason,
+		"remote":       remote,
+	}).WithFields(i.Config.Config.GeoIP.Fields(remote)).Warnln("audit: default authority unavailable, falling back to local sign-in")
+
+	if webhook := i.Config.Config.AuditWebhook; webhook != nil {
+		event := audit.NewEvent(audit.EventTypeAuthorityFallback)
+		event.AuthorityID = authority.ID
+		event.Reason = reason
+		event.ClientID = req.Form.Get("client_id")
+		event.SetRemoteAddr(remote, i.Config.Config.GeoIP)
+		webhook.Emit(event)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"testing"
+	"time"
+
+	"stash.kopano.io/kgol/oidc-go"
+)
+
+func TestAuthorityFailedRecently(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		lastFailure time.Time
+		expected    bool
+	}{
+		{time.Time{}, false},
+		{now, true},
+		{now.Add(-30 * time.Second), true},
+		{now.Add(-time.Minute), false},
+		{now.Add(-time.Hour), false},
+	} {
+		if failed := authorityFailedRecently(test.lastFailure, now, time.Minute); failed != test.expected {
+			t.Errorf("authorityFailedRecently(%v) is %v, want %v", test.lastFailure, failed, test.expected)
+		}
+	}
+}
+
+func TestIsAuthorityFailure(t *testing.T) {
+	for errorID, expected := range map[string]bool{
+		oidc.ErrorCodeOAuth2ServerError:            true,
+		oidc.ErrorCodeOAuth2TemporarilyUnavailable: true,
+		oidc.ErrorCodeOAuth2AccessDenied:           false,
+		oidc.ErrorCodeOIDCLoginRequired:            false,
+	} {
+		if isAuthorityFailure(errorID) != expected {
+			t.Errorf("isAuthorityFailure(%v) is not %v", errorID, expected)
+		}
+	}
+}
+
+func TestValidateAuthorityFallback(t *testing.T) {
+	for _, policy := range []string{"", AuthorityFallbackNone, AuthorityFallbackLocal} {
+		if err := ValidateAuthorityFallback(policy); err != nil {
+			t.Errorf("policy %v: unexpected error: %v", policy, err)
+		}
+	}
+	if err := ValidateAuthorityFallback("remote"); err == nil {
+		t.Errorf("unsupported policy accepted")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/audit"
+	"stash.kopano.io/kc/konnect/identity/authorities"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// federationDeniedReasonIdentityAliasMissing is the reason of denied sign-ins
+// with an authority which requires identity aliases, when the identity claim
+// value has no alias.
+const federationDeniedReasonIdentityAliasMissing = "identity_alias_missing"
+
+// deniedReasonAmbiguousUser is the reason of denied sign-ins, when the
+// username matches more than one user of the backend.
+const deniedReasonAmbiguousUser = "ambiguous_user"
+
+// auditFederationDenied logs and emits an audit event for the denied sign-in
+// with the provided authority for the provided client and reason.
+func (i *Identifier) auditFederationDenied(req *http.Request, authority *authorities.Details, clientID string, reason string) {
+	remote := utils.ClientIPFromRequest(req, i.Config.Config.TrustedProxyClientIPHeader, i.Config.Config.TrustedProxyIPs, i.Config.Config.TrustedProxyNets)
+	i.logger.WithFields(logrus.Fields{
+		"authority_id": authority.ID,
+		"client_id":    clientID,
+		"reason":       reason,
+		"remote":       remote,
+	}).WithFields(i.Config.Config.GeoIP.Fields(remote)).Warnln("audit: denied sign-in with authority")
+
+	if webhook := i.Config.Config.AuditWebhook; webhook != nil {
+		event := audit.NewEvent(audit.EventTypeFederationDenied)
+		event.AuthorityID = authority.ID
+		event.Reason = reason
+		event.ClientID = clientID
+		event.SetRemoteAddr(remote, i.Config.Config.GeoIP)
+		webhook.Emit(event)
+	}
+}
+
+// auditLogonDenied logs and emits an audit event for the denied local sign-in
+// for the provided client and reason.
+func (i *Identifier) auditLogonDenied(req *http.Request, clientID string, reason string) {
+	remote := utils.ClientIPFromRequest(req, i.Config.Config.TrustedProxyClientIPHeader, i.Config.Config.TrustedProxyIPs, i.Config.Config.TrustedProxyNets)
+	i.logger.WithFields(logrus.Fields{
+		"client_id": clientID,
+		"reason":    reason,
+		"remote":    remote,
+	}).WithFields(i.Config.Config.GeoIP.Fields(remote)).Warnln("audit: denied sign-in")
+
+	if webhook := i.Config.Config.AuditWebhook; webhook != nil {
+		event := audit.NewEvent(audit.EventTypeLogonDenied)
+		event.Reason = reason
+		event.ClientID = clientID
+		event.SetRemoteAddr(remote, i.Config.Config.GeoIP)
+		webhook.Emit(event)
+	}
+}
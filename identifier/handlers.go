@@ -32,32 +32,18 @@ import (
 	"github.com/sirupsen/logrus"
 	"stash.kopano.io/kgol/oidc-go"
 
+	"stash.kopano.io/kc/konnect/identifier/backends"
 	"stash.kopano.io/kc/konnect/identifier/meta"
 	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
 	"stash.kopano.io/kc/konnect/identity/authorities"
 
 	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/signing"
+	"stash.kopano.io/kc/konnect/tracing"
 	"stash.kopano.io/kc/konnect/utils"
 )
 
-func (i *Identifier) staticHandler(handler http.Handler, cache bool) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		addCommonResponseHeaders(rw.Header())
-		if cache {
-			rw.Header().Set("Cache-Control", "max-age=3153600, public")
-		} else {
-			rw.Header().Set("Cache-Control", "no-cache, max-age=0, public")
-		}
-		if strings.HasSuffix(req.URL.Path, "/") {
-			// Do not serve folder-ish resources.
-			i.ErrorPage(rw, http.StatusNotFound, "", "")
-			return
-		}
-		handler.ServeHTTP(rw, req)
-	})
-}
-
 func (i *Identifier) secureHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		var err error
@@ -147,9 +133,39 @@ func (i *Identifier) handleIdentifier(rw http.ResponseWriter, req *http.Request)
 	case FlowOAuth:
 		fallthrough
 	case "":
-		//  Check if there is a default authority, if so use that.
-		authority := i.authorities.Default(req.Context())
+		// NOTE: A requested authority is never replaced by the default
+		// authority, since it might be required to meet the requested
+		// authentication requirements.
+		if authorityID := req.Form.Get("authority_id"); authorityID != "" {
+			authority, _ := i.authorities.Lookup(req.Context(), authorityID)
+			i.newOAuth2Start(rw, req, authority)
+			return
+		}
+
+		// Let the user choose the authority, unless the login hint resolves
+		// to an authority or there is nothing to choose from.
+		loginHint := req.Form.Get("login_hint")
+		if i.Config.AuthorityChooser {
+			local := i.localSignInAllowed(req.Context())
+			if local && req.Form.Get(localSignInParameter) != "" {
+				break
+			}
+			if i.authorities.ForHint(req.Context(), loginHint) == nil {
+				if choices := i.authorityChoices(req.Context()); len(choices) > 1 || (local && len(choices) > 0) {
+					i.writeAuthorityChooser(rw, req, choices, local)
+					return
+				}
+			}
+		}
+
+		//  Check if there is a default authority, if so use that. The login
+		// hint selects the default authority for its domain if any.
+		authority := i.authorities.DefaultForHint(req.Context(), loginHint)
 		if authority != nil {
+			if reason := i.authorityFallbackReason(authority); reason != "" {
+				i.auditAuthorityFallback(req, authority, reason)
+				break
+			}
 			i.newOAuth2Start(rw, req, authority)
 			return
 		}
@@ -169,6 +185,12 @@ func (i *Identifier) newIdentifierDefault(rw http.ResponseWriter, req *http.Requ
 
 	// Write index with random nonce to response.
 	index := bytes.Replace(i.webappIndexHTML, []byte("__CSP_NONCE__"), []byte(nonce), 1)
+	if i.Config.StaticCompression {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		cw := newCompressResponseWriter(rw, acceptedEncodings(req.Header.Get("Accept-Encoding")))
+		defer cw.Close()
+		rw = cw
+	}
 	rw.Write(index)
 }
 
@@ -242,7 +264,16 @@ func (i *Identifier) handleLogon(rw http.ResponseWriter, req *http.Request) {
 				if forwardedUser != "" {
 					if forwardedUser == params[0] {
 						resolvedUser, resolveErr := i.resolveUser(req.Context(), params[0])
-						if resolveErr != nil {
+						if resolveErr == ErrBackendUnavailable {
+							i.logger.Warnln("identifier failed to resolve user, backend unavailable")
+							i.ErrorPage(rw, http.StatusServiceUnavailable, "", "backend unavailable")
+							return
+						} else if resolveErr == backends.ErrAmbiguousUser {
+							// NOTE: Ambiguous users fail like unknown users,
+							// the reason is only kept in the audit event.
+							i.auditLogonDenied(req, audience, deniedReasonAmbiguousUser)
+							break
+						} else if resolveErr != nil {
 							i.logger.WithError(resolveErr).Errorln("identifier failed to resolve user with backend")
 							i.ErrorPage(rw, http.StatusInternalServerError, "", "failed to resolve user")
 							return
@@ -268,12 +299,54 @@ func (i *Identifier) handleLogon(rw http.ResponseWriter, req *http.Request) {
 		switch params[2] {
 		case ModeLogonUsernamePassword:
 			// Username and password validation mode.
-			logonedUser, logonErr := i.logonUser(req.Context(), audience, params[0], params[1])
-			if logonErr != nil {
+			remote := utils.ClientIPFromRequest(req, i.Config.Config.TrustedProxyClientIPHeader, i.Config.Config.TrustedProxyIPs, i.Config.Config.TrustedProxyNets)
+			if i.lockedOut(params[0], remote) {
+				i.logger.WithFields(logrus.Fields{
+					"username": params[0],
+					"remote":   remote,
+				}).WithFields(i.Config.Config.GeoIP.Fields(remote)).Warnln("identifier logon rejected, locked out after too many failed attempts")
+				i.auditLogonDenied(req, audience, deniedReasonLockedOut)
+				i.ErrorPage(rw, http.StatusTooManyRequests, "", "too many failed logon attempts")
+				return
+			}
+			var logonedUser *IdentifiedUser
+			var logonErr error
+			if i.credentialPolicy != nil && i.credentialPolicy.ValidateCredential(params[1]) != nil {
+				// NOTE: Passwords which do not meet the credential policy
+				// can never be valid, thus such logons fail like wrong
+				// passwords without asking the backend.
+				i.logger.WithField("username", params[0]).Debugln("identifier logon password does not meet credential policy")
+			} else {
+				logonedUser, logonErr = i.logonUser(req.Context(), audience, params[0], params[1])
+			}
+			if logonErr == ErrBackendUnavailable {
+				i.logger.Warnln("identifier failed to logon, backend unavailable")
+				i.ErrorPage(rw, http.StatusServiceUnavailable, "", "backend unavailable")
+				return
+			} else if logonErr == backends.ErrAmbiguousUser {
+				// NOTE: Ambiguous users fail like wrong passwords, so that it
+				// is not revealed that the username exists. The reason is only
+				// kept in the audit event.
+				i.auditLogonDenied(req, audience, deniedReasonAmbiguousUser)
+				logonedUser, logonErr = nil, nil
+			} else if logonErr != nil {
 				i.logger.WithError(logonErr).Errorln("identifier failed to logon with backend")
 				i.ErrorPage(rw, http.StatusInternalServerError, "", "failed to logon")
 				return
 			}
+			i.logger.WithFields(logrus.Fields{
+				"username": params[0],
+				"success":  logonedUser != nil,
+				"remote":   remote,
+			}).WithFields(i.Config.Config.GeoIP.Fields(remote)).Infoln("identifier logon")
+			if logonedUser != nil {
+				i.resetLockout(params[0])
+			} else if i.failLockout(params[0], remote) {
+				i.logger.WithFields(logrus.Fields{
+					"username": params[0],
+					"remote":   remote,
+				}).Warnln("identifier logon locked out after too many failed attempts")
+			}
 			user = logonedUser
 
 		default:
@@ -298,8 +371,12 @@ func (i *Identifier) handleLogon(rw http.ResponseWriter, req *http.Request) {
 		i.logger.WithError(err).Debugln("identifier failed to update user data in logon request")
 	}
 
-	// Set logon time.
-	user.logonAt = time.Now()
+	// Set logon time. NOTE: Logons with the current logon cookie keep its
+	// logon time when a session maximum lifetime is set, so the session
+	// lifetime cannot be extended without signing in again.
+	if i.Config.SessionMaxLifetime <= 0 || user.logonAt.IsZero() {
+		user.logonAt = time.Now()
+	}
 
 	if r.Hello != nil {
 		hello, errHello := i.newHelloResponse(rw, req, r.Hello, user)
@@ -380,7 +457,8 @@ func (i *Identifier) handleConsent(rw http.ResponseWriter, req *http.Request) {
 	addNoCacheResponseHeaders(rw.Header())
 
 	consent := &Consent{
-		Allow: r.Allow,
+		Allow:    r.Allow,
+		Remember: r.Remember,
 	}
 	if r.Allow {
 		consent.RawScope = r.RawScope
@@ -446,7 +524,7 @@ func (i *Identifier) handleHello(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (i Identifier) newHelloResponse(rw http.ResponseWriter, req *http.Request, r *HelloRequest, identifiedUser *IdentifiedUser) (*HelloResponse, error) {
+func (i *Identifier) newHelloResponse(rw http.ResponseWriter, req *http.Request, r *HelloRequest, identifiedUser *IdentifiedUser) (*HelloResponse, error) {
 	var err error
 	response := &HelloResponse{
 		State: r.State,
@@ -539,7 +617,7 @@ handleHelloLoop:
 			response.Scopes = r.Scopes
 			response.ClientDetails = clientDetails
 			response.Meta = &meta.Meta{
-				Scopes: scopes.NewScopesFromIDs(r.Scopes, i.meta.Scopes),
+				Scopes: scopes.NewScopesFromIDs(r.Scopes, i.getMeta().Scopes),
 			}
 		}
 
@@ -572,8 +650,11 @@ func (i *Identifier) newOAuth2Start(rw http.ResponseWriter, req *http.Request, a
 
 	if authority == nil {
 		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, "no authority")
-	} else if !authority.IsReady() {
-		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, "authority not ready")
+	} else {
+		tracing.SpanFromContext(req.Context()).SetAttributes(tracing.String("authority_id", authority.ID))
+		if !authority.IsReady() {
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, "authority not ready")
+		}
 	}
 
 	switch typedErr := err.(type) {
@@ -610,6 +691,10 @@ func (i *Identifier) newOAuth2Start(rw http.ResponseWriter, req *http.Request, a
 
 		ClientID: clientID,
 		Ref:      authority.ID,
+
+		// NOTE: The nonce is independent of any nonce sent by the RP and is
+		// used to bind the upstream ID token to this authorization state.
+		Nonce: rndm.GenerateRandomString(32),
 	}
 
 	// Construct URL to redirect client to external OAuth2 authorize endpoints.
@@ -622,7 +707,7 @@ func (i *Identifier) newOAuth2Start(rw http.ResponseWriter, req *http.Request, a
 	query.Add("response_mode", oidc.ResponseModeQuery)
 	query.Add("scope", strings.Join(scopes, " "))
 	query.Add("redirect_uri", i.oauth2CbEndpointURI.String())
-	query.Add("nonce", rndm.GenerateRandomString(32))
+	query.Add("nonce", sd.Nonce)
 	if codeChallengeMethod != "" {
 		if codeChallenge, err := oidc.MakeCodeChallenge(codeChallengeMethod, codeVerifier); err == nil {
 			query.Add("code_challenge", codeChallenge)
@@ -634,24 +719,7 @@ func (i *Identifier) newOAuth2Start(rw http.ResponseWriter, req *http.Request, a
 		}
 	}
 	query.Add("state", sd.State)
-	if display := req.Form.Get("display"); display != "" {
-		query.Add("display", display)
-	}
-	if prompt := req.Form.Get("prompt"); prompt != "" {
-		query.Add("prompt", prompt)
-	}
-	if maxAge := req.Form.Get("max_age"); maxAge != "" {
-		query.Add("max_age", maxAge)
-	}
-	if uiLocales := req.Form.Get("ui_locales"); uiLocales != "" {
-		query.Add("ui_locales", uiLocales)
-	}
-	if acrValues := req.Form.Get("acr_values"); acrValues != "" {
-		query.Add("acr_values", acrValues)
-	}
-	if claimsLocales := req.Form.Get("claims_locales"); claimsLocales != "" {
-		query.Add("claims_locales", claimsLocales)
-	}
+	addForwardedAuthorityParameters(query, req.Form)
 
 	// Set cookie which is consumed by the callback later.
 	err = i.SetStateToOAuth2StateCookie(req.Context(), rw, sd)
@@ -703,9 +771,12 @@ func (i *Identifier) newOAuth2Cb(rw http.ResponseWriter, req *http.Request) {
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "unknown client_id")
 			break
 		}
+		tracing.SpanFromContext(req.Context()).SetAttributes(tracing.String("authority_id", authority.ID), tracing.String("client_id", sd.ClientID))
 
 		if authenticationErrorID := req.Form.Get("error"); authenticationErrorID != "" {
 			// Incoming error case.
+			// NOTE: The error is never recorded as failure of the authority,
+			// since anyone with a valid state can send it.
 			err = konnectoidc.NewOAuth2Error(authenticationErrorID, req.Form.Get("error_description"))
 			break
 		}
@@ -719,18 +790,34 @@ func (i *Identifier) newOAuth2Cb(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		var username *string
+		var acr string
+		var amr []string
 		if authority.AuthorityType == authorities.AuthorityTypeOIDC {
 			// Parse and validate IDToken.
-			idToken, idTokenParseErr := jwt.ParseWithClaims(authenticationSuccess.IDToken, jwt.MapClaims{}, authority.Keyfunc())
+			// NOTE: Time claims are validated separately to allow for clock
+			// skew between konnect and the authority.
+			parser := &jwt.Parser{
+				SkipClaimsValidation: true,
+			}
+			_, validateSpan := tracing.Start(req.Context(), "authority.validate_id_token", tracing.String("authority_id", authority.ID))
+			idToken, idTokenParseErr := parser.ParseWithClaims(authenticationSuccess.IDToken, jwt.MapClaims{}, signing.StrictKeyfunc(authority.Keyfunc(), func(token *jwt.Token, rejectErr error) {
+				i.logger.WithError(rejectErr).WithFields(logrus.Fields{
+					"authority_id": authority.ID,
+					"alg":          token.Header[oidc.JWTHeaderAlg],
+					"kid":          token.Header[oidc.JWTHeaderKeyID],
+				}).Warnln("audit: rejected authority id token with disallowed alg or header")
+			}))
+			if idTokenParseErr == nil {
+				idTokenParseErr = validateIDTokenTimes(idToken.Claims.(jwt.MapClaims), time.Now(), i.Config.ClockSkew)
+			}
+			validateSpan.SetError(idTokenParseErr)
+			validateSpan.End()
 			if idTokenParseErr != nil {
-				if authority.Insecure {
-					i.logger.WithField("client_id", sd.ClientID).WithError(idTokenParseErr).Warnln("identifier ignoring validation error for insecure authority")
-					err = nil
-				} else {
-					i.logger.WithError(idTokenParseErr).Debugln("identifier failed to validate oauth2 cb id token")
-					err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2ServerError, "authority response validation failed")
-					break
-				}
+				// NOTE: Insecure authorities only skip TLS verification, their ID
+				// tokens are always validated.
+				i.logger.WithError(idTokenParseErr).Debugln("identifier failed to validate oauth2 cb id token")
+				err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2ServerError, "authority response validation failed")
+				break
 			}
 			claims, _ = idToken.Claims.(jwt.MapClaims)
 			if claims == nil {
@@ -738,22 +825,48 @@ func (i *Identifier) newOAuth2Cb(rw http.ResponseWriter, req *http.Request) {
 				break
 			}
 
+			// Ensure the ID token was issued for this authorization state, to
+			// reject replayed ID tokens.
+			if nonceErr := validateIDTokenNonce(claims, sd.Nonce); nonceErr != nil {
+				i.logger.WithError(nonceErr).Debugln("identifier failed to validate oauth2 cb id token nonce")
+				err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2ServerError, "authority response validation failed")
+				break
+			}
+
 			// Lookup username and user.
 			un, claimsErr := authority.IdentityClaimValue(claims)
-			if claimsErr != nil {
+			if claimsErr == authorities.ErrIdentityAliasMissing {
+				i.auditFederationDenied(req, authority, sd.ClientID, federationDeniedReasonIdentityAliasMissing)
+				err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2AccessDenied, "identity has no alias")
+				break
+			} else if claimsErr != nil {
 				i.logger.WithError(claimsErr).Debugln("identifier failed to get username from oauth2 cb id token claims")
 				err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InsufficientScope, "identity claim not found")
 				break
 			}
 
 			username = &un
+
+			// Remember the authentication context class reference which was
+			// satisfied by the authority and the authentication methods which
+			// were used at the authority, if any.
+			acr = authority.ACRClaimValue(claims)
+			amr = authority.AMRClaimValue(claims)
 		} else {
 			err = errors.New("unknown authority type")
 			break
 		}
 
 		user, err = i.resolveUser(req.Context(), *username)
-		if err != nil {
+		if err == ErrBackendUnavailable {
+			i.logger.WithField("username", *username).Warnln("identifier failed to resolve oauth2 cb user, backend unavailable")
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, "backend unavailable")
+			break
+		} else if err == backends.ErrAmbiguousUser {
+			i.auditFederationDenied(req, authority, sd.ClientID, deniedReasonAmbiguousUser)
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2AccessDenied, "no such user")
+			break
+		} else if err != nil {
 			i.logger.WithError(err).WithField("username", *username).Debugln("identifier failed to resolve oauth2 cb user with backend")
 			// TODO(longsleep): Break on validation error.
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2AccessDenied, "failed to resolve user")
@@ -773,8 +886,11 @@ func (i *Identifier) newOAuth2Cb(rw http.ResponseWriter, req *http.Request) {
 			i.logger.WithError(err).Debugln("identifier failed to update user data in oauth2 cb request")
 		}
 
-		// Set logon time.
+		// Set logon time, acr, amr and authority.
 		user.logonAt = time.Now()
+		user.acr = acr
+		user.amr = amr
+		user.authorityID = authority.ID
 
 		err = i.SetUserToLogonCookie(req.Context(), rw, user)
 		if err != nil {
@@ -798,8 +914,30 @@ func (i *Identifier) newOAuth2Cb(rw http.ResponseWriter, req *http.Request) {
 
 	switch typedErr := err.(type) {
 	case nil:
-		// breaks
+		// NOTE: The sign-in at the authority just happened, so remove the
+		// prompt values which enforce a sign-in to avoid sending the user to
+		// the authority again.
+		if prompt := query.Get("prompt"); prompt != "" {
+			prompts := make([]string, 0)
+			for _, value := range strings.Split(prompt, " ") {
+				if value == oidc.PromptLogin || value == oidc.PromptSelectAccount {
+					continue
+				}
+				prompts = append(prompts, value)
+			}
+			if len(prompts) > 0 {
+				query.Set("prompt", strings.Join(prompts, " "))
+			} else {
+				query.Del("prompt")
+			}
+		}
 	case *konnectoidc.OAuth2Error:
+		if authority != nil && isAuthorityFailure(typedErr.ErrorID) && query.Get("authority_id") == "" && i.authorityFallbackReason(authority) != "" {
+			// NOTE: Continue the authorization without error, it falls back to
+			// the local sign-in now.
+			i.logger.WithFields(utils.ErrorAsFields(err)).Debugln("oauth2 cb authority failure, retrying with fallback")
+			break
+		}
 		// Pass along OAuth2 error.
 		i.logger.WithFields(utils.ErrorAsFields(err)).Debugln("oauth2 cb error")
 		// NOTE(longsleep): Pass along error ID but not the description to avoid
@@ -20,11 +20,16 @@ package identifier
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"html"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/deckarep/golang-set"
@@ -35,6 +40,8 @@ import (
 
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identifier/backends"
+	"stash.kopano.io/kc/konnect/identifier/lockout"
+	lockoutManagers "stash.kopano.io/kc/konnect/identifier/lockout/managers"
 	"stash.kopano.io/kc/konnect/identifier/meta"
 	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
 	"stash.kopano.io/kc/konnect/identity"
@@ -59,9 +66,11 @@ type Identifier struct {
 	baseURI         *url.URL
 	pathPrefix      string
 	staticFolder    string
+	staticMaxAge    time.Duration
 	logonCookieName string
 	scopesConf      string
 	webappIndexHTML []byte
+	templates       map[string]*template.Template
 
 	authorizationEndpointURI *url.URL
 	oauth2CbEndpointURI      *url.URL
@@ -72,7 +81,15 @@ type Identifier struct {
 	clients     *clients.Registry
 	authorities *authorities.Registry
 
-	meta *meta.Meta
+	meta            *meta.Meta
+	scopesSupported []string
+	metaMutex       sync.RWMutex
+
+	credentialPolicy *backends.CredentialPolicy
+	lockouts         lockout.Manager
+	remoteLockouts   lockout.Manager
+
+	authorityFallbackDuration time.Duration
 
 	onSetLogonCallbacks   []func(ctx context.Context, rw http.ResponseWriter, user identity.User) error
 	onUnsetLogonCallbacks []func(ctx context.Context, rw http.ResponseWriter) error
@@ -97,34 +114,107 @@ func NewIdentifier(c *Config) (*Identifier, error) {
 
 	webappIndexHTML = bytes.Replace(webappIndexHTML, []byte("__PATH_PREFIX__"), []byte(c.PathPrefix), 1)
 
+	// Policy declared by the backend takes precedence over the configured one.
+	credentialPolicy := c.CredentialPolicy
+	if backend, ok := c.Backend.(backends.BackendWithCredentialPolicy); ok {
+		if backendCredentialPolicy := backend.CredentialPolicy(); backendCredentialPolicy != nil {
+			credentialPolicy = backendCredentialPolicy
+		}
+	}
+	credentialPolicyJSON := []byte{}
+	if credentialPolicy != nil {
+		if err = credentialPolicy.Validate(); err != nil {
+			return nil, fmt.Errorf("identifier invalid credential policy: %v", err)
+		}
+		if credentialPolicyJSON, err = json.Marshal(credentialPolicy); err != nil {
+			return nil, err
+		}
+	}
+	webappIndexHTML = bytes.Replace(webappIndexHTML, []byte("__CREDENTIAL_POLICY__"), []byte(html.EscapeString(string(credentialPolicyJSON))), 1)
+	webappIndexHTML = bytes.Replace(webappIndexHTML, []byte("__CONSENT_REMEMBER__"), []byte(strconv.FormatBool(c.ConsentStore != nil)), 1)
+
+	templates, err := loadTemplates(c.TemplatesPath)
+	if err != nil {
+		return nil, fmt.Errorf("identifier %v", err)
+	}
+
+	staticMaxAge := c.StaticMaxAge
+	if staticMaxAge <= 0 {
+		staticMaxAge = DefaultStaticMaxAge
+	}
+
+	if err = ValidateAuthorityFallback(c.AuthorityFallback); err != nil {
+		return nil, fmt.Errorf("identifier %v", err)
+	}
+	authorityFallbackDuration := c.AuthorityFallbackDuration
+	if authorityFallbackDuration <= 0 {
+		authorityFallbackDuration = DefaultAuthorityFallbackDuration
+	}
+
+	if c.BackendTimeout < 0 {
+		return nil, fmt.Errorf("identifier invalid backend timeout: %v", c.BackendTimeout)
+	}
+	if c.BackendRetries < 0 {
+		return nil, fmt.Errorf("identifier invalid backend retries: %d", c.BackendRetries)
+	}
+	if c.BackendBreakerThreshold < 0 {
+		return nil, fmt.Errorf("identifier invalid backend breaker threshold: %d", c.BackendBreakerThreshold)
+	}
+	if c.Config.WithMetrics {
+		if err = registerMetrics(c.Config.Registerer()); err != nil {
+			return nil, fmt.Errorf("identifier failed to register metrics: %v", err)
+		}
+	}
+	backend := c.Backend
+	if backend != nil && (c.BackendTimeout > 0 || c.BackendRetries > 0 || c.BackendBreakerThreshold > 0) {
+		guarded := &guardedBackend{
+			Backend: backend,
+
+			timeout: c.BackendTimeout,
+			retries: c.BackendRetries,
+		}
+		if c.BackendBreakerThreshold > 0 {
+			backendBreakerDuration := c.BackendBreakerDuration
+			if backendBreakerDuration <= 0 {
+				backendBreakerDuration = DefaultBackendBreakerDuration
+			}
+			guarded.breaker = newBackendBreaker(c.BackendBreakerThreshold, backendBreakerDuration, c.Config.Logger)
+		}
+		backend = guarded
+	}
+
 	i := &Identifier{
 		Config: c,
 
 		baseURI:         c.BaseURI,
 		pathPrefix:      c.PathPrefix,
 		staticFolder:    staticFolder,
+		staticMaxAge:    staticMaxAge,
 		logonCookieName: c.LogonCookieName,
 		scopesConf:      c.ScopesConf,
 		webappIndexHTML: webappIndexHTML,
+		templates:       templates,
 
 		authorizationEndpointURI: c.AuthorizationEndpointURI,
 		oauth2CbEndpointURI:      oauth2CbEndpointURI,
 
-		backend: c.Backend,
+		backend: backend,
+
+		authorityFallbackDuration: authorityFallbackDuration,
 
 		onSetLogonCallbacks:   make([]func(ctx context.Context, rw http.ResponseWriter, user identity.User) error, 0),
 		onUnsetLogonCallbacks: make([]func(ctx context.Context, rw http.ResponseWriter) error, 0),
 
+		credentialPolicy: credentialPolicy,
+
 		logger: c.Config.Logger,
 	}
 
-	i.meta = &meta.Meta{}
-	i.meta.Scopes, err = scopes.NewScopesFromFile(i.scopesConf, i.logger)
+	scopesMeta, err := i.LoadScopes()
 	if err != nil {
 		return nil, err
 	}
-
-	i.meta.Scopes.Extend(c.Backend.ScopesMeta())
+	i.SetScopes(scopesMeta)
 
 	return i, nil
 }
@@ -134,7 +224,9 @@ func (i *Identifier) RegisterManagers(mgrs *managers.Managers) error {
 	i.clients = mgrs.Must("clients").(*clients.Registry)
 	i.authorities = mgrs.Must("authorities").(*authorities.Registry)
 
-	if service, ok := i.backend.(managers.ServiceUsesManagers); ok {
+	// NOTE: The configured backend is checked, since the backend of the
+	// identifier might wrap it.
+	if service, ok := i.Config.Backend.(managers.ServiceUsesManagers); ok {
 		err := service.RegisterManagers(mgrs)
 		if err != nil {
 			return err
@@ -149,8 +241,8 @@ func (i *Identifier) RegisterManagers(mgrs *managers.Managers) error {
 func (i *Identifier) AddRoutes(ctx context.Context, router *mux.Router) {
 	r := router.PathPrefix(i.pathPrefix).Subrouter()
 
-	r.PathPrefix("/static/").Handler(i.staticHandler(http.StripPrefix(i.pathPrefix, http.FileServer(http.Dir(i.staticFolder))), true))
-	r.Handle("/service-worker.js", i.staticHandler(http.StripPrefix(i.pathPrefix, http.FileServer(http.Dir(i.staticFolder))), false))
+	r.PathPrefix("/static/").Handler(i.staticHandler(http.Dir(i.staticFolder), true))
+	r.Handle("/service-worker.js", i.staticHandler(http.Dir(i.staticFolder), false))
 	r.Handle("/identifier", http.HandlerFunc(i.handleIdentifier)).Methods(http.MethodGet)
 	r.Handle("/chooseaccount", i).Methods(http.MethodGet)
 	r.Handle("/consent", i).Methods(http.MethodGet)
@@ -164,6 +256,18 @@ func (i *Identifier) AddRoutes(ctx context.Context, router *mux.Router) {
 	r.Handle("/identifier/oauth2/start", http.HandlerFunc(i.handleOAuth2Start)).Methods(http.MethodGet)
 	r.Handle("/identifier/oauth2/cb", http.HandlerFunc(i.handleOAuth2Cb)).Methods(http.MethodGet)
 
+	if cp := i.credentialPolicy; cp != nil {
+		// NOTE: Lockouts are counted per username and on top of that per
+		// client IP, so that guessing passwords of many usernames from the
+		// same client gets locked out as well.
+		if cp.LockoutThreshold > 0 {
+			i.lockouts = lockoutManagers.NewMemoryMapManager(ctx, 0, cp.LockoutThreshold, cp.LockoutDuration)
+		}
+		if cp.RemoteLockoutThreshold > 0 {
+			i.remoteLockouts = lockoutManagers.NewMemoryMapManager(ctx, 0, cp.RemoteLockoutThreshold, cp.LockoutDuration)
+		}
+	}
+
 	if i.backend != nil {
 		i.backend.RunWithContext(ctx)
 	}
@@ -229,10 +333,38 @@ func (i *Identifier) ErrorPage(rw http.ResponseWriter, code int, title string, m
 // SetUserToLogonCookie serializes the provided user into an encrypted string
 // and sets it as cookie on the provided http.ResponseWriter.
 func (i *Identifier) SetUserToLogonCookie(ctx context.Context, rw http.ResponseWriter, user *IdentifiedUser) error {
+	err := i.writeLogonCookie(rw, user)
+	if err != nil {
+		return err
+	}
+	// Trigger callbacks.
+	for _, f := range i.onSetLogonCallbacks {
+		err = f(ctx, rw, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TouchLogonCookie renews the last activity time of the provided user in its
+// logon cookie on the provided http.ResponseWriter when a session idle timeout
+// is configured. It is intended to be called on interactive use only.
+func (i *Identifier) TouchLogonCookie(ctx context.Context, rw http.ResponseWriter, user *IdentifiedUser) error {
+	if i.Config.SessionIdleTimeout <= 0 {
+		return nil
+	}
+
+	return i.writeLogonCookie(rw, user)
+}
+
+func (i *Identifier) writeLogonCookie(rw http.ResponseWriter, user *IdentifiedUser) error {
 	loggedOn, logonAt := user.LoggedOn()
 	if !loggedOn {
 		return fmt.Errorf("refused to set cookie for not logged on user")
 	}
+	user.activeAt = time.Now()
 
 	// Add standard claims.
 	claims := jwt.Claims{
@@ -247,6 +379,23 @@ func (i *Identifier) SetUserToLogonCookie(ctx context.Context, rw http.ResponseW
 	if sessionRef != nil {
 		userClaims[SessionIDClaim] = user.SessionRef()
 	}
+	if user.acr != "" {
+		userClaims[ACRClaim] = user.acr
+	}
+	if len(user.amr) > 0 {
+		userClaims[AMRClaim] = user.amr
+	}
+	if user.authorityID != "" {
+		userClaims[AuthorityIDClaim] = user.authorityID
+	}
+	if i.Config.SessionIdleTimeout > 0 {
+		userClaims[ActiveAtClaim] = user.activeAt.Unix()
+	}
+	if attribute := i.Config.SubjectAttribute; needsSubjectAttributeClaim(attribute) {
+		if value, attributeErr := identity.GetUserSubjectAttribute(user, attribute); attributeErr == nil {
+			userClaims[SubjectAttributeClaim] = map[string]string{attribute: value}
+		}
+	}
 	// User defined claims.
 	userClaims[UserClaimsClaim] = user.claims
 
@@ -256,20 +405,14 @@ func (i *Identifier) SetUserToLogonCookie(ctx context.Context, rw http.ResponseW
 		return err
 	}
 
-	// Set cookie.
-	err = i.setLogonCookie(rw, serialized)
-	if err != nil {
-		return err
-	}
-	// Trigger callbacks.
-	for _, f := range i.onSetLogonCallbacks {
-		err = f(ctx, rw, user)
-		if err != nil {
-			return err
-		}
+	// Set cookie, letting the browser discard it when the session lifetime is
+	// exceeded.
+	var expires time.Time
+	if i.Config.SessionMaxLifetime > 0 {
+		expires = logonAt.Add(i.Config.SessionMaxLifetime)
 	}
 
-	return nil
+	return i.setLogonCookie(rw, serialized, expires)
 }
 
 // UnsetLogonCookie adds cookie remove headers to the provided http.ResponseWriter
@@ -365,6 +508,23 @@ func (i *Identifier) GetUserFromLogonCookie(ctx context.Context, req *http.Reque
 			return nil, nil
 		}
 	}
+	if i.Config.SessionMaxLifetime > 0 || i.Config.SessionIdleTimeout > 0 {
+		activeAt := logonAt
+		if v, ok := userClaims[ActiveAtClaim].(float64); ok {
+			activeAt = time.Unix(int64(v), 0)
+		}
+		if i.isSessionExpired(logonAt, activeAt) {
+			// Ignore logon as its session has ended and clean up the backend
+			// session if any, the logon cookie is replaced on next sign-in.
+			if sessionRef, _ := userClaims[SessionIDClaim].(string); sessionRef != "" {
+				if err = i.backend.DestroySession(ctx, &sessionRef); err != nil {
+					i.logger.WithError(err).Debugln("failed to destroy expired logon session")
+				}
+			}
+			return nil, nil
+		}
+		user.activeAt = activeAt
+	}
 
 	// Get and refresh session via claim.
 	if v, _ := userClaims[SessionIDClaim]; v != nil {
@@ -392,10 +552,43 @@ func (i *Identifier) GetUserFromLogonCookie(ctx context.Context, req *http.Reque
 	if v, _ := userClaims[UserClaimsClaim]; v != nil {
 		user.claims = v.(map[string]interface{})
 	}
+	if v, ok := userClaims[ACRClaim].(string); ok {
+		user.acr = v
+	}
+	if v, ok := userClaims[AMRClaim].([]interface{}); ok {
+		for _, amr := range v {
+			if s, ok := amr.(string); ok {
+				user.amr = append(user.amr, s)
+			}
+		}
+	}
+	if v, ok := userClaims[AuthorityIDClaim].(string); ok {
+		user.authorityID = v
+	}
+	if v, ok := userClaims[SubjectAttributeClaim].(map[string]interface{}); ok {
+		if value, ok := v[i.Config.SubjectAttribute].(string); ok {
+			user.setSubjectAttribute(i.Config.SubjectAttribute, value)
+		}
+	}
 
 	return user, nil
 }
 
+// isSessionExpired returns true if a logon session with the provided logon
+// and last activity time exceeds the configured session maximum lifetime or
+// idle timeout.
+func (i *Identifier) isSessionExpired(logonAt time.Time, activeAt time.Time) bool {
+	now := time.Now()
+	if i.Config.SessionMaxLifetime > 0 && logonAt.Add(i.Config.SessionMaxLifetime).Before(now) {
+		return true
+	}
+	if i.Config.SessionIdleTimeout > 0 && activeAt.Add(i.Config.SessionIdleTimeout).Before(now) {
+		return true
+	}
+
+	return false
+}
+
 // GetUserFromID looks up the user identified by the provided userID by
 // requesting the associated backend.
 func (i *Identifier) GetUserFromID(ctx context.Context, userID string, sessionRef *string) (*IdentifiedUser, error) {
@@ -486,6 +679,35 @@ func (i *Identifier) GetConsentFromConsentCookie(ctx context.Context, rw http.Re
 	return &consent, nil
 }
 
+// GetRememberedConsent returns the remembered Consent of the user with the
+// provided sub for the client with the provided ID, or nil if there is none
+// or no ConsentStore is configured.
+func (i *Identifier) GetRememberedConsent(ctx context.Context, sub string, clientID string) (*Consent, error) {
+	if i.Config.ConsentStore == nil {
+		return nil, nil
+	}
+
+	return i.Config.ConsentStore.Get(ctx, sub, clientID)
+}
+
+// RememberConsent remembers the provided allowing Consent of the user with
+// the provided sub for the client with the provided ID. A Consent which does
+// not allow forgets any remembered Consent instead.
+func (i *Identifier) RememberConsent(ctx context.Context, sub string, clientID string, consent *Consent) error {
+	if i.Config.ConsentStore == nil {
+		return nil
+	}
+
+	if !consent.Allow {
+		return i.Config.ConsentStore.Revoke(ctx, sub, clientID)
+	}
+
+	return i.Config.ConsentStore.Set(ctx, sub, clientID, &Consent{
+		Allow:    true,
+		RawScope: consent.RawScope,
+	})
+}
+
 // SetStateToOAuth2StateCookie serializses the provided StateRequest and sets it
 // as cookie on the provided ReponseWriter.
 func (i *Identifier) SetStateToOAuth2StateCookie(ctx context.Context, rw http.ResponseWriter, sd *StateData) error {
@@ -538,11 +760,26 @@ func (i *Identifier) Name() string {
 	return i.backend.Name()
 }
 
-// ScopesSupported return the scopes supported by the accociated Identifier.
-func (i *Identifier) ScopesSupported() []string {
+// LoadScopes loads the scopes meta data from the accociated Identifier's
+// scopes configuration file, extended with the scopes meta data of its
+// backend. The loaded scopes meta data is not used until it is set with
+// SetScopes.
+func (i *Identifier) LoadScopes() (*scopes.Scopes, error) {
+	scopesMeta, err := scopes.NewScopesFromFile(i.scopesConf, i.logger)
+	if err != nil {
+		return nil, err
+	}
+	scopesMeta.Extend(i.backend.ScopesMeta())
+
+	return scopesMeta, nil
+}
+
+// SetScopes replaces the scopes meta data of the accociated Identifier with
+// the provided scopes meta data.
+func (i *Identifier) SetScopes(scopesMeta *scopes.Scopes) {
 	scopes := mapset.NewThreadUnsafeSet()
 
-	for scope := range i.meta.Scopes.Definitions {
+	for scope := range scopesMeta.Definitions {
 		scopes.Add(scope)
 	}
 	for _, scope := range i.backend.ScopesSupported() {
@@ -555,7 +792,28 @@ func (i *Identifier) ScopesSupported() []string {
 		supportedScopes = append(supportedScopes, scope.(string))
 	}
 
-	return supportedScopes
+	i.metaMutex.Lock()
+	i.meta = &meta.Meta{
+		Scopes: scopesMeta,
+	}
+	i.scopesSupported = supportedScopes
+	i.metaMutex.Unlock()
+}
+
+// getMeta returns the current meta data of the accociated Identifier.
+func (i *Identifier) getMeta() *meta.Meta {
+	i.metaMutex.RLock()
+	defer i.metaMutex.RUnlock()
+
+	return i.meta
+}
+
+// ScopesSupported return the scopes supported by the accociated Identifier.
+func (i *Identifier) ScopesSupported() []string {
+	i.metaMutex.RLock()
+	defer i.metaMutex.RUnlock()
+
+	return i.scopesSupported
 }
 
 // OnSetLogon implements a way to register hooks whenever logon information is
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identifier/backends"
+	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
+	"stash.kopano.io/kc/konnect/identity"
+)
+
+type namedTestBackend struct {
+	backends.Backend
+}
+
+func (b *namedTestBackend) Name() string {
+	return "test"
+}
+
+func (b *namedTestBackend) ScopesMeta() *scopes.Scopes {
+	return nil
+}
+
+func (b *namedTestBackend) ScopesSupported() []string {
+	return []string{"backend-scope"}
+}
+
+func TestIsSessionExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		maxLifetime time.Duration
+		idleTimeout time.Duration
+		logonAt     time.Time
+		activeAt    time.Time
+		expired     bool
+	}{
+		{"unlimited", 0, 0, now.Add(-720 * time.Hour), now.Add(-720 * time.Hour), false},
+		{"within lifetime", time.Hour, 0, now.Add(-30 * time.Minute), now.Add(-30 * time.Minute), false},
+		{"lifetime exceeded", time.Hour, 0, now.Add(-2 * time.Hour), now, true},
+		{"active", 0, 10 * time.Minute, now.Add(-2 * time.Hour), now.Add(-5 * time.Minute), false},
+		{"idle", 0, 10 * time.Minute, now.Add(-2 * time.Hour), now.Add(-15 * time.Minute), true},
+		{"active but lifetime exceeded", time.Hour, 10 * time.Minute, now.Add(-2 * time.Hour), now, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := &Identifier{
+				Config: &Config{
+					SessionMaxLifetime: test.maxLifetime,
+					SessionIdleTimeout: test.idleTimeout,
+				},
+			}
+			if expired := i.isSessionExpired(test.logonAt, test.activeAt); expired != test.expired {
+				t.Errorf("expected expired %v, got %v", test.expired, expired)
+			}
+		})
+	}
+}
+
+func TestLogonCookieSubjectAttribute(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tests := []struct {
+		name      string
+		attribute string
+		read      string
+		expected  string
+	}{
+		{"uid", identity.SubjectAttributeUniqueID, identity.SubjectAttributeUniqueID, "unique-1"},
+		{"id", identity.SubjectAttributeID, identity.SubjectAttributeID, "42"},
+		{"email", identity.SubjectAttributeEmail, identity.SubjectAttributeEmail, "user1@example.com"},
+		{"username", identity.SubjectAttributeUsername, identity.SubjectAttributeUsername, "user1"},
+		{"sub", "", "", "subject-1"},
+		{"attribute changed", identity.SubjectAttributeUniqueID, identity.SubjectAttributeEmail, ""},
+	}
+
+	for _, test := range tests {
+		backend := &namedTestBackend{}
+		i := &Identifier{
+			Config: &Config{
+				Config:           &config.Config{},
+				SubjectAttribute: test.attribute,
+			},
+			backend:         backend,
+			logonCookieName: "test-cookie",
+			logger:          logger,
+		}
+		if err := i.SetKey(make([]byte, 32)); err != nil {
+			t.Fatal(err)
+		}
+
+		user := &IdentifiedUser{
+			sub:      "subject-1",
+			username: "user1",
+			email:    "user1@example.com",
+			id:       42,
+			uid:      "unique-1",
+			backend:  backend,
+			logonAt:  time.Now(),
+		}
+		rr := httptest.NewRecorder()
+		if err := i.writeLogonCookie(rr, user); err != nil {
+			t.Fatalf("%s: failed to write logon cookie: %v", test.name, err)
+		}
+
+		req := httptest.NewRequest("GET", "https://konnect.example.com/signin/v1/identifier/_/logon", nil)
+		for _, cookie := range rr.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		i.Config.SubjectAttribute = test.read
+		cookieUser, err := i.GetUserFromLogonCookie(req.Context(), req, 0, false)
+		if err != nil || cookieUser == nil {
+			t.Fatalf("%s: failed to get user from logon cookie: %v", test.name, err)
+		}
+
+		value, _ := identity.GetUserSubjectAttribute(cookieUser, test.read)
+		if value != test.expected {
+			t.Errorf("%s: got subject attribute %v want %v", test.name, value, test.expected)
+		}
+	}
+}
+
+func TestLoadAndSetScopes(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	tempDir, err := ioutil.TempDir("", "konnect-identifier-scopes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	scopesConf := filepath.Join(tempDir, "scopes.yaml")
+
+	i := &Identifier{
+		Config:     &Config{},
+		scopesConf: scopesConf,
+		backend:    &namedTestBackend{},
+		logger:     logger,
+	}
+
+	if _, err = i.LoadScopes(); err == nil {
+		t.Error("missing scopes conf was loaded")
+	}
+
+	if err = ioutil.WriteFile(scopesConf, []byte("scopes:\n  custom-scope:\n    title: Custom scope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	scopesMeta, err := i.LoadScopes()
+	if err != nil {
+		t.Fatalf("failed to load scopes conf: %v", err)
+	}
+	if definition, ok := scopesMeta.Definitions["custom-scope"]; !ok || definition.Title != "Custom scope" {
+		t.Errorf("unexpected scope definitions: %v", scopesMeta.Definitions)
+	}
+	if i.ScopesSupported() != nil {
+		t.Errorf("loaded scopes were used before they were set: %v", i.ScopesSupported())
+	}
+
+	i.SetScopes(scopesMeta)
+	supported := append([]string{}, i.ScopesSupported()...)
+	sort.Strings(supported)
+	if len(supported) != 2 || supported[0] != "backend-scope" || supported[1] != "custom-scope" {
+		t.Errorf("unexpected supported scopes: %v", supported)
+	}
+	if i.getMeta().Scopes != scopesMeta {
+		t.Error("scopes meta data was not set")
+	}
+
+	if err = ioutil.WriteFile(scopesConf, []byte("scopes: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.LoadScopes(); err == nil {
+		t.Error("invalid scopes conf was loaded")
+	}
+	if i.getMeta().Scopes != scopesMeta {
+		t.Error("failed load replaced the scopes meta data")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"strings"
+)
+
+// deniedReasonLockedOut is the reason of denied sign-ins, when the username or
+// the client is locked out after too many failed logon attempts.
+const deniedReasonLockedOut = "locked_out"
+
+// lockoutUsernameKey returns the key used to count failed logon attempts of
+// the provided username.
+func lockoutUsernameKey(username string) string {
+	// NOTE: Usernames are folded, so that case variants of the same username
+	// are counted together.
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// lockedOut returns true if the provided username or the provided remote
+// address is locked out after too many failed logon attempts.
+func (i *Identifier) lockedOut(username string, remote string) bool {
+	if i.lockouts != nil && i.lockouts.Locked(lockoutUsernameKey(username)) {
+		return true
+	}
+	if i.remoteLockouts != nil && i.remoteLockouts.Locked(remote) {
+		return true
+	}
+
+	return false
+}
+
+// failLockout records a failed logon attempt of the provided username from
+// the provided remote address and returns true if either of them is locked
+// out now.
+func (i *Identifier) failLockout(username string, remote string) bool {
+	locked := false
+	if i.lockouts != nil && i.lockouts.Fail(lockoutUsernameKey(username)) {
+		locked = true
+	}
+	if i.remoteLockouts != nil && i.remoteLockouts.Fail(remote) {
+		locked = true
+	}
+
+	return locked
+}
+
+// resetLockout removes the failed logon attempts of the provided username.
+// Failures of the remote address are kept, so that a successful logon with a
+// known password does not reset the limit of the client.
+func (i *Identifier) resetLockout(username string) {
+	if i.lockouts != nil {
+		i.lockouts.Reset(lockoutUsernameKey(username))
+	}
+}
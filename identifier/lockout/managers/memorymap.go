@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"stash.kopano.io/kc/konnect/identifier/lockout"
+)
+
+// Defaults used by memory map managers.
+const (
+	DefaultLockoutDuration = 15 * time.Minute
+	DefaultMaxRecords      = 10000
+)
+
+// memoryMapManager counts failed logon attempts by key in memory, locking out
+// a key when its failures reach the threshold. Records expire after the
+// duration since their last failure. The manager's methods are safe to call
+// from multiple Go routines.
+type memoryMapManager struct {
+	mutex sync.Mutex
+
+	table map[string]*list.Element
+	queue *list.List
+
+	threshold  int
+	duration   time.Duration
+	maxRecords int
+}
+
+type lockoutRecord struct {
+	key      string
+	failures int
+	when     time.Time
+}
+
+// NewMemoryMapManager creates a new lockout Manager which holds at most the
+// provided number of records and locks out keys for the provided duration
+// after the provided threshold of failures is reached. If zero values are
+// provided for maxRecords or duration, the defaults are used.
+func NewMemoryMapManager(ctx context.Context, maxRecords int, threshold int, duration time.Duration) lockout.Manager {
+	if maxRecords <= 0 {
+		maxRecords = DefaultMaxRecords
+	}
+	if duration <= 0 {
+		duration = DefaultLockoutDuration
+	}
+
+	lm := &memoryMapManager{
+		table: make(map[string]*list.Element),
+		queue: list.New(),
+
+		threshold:  threshold,
+		duration:   duration,
+		maxRecords: maxRecords,
+	}
+
+	// Cleanup function.
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lm.mutex.Lock()
+				lm.purgeExpired()
+				lm.mutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return lm
+}
+
+// purgeExpired removes all expired records, oldest first. The accociated
+// manager's mutex must be held when calling.
+func (lm *memoryMapManager) purgeExpired() {
+	deadline := time.Now().Add(-lm.duration)
+	for {
+		element := lm.queue.Front()
+		if element == nil {
+			return
+		}
+		record := element.Value.(*lockoutRecord)
+		if record.when.After(deadline) {
+			// NOTE: Records are queued in order of their last failure, thus
+			// all remaining records are not expired.
+			return
+		}
+		lm.queue.Remove(element)
+		delete(lm.table, record.key)
+	}
+}
+
+// Locked returns true if the provided key is locked out in the accociated
+// manager.
+func (lm *memoryMapManager) Locked(key string) bool {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	element, found := lm.table[key]
+	if !found {
+		return false
+	}
+	record := element.Value.(*lockoutRecord)
+	if time.Since(record.when) >= lm.duration {
+		lm.queue.Remove(element)
+		delete(lm.table, key)
+		return false
+	}
+
+	return record.failures >= lm.threshold
+}
+
+// Fail records a failed logon attempt for the provided key in the accociated
+// manager and returns true if the key is locked out now. If the table is
+// full, expired records are removed and then the records with the oldest last
+// failure, so that failures can always be recorded.
+func (lm *memoryMapManager) Fail(key string) bool {
+	now := time.Now()
+
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+
+	var record *lockoutRecord
+	if element, found := lm.table[key]; found {
+		record = element.Value.(*lockoutRecord)
+		if now.Sub(record.when) >= lm.duration {
+			record.failures = 0
+		}
+		lm.queue.MoveToBack(element)
+	} else {
+		if len(lm.table) >= lm.maxRecords {
+			lm.purgeExpired()
+			for len(lm.table) >= lm.maxRecords {
+				element := lm.queue.Front()
+				lm.queue.Remove(element)
+				delete(lm.table, element.Value.(*lockoutRecord).key)
+			}
+		}
+		record = &lockoutRecord{
+			key: key,
+		}
+		lm.table[key] = lm.queue.PushBack(record)
+	}
+	record.failures++
+	record.when = now
+
+	return record.failures >= lm.threshold
+}
+
+// Reset removes the failed logon attempts of the provided key from the
+// accociated manager.
+func (lm *memoryMapManager) Reset(key string) {
+	lm.mutex.Lock()
+	if element, found := lm.table[key]; found {
+		lm.queue.Remove(element)
+		delete(lm.table, key)
+	}
+	lm.mutex.Unlock()
+}
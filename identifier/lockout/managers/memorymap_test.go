@@ -0,0 +1,94 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryMapManagerFailReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lm := NewMemoryMapManager(ctx, 0, 3, time.Hour)
+	for i := 1; i < 3; i++ {
+		if lm.Fail("a") {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+	if lm.Locked("a") {
+		t.Fatalf("locked before threshold")
+	}
+	if !lm.Fail("a") || !lm.Locked("a") {
+		t.Fatalf("not locked at threshold")
+	}
+	if lm.Locked("b") {
+		t.Errorf("unrelated key locked")
+	}
+	lm.Reset("a")
+	if lm.Locked("a") {
+		t.Errorf("locked after reset")
+	}
+}
+
+func TestMemoryMapManagerExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lm := NewMemoryMapManager(ctx, 10, 1, time.Minute).(*memoryMapManager)
+	lm.Fail("a")
+	lm.Fail("b")
+	lm.table["a"].Value.(*lockoutRecord).when = time.Now().Add(-2 * time.Minute)
+	if lm.Locked("a") {
+		t.Errorf("locked after expiry")
+	}
+
+	lm.Fail("c")
+	lm.table["b"].Value.(*lockoutRecord).when = time.Now().Add(-2 * time.Minute)
+	lm.purgeExpired()
+	if _, ok := lm.table["b"]; ok {
+		t.Errorf("expired record was not purged")
+	}
+	if len(lm.table) != 1 || lm.queue.Len() != 1 {
+		t.Errorf("unexpected number of records after purge: %d %d", len(lm.table), lm.queue.Len())
+	}
+}
+
+func TestMemoryMapManagerMaxRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lm := NewMemoryMapManager(ctx, 2, 2, time.Hour).(*memoryMapManager)
+	lm.Fail("a")
+	lm.Fail("b")
+	// Failing again moves the record to the back of the queue.
+	lm.Fail("a")
+	lm.Fail("c")
+
+	if len(lm.table) != 2 || lm.queue.Len() != 2 {
+		t.Fatalf("manager not bounded: got %d records", len(lm.table))
+	}
+	if _, ok := lm.table["b"]; ok {
+		t.Errorf("record with oldest failure was not evicted")
+	}
+	if !lm.Locked("a") {
+		t.Errorf("record with recent failure was evicted")
+	}
+}
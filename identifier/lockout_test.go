@@ -0,0 +1,75 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lockoutManagers "stash.kopano.io/kc/konnect/identifier/lockout/managers"
+)
+
+func TestIdentifierLockout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	i := &Identifier{
+		lockouts:       lockoutManagers.NewMemoryMapManager(ctx, 0, 2, time.Hour),
+		remoteLockouts: lockoutManagers.NewMemoryMapManager(ctx, 0, 3, time.Hour),
+	}
+
+	// Case variants of the username count together.
+	if i.failLockout("Alice", "192.0.2.1") {
+		t.Fatalf("locked after first failure")
+	}
+	if !i.failLockout(" alice", "192.0.2.2") {
+		t.Fatalf("username not locked at threshold")
+	}
+	if !i.lockedOut("ALICE", "192.0.2.3") {
+		t.Errorf("username not locked from other remote")
+	}
+	i.resetLockout("alice")
+	if i.lockedOut("alice", "192.0.2.3") {
+		t.Errorf("username locked after reset")
+	}
+
+	// The remote limit applies across usernames.
+	i.failLockout("bob", "192.0.2.9")
+	i.failLockout("carol", "192.0.2.9")
+	if i.lockedOut("dave", "192.0.2.9") {
+		t.Fatalf("remote locked before threshold")
+	}
+	if !i.failLockout("erin", "192.0.2.9") || !i.lockedOut("dave", "192.0.2.9") {
+		t.Errorf("remote not locked at threshold")
+	}
+	if i.lockedOut("dave", "192.0.2.10") {
+		t.Errorf("unrelated remote locked")
+	}
+
+	// Without managers nothing is locked out.
+	unlimited := &Identifier{}
+	for n := 0; n < 5; n++ {
+		if unlimited.failLockout("alice", "192.0.2.1") {
+			t.Fatalf("locked without lockout managers")
+		}
+	}
+	if unlimited.lockedOut("alice", "192.0.2.1") {
+		t.Errorf("locked without lockout managers")
+	}
+}
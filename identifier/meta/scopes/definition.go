@@ -20,6 +20,18 @@ package scopes
 // A Definition contains the meta data for a single scope.
 type Definition struct {
 	Priority    int    `json:"priority" yaml:"priority"`
+	Title       string `json:"title,omitempty" yaml:"title"`
 	Description string `json:"description,omitempty" yaml:"description"`
 	ID          string `json:"id,omitempty"`
+
+	// Localized holds localized titles and descriptions keyed by locale
+	// (Eg. de or de-DE).
+	Localized map[string]*Localization `json:"localized,omitempty" yaml:"localized"`
+}
+
+// A Localization contains the localized human readable meta data for a single
+// scope.
+type Localization struct {
+	Title       string `json:"title,omitempty" yaml:"title"`
+	Description string `json:"description,omitempty" yaml:"description"`
 }
@@ -62,6 +62,18 @@ var defaultScopesDefinitionMap = map[string]*Definition{
 type Scopes struct {
 	Mapping     map[string]string      `json:"mapping" yaml:"mapping"`
 	Definitions map[string]*Definition `json:"definitions" yaml:"scopes"`
+
+	// ProfileClaims maps profile claims to the identity manager user
+	// attributes they are populated from.
+	ProfileClaims map[string]string `json:"-" yaml:"profile_claims"`
+
+	// ClaimsPlacement maps scopes to where the claims released for them
+	// appear, one of id_token, userinfo or both.
+	ClaimsPlacement map[string]string `json:"-" yaml:"claims_placement"`
+
+	// AccessTokenClaims maps scopes to the claims of the user which are
+	// added to access tokens when the scope is authorized.
+	AccessTokenClaims map[string][]string `json:"-" yaml:"access_token_claims"`
 }
 
 // NewScopesFromIDs creates a new scopes meta data collection from the provided
@@ -118,6 +130,9 @@ func NewScopesFromFile(scopesConfFilepath string, logger logrus.FieldLogger) (*S
 				"id":       id,
 				"priority": definition.Priority,
 			}
+			if definition.Title != "" {
+				fields["title"] = definition.Title
+			}
 
 			logger.WithFields(fields).Debugln("registered scope")
 		}
@@ -130,6 +145,33 @@ func NewScopesFromFile(scopesConfFilepath string, logger logrus.FieldLogger) (*S
 
 			logger.WithFields(fields).Debugln("registered scope mapping")
 		}
+
+		for claim, attribute := range scopes.ProfileClaims {
+			fields := logrus.Fields{
+				"claim":     claim,
+				"attribute": attribute,
+			}
+
+			logger.WithFields(fields).Debugln("registered profile claim mapping")
+		}
+
+		for scope, placement := range scopes.ClaimsPlacement {
+			fields := logrus.Fields{
+				"scope":     scope,
+				"placement": placement,
+			}
+
+			logger.WithFields(fields).Debugln("registered claims placement")
+		}
+
+		for scope, claims := range scopes.AccessTokenClaims {
+			fields := logrus.Fields{
+				"scope":  scope,
+				"claims": claims,
+			}
+
+			logger.WithFields(fields).Debugln("registered access token claims")
+		}
 	}
 
 	if scopes.Mapping == nil {
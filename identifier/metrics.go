@@ -0,0 +1,61 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsSubsystem = "identifier"
+
+var (
+	backendBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "konnect",
+			Subsystem: metricsSubsystem,
+			Name:      "backend_breaker_state",
+			Help:      "Current state of the identifier backend circuit breaker, 1 for the current state and 0 otherwise.",
+		},
+		[]string{"state"},
+	)
+	backendBreakerRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "konnect",
+			Subsystem: metricsSubsystem,
+			Name:      "backend_breaker_rejections_total",
+			Help:      "Number of identifier backend requests rejected while the circuit breaker was open.",
+		},
+	)
+)
+
+// registerMetrics registers the identifier metrics with the provided
+// prometheus registerer. It is safe to call multiple times with the same
+// registerer.
+func registerMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		backendBreakerState,
+		backendBreakerRejections,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -126,6 +126,8 @@ type StateData struct {
 
 	ClientID string `json:"client_id"`
 	Ref      string `json:"ref,omitempty"`
+
+	Nonce string `json:"nonce,omitempty"`
 }
 
 // A ConsentRequest is the request data as sent to the consent endpoint.
@@ -137,12 +139,14 @@ type ConsentRequest struct {
 	RawRedirectURI string `json:"redirect_uri"`
 	Ref            string `json:"ref"`
 	Nonce          string `json:"flow_nonce"`
+	Remember       bool   `json:"remember"`
 }
 
 // Consent is the data received and sent to allow or cancel consent flows.
 type Consent struct {
 	Allow    bool   `json:"allow"`
 	RawScope string `json:"scope"`
+	Remember bool   `json:"remember,omitempty"`
 }
 
 // Scopes returns the associated consents approved scopes filtered by the
@@ -164,3 +168,20 @@ func (c *Consent) Scopes(requestedScopes map[string]bool) (map[string]bool, map[
 
 	return approved, scopes
 }
+
+// Covers returns true if the associated consent allows all of the provided
+// requested scopes.
+func (c *Consent) Covers(requestedScopes map[string]bool) bool {
+	if !c.Allow {
+		return false
+	}
+
+	_, scopes := c.Scopes(nil)
+	for n, v := range requestedScopes {
+		if ok, _ := scopes[n]; v && !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -11,6 +11,7 @@ import {
   ERROR_LOGIN_VALIDATE_MISSINGUSERNAME,
   ERROR_LOGIN_VALIDATE_MISSINGPASSWORD,
   ERROR_LOGIN_FAILED,
+  ERROR_LOGIN_LOCKED,
   ERROR_HTTP_UNEXPECTED_RESPONSE_STATUS,
   ERROR_HTTP_UNEXPECTED_RESPONSE_STATE
 } from '../errors';
@@ -98,7 +99,8 @@ export function executeLogon(username, password, mode=ModeLogonUsernamePassword)
     return axios.post('./identifier/_/logon', r, {
       headers: {
         'Kopano-Konnect-XSRF': '1'
-      }
+      },
+      validateStatus: status => (status >= 200 && status < 300) || status === 429
     }).then(response => {
       switch (response.status) {
         case 200:
@@ -113,6 +115,15 @@ export function executeLogon(username, password, mode=ModeLogonUsernamePassword)
               http: new Error(ERROR_LOGIN_FAILED)
             }
           };
+        case 429:
+          // locked out after too many failed attempts.
+          return {
+            success: false,
+            state: r.state,
+            errors: {
+              http: new Error(ERROR_LOGIN_LOCKED)
+            }
+          };
         default:
           // error.
           throw new ExtendedError(ERROR_HTTP_UNEXPECTED_RESPONSE_STATUS, response);
@@ -147,7 +158,7 @@ export function executeLogon(username, password, mode=ModeLogonUsernamePassword)
   };
 }
 
-export function executeConsent(allow=false, scope='') {
+export function executeConsent(allow=false, scope='', remember=false) {
   return function(dispatch, getState) {
     dispatch(requestConsent(allow));
 
@@ -159,7 +170,8 @@ export function executeConsent(allow=false, scope='') {
       client_id: query.client_id || '', // eslint-disable-line camelcase
       redirect_uri: query.redirect_uri || '', // eslint-disable-line camelcase
       ref: query.state || '',
-      flow_nonce: query.nonce || '' // eslint-disable-line camelcase
+      flow_nonce: query.nonce || '', // eslint-disable-line camelcase
+      remember
     });
     return axios.post('./identifier/_/consent', r, {
       headers: {
@@ -12,6 +12,8 @@ import CircularProgress from '@material-ui/core/CircularProgress';
 import green from '@material-ui/core/colors/green';
 import Typography from '@material-ui/core/Typography';
 import DialogActions from '@material-ui/core/DialogActions';
+import FormControlLabel from '@material-ui/core/FormControlLabel';
+import Checkbox from '@material-ui/core/Checkbox';
 
 import { executeConsent, advanceLogonFlow, receiveValidateLogon } from '../actions/login-actions';
 import { ErrorMessage } from '../errors';
@@ -38,6 +40,9 @@ const styles = theme => ({
   scopesList: {
     marginBottom: theme.spacing.unit * 2
   },
+  offlineAccess: {
+    marginBottom: theme.spacing.unit * 2
+  },
   wrapper: {
     marginTop: theme.spacing.unit * 2,
     position: 'relative',
@@ -50,6 +55,10 @@ const styles = theme => ({
 });
 
 class Consent extends Component {
+  state = {
+    remember: false
+  };
+
   componentDidMount() {
     const { dispatch, hello, history, client } = this.props;
     if ((!hello || !hello.state || !client) && history.action !== 'PUSH') {
@@ -72,19 +81,32 @@ class Consent extends Component {
     }).join(' ');
 
     const { dispatch, history } = this.props;
-    dispatch(executeConsent(allow, scope)).then((response) => {
+    const { remember } = this.state;
+    dispatch(executeConsent(allow, scope, remember)).then((response) => {
       if (response.success) {
         dispatch(advanceLogonFlow(response.success, history, true, {konnect: response.state}));
       }
     });
   }
 
+  handleRememberChange = (event) => {
+    this.setState({
+      remember: event.target.checked
+    });
+  }
+
   render() {
-    const { classes, loading, hello, errors, client } = this.props;
+    const { classes, loading, hello, errors, client, consentRemember } = this.props;
+    const { remember } = this.state;
 
     const scopes = hello.details.scopes || {};
     const meta = hello.details.meta || {};
 
+    // Offline access is surfaced separately, since it allows the client to
+    // keep access without further interaction.
+    const offlineAccess = !!scopes.offline_access;
+    const listedScopes = Object.assign({}, scopes, {offline_access: false});
+
     return (
       <div>
         <Typography variant="h5" component="h3">
@@ -118,7 +140,18 @@ class Consent extends Component {
             }}
           ></FormattedMessage>
         </Typography>
-        <ScopesList dense disablePadding className={classes.scopesList} scopes={scopes} meta={meta.scopes}></ScopesList>
+        <ScopesList dense disablePadding className={classes.scopesList} scopes={listedScopes} meta={meta.scopes}></ScopesList>
+        {renderIf(offlineAccess)(() => (
+          <Typography variant="body2" color="error" className={classes.offlineAccess}>
+            <FormattedMessage
+              id="konnect.consent.offlineAccess"
+              defaultMessage="{clientDisplayName} also wants offline access. This keeps the allowed access even when you are signed out, until you revoke it."
+              values={{
+                clientDisplayName: <em><ClientDisplayName client={client}/></em>
+              }}
+            ></FormattedMessage>
+          </Typography>
+        ))}
 
         <Typography variant="subtitle1" gutterBottom>
           <FormattedMessage
@@ -135,6 +168,20 @@ class Consent extends Component {
             defaultMessage="By clicking Allow, you allow this app to use your information.">
           </FormattedMessage>
         </Typography>
+        {renderIf(consentRemember)(() => (
+          <FormControlLabel
+            control={<Checkbox
+              checked={remember}
+              disabled={!!loading}
+              onChange={this.handleRememberChange}
+              color="primary"
+            />}
+            label={<FormattedMessage
+              id="konnect.consent.remember.label"
+              defaultMessage="Remember this decision">
+            </FormattedMessage>}
+          />
+        ))}
 
         <form action="" onSubmit={this.action(undefined, scopes)}>
           <DialogActions>
@@ -183,20 +230,22 @@ Consent.propTypes = {
   errors: PropTypes.object.isRequired,
   hello: PropTypes.object,
   client: PropTypes.object.isRequired,
+  consentRemember: PropTypes.bool,
 
   dispatch: PropTypes.func.isRequired,
   history: PropTypes.object.isRequired
 };
 
 const mapStateToProps = (state) => {
-  const { hello } = state.common;
+  const { hello, consentRemember } = state.common;
   const { loading, errors } = state.login;
 
   return {
     loading: loading,
     errors,
     hello,
-    client: hello.details.client || {}
+    client: hello.details.client || {},
+    consentRemember
   };
 };
 
@@ -1,6 +1,7 @@
 import React from 'react';
 import PropTypes from 'prop-types';
 import classNames from 'classnames';
+import { connect } from 'react-redux';
 
 import { withStyles } from '@material-ui/core/styles';
 import Grid from '@material-ui/core/Grid';
@@ -25,6 +26,9 @@ const styles = theme => ({
     paddingRight: 2 * theme.spacing.unit,
     position: 'relative'
   },
+  compact: {
+    minHeight: 0
+  },
   logo: {
     height: 18,
     marginBottom: theme.spacing.unit * 2
@@ -45,11 +49,16 @@ function ResponsiveScreen(props) {
     loading,
     children,
     className,
+    display,
     DialogProps,
     PaperProps,
+    dispatch, // eslint-disable-line no-unused-vars
     ...other
   } = props;
 
+  // Popups and touch devices get a compact layout which fills the window.
+  const compact = display === 'popup' || display === 'touch';
+
   const logo = withoutLogo ? null :
     <DialogContent><img src={KopanoLogo} className={classes.logo} alt="Kopano"/></DialogContent>;
 
@@ -60,10 +69,11 @@ function ResponsiveScreen(props) {
       className={classNames(classes.root, className)} {...other}>
       <ResponsiveDialog open fullWidth maxWidth="sm"
         disableBackdropClick disableEscapeKeyDown hideBackdrop
+        {...(compact ? {fullScreen: true} : {})}
         {...DialogProps}
         PaperProps={{elevation: 4, ...PaperProps}}
       >
-        <div className={classes.content}>
+        <div className={classNames(classes.content, {[classes.compact]: compact})}>
           {logo}
           {content}
         </div>
@@ -85,8 +95,19 @@ ResponsiveScreen.propTypes = {
   withoutPadding: PropTypes.bool,
   children: PropTypes.node.isRequired,
   className: PropTypes.string,
+  display: PropTypes.string,
   PaperProps: PropTypes.object,
-  DialogProps: PropTypes.object
+  DialogProps: PropTypes.object,
+
+  dispatch: PropTypes.func
+};
+
+const mapStateToProps = (state) => {
+  const { display } = state.common;
+
+  return {
+    display
+  };
 };
 
-export default withStyles(styles)(ResponsiveScreen);
+export default connect(mapStateToProps)(withStyles(styles)(ResponsiveScreen));
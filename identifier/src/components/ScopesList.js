@@ -26,6 +26,16 @@ const scopeIDTranslations = defineMessages({
   }
 });
 
+// Returns the localized values of the provided definition for the provided
+// locale, falling back to the base language of the locale.
+const getLocalized = (definition, locale) => {
+  const localized = definition.localized;
+  if (!localized || !locale) {
+    return {};
+  }
+  return localized[locale] || localized[locale.split('-')[0]] || {};
+};
+
 const ScopesList = ({scopes, meta, classes, intl, ...rest}) => {
   const { mapping, definitions } = meta;
 
@@ -48,6 +58,7 @@ const ScopesList = ({scopes, meta, classes, intl, ...rest}) => {
     }
     let definition = definitions[id];
     let label ;
+    let description;
     if (definition) {
       if (definition.id) {
         const translation = scopeIDTranslations[definition.id];
@@ -56,7 +67,15 @@ const ScopesList = ({scopes, meta, classes, intl, ...rest}) => {
         }
       }
       if (!label) {
-        label = definition.description;
+        const localized = getLocalized(definition, intl.locale);
+        const title = localized.title || definition.title;
+        description = localized.description || definition.description;
+        if (title) {
+          label = title;
+        } else {
+          label = description;
+          description = undefined;
+        }
       }
     }
     if (!label) {
@@ -78,7 +97,7 @@ const ScopesList = ({scopes, meta, classes, intl, ...rest}) => {
           disableRipple
           disabled
         />
-        <ListItemText primary={label} />
+        <ListItemText primary={label} secondary={description} />
       </ListItem>
     );
   }
@@ -3,6 +3,7 @@ import { injectIntl, defineMessages } from 'react-intl';
 export const ERROR_LOGIN_VALIDATE_MISSINGUSERNAME = 'konnect.error.login.validate.missingUsername';
 export const ERROR_LOGIN_VALIDATE_MISSINGPASSWORD = 'konnect.error.login.validate.missingPassword';
 export const ERROR_LOGIN_FAILED = 'konnect.error.login.failed';
+export const ERROR_LOGIN_LOCKED = 'konnect.error.login.locked';
 export const ERROR_HTTP_NETWORK_ERROR = 'konnet.error.http.networkError';
 export const ERROR_HTTP_UNEXPECTED_RESPONSE_STATUS = 'konnect.error.http.unexpectedResponseStatus';
 export const ERROR_HTTP_UNEXPECTED_RESPONSE_STATE = 'konnect.error.http.unexpectedResponseState';
@@ -21,6 +22,10 @@ const translations = defineMessages({
     id: ERROR_LOGIN_FAILED,
     defaultMessage: 'Logon failed. Please verify your credentials and try again.'
   },
+  [ERROR_LOGIN_LOCKED]: {
+    id: ERROR_LOGIN_LOCKED,
+    defaultMessage: 'Too many failed logon attempts. Please try again later.'
+  },
   [ERROR_HTTP_NETWORK_ERROR]: {
     id: ERROR_HTTP_NETWORK_ERROR,
     defaultMessage: 'Network error. Please check your connection and try again.'
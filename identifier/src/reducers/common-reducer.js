@@ -19,13 +19,46 @@ const defaultPathPrefix = (() => {
   return pathPrefix;
 })();
 
+const defaultCredentialPolicy = (() => {
+  const credentialPolicy = document.getElementById('root').getAttribute('data-credential-policy');
+  if (!credentialPolicy || credentialPolicy === '__CREDENTIAL_POLICY__') {
+    // No policy, or not replaced.
+    return null;
+  }
+  try {
+    return JSON.parse(credentialPolicy);
+  } catch (err) {
+    return null;
+  }
+})();
+
+const defaultDisplay = (() => {
+  // NOTE: Only display values which are supported by the server are passed
+  // along, everything else uses the default page display.
+  switch (query.display) {
+    case 'popup':
+    case 'touch':
+      return query.display;
+    default:
+      return 'page';
+  }
+})();
+
+const defaultConsentRemember = (() => {
+  // Not replaced means false, remembering consent needs server support.
+  return document.getElementById('root').getAttribute('data-consent-remember') === 'true';
+})();
+
 const defaultState = {
   hello: null,
   error: null,
   flow: flow,
   query: query,
   updateAvailable: false,
-  pathPrefix: defaultPathPrefix
+  pathPrefix: defaultPathPrefix,
+  credentialPolicy: defaultCredentialPolicy,
+  consentRemember: defaultConsentRemember,
+  display: defaultDisplay
 };
 
 function commonReducer(state = defaultState, action) {
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStaticMaxAge is the default duration for which static assets with
+// a content hash in their filename may be cached.
+const DefaultStaticMaxAge = 365 * 24 * time.Hour
+
+// staticContentHashPattern matches filenames with a content hash as created
+// by the web app build, for example `main.1a2b3c4d.chunk.js`.
+var staticContentHashPattern = regexp.MustCompile(`\.[0-9a-f]{8,}\.`)
+
+// staticPrecompressedEncodings lists the content encodings for which
+// precompressed variants of static assets are served, in order of
+// preference, with the filename suffix of the variant.
+var staticPrecompressedEncodings = []struct {
+	encoding string
+	suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticCompressibleContentTypes lists the content type prefixes which are
+// compressed on the fly.
+var staticCompressibleContentTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+func (i *Identifier) staticHandler(fs http.FileSystem, cache bool) http.Handler {
+	fileServer := http.FileServer(fs)
+	maxAge := strconv.FormatInt(int64(i.staticMaxAge/time.Second), 10)
+
+	return http.StripPrefix(i.pathPrefix, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		addCommonResponseHeaders(rw.Header())
+		if cache && staticContentHashPattern.MatchString(path.Base(req.URL.Path)) {
+			rw.Header().Set("Cache-Control", "max-age="+maxAge+", public, immutable")
+		} else {
+			rw.Header().Set("Cache-Control", "no-cache, max-age=0, public")
+		}
+		if strings.HasSuffix(req.URL.Path, "/") {
+			// Do not serve folder-ish resources.
+			i.ErrorPage(rw, http.StatusNotFound, "", "")
+			return
+		}
+
+		if !i.Config.StaticCompression || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+			fileServer.ServeHTTP(rw, req)
+			return
+		}
+		rw.Header().Add("Vary", "Accept-Encoding")
+
+		encodings := acceptedEncodings(req.Header.Get("Accept-Encoding"))
+		if serveStaticPrecompressed(rw, req, fs, encodings) {
+			return
+		}
+
+		// NOTE: Ranges cannot be served from content compressed on the fly.
+		req.Header.Del("Range")
+		cw := newCompressResponseWriter(rw, encodings)
+		defer cw.Close()
+		fileServer.ServeHTTP(cw, req)
+	}))
+}
+
+// serveStaticPrecompressed serves the precompressed variant of the file
+// requested with the provided request if the variant exists in the provided
+// file system for one of the provided accepted encodings. Returns true if the
+// request was served.
+func serveStaticPrecompressed(rw http.ResponseWriter, req *http.Request, fs http.FileSystem, encodings map[string]bool) bool {
+	for _, precompressed := range staticPrecompressedEncodings {
+		if !encodings[precompressed.encoding] {
+			continue
+		}
+		f, err := fs.Open(req.URL.Path + precompressed.suffix)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		defer f.Close()
+
+		// NOTE: The content type is derived from the name of the requested
+		// file, not from the precompressed variant.
+		rw.Header().Set("Content-Encoding", precompressed.encoding)
+		http.ServeContent(rw, req, path.Base(req.URL.Path), info.ModTime(), f)
+		return true
+	}
+
+	return false
+}
+
+// acceptedEncodings parses the provided Accept-Encoding header value and
+// returns the content encodings which are acceptable.
+func acceptedEncodings(value string) map[string]bool {
+	encodings := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		params := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if encoding == "" {
+			continue
+		}
+		accepted := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err != nil || q <= 0 {
+					accepted = false
+				}
+			}
+		}
+		encodings[encoding] = accepted
+	}
+
+	return encodings
+}
+
+// compressResponseWriter is a http.ResponseWriter which compresses successful
+// responses with compressible content types with gzip or deflate.
+type compressResponseWriter struct {
+	http.ResponseWriter
+
+	encoding    string
+	writer      io.WriteCloser
+	wroteHeader bool
+}
+
+func newCompressResponseWriter(rw http.ResponseWriter, encodings map[string]bool) *compressResponseWriter {
+	cw := &compressResponseWriter{
+		ResponseWriter: rw,
+	}
+	switch {
+	case encodings["gzip"]:
+		cw.encoding = "gzip"
+	case encodings["deflate"]:
+		cw.encoding = "deflate"
+	}
+
+	return cw
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if cw.encoding != "" && status == http.StatusOK && header.Get("Content-Encoding") == "" && isCompressibleContentType(header.Get("Content-Type")) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		switch cw.encoding {
+		case "gzip":
+			cw.writer = gzip.NewWriter(cw.ResponseWriter)
+		case "deflate":
+			// NOTE: The deflate content coding is the zlib format, see
+			// https://tools.ietf.org/html/rfc7230#section-4.2.2.
+			cw.writer = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.writer != nil {
+		return cw.writer.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Close flushes and closes the compressor of the accociated writer if any.
+func (cw *compressResponseWriter) Close() error {
+	if cw.writer == nil {
+		return nil
+	}
+	if err := cw.writer.Close(); err != nil {
+		return fmt.Errorf("failed to close compressor: %v", err)
+	}
+
+	return nil
+}
+
+func isCompressibleContentType(contentType string) bool {
+	for _, prefix := range staticCompressibleContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identifier
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+	encodings := acceptedEncodings("gzip;q=0.8, br, deflate;q=0, identity")
+	for encoding, expected := range map[string]bool{
+		"gzip":     true,
+		"br":       true,
+		"deflate":  false,
+		"identity": true,
+		"compress": false,
+	} {
+		if encodings[encoding] != expected {
+			t.Errorf("unexpected accepted state for %v: got %v want %v", encoding, encodings[encoding], expected)
+		}
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konnect-identifier-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	js := strings.Repeat("console.log('unittest');\n", 64)
+	for name, content := range map[string]string{
+		"static/js/main.1a2b3c4d.chunk.js":    js,
+		"static/js/main.1a2b3c4d.chunk.js.br": "unittest-brotli",
+		"static/js/other.js":                  js,
+		"static/media/logo.png":               "\x89PNG\r\n\x1a\n",
+	} {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := &Identifier{
+		Config: &Config{
+			StaticCompression: true,
+		},
+		pathPrefix:   "/signin/v1",
+		staticMaxAge: DefaultStaticMaxAge,
+	}
+	handler := i.staticHandler(http.Dir(dir), true)
+
+	for _, test := range []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		encoding       string
+		cacheControl   string
+		body           string
+	}{
+		{"precompressed", "/static/js/main.1a2b3c4d.chunk.js", "gzip, br", "br", "max-age=31536000, public, immutable", "unittest-brotli"},
+		{"gzip", "/static/js/main.1a2b3c4d.chunk.js", "gzip", "gzip", "max-age=31536000, public, immutable", js},
+		{"deflate", "/static/js/other.js", "deflate", "deflate", "no-cache, max-age=0, public", js},
+		{"uncompressed", "/static/js/other.js", "", "", "no-cache, max-age=0, public", js},
+		{"incompressible", "/static/media/logo.png", "gzip", "", "no-cache, max-age=0, public", "\x89PNG\r\n\x1a\n"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, i.pathPrefix+test.path, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %v want %v", test.name, rr.Code, http.StatusOK)
+			continue
+		}
+		if encoding := rr.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s: wrong content encoding: got %v want %v", test.name, encoding, test.encoding)
+		}
+		if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != test.cacheControl {
+			t.Errorf("%s: wrong cache control: got %v want %v", test.name, cacheControl, test.cacheControl)
+		}
+		if contentType := rr.Header().Get("Content-Type"); strings.HasSuffix(test.path, ".js") && !strings.Contains(contentType, "javascript") {
+			t.Errorf("%s: wrong content type: %v", test.name, contentType)
+		}
+
+		body := rr.Body.String()
+		var reader io.Reader
+		var readerErr error
+		switch test.encoding {
+		case "gzip":
+			reader, readerErr = gzip.NewReader(rr.Body)
+		case "deflate":
+			reader, readerErr = zlib.NewReader(rr.Body)
+		}
+		if readerErr != nil {
+			t.Errorf("%s: invalid %s body: %v", test.name, test.encoding, readerErr)
+			continue
+		}
+		if reader != nil {
+			b, _ := ioutil.ReadAll(reader)
+			body = string(b)
+		}
+		if body != test.body {
+			t.Errorf("%s: wrong body: %v", test.name, body)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect/identity/authorities"
+)
+
+// Names of the server rendered pages of the identifier which can be replaced
+// by templates with the same file name in the configured templates directory.
+const (
+	TemplateNameAuthorityChooser = "authority-chooser.html"
+)
+
+// localSignInParameter is the query parameter set by the local sign-in entry
+// of the authority chooser to continue with the local sign-in.
+const localSignInParameter = "local"
+
+// templateNames are the names of all server rendered pages of the identifier
+// which can be replaced by templates.
+var templateNames = []string{
+	TemplateNameAuthorityChooser,
+}
+
+var authorityChooserTemplate = template.Must(template.New(TemplateNameAuthorityChooser).Parse(`
+<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style nonce="{{.Nonce}}">
+body { font-family: sans-serif; margin: 0; padding: 2em 1em; color: #333; }
+main { max-width: 24em; margin: 0 auto; }
+h1 { font-size: 1.4em; font-weight: normal; }
+ul { list-style: none; margin: 0; padding: 0; }
+li { margin: 0.5em 0; }
+a { display: flex; align-items: center; padding: 0.8em 1em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+a:hover, a:focus, a.default { border-color: #666; }
+a.default { font-weight: bold; }
+img { width: 1.5em; height: 1.5em; margin-right: 0.8em; object-fit: contain; }
+</style>
+</head>
+<body>
+<main>
+<h1>Choose how to sign in</h1>
+<ul>
+{{range .Authorities}}<li><a href="{{.URI}}"{{if .Local}} data-local{{else}} data-authority-id="{{.ID}}"{{end}}{{if .Default}} class="default"{{end}}>{{if .IconURL}}<img src="{{.IconURL}}" alt="">{{end}}<span>{{.Name}}</span></a></li>
+{{end}}</ul>
+</main>
+</body>
+</html>
+`))
+
+// authorityChooserPageData is the data provided to authority chooser
+// templates.
+type authorityChooserPageData struct {
+	Authorities []*authorityChoice
+	Nonce       string
+}
+
+// authorityChoice is an authority listed in the authority chooser. Default
+// marks the default authority. The local sign-in is listed as choice with
+// Local set and without ID.
+type authorityChoice struct {
+	ID      string
+	Name    string
+	IconURL string
+	Default bool
+	Local   bool
+
+	// URI is the relative URI of the identifier which continues the current
+	// sign-in request with the accociated authority.
+	URI string
+}
+
+// loadTemplates loads the templates found in the provided directory, which
+// replace the built-in templates of the server rendered page with the same
+// name. Pages without template in the directory use the built-in template.
+func loadTemplates(templatesPath string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if templatesPath == "" {
+		return templates, nil
+	}
+
+	for _, name := range templateNames {
+		fn := filepath.Join(templatesPath, name)
+		if _, err := os.Stat(fn); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to access template %v: %v", name, err)
+		}
+		t, err := template.New(name).ParseFiles(fn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %v: %v", name, err)
+		}
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// getTemplate returns the template for the server rendered page with the
+// provided name, which is the loaded template if any and the provided built-in
+// template otherwise.
+func (i *Identifier) getTemplate(name string, builtin *template.Template) *template.Template {
+	if t, ok := i.templates[name]; ok {
+		return t
+	}
+
+	return builtin
+}
+
+// writeAuthorityChooser writes the authority chooser page listing the provided
+// authorities to the provided ResponseWriter. Each listed authority links to
+// the identifier with the query of the provided request and its authority_id.
+// If local is true, the local sign-in is listed after the authorities.
+func (i *Identifier) writeAuthorityChooser(rw http.ResponseWriter, req *http.Request, choices []*authorities.Details, local bool) {
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		i.ErrorPage(rw, http.StatusBadRequest, "", "failed to decode request")
+		return
+	}
+
+	var defaultID string
+	if authority := i.authorities.Default(req.Context()); authority != nil {
+		defaultID = authority.ID
+	}
+
+	nonce := rndm.GenerateRandomString(32)
+	data := &authorityChooserPageData{
+		Authorities: make([]*authorityChoice, 0, len(choices)+1),
+		Nonce:       nonce,
+	}
+	imgSources := map[string]bool{"'self'": true}
+	for _, authority := range choices {
+		query.Set("authority_id", authority.ID)
+		choice := &authorityChoice{
+			ID:      authority.ID,
+			Name:    authority.Name,
+			IconURL: authority.IconURL,
+			Default: authority.ID == defaultID,
+
+			URI: "?" + query.Encode(),
+		}
+		if choice.Name == "" {
+			choice.Name = authority.ID
+		}
+		if iconURL, _ := url.Parse(choice.IconURL); iconURL != nil && iconURL.Host != "" {
+			imgSources[iconURL.Scheme+"://"+iconURL.Host] = true
+		}
+		data.Authorities = append(data.Authorities, choice)
+	}
+	if local {
+		query.Del("authority_id")
+		query.Set(localSignInParameter, "1")
+		data.Authorities = append(data.Authorities, &authorityChoice{
+			Name:  "Username and password",
+			Local: true,
+
+			URI: "?" + query.Encode(),
+		})
+	}
+	imgSrc := make([]string, 0, len(imgSources))
+	for source := range imgSources {
+		imgSrc = append(imgSrc, source)
+	}
+	sort.Strings(imgSrc)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// NOTE: Icons are only allowed from the origins of the listed icons.
+	rw.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; script-src 'nonce-%s'; style-src 'self' 'nonce-%s'; img-src %s; base-uri 'none'; form-action 'self'; frame-ancestors 'none';", nonce, nonce, strings.Join(imgSrc, " ")))
+	rw.WriteHeader(http.StatusOK)
+
+	err = i.getTemplate(TemplateNameAuthorityChooser, authorityChooserTemplate).Execute(rw, data)
+	if err != nil {
+		i.logger.WithError(err).Debugln("failed to write to response")
+	}
+}
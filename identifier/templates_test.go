@@ -0,0 +1,197 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/identity/authorities"
+)
+
+func newTestAuthorityRegistry(ctx context.Context, tb testing.TB, logger logrus.FieldLogger, registrations ...*authorities.AuthorityRegistration) *authorities.Registry {
+	for _, registration := range registrations {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		discover := false
+		registration.AuthorityType = authorities.AuthorityTypeOIDC
+		registration.ClientID = registration.ID + "-client"
+		registration.Discover = &discover
+		registration.RawAuthorizationEndpoint = "https://" + registration.ID + ".example.com/authorize"
+		registration.JWKS = &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: registration.ID + "-key", Algorithm: "ES256", Use: "sig"}},
+		}
+	}
+	registry, err := authorities.NewRegistryWithAuthorities(ctx, registrations, nil, logger)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// NOTE: Authorities are initialized asynchronously by the registry.
+	for deadline := time.Now().Add(5 * time.Second); len(registry.Ready(ctx)) < len(registrations); {
+		if time.Now().After(deadline) {
+			tb.Fatal("authorities did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return registry
+}
+
+func TestWriteAuthorityChooser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry := newTestAuthorityRegistry(ctx, t, logger, &authorities.AuthorityRegistration{
+		ID:      "org-a",
+		Name:    "Alpha",
+		IconURL: "https://static.example.com/org-a.svg",
+	}, &authorities.AuthorityRegistration{
+		ID:   "org-b",
+		Name: "Beta <B>",
+	})
+	i := &Identifier{
+		authorities: registry,
+		logger:      logger,
+	}
+
+	req := httptest.NewRequest("GET", "https://konnect.example.com/signin/v1/identifier?flow=oidc&client_id=app&authority_id=ignored", nil)
+	rr := httptest.NewRecorder()
+	i.writeAuthorityChooser(rr, req, registry.Ready(ctx), false)
+
+	body := rr.Body.String()
+	for _, expected := range []string{
+		`href="?authority_id=org-a&amp;client_id=app&amp;flow=oidc"`,
+		`href="?authority_id=org-b&amp;client_id=app&amp;flow=oidc"`,
+		`<img src="https://static.example.com/org-a.svg" alt="">`,
+		`Beta &lt;B&gt;`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("authority chooser page does not contain %v: %v", expected, body)
+		}
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "img-src 'self' https://static.example.com;") {
+		t.Errorf("wrong Content-Security-Policy: %v", csp)
+	}
+	if strings.Contains(body, "data-local") || strings.Contains(body, `class="default"`) {
+		t.Errorf("authority chooser page has unexpected local or default entry: %v", body)
+	}
+
+	templatesPath, err := ioutil.TempDir("", "konnect-identifier-templates-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templatesPath)
+	err = ioutil.WriteFile(filepath.Join(templatesPath, TemplateNameAuthorityChooser), []byte(`{{range .Authorities}}<a href="{{.URI}}">{{.Name}} ({{.ID}})</a>{{end}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.templates, err = loadTemplates(templatesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	i.writeAuthorityChooser(rr, req, registry.Ready(ctx), false)
+	if body = rr.Body.String(); body != `<a href="?authority_id=org-a&amp;client_id=app&amp;flow=oidc">Alpha (org-a)</a><a href="?authority_id=org-b&amp;client_id=app&amp;flow=oidc">Beta &lt;B&gt; (org-b)</a>` {
+		t.Errorf("wrong authority chooser page from template: %v", body)
+	}
+}
+
+func TestHandleIdentifierAuthorityChooser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, test := range []struct {
+		name       string
+		defaultID  string
+		fallback   string
+		query      string
+		chooser    bool
+		expected   []string
+		unexpected []string
+	}{
+		{"without default", "", AuthorityFallbackNone, "", true, []string{
+			`href="?authority_id=org-a&amp;flow=oidc" data-authority-id="org-a">`,
+			`href="?flow=oidc&amp;local=1" data-local>`,
+		}, nil},
+		{"local chosen", "", AuthorityFallbackNone, "&local=1", false, nil, nil},
+		{"with default", "org-a", AuthorityFallbackNone, "", true, []string{
+			`data-authority-id="org-a" class="default">`,
+		}, []string{"data-local"}},
+		{"local chosen with default", "org-a", AuthorityFallbackNone, "&local=1", true, nil, []string{"data-local"}},
+		{"with default and fallback", "org-a", AuthorityFallbackLocal, "", true, []string{
+			`data-authority-id="org-a" class="default">`,
+			`data-local>`,
+		}, nil},
+	} {
+		registry := newTestAuthorityRegistry(ctx, t, logger, &authorities.AuthorityRegistration{
+			ID:      "org-a",
+			Default: test.defaultID == "org-a",
+		}, &authorities.AuthorityRegistration{
+			ID: "org-b",
+		})
+		i := &Identifier{
+			Config: &Config{
+				AuthorityChooser:  true,
+				AuthorityFallback: test.fallback,
+			},
+			authorities: registry,
+			logger:      logger,
+		}
+
+		req := httptest.NewRequest("GET", "https://konnect.example.com/signin/v1/identifier?flow=oidc"+test.query, nil)
+		rr := httptest.NewRecorder()
+		i.handleIdentifier(rr, req)
+
+		body := rr.Body.String()
+		if chooser := strings.Contains(body, "Choose how to sign in"); chooser != test.chooser {
+			t.Errorf("%s: got chooser %v want %v: %v", test.name, chooser, test.chooser, body)
+			continue
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(body, expected) {
+				t.Errorf("%s: authority chooser page does not contain %v: %v", test.name, expected, body)
+			}
+		}
+		for _, unexpected := range test.unexpected {
+			if strings.Contains(body, unexpected) {
+				t.Errorf("%s: authority chooser page contains %v: %v", test.name, unexpected, body)
+			}
+		}
+	}
+}
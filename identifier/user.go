@@ -20,6 +20,7 @@ package identifier
 import (
 	"context"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -48,7 +49,11 @@ type IdentifiedUser struct {
 	sessionRef *string
 	claims     map[string]interface{}
 
-	logonAt time.Time
+	logonAt     time.Time
+	activeAt    time.Time
+	acr         string
+	amr         []string
+	authorityID string
 }
 
 // Subject returns the associated users subject field. The subject is the main
@@ -129,11 +134,53 @@ func (u *IdentifiedUser) ScopedClaims(authorizedScopes map[string]bool) jwt.MapC
 	return jwt.MapClaims(claims)
 }
 
+// needsSubjectAttributeClaim returns true if the provided subject attribute
+// is not part of the default logon cookie claims.
+func needsSubjectAttributeClaim(attribute string) bool {
+	switch attribute {
+	case identity.SubjectAttributeUniqueID, identity.SubjectAttributeID, identity.SubjectAttributeEmail:
+		return true
+	}
+
+	return false
+}
+
+// setSubjectAttribute sets the provided subject attribute of the accociated
+// user to the provided value.
+func (u *IdentifiedUser) setSubjectAttribute(attribute string, value string) {
+	switch attribute {
+	case identity.SubjectAttributeUniqueID:
+		u.uid = value
+	case identity.SubjectAttributeID:
+		u.id, _ = strconv.ParseInt(value, 10, 64)
+	case identity.SubjectAttributeEmail:
+		u.email = value
+	}
+}
+
 // LoggedOn returns true if the accociated user has a logonAt time set.
 func (u *IdentifiedUser) LoggedOn() (bool, time.Time) {
 	return !u.logonAt.IsZero(), u.logonAt
 }
 
+// ACR returns the authentication context class reference which was satisfied
+// when the accociated user signed in. If empty, no specific class applies.
+func (u *IdentifiedUser) ACR() string {
+	return u.acr
+}
+
+// AMR returns the authentication methods references which were used when the
+// associated user signed in. If empty, no methods are known.
+func (u *IdentifiedUser) AMR() []string {
+	return u.amr
+}
+
+// AuthorityID returns the ID of the authority the associated user signed in
+// with. If empty, the user did not sign in with an authority.
+func (u *IdentifiedUser) AuthorityID() string {
+	return u.authorityID
+}
+
 // SessionRef returns the accociated users underlaying session reference.
 func (u *IdentifiedUser) SessionRef() *string {
 	return u.sessionRef
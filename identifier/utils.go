@@ -18,8 +18,13 @@
 package identifier
 
 import (
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/dgrijalva/jwt-go"
 )
 
 var (
@@ -27,6 +32,30 @@ var (
 	farPastExpiryTimeHTTPHeaderString = farPastExpiryTime.UTC().Format(http.TimeFormat)
 )
 
+// forwardedAuthorityParameters are the authorize request parameters which
+// are forwarded as is to the authorization endpoint of authorities, so the
+// upstream sign-in matches the request of the RP, for example renders in the
+// language of ui_locales and prefills the user name from login_hint.
+var forwardedAuthorityParameters = []string{
+	"display",
+	"prompt",
+	"max_age",
+	"ui_locales",
+	"acr_values",
+	"claims_locales",
+	"login_hint",
+}
+
+// addForwardedAuthorityParameters adds the forwardedAuthorityParameters with
+// a non-empty value in the provided form to the provided query.
+func addForwardedAuthorityParameters(query url.Values, form url.Values) {
+	for _, name := range forwardedAuthorityParameters {
+		if value := form.Get(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+}
+
 func addCommonResponseHeaders(header http.Header) {
 	header.Set("X-Frame-Options", "DENY")
 	header.Set("X-XSS-Protection", "1; mode=block")
@@ -39,3 +68,37 @@ func addNoCacheResponseHeaders(header http.Header) {
 	header.Set("Pragma", "no-cache")
 	header.Set("Expires", farPastExpiryTimeHTTPHeaderString)
 }
+
+// validateIDTokenNonce validates that the nonce claim of the provided ID token
+// claims matches the provided expected nonce.
+func validateIDTokenNonce(claims jwt.MapClaims, expected string) error {
+	if expected == "" {
+		return errors.New("no expected nonce")
+	}
+	nonce, _ := claims["nonce"].(string)
+	if nonce == "" {
+		return errors.New("nonce claim missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(expected)) != 1 {
+		return errors.New("nonce mismatch")
+	}
+
+	return nil
+}
+
+// validateIDTokenTimes validates the exp, nbf and iat claims of the provided
+// ID token claims against the provided time, tolerating the provided clock
+// skew in both directions.
+func validateIDTokenTimes(claims jwt.MapClaims, now time.Time, skew time.Duration) error {
+	if !claims.VerifyExpiresAt(now.Add(-skew).Unix(), false) {
+		return errors.New("token is expired")
+	}
+	if !claims.VerifyNotBefore(now.Add(skew).Unix(), false) {
+		return errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Add(skew).Unix(), false) {
+		return errors.New("token used before issued")
+	}
+
+	return nil
+}
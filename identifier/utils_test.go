@@ -0,0 +1,115 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identifier
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestValidateIDTokenNonce(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		expected string
+		valid    bool
+	}{
+		{"match", jwt.MapClaims{"nonce": "n-0S6_WzA2Mj"}, "n-0S6_WzA2Mj", true},
+		{"mismatch", jwt.MapClaims{"nonce": "n-0S6_WzA2Mj"}, "other-nonce", false},
+		{"missing", jwt.MapClaims{}, "n-0S6_WzA2Mj", false},
+		{"empty", jwt.MapClaims{"nonce": ""}, "", false},
+		{"no expected", jwt.MapClaims{"nonce": "n-0S6_WzA2Mj"}, "", false},
+		{"invalid type", jwt.MapClaims{"nonce": 42}, "42", false},
+	}
+
+	for _, test := range tests {
+		err := validateIDTokenNonce(test.claims, test.expected)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+}
+
+func TestValidateIDTokenTimes(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	skew := 60 * time.Second
+	// NOTE: Numeric claims are float64 when decoded from JSON.
+	at := func(offset int64) float64 {
+		return float64(now.Unix() + offset)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{"valid", jwt.MapClaims{"iat": at(0), "nbf": at(0), "exp": at(300)}, true},
+		{"no time claims", jwt.MapClaims{}, true},
+		{"exp inside skew", jwt.MapClaims{"exp": at(-60)}, true},
+		{"exp outside skew", jwt.MapClaims{"exp": at(-61)}, false},
+		{"nbf inside skew", jwt.MapClaims{"nbf": at(60)}, true},
+		{"nbf outside skew", jwt.MapClaims{"nbf": at(61)}, false},
+		{"iat inside skew", jwt.MapClaims{"iat": at(60)}, true},
+		{"iat outside skew", jwt.MapClaims{"iat": at(61)}, false},
+	}
+
+	for _, test := range tests {
+		err := validateIDTokenTimes(test.claims, now, skew)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+	}
+
+	if err := validateIDTokenTimes(jwt.MapClaims{"exp": at(-1)}, now, 0); err == nil {
+		t.Errorf("expired token without skew: expected error, got none")
+	}
+}
+
+func TestAddForwardedAuthorityParameters(t *testing.T) {
+	form := url.Values{
+		"ui_locales":   {"de-DE en"},
+		"login_hint":   {"jonas@example.com"},
+		"prompt":       {""},
+		"client_id":    {"rp-client"},
+		"redirect_uri": {"https://rp.example.com/cb"},
+	}
+	query := url.Values{
+		"client_id": {"konnect-client"},
+	}
+
+	addForwardedAuthorityParameters(query, form)
+
+	expected := url.Values{
+		"client_id":  {"konnect-client"},
+		"ui_locales": {"de-DE en"},
+		"login_hint": {"jonas@example.com"},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("wrong forwarded parameters: got %v want %v", query, expected)
+	}
+}
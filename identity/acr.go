@@ -0,0 +1,142 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ACRPolicy defines the authentication requirements a sign-in must meet to
+// satisfy an authentication context class reference.
+type ACRPolicy struct {
+	ACR string `yaml:"acr"`
+
+	// Authority, if set, is the ID of the authority users must have signed
+	// in with.
+	Authority string `yaml:"authority"`
+	// AMR are the authentication methods references which all must have been
+	// used when signing in.
+	AMR []string `yaml:"amr,flow"`
+	// MaxAge, if set, is the maximum number of seconds since the sign-in.
+	MaxAge int64 `yaml:"max_age"`
+}
+
+// ACRPolicyData is the base structure of the ACR policies found in the
+// identifier registration configuration file.
+type ACRPolicyData struct {
+	ACRPolicies []*ACRPolicy `yaml:"acr_policies,flow"`
+}
+
+// Validate validates the accociated ACR policy and returns error if it is not
+// valid.
+func (p *ACRPolicy) Validate() error {
+	if p.ACR == "" {
+		return errors.New("acr policy without acr")
+	}
+	for _, amr := range p.AMR {
+		if amr == "" {
+			return fmt.Errorf("acr policy %s with empty amr value", p.ACR)
+		}
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("acr policy %s with invalid max_age: %d", p.ACR, p.MaxAge)
+	}
+
+	return nil
+}
+
+// IsSatisfied returns true if a sign-in with the provided authority ID,
+// authentication methods references and authentication time meets all the
+// requirements of the accociated ACR policy at the provided time.
+func (p *ACRPolicy) IsSatisfied(authorityID string, amr []string, authTime time.Time, now time.Time) bool {
+	if p.Authority != "" && p.Authority != authorityID {
+		return false
+	}
+	for _, required := range p.AMR {
+		found := false
+		for _, v := range amr {
+			if v == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.MaxAge > 0 {
+		if authTime.IsZero() || now.Sub(authTime) > time.Duration(p.MaxAge)*time.Second {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ACRPolicies maps ACR values to the ACR policies which define them.
+type ACRPolicies map[string]*ACRPolicy
+
+// LoadACRPolicies loads the ACR policies from the provided identifier
+// registration configuration file.
+func LoadACRPolicies(registrationConfFilepath string) (ACRPolicies, error) {
+	policies := make(ACRPolicies)
+	if registrationConfFilepath == "" {
+		return policies, nil
+	}
+
+	registrationFile, err := ioutil.ReadFile(registrationConfFilepath)
+	if err != nil {
+		return nil, err
+	}
+	policyData := &ACRPolicyData{}
+	err = yaml.Unmarshal(registrationFile, policyData)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, policy := range policyData.ACRPolicies {
+		if policy == nil {
+			continue
+		}
+		if err = policy.Validate(); err != nil {
+			return nil, err
+		}
+		if _, exists := policies[policy.ACR]; exists {
+			return nil, fmt.Errorf("duplicate acr policy: %s", policy.ACR)
+		}
+		policies[policy.ACR] = policy
+	}
+
+	return policies, nil
+}
+
+// Values returns the sorted ACR values of the accociated ACR policies.
+func (policies ACRPolicies) Values() []string {
+	values := make([]string, 0, len(policies))
+	for acr := range policies {
+		values = append(values, acr)
+	}
+	sort.Strings(values)
+
+	return values
+}
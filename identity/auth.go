@@ -40,4 +40,8 @@ type AuthRecord interface {
 
 	LoggedOn() (bool, time.Time)
 	SetAuthTime(time.Time)
+	ACR() string
+	SetACR(string)
+	AMR() []string
+	SetAMR([]string)
 }
@@ -22,16 +22,23 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"stash.kopano.io/kgol/oidc-go"
 )
 
+// ErrIdentityAliasMissing is the error returned when the associated
+// registration requires identity aliases and the identity claim value has no
+// alias.
+var ErrIdentityAliasMissing = errors.New("identity claim has no alias")
+
 // Details hold detail information about authorities identified by ID.
 type Details struct {
 	ID            string
 	Name          string
 	AuthorityType string
+	IconURL       string
 
 	ClientID     string
 	ClientSecret string
@@ -51,14 +58,51 @@ type Details struct {
 	validationKeys map[string]crypto.PublicKey
 }
 
+// RegistrySnapshot is a read-only view of the state of a Registry at the time
+// of its creation.
+type RegistrySnapshot struct {
+	DefaultID   string               `json:"default_id"`
+	Authorities []*AuthoritySnapshot `json:"authorities"`
+}
+
+// AuthoritySnapshot is a read-only view of the state of a registered authority
+// at the time of its creation.
+type AuthoritySnapshot struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	AuthorityType string `json:"authority_type"`
+	Iss           string `json:"iss,omitempty"`
+
+	Default  bool `json:"default"`
+	Discover bool `json:"discover"`
+	Ready    bool `json:"ready"`
+
+	Managed bool `json:"managed"`
+
+	LastDiscovery *time.Time `json:"last_discovery,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
 // IsReady returns wether or not the assosiated registration entry was ready
 // at time of creation of the associated details.
 func (d *Details) IsReady() bool {
 	return d.ready
 }
 
+// LastFailure returns the time of the last failure of the authority of the
+// associated registration like LastFailure of its AuthorityRegistration.
+func (d *Details) LastFailure() time.Time {
+	if d.Registration == nil {
+		return time.Time{}
+	}
+
+	return d.Registration.LastFailure()
+}
+
 // IdentityClaimValue returns the claim value of the provided claims from the
-// claim defined at the associated registration.
+// claim defined at the associated registration. The value is replaced with
+// its identity alias if any. If the registration requires identity aliases
+// and the value has none, ErrIdentityAliasMissing is returned.
 func (d *Details) IdentityClaimValue(claims map[string]interface{}) (string, error) {
 	icn := d.Registration.IdentityClaimName
 	if icn == "" {
@@ -74,10 +118,16 @@ func (d *Details) IdentityClaimValue(claims map[string]interface{}) (string, err
 		return "", errors.New("identify claim has invalid type")
 	}
 
+	// Transform claim value.
+	cvs = d.Registration.transformIdentityClaim(cvs)
+	if cvs == "" {
+		return "", errors.New("identity claim is empty after transform")
+	}
+
 	// Convert claim value.
 	whitelisted := false
-	if d.Registration.IdentityAliases != nil {
-		if alias, ok := d.Registration.IdentityAliases[cvs]; ok && alias != "" {
+	if d.Registration.identityAliases != nil {
+		if alias, ok := d.Registration.identityAliases[cvs]; ok && alias != "" {
 			cvs = alias
 			whitelisted = true
 		}
@@ -85,12 +135,56 @@ func (d *Details) IdentityClaimValue(claims map[string]interface{}) (string, err
 
 	// Check whitelist.
 	if d.Registration.IdentityAliasRequired && !whitelisted {
-		return "", errors.New("identity claim has no alias")
+		return "", ErrIdentityAliasMissing
 	}
 
 	return cvs, nil
 }
 
+// ACRClaimValue returns the authentication context class reference of the
+// provided claims from the acr claim defined at the associated registration.
+// If the claim is not found, not a string or disabled, empty is returned.
+func (d *Details) ACRClaimValue(claims map[string]interface{}) string {
+	acn := d.Registration.ACRClaimName
+	if acn == "" {
+		acn = authorityDefaultACRClaimName
+	} else if acn == authorityClaimNameDisabled {
+		return ""
+	}
+
+	acr, _ := claims[acn].(string)
+	return acr
+}
+
+// AMRClaimValue returns the authentication methods references of the provided
+// claims from the amr claim defined at the associated registration. If the
+// claim is not found, has no string values or is disabled, nil is returned.
+func (d *Details) AMRClaimValue(claims map[string]interface{}) []string {
+	acn := d.Registration.AMRClaimName
+	if acn == "" {
+		acn = authorityDefaultAMRClaimName
+	} else if acn == authorityClaimNameDisabled {
+		return nil
+	}
+
+	var amr []string
+	switch values := claims[acn].(type) {
+	case []string:
+		amr = values
+	case []interface{}:
+		for _, v := range values {
+			if s, ok := v.(string); ok && s != "" {
+				amr = append(amr, s)
+			}
+		}
+	}
+	if len(amr) == 0 {
+		return nil
+	}
+
+	return amr
+}
+
 // Keyfunc returns a key func to validate JWTs with the keys of the associated
 // authority registration.
 func (d *Details) Keyfunc() jwt.Keyfunc {
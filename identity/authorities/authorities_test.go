@@ -0,0 +1,244 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package authorities
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAuthenticationClaimValues(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeIDToken := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "upstream-key"
+		signed, signErr := token.SignedString(key)
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		return signed
+	}
+
+	for _, test := range []struct {
+		name         string
+		acrClaimName string
+		amrClaimName string
+		claims       jwt.MapClaims
+		acr          string
+		amr          []string
+	}{
+		{"mfa", "", "", jwt.MapClaims{"sub": "upstream-user", "acr": "urn:example:mfa", "amr": []string{"mfa"}}, "urn:example:mfa", []string{"mfa"}},
+		{"missing", "", "", jwt.MapClaims{"sub": "upstream-user"}, "", nil},
+		{"empty", "", "", jwt.MapClaims{"sub": "upstream-user", "amr": []string{}}, "", nil},
+		{"invalid", "", "", jwt.MapClaims{"sub": "upstream-user", "acr": 1, "amr": "mfa"}, "", nil},
+		{"mapped", "upstream_acr", "upstream_amr", jwt.MapClaims{"sub": "upstream-user", "acr": "ignored", "upstream_acr": "1", "upstream_amr": []string{"pwd", "otp"}}, "1", []string{"pwd", "otp"}},
+		{"disabled", "-", "-", jwt.MapClaims{"sub": "upstream-user", "acr": "urn:example:mfa", "amr": []string{"mfa"}}, "", nil},
+	} {
+		authority := newTestAuthorityRegistration(t, "upstream")
+		authority.JWKS.Keys[0].Key = key.Public()
+		authority.ACRClaimName = test.acrClaimName
+		authority.AMRClaimName = test.amrClaimName
+
+		registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{authority}, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authority.Initialize(ctx, logger, nil)
+		details, err := registry.Lookup(ctx, "upstream")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Parse the signed upstream ID token, so that claims are decoded the
+		// same way as in the federation token exchange.
+		idToken, err := jwt.ParseWithClaims(makeIDToken(test.claims), jwt.MapClaims{}, details.Keyfunc())
+		if err != nil {
+			t.Fatalf("%s: failed to parse upstream id token: %v", test.name, err)
+		}
+		claims := idToken.Claims.(jwt.MapClaims)
+
+		if acr := details.ACRClaimValue(claims); acr != test.acr {
+			t.Errorf("%s: wrong acr: got %#v want %#v", test.name, acr, test.acr)
+		}
+		if amr := details.AMRClaimValue(claims); !reflect.DeepEqual(amr, test.amr) {
+			t.Errorf("%s: wrong amr: got %#v want %#v", test.name, amr, test.amr)
+		}
+	}
+}
+
+func TestIdentityClaimValueAliases(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		required bool
+		aliases  map[string]string
+		claims   map[string]interface{}
+		value    string
+		err      error
+	}{
+		{"no aliases", false, nil, map[string]interface{}{"preferred_username": "Upstream"}, "upstream", nil},
+		{"alias", false, map[string]string{"upstream": "local"}, map[string]interface{}{"preferred_username": "Upstream"}, "local", nil},
+		{"unaliased", false, map[string]string{"other": "local"}, map[string]interface{}{"preferred_username": "Upstream"}, "upstream", nil},
+		{"required alias", true, map[string]string{"upstream": "local"}, map[string]interface{}{"preferred_username": "Upstream"}, "local", nil},
+		{"normalized alias key", true, map[string]string{" UpStream ": " local "}, map[string]interface{}{"preferred_username": "Upstream"}, "local", nil},
+		{"required alias missing", true, map[string]string{"other": "local"}, map[string]interface{}{"preferred_username": "Upstream"}, "", ErrIdentityAliasMissing},
+	} {
+		authority := newTestAuthorityRegistration(t, "upstream")
+		authority.IdentityClaimName = "preferred_username"
+		authority.IdentityClaimTrim = true
+		authority.IdentityClaimLowercase = true
+		authority.IdentityAliases = test.aliases
+		authority.IdentityAliasRequired = test.required
+		if err := authority.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		details := &Details{Registration: authority}
+		value, err := details.IdentityClaimValue(test.claims)
+		if err != test.err {
+			t.Errorf("%s: wrong error: got %v want %v", test.name, err, test.err)
+		}
+		if value != test.value {
+			t.Errorf("%s: wrong value: got %#v want %#v", test.name, value, test.value)
+		}
+	}
+}
+
+func TestTransformIdentityClaim(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		trim      bool
+		lowercase bool
+		pattern   string
+		template  string
+		value     string
+		expected  string
+	}{
+		{"none", false, false, "", "", " User@Example.com ", " User@Example.com "},
+		{"trim", true, false, "", "", " User@Example.com\t", "User@Example.com"},
+		{"lowercase", false, true, "", "", "User@Example.com", "user@example.com"},
+		{"replace", false, false, "@.*$", "", "user@example.com", "user"},
+		{"replace with template", false, false, "^([^@]+)@(.+)$", "${2}\\${1}", "user@example.com", "example.com\\user"},
+		{"replace sees transformed value", true, true, "^user@example\\.com$", "local", " USER@Example.com ", "local"},
+		{"replace without match", true, true, "@example\\.org$", "", "user@example.com", "user@example.com"},
+		{"empty after replace", false, false, "^.*$", "", "user", ""},
+	} {
+		authority := newTestAuthorityRegistration(t, "upstream")
+		authority.IdentityClaimTrim = test.trim
+		authority.IdentityClaimLowercase = test.lowercase
+		authority.IdentityClaimReplacePattern = test.pattern
+		authority.IdentityClaimReplaceTemplate = test.template
+		if err := authority.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if value := authority.transformIdentityClaim(test.value); value != test.expected {
+			t.Errorf("%s: wrong value: got %#v want %#v", test.name, value, test.expected)
+		}
+	}
+
+	authority := newTestAuthorityRegistration(t, "upstream")
+	authority.IdentityClaimReplacePattern = "("
+	if err := authority.Validate(); err == nil {
+		t.Error("invalid identity_claim_replace_pattern was accepted")
+	}
+
+	authority = newTestAuthorityRegistration(t, "upstream")
+	authority.IdentityClaimReplacePattern = "^.*$"
+	if err := authority.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	details := &Details{Registration: authority}
+	if _, err := details.IdentityClaimValue(map[string]interface{}{"preferred_username": "user"}); err == nil {
+		t.Error("identity claim which is empty after transform was accepted")
+	}
+}
+
+func TestValidateIdentityAliases(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		required bool
+		aliases  map[string]string
+		valid    bool
+	}{
+		{"none", false, nil, true},
+		{"required without aliases", true, nil, false},
+		{"required with empty aliases", true, map[string]string{}, false},
+		{"empty alias", false, map[string]string{"upstream": " "}, false},
+		{"conflicting aliases", false, map[string]string{"upstream": "one", "UPSTREAM": "two"}, false},
+		{"duplicate aliases", false, map[string]string{"upstream": "one", "UPSTREAM": "one"}, true},
+	} {
+		authority := newTestAuthorityRegistration(t, "upstream")
+		authority.IdentityClaimLowercase = true
+		authority.IdentityAliases = test.aliases
+		authority.IdentityAliasRequired = test.required
+
+		err := authority.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		scopes              []string
+		responseType        string
+		codeChallengeMethod string
+		wantErr             bool
+	}{
+		{"defaults", []string{"openid", "profile"}, "id_token", "S256", false},
+		{"code id_token", []string{"openid"}, "code id_token", "plain", false},
+		{"missing openid scope", []string{"profile"}, "id_token", "S256", true},
+		{"missing id_token response type", []string{"openid"}, "code", "S256", true},
+		{"unknown response type", []string{"openid"}, "id_token magic", "S256", true},
+		{"unsupported code challenge method", []string{"openid"}, "id_token", "S512", true},
+	} {
+		ar := &AuthorityRegistration{
+			AuthorityType:       AuthorityTypeOIDC,
+			Scopes:              test.scopes,
+			ResponseType:        test.responseType,
+			CodeChallengeMethod: test.codeChallengeMethod,
+		}
+		err := ar.validateSettings()
+		if test.wantErr && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
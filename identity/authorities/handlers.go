@@ -0,0 +1,142 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package authorities
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// maxAuthorityRegistrationSize is the maximum size of authority registrations
+// accepted by the AdminHandler.
+const maxAuthorityRegistrationSize = 64 * 1024
+
+// AdminHandler is a http handler which exposes the runtime state of a
+// Registry and manages its managed authorities, protected by a bearer token.
+type AdminHandler struct {
+	path     string
+	registry *Registry
+	token    []byte
+
+	logger logrus.FieldLogger
+}
+
+// NewAdminHandler creates a new AdminHandler serving the provided registry at
+// the provided path, requiring the provided bearer token.
+func NewAdminHandler(path string, registry *Registry, token string, logger logrus.FieldLogger) *AdminHandler {
+	return &AdminHandler{
+		path:     path,
+		registry: registry,
+		token:    []byte(token),
+
+		logger: logger,
+	}
+}
+
+// AddRoutes add the accociated AdminHandler's URL routes to the provided
+// router with the provided context.Context.
+func (h *AdminHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(h.path, h).Methods(http.MethodGet, http.MethodPost)
+	router.Handle(h.path+"/{id}", h).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+}
+
+// ServeHTTP implements the http.Handler interface. GET returns the current
+// state of all authorities or of the authority with the ID in the path. POST
+// with a JSON encoded authority registration as request body adds a managed
+// authority, PUT replaces the managed authority with the ID in the path and
+// DELETE removes it.
+func (h *AdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !utils.RequireBearerToken(rw, req, h.token) {
+		return
+	}
+
+	var err error
+	id := mux.Vars(req)["id"]
+
+	switch req.Method {
+	case http.MethodPost, http.MethodPut:
+		authority := &AuthorityRegistration{}
+		err = json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxAuthorityRegistrationSize)).Decode(authority)
+		if err != nil {
+			http.Error(rw, "invalid authority registration", http.StatusBadRequest)
+			return
+		}
+		if req.Method == http.MethodPost {
+			err = h.registry.Add(req.Context(), authority)
+			id = authority.ID
+			break
+		}
+		if authority.ID == "" {
+			authority.ID = id
+		} else if authority.ID != id {
+			http.Error(rw, "id mismatch", http.StatusBadRequest)
+			return
+		}
+		err = h.registry.Update(req.Context(), authority)
+	case http.MethodDelete:
+		err = h.registry.Deregister(req.Context(), id)
+	}
+
+	switch err {
+	case nil:
+		if req.Method != http.MethodGet {
+			h.logger.WithFields(logrus.Fields{
+				"id":     id,
+				"method": req.Method,
+			}).Warnln("authorities changed via admin endpoint")
+		}
+	case ErrAuthorityUnknown:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	case ErrAuthorityExists, ErrAuthorityNotManaged:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response interface{}
+	snapshot := h.registry.Snapshot(req.Context())
+	if req.Method == http.MethodGet && id != "" {
+		for _, authority := range snapshot.Authorities {
+			if authority.ID == id {
+				response = authority
+				break
+			}
+		}
+		if response == nil {
+			http.Error(rw, ErrAuthorityUnknown.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		response = snapshot
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	err = utils.WriteJSON(rw, http.StatusOK, response, "")
+	if err != nil {
+		h.logger.WithError(err).Errorln("authorities admin request failed writing response")
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package authorities
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsSubsystem = "authorities"
+
+var (
+	defaultAuthorityConflicts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "konnect",
+			Subsystem: metricsSubsystem,
+			Name:      "default_conflicts_total",
+			Help:      "Number of authorities which were marked as default while another default authority was already registered.",
+		},
+	)
+)
+
+// registerMetrics registers the authorities metrics with the provided
+// prometheus registerer. It is safe to call multiple times with the same
+// registerer.
+func registerMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		defaultAuthorityConflicts,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -18,16 +18,24 @@
 package authorities
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2"
 	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 // Supported Authority kind string values.
@@ -41,50 +49,158 @@ var (
 	authorityDefaultResponseType        = oidc.ResponseTypeIDToken
 	authorityDefaultCodeChallengeMethod = oidc.S256CodeChallengeMethod
 	authorityDefaultIdentityClaimName   = oidc.PreferredUsernameClaim
+	authorityDefaultACRClaimName        = "acr"
+	authorityDefaultAMRClaimName        = "amr"
 )
 
+// AuthorityHTTPProxyDirect is the http_proxy value which makes outbound
+// requests to the accociated authority never use a proxy.
+const AuthorityHTTPProxyDirect = "direct"
+
+// authorityClaimNameDisabled is the claim name value which disables the
+// propagation of the accordingly mapped claim.
+const authorityClaimNameDisabled = "-"
+
 // RegistryData is the base structure of our authority registration configuration file.
 type RegistryData struct {
-	Authorities []*AuthorityRegistration `yaml:"authorities,flow"`
+	Authorities []*AuthorityRegistration `yaml:"authorities,flow" json:"authorities"`
 }
 
 // AuthorityRegistration defines an authority with its properties.
 type AuthorityRegistration struct {
-	ID            string `yaml:"id"`
-	Name          string `yaml:"name"`
-	AuthorityType string `yaml:"authority_type"`
+	ID            string `yaml:"id" json:"id,omitempty"`
+	Name          string `yaml:"name" json:"name,omitempty"`
+	AuthorityType string `yaml:"authority_type" json:"authority_type,omitempty"`
+
+	// IconURL is the absolute http(s) URL or the absolute path of the icon
+	// which represents the accociated authority in the authority chooser.
+	IconURL string `yaml:"icon_url" json:"icon_url,omitempty"`
+
+	Iss string `yaml:"iss" json:"iss,omitempty"`
+
+	ClientID     string `yaml:"client_id" json:"client_id,omitempty"`
+	ClientSecret string `yaml:"client_secret" json:"client_secret,omitempty"`
+
+	Insecure bool  `yaml:"insecure" json:"insecure,omitempty"`
+	Default  bool  `yaml:"default" json:"default,omitempty"`
+	Discover *bool `yaml:"discover" json:"discover,omitempty"`
+
+	TrustedCA string `yaml:"trusted_ca" json:"trusted_ca,omitempty"`
+	HTTPProxy string `yaml:"http_proxy" json:"http_proxy,omitempty"`
 
-	Iss string `yaml:"iss"`
+	DiscoverMaxRetries int `yaml:"discover_max_retries" json:"discover_max_retries,omitempty"`
 
-	ClientID     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
+	Scopes              []string `yaml:"scopes" json:"scopes,omitempty"`
+	ResponseType        string   `yaml:"response_type" json:"response_type,omitempty"`
+	CodeChallengeMethod string   `yaml:"code_challenge_method" json:"code_challenge_method,omitempty"`
 
-	Insecure bool  `yaml:"insecure"`
-	Default  bool  `yaml:"default"`
-	Discover *bool `yaml:"discover"`
+	RawMetadataEndpoint      string `yaml:"metadata_endpoint" json:"metadata_endpoint,omitempty"`
+	RawAuthorizationEndpoint string `yaml:"authorization_endpoint" json:"authorization_endpoint,omitempty"`
 
-	Scopes              []string `yaml:"scopes"`
-	ResponseType        string   `yaml:"response_type"`
-	CodeChallengeMethod string   `yaml:"code_challenge_method"`
+	JWKS *jose.JSONWebKeySet `yaml:"jwks" json:"jwks,omitempty"`
 
-	RawMetadataEndpoint      string `yaml:"metadata_endpoint"`
-	RawAuthorizationEndpoint string `yaml:"authorization_endpoint"`
+	IdentityClaimName string `yaml:"identity_claim_name" json:"identity_claim_name,omitempty"`
 
-	JWKS *jose.JSONWebKeySet `yaml:"jwks"`
+	IdentityClaimTrim            bool   `yaml:"identity_claim_trim" json:"identity_claim_trim,omitempty"`
+	IdentityClaimLowercase       bool   `yaml:"identity_claim_lowercase" json:"identity_claim_lowercase,omitempty"`
+	IdentityClaimReplacePattern  string `yaml:"identity_claim_replace_pattern" json:"identity_claim_replace_pattern,omitempty"`
+	IdentityClaimReplaceTemplate string `yaml:"identity_claim_replace" json:"identity_claim_replace,omitempty"`
 
-	IdentityClaimName string `yaml:"identity_claim_name"`
+	IdentityAliases       map[string]string `yaml:"identity_aliases,flow" json:"identity_aliases,omitempty"`
+	IdentityAliasRequired bool              `yaml:"identity_alias_required" json:"identity_alias_required,omitempty"`
 
-	IdentityAliases       map[string]string `yaml:"identity_aliases,flow"`
-	IdentityAliasRequired bool              `yaml:"identity_alias_required"`
+	ACRClaimName string `yaml:"acr_claim_name" json:"acr_claim_name,omitempty"`
+	AMRClaimName string `yaml:"amr_claim_name" json:"amr_claim_name,omitempty"`
+
+	Domains []string `yaml:"domains,flow" json:"domains,omitempty"`
 
 	discover              bool     `yaml:"-"`
 	metadataEndpoint      *url.URL `yaml:"-"`
 	authorizationEndpoint *url.URL `yaml:"-"`
 
+	// domains are the normalized Domains, for which the associated authority
+	// is the default authority.
+	domains map[string]bool
+
+	// rawClientSecret is the client_secret as provided, before it was
+	// resolved, so managed authorities are persisted with the reference to
+	// their secret instead of the secret itself.
+	rawClientSecret string
+
+	// managed is true for authorities which are managed at runtime and
+	// persisted in the store of the registry instead of the registration
+	// configuration file.
+	managed bool
+
+	// codeChallengeMethod is the effective code challenge method, which is
+	// the configured method unless negotiated otherwise with discovery.
+	codeChallengeMethod string
+	// disallowPlainCodeChallengeMethod is true if plain must never be
+	// negotiated as code challenge method.
+	disallowPlainCodeChallengeMethod bool
+	// discoveryMaxStale is the duration after the last successful discovery
+	// after which the associated registration is no longer ready.
+	discoveryMaxStale time.Duration
+
+	identityClaimReplacePattern *regexp.Regexp
+
+	// identityAliases are the IdentityAliases with their keys normalized
+	// with the trim and lowercase identity claim transforms.
+	identityAliases map[string]string
+
+	// trustedCAData are the PEM encoded certificates of TrustedCA.
+	trustedCAData []byte
+
+	// httpProxy is the parsed HTTPProxy, nil when it is empty or
+	// AuthorityHTTPProxyDirect.
+	httpProxy *url.URL
+
 	validationKeys map[string]crypto.PublicKey
 
-	mutex sync.RWMutex
-	ready bool
+	cancel context.CancelFunc
+
+	mutex           sync.RWMutex
+	ready           bool
+	lastDiscovery   time.Time
+	capabilitiesErr error
+	// discoveryErr is the error of the last failed discovery attempt, reset
+	// with the next successful discovery.
+	discoveryErr error
+	// lastFailure is the time of the last failure konnect observed itself
+	// when talking to the associated authority, like a failed discovery or
+	// update of its keys.
+	lastFailure time.Time
+
+	// details caches the immutable Details of the associated registration,
+	// reset whenever its ready state or discovery result changes.
+	details *Details
+}
+
+// LastFailure returns the time of the last failure konnect observed itself
+// when talking to the accociated authority, like a failed discovery or update
+// of its keys. Returns the zero time if there was none.
+func (ar *AuthorityRegistration) LastFailure() time.Time {
+	ar.mutex.RLock()
+	defer ar.mutex.RUnlock()
+
+	return ar.lastFailure
+}
+
+// resolveSecret replaces the accociated client_secret with the secret it
+// references when prefixed with a secret scheme like env: or file:.
+func (ar *AuthorityRegistration) resolveSecret() error {
+	if ar.ClientSecret == "" {
+		return nil
+	}
+
+	secret, err := utils.ReadSecretString(ar.ClientSecret, utils.SecretSchemeInline)
+	if err != nil {
+		return fmt.Errorf("failed to read client_secret: %v", err)
+	}
+	ar.rawClientSecret = ar.ClientSecret
+	ar.ClientSecret = secret
+
+	return nil
 }
 
 // Validate validates the associated authority registration data and returns
@@ -116,6 +232,43 @@ func (ar *AuthorityRegistration) Validate() error {
 	if ar.Discover != nil {
 		ar.discover = *ar.Discover
 	}
+	if ar.TrustedCA != "" {
+		data, err := utils.ReadCertificatesPEM(ar.TrustedCA)
+		if err != nil {
+			return fmt.Errorf("invalid trusted_ca value: %v", err)
+		}
+		if _, err = utils.NewCertPoolFromPEM(data); err != nil {
+			return fmt.Errorf("invalid trusted_ca value: %v", err)
+		}
+		ar.trustedCAData = data
+	}
+	if ar.HTTPProxy != "" && ar.HTTPProxy != AuthorityHTTPProxyDirect {
+		if u, err := utils.ParseHTTPProxyURL(ar.HTTPProxy); err == nil {
+			ar.httpProxy = u
+		} else {
+			return fmt.Errorf("invalid http_proxy value: %v", err)
+		}
+	}
+	if ar.IdentityClaimReplacePattern != "" {
+		if re, err := regexp.Compile(ar.IdentityClaimReplacePattern); err == nil {
+			ar.identityClaimReplacePattern = re
+		} else {
+			return fmt.Errorf("invalid identity_claim_replace_pattern value: %v", err)
+		}
+	}
+	if err := ar.normalizeIdentityAliases(); err != nil {
+		return err
+	}
+	if len(ar.Domains) > 0 {
+		ar.domains = make(map[string]bool)
+		for _, domain := range ar.Domains {
+			normalized := normalizeDomain(domain)
+			if normalized == "" || strings.ContainsAny(normalized, "@/ ") {
+				return fmt.Errorf("invalid domains value: %#v", domain)
+			}
+			ar.domains[normalized] = true
+		}
+	}
 
 	switch ar.AuthorityType {
 	case AuthorityTypeOIDC:
@@ -137,7 +290,7 @@ func (ar *AuthorityRegistration) Validate() error {
 			if ar.authorizationEndpoint == nil {
 				return errors.New("authorization_endpoint is empty")
 			}
-			if ar.JWKS == nil && !ar.Insecure {
+			if ar.JWKS == nil {
 				return errors.New("jwks is empty")
 			}
 		}
@@ -146,6 +299,156 @@ func (ar *AuthorityRegistration) Validate() error {
 	return nil
 }
 
+// transformIdentityClaim returns the provided identity claim value with the
+// transforms of the associated authority registration applied. Transforms are
+// applied in the order trim, lowercase and replace, so a replace pattern always
+// sees the trimmed and lowercased value. Identity aliases are looked up with
+// the transformed value.
+func (ar *AuthorityRegistration) transformIdentityClaim(value string) string {
+	if ar.IdentityClaimTrim {
+		value = strings.TrimSpace(value)
+	}
+	if ar.IdentityClaimLowercase {
+		value = strings.ToLower(value)
+	}
+	if ar.identityClaimReplacePattern != nil {
+		value = ar.identityClaimReplacePattern.ReplaceAllString(value, ar.IdentityClaimReplaceTemplate)
+	}
+
+	return value
+}
+
+// normalizeIdentityAliases validates the identity aliases of the associated
+// authority registration and normalizes their keys with the trim and
+// lowercase identity claim transforms, so they match the transformed claim
+// values they are looked up with. Returns error if an alias is empty, if
+// keys conflict after normalization or if identity aliases are required but
+// none are set, since then every sign-in would be rejected.
+func (ar *AuthorityRegistration) normalizeIdentityAliases() error {
+	if len(ar.IdentityAliases) == 0 {
+		if ar.IdentityAliasRequired {
+			return errors.New("identity_alias_required is set but identity_aliases is empty")
+		}
+		ar.identityAliases = nil
+		return nil
+	}
+
+	identityAliases := make(map[string]string, len(ar.IdentityAliases))
+	for key, alias := range ar.IdentityAliases {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			return fmt.Errorf("invalid identity_aliases value: empty alias for %#v", key)
+		}
+		normalized := key
+		if ar.IdentityClaimTrim {
+			normalized = strings.TrimSpace(normalized)
+		}
+		if ar.IdentityClaimLowercase {
+			normalized = strings.ToLower(normalized)
+		}
+		if existing, ok := identityAliases[normalized]; ok && existing != alias {
+			return fmt.Errorf("invalid identity_aliases value: conflicting aliases for %#v", normalized)
+		}
+		identityAliases[normalized] = alias
+	}
+	ar.identityAliases = identityAliases
+
+	return nil
+}
+
+// validateSettings validates the scopes, response type and code challenge
+// method of the associated authority registration against what is supported
+// by konnect and returns error if not supported.
+func (ar *AuthorityRegistration) validateSettings() error {
+	switch ar.AuthorityType {
+	case AuthorityTypeOIDC:
+		hasOpenIDScope := false
+		for _, scope := range ar.Scopes {
+			if scope == oidc.ScopeOpenID {
+				hasOpenIDScope = true
+				break
+			}
+		}
+		if !hasOpenIDScope {
+			return fmt.Errorf("scopes must include %s", oidc.ScopeOpenID)
+		}
+
+		hasIDTokenResponseType := false
+		for _, responseType := range strings.Fields(ar.ResponseType) {
+			switch responseType {
+			case oidc.ResponseTypeIDToken:
+				hasIDTokenResponseType = true
+			case oidc.ResponseTypeCode, oidc.ResponseTypeToken:
+			default:
+				return fmt.Errorf("unknown response_type value: %s", responseType)
+			}
+		}
+		if !hasIDTokenResponseType {
+			// NOTE: Authentication results are taken from the ID token, thus
+			// it always must be part of the response.
+			return fmt.Errorf("response_type must include %s", oidc.ResponseTypeIDToken)
+		}
+
+		switch ar.CodeChallengeMethod {
+		case oidc.PlainCodeChallengeMethod, oidc.S256CodeChallengeMethod:
+		default:
+			return fmt.Errorf("unsupported code_challenge_method value: %s", ar.CodeChallengeMethod)
+		}
+	}
+
+	return nil
+}
+
+// validateCapabilities validates the scopes and response type of the
+// associated authority registration against the capabilities announced by the
+// provided discovery document. Capabilities which are not announced are not
+// validated.
+func (ar *AuthorityRegistration) validateCapabilities(wellKnown *oidc.WellKnown) error {
+	if len(wellKnown.ScopesSupported) > 0 {
+		for _, scope := range ar.Scopes {
+			if !utils.ContainsString(wellKnown.ScopesSupported, scope) {
+				return fmt.Errorf("scope %s is not in scopes_supported", scope)
+			}
+		}
+	}
+
+	if len(wellKnown.ResponseTypesSupported) > 0 {
+		supported := false
+		for _, responseType := range wellKnown.ResponseTypesSupported {
+			if equalResponseTypes(responseType, ar.ResponseType) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("response_type %s is not in response_types_supported", ar.ResponseType)
+		}
+	}
+
+	return nil
+}
+
+// negotiateCodeChallengeMethod returns the code challenge method to use with
+// the associated authority for the provided code_challenge_methods_supported
+// of its discovery document. S256 is always preferred when supported, plain
+// is only used when S256 is not supported and plain is not disallowed. An
+// empty value is returned to disable PKCE, if none of the usable methods are
+// supported. Without announced methods, the configured method is returned.
+func (ar *AuthorityRegistration) negotiateCodeChallengeMethod(supported []string) string {
+	if len(supported) == 0 {
+		return ar.CodeChallengeMethod
+	}
+
+	switch {
+	case utils.ContainsString(supported, oidc.S256CodeChallengeMethod):
+		return oidc.S256CodeChallengeMethod
+	case !ar.disallowPlainCodeChallengeMethod && utils.ContainsString(supported, oidc.PlainCodeChallengeMethod):
+		return oidc.PlainCodeChallengeMethod
+	default:
+		return ""
+	}
+}
+
 func (ar *AuthorityRegistration) setValidationKeysFromJWKS(jwks *jose.JSONWebKeySet, skipInvalid bool) error {
 	if jwks == nil || len(jwks.Keys) == 0 {
 		ar.validationKeys = nil
@@ -174,8 +477,91 @@ func (ar *AuthorityRegistration) setValidationKeysFromJWKS(jwks *jose.JSONWebKey
 	return nil
 }
 
-// Initialize initializes the associated registration with the provided context.
-func (ar *AuthorityRegistration) Initialize(ctx context.Context, logger logrus.FieldLogger) error {
+// getDetails returns the immutable Details of the associated registration,
+// creating and caching them as needed. The returned Details are a stable
+// snapshot which is never modified, so they are safe to use concurrently.
+func (ar *AuthorityRegistration) getDetails() *Details {
+	now := time.Now()
+	ar.mutex.RLock()
+	details := ar.details
+	if details != nil && details.ready && ar.isDiscoveryStale(now) {
+		details = nil
+	}
+	ar.mutex.RUnlock()
+	if details != nil {
+		return details
+	}
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	ready := ar.ready && !ar.isDiscoveryStale(now)
+	if ar.details == nil || ar.details.ready != ready {
+		details = &Details{
+			ID:            ar.ID,
+			Name:          ar.Name,
+			AuthorityType: ar.AuthorityType,
+			IconURL:       ar.IconURL,
+
+			ClientID:     ar.ClientID,
+			ClientSecret: ar.ClientSecret,
+
+			Insecure: ar.Insecure,
+
+			Scopes:              ar.Scopes,
+			ResponseType:        ar.ResponseType,
+			CodeChallengeMethod: ar.codeChallengeMethod,
+
+			Registration: ar,
+		}
+		// Fill in dynamic stuff.
+		details.ready = ready
+		if ready {
+			details.AuthorizationEndpoint = ar.authorizationEndpoint
+			details.validationKeys = ar.validationKeys
+		}
+		ar.details = details
+	}
+
+	return ar.details
+}
+
+// isDiscoveryStale returns true if the associated registration uses
+// discovery and its last successful discovery is older than its maximum
+// staleness at the provided time. It must be called with the accociated
+// registration's mutex locked.
+func (ar *AuthorityRegistration) isDiscoveryStale(now time.Time) bool {
+	if ar.discoveryMaxStale <= 0 || !ar.discover || ar.lastDiscovery.IsZero() {
+		return false
+	}
+
+	return now.Sub(ar.lastDiscovery) > ar.discoveryMaxStale
+}
+
+// equal returns true if the provided authority registration has the same
+// configuration as the associated authority registration.
+func (ar *AuthorityRegistration) equal(other *AuthorityRegistration) bool {
+	a, err := json.Marshal(ar)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(a, b)
+}
+
+// shutdown stops the background processing of the associated registration.
+func (ar *AuthorityRegistration) shutdown() {
+	if ar.cancel != nil {
+		ar.cancel()
+	}
+}
+
+// Initialize initializes the associated registration with the provided context,
+// using the provided http.Client for outbound requests to the authority.
+func (ar *AuthorityRegistration) Initialize(ctx context.Context, logger logrus.FieldLogger, httpClient *http.Client) error {
 	ar.mutex.Lock()
 	defer ar.mutex.Unlock()
 
@@ -183,12 +569,13 @@ func (ar *AuthorityRegistration) Initialize(ctx context.Context, logger logrus.F
 	case AuthorityTypeOIDC:
 		if ar.authorizationEndpoint != nil && ar.validationKeys != nil {
 			ar.ready = true
+			ar.details = nil
 		}
 		if ar.metadataEndpoint == nil {
 			return fmt.Errorf("no metadata_endpoint set")
 		}
 
-		return initializeOIDC(ctx, logger, ar)
+		return initializeOIDC(ctx, logger, httpClient, ar)
 	}
 
 	return nil
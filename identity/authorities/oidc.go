@@ -20,13 +20,16 @@ package authorities
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v2"
 	"stash.kopano.io/kgol/oidc-go"
 
+	"stash.kopano.io/kc/konnect/tracing"
 	"stash.kopano.io/kc/konnect/utils"
 )
 
@@ -38,7 +41,13 @@ func (logger *oidcProviderLogger) Printf(format string, args ...interface{}) {
 	logger.logger.Debugf(format, args...)
 }
 
-func initializeOIDC(ctx context.Context, logger logrus.FieldLogger, ar *AuthorityRegistration) error {
+// Authority discovery retry settings.
+const (
+	authorityDiscoverRetryInitialDelay = 1 * time.Second
+	authorityDiscoverRetryMaxDelay     = 5 * time.Minute
+)
+
+func initializeOIDC(ctx context.Context, logger logrus.FieldLogger, httpClient *http.Client, ar *AuthorityRegistration) error {
 	providerLogger := logger.WithFields(logrus.Fields{
 		"id":   ar.ID,
 		"type": AuthorityTypeOIDC,
@@ -46,11 +55,7 @@ func initializeOIDC(ctx context.Context, logger logrus.FieldLogger, ar *Authorit
 	config := &oidc.ProviderConfig{
 		Logger:     &oidcProviderLogger{providerLogger},
 		HTTPHeader: http.Header{},
-	}
-	if ar.Insecure {
-		config.HTTPClient = utils.InsecureHTTPClient
-	} else {
-		config.HTTPClient = utils.DefaultHTTPClient
+		HTTPClient: httpClient,
 	}
 	config.HTTPHeader.Set("User-Agent", utils.DefaultHTTPUserAgent)
 
@@ -64,67 +69,169 @@ func initializeOIDC(ctx context.Context, logger logrus.FieldLogger, ar *Authorit
 	if issuer.Host == "" {
 		return fmt.Errorf("issuer host is empty")
 	}
+	go func() {
+		// Retry discovery with exponential backoff until the authority becomes
+		// ready or the context is done.
+		attempt := 0
+		for {
+			attempt++
+			retryErr := runOIDCProvider(ctx, providerLogger, issuer, config, ar)
+			if retryErr == nil {
+				return
+			}
+			ar.mutex.Lock()
+			ar.discoveryErr = retryErr
+			ar.lastFailure = time.Now()
+			ar.mutex.Unlock()
+
+			if ar.DiscoverMaxRetries > 0 && attempt > ar.DiscoverMaxRetries {
+				providerLogger.WithError(retryErr).WithField("attempt", attempt).Errorln("authority discovery failed, giving up")
+				return
+			}
+
+			delay := getDiscoverRetryDelay(attempt)
+			providerLogger.WithError(retryErr).WithFields(logrus.Fields{
+				"attempt": attempt,
+				"delay":   delay,
+			}).Warnln("authority discovery failed, retrying")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// runOIDCProvider creates and initializes a new oidc provider for the provided
+// issuer and applies its updates to the provided authority registration. It
+// returns nil when the provided context is done and an error if the provider
+// failed before the authority became ready.
+func runOIDCProvider(ctx context.Context, providerLogger logrus.FieldLogger, issuer *url.URL, config *oidc.ProviderConfig, ar *AuthorityRegistration) error {
 	provider, err := oidc.NewProvider(issuer, config)
 	if err != nil {
 		return fmt.Errorf("failed to create oidc provider: %v", err)
 	}
+	// Trace discovery until the first definition or error.
+	_, discoverSpan := tracing.Start(ctx, "authority.discover", tracing.String("authority_id", ar.ID), tracing.String("iss", issuer.String()))
+	defer discoverSpan.End()
+
 	updates := make(chan *oidc.ProviderDefinition)
 	errors := make(chan error)
 	err = provider.Initialize(ctx, updates, errors)
 	if err != nil {
+		discoverSpan.SetError(err)
 		return fmt.Errorf("failed to initialize oidc provider: %v", err)
 	}
-	go func() {
-		// Handle updates and errors of authority meta data.
-		var pd *oidc.ProviderDefinition
-		var jwks *jose.JSONWebKeySet
-		for {
-			pd = nil
 
-			select {
-			case <-ctx.Done():
-				return
-			case update := <-updates:
-				pd = update
-			case err := <-errors:
-				providerLogger.Errorf("error while oidc provider update: %v", err)
+	// Handle updates and errors of authority meta data.
+	var pd *oidc.ProviderDefinition
+	var jwks *jose.JSONWebKeySet
+	for {
+		pd = nil
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case update := <-updates:
+			pd = update
+			discoverSpan.End()
+		case err := <-errors:
+			discoverSpan.SetError(err)
+			discoverSpan.End()
+			ar.mutex.Lock()
+			ar.lastFailure = time.Now()
+			ready := ar.ready
+			stale := ar.isDiscoveryStale(ar.lastFailure)
+			lastDiscovery := ar.lastDiscovery
+			ar.mutex.Unlock()
+			if !ready {
+				provider.Shutdown()
+				return err
+			}
+			providerLogger.Errorf("error while oidc provider update: %v", err)
+			if stale {
+				providerLogger.WithField("last_discovery", lastDiscovery).Warnln("authority discovery is stale, not ready until discovery succeeds again")
 			}
+		}
 
-			if pd != nil {
-				ar.mutex.Lock()
+		if pd != nil {
+			ar.mutex.Lock()
 
-				if pd.WellKnown != nil && pd.WellKnown.AuthorizationEndpoint != "" {
-					if ar.authorizationEndpoint, err = url.Parse(pd.WellKnown.AuthorizationEndpoint); err != nil {
-						providerLogger.WithError(err).Errorln("failed to parse oidc provider discover document authorization_endpoint")
-					}
+			ar.lastDiscovery = time.Now()
+			ar.discoveryErr = nil
+			// Discovery results change the details, so reset them.
+			ar.details = nil
+
+			if pd.WellKnown != nil && pd.WellKnown.AuthorizationEndpoint != "" {
+				if ar.authorizationEndpoint, err = url.Parse(pd.WellKnown.AuthorizationEndpoint); err != nil {
+					providerLogger.WithError(err).Errorln("failed to parse oidc provider discover document authorization_endpoint")
 				}
+			}
 
-				if pd.JWKS != jwks {
-					if err := ar.setValidationKeysFromJWKS(pd.JWKS, true); err != nil {
-						providerLogger.Errorf("failed to set authority keys from oidc provider jwks: %v", err)
-					}
+			if pd.JWKS != jwks {
+				if err := ar.setValidationKeysFromJWKS(pd.JWKS, true); err != nil {
+					ar.lastFailure = time.Now()
+					providerLogger.Errorf("failed to set authority keys from oidc provider jwks: %v", err)
 				}
+			}
 
-				ready := ar.ready
-				if ar.authorizationEndpoint != nil && ar.validationKeys != nil {
-					ar.ready = true
-				} else {
-					ar.ready = false
+			if pd.WellKnown != nil {
+				ar.capabilitiesErr = ar.validateCapabilities(pd.WellKnown)
+				if ar.capabilitiesErr != nil {
+					providerLogger.WithError(ar.capabilitiesErr).Errorln("authority configuration is not supported by oidc provider")
 				}
-				if ready != ar.ready {
-					if ar.ready {
-						providerLogger.Infoln("authority is now ready")
+
+				codeChallengeMethod := ar.negotiateCodeChallengeMethod(pd.WellKnown.CodeChallengeMethodsSupported)
+				if codeChallengeMethod != ar.codeChallengeMethod {
+					fields := logrus.Fields{
+						"configured": ar.CodeChallengeMethod,
+						"supported":  pd.WellKnown.CodeChallengeMethodsSupported,
+					}
+					if codeChallengeMethod == "" {
+						providerLogger.WithFields(fields).Warnln("oidc provider supports no known code challenge method, pkce is disabled")
 					} else {
-						providerLogger.Warnln("authority is no longer ready")
+						providerLogger.WithFields(fields).WithField("code_challenge_method", codeChallengeMethod).Infoln("using code challenge method supported by oidc provider")
 					}
-				} else if !ar.ready {
-					providerLogger.Warnln("authority not ready")
+					ar.codeChallengeMethod = codeChallengeMethod
 				}
+			}
 
-				ar.mutex.Unlock()
+			ready := ar.ready
+			if ar.authorizationEndpoint != nil && ar.validationKeys != nil && ar.capabilitiesErr == nil {
+				ar.ready = true
+			} else {
+				ar.ready = false
+			}
+			if ready != ar.ready {
+				if ar.ready {
+					providerLogger.Infoln("authority is now ready")
+				} else {
+					providerLogger.Warnln("authority is no longer ready")
+				}
+			} else if !ar.ready {
+				providerLogger.Warnln("authority not ready")
 			}
+
+			ar.mutex.Unlock()
 		}
-	}()
+	}
+}
 
-	return nil
+// getDiscoverRetryDelay returns the exponential backoff delay with jitter for
+// the provided discovery attempt.
+func getDiscoverRetryDelay(attempt int) time.Duration {
+	delay := authorityDiscoverRetryMaxDelay
+	if attempt < 32 {
+		if d := authorityDiscoverRetryInitialDelay << uint(attempt-1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+
+	// Apply jitter, randomly using between half and the full delay.
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
 }
@@ -19,30 +19,253 @@ package authorities
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/utils"
 )
 
+// registryWaitReadyInterval is the interval in which WaitReady checks if the
+// default authority is ready.
+const registryWaitReadyInterval = 100 * time.Millisecond
+
 // Registry implements the registry for registered authorities.
 type Registry struct {
 	mutex sync.RWMutex
 
-	defaultID   string
-	authorities map[string]*AuthorityRegistration
+	defaultID     string
+	authorities   map[string]*AuthorityRegistration
+	strictDefault bool
+
+	// withMetrics enables the registry metrics. defaultConflicts holds the
+	// IDs of the authorities which have been counted as default conflict, so
+	// that conflicts are counted once and not again on every reload.
+	withMetrics      bool
+	defaultConflicts map[string]bool
+
+	disallowPlainCodeChallengeMethod bool
+
+	// discoveryMaxStale is the duration after the last successful discovery
+	// of an authority after which it is no longer ready. If zero, discovery
+	// results never get stale.
+	discoveryMaxStale time.Duration
+
+	// maxAuthorities is the maximum number of registered authorities. If
+	// zero, the number of authorities is not limited.
+	maxAuthorities int
+
+	// ctx is used to initialize authorities which are added at runtime.
+	ctx context.Context
+
+	// storeFilepath is the path of the file where managed authorities are
+	// persisted. If empty, managed authorities are not persisted.
+	storeFilepath string
+
+	httpClientConfig   *utils.HTTPClientConfig
+	tlsClientConfig    *tls.Config
+	httpClient         *http.Client
+	insecureHTTPClient *http.Client
+	rootCAsPEM         []byte
+
+	// httpClients caches the clients for authorities which need their own
+	// proxy or root CAs, keyed by httpClientKey.
+	httpClients      map[string]*http.Client
+	httpClientsMutex sync.Mutex
+
+	// requestLogger logs outbound requests to authorities with their ID,
+	// taken from the RequestLogger of the provided HTTP client config.
+	requestLogger   logrus.FieldLogger
+	requestLogLevel logrus.Level
 
 	logger logrus.FieldLogger
 }
 
-// NewRegistry creates a new authorizations Registry with the provided parameters.
-func NewRegistry(ctx context.Context, registrationConfFilepath string, logger logrus.FieldLogger) (*Registry, error) {
+// RegistryConfig defines the settings of a Registry. The zero value is a
+// valid configuration.
+type RegistryConfig struct {
+	// StrictDefault rejects registration configurations which mark more than
+	// one authority as default with error instead of keeping the first
+	// default authority.
+	StrictDefault bool
+
+	// DisallowPlainCodeChallengeMethod rejects authorities configured with
+	// the plain PKCE code challenge method and never negotiates plain with
+	// authorities, even if they announce it.
+	DisallowPlainCodeChallengeMethod bool
+
+	// DiscoveryMaxStale, if not zero, makes authorities using discovery not
+	// ready when their last successful discovery is older than it, until
+	// discovery succeeds again.
+	DiscoveryMaxStale time.Duration
+
+	// MaxAuthorities, if not zero, is the maximum number of authorities which
+	// can be registered.
+	MaxAuthorities int
+
+	// HTTPClientConfig and TLSClientConfig are used to create the clients for
+	// outbound HTTP requests to authorities, shared by all authorities.
+	// Authorities marked as insecure get a client which skips TLS
+	// verification and authorities with a trusted CA get a client which
+	// trusts that CA in addition to the system roots and RootCAsPEM, both
+	// affecting only requests to these authorities. If the HTTP client
+	// config has a RequestLogger, requests are logged together with the ID
+	// of the authority they are made for.
+	HTTPClientConfig *utils.HTTPClientConfig
+	TLSClientConfig  *tls.Config
+
+	// RootCAsPEM, if set, are PEM encoded CA certificates which are trusted
+	// for connections to all authorities in addition to the system roots,
+	// replacing the root CAs of TLSClientConfig.
+	RootCAsPEM []byte
+
+	// MetricsRegisterer, if set, enables the registry metrics and is used to
+	// register them.
+	MetricsRegisterer prometheus.Registerer
+}
+
+// NewRegistry creates a new authorizations Registry with the provided
+// parameters. The registrationConfFilepath can be a registration configuration
+// file or a directory of such files, which are merged. If config is nil, the
+// zero RegistryConfig is used.
+func NewRegistry(ctx context.Context, registrationConfFilepath string, config *RegistryConfig, logger logrus.FieldLogger) (*Registry, error) {
+	registryData, err := readRegistryData(registrationConfFilepath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRegistry(ctx, registryData, config, logger)
+}
+
+// NewRegistryWithAuthorities creates a new authorizations Registry like
+// NewRegistry, but with the provided authorities instead of reading them from
+// a registration configuration file. The authorities are validated and
+// registered the same way as authorities from a registration configuration
+// file, making this useful to embed or test with fixed authorities.
+func NewRegistryWithAuthorities(ctx context.Context, authorities []*AuthorityRegistration, config *RegistryConfig, logger logrus.FieldLogger) (*Registry, error) {
+	registryData := &RegistryData{
+		Authorities: authorities,
+	}
+
+	return newRegistry(ctx, registryData, config, logger)
+}
+
+func newRegistry(ctx context.Context, registryData *RegistryData, config *RegistryConfig, logger logrus.FieldLogger) (*Registry, error) {
+	if config == nil {
+		config = &RegistryConfig{}
+	}
+	httpClientConfig := config.HTTPClientConfig
+	tlsClientConfig := config.TLSClientConfig
+	if tlsClientConfig == nil {
+		tlsClientConfig = utils.DefaultTLSConfig()
+	}
+	if len(config.RootCAsPEM) > 0 {
+		rootCAs, err := utils.NewCertPoolFromPEM(config.RootCAsPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root CAs: %v", err)
+		}
+		tlsClientConfig = tlsClientConfig.Clone()
+		tlsClientConfig.RootCAs = rootCAs
+	}
+	var requestLogger logrus.FieldLogger
+	var requestLogLevel logrus.Level
+	if httpClientConfig != nil && httpClientConfig.RequestLogger != nil {
+		// NOTE: Requests are logged per authority, so the shared clients must
+		// not log on their own.
+		requestLogger = httpClientConfig.RequestLogger
+		requestLogLevel = httpClientConfig.RequestLogLevel
+		withoutRequestLogger := *httpClientConfig
+		withoutRequestLogger.RequestLogger = nil
+		httpClientConfig = &withoutRequestLogger
+	}
+
+	if config.MetricsRegisterer != nil {
+		if err := registerMetrics(config.MetricsRegisterer); err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %v", err)
+		}
+	}
+
+	r := &Registry{
+		authorities:   make(map[string]*AuthorityRegistration),
+		strictDefault: config.StrictDefault,
+
+		withMetrics:      config.MetricsRegisterer != nil,
+		defaultConflicts: make(map[string]bool),
+
+		disallowPlainCodeChallengeMethod: config.DisallowPlainCodeChallengeMethod,
+		discoveryMaxStale:                config.DiscoveryMaxStale,
+		maxAuthorities:                   config.MaxAuthorities,
+
+		ctx: ctx,
+
+		httpClientConfig:   httpClientConfig,
+		tlsClientConfig:    tlsClientConfig,
+		httpClient:         utils.NewHTTPClient(httpClientConfig, tlsClientConfig),
+		insecureHTTPClient: utils.NewHTTPClient(httpClientConfig, insecureTLSClientConfig(tlsClientConfig)),
+		rootCAsPEM:         config.RootCAsPEM,
+		httpClients:        make(map[string]*http.Client),
+
+		requestLogger:   requestLogger,
+		requestLogLevel: requestLogLevel,
+
+		logger: logger,
+	}
+
+	authorities, defaultID, conflicts, err := r.loadAuthorities(registryData)
+	if err != nil {
+		return nil, err
+	}
+	for _, authority := range authorities {
+		r.authorities[authority.ID] = authority
+		r.initialize(ctx, authority)
+	}
+	r.defaultID = defaultID
+	for _, id := range conflicts {
+		r.countDefaultConflict(id)
+	}
+
+	return r, nil
+}
+
+// insecureTLSClientConfig returns a copy of the provided tls.Config which
+// skips TLS verification.
+func insecureTLSClientConfig(tlsClientConfig *tls.Config) *tls.Config {
+	config := tlsClientConfig.Clone()
+	config.InsecureSkipVerify = true
+
+	return config
+}
+
+// readRegistryData reads and parses the authorities registration
+// configuration at the provided path. If the path is a directory, all its
+// *.yaml files are read in lexical order of their names and their authorities
+// are merged. Authority IDs must be unique across these files.
+func readRegistryData(registrationConfFilepath string, logger logrus.FieldLogger) (*RegistryData, error) {
 	registryData := &RegistryData{}
 
 	if registrationConfFilepath != "" {
+		info, err := os.Stat(registrationConfFilepath)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return readRegistryDataDir(registrationConfFilepath, logger)
+		}
+
 		logger.Debugf("parsing authorities registration conf from %v", registrationConfFilepath)
 		registryFile, err := ioutil.ReadFile(registrationConfFilepath)
 		if err != nil {
@@ -55,66 +278,364 @@ func NewRegistry(ctx context.Context, registrationConfFilepath string, logger lo
 		}
 	}
 
-	r := &Registry{
-		authorities: make(map[string]*AuthorityRegistration),
+	return registryData, nil
+}
 
-		logger: logger,
+// readRegistryDataDir reads, parses and merges the authorities registration
+// configuration files in the directory at the provided path. Hidden files are
+// ignored.
+func readRegistryDataDir(registrationConfDirpath string, logger logrus.FieldLogger) (*RegistryData, error) {
+	matches, err := filepath.Glob(filepath.Join(registrationConfDirpath, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	registryData := &RegistryData{}
+	sources := make(map[string]string)
+	for _, fn := range matches {
+		if strings.HasPrefix(filepath.Base(fn), ".") {
+			continue
+		}
+		logger.Debugf("parsing authorities registration conf from %v", fn)
+		registryFile, readErr := ioutil.ReadFile(fn)
+		if readErr != nil {
+			return nil, readErr
+		}
+		fileData := &RegistryData{}
+		if err = yaml.Unmarshal(registryFile, fileData); err != nil {
+			return nil, fmt.Errorf("failed to parse %v: %v", fn, err)
+		}
+		for _, authority := range fileData.Authorities {
+			id := authority.ID
+			if id == "" {
+				id = authority.Name
+			}
+			if id != "" {
+				if source, ok := sources[id]; ok {
+					return nil, fmt.Errorf("duplicate authority id %v in %v, already defined in %v", id, fn, source)
+				}
+				sources[id] = fn
+			}
+			registryData.Authorities = append(registryData.Authorities, authority)
+		}
 	}
 
+	return registryData, nil
+}
+
+// loadAuthorities validates the authorities of the provided registry data and
+// returns the valid ones mapped by ID together with the ID of the default
+// authority if any and the IDs of the authorities whose default flag was
+// ignored. Invalid authorities are skipped. Returns error if the accociated
+// registry is strict about the default authority and more than one valid
+// authority is marked as default.
+func (r *Registry) loadAuthorities(registryData *RegistryData) (map[string]*AuthorityRegistration, string, []string, error) {
+	authorities := make(map[string]*AuthorityRegistration)
+
 	var defaultAuthority *AuthorityRegistration
+	var conflicts []string
+	domains := make(map[string]string)
 	for _, authority := range registryData.Authorities {
-		validateErr := authority.Validate()
-		registerErr := r.Register(authority)
+		validateErr := authority.resolveSecret()
+		if validateErr == nil {
+			validateErr = authority.Validate()
+		}
+		var registerErr error
+		if validateErr == nil {
+			registerErr = r.prepare(authority)
+		}
 		fields := logrus.Fields{
 			"id":                 authority.ID,
 			"client_id":          authority.ClientID,
 			"with_client_secret": authority.ClientSecret != "",
 			"authority_type":     authority.AuthorityType,
 			"insecure":           authority.Insecure,
+			"with_trusted_ca":    authority.TrustedCA != "",
+			"with_http_proxy":    authority.HTTPProxy != "",
 			"default":            authority.Default,
 			"discover":           authority.discover,
 			"alias_required":     authority.IdentityAliasRequired,
 		}
 
 		if validateErr != nil {
-			logger.WithError(validateErr).WithFields(fields).Warnln("skipped registration of invalid authority entry")
+			r.logger.WithError(validateErr).WithFields(fields).Warnln("skipped registration of invalid authority entry")
 			continue
 		}
 		if registerErr != nil {
-			logger.WithError(registerErr).WithFields(fields).Warnln("skipped registration of invalid authority")
+			r.logger.WithError(registerErr).WithFields(fields).Warnln("skipped registration of invalid authority")
 			continue
 		}
+		if limitErr := r.checkMaxAuthorities(authorities, authority.ID); limitErr != nil {
+			r.logger.WithError(limitErr).WithFields(fields).Warnln("skipped registration of authority")
+			continue
+		}
+		if authority.Insecure {
+			r.logger.WithFields(fields).Warnln("insecure authority, TLS connections to this authority are susceptible to man-in-the-middle attacks")
+		}
+		for domain := range authority.domains {
+			if domainID, ok := domains[domain]; ok && domainID != authority.ID {
+				r.logger.WithFields(logrus.Fields{
+					"id":        authority.ID,
+					"domain":    domain,
+					"domain_id": domainID,
+				}).Warnln("authority domain is already used by another authority, the authority with the lower id is used for the domain")
+				continue
+			}
+			domains[domain] = authority.ID
+		}
 		if authority.Default || defaultAuthority == nil {
 			if defaultAuthority == nil || !defaultAuthority.Default {
 				defaultAuthority = authority
 			} else {
-				logger.Warnln("ignored default authority flag since already have a default")
+				conflicts = append(conflicts, authority.ID)
+				r.logger.WithFields(logrus.Fields{
+					"id":         authority.ID,
+					"default_id": defaultAuthority.ID,
+				}).Warnln("ignored default authority flag since already have a default")
 			}
-		} else {
+		} else if len(authority.domains) == 0 {
 			// TODO(longsleep): Implement authority selection.
-			logger.Warnln("non-default additional authorities are not supported yet")
+			r.logger.Warnln("non-default additional authorities are not supported yet")
 		}
 
-		go authority.Initialize(ctx, logger)
+		authorities[authority.ID] = authority
+		r.logger.WithFields(fields).Debugln("registered authority")
+	}
 
-		logger.WithFields(fields).Debugln("registered authority")
+	if len(conflicts) > 0 && r.strictDefault {
+		return nil, "", nil, fmt.Errorf("multiple default authorities, %s conflicting with %s", strings.Join(conflicts, ", "), defaultAuthority.ID)
 	}
 
+	var defaultID string
 	if defaultAuthority != nil {
 		if defaultAuthority.Default {
-			r.defaultID = defaultAuthority.ID
-			logger.WithField("id", defaultAuthority.ID).Infoln("using external default authority")
+			defaultID = defaultAuthority.ID
+			r.logger.WithField("id", defaultAuthority.ID).Infoln("using external default authority")
 		} else {
-			logger.Warnln("non-default authorities are not supported yet")
+			r.logger.Warnln("non-default authorities are not supported yet")
 		}
 	}
 
-	return r, nil
+	return authorities, defaultID, conflicts, nil
+}
+
+// countDefaultConflict counts the authority with the provided ID as default
+// conflict, unless it has been counted already. It must be called with the
+// accociated registry's mutex locked, or before the registry is used.
+func (r *Registry) countDefaultConflict(id string) {
+	if !r.withMetrics || r.defaultConflicts[id] {
+		return
+	}
+	r.defaultConflicts[id] = true
+	defaultAuthorityConflicts.Inc()
+}
+
+// initialize starts the initialization of the provided authority with a
+// context which is canceled when the authority gets removed or replaced.
+func (r *Registry) initialize(ctx context.Context, authority *AuthorityRegistration) {
+	authorityCtx, cancel := context.WithCancel(ctx)
+	authority.cancel = cancel
+
+	go authority.Initialize(authorityCtx, r.logger, r.httpClientFor(authority))
+}
+
+// httpClientFor returns the http.Client to use for outbound requests to the
+// provided authority.
+func (r *Registry) httpClientFor(authority *AuthorityRegistration) *http.Client {
+	httpClient := r.baseHTTPClientFor(authority)
+	if r.requestLogger == nil {
+		return httpClient
+	}
+
+	hook := utils.NewHTTPRequestLogHook(r.requestLogger.WithField("authority_id", authority.ID), r.requestLogLevel)
+	return &http.Client{
+		Timeout:   httpClient.Timeout,
+		Transport: utils.NewHTTPHookTransport(httpClient.Transport, hook),
+	}
+}
+
+// baseHTTPClientFor returns the http.Client to use for outbound requests to
+// the provided authority without request logging. Clients are shared by all
+// authorities with the same proxy, trusted CA and insecure settings.
+func (r *Registry) baseHTTPClientFor(authority *AuthorityRegistration) *http.Client {
+	if authority.trustedCAData == nil && authority.HTTPProxy == "" {
+		if authority.Insecure {
+			return r.insecureHTTPClient
+		}
+
+		return r.httpClient
+	}
+
+	key := httpClientKey(authority)
+
+	r.httpClientsMutex.Lock()
+	defer r.httpClientsMutex.Unlock()
+
+	if httpClient, ok := r.httpClients[key]; ok {
+		return httpClient
+	}
+	httpClient := r.newHTTPClientFor(authority)
+	r.httpClients[key] = httpClient
+
+	return httpClient
+}
+
+// httpClientKey returns the key of the cached http.Client for the provided
+// authority.
+func httpClientKey(authority *AuthorityRegistration) string {
+	trustedCAHash := sha256.Sum256(authority.trustedCAData)
+
+	return fmt.Sprintf("%t:%s:%x", authority.Insecure, authority.HTTPProxy, trustedCAHash)
+}
+
+// newHTTPClientFor creates a new http.Client for outbound requests to the
+// provided authority with its proxy and trusted CA settings.
+func (r *Registry) newHTTPClientFor(authority *AuthorityRegistration) *http.Client {
+
+	httpClientConfig := &utils.HTTPClientConfig{}
+	if r.httpClientConfig != nil {
+		*httpClientConfig = *r.httpClientConfig
+	}
+	if authority.HTTPProxy == AuthorityHTTPProxyDirect {
+		httpClientConfig.WithoutProxy = true
+	} else if authority.httpProxy != nil {
+		httpClientConfig.Proxy = authority.httpProxy
+		httpClientConfig.WithoutProxy = false
+	}
+
+	tlsClientConfig := r.tlsClientConfig.Clone()
+	if authority.trustedCAData != nil {
+		// NOTE: The data of both was validated before, thus errors are not
+		// expected here.
+		data := append(append(append([]byte{}, r.rootCAsPEM...), '\n'), authority.trustedCAData...)
+		if rootCAs, err := utils.NewCertPoolFromPEM(data); err == nil {
+			tlsClientConfig.RootCAs = rootCAs
+		}
+	}
+	tlsClientConfig.InsecureSkipVerify = tlsClientConfig.InsecureSkipVerify || authority.Insecure
+
+	return utils.NewHTTPClient(httpClientConfig, tlsClientConfig)
+}
+
+// Reload reads the authorities registration configuration file at the
+// provided path again and applies it to the accociated registry. Added
+// authorities are registered and initialized, removed authorities are
+// deregistered and changed authorities are initialized again. Unchanged
+// authorities are kept as they are including their ready state. Managed
+// authorities are kept as well and take precedence over authorities with the
+// same ID in the registration configuration file. The provided context is used
+// for initialization of added or changed authorities and thus should be valid
+// for as long as the registry is in use.
+func (r *Registry) Reload(ctx context.Context, registrationConfFilepath string) error {
+	registryData, err := readRegistryData(registrationConfFilepath, r.logger)
+	if err != nil {
+		return err
+	}
+
+	authorities, defaultID, conflicts, err := r.loadAuthorities(registryData)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Keep managed authorities, since they are not part of the registration
+	// configuration file.
+	for id, current := range r.authorities {
+		if !current.managed {
+			continue
+		}
+		if _, ok := authorities[id]; ok {
+			r.logger.WithField("id", id).Warnln("ignored authority from registration conf, since a managed authority with the same id exists")
+		} else if err = r.checkMaxAuthorities(authorities, id); err != nil {
+			return err
+		}
+		authorities[id] = current
+		if defaultID == "" && id == r.defaultID {
+			defaultID = id
+		}
+	}
+
+	for id, authority := range authorities {
+		if current, ok := r.authorities[id]; ok {
+			if current.equal(authority) {
+				// Keep unchanged authority, to avoid discovery again.
+				authorities[id] = current
+				continue
+			}
+			current.shutdown()
+			r.logger.WithField("id", id).Infoln("authority changed, initializing again")
+		} else {
+			r.logger.WithField("id", id).Infoln("authority added")
+		}
+		r.initialize(ctx, authority)
+	}
+	for id, current := range r.authorities {
+		if _, ok := authorities[id]; !ok {
+			current.shutdown()
+			r.logger.WithField("id", id).Infoln("authority removed")
+		}
+	}
+
+	// NOTE: Requests which have looked up an authority before continue to use
+	// it, since lookups return details which are independent of the registry.
+	r.authorities = authorities
+	r.defaultID = defaultID
+
+	// Forget counted conflicts which are resolved, so that only new conflicts
+	// are counted.
+	for id := range r.defaultConflicts {
+		if authority, ok := authorities[id]; !ok || !authority.Default || id == defaultID {
+			delete(r.defaultConflicts, id)
+		}
+	}
+	for _, id := range conflicts {
+		r.countDefaultConflict(id)
+	}
+
+	return nil
 }
 
 // Register validates the provided authority registration and adds the authority
-// to the accociated registry if valid. Returns error otherwise.
+// to the accociated registry if valid. Returns error otherwise, also when the
+// authority is not registered yet and the maximum number of authorities of the
+// accociated registry is reached.
 func (r *Registry) Register(authority *AuthorityRegistration) error {
+	if err := r.prepare(authority); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.checkMaxAuthorities(r.authorities, authority.ID); err != nil {
+		return err
+	}
+	r.authorities[authority.ID] = authority
+
+	return nil
+}
+
+// checkMaxAuthorities returns error if the authority with the provided ID is
+// not part of the provided authorities and adding it would exceed the maximum
+// number of authorities of the accociated registry.
+func (r *Registry) checkMaxAuthorities(authorities map[string]*AuthorityRegistration, id string) error {
+	if r.maxAuthorities <= 0 {
+		return nil
+	}
+	if _, ok := authorities[id]; ok {
+		return nil
+	}
+	if len(authorities) >= r.maxAuthorities {
+		return fmt.Errorf("too many authorities, the maximum of %d registered authorities is reached", r.maxAuthorities)
+	}
+
+	return nil
+}
+
+// prepare validates the provided authority registration and applies defaults.
+func (r *Registry) prepare(authority *AuthorityRegistration) error {
 	if authority.ID == "" {
 		if authority.Name != "" {
 			authority.ID = authority.Name
@@ -126,6 +647,9 @@ func (r *Registry) Register(authority *AuthorityRegistration) error {
 	if authority.ClientID == "" {
 		return errors.New("invalid authority client_id")
 	}
+	if !validIconURL(authority.IconURL) {
+		return fmt.Errorf("invalid authority icon_url: %v", authority.IconURL)
+	}
 
 	switch authority.AuthorityType {
 	case AuthorityTypeOIDC:
@@ -139,18 +663,30 @@ func (r *Registry) Register(authority *AuthorityRegistration) error {
 		if authority.CodeChallengeMethod == "" {
 			authority.CodeChallengeMethod = authorityDefaultCodeChallengeMethod
 		}
+		if r.disallowPlainCodeChallengeMethod && authority.CodeChallengeMethod == oidc.PlainCodeChallengeMethod {
+			return errors.New("code_challenge_method plain is not allowed")
+		}
+		authority.codeChallengeMethod = authority.CodeChallengeMethod
+		authority.disallowPlainCodeChallengeMethod = r.disallowPlainCodeChallengeMethod
+		authority.discoveryMaxStale = r.discoveryMaxStale
 		if authority.IdentityClaimName == "" {
 			authority.IdentityClaimName = authorityDefaultIdentityClaimName
 		}
+		if authority.ACRClaimName == "" {
+			authority.ACRClaimName = authorityDefaultACRClaimName
+		}
+		if authority.AMRClaimName == "" {
+			authority.AMRClaimName = authorityDefaultAMRClaimName
+		}
+
+		if err := authority.validateSettings(); err != nil {
+			return err
+		}
 
 	default:
 		return fmt.Errorf("unknown authority type: %v", authority.AuthorityType)
 	}
 
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-	r.authorities[authority.ID] = authority
-
 	return nil
 }
 
@@ -162,34 +698,7 @@ func (r *Registry) Lookup(ctx context.Context, authorityID string) (*Details, er
 		return nil, fmt.Errorf("unknown authority id: %v", authorityID)
 	}
 
-	// Create immutable registry record.
-	// TODO(longsleep): Cache record.
-	details := &Details{
-		ID:            registration.ID,
-		Name:          registration.Name,
-		AuthorityType: registration.AuthorityType,
-
-		ClientID:     registration.ClientID,
-		ClientSecret: registration.ClientSecret,
-
-		Insecure: registration.Insecure,
-
-		Scopes:              registration.Scopes,
-		ResponseType:        registration.ResponseType,
-		CodeChallengeMethod: registration.CodeChallengeMethod,
-
-		Registration: registration,
-	}
-	registration.mutex.RLock()
-	// Fill in dynamic stuff.
-	details.ready = registration.ready
-	if registration.ready {
-		details.AuthorizationEndpoint = registration.authorizationEndpoint
-		details.validationKeys = registration.validationKeys
-	}
-	registration.mutex.RUnlock()
-
-	return details, nil
+	return registration.getDetails(), nil
 }
 
 // Get returns the registered authorities registration for the provided client ID.
@@ -208,6 +717,149 @@ func (r *Registry) Get(ctx context.Context, authorityID string) (*AuthorityRegis
 
 // Default returns the default authority from the associated registry if any.
 func (r *Registry) Default(ctx context.Context) *Details {
-	authority, _ := r.Lookup(ctx, r.defaultID)
+	r.mutex.RLock()
+	defaultID := r.defaultID
+	r.mutex.RUnlock()
+
+	authority, _ := r.Lookup(ctx, defaultID)
 	return authority
 }
+
+// WaitReady blocks until the default authority of the accociated registry is
+// ready or the provided context is done, in which case an error with the reason
+// why the default authority is not ready is returned. Registries without
+// default authority are ready immediately.
+func (r *Registry) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(registryWaitReadyInterval)
+	defer ticker.Stop()
+
+	for {
+		r.mutex.RLock()
+		authority, ok := r.authorities[r.defaultID]
+		r.mutex.RUnlock()
+		if !ok || authority.getDetails().ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			authority.mutex.RLock()
+			err := authority.discoveryErr
+			if err == nil {
+				err = authority.capabilitiesErr
+			}
+			authority.mutex.RUnlock()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("default authority %s is not ready: %v", authority.ID, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// DefaultForHint returns the default authority for the provided hint from the
+// associated registry if any. If the hint resolves to an authority like with
+// ForHint, that authority is returned. Otherwise, the hint is ignored and the
+// default authority is returned like Default does.
+func (r *Registry) DefaultForHint(ctx context.Context, hint string) *Details {
+	if authority := r.ForHint(ctx, hint); authority != nil {
+		return authority
+	}
+
+	return r.Default(ctx)
+}
+
+// ForHint returns the authority for the provided hint from the associated
+// registry if any. If the hint is an email address like value and its domain
+// is in the domains of an authority, that authority is returned. If multiple
+// authorities have the domain, the one with the lowest ID is used. Returns nil
+// if the hint resolves to no authority.
+func (r *Registry) ForHint(ctx context.Context, hint string) *Details {
+	domain := hintDomain(hint)
+	if domain == "" {
+		return nil
+	}
+
+	var domainID string
+	r.mutex.RLock()
+	for id, registration := range r.authorities {
+		if registration.domains[domain] && (domainID == "" || id < domainID) {
+			domainID = id
+		}
+	}
+	r.mutex.RUnlock()
+
+	authority, _ := r.Lookup(ctx, domainID)
+	return authority
+}
+
+// Ready returns the authorities of the associated registry which are ready,
+// ordered by their name and ID.
+func (r *Registry) Ready(ctx context.Context) []*Details {
+	r.mutex.RLock()
+	registrations := make([]*AuthorityRegistration, 0, len(r.authorities))
+	for _, registration := range r.authorities {
+		registrations = append(registrations, registration)
+	}
+	r.mutex.RUnlock()
+
+	authorities := make([]*Details, 0, len(registrations))
+	for _, registration := range registrations {
+		if details := registration.getDetails(); details.IsReady() {
+			authorities = append(authorities, details)
+		}
+	}
+	sort.Slice(authorities, func(i, j int) bool {
+		if authorities[i].Name != authorities[j].Name {
+			return authorities[i].Name < authorities[j].Name
+		}
+		return authorities[i].ID < authorities[j].ID
+	})
+
+	return authorities
+}
+
+// Snapshot returns a read-only view of the current state of the accociated
+// registry and its authorities.
+func (r *Registry) Snapshot(ctx context.Context) *RegistrySnapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	snapshot := &RegistrySnapshot{
+		DefaultID:   r.defaultID,
+		Authorities: make([]*AuthoritySnapshot, 0, len(r.authorities)),
+	}
+	for _, registration := range r.authorities {
+		authority := &AuthoritySnapshot{
+			ID:            registration.ID,
+			Name:          registration.Name,
+			AuthorityType: registration.AuthorityType,
+			Iss:           registration.Iss,
+			Default:       registration.ID == r.defaultID,
+			Discover:      registration.discover,
+
+			Managed: registration.managed,
+		}
+		registration.mutex.RLock()
+		stale := registration.isDiscoveryStale(time.Now())
+		authority.Ready = registration.ready && !stale
+		if registration.capabilitiesErr != nil {
+			authority.Error = registration.capabilitiesErr.Error()
+		} else if stale {
+			authority.Error = "discovery is stale"
+		}
+		if !registration.lastDiscovery.IsZero() {
+			lastDiscovery := registration.lastDiscovery
+			authority.LastDiscovery = &lastDiscovery
+		}
+		registration.mutex.RUnlock()
+
+		snapshot.Authorities = append(snapshot.Authorities, authority)
+	}
+	sort.Slice(snapshot.Authorities, func(i, j int) bool {
+		return snapshot.Authorities[i].ID < snapshot.Authorities[j].ID
+	})
+
+	return snapshot
+}
@@ -0,0 +1,1131 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package authorities
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+func newTestAuthorityRegistration(tb testing.TB, id string) *AuthorityRegistration {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	discover := false
+
+	return &AuthorityRegistration{
+		ID:                       id,
+		AuthorityType:            AuthorityTypeOIDC,
+		ClientID:                 id + "-client",
+		Default:                  true,
+		Discover:                 &discover,
+		RawAuthorizationEndpoint: "https://authority.example.com/authorize",
+		JWKS: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: id + "-key", Algorithm: "ES256", Use: "sig"}},
+		},
+	}
+}
+
+func newTestRegistry(ctx context.Context, tb testing.TB) *Registry {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistryWithAuthorities(ctx, nil, nil, logger)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	authority := newTestAuthorityRegistration(tb, "fixture")
+	if err = authority.Validate(); err != nil {
+		tb.Fatal(err)
+	}
+	if err = registry.Register(authority); err != nil {
+		tb.Fatal(err)
+	}
+	authority.Initialize(ctx, logger, nil)
+
+	return registry
+}
+
+func TestNewRegistryWithAuthorities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{
+		newTestAuthorityRegistration(t, "fixture"),
+		{
+			ID:            "invalid",
+			AuthorityType: AuthorityTypeOIDC,
+		},
+	}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := registry.Get(ctx, "invalid"); ok {
+		t.Errorf("invalid authority was registered")
+	}
+	authority, ok := registry.Get(ctx, "fixture")
+	if !ok {
+		t.Fatalf("fixture authority was not registered")
+	}
+	if authority.ResponseType != authorityDefaultResponseType {
+		t.Errorf("fixture authority has wrong response type: got %#v want %#v", authority.ResponseType, authorityDefaultResponseType)
+	}
+	if details := registry.Default(ctx); details == nil || details.ID != "fixture" {
+		t.Errorf("fixture authority is not the default: %v", details)
+	}
+}
+
+func TestRegistryMaxAuthorities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	second := newTestAuthorityRegistration(t, "second")
+	second.Default = false
+	registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{
+		newTestAuthorityRegistration(t, "first"),
+		second,
+	}, &RegistryConfig{MaxAuthorities: 1}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := registry.Get(ctx, "first"); !ok {
+		t.Errorf("first authority was not registered")
+	}
+	if _, ok := registry.Get(ctx, "second"); ok {
+		t.Errorf("authority beyond maximum was registered")
+	}
+
+	if err = registry.Register(newTestAuthorityRegistration(t, "first")); err != nil {
+		t.Errorf("failed to register authority again: %v", err)
+	}
+	if err = registry.Register(newTestAuthorityRegistration(t, "third")); err == nil {
+		t.Errorf("registered authority beyond maximum")
+	}
+	managed := newTestAuthorityRegistration(t, "managed")
+	managed.Default = false
+	if err = registry.Add(ctx, managed); err == nil {
+		t.Errorf("added managed authority beyond maximum")
+	}
+	if snapshot := registry.Snapshot(ctx); len(snapshot.Authorities) != 1 {
+		t.Errorf("unexpected number of authorities: %d", len(snapshot.Authorities))
+	}
+}
+
+func TestReadRegistryDataDir(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	confDir, err := ioutil.TempDir("", "konnect-authorities-conf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+
+	for fn, data := range map[string]string{
+		"20-second.yaml":  "authorities:\n  - id: second\n  - id: third\n",
+		"10-first.yaml":   "authorities:\n  - id: first\n",
+		".hidden.yaml":    "authorities:\n  - id: hidden\n",
+		"ignored.yaml.in": "authorities:\n  - id: ignored\n",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(confDir, fn), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registryData, err := readRegistryData(confDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, authority := range registryData.Authorities {
+		ids = append(ids, authority.ID)
+	}
+	if strings.Join(ids, ",") != "first,second,third" {
+		t.Errorf("unexpected authorities: %v", ids)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(confDir, "30-duplicate.yaml"), []byte("authorities:\n  - id: first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readRegistryData(confDir, logger); err == nil || !strings.Contains(err.Error(), "duplicate authority id first") {
+		t.Errorf("expected duplicate authority id error, got %v", err)
+	}
+}
+
+func TestRegistryLookupCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := newTestRegistry(ctx, t)
+
+	details, err := registry.Lookup(ctx, "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !details.IsReady() {
+		t.Fatalf("fixture authority is not ready")
+	}
+	if cached, _ := registry.Lookup(ctx, "fixture"); cached != details {
+		t.Errorf("lookup returned uncached details")
+	}
+
+	// Simulate discovery making the authority no longer ready.
+	registration, _ := registry.Get(ctx, "fixture")
+	registration.mutex.Lock()
+	registration.ready = false
+	registration.details = nil
+	registration.mutex.Unlock()
+
+	updated, _ := registry.Lookup(ctx, "fixture")
+	if updated == details {
+		t.Fatalf("lookup returned stale details")
+	}
+	if updated.IsReady() {
+		t.Errorf("lookup returned ready details for authority which is not ready")
+	}
+	if !details.IsReady() || details.AuthorizationEndpoint == nil {
+		t.Errorf("previously returned details were modified")
+	}
+}
+
+func BenchmarkRegistryLookup(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := newTestRegistry(ctx, b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := registry.Lookup(ctx, "fixture"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNegotiateCodeChallengeMethod(t *testing.T) {
+	for _, test := range []struct {
+		configured    string
+		supported     []string
+		disallowPlain bool
+		expected      string
+	}{
+		{oidc.S256CodeChallengeMethod, nil, false, oidc.S256CodeChallengeMethod},
+		{oidc.PlainCodeChallengeMethod, nil, false, oidc.PlainCodeChallengeMethod},
+		{oidc.S256CodeChallengeMethod, []string{oidc.PlainCodeChallengeMethod, oidc.S256CodeChallengeMethod}, false, oidc.S256CodeChallengeMethod},
+		{oidc.PlainCodeChallengeMethod, []string{oidc.PlainCodeChallengeMethod, oidc.S256CodeChallengeMethod}, false, oidc.S256CodeChallengeMethod},
+		{oidc.S256CodeChallengeMethod, []string{oidc.PlainCodeChallengeMethod}, false, oidc.PlainCodeChallengeMethod},
+		{oidc.S256CodeChallengeMethod, []string{"unknown"}, false, ""},
+		{oidc.S256CodeChallengeMethod, []string{oidc.PlainCodeChallengeMethod, oidc.S256CodeChallengeMethod}, true, oidc.S256CodeChallengeMethod},
+		{oidc.S256CodeChallengeMethod, []string{oidc.PlainCodeChallengeMethod}, true, ""},
+	} {
+		ar := &AuthorityRegistration{
+			CodeChallengeMethod: test.configured,
+
+			disallowPlainCodeChallengeMethod: test.disallowPlain,
+		}
+		if method := ar.negotiateCodeChallengeMethod(test.supported); method != test.expected {
+			t.Errorf("configured %s with supported %v (disallow plain %v): got %#v want %#v", test.configured, test.supported, test.disallowPlain, method, test.expected)
+		}
+	}
+}
+
+func TestNewRegistryDisallowPlainCodeChallengeMethod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, disallowPlain := range []bool{false, true} {
+		plain := newTestAuthorityRegistration(t, "plain")
+		plain.CodeChallengeMethod = oidc.PlainCodeChallengeMethod
+		s256 := newTestAuthorityRegistration(t, "s256")
+		s256.Default = false
+		registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{
+			plain,
+			s256,
+		}, &RegistryConfig{DisallowPlainCodeChallengeMethod: disallowPlain}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := registry.Get(ctx, "plain"); ok == disallowPlain {
+			t.Errorf("authority with plain code challenge method registered %v with disallow plain %v", ok, disallowPlain)
+		}
+		if authority, ok := registry.Get(ctx, "s256"); !ok {
+			t.Errorf("authority with S256 code challenge method not registered with disallow plain %v", disallowPlain)
+		} else if authority.disallowPlainCodeChallengeMethod != disallowPlain {
+			t.Errorf("authority has wrong disallow plain value: got %v want %v", authority.disallowPlainCodeChallengeMethod, disallowPlain)
+		}
+	}
+}
+
+type recordingLogHook struct {
+	entries []*logrus.Entry
+}
+
+func (h *recordingLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingLogHook) Fire(entry *logrus.Entry) error {
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func TestRegistryRequestLogging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	hook := &recordingLogHook{}
+	requestLogger := logrus.New()
+	requestLogger.Out = ioutil.Discard
+	requestLogger.Level = logrus.DebugLevel
+	requestLogger.AddHook(hook)
+
+	registry, err := NewRegistryWithAuthorities(ctx, nil, &RegistryConfig{
+		HTTPClientConfig: &utils.HTTPClientConfig{
+			RequestLogger:   requestLogger,
+			RequestLogLevel: logrus.DebugLevel,
+		},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/token?code=secret-code&state=xyz", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	res, err := registry.httpClientFor(newTestAuthorityRegistration(t, "fixture")).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	entries := hook.entries
+	if len(entries) != 1 {
+		t.Fatalf("wrong number of log entries: got %d want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != logrus.DebugLevel {
+		t.Errorf("wrong log level: %v", entry.Level)
+	}
+	if entry.Data["authority_id"] != "fixture" {
+		t.Errorf("wrong authority_id: %v", entry.Data["authority_id"])
+	}
+	if entry.Data["status"] != http.StatusTeapot {
+		t.Errorf("wrong status: %v", entry.Data["status"])
+	}
+	if u, _ := entry.Data["url"].(string); strings.Contains(u, "secret-code") || !strings.Contains(u, "state=xyz") {
+		t.Errorf("url not redacted: %v", u)
+	}
+	if header, _ := entry.Data["headers"].(http.Header); header.Get("Authorization") == "Bearer secret-token" {
+		t.Errorf("authorization header not redacted: %v", header)
+	}
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("request header was modified")
+	}
+}
+
+func TestRegistryHTTPProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newProxy := func(hits *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			*hits = append(*hits, req.URL.String())
+			rw.WriteHeader(http.StatusTeapot)
+		}))
+	}
+	var defaultHits, authorityHits []string
+	defaultProxy := newProxy(&defaultHits)
+	defer defaultProxy.Close()
+	authorityProxy := newProxy(&authorityHits)
+	defer authorityProxy.Close()
+
+	defaultProxyURL, err := utils.ParseHTTPProxyURL(defaultProxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistryWithAuthorities(ctx, nil, &RegistryConfig{
+		HTTPClientConfig: &utils.HTTPClientConfig{
+			Proxy: defaultProxyURL,
+		},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const target = "http://authority.invalid/.well-known/openid-configuration"
+
+	for _, test := range []struct {
+		name      string
+		httpProxy string
+		hits      *[]string
+	}{
+		{"default", "", &defaultHits},
+		{"override", authorityProxy.URL, &authorityHits},
+		{"direct", AuthorityHTTPProxyDirect, nil},
+	} {
+		defaultHits, authorityHits = nil, nil
+
+		authority := newTestAuthorityRegistration(t, "proxy")
+		authority.HTTPProxy = test.httpProxy
+		if err := authority.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		res, err := registry.httpClientFor(authority).Get(target)
+		if err == nil {
+			res.Body.Close()
+		}
+		if test.hits == nil {
+			if err == nil || len(defaultHits) != 0 || len(authorityHits) != 0 {
+				t.Errorf("%s: request was not sent directly: %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(*test.hits) != 1 || (*test.hits)[0] != target {
+			t.Errorf("%s: request was not sent through the proxy: %v", test.name, *test.hits)
+		}
+		if len(defaultHits)+len(authorityHits) != 1 {
+			t.Errorf("%s: request was sent through the wrong proxy", test.name)
+		}
+	}
+
+	for _, value := range []string{"ftp://proxy.example.com", "http://", "://proxy"} {
+		authority := newTestAuthorityRegistration(t, "proxy")
+		authority.HTTPProxy = value
+		if err := authority.Validate(); err == nil {
+			t.Errorf("invalid http_proxy %q was accepted", value)
+		}
+	}
+}
+
+// newTestTLSServer starts a TLS server with a new self-signed certificate
+// for 127.0.0.1 and returns it together with the PEM encoded certificate.
+func newTestTLSServer(tb testing.TB) (*httptest.Server, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "konnect-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	server.StartTLS()
+
+	return server, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestRegistryTrustedCA(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	globalServer, globalCA := newTestTLSServer(t)
+	defer globalServer.Close()
+	authorityServer, authorityCA := newTestTLSServer(t)
+	defer authorityServer.Close()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistryWithAuthorities(ctx, nil, &RegistryConfig{
+		RootCAsPEM: globalCA,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := newTestAuthorityRegistration(t, "plain")
+	trusted := newTestAuthorityRegistration(t, "trusted")
+	trusted.TrustedCA = string(authorityCA)
+	other := newTestAuthorityRegistration(t, "other")
+	other.TrustedCA = string(authorityCA)
+	for _, authority := range []*AuthorityRegistration{plain, trusted, other} {
+		if err = authority.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		authority *AuthorityRegistration
+		target    string
+		ok        bool
+	}{
+		{"plain with global CA", plain, globalServer.URL, true},
+		{"plain with authority CA", plain, authorityServer.URL, false},
+		{"trusted with global CA", trusted, globalServer.URL, true},
+		{"trusted with authority CA", trusted, authorityServer.URL, true},
+	} {
+		res, err := registry.httpClientFor(test.authority).Get(test.target)
+		if err == nil {
+			res.Body.Close()
+		}
+		if test.ok != (err == nil) {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+	}
+
+	if registry.baseHTTPClientFor(trusted) != registry.baseHTTPClientFor(other) {
+		t.Error("http client for authorities with the same trusted CA was not reused")
+	}
+	if registry.baseHTTPClientFor(trusted) == registry.baseHTTPClientFor(plain) {
+		t.Error("http client for authority with trusted CA is the shared client")
+	}
+
+	if _, err = NewRegistryWithAuthorities(ctx, nil, &RegistryConfig{
+		RootCAsPEM: []byte("invalid"),
+	}, logger); err == nil {
+		t.Error("invalid root CAs were accepted")
+	}
+}
+
+func TestRegistryWaitReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	discover := true
+	unreachable := newTestAuthorityRegistration(t, "unreachable")
+	unreachable.Iss = "https://unreachable.example.com"
+	unreachable.Discover = &discover
+	unreachable.JWKS = nil
+	unreachable.RawAuthorizationEndpoint = ""
+	unreachable.discoveryErr = fmt.Errorf("unittest discovery failure")
+
+	for _, test := range []struct {
+		name        string
+		authorities []*AuthorityRegistration
+		wantErr     string
+	}{
+		{"none", nil, ""},
+		{"ready", []*AuthorityRegistration{newTestAuthorityRegistration(t, "ready")}, ""},
+		{"unreachable", []*AuthorityRegistration{unreachable}, "unittest discovery failure"},
+	} {
+		registry, err := NewRegistryWithAuthorities(ctx, test.authorities, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		err = registry.WaitReady(waitCtx)
+		waitCancel()
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: wrong error: got %v want %s", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestRegistryManagedAuthorities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storeDir, err := ioutil.TempDir("", "konnect-authorities-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	storeFilepath := filepath.Join(storeDir, "authorities.json")
+
+	registry := newTestRegistry(ctx, t)
+	if err = registry.LoadStore(ctx, storeFilepath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Managed authorities must not reference secrets of the server.
+	for _, secret := range []string{"env:KONNECT_TEST_AUTHORITY_SECRET", "file:/etc/passwd"} {
+		referencing := newTestAuthorityRegistration(t, "managed")
+		referencing.ClientSecret = secret
+		if err = registry.Add(ctx, referencing); err != ErrSecretReference {
+			t.Errorf("expected secret reference error for %v, got %v", secret, err)
+		}
+	}
+
+	managed := newTestAuthorityRegistration(t, "managed")
+	managed.Default = false
+	managed.ClientSecret = "inline:managed-secret"
+	if err = registry.Add(ctx, managed); err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.Add(ctx, newTestAuthorityRegistration(t, "managed")); err != ErrAuthorityExists {
+		t.Errorf("expected exists error, got %v", err)
+	}
+	if err = registry.Update(ctx, newTestAuthorityRegistration(t, "fixture")); err != ErrAuthorityNotManaged {
+		t.Errorf("expected not managed error, got %v", err)
+	}
+	if err = registry.Update(ctx, newTestAuthorityRegistration(t, "unknown")); err != ErrAuthorityUnknown {
+		t.Errorf("expected unknown error, got %v", err)
+	}
+	if err = registry.Deregister(ctx, "fixture"); err != ErrAuthorityNotManaged {
+		t.Errorf("expected not managed error, got %v", err)
+	}
+
+	details, err := registry.Lookup(ctx, "managed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.ClientSecret != "managed-secret" {
+		t.Errorf("managed authority secret not resolved: %v", details.ClientSecret)
+	}
+	if details := registry.Default(ctx); details != nil {
+		t.Errorf("non-default managed authority became default: %v", details.ID)
+	}
+
+	// The store keeps the secret as provided.
+	stored, err := ioutil.ReadFile(storeFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stored), "inline:managed-secret") {
+		t.Errorf("store has unexpected client_secret: %s", stored)
+	}
+
+	// Managed authorities are restored from the store.
+	restored := newTestRegistry(ctx, t)
+	if err = restored.LoadStore(ctx, storeFilepath); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := restored.Snapshot(ctx)
+	if len(snapshot.Authorities) != 2 || snapshot.Authorities[0].ID != "fixture" || snapshot.Authorities[0].Managed || snapshot.Authorities[1].ID != "managed" || !snapshot.Authorities[1].Managed {
+		t.Errorf("unexpected restored authorities: %v", snapshot.Authorities)
+	}
+	if details, _ := restored.Lookup(ctx, "managed"); details == nil || details.ClientSecret != "managed-secret" {
+		t.Errorf("restored managed authority secret not resolved: %v", details)
+	}
+
+	// Managed authorities survive reload of the registration conf.
+	if err = restored.Reload(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.Get(ctx, "managed"); !ok {
+		t.Errorf("managed authority was removed by reload")
+	}
+
+	if err = restored.Deregister(ctx, "managed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.Get(ctx, "managed"); ok {
+		t.Errorf("managed authority was not removed")
+	}
+	if err = restored.Deregister(ctx, "managed"); err != ErrAuthorityUnknown {
+		t.Errorf("expected unknown error, got %v", err)
+	}
+	stored, _ = ioutil.ReadFile(storeFilepath)
+	if strings.Contains(string(stored), "\"managed\"") {
+		t.Errorf("managed authority was not removed from store: %s", stored)
+	}
+}
+
+func TestCheckAndMigrateStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storeDir, err := ioutil.TempDir("", "konnect-authorities-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	storeFilepath := filepath.Join(storeDir, "authorities.json")
+
+	registry := newTestRegistry(ctx, t)
+	if err = registry.LoadStore(ctx, storeFilepath); err != nil {
+		t.Fatal(err)
+	}
+	managed := newTestAuthorityRegistration(t, "managed")
+	managed.Default = false
+	if err = registry.Add(ctx, managed); err != nil {
+		t.Fatal(err)
+	}
+	current, err := ioutil.ReadFile(storeFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, invalid, err := CheckStore(storeFilepath, registry.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].ID != "managed" || len(invalid) != 0 {
+		t.Errorf("unexpected check result: %v %v", stored, invalid)
+	}
+	if changed, migrateErr := MigrateStore(storeFilepath, false, registry.logger); migrateErr != nil || changed {
+		t.Errorf("unexpected migration of current store: %v %v", changed, migrateErr)
+	}
+
+	// Stores in another format are rewritten.
+	var data map[string]interface{}
+	if err = json.Unmarshal(current, &data); err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := json.Marshal(data)
+	if err = ioutil.WriteFile(storeFilepath, compact, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, migrateErr := MigrateStore(storeFilepath, true, registry.logger); migrateErr != nil || !changed {
+		t.Errorf("unexpected dry run migration result: %v %v", changed, migrateErr)
+	}
+	if b, _ := ioutil.ReadFile(storeFilepath); string(b) != string(compact) {
+		t.Errorf("dry run migration changed the store")
+	}
+	if changed, migrateErr := MigrateStore(storeFilepath, false, registry.logger); migrateErr != nil || !changed {
+		t.Errorf("unexpected migration result: %v %v", changed, migrateErr)
+	}
+	if b, _ := ioutil.ReadFile(storeFilepath); string(b) != string(current) {
+		t.Errorf("migrated store differs from current format: %s", b)
+	}
+
+	// Stores with invalid authorities are not migrated.
+	data["authorities"] = append(data["authorities"].([]interface{}), map[string]interface{}{"id": "invalid"})
+	withInvalid, _ := json.Marshal(data)
+	if err = ioutil.WriteFile(storeFilepath, withInvalid, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, invalid, err = CheckStore(storeFilepath, registry.logger); err != nil || len(invalid) != 1 || invalid[1] == nil {
+		t.Errorf("unexpected check result for invalid store: %v %v", invalid, err)
+	}
+	if _, err = MigrateStore(storeFilepath, false, registry.logger); err == nil {
+		t.Errorf("expected migration error for invalid store")
+	}
+}
+
+func TestRegistryDefaultForHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	orgA := newTestAuthorityRegistration(t, "org-a")
+	orgA.Default = false
+	orgA.Domains = []string{"Org-A.example.com"}
+	orgB := newTestAuthorityRegistration(t, "org-b")
+	orgB.Default = false
+	orgB.Domains = []string{"org-b.example.com", "org-a.example.com"}
+	invalid := newTestAuthorityRegistration(t, "invalid-domain")
+	invalid.Default = false
+	invalid.Domains = []string{"user@example.com"}
+	registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{
+		newTestAuthorityRegistration(t, "global"),
+		orgB,
+		orgA,
+		invalid,
+	}, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Get(ctx, "invalid-domain"); ok {
+		t.Errorf("authority with invalid domain was registered")
+	}
+
+	for _, test := range []struct {
+		hint     string
+		expected string
+	}{
+		{"alice@org-a.example.com", "org-a"},
+		{"bob@ORG-B.example.com ", "org-b"},
+		{"carol@other.example.com", "global"},
+		{"carol", "global"},
+		{"", "global"},
+	} {
+		details := registry.DefaultForHint(ctx, test.hint)
+		if details == nil || details.ID != test.expected {
+			t.Errorf("wrong authority for hint %#v: got %v want %s", test.hint, details, test.expected)
+		}
+		details = registry.ForHint(ctx, test.hint)
+		if test.expected == "global" {
+			if details != nil {
+				t.Errorf("unexpected authority for unresolved hint %#v: %v", test.hint, details.ID)
+			}
+		} else if details == nil || details.ID != test.expected {
+			t.Errorf("wrong resolved authority for hint %#v: got %v want %s", test.hint, details, test.expected)
+		}
+	}
+}
+
+func TestRegistryReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistryWithAuthorities(ctx, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beta := newTestAuthorityRegistration(t, "beta")
+	beta.Name = "Beta"
+	alpha := newTestAuthorityRegistration(t, "alpha")
+	alpha.Name = "Alpha"
+	alpha.IconURL = "https://alpha.example.com/icon.svg"
+	pending := newTestAuthorityRegistration(t, "pending")
+	pending.Name = "Aardvark"
+	for _, authority := range []*AuthorityRegistration{beta, alpha, pending} {
+		if err = authority.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err = registry.Register(authority); err != nil {
+			t.Fatal(err)
+		}
+	}
+	beta.Initialize(ctx, logger, nil)
+	alpha.Initialize(ctx, logger, nil)
+
+	ready := registry.Ready(ctx)
+	if len(ready) != 2 || ready[0].ID != "alpha" || ready[1].ID != "beta" {
+		t.Fatalf("wrong ready authorities: %v", ready)
+	}
+	if ready[0].IconURL != alpha.IconURL {
+		t.Errorf("wrong icon url: got %v want %v", ready[0].IconURL, alpha.IconURL)
+	}
+
+	for _, iconURL := range []string{"javascript:alert(1)", "//example.com/icon.svg", "icon.svg", "https:///icon.svg"} {
+		invalid := newTestAuthorityRegistration(t, "invalid")
+		invalid.IconURL = iconURL
+		if err = registry.Register(invalid); err == nil {
+			t.Errorf("authority with icon url %v was registered", iconURL)
+		}
+	}
+	local := newTestAuthorityRegistration(t, "local")
+	local.IconURL = "/static/local.png"
+	if err = registry.Register(local); err != nil {
+		t.Errorf("authority with local icon url was not registered: %v", err)
+	}
+}
+
+func TestRegistryDiscoveryMaxStale(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	authority := newTestAuthorityRegistration(t, "upstream")
+	registry, err := NewRegistryWithAuthorities(ctx, []*AuthorityRegistration{authority}, &RegistryConfig{DiscoveryMaxStale: time.Hour}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority.Initialize(ctx, logger, nil)
+
+	setLastDiscovery := func(lastDiscovery time.Time) {
+		authority.mutex.Lock()
+		authority.discover = true
+		authority.lastDiscovery = lastDiscovery
+		authority.details = nil
+		authority.mutex.Unlock()
+	}
+
+	for _, test := range []struct {
+		name          string
+		lastDiscovery time.Time
+		ready         bool
+	}{
+		{"fresh", time.Now().Add(-time.Minute), true},
+		{"stale", time.Now().Add(-2 * time.Hour), false},
+		{"refreshed", time.Now(), true},
+	} {
+		setLastDiscovery(test.lastDiscovery)
+
+		details, err := registry.Lookup(ctx, "upstream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details.IsReady() != test.ready {
+			t.Errorf("%s: wrong ready state: got %v want %v", test.name, details.IsReady(), test.ready)
+		}
+		if !test.ready && details.AuthorizationEndpoint != nil {
+			t.Errorf("%s: stale authority details must not have an authorization endpoint", test.name)
+		}
+
+		snapshot := registry.Snapshot(ctx).Authorities[0]
+		if snapshot.Ready != test.ready {
+			t.Errorf("%s: wrong snapshot ready state: got %v want %v", test.name, snapshot.Ready, test.ready)
+		}
+		if !test.ready && snapshot.Error == "" {
+			t.Errorf("%s: expected snapshot error", test.name)
+		}
+	}
+
+	// Cached details must become stale too.
+	setLastDiscovery(time.Now())
+	if details, _ := registry.Lookup(ctx, "upstream"); !details.IsReady() {
+		t.Fatal("expected ready authority")
+	}
+	authority.mutex.Lock()
+	authority.lastDiscovery = time.Now().Add(-2 * time.Hour)
+	authority.mutex.Unlock()
+	if details, _ := registry.Lookup(ctx, "upstream"); details.IsReady() {
+		t.Error("expected cached details to become stale")
+	}
+}
+
+func TestRegistryDefaultConflicts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	confDir, err := ioutil.TempDir("", "konnect-authorities-conf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+
+	writeConf := func(ids ...string) string {
+		var data string
+		for _, id := range ids {
+			data += fmt.Sprintf("  - id: %s\n    authority_type: oidc\n    client_id: %s-client\n    default: yes\n    iss: https://127.0.0.1:1/%s\n    discover_max_retries: 1\n", id, id, id)
+		}
+		fn := filepath.Join(confDir, strings.Join(ids, "-")+".yaml")
+		if writeErr := ioutil.WriteFile(fn, []byte("authorities:\n"+data), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		return fn
+	}
+	single := writeConf("first")
+	conflicting := writeConf("first", "second")
+	moreConflicting := writeConf("first", "second", "third")
+
+	metricsRegistry := prometheus.NewRegistry()
+	if err = registerMetrics(metricsRegistry); err != nil {
+		t.Fatal(err)
+	}
+	conflicts := func() float64 {
+		families, gatherErr := metricsRegistry.Gather()
+		if gatherErr != nil {
+			t.Fatal(gatherErr)
+		}
+		for _, family := range families {
+			if family.GetName() == "konnect_authorities_default_conflicts_total" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		t.Fatal("default conflicts metric not found")
+		return 0
+	}
+
+	// Conflicts are not counted without metrics.
+	start := conflicts()
+	registry, err := NewRegistry(ctx, conflicting, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.defaultID != "first" {
+		t.Errorf("wrong default authority: %v", registry.defaultID)
+	}
+	if err = registry.Reload(ctx, conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if value := conflicts(); value != start {
+		t.Errorf("conflicts were counted without metrics: %v", value-start)
+	}
+
+	// Conflicts are counted once, not again on reload.
+	registry, err = NewRegistry(ctx, conflicting, &RegistryConfig{MetricsRegisterer: prometheus.NewRegistry()}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := conflicts(); value != start+1 {
+		t.Errorf("wrong number of counted conflicts: got %v want 1", value-start)
+	}
+	if err = registry.Reload(ctx, conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if value := conflicts(); value != start+1 {
+		t.Errorf("conflicts were counted again on reload: got %v want 1", value-start)
+	}
+	if err = registry.Reload(ctx, moreConflicting); err != nil {
+		t.Fatal(err)
+	}
+	if value := conflicts(); value != start+2 {
+		t.Errorf("new conflict was not counted on reload: got %v want 2", value-start)
+	}
+	if err = registry.Reload(ctx, single); err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.Reload(ctx, conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if value := conflicts(); value != start+3 {
+		t.Errorf("conflict was not counted again after it was resolved: got %v want 3", value-start)
+	}
+
+	// Strict registries reject conflicts.
+	if _, err = NewRegistry(ctx, conflicting, &RegistryConfig{StrictDefault: true}, logger); err == nil {
+		t.Errorf("strict registry accepted conflicting default authorities")
+	}
+	registry, err = NewRegistry(ctx, single, &RegistryConfig{StrictDefault: true}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.Reload(ctx, conflicting); err == nil {
+		t.Errorf("strict registry reloaded conflicting default authorities")
+	}
+	if _, ok := registry.Get(ctx, "second"); ok || registry.defaultID != "first" {
+		t.Errorf("strict registry changed authorities on rejected reload")
+	}
+}
+
+func TestRegistryReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	confDir, err := ioutil.TempDir("", "konnect-authorities-conf-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	confFilepath := filepath.Join(confDir, "authorities.yaml")
+	writeConf := func(data string) {
+		if writeErr := ioutil.WriteFile(confFilepath, []byte("authorities:\n"+data), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	authorityConf := func(id string, name string) string {
+		return fmt.Sprintf("  - id: %s\n    name: %s\n    authority_type: oidc\n    client_id: %s-client\n    iss: https://127.0.0.1:1/%s\n    discover_max_retries: 1\n", id, name, id, id)
+	}
+
+	writeConf(authorityConf("unchanged", "Unchanged") + authorityConf("changed", "Changed") + authorityConf("removed", "Removed"))
+	registry, err := NewRegistry(ctx, confFilepath, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged, _ := registry.Get(ctx, "unchanged")
+	changed, _ := registry.Get(ctx, "changed")
+	if unchanged == nil || changed == nil {
+		t.Fatalf("authorities were not registered")
+	}
+
+	writeConf(authorityConf("unchanged", "Unchanged") + authorityConf("changed", "Changed again") + authorityConf("added", "Added"))
+	if err = registry.Reload(ctx, confFilepath); err != nil {
+		t.Fatal(err)
+	}
+	if authority, ok := registry.Get(ctx, "unchanged"); !ok || authority != unchanged {
+		t.Errorf("unchanged authority was replaced on reload")
+	}
+	if authority, ok := registry.Get(ctx, "changed"); !ok || authority == changed || authority.Name != "Changed again" {
+		t.Errorf("changed authority was not replaced on reload: %v", authority)
+	}
+	if _, ok := registry.Get(ctx, "added"); !ok {
+		t.Errorf("added authority was not registered on reload")
+	}
+	if _, ok := registry.Get(ctx, "removed"); ok {
+		t.Errorf("removed authority was not deregistered on reload")
+	}
+
+	// Invalid registration conf leaves the registry as it is.
+	writeConf("  - id: [\n")
+	if err = registry.Reload(ctx, confFilepath); err == nil {
+		t.Errorf("invalid registration conf was reloaded")
+	}
+	if authority, ok := registry.Get(ctx, "unchanged"); !ok || authority != unchanged {
+		t.Errorf("unchanged authority was replaced by failed reload")
+	}
+	if _, ok := registry.Get(ctx, "added"); !ok {
+		t.Errorf("added authority was removed by failed reload")
+	}
+	if err = registry.Reload(ctx, filepath.Join(confDir, "missing.yaml")); err == nil {
+		t.Errorf("missing registration conf was reloaded")
+	}
+	if snapshot := registry.Snapshot(ctx); len(snapshot.Authorities) != 3 {
+		t.Errorf("wrong number of authorities after failed reload: %v", len(snapshot.Authorities))
+	}
+}
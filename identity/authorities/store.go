@@ -0,0 +1,400 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package authorities
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Managed authority errors.
+var (
+	ErrAuthorityUnknown    = errors.New("unknown authority")
+	ErrAuthorityExists     = errors.New("authority already exists")
+	ErrAuthorityNotManaged = errors.New("authority is defined by registration conf")
+
+	ErrSecretReference = errors.New("client_secret of managed authorities must not reference env: or file: secrets")
+)
+
+// LoadStore reads the managed authorities from the store file at the provided
+// path, then registers and initializes them with the provided context. From
+// then on, changes to managed authorities are persisted to that file. Managed
+// authorities take precedence over registered authorities with the same ID. A
+// store file which does not exist yet is not an error.
+func (r *Registry) LoadStore(ctx context.Context, storeFilepath string) error {
+	registryData := &RegistryData{}
+
+	storeFile, err := ioutil.ReadFile(storeFilepath)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(storeFile, registryData); err != nil {
+			return fmt.Errorf("failed to parse authorities store: %v", err)
+		}
+	case os.IsNotExist(err):
+		// Nothing stored yet.
+	default:
+		return fmt.Errorf("failed to read authorities store: %v", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.storeFilepath = storeFilepath
+	for _, authority := range registryData.Authorities {
+		if validateErr := r.validate(authority); validateErr != nil {
+			r.logger.WithError(validateErr).WithField("id", authority.ID).Warnln("skipped registration of invalid managed authority")
+			continue
+		}
+		if limitErr := r.checkMaxAuthorities(r.authorities, authority.ID); limitErr != nil {
+			r.logger.WithError(limitErr).WithField("id", authority.ID).Warnln("skipped registration of managed authority")
+			continue
+		}
+		if current, ok := r.authorities[authority.ID]; ok {
+			r.logger.WithField("id", authority.ID).Warnln("managed authority replaces authority from registration conf")
+			current.shutdown()
+		}
+
+		authority.managed = true
+		r.authorities[authority.ID] = authority
+		r.applyDefault(authority)
+		r.initialize(ctx, authority)
+		r.logger.WithField("id", authority.ID).Debugln("registered managed authority")
+	}
+
+	return nil
+}
+
+// Add validates the provided authority registration and adds it as managed
+// authority to the accociated registry. The authority is initialized right
+// away with the context of the registry and persisted to its store, if any.
+// Returns ErrAuthorityExists, if an authority with the same ID is registered
+// already and error if the maximum number of authorities is reached.
+func (r *Registry) Add(ctx context.Context, authority *AuthorityRegistration) error {
+	if err := r.validate(authority); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.authorities[authority.ID]; ok {
+		return ErrAuthorityExists
+	}
+	if err := r.checkMaxAuthorities(r.authorities, authority.ID); err != nil {
+		return err
+	}
+
+	return r.replace(authority, nil)
+}
+
+// Update validates the provided authority registration and replaces the
+// managed authority with the same ID with it. The authority is initialized
+// again with the context of the registry and persisted to its store, if any.
+// Returns ErrAuthorityUnknown, if there is no authority with the same ID and
+// ErrAuthorityNotManaged if the authority is defined by the registration
+// configuration file.
+func (r *Registry) Update(ctx context.Context, authority *AuthorityRegistration) error {
+	if err := r.validate(authority); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	current, ok := r.authorities[authority.ID]
+	if !ok {
+		return ErrAuthorityUnknown
+	}
+	if !current.managed {
+		return ErrAuthorityNotManaged
+	}
+
+	return r.replace(authority, current)
+}
+
+// Deregister removes the managed authority with the provided ID from the
+// accociated registry and its store, if any. Returns ErrAuthorityUnknown, if
+// there is no such authority and ErrAuthorityNotManaged if the authority is
+// defined by the registration configuration file.
+func (r *Registry) Deregister(ctx context.Context, authorityID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	current, ok := r.authorities[authorityID]
+	if !ok {
+		return ErrAuthorityUnknown
+	}
+	if !current.managed {
+		return ErrAuthorityNotManaged
+	}
+
+	authorities := r.copyAuthorities()
+	delete(authorities, authorityID)
+	if err := r.persist(authorities); err != nil {
+		return err
+	}
+
+	current.shutdown()
+	r.authorities = authorities
+	if r.defaultID == authorityID {
+		r.defaultID = ""
+	}
+	r.logger.WithField("id", authorityID).Infoln("managed authority removed")
+
+	return nil
+}
+
+// validate resolves the secret of the provided managed authority
+// registration, then validates it and applies defaults. Secrets of managed
+// authorities must be provided as value, references to the environment or
+// files of the server are only supported by the registration conf.
+func (r *Registry) validate(authority *AuthorityRegistration) error {
+	switch utils.SecretScheme(authority.ClientSecret) {
+	case utils.SecretSchemeEnv, utils.SecretSchemeFile:
+		return ErrSecretReference
+	}
+	if err := authority.resolveSecret(); err != nil {
+		return err
+	}
+	if err := authority.Validate(); err != nil {
+		return err
+	}
+
+	return r.prepare(authority)
+}
+
+// replace persists and registers the provided authority as managed authority,
+// shutting down the provided current authority if any. It must be called with
+// the accociated registry's mutex locked.
+func (r *Registry) replace(authority *AuthorityRegistration, current *AuthorityRegistration) error {
+	if authority.Default && r.strictDefault && r.defaultID != "" && r.defaultID != authority.ID {
+		return fmt.Errorf("multiple default authorities, %s conflicting with %s", authority.ID, r.defaultID)
+	}
+
+	authority.managed = true
+	authorities := r.copyAuthorities()
+	authorities[authority.ID] = authority
+	if err := r.persist(authorities); err != nil {
+		return err
+	}
+
+	if current != nil {
+		current.shutdown()
+	}
+	r.authorities = authorities
+	r.applyDefault(authority)
+	r.initialize(r.ctx, authority)
+
+	if current != nil {
+		r.logger.WithField("id", authority.ID).Infoln("managed authority changed, initializing again")
+	} else {
+		r.logger.WithField("id", authority.ID).Infoln("managed authority added")
+	}
+
+	return nil
+}
+
+// applyDefault applies the default flag of the provided authority to the
+// default authority of the accociated registry. It must be called with the
+// accociated registry's mutex locked.
+func (r *Registry) applyDefault(authority *AuthorityRegistration) {
+	switch {
+	case authority.Default && (r.defaultID == "" || r.defaultID == authority.ID):
+		r.defaultID = authority.ID
+	case authority.Default:
+		r.countDefaultConflict(authority.ID)
+		r.logger.WithFields(logrus.Fields{
+			"id":         authority.ID,
+			"default_id": r.defaultID,
+		}).Warnln("ignored default authority flag since already have a default")
+	case r.defaultID == authority.ID:
+		r.defaultID = ""
+	}
+}
+
+// copyAuthorities returns a copy of the authorities map of the accociated
+// registry. It must be called with the accociated registry's mutex locked.
+func (r *Registry) copyAuthorities() map[string]*AuthorityRegistration {
+	authorities := make(map[string]*AuthorityRegistration, len(r.authorities))
+	for id, authority := range r.authorities {
+		authorities[id] = authority
+	}
+
+	return authorities
+}
+
+// persist writes the managed authorities of the provided authorities to the
+// store file of the accociated registry, if any.
+func (r *Registry) persist(authorities map[string]*AuthorityRegistration) error {
+	if r.storeFilepath == "" {
+		r.logger.Debugln("managed authorities are not persisted, no store configured")
+		return nil
+	}
+
+	b, err := marshalStore(authorities)
+	if err != nil {
+		return err
+	}
+
+	return writeStoreFile(r.storeFilepath, b)
+}
+
+// marshalStore returns the store file data of the managed authorities of the
+// provided authorities.
+func marshalStore(authorities map[string]*AuthorityRegistration) ([]byte, error) {
+	stored := make([]map[string]interface{}, 0)
+	for _, authority := range authorities {
+		if !authority.managed {
+			continue
+		}
+		data, err := authority.storeData()
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, data)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i]["id"].(string) < stored[j]["id"].(string)
+	})
+
+	return json.MarshalIndent(map[string]interface{}{
+		"authorities": stored,
+	}, "", "  ")
+}
+
+// writeStoreFile writes the provided data to the store file at the provided
+// path.
+func writeStoreFile(storeFilepath string, b []byte) error {
+	// Write to a temporary file first and rename, so the store is never left
+	// partially written.
+	f, err := ioutil.TempFile(filepath.Dir(storeFilepath), ".authorities-")
+	if err != nil {
+		return fmt.Errorf("failed to write authorities store: %v", err)
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), storeFilepath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write authorities store: %v", err)
+	}
+
+	return nil
+}
+
+// CheckStore reads the managed authorities store file at the provided path
+// and validates its authorities without registering or initializing them.
+// Returns the stored authorities, which are prepared with defaults when
+// valid, and the validation errors by index of the stored authority.
+func CheckStore(storeFilepath string, logger logrus.FieldLogger) ([]*AuthorityRegistration, map[int]error, error) {
+	storeFile, err := ioutil.ReadFile(storeFilepath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read authorities store: %v", err)
+	}
+	registryData := &RegistryData{}
+	if err = json.Unmarshal(storeFile, registryData); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse authorities store: %v", err)
+	}
+
+	r := &Registry{
+		logger: logger,
+	}
+	invalid := make(map[int]error)
+	seen := make(map[string]bool)
+	for idx, authority := range registryData.Authorities {
+		if validateErr := r.validate(authority); validateErr != nil {
+			invalid[idx] = validateErr
+			continue
+		}
+		if seen[authority.ID] {
+			invalid[idx] = fmt.Errorf("duplicate authority id %v", authority.ID)
+			continue
+		}
+		seen[authority.ID] = true
+		authority.managed = true
+	}
+
+	return registryData.Authorities, invalid, nil
+}
+
+// MigrateStore rewrites the managed authorities store file at the provided
+// path in the current store format. It refuses to migrate stores with invalid
+// authorities, since those would be lost. Returns true if the store file was
+// changed or, if dryRun is true, would be changed.
+func MigrateStore(storeFilepath string, dryRun bool, logger logrus.FieldLogger) (bool, error) {
+	stored, invalid, err := CheckStore(storeFilepath, logger)
+	if err != nil {
+		return false, err
+	}
+	if len(invalid) > 0 {
+		return false, fmt.Errorf("authorities store has %d invalid authorities, fix them first", len(invalid))
+	}
+
+	authorities := make(map[string]*AuthorityRegistration, len(stored))
+	for _, authority := range stored {
+		authorities[authority.ID] = authority
+	}
+	b, err := marshalStore(authorities)
+	if err != nil {
+		return false, err
+	}
+	current, err := ioutil.ReadFile(storeFilepath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read authorities store: %v", err)
+	}
+	if bytes.Equal(current, b) {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	return true, writeStoreFile(storeFilepath, b)
+}
+
+// storeData returns the data of the accociated registration to persist it,
+// with its client_secret as provided before it was resolved.
+func (ar *AuthorityRegistration) storeData() (map[string]interface{}, error) {
+	b, err := json.Marshal(ar)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	if err = json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	if ar.rawClientSecret != "" {
+		data["client_secret"] = ar.rawClientSecret
+	}
+
+	return data, nil
+}
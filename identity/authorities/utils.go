@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package authorities
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// equalResponseTypes returns true if the provided space separated response
+// type values contain the same response types, regardless of their order.
+func equalResponseTypes(a, b string) bool {
+	af := strings.Fields(a)
+	bf := strings.Fields(b)
+	if len(af) != len(bf) {
+		return false
+	}
+	sort.Strings(af)
+	sort.Strings(bf)
+	for idx := range af {
+		if af[idx] != bf[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeDomain returns the provided domain trimmed and lowercased, without
+// trailing dot.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// hintDomain returns the normalized domain of the provided hint, which is the
+// part after the last @ of email address like hints. Returns empty string if
+// the hint has no domain.
+func hintDomain(hint string) string {
+	idx := strings.LastIndex(hint, "@")
+	if idx < 0 {
+		return ""
+	}
+
+	return normalizeDomain(hint[idx+1:])
+}
+
+// validIconURL returns true if the provided icon URL is empty, an absolute
+// http or https URL or an absolute path.
+func validIconURL(iconURL string) bool {
+	if iconURL == "" {
+		return true
+	}
+
+	u, err := url.Parse(iconURL)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "":
+		return u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(iconURL, "//")
+	}
+
+	return false
+}
@@ -35,6 +35,8 @@ type authRecord struct {
 
 	user     PublicUser
 	authTime time.Time
+	acr      string
+	amr      []string
 }
 
 // NewAuthRecord returns a implementation of identity.AuthRecord holding
@@ -127,3 +129,23 @@ func (r *authRecord) LoggedOn() (bool, time.Time) {
 func (r *authRecord) SetAuthTime(authTime time.Time) {
 	r.authTime = authTime
 }
+
+// ACR implements the identity.AuthRecord interface.
+func (r *authRecord) ACR() string {
+	return r.acr
+}
+
+// SetACR implements the identity.AuthRecord interface.
+func (r *authRecord) SetACR(acr string) {
+	r.acr = acr
+}
+
+// AMR implements the identity.AuthRecord interface.
+func (r *authRecord) AMR() []string {
+	return r.amr
+}
+
+// SetAMR implements the identity.AuthRecord interface.
+func (r *authRecord) SetAMR(amr []string) {
+	r.amr = amr
+}
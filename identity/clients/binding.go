@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"fmt"
+)
+
+// Default network prefix lengths to which the client IP of bound tokens is
+// reduced, so tokens stay valid when the client IP changes within its network.
+const (
+	DefaultTokenBindingIPv4Prefix = 24
+	DefaultTokenBindingIPv6Prefix = 64
+)
+
+// TokenBinding defines the attributes of the request which tokens are bound to
+// when they are issued. Bound tokens are rejected when used with requests not
+// matching these attributes.
+type TokenBinding struct {
+	IP         bool `yaml:"ip" json:"-"`
+	IPv4Prefix int  `yaml:"ipv4_prefix" json:"-"`
+	IPv6Prefix int  `yaml:"ipv6_prefix" json:"-"`
+
+	UserAgent bool `yaml:"user_agent" json:"-"`
+}
+
+// Validate validates the accociated token binding and returns error if it is
+// not valid.
+func (tb *TokenBinding) Validate() error {
+	if tb.IPv4Prefix < 0 || tb.IPv4Prefix > 32 {
+		return fmt.Errorf("invalid token binding ipv4_prefix: %d", tb.IPv4Prefix)
+	}
+	if tb.IPv6Prefix < 0 || tb.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid token binding ipv6_prefix: %d", tb.IPv6Prefix)
+	}
+
+	return nil
+}
+
+// Enabled returns true if the accociated token binding binds tokens to at
+// least one attribute.
+func (tb *TokenBinding) Enabled() bool {
+	return tb != nil && (tb.IP || tb.UserAgent)
+}
+
+// IPPrefixes returns the IPv4 and IPv6 network prefix lengths of the
+// accociated token binding, using the defaults for those not set.
+func (tb *TokenBinding) IPPrefixes() (int, int) {
+	ipv4Prefix, ipv6Prefix := tb.IPv4Prefix, tb.IPv6Prefix
+	if ipv4Prefix == 0 {
+		ipv4Prefix = DefaultTokenBindingIPv4Prefix
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = DefaultTokenBindingIPv6Prefix
+	}
+
+	return ipv4Prefix, ipv6Prefix
+}
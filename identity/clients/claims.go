@@ -18,9 +18,108 @@
 package clients
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/dgrijalva/jwt-go"
 )
 
+// reservedAccessTokenClaims are claims which are set by konnect in access
+// tokens and cannot be configured to be injected.
+var reservedAccessTokenClaims = map[string]bool{
+	"iss": true,
+	"sub": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+	"azp": true,
+	"cnf": true,
+}
+
+// IsReservedAccessTokenClaim returns true if the provided claim name is
+// reserved for access tokens issued by konnect.
+func IsReservedAccessTokenClaim(claim string) bool {
+	return claim == "" || reservedAccessTokenClaims[claim] || strings.HasPrefix(claim, "kc.")
+}
+
+// reservedIDTokenClaims are claims which are set by konnect in ID tokens in
+// addition to the reserved access token claims.
+var reservedIDTokenClaims = map[string]bool{
+	"nonce":     true,
+	"auth_time": true,
+	"acr":       true,
+	"amr":       true,
+	"at_hash":   true,
+	"c_hash":    true,
+	"sid":       true,
+}
+
+// IsReservedStaticClaim returns true if the provided claim name is reserved
+// for access tokens or ID tokens issued by konnect and thus cannot be used as
+// static claim.
+func IsReservedStaticClaim(claim string) bool {
+	return IsReservedAccessTokenClaim(claim) || reservedIDTokenClaims[claim]
+}
+
+// validateStaticClaims validates the provided static claims, converting
+// nested maps as decoded from YAML to maps with string keys so all values can
+// be encoded as JSON.
+func validateStaticClaims(claims map[string]interface{}) error {
+	for claim, value := range claims {
+		if IsReservedStaticClaim(claim) {
+			return fmt.Errorf("reserved claim %v", claim)
+		}
+		normalized, err := normalizeStaticClaimValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of claim %v: %v", claim, err)
+		}
+		claims[claim] = normalized
+	}
+
+	return nil
+}
+
+func normalizeStaticClaimValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", key)
+			}
+			nestedValue, err := normalizeStaticClaimValue(nested)
+			if err != nil {
+				return nil, err
+			}
+			normalized[name] = nestedValue
+		}
+		return normalized, nil
+	case map[string]interface{}:
+		for key, nested := range v {
+			nestedValue, err := normalizeStaticClaimValue(nested)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = nestedValue
+		}
+		return v, nil
+	case []interface{}:
+		for idx, nested := range v {
+			nestedValue, err := normalizeStaticClaimValue(nested)
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = nestedValue
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
 // RegistrationClaims are claims used to with dynamic clients.
 type RegistrationClaims struct {
 	jwt.StandardClaims
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRegistryStaticClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	f, err := ioutil.TempFile("", "konnect-static-claims-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+clients:
+  - id: client-with-static-claims
+    insecure: yes
+    static_claims:
+      tenant_id: tenant-a
+      tenant:
+        name: Tenant A
+        groups: [a, b]
+  - id: client-with-reserved-static-claims
+    insecure: yes
+    static_claims:
+      sub: someone-else
+subject_static_claims:
+  alice:
+    tenant_id: tenant-b
+  mallory:
+    nonce: fixed
+`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := NewRegistry(ctx, nil, f.Name(), 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.Get(ctx, "client-with-reserved-static-claims"); ok {
+		t.Errorf("client with reserved static claim was registered")
+	}
+
+	for _, test := range []struct {
+		clientID string
+		subject  string
+		expected map[string]interface{}
+	}{
+		{"client-with-static-claims", "bob", map[string]interface{}{
+			"tenant_id": "tenant-a",
+			"tenant": map[string]interface{}{
+				"name":   "Tenant A",
+				"groups": []interface{}{"a", "b"},
+			},
+		}},
+		{"client-with-static-claims", "alice", map[string]interface{}{
+			"tenant_id": "tenant-b",
+			"tenant": map[string]interface{}{
+				"name":   "Tenant A",
+				"groups": []interface{}{"a", "b"},
+			},
+		}},
+		{"other-client", "alice", map[string]interface{}{
+			"tenant_id": "tenant-b",
+		}},
+		{"other-client", "bob", nil},
+		{"other-client", "mallory", nil},
+	} {
+		claims := registry.StaticClaims(ctx, test.clientID, test.subject)
+		if !reflect.DeepEqual(claims, test.expected) {
+			t.Errorf("%s %s: wrong static claims: got %#v want %#v", test.clientID, test.subject, claims, test.expected)
+		}
+		if _, err = json.Marshal(claims); err != nil {
+			t.Errorf("%s %s: static claims cannot be encoded: %v", test.clientID, test.subject, err)
+		}
+	}
+}
+
+func TestIsReservedStaticClaim(t *testing.T) {
+	for claim, reserved := range map[string]bool{
+		"":          true,
+		"sub":       true,
+		"aud":       true,
+		"nonce":     true,
+		"auth_time": true,
+		"kc.foo":    true,
+		"tenant_id": false,
+		"email":     false,
+	} {
+		if IsReservedStaticClaim(claim) != reserved {
+			t.Errorf("claim %#v reserved was incorrect, want %v", claim, reserved)
+		}
+	}
+}
+
+func TestIsReservedAccessTokenClaim(t *testing.T) {
+	for _, test := range []struct {
+		claim    string
+		reserved bool
+	}{
+		{"", true},
+		{"sub", true},
+		{"aud", true},
+		{"azp", true},
+		{"cnf", true},
+		{"kc.identity", true},
+		{"kc.custom", true},
+		{"tenant", false},
+		{"roles", false},
+		{"email", false},
+		{"kc", false},
+	} {
+		if reserved := IsReservedAccessTokenClaim(test.claim); reserved != test.reserved {
+			t.Errorf("%#v: got reserved %v want %v", test.claim, reserved, test.reserved)
+		}
+	}
+}
+
+func TestClientRegistrationValidateAccessTokenClaims(t *testing.T) {
+	for _, test := range []struct {
+		claims []string
+		valid  bool
+	}{
+		{nil, true},
+		{[]string{"tenant", "roles"}, true},
+		{[]string{"tenant", "sub"}, false},
+		{[]string{"kc.identity"}, false},
+	} {
+		client := &ClientRegistration{
+			ID:                "client",
+			RedirectURIs:      []string{"https://client.example.com/cb"},
+			AccessTokenClaims: test.claims,
+		}
+		if valid := client.Validate() == nil; valid != test.valid {
+			t.Errorf("%v: got valid %v want %v", test.claims, valid, test.valid)
+		}
+	}
+}
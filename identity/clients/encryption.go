@@ -0,0 +1,181 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// IDTokenEncryptionAlgs are the key management algorithms supported for
+// encrypted ID tokens.
+var IDTokenEncryptionAlgs = []string{
+	string(jose.RSA_OAEP),
+	string(jose.RSA_OAEP_256),
+	string(jose.ECDH_ES),
+	string(jose.ECDH_ES_A128KW),
+	string(jose.ECDH_ES_A256KW),
+}
+
+// IDTokenEncryptionEncs are the content encryption algorithms supported for
+// encrypted ID tokens.
+var IDTokenEncryptionEncs = []string{
+	string(jose.A128CBC_HS256),
+	string(jose.A256CBC_HS512),
+	string(jose.A128GCM),
+	string(jose.A256GCM),
+}
+
+// DefaultIDTokenEncryptionEnc is the content encryption algorithm which is used
+// when a client registers id_token_encrypted_response_alg without
+// id_token_encrypted_response_enc as specified at
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata.
+const DefaultIDTokenEncryptionEnc = string(jose.A128CBC_HS256)
+
+// validateIDTokenEncryption validates the ID token encryption settings of the
+// accociated client registration.
+func (cr *ClientRegistration) validateIDTokenEncryption() error {
+	if cr.RawIDTokenEncryptedResponseAlg == "" {
+		if cr.RawIDTokenEncryptedResponseEnc != "" {
+			return errors.New("id_token_encrypted_response_enc requires id_token_encrypted_response_alg")
+		}
+		return nil
+	}
+
+	if !utils.ContainsString(IDTokenEncryptionAlgs, cr.RawIDTokenEncryptedResponseAlg) {
+		return fmt.Errorf("unsupported id_token_encrypted_response_alg: %v", cr.RawIDTokenEncryptedResponseAlg)
+	}
+	if cr.RawIDTokenEncryptedResponseEnc != "" && !utils.ContainsString(IDTokenEncryptionEncs, cr.RawIDTokenEncryptedResponseEnc) {
+		return fmt.Errorf("unsupported id_token_encrypted_response_enc: %v", cr.RawIDTokenEncryptedResponseEnc)
+	}
+	if cr.JWKS == nil && cr.JWKSURI == "" {
+		return errors.New("jwks or jwks_uri is required for id_token_encrypted_response_alg")
+	}
+
+	return nil
+}
+
+// IDTokenEncryption returns the key management and content encryption
+// algorithms to use for ID tokens issued to the accociated client. Returns
+// false if the client did not register for encrypted ID tokens.
+func (cr *ClientRegistration) IDTokenEncryption() (jose.KeyAlgorithm, jose.ContentEncryption, bool) {
+	if cr.RawIDTokenEncryptedResponseAlg == "" {
+		return "", "", false
+	}
+
+	enc := cr.RawIDTokenEncryptedResponseEnc
+	if enc == "" {
+		enc = DefaultIDTokenEncryptionEnc
+	}
+
+	return jose.KeyAlgorithm(cr.RawIDTokenEncryptedResponseAlg), jose.ContentEncryption(enc), true
+}
+
+// EncryptionKey returns a public key of the provided client registration which
+// is suitable for the provided key management algorithm. Keys are taken from
+// the client's registered jwks, or fetched from its jwks_uri.
+func (r *Registry) EncryptionKey(ctx context.Context, client *ClientRegistration, alg jose.KeyAlgorithm) (*jose.JSONWebKey, error) {
+	var keys []jose.JSONWebKey
+	if client.JWKS != nil {
+		for _, k := range client.JWKS.Keys {
+			publicKey, err := k.DecodePublicKey()
+			if err != nil {
+				continue
+			}
+			keys = append(keys, jose.JSONWebKey{
+				Key:   publicKey,
+				KeyID: k.Kid,
+				Use:   k.Use,
+			})
+		}
+	} else if client.JWKSURI != "" {
+		var err error
+		keys, err = r.getJWKS(ctx, client, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var candidate *jose.JSONWebKey
+	for idx, key := range keys {
+		if !matchesKeyAlgorithm(key.Key, alg) {
+			continue
+		}
+		switch key.Use {
+		case "enc":
+			// Prefer explicit encryption keys.
+			return &keys[idx], nil
+		case "":
+			if candidate == nil {
+				candidate = &keys[idx]
+			}
+		}
+	}
+	if candidate == nil {
+		return nil, fmt.Errorf("no client encryption key for %v", alg)
+	}
+
+	return candidate, nil
+}
+
+// SymmetricKey returns a symmetric key with the provided size in bytes which
+// is derived from the accociated client registration's secret as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#SymmetricKeyEntropy.
+// Dynamic clients have no usable secret, since only its hash is known.
+func (cr *ClientRegistration) SymmetricKey(size int) ([]byte, error) {
+	if cr.Dynamic || cr.Secret == "" {
+		return nil, errors.New("client has no secret to derive a symmetric key")
+	}
+
+	var sum []byte
+	switch {
+	case size <= sha256.Size:
+		s := sha256.Sum256([]byte(cr.Secret))
+		sum = s[:]
+	case size <= sha512.Size384:
+		s := sha512.Sum384([]byte(cr.Secret))
+		sum = s[:]
+	case size <= sha512.Size:
+		s := sha512.Sum512([]byte(cr.Secret))
+		sum = s[:]
+	default:
+		return nil, fmt.Errorf("unsupported symmetric key size: %d", size)
+	}
+
+	return sum[:size], nil
+}
+
+func matchesKeyAlgorithm(key interface{}, alg jose.KeyAlgorithm) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == jose.RSA_OAEP || alg == jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		return alg == jose.ECDH_ES || alg == jose.ECDH_ES_A128KW || alg == jose.ECDH_ES_A256KW
+	}
+
+	return false
+}
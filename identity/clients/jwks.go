@@ -0,0 +1,262 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+const (
+	jwksCacheDuration      = 5 * time.Minute
+	jwksMaxCacheDuration   = 24 * time.Hour
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksSizeLimit          = 512 * 1024
+)
+
+// jwksRecord holds the cached keys of a client's jwks_uri.
+type jwksRecord struct {
+	mutex sync.Mutex
+
+	uri       string
+	keys      []jose.JSONWebKey
+	expires   time.Time
+	fetchedAt time.Time
+}
+
+// validateJWKSURI validates the jwks_uri of the accociated client
+// registration. The jwks_uri must use https, unless the client is insecure.
+func (cr *ClientRegistration) validateJWKSURI() error {
+	if cr.JWKSURI == "" {
+		return nil
+	}
+
+	u, err := url.Parse(cr.JWKSURI)
+	if err != nil || u.Host == "" {
+		return errors.New("jwks_uri must be an absolute URI")
+	}
+	if u.Scheme != "https" && !(cr.Insecure && u.Scheme == "http") {
+		return errors.New("jwks_uri must use https")
+	}
+
+	return nil
+}
+
+// Secure looks up the signing key matching the provided kid of the provided
+// client registration and returns its public key part as a secured client.
+// Keys are taken from the client's registered jwks, or fetched from its
+// jwks_uri. Keys fetched from jwks_uri are cached per client according to the
+// cache headers of the response and are refreshed when the kid is unknown.
+func (r *Registry) Secure(ctx context.Context, client *ClientRegistration, rawKid interface{}) (*Secured, error) {
+	if client.JWKS != nil || client.JWKSURI == "" {
+		if client.JWKS == nil {
+			return nil, errors.New("no client keys registered")
+		}
+		return client.Secure(rawKid)
+	}
+
+	kid, _ := rawKid.(string)
+	keys, err := r.getJWKS(ctx, client, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *jose.JSONWebKey
+	for idx, k := range keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if kid == "" {
+			if key != nil {
+				return nil, errors.New("kid required, client has multiple keys")
+			}
+			key = &keys[idx]
+		} else if k.KeyID == kid {
+			key = &keys[idx]
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid")
+	}
+
+	return &Secured{
+		ID:              client.ID,
+		DisplayName:     client.Name,
+		ApplicationType: client.ApplicationType,
+
+		Kid:       key.KeyID,
+		PublicKey: key.Key,
+
+		TrustedScopes: client.TrustedScopes,
+
+		Registration: client,
+	}, nil
+}
+
+// getJWKS returns the keys of the provided client's jwks_uri, from cache if
+// possible. The cache is refreshed when expired, or when the provided kid is
+// not found, but at most once per minimal refresh interval. Cached keys are
+// kept when a refresh fails.
+func (r *Registry) getJWKS(ctx context.Context, client *ClientRegistration, kid string) ([]jose.JSONWebKey, error) {
+	r.jwksMutex.Lock()
+	if r.jwks == nil {
+		r.jwks = make(map[string]*jwksRecord)
+	}
+	record, ok := r.jwks[client.ID]
+	if !ok || record.uri != client.JWKSURI {
+		record = &jwksRecord{
+			uri: client.JWKSURI,
+		}
+		r.jwks[client.ID] = record
+	}
+	r.jwksMutex.Unlock()
+
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	now := time.Now()
+	refresh := record.keys == nil || !record.expires.After(now)
+	if !refresh && kid != "" {
+		refresh = !containsKeyID(record.keys, kid)
+	}
+	if !refresh || (record.keys != nil && now.Sub(record.fetchedAt) < jwksMinRefreshInterval) {
+		return record.keys, nil
+	}
+
+	record.fetchedAt = now
+	keys, cacheDuration, err := fetchJWKS(ctx, client)
+	if err != nil {
+		if record.keys != nil {
+			r.logger.WithError(err).WithField("client_id", client.ID).Warnln("failed to refresh client jwks, using cached keys")
+			return record.keys, nil
+		}
+		return nil, err
+	}
+
+	record.keys = keys
+	record.expires = now.Add(cacheDuration)
+
+	return keys, nil
+}
+
+// fetchJWKS fetches the keys from the jwks_uri of the provided client
+// registration. The jwks_uri of dynamic clients and redirects to other hosts
+// must not point to internal addresses.
+func fetchJWKS(ctx context.Context, client *ClientRegistration) ([]jose.JSONWebKey, time.Duration, error) {
+	parsed, err := url.Parse(client.JWKSURI)
+	if err != nil || parsed.Host == "" {
+		return nil, 0, errors.New("invalid jwks_uri")
+	}
+	if parsed.Scheme != "https" && !(client.Insecure && parsed.Scheme == "http") {
+		return nil, 0, errors.New("jwks_uri must use https")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", utils.DefaultHTTPUserAgent)
+
+	httpClient := &http.Client{
+		Timeout:   utils.DefaultHTTPClient.Timeout,
+		Transport: newOutboundTransport(client, parsed.Host),
+	}
+	response, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch client jwks: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to fetch client jwks: unexpected status %d", response.StatusCode)
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err = json.NewDecoder(io.LimitReader(response.Body, jwksSizeLimit)).Decode(&jwks); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode client jwks: %v", err)
+	}
+
+	keys := make([]jose.JSONWebKey, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if !key.Valid() {
+			continue
+		}
+		keys = append(keys, key.Public())
+	}
+
+	cacheDuration := getCacheDuration(response.Header, jwksCacheDuration)
+	if cacheDuration > jwksMaxCacheDuration {
+		cacheDuration = jwksMaxCacheDuration
+	}
+
+	return keys, cacheDuration, nil
+}
+
+// getCacheDuration returns the duration for which a response with the
+// provided headers can be cached according to its Cache-Control and Expires
+// headers, falling back to the provided default.
+func getCacheDuration(header http.Header, fallback time.Duration) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0
+			case strings.HasPrefix(directive, "max-age="):
+				if seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil && seconds >= 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+
+	return fallback
+}
+
+func containsKeyID(keys []jose.JSONWebKey, kid string) bool {
+	for _, key := range keys {
+		if key.KeyID == kid {
+			return true
+		}
+	}
+
+	return false
+}
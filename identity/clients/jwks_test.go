@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestRegistrySecureWithJWKSURI(t *testing.T) {
+	ctx := context.Background()
+
+	var mutex sync.Mutex
+	var served jose.JSONWebKeySet
+	var requests int
+	setKey := func(kid string) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		served = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &privateKey.PublicKey, KeyID: kid, Use: "sig"}}}
+		mutex.Unlock()
+	}
+	requestCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+	setKey("key-1")
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		json.NewEncoder(rw).Encode(served)
+	}))
+	defer s.Close()
+
+	r := &Registry{
+		logger: logrus.New(),
+	}
+	client := &ClientRegistration{
+		ID:       "client-with-jwks-uri",
+		Insecure: true,
+		JWKSURI:  s.URL,
+	}
+	if err := client.validateJWKSURI(); err != nil {
+		t.Fatalf("unexpected jwks_uri validation error: %v", err)
+	}
+
+	secured, err := r.Secure(ctx, client, "key-1")
+	if err != nil || secured.Kid != "key-1" {
+		t.Fatalf("unexpected secure result: %v %v", secured, err)
+	}
+	if _, err = r.Secure(ctx, client, "key-1"); err != nil || requestCount() != 1 {
+		t.Fatalf("expected cached keys, got %v after %d requests", err, requestCount())
+	}
+	if record := r.jwks[client.ID]; time.Until(record.expires) < 59*time.Minute {
+		t.Errorf("expected cache duration from max-age, got %v", time.Until(record.expires))
+	}
+
+	// Rotate the key, unknown kid triggers a refresh but at most once per
+	// minimal refresh interval.
+	setKey("key-2")
+	if _, err = r.Secure(ctx, client, "key-2"); err == nil {
+		t.Fatal("expected unknown kid error within minimal refresh interval")
+	}
+	r.jwks[client.ID].fetchedAt = time.Now().Add(-jwksMinRefreshInterval)
+	secured, err = r.Secure(ctx, client, "key-2")
+	if err != nil || secured.Kid != "key-2" || requestCount() != 2 {
+		t.Fatalf("unexpected secure result after rotation: %v %v after %d requests", secured, err, requestCount())
+	}
+
+	dynamicClient := &ClientRegistration{
+		ID:       "dynamic-client-with-jwks-uri",
+		Insecure: true,
+		Dynamic:  true,
+		JWKSURI:  s.URL,
+	}
+	if _, err = r.Secure(ctx, dynamicClient, "key-2"); err == nil {
+		t.Error("expected secure error for dynamic client with internal jwks_uri")
+	}
+
+	client.Insecure = false
+	if err = client.validateJWKSURI(); err == nil {
+		t.Error("expected jwks_uri validation error for http without insecure")
+	}
+}
@@ -21,15 +21,23 @@ import (
 	"context"
 	"crypto"
 	"crypto/subtle"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/mendsley/gojwk"
 	"golang.org/x/crypto/blake2b"
 	_ "gopkg.in/yaml.v2" // Make sure we have yaml.
+	"stash.kopano.io/kgol/oidc-go"
 	"stash.kopano.io/kgol/rndm"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 // Constat data used with dynamic stateless clients.
@@ -41,6 +49,10 @@ const (
 // RegistryData is the base structur of our client registry configuration file.
 type RegistryData struct {
 	Clients []*ClientRegistration `yaml:"clients,flow"`
+
+	// SubjectStaticClaims maps subjects to static claims which are added to
+	// tokens issued for the subject.
+	SubjectStaticClaims map[string]map[string]interface{} `yaml:"subject_static_claims"`
 }
 
 // ClientRegistration defines a client with its properties.
@@ -65,7 +77,20 @@ type ClientRegistration struct {
 	RedirectURIs []string `yaml:"redirect_uris,flow" json:"redirect_uris,omitempty"`
 	Origins      []string `yaml:"origins,flow" json:"-"`
 
-	JWKS *gojwk.Key `yaml:"jwks" json:"-"`
+	// RedirectURISchemes, if set, restricts the schemes which can be used in
+	// redirect URIs of the client.
+	RedirectURISchemes []string `yaml:"redirect_uri_schemes,flow" json:"-"`
+
+	// RedirectURIQueryParameters, if set, lists the names of additional query
+	// parameters which are accepted in redirect URIs of the client, while
+	// scheme, host and path must still match a registered redirect URI. The
+	// value RedirectURIQueryParametersAny accepts all additional parameters.
+	RedirectURIQueryParameters []string `yaml:"redirect_uri_query_parameters,flow" json:"-"`
+
+	JWKS    *gojwk.Key `yaml:"jwks" json:"-"`
+	JWKSURI string     `yaml:"jwks_uri" json:"jwks_uri,omitempty"`
+
+	RequestURIs []string `yaml:"request_uris,flow" json:"request_uris,omitempty"`
 
 	RawIDTokenSignedResponseAlg    string `yaml:"id_token_signed_response_alg" json:"id_token_signed_response_alg,omitempty"`
 	RawUserInfoSignedResponseAlg   string `yaml:"userinfo_signed_response_alg" json:"userinfo_signed_response_alg,omitempty"`
@@ -73,12 +98,242 @@ type ClientRegistration struct {
 	RawTokenEndpointAuthMethod     string `yaml:"token_endpoint_auth_method" json:"token_endpoint_auth_method,omitempty"`
 	RawTokenEndpointAuthSigningAlg string `yaml:"token_endpoint_auth_signing_alg"  json:"token_endpoint_auth_signing_alg,omitempty"`
 
+	RawIDTokenEncryptedResponseAlg string `yaml:"id_token_encrypted_response_alg" json:"id_token_encrypted_response_alg,omitempty"`
+	RawIDTokenEncryptedResponseEnc string `yaml:"id_token_encrypted_response_enc" json:"id_token_encrypted_response_enc,omitempty"`
+
+	SubjectType         string `yaml:"subject_type" json:"subject_type,omitempty"`
+	SectorIdentifierURI string `yaml:"sector_identifier_uri" json:"sector_identifier_uri,omitempty"`
+
 	PostLogoutRedirectURIs []string `yaml:"post_logout_redirect_uris,flow" json:"post_logout_redirect_uris,omitempty"`
+
+	FrontchannelLogoutURI             string `yaml:"frontchannel_logout_uri" json:"frontchannel_logout_uri,omitempty"`
+	FrontchannelLogoutSessionRequired bool   `yaml:"frontchannel_logout_session_required" json:"frontchannel_logout_session_required,omitempty"`
+
+	TLSClientAuthSubjectDN                string `yaml:"tls_client_auth_subject_dn" json:"-"`
+	TLSClientAuthThumbprint               string `yaml:"tls_client_auth_thumbprint" json:"-"`
+	TLSClientCertificateBoundAccessTokens bool   `yaml:"tls_client_certificate_bound_access_tokens" json:"-"`
+
+	AccessTokenAudience string   `yaml:"access_token_audience" json:"-"`
+	AccessTokenClaims   []string `yaml:"access_token_claims,flow" json:"-"`
+
+	AdditionalAudiences []string `yaml:"additional_audiences,flow" json:"-"`
+
+	// StaticClaims are added to access tokens and ID tokens issued to the
+	// client, unless the tokens already have claims with the same names.
+	StaticClaims map[string]interface{} `yaml:"static_claims" json:"-"`
+
+	// AllowedScopes are the scopes which can be granted to the client with
+	// the client_credentials grant, where no user approves scopes.
+	AllowedScopes []string `yaml:"allowed_scopes,flow" json:"-"`
+
+	// TokenBinding, if set, replaces the globally configured token binding
+	// for tokens issued to the client.
+	TokenBinding *TokenBinding `yaml:"token_binding" json:"-"`
+}
+
+// resolveSecret replaces the accociated client registration's secret with the
+// secret it references when it is prefixed with a secret scheme like env: or
+// file:. Values without prefix are used as is.
+func (cr *ClientRegistration) resolveSecret() error {
+	if cr.Secret == "" {
+		return nil
+	}
+
+	secret, err := utils.ReadSecretString(cr.Secret, utils.SecretSchemeInline)
+	if err != nil {
+		return fmt.Errorf("failed to read client secret: %v", err)
+	}
+	cr.Secret = secret
+
+	return nil
 }
 
 // Validate validates the associated client registration data and returns error
 // if the data is not valid.
 func (cr *ClientRegistration) Validate() error {
+	switch cr.RawTokenEndpointAuthMethod {
+	case konnectoidc.AuthMethodTLSClientAuth:
+		if cr.TLSClientAuthSubjectDN == "" {
+			return errors.New("tls_client_auth_subject_dn is required for tls_client_auth")
+		}
+	case konnectoidc.AuthMethodSelfSignedTLSClientAuth:
+		if cr.TLSClientAuthThumbprint == "" {
+			return errors.New("tls_client_auth_thumbprint is required for self_signed_tls_client_auth")
+		}
+	case konnectoidc.AuthMethodPrivateKeyJWT:
+		if (cr.JWKS == nil || len(cr.JWKS.Keys) == 0) && cr.JWKSURI == "" {
+			return errors.New("jwks or jwks_uri is required for private_key_jwt")
+		}
+	}
+
+	if err := validateSubjectType(cr.SubjectType); err != nil {
+		return err
+	}
+
+	if err := cr.validateJWKSURI(); err != nil {
+		return err
+	}
+
+	if err := cr.validateRequestURIs(); err != nil {
+		return err
+	}
+
+	if err := cr.validateRedirectURISchemes(); err != nil {
+		return err
+	}
+
+	if err := cr.validateRedirectURIQueryParameters(); err != nil {
+		return err
+	}
+
+	if err := cr.validateIDTokenEncryption(); err != nil {
+		return err
+	}
+
+	if cr.FrontchannelLogoutURI != "" {
+		if u, err := url.Parse(cr.FrontchannelLogoutURI); err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return errors.New("frontchannel_logout_uri must be an absolute URI without fragment")
+		}
+	}
+
+	for _, claim := range cr.AccessTokenClaims {
+		if IsReservedAccessTokenClaim(claim) {
+			return fmt.Errorf("access_token_claims must not contain reserved claim %v", claim)
+		}
+	}
+
+	if err := validateStaticClaims(cr.StaticClaims); err != nil {
+		return fmt.Errorf("invalid static_claims: %v", err)
+	}
+
+	if cr.TokenBinding != nil {
+		if err := cr.TokenBinding.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRedirectURISchemes validates the redirect_uri_schemes of the
+// accociated client registration and checks that all registered redirect URIs
+// use one of them.
+func (cr *ClientRegistration) validateRedirectURISchemes() error {
+	for _, scheme := range cr.RedirectURISchemes {
+		if scheme == "" || scheme != strings.ToLower(scheme) || strings.Contains(scheme, ":") {
+			return fmt.Errorf("invalid redirect_uri_schemes value: %v", scheme)
+		}
+	}
+	for _, urlString := range cr.RedirectURIs {
+		parsed, err := url.Parse(urlString)
+		if err != nil {
+			return fmt.Errorf("invalid redirect_uri %v", urlString)
+		}
+		if err = cr.ValidateRedirectURIScheme(parsed); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateRedirectURIScheme returns error if the scheme of the provided
+// redirect URI is not allowed by the redirect_uri_schemes of the accociated
+// client registration. All schemes are allowed if none are configured.
+func (cr *ClientRegistration) ValidateRedirectURIScheme(redirectURI *url.URL) error {
+	if len(cr.RedirectURISchemes) == 0 {
+		return nil
+	}
+	scheme := strings.ToLower(redirectURI.Scheme)
+	for _, allowed := range cr.RedirectURISchemes {
+		if allowed == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("redirect_uri scheme %v is not allowed for client", redirectURI.Scheme)
+}
+
+// AllowsGrantType returns true if the provided grant type is allowed by the
+// grant_types of the accociated client registration. All grant types except
+// client_credentials are allowed if none are registered.
+func (cr *ClientRegistration) AllowsGrantType(grantType string) bool {
+	if len(cr.GrantTypes) == 0 {
+		// NOTE: Tokens without user must be enabled explicitly.
+		return grantType != konnectoidc.GrantTypeClientCredentials
+	}
+	for _, allowed := range cr.GrantTypes {
+		if allowed == grantType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesRedirects returns true if the accociated client registration allows any
+// grant type which redirects to the client. Clients which only use the
+// client_credentials grant never get redirected.
+func (cr *ClientRegistration) UsesRedirects() bool {
+	for _, grantType := range cr.GrantTypes {
+		if grantType != konnectoidc.GrantTypeClientCredentials {
+			return true
+		}
+	}
+
+	return len(cr.GrantTypes) == 0
+}
+
+// UsesTLSClientAuth returns true if the accociated client registration
+// authenticates with a TLS client certificate at the token endpoint.
+func (cr *ClientRegistration) UsesTLSClientAuth() bool {
+	switch cr.RawTokenEndpointAuthMethod {
+	case konnectoidc.AuthMethodTLSClientAuth:
+		return true
+	case konnectoidc.AuthMethodSelfSignedTLSClientAuth:
+		return true
+	}
+
+	return false
+}
+
+// IsPublic returns true if the accociated client registration has no means to
+// authenticate at the token endpoint.
+func (cr *ClientRegistration) IsPublic() bool {
+	if cr.RawTokenEndpointAuthMethod == oidc.AuthMethodNone {
+		return true
+	}
+	if cr.Secret != "" || cr.UsesTLSClientAuth() {
+		return false
+	}
+
+	return cr.RawTokenEndpointAuthMethod != konnectoidc.AuthMethodPrivateKeyJWT
+}
+
+// ValidateTLSClientCertificate checks if the provided certificate matches the
+// accociated client registration's registered subject DN or thumbprint as
+// specified at https://tools.ietf.org/html/rfc8705#section-2. The certificate
+// chain must have been validated already by whoever terminated the TLS
+// connection.
+func (cr *ClientRegistration) ValidateTLSClientCertificate(cert *x509.Certificate) error {
+	if cert == nil {
+		return errors.New("no client certificate")
+	}
+
+	switch cr.RawTokenEndpointAuthMethod {
+	case konnectoidc.AuthMethodTLSClientAuth:
+		if cr.TLSClientAuthSubjectDN == "" || cert.Subject.String() != cr.TLSClientAuthSubjectDN {
+			return errors.New("client certificate subject mismatch")
+		}
+	case konnectoidc.AuthMethodSelfSignedTLSClientAuth:
+		thumbprint := utils.CertificateThumbprintS256(cert)
+		if cr.TLSClientAuthThumbprint == "" || subtle.ConstantTimeCompare([]byte(thumbprint), []byte(cr.TLSClientAuthThumbprint)) != 1 {
+			return errors.New("client certificate thumbprint mismatch")
+		}
+	default:
+		return errors.New("client does not use tls client authentication")
+	}
+
 	return nil
 }
 
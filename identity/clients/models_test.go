@@ -0,0 +1,169 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+func TestClientRegistrationRedirectURISchemes(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		client       *ClientRegistration
+		redirectURI  string
+		registerable bool
+		valid        bool
+	}{
+		{"unrestricted", &ClientRegistration{ApplicationType: oidc.ApplicationTypeNative, RedirectURIs: []string{"myapp://cb"}}, "myapp://cb", true, true},
+		{"allowed", &ClientRegistration{ApplicationType: oidc.ApplicationTypeNative, RedirectURIs: []string{"myapp://cb"}, RedirectURISchemes: []string{"myapp"}}, "myapp://cb", true, true},
+		{"disallowed registration", &ClientRegistration{ApplicationType: oidc.ApplicationTypeNative, RedirectURIs: []string{"myapp://cb"}, RedirectURISchemes: []string{"http"}}, "", false, false},
+		{"invalid scheme", &ClientRegistration{RedirectURIs: []string{"https://rp.example.com/cb"}, RedirectURISchemes: []string{"HTTPS"}}, "", false, false},
+		{"insecure allowed", &ClientRegistration{Insecure: true, RedirectURISchemes: []string{"https"}}, "https://rp.example.com/cb", true, true},
+		{"insecure disallowed", &ClientRegistration{Insecure: true, RedirectURISchemes: []string{"https"}}, "http://rp.example.com/cb", true, false},
+	} {
+		test.client.ID = "unittest-client"
+		err := test.client.Validate()
+		if test.registerable != (err == nil) {
+			t.Errorf("%s: unexpected validation result: %v", test.name, err)
+			continue
+		}
+		if !test.registerable {
+			continue
+		}
+
+		r := &Registry{
+			clients: make(map[string]*ClientRegistration),
+		}
+		if err = r.Register(test.client); err != nil {
+			t.Errorf("%s: unexpected register error: %v", test.name, err)
+			continue
+		}
+		err = r.Validate(test.client, "", test.redirectURI, "", true)
+		if test.valid != (err == nil) {
+			t.Errorf("%s: unexpected redirect_uri validation result: %v", test.name, err)
+		}
+	}
+}
+
+func TestClientRegistrationAllowsGrantType(t *testing.T) {
+	tests := []struct {
+		grantTypes []string
+		grantType  string
+		allowed    bool
+	}{
+		{nil, "authorization_code", true},
+		{nil, "refresh_token", true},
+		{[]string{"authorization_code"}, "authorization_code", true},
+		{[]string{"authorization_code"}, "refresh_token", false},
+		{[]string{"authorization_code", "refresh_token"}, "refresh_token", true},
+		{[]string{"implicit"}, "authorization_code", false},
+		{nil, "client_credentials", false},
+		{[]string{"client_credentials"}, "client_credentials", true},
+	}
+
+	for _, test := range tests {
+		cr := &ClientRegistration{
+			GrantTypes: test.grantTypes,
+		}
+		if allowed := cr.AllowsGrantType(test.grantType); allowed != test.allowed {
+			t.Errorf("grant type %v with grant_types %v was incorrect, got %v, want %v", test.grantType, test.grantTypes, allowed, test.allowed)
+		}
+	}
+}
+
+func TestClientRegistrationUsesRedirects(t *testing.T) {
+	tests := []struct {
+		grantTypes []string
+		redirects  bool
+	}{
+		{nil, true},
+		{[]string{"authorization_code"}, true},
+		{[]string{"client_credentials"}, false},
+		{[]string{"client_credentials", "refresh_token"}, true},
+	}
+
+	for _, test := range tests {
+		cr := &ClientRegistration{
+			GrantTypes: test.grantTypes,
+		}
+		if redirects := cr.UsesRedirects(); redirects != test.redirects {
+			t.Errorf("redirects with grant_types %v was incorrect, got %v, want %v", test.grantTypes, redirects, test.redirects)
+		}
+	}
+}
+
+func newTestCertificate(tb testing.TB, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestClientRegistrationValidateTLSClientCertificate(t *testing.T) {
+	cert := newTestCertificate(t, "client")
+	other := newTestCertificate(t, "client")
+	thumbprint := utils.CertificateThumbprintS256(cert)
+
+	for _, test := range []struct {
+		name   string
+		client *ClientRegistration
+		cert   *x509.Certificate
+		valid  bool
+	}{
+		{"subject", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodTLSClientAuth, TLSClientAuthSubjectDN: "CN=client"}, cert, true},
+		{"subject mismatch", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodTLSClientAuth, TLSClientAuthSubjectDN: "CN=other"}, cert, false},
+		{"subject not registered", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodTLSClientAuth}, cert, false},
+		{"thumbprint", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodSelfSignedTLSClientAuth, TLSClientAuthThumbprint: thumbprint}, cert, true},
+		{"thumbprint mismatch", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodSelfSignedTLSClientAuth, TLSClientAuthThumbprint: thumbprint}, other, false},
+		{"thumbprint not registered", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodSelfSignedTLSClientAuth}, cert, false},
+		{"no certificate", &ClientRegistration{RawTokenEndpointAuthMethod: konnectoidc.AuthMethodTLSClientAuth, TLSClientAuthSubjectDN: "CN=client"}, nil, false},
+		{"other auth method", &ClientRegistration{RawTokenEndpointAuthMethod: oidc.AuthMethodClientSecretBasic, TLSClientAuthSubjectDN: "CN=client"}, cert, false},
+	} {
+		err := test.client.ValidateTLSClientCertificate(test.cert)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// internalTransport is the http.RoundTripper for outbound requests of
+// statically registered clients to their registered hosts, which may be
+// internal.
+var internalTransport = utils.DefaultHTTPClient.Transport
+
+// guardedTransport is the http.RoundTripper for outbound requests of clients
+// which must not reach internal addresses. The resolved address is checked
+// for every connection, so host names which resolve differently after they
+// were checked cannot be used to reach internal addresses.
+//
+// NOTE: Requests are never sent through a HTTP proxy, as the proxy would
+// resolve the host names instead.
+var guardedTransport = utils.NewHTTPClient(&utils.HTTPClientConfig{
+	WithoutProxy: true,
+	DialControl:  guardedDialControl,
+}, utils.DefaultTLSConfig()).Transport
+
+// internalNets are the networks which request_uri fetches must not be
+// redirected to, in addition to loopback, link-local and unspecified
+// addresses.
+var internalNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// isInternalIP returns true if the provided IP is not reachable publicly.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPublicHost returns error if the provided host name resolves to any
+// internal address.
+func checkPublicHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if isInternalIP(ip) {
+			return fmt.Errorf("host %v is an internal address", host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve host %v: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if isInternalIP(addr.IP) {
+			return fmt.Errorf("host %v resolves to an internal address", host)
+		}
+	}
+
+	return nil
+}
+
+// guardedDialControl is the net.Dialer Control function of guardedTransport,
+// it rejects connections to internal addresses.
+func guardedDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || isInternalIP(ip) {
+		return fmt.Errorf("connection to internal address %v is not allowed", host)
+	}
+
+	return nil
+}
+
+// outboundTransport is a http.RoundTripper which sends requests to a trusted
+// host with internalTransport and all other requests with guardedTransport.
+type outboundTransport struct {
+	trustedHost string
+}
+
+// newOutboundTransport returns the http.RoundTripper for outbound requests of
+// the provided client registration to the provided registered host. Only
+// statically registered clients can reach their registered host if it is
+// internal, redirects to other hosts and all requests of dynamic clients must
+// not reach internal addresses.
+func newOutboundTransport(client *ClientRegistration, registeredHost string) http.RoundTripper {
+	if client.Dynamic {
+		return guardedTransport
+	}
+
+	return &outboundTransport{
+		trustedHost: registeredHost,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *outboundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.trustedHost {
+		return internalTransport.RoundTrip(req)
+	}
+
+	return guardedTransport.RoundTrip(req)
+}
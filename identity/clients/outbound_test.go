@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	for _, test := range []struct {
+		ip       string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.20.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	} {
+		if internal := isInternalIP(net.ParseIP(test.ip)); internal != test.internal {
+			t.Errorf("%s: got internal %v want %v", test.ip, internal, test.internal)
+		}
+	}
+}
+
+func TestGuardedDialControl(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"10.0.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"8.8.8.8:443", true},
+		{"[2001:4860:4860::8888]:443", true},
+		{"invalid", false},
+	} {
+		if err := guardedDialControl("tcp", test.address, nil); test.ok != (err == nil) {
+			t.Errorf("%s: unexpected result: %v", test.address, err)
+		}
+	}
+}
+
+func TestOutboundTransport(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: The name resolves to the internal address of the test server,
+	// which is only caught when dialing.
+	_, port, _ := net.SplitHostPort(u.Host)
+	otherHost := "localhost:" + port
+
+	for _, test := range []struct {
+		name   string
+		client *ClientRegistration
+		target string
+		ok     bool
+	}{
+		{"static to registered host", &ClientRegistration{}, s.URL, true},
+		{"static to other host", &ClientRegistration{}, "http://" + otherHost, false},
+		{"dynamic to registered host", &ClientRegistration{Dynamic: true}, s.URL, false},
+	} {
+		httpClient := &http.Client{
+			Transport: newOutboundTransport(test.client, u.Host),
+		}
+		res, err := httpClient.Get(test.target)
+		if err == nil {
+			res.Body.Close()
+		}
+		if test.ok != (err == nil) {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+	}
+}
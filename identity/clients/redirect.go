@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// RedirectURIQueryParametersAny is the redirect_uri_query_parameters value
+// which allows any additional query parameter.
+const RedirectURIQueryParametersAny = "*"
+
+// authorizationResponseParameters are the parameters which konnect adds to
+// authorization responses. They cannot be allowed as additional redirect URI
+// query parameters.
+var authorizationResponseParameters = map[string]bool{
+	"code":              true,
+	"state":             true,
+	"id_token":          true,
+	"access_token":      true,
+	"token_type":        true,
+	"expires_in":        true,
+	"scope":             true,
+	"session_state":     true,
+	"error":             true,
+	"error_description": true,
+	"error_uri":         true,
+	"iss":               true,
+}
+
+// validateRedirectURIQueryParameters validates the
+// redirect_uri_query_parameters of the accociated client registration.
+func (cr *ClientRegistration) validateRedirectURIQueryParameters() error {
+	for _, name := range cr.RedirectURIQueryParameters {
+		if name == "" {
+			return fmt.Errorf("invalid redirect_uri_query_parameters value")
+		}
+		if authorizationResponseParameters[name] {
+			return fmt.Errorf("redirect_uri_query_parameters must not contain authorization response parameter %v", name)
+		}
+	}
+
+	return nil
+}
+
+// MatchesRedirectURI returns true if the provided redirect URI matches one of
+// the redirect URIs of the accociated client registration. Redirect URIs must
+// match exactly, unless the client registration allows additional query
+// parameters with redirect_uri_query_parameters. In that case, scheme, host
+// and path must match exactly and all query parameters of the registered
+// redirect URI must be present with the same values.
+func (cr *ClientRegistration) MatchesRedirectURI(redirectURIString string) bool {
+	for _, urlString := range cr.RedirectURIs {
+		if urlString == redirectURIString {
+			return true
+		}
+	}
+	if len(cr.RedirectURIQueryParameters) == 0 {
+		return false
+	}
+
+	redirectURI, err := url.Parse(redirectURIString)
+	if err != nil || redirectURI.Fragment != "" {
+		return false
+	}
+	query, err := url.ParseQuery(redirectURI.RawQuery)
+	if err != nil {
+		return false
+	}
+	for _, urlString := range cr.RedirectURIs {
+		registered, parseErr := url.Parse(urlString)
+		if parseErr != nil || registered.Scheme != redirectURI.Scheme || registered.Host != redirectURI.Host || registered.EscapedPath() != redirectURI.EscapedPath() {
+			continue
+		}
+		if cr.matchesRedirectURIQuery(registered.Query(), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cr *ClientRegistration) matchesRedirectURIQuery(registered url.Values, query url.Values) bool {
+	allowed := make(map[string]bool)
+	for _, name := range cr.RedirectURIQueryParameters {
+		allowed[name] = true
+	}
+
+	for name, values := range query {
+		if registeredValues, ok := registered[name]; ok {
+			if !equalStrings(registeredValues, values) {
+				return false
+			}
+			continue
+		}
+		if authorizationResponseParameters[name] {
+			return false
+		}
+		if !allowed[name] && !allowed[RedirectURIQueryParametersAny] {
+			return false
+		}
+	}
+	for name := range registered {
+		if _, ok := query[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"testing"
+)
+
+func TestClientRegistrationMatchesRedirectURI(t *testing.T) {
+	exact := &ClientRegistration{
+		RedirectURIs: []string{"https://rp.example.com/cb", "https://rp.example.com/cb2?tenant=a"},
+	}
+	allowed := &ClientRegistration{
+		RedirectURIs:               exact.RedirectURIs,
+		RedirectURIQueryParameters: []string{"ref"},
+	}
+	wildcard := &ClientRegistration{
+		RedirectURIs:               exact.RedirectURIs,
+		RedirectURIQueryParameters: []string{RedirectURIQueryParametersAny},
+	}
+
+	for _, test := range []struct {
+		name        string
+		client      *ClientRegistration
+		redirectURI string
+		matches     bool
+	}{
+		{"exact", exact, "https://rp.example.com/cb", true},
+		{"exact with query", exact, "https://rp.example.com/cb2?tenant=a", true},
+		{"exact extra query", exact, "https://rp.example.com/cb?ref=1", false},
+		{"allowed extra query", allowed, "https://rp.example.com/cb?ref=1", true},
+		{"allowed extra query with registered query", allowed, "https://rp.example.com/cb2?ref=1&tenant=a", true},
+		{"allowed changed registered query", allowed, "https://rp.example.com/cb2?ref=1&tenant=b", false},
+		{"allowed missing registered query", allowed, "https://rp.example.com/cb2?ref=1", false},
+		{"allowed unknown query", allowed, "https://rp.example.com/cb?other=1", false},
+		{"allowed other path", allowed, "https://rp.example.com/other?ref=1", false},
+		{"allowed other host", allowed, "https://other.example.com/cb?ref=1", false},
+		{"any extra query", wildcard, "https://rp.example.com/cb?other=1&ref=2", true},
+		{"any response parameter", wildcard, "https://rp.example.com/cb?code=1", false},
+		{"any fragment", wildcard, "https://rp.example.com/cb?ref=1#frag", false},
+	} {
+		if matches := test.client.MatchesRedirectURI(test.redirectURI); matches != test.matches {
+			t.Errorf("%s: unexpected match result: got %v want %v", test.name, matches, test.matches)
+		}
+	}
+
+	invalid := &ClientRegistration{
+		ID:                         "unittest-client",
+		RedirectURIs:               exact.RedirectURIs,
+		RedirectURIQueryParameters: []string{"state"},
+	}
+	if err := invalid.Validate(); err == nil {
+		t.Error("expected validation error for authorization response parameter")
+	}
+}
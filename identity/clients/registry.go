@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 
@@ -38,6 +39,15 @@ type Registry struct {
 
 	trustedURI *url.URL
 	clients    map[string]*ClientRegistration
+	maxClients int
+
+	subjectStaticClaims map[string]map[string]interface{}
+
+	sectorIdentifiersMutex sync.Mutex
+	sectorIdentifiers      map[string]*sectorIdentifierRecord
+
+	jwksMutex sync.Mutex
+	jwks      map[string]*jwksRecord
 
 	StatelessCreator   func(ctx context.Context, signingMethod jwt.SigningMethod, claims jwt.Claims) (string, error)
 	StatelessValidator func(token *jwt.Token) (interface{}, error)
@@ -45,18 +55,15 @@ type Registry struct {
 	logger logrus.FieldLogger
 }
 
-// NewRegistry created a new client Registry with the provided parameters.
-func NewRegistry(ctx context.Context, trustedURI *url.URL, registrationConfFilepath string, logger logrus.FieldLogger) (*Registry, error) {
+// NewRegistry created a new client Registry with the provided parameters. If
+// maxClients is not zero, no more than maxClients clients can be registered.
+func NewRegistry(ctx context.Context, trustedURI *url.URL, registrationConfFilepath string, maxClients int, logger logrus.FieldLogger) (*Registry, error) {
 	registryData := &RegistryData{}
 
 	if registrationConfFilepath != "" {
 		logger.Debugf("parsing identifier registration conf from %v", registrationConfFilepath)
-		registryFile, err := ioutil.ReadFile(registrationConfFilepath)
-		if err != nil {
-			return nil, err
-		}
-
-		err = yaml.Unmarshal(registryFile, registryData)
+		var err error
+		registryData, err = readRegistryData(registrationConfFilepath)
 		if err != nil {
 			return nil, err
 		}
@@ -65,13 +72,23 @@ func NewRegistry(ctx context.Context, trustedURI *url.URL, registrationConfFilep
 	r := &Registry{
 		trustedURI: trustedURI,
 		clients:    make(map[string]*ClientRegistration),
+		maxClients: maxClients,
 
 		logger: logger,
 	}
 
 	for _, client := range registryData.Clients {
-		validateErr := client.Validate()
-		registerErr := r.Register(client)
+		validateErr := client.resolveSecret()
+		if validateErr == nil {
+			validateErr = client.Validate()
+		}
+		if validateErr == nil {
+			validateErr = r.ValidateSectorIdentifier(ctx, client)
+		}
+		var registerErr error
+		if validateErr == nil {
+			registerErr = r.Register(client)
+		}
 		fields := logrus.Fields{
 			"client_id":          client.ID,
 			"with_client_secret": client.Secret != "",
@@ -93,17 +110,83 @@ func NewRegistry(ctx context.Context, trustedURI *url.URL, registrationConfFilep
 		logger.WithFields(fields).Debugln("registered client")
 	}
 
+	for subject, claims := range registryData.SubjectStaticClaims {
+		if err := validateStaticClaims(claims); err != nil {
+			logger.WithError(err).WithField("sub", subject).Warnln("skipped invalid subject static claims")
+			continue
+		}
+		if r.subjectStaticClaims == nil {
+			r.subjectStaticClaims = make(map[string]map[string]interface{})
+		}
+		r.subjectStaticClaims[subject] = claims
+	}
+
 	return r, nil
 }
 
+func readRegistryData(registrationConfFilepath string) (*RegistryData, error) {
+	registryFile, err := ioutil.ReadFile(registrationConfFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	registryData := &RegistryData{}
+	err = yaml.Unmarshal(registryFile, registryData)
+	if err != nil {
+		return nil, err
+	}
+
+	return registryData, nil
+}
+
+// CheckRegistrationConf reads the clients of the registration configuration
+// file at the provided path and validates them the same way as NewRegistry,
+// except for sector identifiers which are not fetched. Returns the clients
+// and the validation errors by index of the client.
+func CheckRegistrationConf(registrationConfFilepath string, logger logrus.FieldLogger) ([]*ClientRegistration, map[int]error, error) {
+	registryData, err := readRegistryData(registrationConfFilepath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := &Registry{
+		clients: make(map[string]*ClientRegistration),
+
+		logger: logger,
+	}
+	invalid := make(map[int]error)
+	for idx, client := range registryData.Clients {
+		validateErr := client.resolveSecret()
+		if validateErr == nil {
+			validateErr = client.Validate()
+		}
+		if validateErr == nil {
+			if _, exists := r.clients[client.ID]; exists {
+				validateErr = fmt.Errorf("duplicate client id %v", client.ID)
+			}
+		}
+		if validateErr == nil {
+			validateErr = r.Register(client)
+		}
+		if validateErr != nil {
+			invalid[idx] = validateErr
+		}
+	}
+
+	return registryData.Clients, invalid, nil
+}
+
 // Register validates the provided client registration and adds the client
-// to the accociated registry if valid. Returns error otherwise.
+// to the accociated registry if valid. Returns error otherwise, also when the
+// client is not registered yet and the maximum number of clients of the
+// accociated registry is reached.
 func (r *Registry) Register(client *ClientRegistration) error {
 	if client.ID == "" {
 		return errors.New("invalid client_id")
 	}
 
-	if !client.Insecure && len(client.RedirectURIs) == 0 {
+	redirects := client.UsesRedirects()
+	if !client.Insecure && redirects && len(client.RedirectURIs) == 0 {
 		return errors.New("no redirect_uris")
 	}
 
@@ -129,7 +212,7 @@ func (r *Registry) Register(client *ClientRegistration) error {
 				client.Origins = append(client.Origins, parsed.Scheme+"://"+parsed.Host)
 			}
 		}
-		if !client.Insecure && len(client.Origins) == 0 {
+		if !client.Insecure && redirects && len(client.Origins) == 0 {
 			return errors.New("no origins - origin is required when application_type is web")
 		}
 		// breaks
@@ -155,6 +238,9 @@ func (r *Registry) Register(client *ClientRegistration) error {
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	if _, exists := r.clients[client.ID]; !exists && r.maxClients > 0 && len(r.clients) >= r.maxClients {
+		return fmt.Errorf("too many clients, the maximum of %d registered clients is reached", r.maxClients)
+	}
 	r.clients[client.ID] = client
 	return nil
 }
@@ -178,22 +264,32 @@ func (r *Registry) Validate(client *ClientRegistration, clientSecret string, red
 		}
 	}
 
+	if redirectURIString != "" && len(client.RedirectURISchemes) > 0 {
+		// Enforce allowed schemes also for insecure clients without configured
+		// redirect URIs.
+		redirectURI, err := url.Parse(redirectURIString)
+		if err != nil {
+			return fmt.Errorf("invalid redirect_uri: %v", redirectURIString)
+		}
+		if err = client.ValidateRedirectURIScheme(redirectURI); err != nil {
+			return err
+		}
+	}
+
 	if redirectURIString != "" && (!client.Insecure || len(client.RedirectURIs) > 0) {
 		// Make sure to validate the redirect URI unless client is marked insecure
 		// and has no configured redirect URIs.
-		redirectURIOK := false
-		for _, urlString := range client.RedirectURIs {
-			if urlString == redirectURIString {
-				redirectURIOK = true
-				break
-			}
-		}
-		if !redirectURIOK {
+		if !client.MatchesRedirectURI(redirectURIString) {
 			return fmt.Errorf("invalid redirect_uri: %v", redirectURIString)
 		}
 	}
 
 	if !withoutSecret {
+		if client.UsesTLSClientAuth() {
+			// Clients using TLS client authentication must never be let in
+			// with a secret.
+			return errors.New("client requires tls client authentication")
+		}
 		if valid, err := client.validateSecret(clientSecret); !valid {
 			return fmt.Errorf("invalid client_secret: %v", err)
 		}
@@ -202,9 +298,39 @@ func (r *Registry) Validate(client *ClientRegistration, clientSecret string, red
 	return nil
 }
 
+// ValidatePostLogoutRedirectURI validates the provided post logout redirect
+// URI string against the registered post logout redirect URIs of the provided
+// client registration.
+func (r *Registry) ValidatePostLogoutRedirectURI(client *ClientRegistration, postLogoutRedirectURIString string) error {
+	if postLogoutRedirectURIString == "" || (client.Insecure && len(client.PostLogoutRedirectURIs) == 0) {
+		// Nothing to validate, or client is marked insecure and has no
+		// configured post logout redirect URIs.
+		return nil
+	}
+
+	for _, urlString := range client.PostLogoutRedirectURIs {
+		if urlString == postLogoutRedirectURIString {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid post_logout_redirect_uri: %v", postLogoutRedirectURIString)
+}
+
 // Lookup returns and validates the clients Detail information for the provided
 // parameters from the accociated registry.
 func (r *Registry) Lookup(ctx context.Context, clientID string, clientSecret string, redirectURI *url.URL, originURIString string, withoutSecret bool) (*Details, error) {
+	return r.lookup(ctx, clientID, clientSecret, redirectURI, originURIString, withoutSecret, false)
+}
+
+// LookupForEndSession returns the clients Detail information for the provided
+// parameters from the accociated registry, validating the provided URI as
+// post logout redirect URI instead of as redirect URI.
+func (r *Registry) LookupForEndSession(ctx context.Context, clientID string, postLogoutRedirectURI *url.URL, originURIString string) (*Details, error) {
+	return r.lookup(ctx, clientID, "", postLogoutRedirectURI, originURIString, true, true)
+}
+
+func (r *Registry) lookup(ctx context.Context, clientID string, clientSecret string, redirectURI *url.URL, originURIString string, withoutSecret bool, endSession bool) (*Details, error) {
 	var err error
 	var trusted bool
 	var dynamic bool
@@ -248,11 +374,21 @@ func (r *Registry) Lookup(ctx context.Context, clientID string, clientSecret str
 
 	if registration != nil {
 		redirectURIBase := &url.URL{
-			Scheme: redirectURI.Scheme,
-			Host:   redirectURI.Host,
-			Path:   redirectURI.Path,
+			Scheme:   redirectURI.Scheme,
+			Host:     redirectURI.Host,
+			Path:     redirectURI.Path,
+			RawPath:  redirectURI.RawPath,
+			RawQuery: redirectURI.RawQuery,
+		}
+		if endSession {
+			// Post logout redirect URIs must match exactly.
+			err = r.Validate(registration, clientSecret, "", originURIString, withoutSecret)
+			if err == nil {
+				err = r.ValidatePostLogoutRedirectURI(registration, redirectURI.String())
+			}
+		} else {
+			err = r.Validate(registration, clientSecret, redirectURIBase.String(), originURIString, withoutSecret)
 		}
-		err = r.Validate(registration, clientSecret, redirectURIBase.String(), originURIString, withoutSecret)
 		displayName = registration.Name
 		trusted = registration.Trusted
 	} else {
@@ -297,9 +433,62 @@ func (r *Registry) Get(ctx context.Context, clientID string) (*ClientRegistratio
 		return registration, true
 	}
 
+	if !strings.HasPrefix(clientID, DynamicStatelessClientIDPrefix) {
+		return nil, false
+	}
+
 	return r.getDynamicClient(clientID)
 }
 
+// Count returns the number of clients registered at the accociated registry.
+// Dynamic clients are stateless and thus not counted.
+func (r *Registry) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.clients)
+}
+
+// Clients returns the clients registered at the accociated registry ordered
+// by their ID. Dynamic clients are stateless and thus not included.
+func (r *Registry) Clients() []*ClientRegistration {
+	r.mutex.RLock()
+	registrations := make([]*ClientRegistration, 0, len(r.clients))
+	for _, registration := range r.clients {
+		registrations = append(registrations, registration)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].ID < registrations[j].ID
+	})
+	return registrations
+}
+
+// StaticClaims returns the static claims of the client with the provided
+// client ID merged with the static claims of the provided subject, where the
+// claims of the subject take precedence. Returns nil if there are none.
+func (r *Registry) StaticClaims(ctx context.Context, clientID string, subject string) map[string]interface{} {
+	var clientClaims map[string]interface{}
+	if registration, _ := r.Get(ctx, clientID); registration != nil {
+		clientClaims = registration.StaticClaims
+	}
+	subjectClaims := r.subjectStaticClaims[subject]
+	if len(clientClaims) == 0 && len(subjectClaims) == 0 {
+		return nil
+	}
+
+	claims := make(map[string]interface{}, len(clientClaims)+len(subjectClaims))
+	for claim, value := range clientClaims {
+		claims[claim] = value
+	}
+	for claim, value := range subjectClaims {
+		claims[claim] = value
+	}
+
+	return claims
+}
+
 func (r *Registry) getDynamicClient(clientID string) (*ClientRegistration, bool) {
 	var registration *ClientRegistration
 
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRegistryMaxClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	registry, err := NewRegistry(ctx, nil, "", 2, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"client-a", "client-b"} {
+		if err = registry.Register(&ClientRegistration{ID: id, Insecure: true}); err != nil {
+			t.Fatalf("failed to register %s: %v", id, err)
+		}
+	}
+	if err = registry.Register(&ClientRegistration{ID: "client-c", Insecure: true}); err == nil {
+		t.Errorf("registered client beyond maximum")
+	}
+	if _, ok := registry.Get(ctx, "client-c"); ok {
+		t.Errorf("client beyond maximum is registered")
+	}
+	if err = registry.Register(&ClientRegistration{ID: "client-a", Insecure: true}); err != nil {
+		t.Errorf("failed to register client again: %v", err)
+	}
+}
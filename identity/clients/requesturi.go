@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+const (
+	requestURITimeout      = 10 * time.Second
+	requestURIMaxRedirects = 3
+	requestURISizeLimit    = 64 * 1024
+)
+
+// validateRequestURIs validates the request_uris of the accociated client
+// registration. All request_uris must be absolute and use https, unless the
+// client is insecure.
+func (cr *ClientRegistration) validateRequestURIs() error {
+	for _, requestURI := range cr.RequestURIs {
+		u, err := url.Parse(requestURI)
+		if err != nil || u.Host == "" {
+			return errors.New("request_uris must be absolute URIs")
+		}
+		if u.Scheme != "https" && !(cr.Insecure && u.Scheme == "http") {
+			return errors.New("request_uris must use https")
+		}
+	}
+
+	return nil
+}
+
+// HasRequestURI returns true if the provided request_uri is registered for
+// the accociated client registration. The fragment of the provided value is
+// ignored when the registered value has none, as clients use it to reference
+// a specific version of the request object as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#RequestUriParameter.
+func (cr *ClientRegistration) HasRequestURI(requestURI string) bool {
+	u, err := url.Parse(requestURI)
+	if err != nil {
+		return false
+	}
+	withoutFragment := *u
+	withoutFragment.Fragment = ""
+
+	for _, registered := range cr.RequestURIs {
+		if registered == requestURI || registered == withoutFragment.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FetchRequestObject fetches the request object referenced by the provided
+// request_uri for the provided client registration. The request_uri must be
+// registered for the client. Responses larger than sizeLimit are rejected, a
+// sizeLimit of zero or less uses a default limit. Redirects must use https
+// and must not point to internal addresses. Request objects of dynamic
+// clients must not be fetched from internal addresses at all.
+func (r *Registry) FetchRequestObject(ctx context.Context, client *ClientRegistration, requestURI string, sizeLimit int) (string, error) {
+	if !client.HasRequestURI(requestURI) {
+		return "", errors.New("request_uri is not registered for client")
+	}
+	if sizeLimit <= 0 {
+		sizeLimit = requestURISizeLimit
+	}
+
+	parsed, err := url.Parse(requestURI)
+	if err != nil {
+		return "", errors.New("invalid request_uri")
+	}
+	parsed.Fragment = ""
+	if client.Dynamic {
+		if err = checkPublicHost(ctx, parsed.Hostname()); err != nil {
+			return "", err
+		}
+	}
+
+	httpClient := &http.Client{
+		Timeout:   requestURITimeout,
+		Transport: newOutboundTransport(client, parsed.Host),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= requestURIMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "https" && !(client.Insecure && req.URL.Scheme == "http") {
+				return errors.New("redirect must use https")
+			}
+			return checkPublicHost(req.Context(), req.URL.Hostname())
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/oauth-authz-req+jwt, application/jwt")
+	req.Header.Set("User-Agent", utils.DefaultHTTPUserAgent)
+
+	response, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch request_uri: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch request_uri: unexpected status %d", response.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, int64(sizeLimit)+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read request_uri: %v", err)
+	}
+	if len(body) > sizeLimit {
+		return "", errors.New("request_uri response is too large")
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return "", errors.New("request_uri response is empty")
+	}
+
+	return string(body), nil
+}
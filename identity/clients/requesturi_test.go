@@ -0,0 +1,85 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package clients
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRegistryFetchRequestObject(t *testing.T) {
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request.jwt", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/oauth-authz-req+jwt")
+		rw.Write([]byte("unittest.request.object\n"))
+	})
+	mux.HandleFunc("/large.jwt", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(strings.Repeat("r", 128)))
+	})
+	mux.HandleFunc("/redirect.jwt", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/request.jwt", http.StatusFound)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	r := &Registry{
+		logger: logrus.New(),
+	}
+	client := &ClientRegistration{
+		ID:          "client-with-request-uris",
+		Insecure:    true,
+		RequestURIs: []string{s.URL + "/request.jwt", s.URL + "/large.jwt", s.URL + "/redirect.jwt"},
+	}
+	if err := client.validateRequestURIs(); err != nil {
+		t.Fatalf("unexpected request_uris validation error: %v", err)
+	}
+
+	request, err := r.FetchRequestObject(ctx, client, s.URL+"/request.jwt#v1", 0)
+	if err != nil || request != "unittest.request.object" {
+		t.Fatalf("unexpected fetch result: %v %v", request, err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		requestURI string
+	}{
+		{"unregistered", s.URL + "/other.jwt"},
+		{"too large", s.URL + "/large.jwt"},
+		{"redirect to internal address", s.URL + "/redirect.jwt"},
+	} {
+		if _, err = r.FetchRequestObject(ctx, client, test.requestURI, 64); err == nil {
+			t.Errorf("%s: expected fetch error", test.name)
+		}
+	}
+
+	client.Dynamic = true
+	if _, err = r.FetchRequestObject(ctx, client, s.URL+"/request.jwt", 0); err == nil {
+		t.Error("expected fetch error for dynamic client with internal request_uri")
+	}
+
+	client.Insecure = false
+	if err = client.validateRequestURIs(); err == nil {
+		t.Error("expected request_uris validation error for http without insecure")
+	}
+}
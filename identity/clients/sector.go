@@ -0,0 +1,186 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+const (
+	sectorIdentifierCacheDuration = 1 * time.Hour
+	sectorIdentifierSizeLimit     = 64 * 1024
+)
+
+type sectorIdentifierRecord struct {
+	redirectURIs map[string]bool
+	expires      time.Time
+}
+
+// ValidateSectorIdentifier validates the provided client registration's
+// sector_identifier_uri and subject type as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg. When a
+// sector_identifier_uri is set, its JSON document is fetched (or taken from
+// cache) and all of the client's redirect URIs must be listed in it. Pairwise
+// clients without sector_identifier_uri must use a single redirect URI host.
+func (r *Registry) ValidateSectorIdentifier(ctx context.Context, client *ClientRegistration) error {
+	if client.SectorIdentifierURI != "" {
+		redirectURIs, err := r.getSectorIdentifierRedirectURIs(ctx, client.SectorIdentifierURI)
+		if err != nil {
+			return err
+		}
+		for _, redirectURI := range client.RedirectURIs {
+			if !redirectURIs[redirectURI] {
+				return fmt.Errorf("redirect_uri %v is not listed in sector_identifier_uri", redirectURI)
+			}
+		}
+
+		return nil
+	}
+
+	if client.SubjectType == konnectoidc.SubjectIDPairwise {
+		host := ""
+		for _, redirectURI := range client.RedirectURIs {
+			parsed, err := url.Parse(redirectURI)
+			if err != nil {
+				return fmt.Errorf("invalid redirect_uri %v", redirectURI)
+			}
+			if host != "" && parsed.Host != host {
+				return errors.New("sector_identifier_uri is required for pairwise clients with redirect_uris on multiple hosts")
+			}
+			host = parsed.Host
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) getSectorIdentifierRedirectURIs(ctx context.Context, sectorIdentifierURI string) (map[string]bool, error) {
+	r.sectorIdentifiersMutex.Lock()
+	record, ok := r.sectorIdentifiers[sectorIdentifierURI]
+	r.sectorIdentifiersMutex.Unlock()
+	if ok && record.expires.After(time.Now()) {
+		return record.redirectURIs, nil
+	}
+
+	redirectURIs, err := fetchSectorIdentifierRedirectURIs(ctx, sectorIdentifierURI)
+	if err != nil {
+		return nil, err
+	}
+
+	r.sectorIdentifiersMutex.Lock()
+	if r.sectorIdentifiers == nil {
+		r.sectorIdentifiers = make(map[string]*sectorIdentifierRecord)
+	}
+	now := time.Now()
+	for uri, record := range r.sectorIdentifiers {
+		if !record.expires.After(now) {
+			delete(r.sectorIdentifiers, uri)
+		}
+	}
+	r.sectorIdentifiers[sectorIdentifierURI] = &sectorIdentifierRecord{
+		redirectURIs: redirectURIs,
+		expires:      now.Add(sectorIdentifierCacheDuration),
+	}
+	r.sectorIdentifiersMutex.Unlock()
+
+	return redirectURIs, nil
+}
+
+func fetchSectorIdentifierRedirectURIs(ctx context.Context, sectorIdentifierURI string) (map[string]bool, error) {
+	parsed, err := url.Parse(sectorIdentifierURI)
+	if err != nil || parsed.Host == "" {
+		return nil, errors.New("invalid sector_identifier_uri")
+	}
+	if parsed.Scheme != "https" {
+		return nil, errors.New("sector_identifier_uri must use https")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", utils.DefaultHTTPUserAgent)
+
+	response, err := utils.DefaultHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sector_identifier_uri: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch sector_identifier_uri: unexpected status %d", response.StatusCode)
+	}
+
+	var values []string
+	if err = json.NewDecoder(io.LimitReader(response.Body, sectorIdentifierSizeLimit)).Decode(&values); err != nil {
+		return nil, fmt.Errorf("failed to decode sector_identifier_uri document: %v", err)
+	}
+
+	redirectURIs := make(map[string]bool)
+	for _, value := range values {
+		redirectURIs[value] = true
+	}
+
+	return redirectURIs, nil
+}
+
+// SectorIdentifier returns the host which identifies the sector of the
+// accociated client registration for pairwise subjects. This is the host of
+// the sector_identifier_uri if set, or the host of the first redirect URI.
+func (cr *ClientRegistration) SectorIdentifier() string {
+	if cr.SectorIdentifierURI != "" {
+		if parsed, err := url.Parse(cr.SectorIdentifierURI); err == nil {
+			return parsed.Host
+		}
+	}
+	for _, redirectURI := range cr.RedirectURIs {
+		if parsed, err := url.Parse(redirectURI); err == nil {
+			return parsed.Host
+		}
+	}
+
+	return ""
+}
+
+// UsesPairwiseSubject returns true if the accociated client registration
+// uses pairwise subject identifiers.
+func (cr *ClientRegistration) UsesPairwiseSubject() bool {
+	return cr.SubjectType == konnectoidc.SubjectIDPairwise
+}
+
+func validateSubjectType(subjectType string) error {
+	switch subjectType {
+	case "", oidc.SubjectIDPublic, konnectoidc.SubjectIDPairwise:
+		return nil
+	default:
+		return fmt.Errorf("unsupported subject_type: %v", subjectType)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package clients
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+func TestRegistryValidateSectorIdentifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	fetches := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetches++
+		switch req.URL.Path {
+		case "/sector.json":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(`["https://a.example.com/cb","https://b.example.com/cb"]`))
+		case "/invalid.json":
+			rw.Write([]byte(`{"redirect_uris":[]}`))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	defaultHTTPClient := utils.DefaultHTTPClient
+	utils.DefaultHTTPClient = server.Client()
+	defer func() {
+		utils.DefaultHTTPClient = defaultHTTPClient
+	}()
+
+	registry, err := NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		client *ClientRegistration
+		valid  bool
+	}{
+		{"public single host", &ClientRegistration{RedirectURIs: []string{"https://a.example.com/cb"}}, true},
+		{"public multiple hosts", &ClientRegistration{RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}, true},
+		{"pairwise single host", &ClientRegistration{SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://a.example.com/cb", "https://a.example.com/other"}}, true},
+		{"pairwise multiple hosts", &ClientRegistration{SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}, false},
+		{"sector listed", &ClientRegistration{SubjectType: konnectoidc.SubjectIDPairwise, SectorIdentifierURI: server.URL + "/sector.json", RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}, true},
+		{"sector not listed", &ClientRegistration{SubjectType: konnectoidc.SubjectIDPairwise, SectorIdentifierURI: server.URL + "/sector.json", RedirectURIs: []string{"https://c.example.com/cb"}}, false},
+		{"sector not found", &ClientRegistration{SectorIdentifierURI: server.URL + "/missing.json", RedirectURIs: []string{"https://a.example.com/cb"}}, false},
+		{"sector invalid document", &ClientRegistration{SectorIdentifierURI: server.URL + "/invalid.json", RedirectURIs: []string{"https://a.example.com/cb"}}, false},
+		{"sector without https", &ClientRegistration{SectorIdentifierURI: "http://sector.example.com/sector.json", RedirectURIs: []string{"https://a.example.com/cb"}}, false},
+		{"sector invalid uri", &ClientRegistration{SectorIdentifierURI: "sector.json", RedirectURIs: []string{"https://a.example.com/cb"}}, false},
+	} {
+		err := registry.ValidateSectorIdentifier(ctx, test.client)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+		}
+	}
+
+	// Sector documents are cached.
+	fetches = 0
+	client := &ClientRegistration{SectorIdentifierURI: server.URL + "/sector.json", RedirectURIs: []string{"https://b.example.com/cb"}}
+	if err = registry.ValidateSectorIdentifier(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 0 {
+		t.Errorf("cached sector document was fetched again")
+	}
+	registry.sectorIdentifiersMutex.Lock()
+	registry.sectorIdentifiers[client.SectorIdentifierURI].expires = time.Now().Add(-time.Second)
+	registry.sectorIdentifiersMutex.Unlock()
+	if err = registry.ValidateSectorIdentifier(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Errorf("expired sector document was not fetched again: %d", fetches)
+	}
+}
+
+func TestClientRegistrationSectorIdentifier(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		client   *ClientRegistration
+		expected string
+	}{
+		{"none", &ClientRegistration{}, ""},
+		{"redirect uri", &ClientRegistration{RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}, "a.example.com"},
+		{"sector identifier uri", &ClientRegistration{SectorIdentifierURI: "https://sector.example.com/sector.json", RedirectURIs: []string{"https://a.example.com/cb"}}, "sector.example.com"},
+	} {
+		if sectorIdentifier := test.client.SectorIdentifier(); sectorIdentifier != test.expected {
+			t.Errorf("%s: got %#v want %#v", test.name, sectorIdentifier, test.expected)
+		}
+	}
+}
+
+func TestValidateSubjectType(t *testing.T) {
+	for _, test := range []struct {
+		subjectType string
+		valid       bool
+	}{
+		{"", true},
+		{"public", true},
+		{konnectoidc.SubjectIDPairwise, true},
+		{"unknown", false},
+	} {
+		if valid := validateSubjectType(test.subjectType) == nil; valid != test.valid {
+			t.Errorf("%#v: got valid %v want %v", test.subjectType, valid, test.valid)
+		}
+	}
+}
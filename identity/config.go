@@ -30,5 +30,21 @@ type Config struct {
 
 	ScopesSupported []string
 
+	// ProfileClaimsMapping maps profile claims to the user profile attributes
+	// they are populated from. If nil, DefaultProfileClaimsMapping is used.
+	ProfileClaimsMapping map[string]string
+
+	// ScopeClaimsResolver resolves the claims released for granted scopes. If
+	// nil, a StaticScopeClaimsResolver with ProfileClaimsMapping is used.
+	ScopeClaimsResolver ScopeClaimsResolver
+
+	// SubjectAttribute selects the user attribute the local subject is
+	// derived from. If empty, the user's subject is used.
+	SubjectAttribute string
+
+	// ACRPolicies define the authentication requirements of the supported
+	// authentication context class references.
+	ACRPolicies ACRPolicies
+
 	Logger logrus.FieldLogger
 }
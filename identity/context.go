@@ -30,6 +30,9 @@ type key int
 // instead of using this key directly.
 var authRecordKey key
 
+// clientIDKey is the key for the client ID of the request in Contexts.
+var clientIDKey key = 1
+
 // NewContext returns a new Context that carries value auth.
 func NewContext(ctx context.Context, auth AuthRecord) context.Context {
 	return context.WithValue(ctx, authRecordKey, auth)
@@ -40,3 +43,15 @@ func FromContext(ctx context.Context) (AuthRecord, bool) {
 	auth, ok := ctx.Value(authRecordKey).(AuthRecord)
 	return auth, ok
 }
+
+// NewClientIDContext returns a new Context that carries the provided client
+// ID, the client for which claims are assembled.
+func NewClientIDContext(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, clientIDKey, clientID)
+}
+
+// ClientIDFromContext returns the client ID value stored in ctx, if any.
+func ClientIDFromContext(ctx context.Context) (string, bool) {
+	clientID, ok := ctx.Value(clientIDKey).(string)
+	return clientID, ok
+}
@@ -46,3 +46,24 @@ type Manager interface {
 	OnSetLogon(func(ctx context.Context, rw http.ResponseWriter, user User) error) error
 	OnUnsetLogon(func(ctx context.Context, rw http.ResponseWriter) error) error
 }
+
+// ManagerWithACRValues is a Manager which enforces the authentication
+// requirements of the authentication context class references it supports.
+type ManagerWithACRValues interface {
+	Manager
+	ACRValuesSupported() []string
+}
+
+// ManagerWithDisplayValues is a Manager which adapts its sign-in user
+// interface to the display values it supports.
+type ManagerWithDisplayValues interface {
+	Manager
+	DisplayValuesSupported() []string
+}
+
+// ManagerWithScopesReload is a Manager which supports replacing its scopes
+// configuration at runtime.
+type ManagerWithScopesReload interface {
+	Manager
+	ReloadScopes() error
+}
@@ -36,6 +36,7 @@ import (
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identity"
 	"stash.kopano.io/kc/konnect/managers"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/payload"
 	"stash.kopano.io/kc/konnect/version"
 )
@@ -50,6 +51,9 @@ type CookieIdentityManager struct {
 
 	scopesSupported []string
 
+	profileClaimsMapping map[string]string
+	scopeClaimsResolver  identity.ScopeClaimsResolver
+
 	signInFormURI string
 	logger        logrus.FieldLogger
 
@@ -92,6 +96,9 @@ func NewCookieIdentityManager(c *identity.Config, backendURI *url.URL, cookieNam
 			oidc.ScopeEmail,
 			konnect.ScopeID,
 		}, nil, c.ScopesSupported),
+
+		profileClaimsMapping: c.ProfileClaimsMapping,
+		scopeClaimsResolver:  c.ScopeClaimsResolver,
 	}
 
 	return im
@@ -332,7 +339,7 @@ func (im *CookieIdentityManager) Authorize(ctx context.Context, rw http.Response
 
 	if promptConsent {
 		if ar.Prompts[oidc.PromptNone] == true {
-			return auth, ar.NewError(oidc.ErrorCodeOIDCInteractionRequired, "consent required")
+			return auth, ar.NewError(konnectoidc.ErrorCodeOIDCConsentRequired, "consent required")
 		}
 
 		// TODO(longsleep): Implement permissions page / consent prompt.
@@ -426,7 +433,7 @@ func (im *CookieIdentityManager) Fetch(ctx context.Context, userID string, sessi
 	}
 
 	authorizedScopes, _ := identity.AuthorizeScopes(im, user, scopes)
-	claims := identity.GetUserClaimsForScopes(user, authorizedScopes, requestedClaimsMaps)
+	claims := identity.ResolveScopeClaims(ctx, im.scopeClaimsResolver, user, authorizedScopes, requestedClaimsMaps, im.profileClaimsMapping)
 
 	auth = identity.NewAuthRecord(im, user.Subject(), authorizedScopes, nil, claims)
 	auth.SetUser(user)
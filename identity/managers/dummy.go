@@ -30,7 +30,7 @@ import (
 
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identity"
-
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/payload"
 )
 
@@ -42,6 +42,9 @@ type DummyIdentityManager struct {
 	sub string
 
 	scopesSupported []string
+
+	profileClaimsMapping map[string]string
+	scopeClaimsResolver  identity.ScopeClaimsResolver
 }
 
 // NewDummyIdentityManager creates a new DummyIdentityManager from the
@@ -54,6 +57,9 @@ func NewDummyIdentityManager(c *identity.Config, sub string) *DummyIdentityManag
 			oidc.ScopeProfile,
 			oidc.ScopeEmail,
 		}, nil, c.ScopesSupported),
+
+		profileClaimsMapping: c.ProfileClaimsMapping,
+		scopeClaimsResolver:  c.ScopeClaimsResolver,
 	}
 
 	return im
@@ -139,7 +145,7 @@ func (im *DummyIdentityManager) Authorize(ctx context.Context, rw http.ResponseW
 
 	if promptConsent {
 		if ar.Prompts[oidc.PromptNone] == true {
-			return auth, ar.NewError(oidc.ErrorCodeOIDCInteractionRequired, "consent required")
+			return auth, ar.NewError(konnectoidc.ErrorCodeOIDCConsentRequired, "consent required")
 		}
 
 		// TODO(longsleep): Implement consent page.
@@ -189,7 +195,7 @@ func (im *DummyIdentityManager) Fetch(ctx context.Context, userID string, sessio
 	user := &dummyUser{im.sub}
 
 	authorizedScopes, _ := identity.AuthorizeScopes(im, user, scopes)
-	claims := identity.GetUserClaimsForScopes(user, authorizedScopes, requestedClaimsMaps)
+	claims := identity.ResolveScopeClaims(ctx, im.scopeClaimsResolver, user, authorizedScopes, requestedClaimsMaps, im.profileClaimsMapping)
 
 	return identity.NewAuthRecord(im, user.Subject(), authorizedScopes, nil, claims), true, nil
 }
@@ -32,6 +32,7 @@ import (
 	"stash.kopano.io/kc/konnect/identity"
 	"stash.kopano.io/kc/konnect/identity/clients"
 	"stash.kopano.io/kc/konnect/managers"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/payload"
 	"stash.kopano.io/kc/konnect/utils"
 )
@@ -43,6 +44,9 @@ type GuestIdentityManager struct {
 	scopesSupported []string
 	claimsSupported []string
 
+	profileClaimsMapping map[string]string
+	scopeClaimsResolver  identity.ScopeClaimsResolver
+
 	logger  logrus.FieldLogger
 	clients *clients.Registry
 
@@ -67,6 +71,9 @@ func NewGuestIdentityManager(c *identity.Config) *GuestIdentityManager {
 			oidc.EmailVerifiedClaim,
 		},
 
+		profileClaimsMapping: c.ProfileClaimsMapping,
+		scopeClaimsResolver:  c.ScopeClaimsResolver,
+
 		logger: c.Logger,
 
 		onSetLogonCallbacks:   make([]func(ctx context.Context, rw http.ResponseWriter, user identity.User) error, 0),
@@ -318,7 +325,7 @@ func (im *GuestIdentityManager) Authorize(ctx context.Context, rw http.ResponseW
 
 	if promptConsent {
 		if ar.Prompts[oidc.PromptNone] == true {
-			return auth, ar.NewError(oidc.ErrorCodeOIDCInteractionRequired, "consent required")
+			return auth, ar.NewError(konnectoidc.ErrorCodeOIDCConsentRequired, "consent required")
 		}
 
 		// TODO(longsleep): Implement consent page.
@@ -451,7 +458,7 @@ func (im *GuestIdentityManager) Fetch(ctx context.Context, userID string, sessio
 	}
 
 	authorizedScopes, _ := identity.AuthorizeScopes(im, user, scopes)
-	claims := identity.GetUserClaimsForScopes(user, authorizedScopes, requestedClaimsMaps)
+	claims := identity.ResolveScopeClaims(ctx, im.scopeClaimsResolver, user, authorizedScopes, requestedClaimsMaps, im.profileClaimsMapping)
 
 	auth := identity.NewAuthRecord(im, user.Subject(), authorizedScopes, nil, claims)
 	auth.SetUser(user)
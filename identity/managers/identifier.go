@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -44,8 +45,16 @@ type IdentifierIdentityManager struct {
 	signInFormURI string
 	signedOutURI  string
 
-	scopesSupported []string
-	claimsSupported []string
+	scopesSupported         []string
+	scopesSupportedOverride []string
+	claimsSupported         []string
+
+	profileClaimsMapping map[string]string
+	scopeClaimsResolver  identity.ScopeClaimsResolver
+	subjectAttribute     string
+	scopesMutex          sync.RWMutex
+
+	acrPolicies identity.ACRPolicies
 
 	identifier *identifier.Identifier
 	clients    *clients.Registry
@@ -54,6 +63,8 @@ type IdentifierIdentityManager struct {
 
 type identifierUser struct {
 	*identifier.IdentifiedUser
+
+	subjectValue string
 }
 
 func (u *identifierUser) Raw() string {
@@ -61,12 +72,32 @@ func (u *identifierUser) Raw() string {
 }
 
 func (u *identifierUser) Subject() string {
-	sub, _ := getPublicSubject([]byte(u.Raw()), []byte(u.IdentifiedUser.BackendName()))
+	sub, _ := getPublicSubject([]byte(u.subjectValue), []byte(u.IdentifiedUser.BackendName()))
 	return sub
 }
 
-func asIdentifierUser(user *identifier.IdentifiedUser) *identifierUser {
-	return &identifierUser{user}
+// asIdentifierUser wraps the provided user, deriving its public subject from
+// the configured subject attribute. Users from logon cookies only carry a
+// subset of their attributes, so the user is looked up at the backend if the
+// attribute is not available.
+func (im *IdentifierIdentityManager) asIdentifierUser(ctx context.Context, user *identifier.IdentifiedUser) (*identifierUser, error) {
+	value, err := identity.GetUserSubjectAttribute(user, im.subjectAttribute)
+	if err != nil && im.subjectAttribute != "" && im.subjectAttribute != identity.SubjectAttributeSubject {
+		var backendUser *identifier.IdentifiedUser
+		backendUser, err = im.identifier.GetUserFromID(ctx, user.Subject(), user.SessionRef())
+		if err == nil {
+			value, err = identity.GetUserSubjectAttribute(backendUser, im.subjectAttribute)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &identifierUser{
+		IdentifiedUser: user,
+
+		subjectValue: value,
+	}, nil
 }
 
 // NewIdentifierIdentityManager creates a new IdentifierIdentityManager from the provided
@@ -79,6 +110,7 @@ func NewIdentifierIdentityManager(c *identity.Config, i *identifier.Identifier)
 		scopesSupported: setupSupportedScopes([]string{
 			oidc.ScopeOfflineAccess,
 		}, i.ScopesSupported(), c.ScopesSupported),
+		scopesSupportedOverride: c.ScopesSupported,
 		claimsSupported: []string{
 			oidc.NameClaim,
 			oidc.FamilyNameClaim,
@@ -87,6 +119,12 @@ func NewIdentifierIdentityManager(c *identity.Config, i *identifier.Identifier)
 			oidc.EmailVerifiedClaim,
 		},
 
+		profileClaimsMapping: c.ProfileClaimsMapping,
+		scopeClaimsResolver:  c.ScopeClaimsResolver,
+		subjectAttribute:     c.SubjectAttribute,
+
+		acrPolicies: c.ACRPolicies,
+
 		identifier: i,
 		logger:     c.Logger,
 	}
@@ -105,6 +143,8 @@ func (im *IdentifierIdentityManager) RegisterManagers(mgrs *managers.Managers) e
 func (im *IdentifierIdentityManager) Authenticate(ctx context.Context, rw http.ResponseWriter, req *http.Request, ar *payload.AuthenticationRequest, next identity.Manager) (identity.AuthRecord, error) {
 	var user *identifierUser
 	var err error
+	var stepUp bool
+	var acr string
 
 	if authenticationErrorID := req.Form.Get("error"); authenticationErrorID != "" {
 		// Incoming with error. Directly abort and return.
@@ -114,7 +154,11 @@ func (im *IdentifierIdentityManager) Authenticate(ctx context.Context, rw http.R
 	u, _ := im.identifier.GetUserFromLogonCookie(ctx, req, ar.MaxAge, true)
 	if u != nil {
 		// TODO(longsleep): Add other user meta data.
-		user = asIdentifierUser(u)
+		user, err = im.asIdentifierUser(ctx, u)
+		if err != nil {
+			im.logger.WithError(err).Errorln("IdentifierIdentityManager: failed to get user subject")
+			return nil, ar.NewError(oidc.ErrorCodeOAuth2AccessDenied, "IdentifierIdentityManager: user has no subject")
+		}
 	} else {
 		// Not signed in.
 		if next != nil {
@@ -140,6 +184,28 @@ func (im *IdentifierIdentityManager) Authenticate(ctx context.Context, rw http.R
 		err = ar.NewError(oidc.ErrorCodeOIDCLoginRequired, "IdentifierIdentityManager: not signed in")
 	}
 
+	// Check requested authentication context class reference as specified at
+	// https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics.
+	if user != nil {
+		acr = user.ACR()
+		if acrValues, essential := ar.RequestedACRValues(); len(acrValues) > 0 {
+			_, logonAt := u.LoggedOn()
+			if satisfied, ok := satisfiedACR(im.acrPolicies, acrValues, user.ACR(), user.AMR(), user.AuthorityID(), logonAt); ok {
+				acr = satisfied
+			} else if ar.Prompts[oidc.PromptNone] == true {
+				if essential {
+					return nil, ar.NewError(konnectoidc.ErrorCodeOIDCUnmetAuthenticationRequirements, "IdentifierIdentityManager: requested acr not satisfied")
+				}
+				// NOTE: Voluntary acr values are best effort. Continue with the
+				// current sign-in, its acr gets reflected in the ID token.
+			} else {
+				// Enforce sign-in again, to step up authentication.
+				err = ar.NewError(oidc.ErrorCodeOIDCLoginRequired, "IdentifierIdentityManager: acr step-up required")
+				stepUp = true
+			}
+		}
+	}
+
 	// Check prompt value.
 	switch {
 	case ar.Prompts[oidc.PromptNone] == true:
@@ -180,6 +246,27 @@ func (im *IdentifierIdentityManager) Authenticate(ctx context.Context, rw http.R
 			return nil, err
 		}
 		query.Set("flow", identifier.FlowOIDC)
+		// NOTE: The login hint might come from a validated login_hint_token,
+		// which itself is never passed on to the sign-in form.
+		query.Del("login_hint_token")
+		if ar.LoginHint != "" {
+			query.Set("login_hint", ar.LoginHint)
+		}
+		if ar.Display != "" {
+			query.Set("display", ar.Display)
+		} else {
+			query.Del("display")
+		}
+		if stepUp && ar.Prompts[oidc.PromptLogin] != true {
+			// Ignore the current sign-in when stepping up.
+			query.Set("prompt", strings.TrimSpace(ar.RawPrompt+" "+oidc.PromptLogin))
+		}
+		if acrValues, _ := ar.RequestedACRValues(); len(acrValues) > 0 {
+			// Route the sign-in to the authority required by the requested acr.
+			if authorityID := acrAuthorityID(im.acrPolicies, acrValues); authorityID != "" {
+				query.Set("authority_id", authorityID)
+			}
+		}
 		if ar.Claims != nil {
 			// Add derived scope list from claims request.
 			claimsScopes := ar.Claims.Scopes(ar.Scopes)
@@ -194,15 +281,40 @@ func (im *IdentifierIdentityManager) Authenticate(ctx context.Context, rw http.R
 		return nil, &identity.IsHandledError{}
 	}
 
+	if !ar.Prompts[oidc.PromptNone] {
+		// NOTE: Only interactive use resets the session idle timeout, silent
+		// prompt=none checks must not keep sessions alive.
+		if touchErr := im.identifier.TouchLogonCookie(ctx, rw, u); touchErr != nil {
+			im.logger.WithError(touchErr).Warnln("IdentifierIdentityManager: failed to renew logon cookie")
+		}
+	}
+
 	auth := identity.NewAuthRecord(im, user.Subject(), nil, nil, nil)
 	auth.SetUser(user)
 	if loggedOn, logonAt := u.LoggedOn(); loggedOn {
 		auth.SetAuthTime(logonAt)
 	}
+	auth.SetACR(acr)
+	auth.SetAMR(user.AMR())
 
 	return auth, nil
 }
 
+// ACRValuesSupported implements the identity.ManagerWithACRValues interface.
+func (im *IdentifierIdentityManager) ACRValuesSupported() []string {
+	return im.acrPolicies.Values()
+}
+
+// DisplayValuesSupported implements the identity.ManagerWithDisplayValues
+// interface.
+func (im *IdentifierIdentityManager) DisplayValuesSupported() []string {
+	return []string{
+		konnectoidc.DisplayPage,
+		konnectoidc.DisplayPopup,
+		konnectoidc.DisplayTouch,
+	}
+}
+
 // Authorize implements the identity.Manager interface.
 func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.ResponseWriter, req *http.Request, ar *payload.AuthenticationRequest, auth identity.AuthRecord) (identity.AuthRecord, error) {
 	promptConsent := false
@@ -238,6 +350,21 @@ func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.Resp
 	if err != nil {
 		return nil, err
 	}
+	if consent != nil {
+		if consent.Remember {
+			if err = im.identifier.RememberConsent(req.Context(), auth.Subject(), ar.ClientID, consent); err != nil {
+				im.logger.WithError(err).Warnln("IdentifierIdentityManager: failed to remember consent")
+			}
+		}
+	} else if promptConsent && !ar.Prompts[oidc.PromptConsent] {
+		// Use remembered consent, if it allows all requested scopes.
+		remembered, rememberedErr := im.identifier.GetRememberedConsent(req.Context(), auth.Subject(), ar.ClientID)
+		if rememberedErr != nil {
+			im.logger.WithError(rememberedErr).Warnln("IdentifierIdentityManager: failed to get remembered consent")
+		} else if remembered != nil && remembered.Covers(im.requestedConsentScopes(ar)) {
+			consent = remembered
+		}
+	}
 	if consent != nil {
 		if !consent.Allow {
 			return auth, ar.NewError(oidc.ErrorCodeOAuth2AccessDenied, "consent denied")
@@ -250,7 +377,7 @@ func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.Resp
 		if ar.Claims != nil {
 			err = ar.Claims.ApplyScopes(allApprovedScopes)
 			if err != nil {
-				return nil, err
+				return auth, ar.NewError(oidc.ErrorCodeOAuth2AccessDenied, err.Error())
 			}
 		}
 
@@ -259,7 +386,7 @@ func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.Resp
 
 	if promptConsent {
 		if ar.Prompts[oidc.PromptNone] == true {
-			return auth, ar.NewError(oidc.ErrorCodeOIDCInteractionRequired, "consent required")
+			return auth, ar.NewError(konnectoidc.ErrorCodeOIDCConsentRequired, "consent required")
 		}
 
 		// Build consent URL.
@@ -268,6 +395,11 @@ func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.Resp
 			return nil, err
 		}
 		query.Set("flow", identifier.FlowConsent)
+		if ar.Display != "" {
+			query.Set("display", ar.Display)
+		} else {
+			query.Del("display")
+		}
 		if ar.Claims != nil {
 			// Add derived scope list from claims request.
 			claimsScopes := ar.Claims.Scopes(ar.Scopes)
@@ -325,18 +457,35 @@ func (im *IdentifierIdentityManager) Authorize(ctx context.Context, rw http.Resp
 	return auth, nil
 }
 
+// requestedConsentScopes returns the scopes which need consent for the
+// provided authentication request, including the scopes derived from its
+// claims request.
+func (im *IdentifierIdentityManager) requestedConsentScopes(ar *payload.AuthenticationRequest) map[string]bool {
+	if ar.Claims == nil {
+		return ar.Scopes
+	}
+
+	scopes := make(map[string]bool)
+	for scope, v := range ar.Scopes {
+		scopes[scope] = v
+	}
+	for _, scope := range ar.Claims.Scopes(ar.Scopes) {
+		scopes[scope] = true
+	}
+
+	return scopes
+}
+
 // EndSession implements the identity.Manager interface.
 func (im *IdentifierIdentityManager) EndSession(ctx context.Context, rw http.ResponseWriter, req *http.Request, esr *payload.EndSessionRequest) error {
-	// FIXME(longsleep): For now we always require the id_token_hint. Instead
-	// of fail we should treat is as unstrusted client.
-	if esr.IDTokenHint == nil {
+	// The client is identified by the id_token_hint or client_id.
+	if esr.ClientID == "" {
 		im.logger.Debugln("endsession request without id_token_hint")
 		return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint required")
 	}
 
 	origin := utils.OriginFromRequestHeaders(req.Header)
-	claims := esr.IDTokenHint.Claims.(*konnectoidc.IDTokenClaims)
-	clientDetails, err := im.clients.Lookup(ctx, claims.Audience, "", esr.PostLogoutRedirectURI, origin, true)
+	clientDetails, err := im.clients.LookupForEndSession(ctx, esr.ClientID, esr.PostLogoutRedirectURI, origin)
 	if err != nil {
 		// FIXME(longsleep): This error should no be fatal since according to
 		// the spec in https://openid.net/specs/openid-connect-session-1_0.html#RPLogout the
@@ -349,7 +498,11 @@ func (im *IdentifierIdentityManager) EndSession(ctx context.Context, rw http.Res
 	var user *identifierUser
 	u, _ := im.identifier.GetUserFromLogonCookie(ctx, req, 0, false)
 	if u != nil {
-		user = asIdentifierUser(u)
+		user, err = im.asIdentifierUser(ctx, u)
+		if err != nil {
+			im.logger.WithError(err).Errorln("IdentifierIdentityManager: failed to get user subject for end session")
+			return esr.NewBadRequest(oidc.ErrorCodeOAuth2AccessDenied, "user has no subject")
+		}
 	} else {
 		// Ignore when not signed in, for end session.
 	}
@@ -366,7 +519,11 @@ func (im *IdentifierIdentityManager) EndSession(ctx context.Context, rw http.Res
 		}
 	}
 
-	if clientDetails.Trusted {
+	// NOTE: Without id_token_hint the request can be made by anyone, thus the
+	// client is treated as untrusted.
+	trusted := clientDetails.Trusted && esr.IDTokenHint != nil
+
+	if trusted {
 		// Directly clear identifier session when a trusted client requests it.
 		err = im.identifier.UnsetLogonCookie(ctx, u, rw)
 		if err != nil {
@@ -375,7 +532,7 @@ func (im *IdentifierIdentityManager) EndSession(ctx context.Context, rw http.Res
 		}
 	}
 
-	if !clientDetails.Trusted || esr.PostLogoutRedirectURI == nil || esr.PostLogoutRedirectURI.String() == "" {
+	if !trusted || esr.PostLogoutRedirectURI == nil || esr.PostLogoutRedirectURI.String() == "" {
 		// Handle directly.by redirecting to our logout confirm url for untrusted
 		// clients or when no URL was set.
 		u, _ := url.Parse(im.signedOutURI)
@@ -415,9 +572,16 @@ func (im *IdentifierIdentityManager) Fetch(ctx context.Context, userID string, s
 		return nil, false, fmt.Errorf("IdentifierIdentityManager: no user")
 	}
 
-	user := asIdentifierUser(u)
+	user, err := im.asIdentifierUser(ctx, u)
+	if err != nil {
+		im.logger.WithError(err).Errorln("IdentifierIdentityManager: fetch failed to get user subject")
+		return nil, false, fmt.Errorf("IdentifierIdentityManager: no subject")
+	}
 	authorizedScopes, _ := identity.AuthorizeScopes(im, user, scopes)
-	claims := identity.GetUserClaimsForScopes(user, authorizedScopes, requestedClaimsMaps)
+	im.scopesMutex.RLock()
+	profileClaimsMapping := im.profileClaimsMapping
+	im.scopesMutex.RUnlock()
+	claims := identity.ResolveScopeClaims(ctx, im.scopeClaimsResolver, user, authorizedScopes, requestedClaimsMaps, profileClaimsMapping)
 
 	auth := identity.NewAuthRecord(im, user.Subject(), authorizedScopes, nil, claims)
 	auth.SetUser(user)
@@ -432,9 +596,39 @@ func (im *IdentifierIdentityManager) Name() string {
 
 // ScopesSupported implements the identity.Manager interface.
 func (im *IdentifierIdentityManager) ScopesSupported(scopes map[string]bool) []string {
+	im.scopesMutex.RLock()
+	defer im.scopesMutex.RUnlock()
+
 	return im.scopesSupported
 }
 
+// ReloadScopes implements the identity.ManagerWithScopesReload interface. The
+// scopes configuration file of the accociated identifier is loaded again and
+// replaces the current scope definitions, scope mappings and profile claims
+// mapping. If the scopes configuration is not valid, the current scopes
+// configuration is kept.
+func (im *IdentifierIdentityManager) ReloadScopes() error {
+	scopesMeta, err := im.identifier.LoadScopes()
+	if err != nil {
+		return err
+	}
+	profileClaimsMapping, err := identity.NewProfileClaimsMapping(scopesMeta.ProfileClaims)
+	if err != nil {
+		return fmt.Errorf("invalid profile_claims: %v", err)
+	}
+
+	im.scopesMutex.Lock()
+	defer im.scopesMutex.Unlock()
+
+	im.identifier.SetScopes(scopesMeta)
+	im.scopesSupported = setupSupportedScopes([]string{
+		oidc.ScopeOfflineAccess,
+	}, im.identifier.ScopesSupported(), im.scopesSupportedOverride)
+	im.profileClaimsMapping = profileClaimsMapping
+
+	return nil
+}
+
 // ClaimsSupported implements the identity.Manager interface.
 func (im *IdentifierIdentityManager) ClaimsSupported(claims []string) []string {
 	return im.claimsSupported
@@ -0,0 +1,269 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identifier"
+	"stash.kopano.io/kc/konnect/identifier/backends"
+	"stash.kopano.io/kc/konnect/identifier/meta/scopes"
+	"stash.kopano.io/kc/konnect/identity"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+type identifierTestBackend struct {
+	backends.Backend
+}
+
+func (b *identifierTestBackend) Name() string {
+	return "test"
+}
+
+func (b *identifierTestBackend) ScopesMeta() *scopes.Scopes {
+	return nil
+}
+
+func (b *identifierTestBackend) ScopesSupported() []string {
+	return nil
+}
+
+func (b *identifierTestBackend) RunWithContext(ctx context.Context) error {
+	return nil
+}
+
+func (b *identifierTestBackend) Logon(ctx context.Context, audience, username, password string) (bool, *string, *string, map[string]interface{}, error) {
+	if password != "secret" {
+		return false, nil, nil, nil, nil
+	}
+	subject := "sub-" + username
+	return true, &subject, nil, nil, nil
+}
+
+func newTestIdentifier(t *testing.T, tempDir string, scopesConf string) *identifier.Identifier {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "index.html"), []byte("<html></html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	baseURI, _ := url.Parse("https://konnect.example.com")
+	i, err := identifier.NewIdentifier(&identifier.Config{
+		Config: &config.Config{
+			Logger: logger,
+		},
+
+		BaseURI:         baseURI,
+		PathPrefix:      "/signin/v1",
+		StaticFolder:    tempDir,
+		LogonCookieName: "test-logon",
+		ScopesConf:      scopesConf,
+
+		Backend: &identifierTestBackend{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.SetKey(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func newTestIdentifierIdentityManager(i *identifier.Identifier, acrPolicies identity.ACRPolicies) *IdentifierIdentityManager {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	signInFormURI, _ := url.Parse("https://konnect.example.com/signin/v1/identifier")
+	signedOutURI, _ := url.Parse("https://konnect.example.com/signin/v1/goodbye")
+
+	return NewIdentifierIdentityManager(&identity.Config{
+		SignInFormURI: signInFormURI,
+		SignedOutURI:  signedOutURI,
+
+		ACRPolicies: acrPolicies,
+
+		Logger: logger,
+	}, i)
+}
+
+func TestIdentifierIdentityManagerReloadScopes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "konnect-identifier-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	scopesConf := filepath.Join(tempDir, "scopes.yaml")
+	writeScopesConf := func(data string) {
+		if writeErr := ioutil.WriteFile(scopesConf, []byte(data), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	writeScopesConf("scopes:\n  scope-a:\n    title: A\n")
+
+	i := newTestIdentifier(t, tempDir, scopesConf)
+	im := newTestIdentifierIdentityManager(i, nil)
+
+	if !utils.ContainsString(im.ScopesSupported(nil), "scope-a") {
+		t.Fatalf("initial scope missing: %v", im.ScopesSupported(nil))
+	}
+
+	for _, test := range []struct {
+		name     string
+		conf     string
+		valid    bool
+		expected string
+		removed  string
+		claims   map[string]string
+	}{
+		{"replaced", "scopes:\n  scope-b:\n    title: B\nprofile_claims:\n  name: username\n", true, "scope-b", "scope-a", map[string]string{"name": identity.ProfileAttributeUsername}},
+		{"invalid yaml", "scopes: [\n", false, "scope-b", "scope-a", map[string]string{"name": identity.ProfileAttributeUsername}},
+		{"invalid profile claims", "scopes:\n  scope-c:\n    title: C\nprofile_claims:\n  unknown: name\n", false, "scope-b", "scope-c", map[string]string{"name": identity.ProfileAttributeUsername}},
+	} {
+		writeScopesConf(test.conf)
+
+		err = im.ReloadScopes()
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+		}
+		supported := im.ScopesSupported(nil)
+		if !utils.ContainsString(supported, test.expected) || utils.ContainsString(supported, test.removed) {
+			t.Errorf("%s: unexpected supported scopes: %v", test.name, supported)
+		}
+		if !utils.ContainsString(i.ScopesSupported(), test.expected) {
+			t.Errorf("%s: unexpected identifier scopes: %v", test.name, i.ScopesSupported())
+		}
+		for claim, attribute := range test.claims {
+			if im.profileClaimsMapping[claim] != attribute {
+				t.Errorf("%s: got profile attribute %v for %v want %v", test.name, im.profileClaimsMapping[claim], claim, attribute)
+			}
+		}
+	}
+}
+
+func TestIdentifierIdentityManagerACRStepUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir("", "konnect-identifier-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	i := newTestIdentifier(t, tempDir, "")
+	im := newTestIdentifierIdentityManager(i, identity.ACRPolicies{
+		"urn:example:recent": &identity.ACRPolicy{ACR: "urn:example:recent", MaxAge: 3600},
+		"urn:example:mfa":    &identity.ACRPolicy{ACR: "urn:example:mfa", Authority: "mfa-idp"},
+	})
+
+	// Sign in with username and password, to get a logon cookie.
+	router := mux.NewRouter()
+	i.AddRoutes(ctx, router)
+	logonReq := httptest.NewRequest(http.MethodPost, "https://konnect.example.com/signin/v1/identifier/_/logon", strings.NewReader(`{"params":["user1","secret","1"]}`))
+	logonReq.Header.Set("Kopano-Konnect-XSRF", "1")
+	logonReq.Header.Set("Origin", "https://konnect.example.com")
+	logonReq.Header.Set("Content-Type", "application/json")
+	logonRR := httptest.NewRecorder()
+	router.ServeHTTP(logonRR, logonReq)
+	cookies := logonRR.Result().Cookies()
+	if logonRR.Code != http.StatusOK || len(cookies) == 0 {
+		t.Fatalf("logon failed: %v %v", logonRR.Code, logonRR.Body.String())
+	}
+
+	for _, test := range []struct {
+		name      string
+		params    url.Values
+		acr       string
+		redirect  bool
+		prompt    string
+		authority string
+		errorID   string
+	}{
+		{"without acr", url.Values{}, "", false, "", "", ""},
+		{"satisfied acr", url.Values{"acr_values": {"urn:example:recent"}}, "urn:example:recent", false, "", "", ""},
+		{"preferred satisfied acr", url.Values{"acr_values": {"urn:example:mfa urn:example:recent"}}, "urn:example:recent", false, "", "", ""},
+		{"step-up", url.Values{"acr_values": {"urn:example:mfa"}}, "", true, "login", "mfa-idp", ""},
+		{"step-up with prompt", url.Values{"acr_values": {"urn:example:mfa"}, "prompt": {"consent"}}, "", true, "consent login", "mfa-idp", ""},
+		{"step-up without policy", url.Values{"acr_values": {"urn:example:unknown"}}, "", true, "login", "", ""},
+		{"voluntary without prompt", url.Values{"acr_values": {"urn:example:mfa"}, "prompt": {"none"}}, "", false, "", "", ""},
+		{"essential without prompt", url.Values{"claims": {`{"id_token":{"acr":{"essential":true,"values":["urn:example:mfa"]}}}`}, "prompt": {"none"}}, "", false, "", "", "unmet_authentication_requirements"},
+		{"essential satisfied", url.Values{"claims": {`{"id_token":{"acr":{"essential":true,"value":"urn:example:recent"}}}`}, "prompt": {"none"}}, "urn:example:recent", false, "", "", ""},
+	} {
+		values := url.Values{
+			"scope":         {"openid"},
+			"response_type": {"id_token"},
+			"client_id":     {"client"},
+			"redirect_uri":  {"https://client.example.com/cb"},
+			"nonce":         {"nonce"},
+		}
+		for key, value := range test.params {
+			values[key] = value
+		}
+		ar, err := payload.NewAuthenticationRequest(values, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://konnect.example.com/konnect/v1/authorize?"+values.Encode(), nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+
+		auth, err := im.Authenticate(ctx, rr, req, ar, nil)
+		switch {
+		case test.errorID != "":
+			if authErr, ok := err.(*payload.AuthenticationError); !ok || authErr.ErrorID != test.errorID {
+				t.Errorf("%s: got error %v want %v", test.name, err, test.errorID)
+			}
+			continue
+		case test.redirect:
+			if _, ok := err.(*identity.IsHandledError); !ok || rr.Code != http.StatusFound {
+				t.Errorf("%s: expected sign-in redirect, got %v %v", test.name, rr.Code, err)
+				continue
+			}
+			location, _ := url.Parse(rr.Header().Get("Location"))
+			query := location.Query()
+			if query.Get("prompt") != test.prompt || query.Get("authority_id") != test.authority {
+				t.Errorf("%s: got prompt %#v authority_id %#v want %#v %#v", test.name, query.Get("prompt"), query.Get("authority_id"), test.prompt, test.authority)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if auth.ACR() != test.acr {
+			t.Errorf("%s: got acr %#v want %#v", test.name, auth.ACR(), test.acr)
+		}
+	}
+}
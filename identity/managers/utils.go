@@ -19,9 +19,11 @@ package managers
 
 import (
 	"encoding/base64"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 
+	"stash.kopano.io/kc/konnect/identity"
 	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 )
 
@@ -49,3 +51,50 @@ func getPublicSubject(sub []byte, extra []byte) (string, error) {
 	s := base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
 	return s + "@konnect", nil
 }
+
+func containsACR(acrValues []string, acr string) bool {
+	if acr == "" {
+		return false
+	}
+	for _, v := range acrValues {
+		if v == acr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// satisfiedACR returns the first of the provided acr values which is satisfied
+// by a sign-in with the provided acr, authentication methods references,
+// authority ID and authentication time. Values with an ACR policy are
+// satisfied when the sign-in meets the policy, all other values only when they
+// match the acr of the sign-in.
+func satisfiedACR(policies identity.ACRPolicies, acrValues []string, acr string, amr []string, authorityID string, authTime time.Time) (string, bool) {
+	now := time.Now()
+	for _, v := range acrValues {
+		if policy, ok := policies[v]; ok {
+			if policy.IsSatisfied(authorityID, amr, authTime, now) {
+				return v, true
+			}
+			continue
+		}
+		if acr != "" && v == acr {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// acrAuthorityID returns the ID of the authority required by the ACR policy
+// of the first of the provided acr values which has one.
+func acrAuthorityID(policies identity.ACRPolicies, acrValues []string) string {
+	for _, v := range acrValues {
+		if policy, ok := policies[v]; ok && policy.Authority != "" {
+			return policy.Authority
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/konnect/identity"
+)
+
+func TestSatisfiedACR(t *testing.T) {
+	policies := identity.ACRPolicies{
+		"urn:example:recent": &identity.ACRPolicy{ACR: "urn:example:recent", MaxAge: 60},
+		"urn:example:mfa":    &identity.ACRPolicy{ACR: "urn:example:mfa", Authority: "mfa-idp", AMR: []string{"otp"}},
+	}
+	now := time.Now()
+
+	for _, test := range []struct {
+		name        string
+		acrValues   []string
+		acr         string
+		amr         []string
+		authorityID string
+		authTime    time.Time
+		expected    string
+		satisfied   bool
+	}{
+		{"no values", nil, "", nil, "", now, "", false},
+		{"recent", []string{"urn:example:recent"}, "", nil, "", now, "urn:example:recent", true},
+		{"too old", []string{"urn:example:recent"}, "", nil, "", now.Add(-2 * time.Minute), "", false},
+		{"unknown auth time", []string{"urn:example:recent"}, "", nil, "", time.Time{}, "", false},
+		{"mfa", []string{"urn:example:mfa"}, "", []string{"pwd", "otp"}, "mfa-idp", now, "urn:example:mfa", true},
+		{"mfa wrong authority", []string{"urn:example:mfa"}, "", []string{"otp"}, "other-idp", now, "", false},
+		{"mfa missing amr", []string{"urn:example:mfa"}, "", []string{"pwd"}, "mfa-idp", now, "", false},
+		{"first satisfied", []string{"urn:example:mfa", "urn:example:recent"}, "", nil, "", now, "urn:example:recent", true},
+		{"matching acr without policy", []string{"urn:example:other"}, "urn:example:other", nil, "", now, "urn:example:other", true},
+		{"other acr without policy", []string{"urn:example:other"}, "urn:example:recent", nil, "", now, "", false},
+	} {
+		acr, satisfied := satisfiedACR(policies, test.acrValues, test.acr, test.amr, test.authorityID, test.authTime)
+		if acr != test.expected || satisfied != test.satisfied {
+			t.Errorf("%s: got %#v %v want %#v %v", test.name, acr, satisfied, test.expected, test.satisfied)
+		}
+	}
+}
+
+func TestACRAuthorityID(t *testing.T) {
+	policies := identity.ACRPolicies{
+		"urn:example:recent": &identity.ACRPolicy{ACR: "urn:example:recent", MaxAge: 60},
+		"urn:example:mfa":    &identity.ACRPolicy{ACR: "urn:example:mfa", Authority: "mfa-idp"},
+	}
+
+	for _, test := range []struct {
+		name      string
+		acrValues []string
+		expected  string
+	}{
+		{"no values", nil, ""},
+		{"without authority", []string{"urn:example:recent"}, ""},
+		{"unknown", []string{"urn:example:other"}, ""},
+		{"with authority", []string{"urn:example:recent", "urn:example:mfa"}, "mfa-idp"},
+	} {
+		if authorityID := acrAuthorityID(policies, test.acrValues); authorityID != test.expected {
+			t.Errorf("%s: got %#v want %#v", test.name, authorityID, test.expected)
+		}
+	}
+}
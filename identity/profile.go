@@ -0,0 +1,190 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identity
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+// Profile attributes of users which can be mapped to profile claims. Other
+// attributes are provided by users implementing UserWithProfileAttributes.
+const (
+	ProfileAttributeName       = "name"
+	ProfileAttributeFamilyName = "family_name"
+	ProfileAttributeGivenName  = "given_name"
+	ProfileAttributeUsername   = "username"
+	ProfileAttributeEmail      = "email"
+	ProfileAttributeSubject    = "sub"
+	ProfileAttributeUniqueID   = "uid"
+	ProfileAttributeID         = "id"
+)
+
+// ProfileClaims are the profile scope claims which can be mapped to user
+// profile attributes.
+var ProfileClaims = []string{
+	oidc.NameClaim,
+	oidc.FamilyNameClaim,
+	oidc.GivenNameClaim,
+	oidc.MiddleNameClaim,
+	konnectoidc.NicknameClaim,
+	oidc.PreferredUsernameClaim,
+	oidc.ProfileClaim,
+	oidc.PictureClaim,
+	oidc.WebsiteClaim,
+	oidc.GenderClaim,
+	oidc.BirthdateClaim,
+	oidc.ZoneinfoClaim,
+	konnectoidc.LocaleClaim,
+}
+
+// DefaultProfileClaimsMapping is the mapping of profile claims to the user
+// profile attributes they are populated from, when no other mapping is set.
+var DefaultProfileClaimsMapping = map[string]string{
+	oidc.NameClaim:              ProfileAttributeName,
+	oidc.FamilyNameClaim:        ProfileAttributeFamilyName,
+	oidc.GivenNameClaim:         ProfileAttributeGivenName,
+	oidc.PreferredUsernameClaim: ProfileAttributeUsername,
+}
+
+var profileAttributeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+
+// NewProfileClaimsMapping returns a new profile claims mapping with the
+// provided overrides applied to the DefaultProfileClaimsMapping. Overriding a
+// claim with an empty attribute removes that claim from the mapping.
+func NewProfileClaimsMapping(overrides map[string]string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for claim, attribute := range DefaultProfileClaimsMapping {
+		mapping[claim] = attribute
+	}
+
+	for claim, attribute := range overrides {
+		if !isProfileClaim(claim) {
+			return nil, fmt.Errorf("unsupported profile claim: %v", claim)
+		}
+		if attribute == "" {
+			delete(mapping, claim)
+			continue
+		}
+		if !profileAttributeRegexp.MatchString(attribute) {
+			return nil, fmt.Errorf("invalid profile attribute for %v claim: %v", claim, attribute)
+		}
+		mapping[claim] = attribute
+	}
+
+	return mapping, nil
+}
+
+func isProfileClaim(claim string) bool {
+	for _, c := range ProfileClaims {
+		if c == claim {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUserProfileAttribute returns the value of the provided user's profile
+// attribute. Returns false if the user does not support the attribute.
+func getUserProfileAttribute(user User, attribute string) (string, bool) {
+	switch attribute {
+	case "":
+		return "", false
+	case ProfileAttributeName:
+		if userWithProfile, ok := user.(UserWithProfile); ok {
+			return userWithProfile.Name(), true
+		}
+	case ProfileAttributeFamilyName:
+		if userWithProfile, ok := user.(UserWithProfile); ok {
+			return userWithProfile.FamilyName(), true
+		}
+	case ProfileAttributeGivenName:
+		if userWithProfile, ok := user.(UserWithProfile); ok {
+			return userWithProfile.GivenName(), true
+		}
+	case ProfileAttributeUsername:
+		if userWithUsername, ok := user.(UserWithUsername); ok {
+			return userWithUsername.Username(), true
+		}
+	case ProfileAttributeEmail:
+		if userWithEmail, ok := user.(UserWithEmail); ok {
+			return userWithEmail.Email(), true
+		}
+	case ProfileAttributeSubject:
+		return user.Subject(), true
+	case ProfileAttributeUniqueID:
+		if userWithUniqueID, ok := user.(UserWithUniqueID); ok {
+			return userWithUniqueID.UniqueID(), true
+		}
+	case ProfileAttributeID:
+		if userWithID, ok := user.(UserWithID); ok && userWithID.ID() != 0 {
+			return strconv.FormatInt(userWithID.ID(), 10), true
+		}
+	}
+
+	// NOTE: Users can provide the built-in attributes as well, for example
+	// when they do not implement the accociated interface.
+	if userWithProfileAttributes, ok := user.(UserWithProfileAttributes); ok {
+		return userWithProfileAttributes.ProfileAttribute(attribute)
+	}
+
+	return "", false
+}
+
+// setProfileClaim sets the provided profile claim value on the provided
+// profile claims. Empty values are not set, so they are omitted.
+func setProfileClaim(profileClaims *konnectoidc.ProfileClaims, claim string, value string) {
+	if value == "" {
+		return
+	}
+
+	switch claim {
+	case oidc.NameClaim:
+		profileClaims.Name = value
+	case oidc.FamilyNameClaim:
+		profileClaims.FamilyName = value
+	case oidc.GivenNameClaim:
+		profileClaims.GivenName = value
+	case oidc.MiddleNameClaim:
+		profileClaims.MiddleName = value
+	case konnectoidc.NicknameClaim:
+		profileClaims.Nickname = value
+	case oidc.PreferredUsernameClaim:
+		profileClaims.PreferredUsername = value
+	case oidc.ProfileClaim:
+		profileClaims.Profile = value
+	case oidc.PictureClaim:
+		profileClaims.Picture = value
+	case oidc.WebsiteClaim:
+		profileClaims.Website = value
+	case oidc.GenderClaim:
+		profileClaims.Gender = value
+	case oidc.BirthdateClaim:
+		profileClaims.Birthdate = value
+	case oidc.ZoneinfoClaim:
+		profileClaims.Zoneinfo = value
+	case konnectoidc.LocaleClaim:
+		profileClaims.Locale = value
+	}
+}
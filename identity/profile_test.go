@@ -0,0 +1,185 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identity
+
+import (
+	"reflect"
+	"testing"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+type profileTestUser struct {
+	attributes map[string]string
+}
+
+func (u *profileTestUser) Subject() string {
+	return "subject"
+}
+
+func (u *profileTestUser) Name() string {
+	return "Jane Doe"
+}
+
+func (u *profileTestUser) FamilyName() string {
+	return "Doe"
+}
+
+func (u *profileTestUser) GivenName() string {
+	return ""
+}
+
+func (u *profileTestUser) Username() string {
+	return "jane"
+}
+
+func (u *profileTestUser) Email() string {
+	return "jane@example.com"
+}
+
+func (u *profileTestUser) EmailVerified() bool {
+	return true
+}
+
+func (u *profileTestUser) ID() int64 {
+	return 1234
+}
+
+func (u *profileTestUser) ProfileAttribute(attribute string) (string, bool) {
+	value, ok := u.attributes[attribute]
+	return value, ok
+}
+
+func TestNewProfileClaimsMapping(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		overrides map[string]string
+		expected  map[string]string
+		valid     bool
+	}{
+		{"default", nil, DefaultProfileClaimsMapping, true},
+		{"override", map[string]string{oidc.NameClaim: ProfileAttributeUsername}, map[string]string{
+			oidc.NameClaim:              ProfileAttributeUsername,
+			oidc.FamilyNameClaim:        ProfileAttributeFamilyName,
+			oidc.GivenNameClaim:         ProfileAttributeGivenName,
+			oidc.PreferredUsernameClaim: ProfileAttributeUsername,
+		}, true},
+		{"remove", map[string]string{oidc.FamilyNameClaim: "", oidc.GivenNameClaim: ""}, map[string]string{
+			oidc.NameClaim:              ProfileAttributeName,
+			oidc.PreferredUsernameClaim: ProfileAttributeUsername,
+		}, true},
+		{"additional claims", map[string]string{konnectoidc.NicknameClaim: ProfileAttributeUniqueID, oidc.PictureClaim: "picture", konnectoidc.LocaleClaim: "preferred-language"}, map[string]string{
+			oidc.NameClaim:              ProfileAttributeName,
+			oidc.FamilyNameClaim:        ProfileAttributeFamilyName,
+			oidc.GivenNameClaim:         ProfileAttributeGivenName,
+			oidc.PreferredUsernameClaim: ProfileAttributeUsername,
+			konnectoidc.NicknameClaim:   ProfileAttributeUniqueID,
+			oidc.PictureClaim:           "picture",
+			konnectoidc.LocaleClaim:     "preferred-language",
+		}, true},
+		{"unsupported claim", map[string]string{oidc.EmailClaim: ProfileAttributeEmail}, nil, false},
+		{"unknown claim", map[string]string{"unknown": ProfileAttributeName}, nil, false},
+		{"invalid attribute", map[string]string{oidc.NameClaim: "not valid"}, nil, false},
+	} {
+		mapping, err := NewProfileClaimsMapping(test.overrides)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(mapping, test.expected) {
+			t.Errorf("%s: got mapping %v want %v", test.name, mapping, test.expected)
+		}
+	}
+
+	// The default mapping is never modified.
+	if len(DefaultProfileClaimsMapping) != 4 || DefaultProfileClaimsMapping[oidc.NameClaim] != ProfileAttributeName {
+		t.Errorf("default profile claims mapping was modified: %v", DefaultProfileClaimsMapping)
+	}
+}
+
+func TestGetUserClaimsForScopesProfileClaims(t *testing.T) {
+	user := &profileTestUser{
+		attributes: map[string]string{
+			"picture":   "https://example.com/jane.png",
+			"locale":    "de-DE",
+			"empty":     "",
+			"middle":    "Ann",
+			"birthdate": "1970-01-01",
+		},
+	}
+	mapping := map[string]string{
+		oidc.NameClaim:              ProfileAttributeName,
+		oidc.FamilyNameClaim:        ProfileAttributeFamilyName,
+		oidc.GivenNameClaim:         ProfileAttributeGivenName,
+		oidc.MiddleNameClaim:        "middle",
+		konnectoidc.NicknameClaim:   ProfileAttributeID,
+		oidc.PreferredUsernameClaim: ProfileAttributeEmail,
+		oidc.ProfileClaim:           "empty",
+		oidc.PictureClaim:           "picture",
+		oidc.WebsiteClaim:           "missing",
+		oidc.BirthdateClaim:         "birthdate",
+		konnectoidc.LocaleClaim:     "locale",
+	}
+	profileScope := map[string]bool{oidc.ScopeProfile: true}
+
+	for _, test := range []struct {
+		name      string
+		scopes    map[string]bool
+		requested []*payload.ClaimsRequestMap
+		mapping   map[string]string
+		expected  *konnectoidc.ProfileClaims
+	}{
+		{"default", profileScope, nil, nil, &konnectoidc.ProfileClaims{
+			Name:              "Jane Doe",
+			FamilyName:        "Doe",
+			PreferredUsername: "jane",
+		}},
+		{"mapped", profileScope, nil, mapping, &konnectoidc.ProfileClaims{
+			Name:              "Jane Doe",
+			FamilyName:        "Doe",
+			MiddleName:        "Ann",
+			Nickname:          "1234",
+			PreferredUsername: "jane@example.com",
+			Picture:           "https://example.com/jane.png",
+			Birthdate:         "1970-01-01",
+			Locale:            "de-DE",
+		}},
+		{"requested", map[string]bool{oidc.ScopeOpenID: true}, []*payload.ClaimsRequestMap{
+			{oidc.PictureClaim: nil, konnectoidc.LocaleClaim: nil, oidc.WebsiteClaim: nil},
+		}, mapping, &konnectoidc.ProfileClaims{
+			Picture: "https://example.com/jane.png",
+			Locale:  "de-DE",
+		}},
+		{"without scope", map[string]bool{oidc.ScopeOpenID: true}, nil, mapping, nil},
+	} {
+		claims := GetUserClaimsForScopesWithProfileClaimsMapping(user, test.scopes, test.requested, test.mapping)
+		profileClaims := konnectoidc.NewProfileClaims(claims[oidc.ScopeProfile])
+		if !reflect.DeepEqual(profileClaims, test.expected) {
+			t.Errorf("%s: got profile claims %#v want %#v", test.name, profileClaims, test.expected)
+		}
+	}
+
+	// The wrapper uses the default mapping.
+	claims := GetUserClaimsForScopes(user, profileScope, nil)
+	if profileClaims := konnectoidc.NewProfileClaims(claims[oidc.ScopeProfile]); profileClaims == nil || profileClaims.PreferredUsername != "jane" || profileClaims.Picture != "" {
+		t.Errorf("unexpected profile claims with default mapping: %#v", profileClaims)
+	}
+}
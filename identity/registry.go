@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identity
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ManagerFactory is a function which creates a new identity Manager with the
+// provided config. The args are the command line arguments which were given
+// after the identity manager name.
+//
+// The returned Manager must implement all methods of the Manager interface.
+// Authenticate, Authorize and EndSession are called by the OpenID Connect
+// provider endpoints, Fetch is used to look up users for tokens and the
+// userinfo endpoint, and AddRoutes is called once to let the manager add its
+// own HTTP routes (for example a sign-in form) to the server.
+type ManagerFactory func(ctx context.Context, config *Config, args []string) (Manager, error)
+
+var (
+	managerFactoriesMutex sync.RWMutex
+	managerFactories      = make(map[string]ManagerFactory)
+)
+
+var (
+	scopeClaimsResolversMutex sync.RWMutex
+	scopeClaimsResolvers      = make(map[string]ScopeClaimsResolver)
+)
+
+// RegisterManagerFactory makes an identity manager available by the provided
+// name. It is intended to be called from the init function of packages which
+// provide identity managers. RegisterManagerFactory panics if the provided
+// factory is nil or if it is called twice for the same name.
+func RegisterManagerFactory(name string, factory ManagerFactory) {
+	managerFactoriesMutex.Lock()
+	defer managerFactoriesMutex.Unlock()
+
+	if factory == nil {
+		panic("identity: register manager factory is nil")
+	}
+	if _, dup := managerFactories[name]; dup {
+		panic(fmt.Sprintf("identity: register manager factory called twice for %s", name))
+	}
+	managerFactories[name] = factory
+}
+
+// LookupManagerFactory returns the identity manager factory which was
+// registered with the provided name.
+func LookupManagerFactory(name string) (ManagerFactory, bool) {
+	managerFactoriesMutex.RLock()
+	defer managerFactoriesMutex.RUnlock()
+
+	factory, ok := managerFactories[name]
+	return factory, ok
+}
+
+// ManagerFactoryNames returns the sorted names of all registered identity
+// manager factories.
+func ManagerFactoryNames() []string {
+	managerFactoriesMutex.RLock()
+	defer managerFactoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(managerFactories))
+	for name := range managerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// RegisterScopeClaimsResolver makes a scope claims resolver available by the
+// provided name. It is intended to be called from the init function of
+// packages which provide scope claims resolvers. RegisterScopeClaimsResolver
+// panics if the provided resolver is nil or if it is called twice for the
+// same name.
+func RegisterScopeClaimsResolver(name string, resolver ScopeClaimsResolver) {
+	scopeClaimsResolversMutex.Lock()
+	defer scopeClaimsResolversMutex.Unlock()
+
+	if resolver == nil {
+		panic("identity: register scope claims resolver is nil")
+	}
+	if _, dup := scopeClaimsResolvers[name]; dup {
+		panic(fmt.Sprintf("identity: register scope claims resolver called twice for %s", name))
+	}
+	scopeClaimsResolvers[name] = resolver
+}
+
+// LookupScopeClaimsResolver returns the scope claims resolver which was
+// registered with the provided name.
+func LookupScopeClaimsResolver(name string) (ScopeClaimsResolver, bool) {
+	scopeClaimsResolversMutex.RLock()
+	defer scopeClaimsResolversMutex.RUnlock()
+
+	resolver, ok := scopeClaimsResolvers[name]
+	return resolver, ok
+}
+
+// ScopeClaimsResolverNames returns the sorted names of all registered scope
+// claims resolvers.
+func ScopeClaimsResolverNames() []string {
+	scopeClaimsResolversMutex.RLock()
+	defer scopeClaimsResolversMutex.RUnlock()
+
+	names := make([]string, 0, len(scopeClaimsResolvers))
+	for name := range scopeClaimsResolvers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
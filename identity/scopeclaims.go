@@ -0,0 +1,66 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package identity
+
+import (
+	"context"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// ScopeClaimsResolver resolves the claims which are released for the granted
+// scopes of a user to a client. The returned claims are mapped by scope, with
+// claims which do not belong to a scope mapped by the empty string.
+//
+// Identity managers invoke their ScopeClaimsResolver when assembling the
+// claims of tokens and userinfo responses. The client ID is empty when claims
+// are assembled without a client.
+type ScopeClaimsResolver interface {
+	ResolveScopeClaims(ctx context.Context, user User, clientID string, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) map[string]jwt.Claims
+}
+
+// StaticScopeClaimsResolver is the default ScopeClaimsResolver. It releases
+// the claims of the granted scopes as configured by its profile claims
+// mapping, or the DefaultProfileClaimsMapping if nil.
+type StaticScopeClaimsResolver struct {
+	ProfileClaimsMapping map[string]string
+}
+
+// ResolveScopeClaims implements the ScopeClaimsResolver interface.
+func (r *StaticScopeClaimsResolver) ResolveScopeClaims(ctx context.Context, user User, clientID string, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) map[string]jwt.Claims {
+	return GetUserClaimsForScopesWithProfileClaimsMapping(user, scopes, requestedClaimsMaps, r.ProfileClaimsMapping)
+}
+
+// ResolveScopeClaims returns the claims of the provided user for the provided
+// scopes using the provided resolver, with the client ID taken from the
+// provided context. If resolver is nil, a StaticScopeClaimsResolver with the
+// provided profile claims mapping is used.
+func ResolveScopeClaims(ctx context.Context, resolver ScopeClaimsResolver, user User, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap, profileClaimsMapping map[string]string) map[string]jwt.Claims {
+	if user == nil {
+		return nil
+	}
+	if resolver == nil {
+		resolver = &StaticScopeClaimsResolver{
+			ProfileClaimsMapping: profileClaimsMapping,
+		}
+	}
+	clientID, _ := ClientIDFromContext(ctx)
+
+	return resolver.ResolveScopeClaims(ctx, user, clientID, scopes, requestedClaimsMaps)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package identity
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// User attributes which can be used as source for the local subject.
+const (
+	SubjectAttributeSubject  = "sub"
+	SubjectAttributeUniqueID = "uid"
+	SubjectAttributeID       = "id"
+	SubjectAttributeUsername = "username"
+	SubjectAttributeEmail    = "email"
+)
+
+// ValidateSubjectAttribute checks if the provided attribute is supported as
+// source for the local subject. It returns true if the attribute is known to
+// be mutable, which means that the subject changes when the attribute value
+// changes (Eg. when the user is renamed).
+func ValidateSubjectAttribute(attribute string) (bool, error) {
+	switch attribute {
+	case "", SubjectAttributeSubject, SubjectAttributeUniqueID, SubjectAttributeID:
+		return false, nil
+	case SubjectAttributeUsername, SubjectAttributeEmail:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported subject attribute: %v", attribute)
+	}
+}
+
+// GetUserSubjectAttribute returns the value of the provided user's attribute
+// to be used as source for the local subject. An empty attribute selects the
+// user's subject. Returns an error if the user does not support the attribute
+// or its value is empty.
+func GetUserSubjectAttribute(user User, attribute string) (string, error) {
+	var value string
+
+	switch attribute {
+	case "", SubjectAttributeSubject:
+		value = user.Subject()
+	case SubjectAttributeUniqueID:
+		if userWithUniqueID, ok := user.(UserWithUniqueID); ok {
+			value = userWithUniqueID.UniqueID()
+		}
+	case SubjectAttributeID:
+		if userWithID, ok := user.(UserWithID); ok && userWithID.ID() != 0 {
+			value = strconv.FormatInt(userWithID.ID(), 10)
+		}
+	case SubjectAttributeUsername:
+		if userWithUsername, ok := user.(UserWithUsername); ok {
+			value = userWithUsername.Username()
+		}
+	case SubjectAttributeEmail:
+		if userWithEmail, ok := user.(UserWithEmail); ok {
+			value = userWithEmail.Email()
+		}
+	default:
+		return "", fmt.Errorf("unsupported subject attribute: %v", attribute)
+	}
+
+	if value == "" {
+		return "", fmt.Errorf("user has no value for subject attribute: %v", attribute)
+	}
+
+	return value, nil
+}
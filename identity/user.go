@@ -41,6 +41,14 @@ type UserWithProfile interface {
 	GivenName() string
 }
 
+// UserWithProfileAttributes is a User with additional profile attributes,
+// which can be mapped to profile claims. The returned bool is false, if the
+// user does not support the provided attribute.
+type UserWithProfileAttributes interface {
+	User
+	ProfileAttribute(attribute string) (string, bool)
+}
+
 // UserWithID is a User with a locally unique numeric id.
 type UserWithID interface {
 	User
@@ -77,6 +85,27 @@ type UserWithSessionRef interface {
 	SessionRef() *string
 }
 
+// UserWithACR is a user which supports the authentication context class
+// reference which was satisfied when the user signed in.
+type UserWithACR interface {
+	User
+	ACR() string
+}
+
+// UserWithAMR is a user which supports the authentication methods references
+// which were used when the user signed in.
+type UserWithAMR interface {
+	User
+	AMR() []string
+}
+
+// UserWithAuthority is a user which supports the ID of the authority it signed
+// in with.
+type UserWithAuthority interface {
+	User
+	AuthorityID() string
+}
+
 // PublicUser is a user with a public Subject and a raw id.
 type PublicUser interface {
 	Subject() string
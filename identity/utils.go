@@ -71,11 +71,24 @@ func AuthorizeScopes(manager Manager, user User, scopes map[string]bool) (map[st
 }
 
 // GetUserClaimsForScopes returns a mapping of user claims of the provided user
-// filtered by the provided scopes.
+// filtered by the provided scopes. Profile claims are populated from the user
+// attributes as defined by the DefaultProfileClaimsMapping.
 func GetUserClaimsForScopes(user User, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) map[string]jwt.Claims {
+	return GetUserClaimsForScopesWithProfileClaimsMapping(user, scopes, requestedClaimsMaps, nil)
+}
+
+// GetUserClaimsForScopesWithProfileClaimsMapping returns a mapping of user
+// claims of the provided user filtered by the provided scopes like
+// GetUserClaimsForScopes. Profile claims are populated from the user
+// attributes as defined by the provided profile claims mapping, or the
+// DefaultProfileClaimsMapping if nil.
+func GetUserClaimsForScopesWithProfileClaimsMapping(user User, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap, profileClaimsMapping map[string]string) map[string]jwt.Claims {
 	if user == nil {
 		return nil
 	}
+	if profileClaimsMapping == nil {
+		profileClaimsMapping = DefaultProfileClaimsMapping
+	}
 
 	claims := make(map[string]jwt.Claims)
 
@@ -89,20 +102,12 @@ func GetUserClaimsForScopes(user User, scopes map[string]bool, requestedClaimsMa
 	}
 	if authorizedScope, _ := scopes[oidc.ScopeProfile]; authorizedScope {
 		var profileClaims *konnectoidc.ProfileClaims
-		if userWithProfile, ok := user.(UserWithProfile); ok {
-			profileClaims = &konnectoidc.ProfileClaims{
-				Name:       userWithProfile.Name(),
-				FamilyName: userWithProfile.FamilyName(),
-				GivenName:  userWithProfile.GivenName(),
-			}
-		}
-		if userWithUsername, ok := user.(UserWithUsername); ok {
-			if profileClaims == nil {
-				profileClaims = &konnectoidc.ProfileClaims{
-					PreferredUsername: userWithUsername.Username(),
+		for claim, attribute := range profileClaimsMapping {
+			if value, ok := getUserProfileAttribute(user, attribute); ok {
+				if profileClaims == nil {
+					profileClaims = &konnectoidc.ProfileClaims{}
 				}
-			} else {
-				profileClaims.PreferredUsername = userWithUsername.Username()
+				setProfileClaim(profileClaims, claim, value)
 			}
 		}
 		if profileClaims != nil {
@@ -136,20 +141,13 @@ func GetUserClaimsForScopes(user User, scopes map[string]bool, requestedClaimsMa
 							}
 						}
 					case oidc.ScopeProfile:
-						if userWithProfile, ok := user.(UserWithProfile); ok {
+						if value, ok := getUserProfileAttribute(user, profileClaimsMapping[requestedClaim]); ok {
 							scopeClaims := konnectoidc.NewProfileClaims(claims[scope])
 							if scopeClaims == nil {
 								scopeClaims = &konnectoidc.ProfileClaims{}
 								claims[scope] = scopeClaims
 							}
-							switch requestedClaim {
-							case oidc.NameClaim:
-								scopeClaims.Name = userWithProfile.Name()
-							case oidc.FamilyNameClaim:
-								scopeClaims.Name = userWithProfile.FamilyName()
-							case oidc.GivenNameClaim:
-								scopeClaims.Name = userWithProfile.GivenName()
-							}
+							setProfileClaim(scopeClaims, requestedClaim, value)
 						}
 					}
 				}
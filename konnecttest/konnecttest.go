@@ -0,0 +1,249 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+// Package konnecttest provides utilities to run a konnect server in process
+// for integration tests.
+package konnecttest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"stash.kopano.io/kc/konnect/bootstrap"
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identity"
+	identityAuthorities "stash.kopano.io/kc/konnect/identity/authorities"
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
+)
+
+// DefaultSubject is the subject of the user which is signed in with the dummy
+// identity manager when no subject is set.
+const DefaultSubject = "konnecttest"
+
+// Options defines the settings of a test server.
+type Options struct {
+	// Subject is the subject of the user which is signed in for all requests
+	// by the dummy identity manager. Defaults to DefaultSubject.
+	Subject string
+
+	// IdentityManager replaces the dummy identity manager if set. If it
+	// implements server.WithRoutes, its routes are added to the server.
+	IdentityManager identity.Manager
+
+	// Clients are registered with the client registry of the server.
+	Clients []*identityClients.ClientRegistration
+
+	// Scopes restricts the scopes supported by the dummy identity manager
+	// and the allowed scopes of the server if set.
+	Scopes []string
+
+	// Authorities are added to the authorities registry of the server, for
+	// use by identity managers.
+	Authorities []*identityAuthorities.AuthorityRegistration
+
+	// Logger receives the log messages of the server. If nil, log messages
+	// are discarded.
+	Logger logrus.FieldLogger
+}
+
+// identityManagerCount numbers the identity manager factories registered for
+// the test servers, since factories cannot be unregistered.
+var identityManagerCount uint64
+
+var (
+	certificate     tls.Certificate
+	certificatePool *x509.CertPool
+	certificateErr  error
+	certificateOnce sync.Once
+)
+
+// New starts a konnect server with the provided options on a random port of
+// the loopback interface and returns its issuer identifier together with a
+// function to stop the server. The server is set up by the same bootstrap as
+// konnectd serve, signs with an ephemeral RSA key, encrypts with an ephemeral
+// secret and serves TLS with an ephemeral certificate which is trusted by the
+// clients returned by Client. Failures are reported with t.Fatal. The
+// returned function can be called multiple times.
+func New(t testing.TB, options Options) (string, func()) {
+	t.Helper()
+
+	logger := options.Logger
+	if logger == nil {
+		discardLogger := logrus.New()
+		discardLogger.Out = ioutil.Discard
+		logger = discardLogger
+	}
+
+	certificateOnce.Do(createCertificate)
+	if certificateErr != nil {
+		t.Fatalf("konnecttest: failed to create certificate: %v", certificateErr)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("konnecttest: failed to listen: %v", err)
+	}
+	issuer := "https://" + listener.Addr().String()
+	listener = tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fail := func(format string, args ...interface{}) {
+		t.Helper()
+		cancel()
+		listener.Close()
+		t.Fatalf("konnecttest: "+format, args...)
+	}
+
+	// NOTE: The bootstrap creates the identity manager by name, so the
+	// identity manager of the options is provided with a registered factory.
+	identityManagerName := fmt.Sprintf("konnecttest-%d", atomic.AddUint64(&identityManagerCount, 1))
+	identity.RegisterManagerFactory(identityManagerName, func(ctx context.Context, config *identity.Config, args []string) (identity.Manager, error) {
+		if options.IdentityManager != nil {
+			return options.IdentityManager, nil
+		}
+		sub := options.Subject
+		if sub == "" {
+			sub = DefaultSubject
+		}
+		return identityManagers.NewDummyIdentityManager(config, sub), nil
+	})
+
+	flags := pflag.NewFlagSet("konnecttest", pflag.ContinueOnError)
+	bootstrap.AddFlags(flags)
+	if err = flags.Set("iss", issuer); err != nil {
+		fail("failed to set issuer: %v", err)
+	}
+	for _, scope := range options.Scopes {
+		if err = flags.Set("allow-scope", scope); err != nil {
+			fail("failed to set allowed scope: %v", err)
+		}
+	}
+
+	bs := bootstrap.New(flags, []string{identityManagerName}, &config.Config{
+		Logger: logger,
+	})
+	if err = bs.Boot(ctx); err != nil {
+		fail("failed to boot: %v", err)
+	}
+
+	clients := bs.Managers().Must("clients").(*identityClients.Registry)
+	for _, client := range options.Clients {
+		if err = clients.Register(client); err != nil {
+			fail("failed to register client %v: %v", client.ID, err)
+		}
+	}
+	authorities := bs.Managers().Must("authorities").(*identityAuthorities.Registry)
+	for _, authority := range options.Authorities {
+		if err = authorities.Add(ctx, authority); err != nil {
+			fail("failed to add authority %v: %v", authority.ID, err)
+		}
+	}
+
+	srv, err := bs.NewServer([]net.Listener{listener}, nil)
+	if err != nil {
+		fail("%v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ctx)
+	}()
+
+	var once sync.Once
+	return issuer, func() {
+		once.Do(func() {
+			cancel()
+			if serveErr := <-errCh; serveErr != nil && serveErr != http.ErrServerClosed {
+				t.Errorf("konnecttest: server failed: %v", serveErr)
+			}
+		})
+	}
+}
+
+// Client returns a new HTTP client which trusts the certificate of the test
+// servers started with New.
+func Client() *http.Client {
+	certificateOnce.Do(createCertificate)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certificatePool,
+			},
+		},
+	}
+}
+
+// createCertificate creates the self-signed certificate for the loopback
+// address which is shared by all test servers.
+func createCertificate() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		certificateErr = err
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: "konnecttest",
+		},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		certificateErr = err
+		return
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		certificateErr = err
+		return
+	}
+
+	certificate = tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        parsed,
+	}
+	certificatePool = x509.NewCertPool()
+	certificatePool.AddCert(parsed)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package konnecttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	identityClients "stash.kopano.io/kc/konnect/identity/clients"
+)
+
+func TestNew(t *testing.T) {
+	issuer, cleanup := New(t, Options{
+		Clients: []*identityClients.ClientRegistration{
+			{
+				ID:           "konnecttest-client",
+				RedirectURIs: []string{"https://rp.example.com/cb"},
+			},
+		},
+	})
+	defer cleanup()
+
+	httpClient := Client()
+	response, err := httpClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected discovery status: %d", response.StatusCode)
+	}
+
+	wellKnown := &oidc.WellKnown{}
+	if err = json.NewDecoder(response.Body).Decode(wellKnown); err != nil {
+		t.Fatal(err)
+	}
+	if wellKnown.Issuer != issuer {
+		t.Errorf("issuer was incorrect, got %s, want %s", wellKnown.Issuer, issuer)
+	}
+
+	jwksResponse, err := httpClient.Get(wellKnown.JwksURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksResponse.Body.Close()
+	if jwksResponse.StatusCode != http.StatusOK {
+		t.Errorf("unexpected jwks status: %d", jwksResponse.StatusCode)
+	}
+
+	// NOTE: The dummy identity manager signs in without user interaction, so
+	// authorize requests of registered clients redirect with a code.
+	client := Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	authorizeResponse, err := client.Get(wellKnown.AuthorizationEndpoint + "?" + url.Values{
+		"client_id":     {"konnecttest-client"},
+		"redirect_uri":  {"https://rp.example.com/cb"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"konnecttest"},
+	}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizeResponse.Body.Close()
+	if authorizeResponse.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected authorize status: %d", authorizeResponse.StatusCode)
+	}
+	location, err := authorizeResponse.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("code") == "" {
+		t.Errorf("authorize response without code: %s", location)
+	}
+
+	cleanup()
+	if _, err = httpClient.Get(issuer + "/health-check"); err == nil {
+		t.Errorf("server still reachable after cleanup")
+	}
+}
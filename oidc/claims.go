@@ -18,6 +18,9 @@
 package oidc
 
 import (
+	"encoding/json"
+	"errors"
+
 	"github.com/dgrijalva/jwt-go"
 )
 
@@ -27,8 +30,17 @@ type IDTokenClaims struct {
 
 	Nonce           string `json:"nonce,omitempty"`
 	AuthTime        int64  `json:"auth_time,omitempty"`
+	ACR             string `json:"acr,omitempty"`
 	AccessTokenHash string `json:"at_hash,omitempty"`
 	CodeHash        string `json:"c_hash,omitempty"`
+	AuthorizedParty string `json:"azp,omitempty"`
+
+	AMR []string `json:"amr,omitempty"`
+
+	// AudienceList holds all values of the aud claim. When decoded, Audience
+	// is set to its first value. When encoded with more than one value, the
+	// aud claim is encoded as array.
+	AudienceList []string `json:"-"`
 
 	*ProfileClaims
 	*EmailClaims
@@ -36,6 +48,57 @@ type IDTokenClaims struct {
 	*SessionClaims
 }
 
+// MarshalJSON implements the json.Marshaler interface, encoding the aud
+// claim as array when the accociated claims have more than one audience.
+func (c IDTokenClaims) MarshalJSON() ([]byte, error) {
+	type idTokenClaims IDTokenClaims
+	if len(c.AudienceList) <= 1 {
+		return json.Marshal(idTokenClaims(c))
+	}
+
+	return json.Marshal(struct {
+		idTokenClaims
+		Audience []string `json:"aud"`
+	}{idTokenClaims(c), c.AudienceList})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, accepting both
+// string and array values for the aud claim.
+func (c *IDTokenClaims) UnmarshalJSON(b []byte) error {
+	type idTokenClaims IDTokenClaims
+	aux := struct {
+		idTokenClaims
+		Audience interface{} `json:"aud,omitempty"`
+	}{}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	*c = IDTokenClaims(aux.idTokenClaims)
+	switch aud := aux.Audience.(type) {
+	case nil:
+	case string:
+		c.Audience = aud
+		c.AudienceList = []string{aud}
+	case []interface{}:
+		c.AudienceList = make([]string, 0, len(aud))
+		for _, value := range aud {
+			s, ok := value.(string)
+			if !ok {
+				return errors.New("aud claim not valid")
+			}
+			c.AudienceList = append(c.AudienceList, s)
+		}
+		if len(c.AudienceList) > 0 {
+			c.Audience = c.AudienceList[0]
+		}
+	default:
+		return errors.New("aud claim not valid")
+	}
+
+	return nil
+}
+
 // Valid implements the jwt.Claims interface.
 func (c IDTokenClaims) Valid() (err error) {
 	return c.StandardClaims.Valid()
@@ -47,7 +110,16 @@ type ProfileClaims struct {
 	Name              string `json:"name,omitempty"`
 	FamilyName        string `json:"family_name,omitempty"`
 	GivenName         string `json:"given_name,omitempty"`
+	MiddleName        string `json:"middle_name,omitempty"`
+	Nickname          string `json:"nickname,omitempty"`
 	PreferredUsername string `json:"preferred_username,omitempty"`
+	Profile           string `json:"profile,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	Website           string `json:"website,omitempty"`
+	Gender            string `json:"gender,omitempty"`
+	Birthdate         string `json:"birthdate,omitempty"`
+	Zoneinfo          string `json:"zoneinfo,omitempty"`
+	Locale            string `json:"locale,omitempty"`
 }
 
 // NewProfileClaims return a new ProfileClaims set from the provided
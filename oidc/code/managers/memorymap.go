@@ -18,38 +18,60 @@
 package managers
 
 import (
+	"container/list"
 	"context"
+	"sync"
 	"time"
 
-	"github.com/orcaman/concurrent-map"
 	"stash.kopano.io/kgol/rndm"
 
 	"stash.kopano.io/kc/konnect/oidc/code"
 )
 
+// Defaults used by memory map managers.
 const (
-	codeValidDuration = 2 * time.Minute
+	DefaultCodeValidDuration = 2 * time.Minute
+	DefaultMaxRecords        = 100000
 )
 
 // Manager provides the api and state for OIDC code generation and token
 // exchange. The CodeManager's methods are safe to call from multiple Go
 // routines.
 type memoryMapManager struct {
-	table        cmap.ConcurrentMap
+	mutex sync.Mutex
+
+	table map[string]*list.Element
+	queue *list.List
+
 	codeDuration time.Duration
+	maxRecords   int
 }
 
 type codeRequestRecord struct {
+	code   string
 	record *code.Record
 	//ar   *payload.AuthenticationRequest
 	//auth identity.AuthRecord
 	when time.Time
 }
 
-// NewMemoryMapManager creates a new CodeManager.
-func NewMemoryMapManager(ctx context.Context) code.Manager {
+// NewMemoryMapManager creates a new CodeManager which holds at most the
+// provided number of codes, each valid for the provided duration. If zero
+// values are provided, the defaults are used.
+func NewMemoryMapManager(ctx context.Context, maxRecords int, codeDuration time.Duration) code.Manager {
+	if maxRecords <= 0 {
+		maxRecords = DefaultMaxRecords
+	}
+	if codeDuration <= 0 {
+		codeDuration = DefaultCodeValidDuration
+	}
+
 	cm := &memoryMapManager{
-		table: cmap.New(),
+		table: make(map[string]*list.Element),
+		queue: list.New(),
+
+		codeDuration: codeDuration,
+		maxRecords:   maxRecords,
 	}
 
 	// Cleanup function.
@@ -59,7 +81,9 @@ func NewMemoryMapManager(ctx context.Context) code.Manager {
 		for {
 			select {
 			case <-ticker.C:
+				cm.mutex.Lock()
 				cm.purgeExpired()
+				cm.mutex.Unlock()
 			case <-ctx.Done():
 				return
 			}
@@ -70,44 +94,74 @@ func NewMemoryMapManager(ctx context.Context) code.Manager {
 	return cm
 }
 
+// purgeExpired removes all expired records, oldest first. The accociated
+// manager's mutex must be held when calling.
 func (cm *memoryMapManager) purgeExpired() {
-	var expired []string
-	deadline := time.Now().Add(-codeValidDuration)
-	var record *codeRequestRecord
-	for entry := range cm.table.IterBuffered() {
-		record = entry.Val.(*codeRequestRecord)
-		if record.when.Before(deadline) {
-			expired = append(expired, entry.Key)
+	deadline := time.Now().Add(-cm.codeDuration)
+	for {
+		element := cm.queue.Front()
+		if element == nil {
+			return
 		}
-	}
-	for _, code := range expired {
-		cm.table.Remove(code)
+		rr := element.Value.(*codeRequestRecord)
+		if !rr.when.Before(deadline) {
+			// NOTE: Records are queued in creation order, thus all
+			// remaining records are not expired.
+			return
+		}
+		cm.queue.Remove(element)
+		delete(cm.table, rr.code)
 	}
 }
 
 // Create creates a new random code string, stores it together with the provided
-// values in the accociated CodeManager's table and returns the code.
+// values in the accociated CodeManager's table and returns the code. If the
+// table is full, expired records are removed and then the oldest records, so
+// that new codes can always be created.
 func (cm *memoryMapManager) Create(record *code.Record) (string, error) {
-	code := rndm.GenerateRandomString(24)
+	codeString := rndm.GenerateRandomString(24)
 
 	rr := &codeRequestRecord{
+		code:   codeString,
 		record: record,
 		when:   time.Now(),
 	}
-	cm.table.Set(code, rr)
 
-	return code, nil
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if len(cm.table) >= cm.maxRecords {
+		cm.purgeExpired()
+		for len(cm.table) >= cm.maxRecords {
+			element := cm.queue.Front()
+			cm.queue.Remove(element)
+			delete(cm.table, element.Value.(*codeRequestRecord).code)
+		}
+	}
+	cm.table[codeString] = cm.queue.PushBack(rr)
+
+	return codeString, nil
 }
 
 // Pop looks up the provided code in the accociated CodeManagers's table. If
 // found it returns the authentication request and backend record plus true.
-// When not found, both values return as nil plus false.
+// When not found or expired, both values return as nil plus false.
 func (cm *memoryMapManager) Pop(code string) (*code.Record, bool) {
-	stored, found := cm.table.Pop(code)
+	cm.mutex.Lock()
+	element, found := cm.table[code]
+	if found {
+		cm.queue.Remove(element)
+		delete(cm.table, code)
+	}
+	cm.mutex.Unlock()
 	if !found {
 		return nil, false
 	}
-	rr := stored.(*codeRequestRecord)
+
+	rr := element.Value.(*codeRequestRecord)
+	if time.Since(rr.when) > cm.codeDuration {
+		return nil, false
+	}
 
 	return rr.record, true
 }
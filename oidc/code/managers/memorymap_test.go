@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/konnect/oidc/code"
+)
+
+func TestMemoryMapManagerCreatePop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := NewMemoryMapManager(ctx, 0, 0)
+	record := &code.Record{}
+	codeString, err := cm.Create(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if popped, ok := cm.Pop(codeString); !ok || popped != record {
+		t.Errorf("code was not found: %v %v", popped, ok)
+	}
+	if _, ok := cm.Pop(codeString); ok {
+		t.Error("code was found twice")
+	}
+	if _, ok := cm.Pop("unknown"); ok {
+		t.Error("unknown code was found")
+	}
+}
+
+func TestMemoryMapManagerExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := NewMemoryMapManager(ctx, 10, time.Minute).(*memoryMapManager)
+	codeString, err := cm.Create(&code.Record{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.table[codeString].Value.(*codeRequestRecord).when = time.Now().Add(-2 * time.Minute)
+
+	if _, ok := cm.Pop(codeString); ok {
+		t.Error("expired code was found")
+	}
+}
+
+func TestMemoryMapManagerMaxRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := NewMemoryMapManager(ctx, 3, time.Minute).(*memoryMapManager)
+
+	codes := make([]string, 0, 5)
+	for i := 0; i < 3; i++ {
+		codeString, err := cm.Create(&code.Record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, codeString)
+	}
+
+	// Expired records are removed first.
+	cm.table[codes[0]].Value.(*codeRequestRecord).when = time.Now().Add(-2 * time.Minute)
+	codeString, err := cm.Create(&code.Record{})
+	if err != nil {
+		t.Fatalf("create with expired records failed: %v", err)
+	}
+	codes = append(codes, codeString)
+	if _, ok := cm.table[codes[0]]; ok {
+		t.Error("expired code was not removed")
+	}
+	if len(cm.table) != 3 {
+		t.Errorf("unexpected number of records: %d", len(cm.table))
+	}
+
+	// Then the oldest records.
+	codeString, err = cm.Create(&code.Record{})
+	if err != nil {
+		t.Fatalf("create with full table failed: %v", err)
+	}
+	codes = append(codes, codeString)
+	if len(cm.table) != 3 || cm.queue.Len() != 3 {
+		t.Errorf("unexpected number of records: %d/%d", len(cm.table), cm.queue.Len())
+	}
+	if _, ok := cm.Pop(codes[1]); ok {
+		t.Error("oldest code was not removed")
+	}
+	for _, codeString := range codes[2:] {
+		if _, ok := cm.Pop(codeString); !ok {
+			t.Errorf("code %v was removed", codeString)
+		}
+	}
+}
@@ -28,6 +28,7 @@ import (
 type OAuth2Error struct {
 	ErrorID          string `json:"error"`
 	ErrorDescription string `json:"error_description"`
+	ErrorURI         string `json:"error_uri,omitempty"`
 }
 
 // Error implements the error interface.
@@ -42,12 +43,12 @@ func (err *OAuth2Error) Description() string {
 
 // NewOAuth2Error creates a new error with id and description.
 func NewOAuth2Error(id string, description string) utils.ErrorWithDescription {
-	return &OAuth2Error{id, description}
+	return &OAuth2Error{ErrorID: id, ErrorDescription: description}
 }
 
 // WriteWWWAuthenticateError writes the provided error with the provided
 // http status code to the provided http response writer as a
-// WWW-Authenticate header with comma seperated fields for id and
+// Bearer WWW-Authenticate header with comma seperated fields for id and
 // description.
 func WriteWWWAuthenticateError(rw http.ResponseWriter, code int, err error) {
 	if code == 0 {
@@ -61,7 +62,7 @@ func WriteWWWAuthenticateError(rw http.ResponseWriter, code int, err error) {
 	default:
 	}
 
-	rw.Header().Set("WWW-Authenticate", fmt.Sprintf("error=\"%s\", error_description=\"%s\"", err.Error(), description))
+	rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"%s\", error_description=\"%s\"", err.Error(), description))
 	rw.WriteHeader(code)
 }
 
@@ -20,3 +20,120 @@ package oidc
 // KonnectIDTokenSubjectSaltV1 is the salt value used when hasing Subjects in
 // ID tokens created by Konnect.
 const KonnectIDTokenSubjectSaltV1 = "konnect-IDToken-v1"
+
+// Token endpoint authentication methods for mutual TLS client authentication
+// as specified at https://tools.ietf.org/html/rfc8705#section-2.
+const (
+	AuthMethodTLSClientAuth           = "tls_client_auth"
+	AuthMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+)
+
+// AuthMethodClientSecretPost is the token endpoint authentication method for
+// clients sending their secret in the request body as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication.
+const AuthMethodClientSecretPost = "client_secret_post"
+
+// AuthMethodPrivateKeyJWT is the token endpoint authentication method for
+// clients authenticating with a signed JWT as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication.
+const AuthMethodPrivateKeyJWT = "private_key_jwt"
+
+// ClientAssertionTypeJWTBearer is the client_assertion_type value for JWT
+// client assertions as specified at https://tools.ietf.org/html/rfc7523#section-2.2.
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// GrantTypeClientCredentials is the grant_type value of the client
+// credentials grant as specified at https://tools.ietf.org/html/rfc6749#section-4.4.
+const GrantTypeClientCredentials = "client_credentials"
+
+// Token type hints of token revocation requests as specified at
+// https://tools.ietf.org/html/rfc7009#section-2.1.
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// ErrorCodeOAuth2InvalidClient is the OAuth2 error code returned when client
+// authentication failed as specified at https://tools.ietf.org/html/rfc6749#section-5.2.
+const ErrorCodeOAuth2InvalidClient = "invalid_client"
+
+// ErrorCodeOAuth2UnauthorizedClient is the OAuth2 error code returned when
+// the authenticated client is not authorized to use the requested grant type
+// as specified at https://tools.ietf.org/html/rfc6749#section-5.2.
+const ErrorCodeOAuth2UnauthorizedClient = "unauthorized_client"
+
+// ErrorCodeOAuth2UnsupportedTokenType is the OAuth2 error code returned when
+// the revocation of the presented token type is not supported as specified at
+// https://tools.ietf.org/html/rfc7009#section-2.2.1.
+const ErrorCodeOAuth2UnsupportedTokenType = "unsupported_token_type"
+
+// ErrorCodeOAuth2InvalidScope is the OAuth2 error code returned when the
+// requested scope is invalid or unknown as specified at
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1.
+const ErrorCodeOAuth2InvalidScope = "invalid_scope"
+
+// ErrorCodeOAuth2UnsupportedResponseMode is the error returned when the
+// requested response_mode is not supported as specified at
+// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes.
+const ErrorCodeOAuth2UnsupportedResponseMode = "unsupported_response_mode"
+
+// ResponseModeFormPost is the response mode which returns authorization
+// response parameters as HTML form values auto-submitted with POST as
+// specified at https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html.
+const ResponseModeFormPost = "form_post"
+
+// Display values of authentication requests which are handled by the
+// identifier sign-in form as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest. The wap
+// display value is not supported.
+const (
+	DisplayPage  = "page"
+	DisplayPopup = "popup"
+	DisplayTouch = "touch"
+)
+
+// AuthenticationContextClassReferenceClaim is the ID token claim holding the
+// authentication context class reference as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken.
+const AuthenticationContextClassReferenceClaim = "acr"
+
+// AuthenticationMethodsReferencesClaim is the ID token claim holding the
+// authentication methods references as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken.
+const AuthenticationMethodsReferencesClaim = "amr"
+
+// Standard profile claims as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims which
+// have no constant in the oidc-go package.
+const (
+	NicknameClaim = "nickname"
+	LocaleClaim   = "locale"
+)
+
+// ErrorCodeOIDCUnmetAuthenticationRequirements is the error returned when the
+// requested authentication requirements cannot be met as specified at
+// https://openid.net/specs/openid-connect-unmet-authentication-requirements-1_0.html.
+const ErrorCodeOIDCUnmetAuthenticationRequirements = "unmet_authentication_requirements"
+
+// ErrorCodeOIDCConsentRequired is the error returned when consent is required
+// but cannot be obtained as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthError.
+const ErrorCodeOIDCConsentRequired = "consent_required"
+
+// ErrorCodeOIDCInvalidRequestURI is the error returned when the request_uri
+// of an authentication request is not registered, cannot be fetched or
+// returns invalid data as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#AuthError.
+const ErrorCodeOIDCInvalidRequestURI = "invalid_request_uri"
+
+// SubjectIDPairwise is the subject type for pairwise subject identifiers as
+// specified at https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg.
+const SubjectIDPairwise = "pairwise"
+
+// KonnectIDTokenPairwiseSubjectSaltV1 is the salt value used when hashing
+// pairwise Subjects in ID tokens created by Konnect.
+const KonnectIDTokenPairwiseSubjectSaltV1 = "konnect-IDToken-pairwise-v1"
+
+// WebFingerIssuerRel is the WebFinger link relation for the OpenID Connect
+// issuer as specified at https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.
+const WebFingerIssuerRel = "http://openid.net/specs/connect/1.0/issuer"
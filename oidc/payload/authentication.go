@@ -49,6 +49,11 @@ type AuthenticationRequest struct {
 	RawPrompt       string         `schema:"prompt"`
 	RawIDTokenHint  string         `schema:"id_token_hint"`
 	RawMaxAge       string         `schema:"max_age"`
+	RawACRValues    string         `schema:"acr_values"`
+	RawDisplay      string         `schema:"display"`
+
+	LoginHint         string `schema:"login_hint"`
+	RawLoginHintToken string `schema:"login_hint_token"`
 
 	RawRequest      string `schema:"request"`
 	RawRequestURI   string `schema:"request_uri"`
@@ -64,8 +69,18 @@ type AuthenticationRequest struct {
 	IDTokenHint   *jwt.Token      `schema:"-"`
 	MaxAge        time.Duration   `schema:"-"`
 	Request       *jwt.Token      `schema:"-"`
+	ACRValues     []string        `schema:"-"`
+
+	// Display is the requested display value if it is supported, empty
+	// otherwise.
+	Display string `schema:"-"`
+
+	// SubjectMapper if set, is used to map user IDs to the subject value
+	// known by the client, for example for pairwise subjects.
+	SubjectMapper func(string) string `schema:"-"`
 
 	UseFragment bool   `schema:"-"`
+	UseFormPost bool   `schema:"-"`
 	Flow        string `schema:"-"`
 
 	Session *Session `schema:"-"`
@@ -135,6 +150,13 @@ func NewAuthenticationRequest(values url.Values, providerMetadata *oidc.WellKnow
 			ar.Prompts[prompt] = true
 		}
 	}
+	switch ar.RawDisplay {
+	case konnectoidc.DisplayPage, konnectoidc.DisplayPopup, konnectoidc.DisplayTouch:
+		ar.Display = ar.RawDisplay
+	default:
+		// NOTE: Unsupported display values are ignored as allowed by the
+		// spec, using the default page display.
+	}
 
 	switch ar.RawResponseType {
 	case oidc.ResponseTypeCode:
@@ -167,6 +189,9 @@ func NewAuthenticationRequest(values url.Values, providerMetadata *oidc.WellKnow
 	case oidc.ResponseModeQuery:
 		ar.UseFragment = false
 		// breaks
+	case konnectoidc.ResponseModeFormPost:
+		ar.UseFragment = false
+		ar.UseFormPost = true
 	}
 
 	if ar.RawMaxAge != "" {
@@ -176,6 +201,9 @@ func NewAuthenticationRequest(values url.Values, providerMetadata *oidc.WellKnow
 		}
 		ar.MaxAge = time.Duration(maxAgeInt) * time.Second
 	}
+	if ar.RawACRValues != "" {
+		ar.ACRValues = strings.Fields(ar.RawACRValues)
+	}
 
 	if ar.Claims != nil && ar.Claims.Passthru != nil {
 		// Remove pass thru claims when not provided in a secure manner. This
@@ -250,6 +278,18 @@ func (ar *AuthenticationRequest) ApplyRequestObject(roc *RequestObjectClaims, me
 	if roc.RawMaxAge != "" {
 		ar.RawMaxAge = roc.RawMaxAge
 	}
+	if roc.RawDisplay != "" {
+		ar.RawDisplay = roc.RawDisplay
+	}
+	if roc.RawACRValues != "" {
+		ar.RawACRValues = roc.RawACRValues
+	}
+	if roc.LoginHint != "" {
+		ar.LoginHint = roc.LoginHint
+	}
+	if roc.RawLoginHintToken != "" {
+		ar.RawLoginHintToken = roc.RawLoginHintToken
+	}
 	if roc.RawRegistration != "" {
 		ar.RawRegistration = roc.RawRegistration
 	}
@@ -297,6 +337,24 @@ func (ar *AuthenticationRequest) Validate(keyFunc jwt.Keyfunc) error {
 		return ar.NewError(oidc.ErrorCodeOAuth2UnsupportedResponseType, "")
 	}
 
+	// Response mode validation following spec at
+	// https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+	switch ar.ResponseMode {
+	case "":
+		// breaks
+	case oidc.ResponseModeQuery:
+		if ar.Flow != oidc.FlowCode {
+			// Tokens must never be returned in the query.
+			return ar.NewError(konnectoidc.ErrorCodeOAuth2UnsupportedResponseMode, "query response mode not allowed for response type")
+		}
+	case oidc.ResponseModeFragment:
+		// breaks
+	case konnectoidc.ResponseModeFormPost:
+		// breaks
+	default:
+		return ar.NewError(konnectoidc.ErrorCodeOAuth2UnsupportedResponseMode, "")
+	}
+
 	// Additional checks for flows with code.
 	if ar.Flow == oidc.FlowCode || ar.Flow == oidc.FlowHybrid {
 		switch ar.CodeChallengeMethod {
@@ -356,6 +414,23 @@ func (ar *AuthenticationRequest) Validate(keyFunc jwt.Keyfunc) error {
 		}
 	}
 
+	// Essential acr requests which can never be met are rejected early.
+	// https://openid.net/specs/openid-connect-core-1_0.html#acrSemantics
+	if acrValues, essential := ar.RequestedACRValues(); essential && ar.providerMetadata != nil && len(ar.providerMetadata.ACRValuesSupported) > 0 {
+		supported := false
+		for _, acr := range acrValues {
+			for _, v := range ar.providerMetadata.ACRValuesSupported {
+				if acr == v {
+					supported = true
+					break
+				}
+			}
+		}
+		if !supported {
+			return ar.NewError(konnectoidc.ErrorCodeOIDCUnmetAuthenticationRequirements, "requested acr not supported")
+		}
+	}
+
 	if ar.RawRequestURI != "" {
 		return ar.NewError(oidc.ErrorCodeOIDCRequestURINotSupported, "")
 	}
@@ -369,6 +444,9 @@ func (ar *AuthenticationRequest) Validate(keyFunc jwt.Keyfunc) error {
 // Verify checks that the passed parameters match the accociated requirements.
 func (ar *AuthenticationRequest) Verify(userID string) error {
 	if ar.IDTokenHint != nil {
+		if ar.SubjectMapper != nil {
+			userID = ar.SubjectMapper(userID)
+		}
 		// Compare userID with IDTokenHint.
 		if userID != ar.IDTokenHint.Claims.(*konnectoidc.IDTokenClaims).Subject {
 			return ar.NewError(oidc.ErrorCodeOIDCLoginRequired, "userid mismatch")
@@ -378,6 +456,33 @@ func (ar *AuthenticationRequest) Verify(userID string) error {
 	return nil
 }
 
+// RequestedACRValues returns the authentication context class reference
+// values requested by the accociated request in order of preference. An
+// acr claim request for the ID token takes precedence over the acr_values
+// parameter. The returned bool is true, when the acr claim was requested as
+// essential, meaning that one of the returned values must be satisfied.
+func (ar *AuthenticationRequest) RequestedACRValues() ([]string, bool) {
+	if ar.Claims != nil && ar.Claims.IDToken != nil {
+		if crv, ok := ar.Claims.IDToken.Get(konnectoidc.AuthenticationContextClassReferenceClaim); ok && crv != nil {
+			var values []string
+			if len(crv.Values) > 0 {
+				for _, v := range crv.Values {
+					if s, ok := v.(string); ok && s != "" {
+						values = append(values, s)
+					}
+				}
+			} else if s, ok := crv.Value.(string); ok && s != "" {
+				values = append(values, s)
+			}
+			if len(values) > 0 {
+				return values, crv.Essential
+			}
+		}
+	}
+
+	return ar.ACRValues, false
+}
+
 // NewError creates a new error with id and string and the associated request's
 // state.
 func (ar *AuthenticationRequest) NewError(id string, description string) *AuthenticationError {
@@ -423,6 +528,7 @@ type AuthenticationSuccess struct {
 type AuthenticationError struct {
 	ErrorID          string `url:"error" json:"error"`
 	ErrorDescription string `url:"error_description,omitempty" json:"error_description,omitempty"`
+	ErrorURI         string `url:"error_uri,omitempty" json:"error_uri,omitempty"`
 	State            string `url:"state,omitempty" json:"state,omitempty"`
 }
 
@@ -442,6 +548,7 @@ func (ae *AuthenticationError) Description() string {
 type AuthenticationBadRequest struct {
 	ErrorID          string `url:"error" json:"error"`
 	ErrorDescription string `url:"error_description,omitempty" json:"error_description,omitempty"`
+	ErrorURI         string `url:"error_uri,omitempty" json:"error_uri,omitempty"`
 	State            string `url:"state,omitempty" json:"state,omitempty"`
 }
 
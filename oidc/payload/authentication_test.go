@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package payload
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"stash.kopano.io/kgol/oidc-go"
+)
+
+func TestAuthenticationRequestDisplay(t *testing.T) {
+	for _, test := range []struct {
+		display  string
+		expected string
+	}{
+		{"", ""},
+		{"page", "page"},
+		{"popup", "popup"},
+		{"touch", "touch"},
+		{"wap", ""},
+		{"unknown", ""},
+	} {
+		values := url.Values{}
+		values.Set("scope", "openid")
+		values.Set("response_type", "code")
+		values.Set("client_id", "client")
+		values.Set("redirect_uri", "https://client.example.com/cb")
+		if test.display != "" {
+			values.Set("display", test.display)
+		}
+
+		ar, err := NewAuthenticationRequest(values, nil, nil)
+		if err != nil {
+			t.Fatalf("display %#v: %v", test.display, err)
+		}
+		if ar.Display != test.expected {
+			t.Errorf("display %#v: got %#v want %#v", test.display, ar.Display, test.expected)
+		}
+	}
+}
+
+func TestAuthenticationRequestRequestedACRValues(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		acrValues string
+		claims    string
+		expected  []string
+		essential bool
+	}{
+		{"none", "", "", nil, false},
+		{"acr_values", "urn:example:mfa urn:example:pwd", "", []string{"urn:example:mfa", "urn:example:pwd"}, false},
+		{"voluntary claim", "", `{"id_token":{"acr":{"values":["urn:example:mfa"]}}}`, []string{"urn:example:mfa"}, false},
+		{"essential claim", "", `{"id_token":{"acr":{"essential":true,"value":"urn:example:mfa"}}}`, []string{"urn:example:mfa"}, true},
+		{"claim precedence", "urn:example:pwd", `{"id_token":{"acr":{"essential":true,"values":["urn:example:mfa"]}}}`, []string{"urn:example:mfa"}, true},
+		{"claim without values", "urn:example:pwd", `{"id_token":{"acr":{"essential":true}}}`, []string{"urn:example:pwd"}, false},
+	} {
+		values := url.Values{}
+		values.Set("scope", "openid")
+		values.Set("response_type", "code")
+		values.Set("client_id", "client")
+		values.Set("redirect_uri", "https://client.example.com/cb")
+		if test.acrValues != "" {
+			values.Set("acr_values", test.acrValues)
+		}
+		if test.claims != "" {
+			values.Set("claims", test.claims)
+		}
+
+		ar, err := NewAuthenticationRequest(values, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		acrValues, essential := ar.RequestedACRValues()
+		if !reflect.DeepEqual(acrValues, test.expected) || essential != test.essential {
+			t.Errorf("%s: got %v %v want %v %v", test.name, acrValues, essential, test.expected, test.essential)
+		}
+	}
+}
+
+func TestAuthenticationRequestValidateEssentialACR(t *testing.T) {
+	providerMetadata := &oidc.WellKnown{
+		ACRValuesSupported: []string{"urn:example:mfa"},
+	}
+
+	for _, test := range []struct {
+		name   string
+		claims string
+		valid  bool
+	}{
+		{"supported", `{"id_token":{"acr":{"essential":true,"value":"urn:example:mfa"}}}`, true},
+		{"one supported", `{"id_token":{"acr":{"essential":true,"values":["urn:example:other","urn:example:mfa"]}}}`, true},
+		{"unsupported voluntary", `{"id_token":{"acr":{"value":"urn:example:other"}}}`, true},
+		{"unsupported essential", `{"id_token":{"acr":{"essential":true,"value":"urn:example:other"}}}`, false},
+	} {
+		values := url.Values{}
+		values.Set("scope", "openid")
+		values.Set("response_type", "code")
+		values.Set("client_id", "client")
+		values.Set("redirect_uri", "https://client.example.com/cb")
+		values.Set("claims", test.claims)
+
+		ar, err := NewAuthenticationRequest(values, providerMetadata, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = ar.Validate(nil)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid {
+			if authErr, ok := err.(*AuthenticationError); !ok || authErr.ErrorID != "unmet_authentication_requirements" {
+				t.Errorf("%s: got error %v want unmet_authentication_requirements", test.name, err)
+			}
+		}
+	}
+}
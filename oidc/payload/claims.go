@@ -19,8 +19,13 @@ package payload
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 
 	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 )
 
 var scopedClaims = map[string]string{
@@ -28,6 +33,7 @@ var scopedClaims = map[string]string{
 	oidc.FamilyNameClaim:        oidc.ScopeProfile,
 	oidc.GivenNameClaim:         oidc.ScopeProfile,
 	oidc.MiddleNameClaim:        oidc.ScopeProfile,
+	konnectoidc.NicknameClaim:   oidc.ScopeProfile,
 	oidc.PreferredUsernameClaim: oidc.ScopeProfile,
 	oidc.ProfileClaim:           oidc.ScopeProfile,
 	oidc.PictureClaim:           oidc.ScopeProfile,
@@ -35,6 +41,7 @@ var scopedClaims = map[string]string{
 	oidc.GenderClaim:            oidc.ScopeProfile,
 	oidc.BirthdateClaim:         oidc.ScopeProfile,
 	oidc.ZoneinfoClaim:          oidc.ScopeProfile,
+	konnectoidc.LocaleClaim:     oidc.ScopeProfile,
 	oidc.UpdatedAtClaim:         oidc.ScopeProfile,
 
 	oidc.EmailClaim:         oidc.ScopeEmail,
@@ -59,21 +66,34 @@ type ClaimsRequest struct {
 }
 
 // ApplyScopes removes all claims requests from the accociated claims request
-// which are not mapped to one of the provided approved scopes.
+// which are mapped to a scope which is not one of the provided approved
+// scopes. Claims which are not mapped to any scope are kept. An error is
+// returned if any of the removed claims was requested as essential.
 func (cr *ClaimsRequest) ApplyScopes(approvedScopes map[string]bool) error {
-	if cr.UserInfo != nil {
-		for claim := range *cr.UserInfo {
-			if approved := approvedScopes[scopedClaims[claim]]; !approved {
-				delete(*cr.UserInfo, claim)
+	denied := make(map[string]bool)
+	for _, crm := range []*ClaimsRequestMap{cr.UserInfo, cr.IDToken} {
+		if crm == nil {
+			continue
+		}
+		for claim, crv := range *crm {
+			scope, scoped := scopedClaims[claim]
+			if !scoped || approvedScopes[scope] {
+				continue
 			}
+			if crv != nil && crv.Essential {
+				denied[claim] = true
+			}
+			delete(*crm, claim)
 		}
 	}
-	if cr.IDToken != nil {
-		for claim := range *cr.IDToken {
-			if approved := approvedScopes[scopedClaims[claim]]; !approved {
-				delete(*cr.IDToken, claim)
-			}
+
+	if len(denied) > 0 {
+		claims := make([]string, 0, len(denied))
+		for claim := range denied {
+			claims = append(claims, claim)
 		}
+		sort.Strings(claims)
+		return fmt.Errorf("essential claims not approved: %s", strings.Join(claims, " "))
 	}
 
 	return nil
@@ -128,6 +148,24 @@ func (crm *ClaimsRequestMap) ScopesMap(excludedScopes map[string]bool) map[strin
 	return scopesMap
 }
 
+// MissingEssential returns the sorted names of all claims of the accociated
+// map which are requested as essential but are not contained in the provided
+// claims.
+func (crm ClaimsRequestMap) MissingEssential(claims map[string]interface{}) []string {
+	var missing []string
+	for claim, crv := range crm {
+		if crv == nil || !crv.Essential {
+			continue
+		}
+		if value, ok := claims[claim]; !ok || value == nil || value == "" {
+			missing = append(missing, claim)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
+
 // Get returns the accociated maps claim value identified by the provided name.
 func (crm ClaimsRequestMap) Get(claim string) (*ClaimsRequestValue, bool) {
 	value, ok := crm[claim]
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package payload
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestClaimsRequestApplyScopes(t *testing.T) {
+	cr := &ClaimsRequest{}
+	if err := json.Unmarshal([]byte(`{"id_token":{"email":{"essential":true},"auth_time":null},"userinfo":{"name":null,"custom":{"value":"x"}}}`), cr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cr.ApplyScopes(map[string]bool{"email": true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cr.UserInfo.Get("name"); ok {
+		t.Error("expected name claim to be removed")
+	}
+	if _, ok := cr.UserInfo.Get("custom"); !ok {
+		t.Error("expected unscoped custom claim to be kept")
+	}
+	if _, ok := cr.IDToken.Get("auth_time"); !ok {
+		t.Error("expected unscoped auth_time claim to be kept")
+	}
+
+	if err := cr.ApplyScopes(map[string]bool{}); err == nil {
+		t.Error("expected error when essential claim is not approved")
+	}
+	if _, ok := cr.IDToken.Get("email"); ok {
+		t.Error("expected email claim to be removed")
+	}
+}
+
+func TestClaimsRequestMapMissingEssential(t *testing.T) {
+	crm := ClaimsRequestMap{
+		"email":    &ClaimsRequestValue{Essential: true},
+		"name":     &ClaimsRequestValue{Essential: true},
+		"nickname": &ClaimsRequestValue{},
+		"picture":  nil,
+	}
+
+	missing := crm.MissingEssential(map[string]interface{}{
+		"email": "user@example.com",
+		"name":  "",
+	})
+	if !reflect.DeepEqual(missing, []string{"name"}) {
+		t.Errorf("unexpected missing essential claims: %v", missing)
+	}
+}
@@ -38,8 +38,17 @@ type EndSessionRequest struct {
 	RawPostLogoutRedirectURI string `schema:"post_logout_redirect_uri"`
 	State                    string `schema:"state"`
 
+	// ClientID is the client requesting the logout as specified at
+	// https://openid.net/specs/openid-connect-rpinitiated-1_0.html#RPLogout
+	// and is set from the aud of the id_token_hint when not provided.
+	ClientID string `schema:"client_id"`
+
 	IDTokenHint           *jwt.Token `schema:"-"`
 	PostLogoutRedirectURI *url.URL   `schema:"-"`
+
+	// SubjectMapper if set, is used to map user IDs to the subject value
+	// known by the client, for example for pairwise subjects.
+	SubjectMapper func(string) string `schema:"-"`
 }
 
 // DecodeEndSessionRequest returns a EndSessionRequest holding the
@@ -65,6 +74,10 @@ func NewEndSessionRequest(values url.Values, providerMetadata *oidc.WellKnown) (
 }
 
 // Validate validates the request data of the accociated endSession request.
+// The id_token_hint must be signed with a key returned by the provided
+// keyFunc, have iss and aud set and be issued by the accociated provider. Its
+// time based claims are not validated, as expired ID tokens are still good to
+// identify the session to end.
 func (esr *EndSessionRequest) Validate(keyFunc jwt.Keyfunc) error {
 	if esr.RawIDTokenHint != "" {
 		parser := &jwt.Parser{
@@ -80,6 +93,21 @@ func (esr *EndSessionRequest) Validate(keyFunc jwt.Keyfunc) error {
 		if err != nil {
 			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		}
+		claims := idTokenHint.Claims.(*konnectoidc.IDTokenClaims)
+		if claims.Issuer == "" {
+			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint without iss")
+		}
+		if esr.providerMetadata != nil && claims.Issuer != esr.providerMetadata.Issuer {
+			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint issuer mismatch")
+		}
+		if claims.Audience == "" {
+			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint without aud")
+		}
+		if esr.ClientID == "" {
+			esr.ClientID = claims.Audience
+		} else if esr.ClientID != claims.Audience {
+			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "client_id does not match id_token_hint")
+		}
 		esr.IDTokenHint = idTokenHint
 	}
 
@@ -87,8 +115,13 @@ func (esr *EndSessionRequest) Validate(keyFunc jwt.Keyfunc) error {
 }
 
 // Verify checks that the passed parameters match the accociated requirements.
+// An empty userID means that there is no signed in user, in which case the
+// id_token_hint alone identifies the session to end.
 func (esr *EndSessionRequest) Verify(userID string) error {
-	if esr.IDTokenHint != nil {
+	if esr.IDTokenHint != nil && userID != "" {
+		if esr.SubjectMapper != nil {
+			userID = esr.SubjectMapper(userID)
+		}
 		// Compare userID with IDTokenHint.
 		if userID != esr.IDTokenHint.Claims.(*konnectoidc.IDTokenClaims).Subject {
 			return esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "userid mismatch")
@@ -98,6 +131,20 @@ func (esr *EndSessionRequest) Verify(userID string) error {
 	return nil
 }
 
+// SessionID returns the sid of the accociated request's id_token_hint or an
+// empty string if there is none.
+func (esr *EndSessionRequest) SessionID() string {
+	if esr.IDTokenHint == nil {
+		return ""
+	}
+	claims := esr.IDTokenHint.Claims.(*konnectoidc.IDTokenClaims)
+	if claims.SessionClaims == nil {
+		return ""
+	}
+
+	return claims.SessionClaims.SessionID
+}
+
 // NewError creates a new error with id and string and the associated request's
 // state.
 func (esr *EndSessionRequest) NewError(id string, description string) *AuthenticationError {
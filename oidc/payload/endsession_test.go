@@ -0,0 +1,72 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package payload
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+func TestEndSessionRequestValidateIssuer(t *testing.T) {
+	key := []byte("unittest-secret")
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	}
+	metadata := &oidc.WellKnown{
+		Issuer: "https://konnect.example.com",
+	}
+
+	for _, test := range []struct {
+		issuer string
+		ok     bool
+	}{
+		{"https://konnect.example.com", true},
+		{"https://other.example.com", false},
+		{"", false},
+	} {
+		idTokenHint, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &konnectoidc.IDTokenClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:   test.issuer,
+				Audience: "client",
+				Subject:  "user",
+			},
+		}).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := url.Values{}
+		values.Set("id_token_hint", idTokenHint)
+		esr, err := NewEndSessionRequest(values, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = esr.Validate(keyFunc)
+		if test.ok != (err == nil) {
+			t.Errorf("issuer %#v: unexpected result: %v", test.issuer, err)
+		}
+		if err == nil && esr.ClientID != "client" {
+			t.Errorf("issuer %#v: client_id not taken from id_token_hint: %v", test.issuer, esr.ClientID)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package payload
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+// Default request parameter limits.
+const (
+	DefaultMaxScopes            = 100
+	DefaultMaxScopeLength       = 4096
+	DefaultMaxRequestLength     = 64 * 1024
+	DefaultMaxClaimsLength      = 16 * 1024
+	DefaultMaxRedirectURILength = 4096
+	DefaultMaxStateLength       = 4096
+)
+
+// RequestLimits define the maximum number and sizes of request parameters
+// accepted with authorize and token requests. A zero value means no limit.
+type RequestLimits struct {
+	MaxScopes            int
+	MaxScopeLength       int
+	MaxRequestLength     int
+	MaxClaimsLength      int
+	MaxRedirectURILength int
+	MaxStateLength       int
+}
+
+// NewDefaultRequestLimits returns RequestLimits with the default limits.
+func NewDefaultRequestLimits() *RequestLimits {
+	return &RequestLimits{
+		MaxScopes:            DefaultMaxScopes,
+		MaxScopeLength:       DefaultMaxScopeLength,
+		MaxRequestLength:     DefaultMaxRequestLength,
+		MaxClaimsLength:      DefaultMaxClaimsLength,
+		MaxRedirectURILength: DefaultMaxRedirectURILength,
+		MaxStateLength:       DefaultMaxStateLength,
+	}
+}
+
+// Check validates the provided raw request values against the accociated
+// limits. It is meant to be called before the values are decoded, so that
+// oversized values are never parsed. A nil RequestLimits accepts
+// everything.
+func (l *RequestLimits) Check(values url.Values) error {
+	if l == nil {
+		return nil
+	}
+
+	if err := checkValuesLength(values, "scope", l.MaxScopeLength); err != nil {
+		return err
+	}
+	if l.MaxScopes > 0 {
+		count := 0
+		for _, value := range values["scope"] {
+			count += len(strings.Fields(value))
+		}
+		if count > l.MaxScopes {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "too many scopes")
+		}
+	}
+	if err := checkValuesLength(values, "request", l.MaxRequestLength); err != nil {
+		return err
+	}
+	if err := checkValuesLength(values, "claims", l.MaxClaimsLength); err != nil {
+		return err
+	}
+	if err := checkValuesLength(values, "redirect_uri", l.MaxRedirectURILength); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CheckScopes validates the number of the provided decoded scopes, which
+// can also be set by request objects, against the accociated limits.
+func (l *RequestLimits) CheckScopes(scopes map[string]bool) error {
+	if l == nil || l.MaxScopes <= 0 {
+		return nil
+	}
+
+	if len(scopes) > l.MaxScopes {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "too many scopes")
+	}
+
+	return nil
+}
+
+// CheckState validates the length of the provided decoded state, which can
+// also be set by request objects, against the accociated limits.
+func (l *RequestLimits) CheckState(state string) error {
+	if l == nil || l.MaxStateLength <= 0 {
+		return nil
+	}
+
+	if len(state) > l.MaxStateLength {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "state too long")
+	}
+
+	return nil
+}
+
+func checkValuesLength(values url.Values, key string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	length := 0
+	for _, value := range values[key] {
+		length += len(value)
+	}
+	if length > limit {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, fmt.Sprintf("%s too long", key))
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// LoginHintTokenClaims holds the claims of a login_hint_token identifying the
+// user for whom authentication is requested as known from
+// https://openid.net/specs/openid-client-initiated-backchannel-authentication-core-1_0.html#auth_request.
+type LoginHintTokenClaims struct {
+	Issuer      string          `json:"iss,omitempty"`
+	RawAudience json.RawMessage `json:"aud,omitempty"`
+	ExpiresAt   int64           `json:"exp,omitempty"`
+	IssuedAt    int64           `json:"iat,omitempty"`
+	NotBefore   int64           `json:"nbf,omitempty"`
+
+	LoginHint         string `json:"login_hint,omitempty"`
+	Email             string `json:"email,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// Valid implements the jwt.Claims interface.
+func (c *LoginHintTokenClaims) Valid() error {
+	now := time.Now().Unix()
+	if c.ExpiresAt != 0 && now > c.ExpiresAt {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != 0 && now < c.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// Audience returns the audience values of the accociated claims. The aud claim
+// can either be a single string or an array of strings.
+func (c *LoginHintTokenClaims) Audience() []string {
+	if len(c.RawAudience) == 0 {
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(c.RawAudience, &single); err == nil {
+		return []string{single}
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.RawAudience, &multiple); err == nil {
+		return multiple
+	}
+
+	return nil
+}
+
+// Hint returns the login hint of the accociated claims. The login_hint claim
+// is preferred, followed by email and preferred_username.
+func (c *LoginHintTokenClaims) Hint() string {
+	switch {
+	case c.LoginHint != "":
+		return c.LoginHint
+	case c.Email != "":
+		return c.Email
+	}
+
+	return c.PreferredUsername
+}
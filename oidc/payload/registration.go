@@ -30,6 +30,7 @@ import (
 
 	"stash.kopano.io/kc/konnect/identity/clients"
 	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 // ClientRegistrationRequest holds the incoming request data for the OpenID
@@ -47,6 +48,9 @@ type ClientRegistrationRequest struct {
 	ClientURI  string   `json:"client_uri"`
 
 	RawJWKS json.RawMessage `json:"jwks"`
+	JWKSURI string          `json:"jwks_uri,omitempty"`
+
+	RequestURIs []string `json:"request_uris,omitempty"`
 
 	RawIDTokenSignedResponseAlg    string `json:"id_token_signed_response_alg"`
 	RawUserInfoSignedResponseAlg   string `json:"userinfo_signed_response_alg"`
@@ -54,8 +58,17 @@ type ClientRegistrationRequest struct {
 	RawTokenEndpointAuthMethod     string `json:"token_endpoint_auth_method"`
 	RawTokenEndpointAuthSigningAlg string `json:"token_endpoint_auth_signing_alg"`
 
+	RawIDTokenEncryptedResponseAlg string `json:"id_token_encrypted_response_alg,omitempty"`
+	RawIDTokenEncryptedResponseEnc string `json:"id_token_encrypted_response_enc,omitempty"`
+
+	SubjectType         string `json:"subject_type,omitempty"`
+	SectorIdentifierURI string `json:"sector_identifier_uri,omitempty"`
+
 	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris"`
 
+	FrontchannelLogoutURI             string `json:"frontchannel_logout_uri"`
+	FrontchannelLogoutSessionRequired bool   `json:"frontchannel_logout_session_required"`
+
 	JWKS *gojwk.Key `json:"-"`
 }
 
@@ -200,9 +213,6 @@ func (crr *ClientRegistrationRequest) Validate() error {
 		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "unknown application_type")
 	}
 
-	if crr.RawIDTokenSignedResponseAlg == "" {
-		crr.RawIDTokenSignedResponseAlg = jwt.SigningMethodRS256.Alg()
-	}
 	if crr.RawIDTokenSignedResponseAlg != "" {
 		alg := jwt.GetSigningMethod(crr.RawIDTokenSignedResponseAlg)
 		if alg == nil {
@@ -228,6 +238,8 @@ func (crr *ClientRegistrationRequest) Validate() error {
 		switch crr.RawTokenEndpointAuthMethod {
 		case oidc.AuthMethodClientSecretBasic:
 			// breaks
+		case konnectoidc.AuthMethodClientSecretPost:
+			// breaks
 		case oidc.AuthMethodNone:
 			// breaks
 		default:
@@ -241,6 +253,48 @@ func (crr *ClientRegistrationRequest) Validate() error {
 		}
 	}
 
+	if crr.RawIDTokenEncryptedResponseAlg != "" {
+		// NOTE: Dynamic clients do not persist jwks, thus a jwks_uri is
+		// required to find the client's encryption key.
+		if crr.JWKSURI == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "jwks_uri required for id_token_encrypted_response_alg")
+		}
+		if !utils.ContainsString(clients.IDTokenEncryptionAlgs, crr.RawIDTokenEncryptedResponseAlg) {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "unsupported id_token_encrypted_response_alg")
+		}
+	}
+	if crr.RawIDTokenEncryptedResponseEnc != "" {
+		if crr.RawIDTokenEncryptedResponseAlg == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "id_token_encrypted_response_enc requires id_token_encrypted_response_alg")
+		}
+		if !utils.ContainsString(clients.IDTokenEncryptionEncs, crr.RawIDTokenEncryptedResponseEnc) {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "unsupported id_token_encrypted_response_enc")
+		}
+	}
+	if crr.JWKSURI != "" {
+		if u, err := url.Parse(crr.JWKSURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "jwks_uri must be an absolute https URI")
+		}
+	}
+
+	for _, uriString := range crr.RequestURIs {
+		if u, err := url.Parse(uriString); err != nil || u.Scheme != "https" || u.Host == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "request_uris must be absolute https URIs")
+		}
+	}
+
+	switch crr.SubjectType {
+	case "", oidc.SubjectIDPublic, konnectoidc.SubjectIDPairwise:
+		// breaks
+	default:
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "unsupported subject_type")
+	}
+	if crr.SectorIdentifierURI != "" {
+		if u, err := url.Parse(crr.SectorIdentifierURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "sector_identifier_uri must be an absolute https URI")
+		}
+	}
+
 	for _, uriString := range crr.PostLogoutRedirectURIs {
 		_, err := url.Parse(uriString)
 		if err != nil {
@@ -248,6 +302,12 @@ func (crr *ClientRegistrationRequest) Validate() error {
 		}
 	}
 
+	if crr.FrontchannelLogoutURI != "" {
+		if u, err := url.Parse(crr.FrontchannelLogoutURI); err != nil || !u.IsAbs() || u.Fragment != "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, "invalid frontchannel_logout_uri")
+		}
+	}
+
 	if crr.JWKS != nil {
 		if len(crr.JWKS.Keys) == 0 {
 			crr.JWKS = nil
@@ -295,7 +355,20 @@ func (crr *ClientRegistrationRequest) ClientRegistration() (*clients.ClientRegis
 		RawTokenEndpointAuthMethod:     crr.RawTokenEndpointAuthMethod,
 		RawTokenEndpointAuthSigningAlg: crr.RawTokenEndpointAuthSigningAlg,
 
+		JWKSURI: crr.JWKSURI,
+
+		RequestURIs: crr.RequestURIs,
+
+		RawIDTokenEncryptedResponseAlg: crr.RawIDTokenEncryptedResponseAlg,
+		RawIDTokenEncryptedResponseEnc: crr.RawIDTokenEncryptedResponseEnc,
+
+		SubjectType:         crr.SubjectType,
+		SectorIdentifierURI: crr.SectorIdentifierURI,
+
 		PostLogoutRedirectURIs: crr.PostLogoutRedirectURIs,
+
+		FrontchannelLogoutURI:             crr.FrontchannelLogoutURI,
+		FrontchannelLogoutSessionRequired: crr.FrontchannelLogoutSessionRequired,
 	}
 
 	return cr, nil
@@ -43,6 +43,11 @@ type RequestObjectClaims struct {
 	RawPrompt       string         `json:"prompt"`
 	RawIDTokenHint  string         `json:"id_token_hint"`
 	RawMaxAge       string         `json:"max_age"`
+	RawACRValues    string         `json:"acr_values"`
+	RawDisplay      string         `json:"display"`
+
+	LoginHint         string `json:"login_hint"`
+	RawLoginHintToken string `json:"login_hint_token"`
 
 	RawRegistration string `json:"registration"`
 
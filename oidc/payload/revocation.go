@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package payload
+
+import (
+	"net/http"
+	"net/url"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+// RevocationRequest holds the incoming parameters and request data for the
+// OAuth 2.0 token revocation endpoint as specified at
+// https://tools.ietf.org/html/rfc7009#section-2.1
+type RevocationRequest struct {
+	clientSecretBasic bool
+
+	Token         string `schema:"token"`
+	TokenTypeHint string `schema:"token_type_hint"`
+
+	ClientID     string `schema:"client_id"`
+	ClientSecret string `schema:"client_secret"`
+
+	ClientAssertionType string `schema:"client_assertion_type"`
+	ClientAssertion     string `schema:"client_assertion"`
+}
+
+// DecodeRevocationRequest returns a RevocationRequest holding the provided
+// request's form data.
+func DecodeRevocationRequest(req *http.Request) (*RevocationRequest, error) {
+	rr, err := NewRevocationRequest(req.PostForm)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, clientSecret, ok, err := decodeClientSecretBasic(req)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rr.ClientID = clientID
+		rr.ClientSecret = clientSecret
+		rr.clientSecretBasic = true
+	}
+
+	return rr, nil
+}
+
+// NewRevocationRequest returns a RevocationRequest holding the provided url
+// values.
+func NewRevocationRequest(values url.Values) (*RevocationRequest, error) {
+	rr := &RevocationRequest{}
+
+	err := DecodeSchema(rr, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
+}
+
+// ClientAuthMethod returns the token endpoint authentication method used by
+// the accociated revocation request. Mutual TLS client authentication is not
+// part of the request data and thus is never returned.
+func (rr *RevocationRequest) ClientAuthMethod() string {
+	switch {
+	case rr.ClientAssertion != "":
+		return konnectoidc.AuthMethodPrivateKeyJWT
+	case rr.clientSecretBasic:
+		return oidc.AuthMethodClientSecretBasic
+	case rr.ClientSecret != "":
+		return konnectoidc.AuthMethodClientSecretPost
+	}
+
+	return oidc.AuthMethodNone
+}
+
+// Validate validates the request data of the accociated revocation request.
+func (rr *RevocationRequest) Validate() error {
+	if err := validateClientAssertionParameters(rr.ClientAssertionType, rr.ClientAssertion, rr.ClientSecret); err != nil {
+		return err
+	}
+
+	if rr.Token == "" {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "missing token")
+	}
+
+	return nil
+}
@@ -27,4 +27,8 @@ type Session struct {
 	ID       string
 	Sub      string
 	Provider string
+
+	// Clients holds the IDs of the clients with front-channel logout
+	// which were authorized within the Session.
+	Clients []string
 }
@@ -19,10 +19,13 @@ package payload
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"stash.kopano.io/kgol/oidc-go"
@@ -36,6 +39,8 @@ import (
 type TokenRequest struct {
 	providerMetadata *oidc.WellKnown
 
+	clientSecretBasic bool
+
 	GrantType       string `schema:"grant_type"`
 	Code            string `schema:"code"`
 	RawRedirectURI  string `schema:"redirect_uri"`
@@ -45,6 +50,9 @@ type TokenRequest struct {
 	ClientID     string `schema:"client_id"`
 	ClientSecret string `schema:"client_secret"`
 
+	ClientAssertionType string `schema:"client_assertion_type"`
+	ClientAssertion     string `schema:"client_assertion"`
+
 	CodeVerifier string `schema:"code_verifier"`
 
 	RedirectURI  *url.URL        `schema:"-"`
@@ -60,31 +68,51 @@ func DecodeTokenRequest(req *http.Request, providerMetadata *oidc.WellKnown) (*T
 		return nil, err
 	}
 
+	clientID, clientSecret, ok, err := decodeClientSecretBasic(req)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		tr.ClientID = clientID
+		tr.ClientSecret = clientSecret
+		tr.clientSecretBasic = true
+	}
+
+	return tr, nil
+}
+
+// decodeClientSecretBasic returns the client id and secret of the Basic
+// authorization header of the provided request and true, or false if the
+// request has no Basic authorization header.
+func decodeClientSecretBasic(req *http.Request) (string, string, bool, error) {
 	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
-	switch auth[0] {
-	case "Basic":
-		if len(auth) != 2 {
-			return nil, fmt.Errorf("invalid Basic authorization header format")
-		}
-		var basic []byte
-		if basic, err = base64.StdEncoding.DecodeString(auth[1]); err != nil {
-			return nil, err
-		}
-		// Split client id and secret.
-		check := strings.SplitN(string(basic), ":", 2)
-		// Data is encoded application/x-www-form-urlencoded UTF-8. See
-		// https://tools.ietf.org/html/rfc6749#appendix-B for details.
-		tr.ClientID, err = url.QueryUnescape(check[0])
-		if err != nil {
-			return nil, err
-		}
-		tr.ClientSecret, err = url.QueryUnescape(check[1])
-		if err != nil {
-			return nil, err
-		}
+	if auth[0] != "Basic" {
+		return "", "", false, nil
+	}
+	if len(auth) != 2 {
+		return "", "", false, fmt.Errorf("invalid Basic authorization header format")
+	}
+	basic, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return "", "", false, err
+	}
+	// Split client id and secret.
+	check := strings.SplitN(string(basic), ":", 2)
+	if len(check) != 2 {
+		return "", "", false, fmt.Errorf("invalid Basic authorization header format")
+	}
+	// Data is encoded application/x-www-form-urlencoded UTF-8. See
+	// https://tools.ietf.org/html/rfc6749#appendix-B for details.
+	clientID, err := url.QueryUnescape(check[0])
+	if err != nil {
+		return "", "", false, err
+	}
+	clientSecret, err := url.QueryUnescape(check[1])
+	if err != nil {
+		return "", "", false, err
 	}
 
-	return tr, err
+	return clientID, clientSecret, true, nil
 }
 
 // NewTokenRequest returns a TokenRequest holding the provided url values.
@@ -111,11 +139,33 @@ func NewTokenRequest(values url.Values, providerMetadata *oidc.WellKnown) (*Toke
 	return tr, nil
 }
 
+// ClientAuthMethod returns the token endpoint authentication method used by
+// the accociated token request. Mutual TLS client authentication is not part
+// of the request data and thus is never returned.
+func (tr *TokenRequest) ClientAuthMethod() string {
+	switch {
+	case tr.ClientAssertion != "":
+		return konnectoidc.AuthMethodPrivateKeyJWT
+	case tr.clientSecretBasic:
+		return oidc.AuthMethodClientSecretBasic
+	case tr.ClientSecret != "":
+		return konnectoidc.AuthMethodClientSecretPost
+	}
+
+	return oidc.AuthMethodNone
+}
+
 // Validate validates the request data of the accociated token request.
 func (tr *TokenRequest) Validate(keyFunc jwt.Keyfunc, claims jwt.Claims) error {
+	if err := validateClientAssertionParameters(tr.ClientAssertionType, tr.ClientAssertion, tr.ClientSecret); err != nil {
+		return err
+	}
+
 	switch tr.GrantType {
 	case oidc.GrantTypeAuthorizationCode:
 		// breaks
+	case konnectoidc.GrantTypeClientCredentials:
+		// breaks
 	case oidc.GrantTypeRefreshToken:
 		if tr.RawRefreshToken != "" {
 			refreshToken, err := jwt.ParseWithClaims(tr.RawRefreshToken, claims, func(token *jwt.Token) (interface{}, error) {
@@ -139,6 +189,26 @@ func (tr *TokenRequest) Validate(keyFunc jwt.Keyfunc, claims jwt.Claims) error {
 	return nil
 }
 
+// validateClientAssertionParameters validates the provided client assertion
+// request parameters, if any.
+func validateClientAssertionParameters(clientAssertionType string, clientAssertion string, clientSecret string) error {
+	if clientAssertionType != "" || clientAssertion != "" {
+		// Client authentication with JWT client assertion according to
+		// https://tools.ietf.org/html/rfc7523#section-2.2
+		if clientAssertionType != konnectoidc.ClientAssertionTypeJWTBearer {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "unsupported client_assertion_type")
+		}
+		if clientAssertion == "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "missing client_assertion")
+		}
+		if clientSecret != "" {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "multiple client authentication methods")
+		}
+	}
+
+	return nil
+}
+
 // TokenSuccess holds the outgoing data for a successful OpenID
 // Connect 1.0 token request as specified at
 // http://openid.net/specs/openid-connect-core-1_0.html#TokenResponse.
@@ -148,4 +218,48 @@ type TokenSuccess struct {
 	IDToken      string `json:"id_token,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
 	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// ClientAssertionClaims define the claims of JWT client assertions as
+// specified at https://tools.ietf.org/html/rfc7523#section-3.
+type ClientAssertionClaims struct {
+	Issuer      string          `json:"iss"`
+	Subject     string          `json:"sub"`
+	RawAudience json.RawMessage `json:"aud"`
+	ExpiresAt   int64           `json:"exp"`
+	IssuedAt    int64           `json:"iat,omitempty"`
+	NotBefore   int64           `json:"nbf,omitempty"`
+	ID          string          `json:"jti,omitempty"`
+}
+
+// Valid implements the jwt.Claims interface.
+func (c *ClientAssertionClaims) Valid() error {
+	now := time.Now().Unix()
+	if c.ExpiresAt == 0 {
+		return errors.New("missing exp claim")
+	}
+	if now > c.ExpiresAt {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != 0 && now < c.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// Audience returns the audience values of the accociated claims. The aud claim
+// can either be a single string or an array of strings.
+func (c *ClientAssertionClaims) Audience() []string {
+	var single string
+	if err := json.Unmarshal(c.RawAudience, &single); err == nil {
+		return []string{single}
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.RawAudience, &multiple); err == nil {
+		return multiple
+	}
+
+	return nil
 }
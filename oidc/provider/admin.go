@@ -0,0 +1,227 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// maxKeySize is the maximum size of key data accepted by the KeysAdminHandler.
+const maxKeySize = 64 * 1024
+
+// KeysAdminHandler is a http handler to show and change the signing and
+// validation keys of a Provider at runtime, protected by a bearer token.
+//
+// NOTE: Changed keys are only kept in memory of the Provider. They are not
+// shared with other instances and are lost on restart, so with multiple
+// instances every instance must be changed the same way and keys which should
+// survive a restart must be added to the key configuration as well.
+type KeysAdminHandler struct {
+	path        string
+	provider    *Provider
+	token       []byte
+	parseSigner func([]byte) (string, crypto.Signer, error)
+
+	logger logrus.FieldLogger
+}
+
+// NewKeysAdminHandler creates a new KeysAdminHandler for the provided provider
+// at the provided path, requiring the provided bearer token. The provided
+// parseSigner function is used to parse uploaded signing keys and returns the
+// key id found in the key data, if any.
+func NewKeysAdminHandler(path string, provider *Provider, token string, parseSigner func([]byte) (string, crypto.Signer, error), logger logrus.FieldLogger) *KeysAdminHandler {
+	return &KeysAdminHandler{
+		path:        path,
+		provider:    provider,
+		token:       []byte(token),
+		parseSigner: parseSigner,
+
+		logger: logger,
+	}
+}
+
+// AddRoutes add the accociated KeysAdminHandler's URL routes to the provided
+// router with the provided context.Context.
+func (h *KeysAdminHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(h.path, h).Methods(http.MethodGet)
+	router.Handle(h.path+"/{kid}", h).Methods(http.MethodPut, http.MethodDelete)
+	router.Handle(h.path+"/{kid}/promote", h).Methods(http.MethodPost)
+}
+
+// ServeHTTP implements the http.Handler interface. GET returns the current
+// keys and their status. PUT with key data as request body adds a pending
+// signing key, POST to promote makes a pending signing key active and DELETE
+// retires a key.
+func (h *KeysAdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !utils.RequireBearerToken(rw, req, h.token) {
+		return
+	}
+
+	var err error
+	kid := mux.Vars(req)["kid"]
+
+	switch req.Method {
+	case http.MethodPut:
+		var body []byte
+		body, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxKeySize))
+		if err != nil {
+			http.Error(rw, "failed to read key", http.StatusBadRequest)
+			return
+		}
+		keyID, signer, parseErr := h.parseSigner(body)
+		if parseErr != nil {
+			h.logger.WithError(parseErr).Debugln("keys admin request with invalid key")
+			http.Error(rw, "invalid key", http.StatusBadRequest)
+			return
+		}
+		if keyID != "" && keyID != kid {
+			http.Error(rw, "kid mismatch", http.StatusBadRequest)
+			return
+		}
+		err = h.provider.AddPendingSigningKey(kid, signer)
+	case http.MethodPost:
+		err = h.provider.PromoteSigningKey(kid)
+	case http.MethodDelete:
+		err = h.provider.RetireKey(kid)
+	}
+
+	switch err {
+	case nil:
+		if kid != "" {
+			h.logger.WithFields(logrus.Fields{
+				"id":     kid,
+				"method": req.Method,
+			}).Warnln("provider keys changed via admin endpoint, the change applies to this instance only and is lost on restart")
+		}
+	case ErrKeyUnknown:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	case ErrKeyExists, ErrKeyInvalidStatus:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	err = utils.WriteJSON(rw, http.StatusOK, map[string]interface{}{
+		"keys": h.provider.Keys(),
+	}, "")
+	if err != nil {
+		h.logger.WithError(err).Errorln("keys admin request failed writing response")
+	}
+}
+
+// maxClaimsPreviewRequestSize is the maximum size of request bodies accepted by
+// the ClaimsPreviewAdminHandler.
+const maxClaimsPreviewRequestSize = 16 * 1024
+
+// ClaimsPreviewRequest is the request body of the ClaimsPreviewAdminHandler.
+type ClaimsPreviewRequest struct {
+	ClientID     string `json:"client_id"`
+	UserID       string `json:"user_id"`
+	Scope        string `json:"scope"`
+	ResponseType string `json:"response_type"`
+}
+
+// ClaimsPreviewAdminHandler is a http handler to show the claims a Provider
+// would issue to a client for a user, protected by a bearer token.
+type ClaimsPreviewAdminHandler struct {
+	path     string
+	provider *Provider
+	token    []byte
+
+	logger logrus.FieldLogger
+}
+
+// NewClaimsPreviewAdminHandler creates a new ClaimsPreviewAdminHandler for the
+// provided provider at the provided path, requiring the provided bearer token.
+func NewClaimsPreviewAdminHandler(path string, provider *Provider, token string, logger logrus.FieldLogger) *ClaimsPreviewAdminHandler {
+	return &ClaimsPreviewAdminHandler{
+		path:     path,
+		provider: provider,
+		token:    []byte(token),
+
+		logger: logger,
+	}
+}
+
+// AddRoutes add the accociated ClaimsPreviewAdminHandler's URL routes to the
+// provided router with the provided context.Context.
+func (h *ClaimsPreviewAdminHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(h.path, h).Methods(http.MethodPost)
+}
+
+// ServeHTTP implements the http.Handler interface. POST with a JSON encoded
+// ClaimsPreviewRequest as request body returns the claims of the ID token,
+// access token and userinfo response for the requested client, user and
+// space separated scopes. A response_type of id_token previews an ID token
+// which is issued without access token.
+func (h *ClaimsPreviewAdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !utils.RequireBearerToken(rw, req, h.token) {
+		return
+	}
+
+	var pr ClaimsPreviewRequest
+	err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxClaimsPreviewRequestSize)).Decode(&pr)
+	if err != nil {
+		http.Error(rw, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if pr.ClientID == "" || pr.UserID == "" {
+		http.Error(rw, "client_id and user_id are required", http.StatusBadRequest)
+		return
+	}
+	scopes := make(map[string]bool)
+	for _, scope := range strings.Fields(pr.Scope) {
+		scopes[scope] = true
+	}
+
+	preview, err := h.provider.PreviewClaims(req.Context(), pr.ClientID, pr.UserID, scopes, pr.ResponseType != oidc.ResponseTypeIDToken)
+	switch err {
+	case nil:
+		h.logger.WithFields(logrus.Fields{
+			"client_id": pr.ClientID,
+			"user_id":   pr.UserID,
+		}).Debugln("claims preview via admin endpoint")
+	case ErrPreviewUnknownClient, ErrPreviewUnknownUser:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	err = utils.WriteJSON(rw, http.StatusOK, preview, "")
+	if err != nil {
+		h.logger.WithError(err).Errorln("claims preview admin request failed writing response")
+	}
+}
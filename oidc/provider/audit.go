@@ -0,0 +1,161 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/audit"
+	"stash.kopano.io/kc/konnect/identity"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// Endpoint names of audit events.
+const (
+	auditEndpointAuthorize  = "authorize"
+	auditEndpointToken      = "token"
+	auditEndpointEndSession = "endsession"
+)
+
+// Reasons of token_rejected audit events.
+const (
+	auditReasonDisallowedAlg        = "disallowed_alg"
+	auditReasonTokenBindingMismatch = "token_binding_mismatch"
+)
+
+// newAuditEvent creates a new audit event of the provided type for the
+// provided request, which can be nil when there is no request.
+func (p *Provider) newAuditEvent(req *http.Request, eventType string, endpoint string) *audit.Event {
+	event := audit.NewEvent(eventType)
+	event.Issuer = p.issuerIdentifier
+	event.Endpoint = endpoint
+	if req != nil {
+		event.SetRemoteAddr(p.getClientIP(req), p.Config.Config.GeoIP)
+		event.RequestID, _ = konnect.FromRequestIDContext(req.Context())
+	}
+
+	return event
+}
+
+// auditTokensIssued emits a token_issued audit event for the provided tokens
+// issued with the provided request. Nothing is emitted if no token was
+// issued.
+func (p *Provider) auditTokensIssued(req *http.Request, endpoint string, ar *payload.AuthenticationRequest, auth identity.AuthRecord, session *payload.Session, grantType string, accessTokenString string, idTokenString string, refreshTokenString string) {
+	webhook := p.Config.Config.AuditWebhook
+	if webhook == nil {
+		return
+	}
+
+	var tokens []string
+	if accessTokenString != "" {
+		tokens = append(tokens, audit.TokenAccessToken)
+	}
+	if idTokenString != "" {
+		tokens = append(tokens, audit.TokenIDToken)
+	}
+	if refreshTokenString != "" {
+		tokens = append(tokens, audit.TokenRefreshToken)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+
+	event := p.newAuditEvent(req, audit.EventTypeTokenIssued, endpoint)
+	event.ClientID = ar.ClientID
+	event.GrantType = grantType
+	event.ResponseType = ar.RawResponseType
+	event.Tokens = tokens
+	if auth != nil {
+		event.Subject = auth.Subject()
+		for scope, granted := range auth.AuthorizedScopes() {
+			if granted {
+				event.Scopes = append(event.Scopes, scope)
+			}
+		}
+		sort.Strings(event.Scopes)
+	}
+	if session != nil {
+		event.SessionID = session.ID
+	}
+
+	webhook.Emit(event)
+}
+
+// auditLogout emits a logout audit event for the provided session ended
+// with the provided request.
+func (p *Provider) auditLogout(req *http.Request, esr *payload.EndSessionRequest, session *payload.Session) {
+	webhook := p.Config.Config.AuditWebhook
+	if webhook == nil {
+		return
+	}
+
+	event := p.newAuditEvent(req, audit.EventTypeLogout, auditEndpointEndSession)
+	event.ClientID = esr.ClientID
+	if session != nil {
+		event.Subject = session.Sub
+		event.SessionID = session.ID
+	}
+
+	webhook.Emit(event)
+}
+
+// auditRefreshTokenReused logs and emits a refresh_token_reused audit event
+// for the reused refresh token with the provided claims presented with the
+// provided request.
+func (p *Provider) auditRefreshTokenReused(req *http.Request, claims *konnect.RefreshTokenClaims) {
+	p.logger.WithFields(logrus.Fields{
+		"client_id": claims.Audience,
+		"sub":       claims.Subject,
+		"family":    claims.Family,
+		"jti":       claims.Id,
+		"remote":    p.getClientIP(req),
+	}).Warnln("refresh token reuse detected, revoked refresh token family")
+
+	webhook := p.Config.Config.AuditWebhook
+	if webhook == nil {
+		return
+	}
+
+	event := p.newAuditEvent(req, audit.EventTypeRefreshTokenReused, auditEndpointToken)
+	event.ClientID = claims.Audience
+	event.Subject = claims.Subject
+	event.SessionID = claims.SessionID
+	event.GrantType = oidc.GrantTypeRefreshToken
+
+	webhook.Emit(event)
+}
+
+// auditTokenRejected emits a token_rejected audit event for the token of the
+// provided kind, which was rejected with the provided request for the
+// provided reason.
+func (p *Provider) auditTokenRejected(req *http.Request, kind string, reason string) {
+	webhook := p.Config.Config.AuditWebhook
+	if webhook == nil {
+		return
+	}
+
+	event := p.newAuditEvent(req, audit.EventTypeTokenRejected, "")
+	event.Tokens = []string{kind}
+	event.Reason = reason
+
+	webhook.Emit(event)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/identity/clients"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// getTokenBinding returns the token binding for tokens issued to the provided
+// client registration, which is the registration's own token binding if set
+// and the globally configured token binding otherwise.
+func (p *Provider) getTokenBinding(registration *clients.ClientRegistration) *clients.TokenBinding {
+	if registration != nil && registration.TokenBinding != nil {
+		return registration.TokenBinding
+	}
+
+	return p.tokenBinding
+}
+
+// makeTokenBindingClaims returns the claims which bind tokens to the provided
+// request according to the provided token binding. Returns nil if tokens are
+// not bound.
+func (p *Provider) makeTokenBindingClaims(req *http.Request, binding *clients.TokenBinding) *konnect.TokenBindingClaims {
+	if !binding.Enabled() {
+		return nil
+	}
+
+	claims := &konnect.TokenBindingClaims{}
+	if binding.IP {
+		ipv4Prefix, ipv6Prefix := binding.IPPrefixes()
+		ip := net.ParseIP(p.getClientIP(req))
+		switch {
+		case ip == nil:
+			// NOTE: Without client IP, tokens stay unbound to the IP. This
+			// only happens with unusual listeners like unix sockets.
+			p.logger.WithField("remote_addr", req.RemoteAddr).Debugln("token binding without client ip")
+		case ip.To4() != nil:
+			mask := net.CIDRMask(ipv4Prefix, 32)
+			claims.IPNet = (&net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}).String()
+		default:
+			mask := net.CIDRMask(ipv6Prefix, 128)
+			claims.IPNet = (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+		}
+	}
+	if binding.UserAgent {
+		claims.UserAgentHash = hashUserAgent(req.UserAgent())
+	}
+
+	return claims
+}
+
+// validateTokenBinding checks that the provided request matches the provided
+// token binding claims of a token of the provided kind. Tokens without token
+// binding claims are always valid.
+func (p *Provider) validateTokenBinding(req *http.Request, kind string, claims *konnect.TokenBindingClaims) error {
+	if claims == nil {
+		return nil
+	}
+
+	var mismatch string
+	if claims.IPNet != "" {
+		_, ipNet, err := net.ParseCIDR(claims.IPNet)
+		ip := net.ParseIP(p.getClientIP(req))
+		if err != nil || ip == nil || !ipNet.Contains(ip) {
+			mismatch = "ip"
+		}
+	}
+	if mismatch == "" && claims.UserAgentHash != "" {
+		if subtle.ConstantTimeCompare([]byte(hashUserAgent(req.UserAgent())), []byte(claims.UserAgentHash)) != 1 {
+			mismatch = "user_agent"
+		}
+	}
+	if mismatch == "" {
+		return nil
+	}
+
+	p.logger.WithFields(logrus.Fields{
+		"kind":    kind,
+		"binding": mismatch,
+	}).Warnln("audit: rejected token with token binding mismatch")
+	p.auditTokenRejected(req, kind, auditReasonTokenBindingMismatch+"_"+mismatch)
+
+	return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "token binding mismatch")
+}
+
+// getClientIP returns the IP address of the client of the provided request,
+// honoring the configured trusted proxies.
+func (p *Provider) getClientIP(req *http.Request) string {
+	return utils.ClientIPFromRequest(req, p.Config.Config.TrustedProxyClientIPHeader, p.Config.Config.TrustedProxyIPs, p.Config.Config.TrustedProxyNets)
+}
+
+// hashUserAgent returns the URL safe base64 encoded SHA-256 hash of the
+// provided user agent.
+func hashUserAgent(userAgent string) string {
+	sum := sha256.Sum256([]byte(userAgent))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
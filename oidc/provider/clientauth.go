@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identity/clients"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// defaultClientAssertionSigningAlgs are the signing algorithms which are
+// accepted for client assertions and signed request objects, if not
+// configured otherwise.
+var defaultClientAssertionSigningAlgs = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodPS256.Alg(),
+}
+
+// makeClientAssertionSigningAlgs validates the provided algs and returns them,
+// or the default algs if none are provided.
+func makeClientAssertionSigningAlgs(algs []string) ([]string, error) {
+	if len(algs) == 0 {
+		return defaultClientAssertionSigningAlgs, nil
+	}
+
+	for _, alg := range algs {
+		if alg == jwt.SigningMethodNone.Alg() {
+			return nil, fmt.Errorf("client assertion signing alg %v is not allowed", alg)
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown client assertion signing alg: %v", alg)
+		}
+	}
+
+	return uniqueStrings(algs), nil
+}
+
+// isClientAssertionSigningAlgAllowed returns true if the provided alg is
+// allowed for client assertions and signed request objects.
+func (p *Provider) isClientAssertionSigningAlgAllowed(alg string) bool {
+	if alg == jwt.SigningMethodNone.Alg() {
+		// Never allow none.
+		return false
+	}
+	for _, allowed := range p.clientAssertionSigningAlgs {
+		if alg == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateClientAssertion validates the provided JWT client assertion for the
+// client with the provided client ID as specified at
+// https://tools.ietf.org/html/rfc7523#section-3. The client ID is optional and
+// is taken from the assertion if empty. On success, the validated client's
+// registration is returned.
+func (p *Provider) validateClientAssertion(req *http.Request, clientID string, assertion string) (*clients.ClientRegistration, error) {
+	ctx := req.Context()
+	var registration *clients.ClientRegistration
+
+	parser := &jwt.Parser{
+		ValidMethods: p.clientAssertionSigningAlgs,
+	}
+	token, err := parser.ParseWithClaims(assertion, &payload.ClientAssertionClaims{}, p.strictKeyfunc(req, "client_assertion", func(token *jwt.Token) (interface{}, error) {
+		if !p.isClientAssertionSigningAlgAllowed(token.Method.Alg()) {
+			return nil, fmt.Errorf("client assertion alg not allowed")
+		}
+
+		claims, _ := token.Claims.(*payload.ClientAssertionClaims)
+		if claims.Subject == "" || claims.Issuer != claims.Subject {
+			return nil, fmt.Errorf("client assertion iss and sub mismatch")
+		}
+		if clientID != "" && claims.Subject != clientID {
+			return nil, fmt.Errorf("client assertion sub does not match client_id")
+		}
+
+		var ok bool
+		registration, ok = p.clients.Get(ctx, claims.Subject)
+		if !ok {
+			return nil, fmt.Errorf("unknown client")
+		}
+		if registration.RawTokenEndpointAuthMethod != konnectoidc.AuthMethodPrivateKeyJWT {
+			return nil, fmt.Errorf("client does not use private_key_jwt")
+		}
+		if registration.RawTokenEndpointAuthSigningAlg != "" && token.Method.Alg() != registration.RawTokenEndpointAuthSigningAlg {
+			return nil, fmt.Errorf("client assertion alg does not match client registration")
+		}
+
+		secureClient, err := p.clients.Secure(ctx, registration, token.Header[oidc.JWTHeaderKeyID])
+		if err != nil {
+			return nil, err
+		}
+		return secureClient.PublicKey, nil
+	}))
+	if err != nil {
+		return nil, konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, err.Error())
+	}
+
+	// The token endpoint URL must be included in the audience.
+	audienceOK := false
+	for _, audience := range token.Claims.(*payload.ClientAssertionClaims).Audience() {
+		if audience == p.getMetadata().TokenEndpoint || audience == p.issuerIdentifier {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, "client assertion aud mismatch")
+	}
+
+	return registration, nil
+}
+
+// clientAllowsGrantType returns true if the client of the provided details is
+// allowed to use the provided grant type. Clients without registration are
+// allowed to use all grant types.
+func clientAllowsGrantType(clientDetails *clients.Details, grantType string) bool {
+	if clientDetails == nil || clientDetails.Registration == nil {
+		return true
+	}
+
+	return clientDetails.Registration.AllowsGrantType(grantType)
+}
+
+// validateTokenEndpointAuthMethod checks that the provided used token endpoint
+// authentication method is the token endpoint authentication method of the
+// provided client registration. Registrations without token endpoint
+// authentication method accept client_secret_basic and client_secret_post.
+func validateTokenEndpointAuthMethod(registration *clients.ClientRegistration, used string) error {
+	switch registration.RawTokenEndpointAuthMethod {
+	case "":
+		if used != oidc.AuthMethodClientSecretBasic && used != konnectoidc.AuthMethodClientSecretPost && used != oidc.AuthMethodNone {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, "client authentication method not allowed for client")
+		}
+	case konnectoidc.AuthMethodTLSClientAuth, konnectoidc.AuthMethodSelfSignedTLSClientAuth:
+		if used != oidc.AuthMethodNone {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, "client requires tls client authentication")
+		}
+	case konnectoidc.AuthMethodPrivateKeyJWT:
+		if used != konnectoidc.AuthMethodPrivateKeyJWT {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, "client_assertion required")
+		}
+	case oidc.AuthMethodNone:
+		if used != oidc.AuthMethodNone {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, "public client must not authenticate")
+		}
+	default:
+		if used != registration.RawTokenEndpointAuthMethod {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, fmt.Sprintf("client requires %s", registration.RawTokenEndpointAuthMethod))
+		}
+	}
+
+	return nil
+}
+
+// authenticateClient authenticates the client of the provided request with the
+// provided client credentials, the client certificate of the request or the
+// provided JWT client assertion, using the provided token endpoint
+// authentication method. On success, the authenticated client's details and
+// the client certificate of the request, if any, are returned.
+func (p *Provider) authenticateClient(req *http.Request, clientID string, clientSecret string, clientAssertion string, authMethod string, redirectURI *url.URL) (*clients.Details, *x509.Certificate, error) {
+	var withoutSecret bool
+
+	clientCertificate, err := p.getClientCertificate(req)
+	if err != nil {
+		return nil, nil, konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
+	}
+	if registration, ok := p.clients.Get(req.Context(), clientID); ok {
+		// Enforce the registered client authentication method.
+		err = validateTokenEndpointAuthMethod(registration, authMethod)
+		if err != nil {
+			return nil, nil, err
+		}
+		if registration.UsesTLSClientAuth() {
+			// Mutual TLS client authentication according to https://tools.ietf.org/html/rfc8705#section-2
+			err = registration.ValidateTLSClientCertificate(clientCertificate)
+			if err != nil {
+				return nil, nil, konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, err.Error())
+			}
+			withoutSecret = true
+		} else if registration.RawTokenEndpointAuthMethod == oidc.AuthMethodNone {
+			// Public clients have no means to authenticate.
+			withoutSecret = true
+		}
+	}
+	if clientAssertion != "" {
+		// JWT client assertion client authentication according to https://tools.ietf.org/html/rfc7523#section-3
+		registration, validateErr := p.validateClientAssertion(req, clientID, clientAssertion)
+		if validateErr != nil {
+			return nil, nil, validateErr
+		}
+		clientID = registration.ID
+		withoutSecret = true
+	}
+
+	clientDetails, err := p.clients.Lookup(req.Context(), clientID, clientSecret, redirectURI, "", withoutSecret)
+	if err != nil {
+		return nil, nil, konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidClient, err.Error())
+	}
+
+	return clientDetails, clientCertificate, nil
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+
+	"stash.kopano.io/kc/konnect/oidc/code"
+	"stash.kopano.io/kc/konnect/tracing"
+)
+
+// createCode creates a new code for the provided record with the accociated
+// provider's code manager.
+func (p *Provider) createCode(ctx context.Context, record *code.Record) (string, error) {
+	_, span := tracing.Start(ctx, "code.create")
+	defer span.End()
+
+	codeString, err := p.codeManager.Create(record)
+	span.SetError(err)
+
+	return codeString, err
+}
+
+// popCode returns and removes the record of the provided code from the
+// accociated provider's code manager.
+func (p *Provider) popCode(ctx context.Context, codeString string) (*code.Record, bool) {
+	_, span := tracing.Start(ctx, "code.pop")
+	defer span.End()
+
+	record, found := p.codeManager.Pop(codeString)
+	span.SetAttributes(tracing.Bool("found", found))
+
+	return record, found
+}
@@ -18,9 +18,51 @@
 package provider
 
 import (
+	"crypto"
 	"time"
 
 	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identity/clients"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// Refresh token rotation modes.
+const (
+	RefreshTokenRotationNone   = "none"
+	RefreshTokenRotationPublic = "public"
+	RefreshTokenRotationAll    = "all"
+)
+
+// MaxRefreshTokenReuseGrace is the maximum reuse grace window of rotated
+// refresh tokens. Longer windows would weaken reuse detection.
+const MaxRefreshTokenReuseGrace = time.Minute
+
+// Access token types, used as typ header of issued JWT access tokens.
+const (
+	AccessTokenTypeJWT   = "JWT"
+	AccessTokenTypeATJWT = "at+jwt"
+)
+
+// Claims in ID token policies, defining which claims released for the granted
+// scopes are included in ID tokens.
+const (
+	ClaimsInIDTokenMinimal = "minimal"
+	ClaimsInIDTokenFull    = "full"
+)
+
+// Claims placements, defining where the claims released for a scope appear.
+const (
+	ClaimsPlacementIDToken  = "id_token"
+	ClaimsPlacementUserInfo = "userinfo"
+	ClaimsPlacementBoth     = "both"
+)
+
+// Unknown scope behaviors, defining how requested scopes which are not
+// supported are handled.
+const (
+	UnknownScopeBehaviorPassthrough = "passthrough"
+	UnknownScopeBehaviorIgnore      = "ignore"
+	UnknownScopeBehaviorError       = "error"
 )
 
 // Config defines a Provider's configuration settings.
@@ -37,6 +79,20 @@ type Config struct {
 	CheckSessionIframePath string
 	RegistrationPath       string
 
+	// RevocationPath, if set, serves the OAuth 2.0 token revocation endpoint.
+	// Revoked access tokens are only rejected when a revocation manager is
+	// registered with the managers of the provider.
+	RevocationPath string
+
+	// AdditionalWellKnownPaths are served with the discovery document in
+	// addition to WellKnownPath.
+	AdditionalWellKnownPaths []string
+
+	// AdditionalIssuerIdentifiers are accepted as iss of incoming tokens in
+	// addition to IssuerIdentifier. New tokens are always issued with
+	// IssuerIdentifier.
+	AdditionalIssuerIdentifiers []string
+
 	BrowserStateCookiePath string
 	BrowserStateCookieName string
 
@@ -46,4 +102,105 @@ type Config struct {
 	AccessTokenDuration  time.Duration
 	IDTokenDuration      time.Duration
 	RefreshTokenDuration time.Duration
+
+	// AccessTokenType is the typ header of issued access tokens. If empty,
+	// at+jwt is used as defined by RFC 9068. Other tokens always use JWT.
+	AccessTokenType string
+
+	// RefreshTokenRotation selects the clients for which refresh tokens are
+	// one-time-use and rotated on every refresh. Empty means none.
+	RefreshTokenRotation string
+
+	// TokenBinding, if set, binds access and refresh tokens to the client IP
+	// network and or the user agent of the request they are issued for. Client
+	// registrations can replace it with their own token binding.
+	TokenBinding *clients.TokenBinding
+
+	// ClientAssertionSigningAlgs are the signing algorithms which are accepted
+	// for client assertions and signed request objects. If empty, RS256,
+	// ES256 and PS256 are accepted. The none algorithm is never accepted.
+	ClientAssertionSigningAlgs []string
+
+	// RegistrationInitialAccessToken, if set, must be sent as Bearer token
+	// with dynamic client registration requests.
+	RegistrationInitialAccessToken string
+	// RegistrationInitialAccessTokenKeys, if set, are used to validate JWT
+	// initial access tokens sent as Bearer token with dynamic client
+	// registration requests. The keys are mapped by kid.
+	RegistrationInitialAccessTokenKeys map[string]crypto.PublicKey
+
+	// UserInfoRequireAudience, if true, requires access tokens sent to the
+	// userinfo endpoint to contain the issuer identifier in their aud claim.
+	UserInfoRequireAudience bool
+
+	// AllowEndSessionWithoutIDTokenHint, if true, allows end session requests
+	// with post_logout_redirect_uri to identify the client with client_id
+	// instead of id_token_hint.
+	AllowEndSessionWithoutIDTokenHint bool
+
+	// RegisteredClientsOnly, if true, rejects authorize requests of clients
+	// which are not registered, including unregistered clients which would be
+	// implicitly trusted since they redirect to the issuer's origin.
+	RegisteredClientsOnly bool
+
+	// AllowRequestURI, if true, allows authorize requests to reference their
+	// request object with request_uri. Only request_uris which are registered
+	// for the requesting client are fetched.
+	AllowRequestURI bool
+
+	// RequestLimits define the maximum number and sizes of parameters of
+	// authorize and token requests. If nil, the default limits are used.
+	RequestLimits *payload.RequestLimits
+
+	// UnknownScopeBehavior defines how requested scopes which are not
+	// supported are handled by authorize and token requests. One of the
+	// UnknownScopeBehavior values, defaults to UnknownScopeBehaviorPassthrough
+	// which leaves them to the identity manager.
+	UnknownScopeBehavior string
+
+	// ClaimsInIDToken defines which claims released for the granted scopes
+	// are included in ID tokens. With ClaimsInIDTokenMinimal, they are only
+	// included when no access token is issued together with the ID token,
+	// since they are available via userinfo otherwise. With
+	// ClaimsInIDTokenFull, they are always included. Defaults to
+	// ClaimsInIDTokenMinimal.
+	ClaimsInIDToken string
+
+	// ClaimsPlacement maps scopes to one of the ClaimsPlacement values, to
+	// place the claims released for them into ID tokens, userinfo responses
+	// or both regardless of ClaimsInIDToken. Claims which are requested with
+	// the claims request parameter are always released where requested.
+	ClaimsPlacement map[string]string
+
+	// AccessTokenClaims maps scopes to the names of claims of the user which
+	// are added to access tokens when the scope is authorized. Reserved access
+	// token claims are not allowed.
+	AccessTokenClaims map[string][]string
+
+	// TemplatesPath, if set, is the directory from which templates are loaded
+	// which replace the built-in templates of server rendered pages with the
+	// same file name. See the TemplateName values for supported pages.
+	TemplatesPath string
+
+	// ErrorURIBase is prefixed to the error code to create the error_uri of
+	// error responses. If empty, no error_uri is returned.
+	ErrorURIBase string
+
+	// ClientErrorLogLimit, if greater than zero, limits the number of logged
+	// client errors per error code and minute. Further client errors with the
+	// same error code are counted and the count is logged with the next log of
+	// the code. Server errors are always logged.
+	ClientErrorLogLimit int
+
+	// Discovery metadata overrides. Each list replaces the computed default
+	// values of the accociated metadata field. Values prefixed with + extend
+	// the computed or replaced values instead.
+	ClaimsSupported     []string
+	GrantTypesSupported []string
+	ACRValuesSupported  []string
+
+	// AllowOpaqueACRValues, if true, accepts acr_values_supported overrides
+	// which are not supported by the identity manager. Such values have no ACR
+	// policy and are passed along to authorities as is.
+	AllowOpaqueACRValues bool
 }
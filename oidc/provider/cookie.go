@@ -27,9 +27,9 @@ func (p *Provider) setBrowserStateCookie(rw http.ResponseWriter, value string) e
 		Value: value,
 
 		Path:     p.browserStateCookiePath,
-		Secure:   true,
 		HttpOnly: false, // This Cookie is intended to be read by Javascript.
 	}
+	p.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -40,11 +40,11 @@ func (p *Provider) removeBrowserStateCookie(rw http.ResponseWriter) error {
 		Name: p.browserStateCookieName,
 
 		Path:     p.browserStateCookiePath,
-		Secure:   true,
 		HttpOnly: false, // This Cookie is intended to be read by Javascript.
 
 		Expires: farPastExpiryTime,
 	}
+	p.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -56,9 +56,9 @@ func (p *Provider) setSessionCookie(rw http.ResponseWriter, value string) error
 		Value: value,
 
 		Path:     p.sessionCookiePath,
-		Secure:   true,
 		HttpOnly: true,
 	}
+	p.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
@@ -78,11 +78,11 @@ func (p *Provider) removeSessionCookie(rw http.ResponseWriter) error {
 		Name: p.sessionCookieName,
 
 		Path:     p.sessionCookiePath,
-		Secure:   true,
 		HttpOnly: true,
 
 		Expires: farPastExpiryTime,
 	}
+	p.Config.Config.ApplyCookieAttributes(&cookie)
 	http.SetCookie(rw, &cookie)
 
 	return nil
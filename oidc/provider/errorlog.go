@@ -0,0 +1,154 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientErrorLogInterval is the interval in which the number of logged client
+// errors per error code is limited.
+const clientErrorLogInterval = time.Minute
+
+// clientErrorLogSampler limits the number of logged client errors per error
+// code and interval and counts the logs which were suppressed.
+type clientErrorLogSampler struct {
+	sync.Mutex
+
+	limit    int
+	interval time.Duration
+	now      func() time.Time
+
+	entries map[string]*clientErrorLogEntry
+}
+
+type clientErrorLogEntry struct {
+	start      time.Time
+	count      int
+	suppressed uint64
+}
+
+func newClientErrorLogSampler(limit int, interval time.Duration) *clientErrorLogSampler {
+	return &clientErrorLogSampler{
+		limit:    limit,
+		interval: interval,
+		now:      time.Now,
+
+		entries: make(map[string]*clientErrorLogEntry),
+	}
+}
+
+// Sample returns true if a client error with the provided code should be
+// logged, together with the number of logs of the code which were suppressed
+// since the last log which was allowed. A nil sampler allows all logs.
+func (s *clientErrorLogSampler) Sample(code string) (bool, uint64) {
+	if s == nil || s.limit <= 0 {
+		return true, 0
+	}
+
+	now := s.now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.entries[code]
+	if !ok {
+		entry = &clientErrorLogEntry{
+			start: now,
+		}
+		s.entries[code] = entry
+	}
+	if now.Sub(entry.start) >= s.interval {
+		entry.start = now
+		entry.count = 0
+	}
+	if entry.count >= s.limit {
+		entry.suppressed++
+		return false, 0
+	}
+	entry.count++
+	suppressed := entry.suppressed
+	entry.suppressed = 0
+
+	return true, suppressed
+}
+
+// Flush returns the number of suppressed logs per error code for all codes
+// whose interval has rolled over, so that they are not lost when no further
+// client error with the code happens. The entries of these codes are removed.
+func (s *clientErrorLogSampler) Flush() map[string]uint64 {
+	if s == nil || s.limit <= 0 {
+		return nil
+	}
+
+	now := s.now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	var flushed map[string]uint64
+	for code, entry := range s.entries {
+		if now.Sub(entry.start) < s.interval {
+			continue
+		}
+		if entry.suppressed > 0 {
+			if flushed == nil {
+				flushed = make(map[string]uint64)
+			}
+			flushed[code] = entry.suppressed
+		}
+		delete(s.entries, code)
+	}
+
+	return flushed
+}
+
+// clientErrorLogger returns the logger of the accociated provider to log a
+// client error with the provided error code and true, or false if the log is
+// suppressed because too many client errors with the code were logged in the
+// current interval. The returned logger reports the number of suppressed logs
+// since the last one. Server errors must always be logged with the logger of
+// the provider directly.
+func (p *Provider) clientErrorLogger(code string) (logrus.FieldLogger, bool) {
+	flushed := p.clientErrorLogSampler.Flush()
+	for flushedCode, suppressed := range flushed {
+		if flushedCode == code {
+			// Reported with the log of the code below.
+			continue
+		}
+		p.logger.WithFields(logrus.Fields{
+			"error_code": flushedCode,
+			"suppressed": suppressed,
+		}).Warnln("client error logs were suppressed")
+	}
+
+	ok, suppressed := p.clientErrorLogSampler.Sample(code)
+	if !ok {
+		return nil, false
+	}
+	suppressed += flushed[code]
+
+	logger := p.logger.WithField("error_code", code)
+	if suppressed > 0 {
+		logger = logger.WithField("suppressed", suppressed)
+	}
+
+	return logger, true
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"stash.kopano.io/kc/konnect"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// describeError returns a copy of the provided OAuth2 or authentication error
+// with its error_uri set from the configured error URI base of the accociated
+// provider and the request ID of the provided context appended to its
+// description. Other errors are returned unchanged.
+func (p *Provider) describeError(ctx context.Context, err error) error {
+	switch e := err.(type) {
+	case *konnectoidc.OAuth2Error:
+		described := *e
+		described.ErrorURI = p.makeErrorURI(e.ErrorID)
+		described.ErrorDescription = describeWithRequestID(ctx, e.ErrorDescription)
+		return &described
+	case *payload.AuthenticationError:
+		described := *e
+		described.ErrorURI = p.makeErrorURI(e.ErrorID)
+		described.ErrorDescription = describeWithRequestID(ctx, e.ErrorDescription)
+		return &described
+	case *payload.AuthenticationBadRequest:
+		described := *e
+		described.ErrorURI = p.makeErrorURI(e.ErrorID)
+		described.ErrorDescription = describeWithRequestID(ctx, e.ErrorDescription)
+		return &described
+	}
+
+	return err
+}
+
+// makeErrorURI returns the error_uri for the provided error code, by appending
+// it to the configured error URI base. Returns an empty string if no base is
+// configured.
+func (p *Provider) makeErrorURI(id string) string {
+	if p.errorURIBase == "" || id == "" {
+		return ""
+	}
+
+	return p.errorURIBase + id
+}
+
+func describeWithRequestID(ctx context.Context, description string) string {
+	requestID, ok := konnect.FromRequestIDContext(ctx)
+	if !ok || requestID == "" {
+		return description
+	}
+	if description == "" {
+		return fmt.Sprintf("request %s", requestID)
+	}
+
+	return fmt.Sprintf("%s (request %s)", description, requestID)
+}
@@ -19,9 +19,14 @@ package provider
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	jwk "github.com/mendsley/gojwk"
@@ -36,18 +41,40 @@ import (
 	"stash.kopano.io/kc/konnect/oidc/code"
 	"stash.kopano.io/kc/konnect/oidc/payload"
 	"stash.kopano.io/kc/konnect/signing"
+	"stash.kopano.io/kc/konnect/tracing"
 	"stash.kopano.io/kc/konnect/utils"
 )
 
 const (
 	registrationSizeLimit = 1024 * 512
+
+	frontchannelLogoutTimeoutSeconds = 5
 )
 
 // WellKnownHandler implements the HTTP provider configuration endpoint
 // for OpenID Connect 1.0 as specified at https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig
 func (p *Provider) WellKnownHandler(rw http.ResponseWriter, req *http.Request) {
 	// TODO(longsleep): Add caching headers.
-	wellKnown := p.metadata
+	// NOTE: Discovery allows only one issuer, so additional issuers are
+	// advertised in a konnect specific field during migration. The
+	// revocation endpoint is defined by RFC 8414 and the front-channel logout
+	// fields by OpenID Connect Front-Channel Logout 1.0, both are not part of
+	// the OpenID Connect discovery metadata.
+	wellKnown := &struct {
+		*oidc.WellKnown
+		RevocationEndpoint                 string   `json:"revocation_endpoint,omitempty"`
+		FrontchannelLogoutSupported        bool     `json:"frontchannel_logout_supported"`
+		FrontchannelLogoutSessionSupported bool     `json:"frontchannel_logout_session_supported"`
+		AdditionalIssuers                  []string `json:"konnect_additional_issuers,omitempty"`
+	}{
+		WellKnown:                          p.getMetadata(),
+		FrontchannelLogoutSupported:        true,
+		FrontchannelLogoutSessionSupported: true,
+		AdditionalIssuers:                  p.additionalIssuerIdentifiers,
+	}
+	if p.revocationPath != "" {
+		wellKnown.RevocationEndpoint = p.makeIssURL(p.revocationPath)
+	}
 
 	err := utils.WriteJSON(rw, http.StatusOK, wellKnown, "")
 	if err != nil {
@@ -61,9 +88,15 @@ func (p *Provider) JwksHandler(rw http.ResponseWriter, req *http.Request) {
 	// TODO(longsleep): Use better library, or self implemented jwks struct.
 	addResponseHeaders(rw.Header())
 
-	validationKeys := p.validationKeys
+	p.keysMutex.RLock()
+	validationKeys := make(map[string]crypto.PublicKey, len(p.validationKeys))
+	for kid, key := range p.validationKeys {
+		validationKeys[kid] = key
+	}
+	p.keysMutex.RUnlock()
+
 	jwks := &jwk.Key{
-		Keys: make([]*jwk.Key, 0, len(validationKeys)-1),
+		Keys: make([]*jwk.Key, 0, len(validationKeys)),
 	}
 	for kid, key := range validationKeys {
 		keyJwk, err := signing.JWKFromPublicKey(key)
@@ -97,12 +130,32 @@ func (p *Provider) AuthorizeHandler(rw http.ResponseWriter, req *http.Request) {
 	// http://openid.net/specs/openid-connect-core-1_0.html#ImplicitValidation
 	err = req.ParseForm()
 	if err != nil {
-		p.logger.WithError(err).Errorln("authorize request invalid form data")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Errorln("authorize request invalid form data")
+		}
 		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		return
 	}
+	err = p.requestLimits.Check(req.Form)
+	if err != nil {
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Debugln("authorize request exceeds limits")
+		}
+		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.(*konnectoidc.OAuth2Error).Description())
+		return
+	}
+	if p.Config.AllowRequestURI && req.Form.Get("request_uri") != "" {
+		err = p.resolveRequestURI(req)
+		if err != nil {
+			if logger, ok := p.clientErrorLogger(err.(*konnectoidc.OAuth2Error).ErrorID); ok {
+				logger.WithFields(utils.ErrorAsFields(err)).Debugln("authorize request invalid request_uri")
+			}
+			p.ErrorPage(rw, http.StatusBadRequest, err.(*konnectoidc.OAuth2Error).ErrorID, err.(*konnectoidc.OAuth2Error).Description())
+			return
+		}
+	}
 
-	ar, err := payload.DecodeAuthenticationRequest(req, p.metadata, func(token *jwt.Token) (interface{}, error) {
+	ar, err := payload.DecodeAuthenticationRequest(req, p.getMetadata(), p.strictKeyfunc(req, "request_object", func(token *jwt.Token) (interface{}, error) {
 		if claims, ok := token.Claims.(*payload.RequestObjectClaims); ok {
 			// Validate signed request tokens according to spec defined at
 			// https://openid.net/specs/openid-connect-core-1_0.html#SignedRequestObject
@@ -118,18 +171,18 @@ func (p *Provider) AuthorizeHandler(rw http.ResponseWriter, req *http.Request) {
 					// none is allowed in this special case.
 					return jwt.UnsafeAllowNoneSignatureType, nil
 				}
+				if !p.isClientAssertionSigningAlgAllowed(token.Method.Alg()) {
+					return nil, fmt.Errorf("token alg not allowed")
+				}
 				// Get secure client.
-				if registration.JWKS != nil {
-					secureClient, err := registration.Secure(token.Header[oidc.JWTHeaderKeyID])
-					if err != nil {
-						return nil, err
-					}
-					if err := claims.SetSecure(secureClient); err != nil {
-						return nil, err
-					}
-					return secureClient.PublicKey, err
+				secureClient, err := p.clients.Secure(req.Context(), registration, token.Header[oidc.JWTHeaderKeyID])
+				if err != nil {
+					return nil, err
+				}
+				if err := claims.SetSecure(secureClient); err != nil {
+					return nil, err
 				}
-				return nil, fmt.Errorf("no client keys registered")
+				return secureClient.PublicKey, err
 			} else {
 				// Also allow, when client is not registered and the token is unsigned.
 				if token.Method == jwt.SigningMethodNone {
@@ -141,19 +194,64 @@ func (p *Provider) AuthorizeHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		return nil, fmt.Errorf("not validated")
-	})
+	}))
 	if err != nil {
-		p.logger.WithFields(utils.ErrorAsFields(err)).Errorln("authorize request invalid request data")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithFields(utils.ErrorAsFields(err)).Errorln("authorize request invalid request data")
+		}
 		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		return
 	}
-	err = ar.Validate(func(token *jwt.Token) (interface{}, error) {
+	p.applyLoginHintToken(req, ar)
+	err = p.validateAuthorizeClient(req.Context(), ar)
+	if err != nil {
+		goto done
+	}
+	// NOTE: Limits of decoded values are checked after the client validation,
+	// so that their errors are returned to the client with the request's state.
+	err = p.requestLimits.CheckScopes(ar.Scopes)
+	if err != nil {
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Debugln("authorize request exceeds limits")
+		}
+		err = ar.NewError(err.Error(), err.(*konnectoidc.OAuth2Error).Description())
+		goto done
+	}
+	err = p.requestLimits.CheckState(ar.State)
+	if err != nil {
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Debugln("authorize request exceeds limits")
+		}
+		// Never return a state which exceeds the limit.
+		ar.State = ""
+		err = ar.NewError(err.Error(), err.(*konnectoidc.OAuth2Error).Description())
+		goto done
+	}
+	err = ar.Validate(p.strictKeyfunc(req, "id_token_hint", signing.TypedKeyfunc(func(token *jwt.Token) (interface{}, error) {
 		// Validator for incoming IDToken hints, looks up key.
 		return p.validateJWT(token)
-	})
+	}, jwtType)))
+	if err != nil {
+		goto done
+	}
+	err = p.applyUnknownScopeBehavior(ar.Scopes)
+	if err != nil {
+		if oauth2Err, ok := err.(*konnectoidc.OAuth2Error); ok {
+			err = ar.NewError(oauth2Err.ErrorID, oauth2Err.Description())
+		} else {
+			err = ar.NewError(konnectoidc.ErrorCodeOAuth2InvalidScope, err.Error())
+		}
+		goto done
+	}
+	err = p.validateRedirectURIScheme(req.Context(), ar)
+	if err != nil {
+		goto done
+	}
+	err = p.validateAuthorizeGrantTypes(req.Context(), ar)
 	if err != nil {
 		goto done
 	}
+	ar.SubjectMapper = p.subjectMapper(req.Context(), ar.ClientID)
 
 	// Find session if any, ignoring errors.
 	ar.Session, err = p.getSession(req)
@@ -168,12 +266,27 @@ func (p *Provider) AuthorizeHandler(rw http.ResponseWriter, req *http.Request) {
 		goto done
 	}
 
+	// Ensure that prompt=none never succeeds with a sign-in which is too old
+	// for the requested max_age, since the End-User cannot be asked to
+	// authenticate again.
+	// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	if ar.Prompts[oidc.PromptNone] && ar.MaxAge > 0 {
+		if loggedOn, logonAt := auth.LoggedOn(); loggedOn && logonAt.Add(ar.MaxAge).Before(time.Now()) {
+			err = ar.NewError(oidc.ErrorCodeOIDCLoginRequired, "max_age exceeded")
+			goto done
+		}
+	}
+
 	// Additional validation based on requested ID token claims.
 	if ar.Claims != nil && ar.Claims.IDToken != nil {
 		// Validate sub claim request
 		// https://openid.net/specs/openid-connect-core-1_0.html#ImplicitValidation
 		if subRequest, ok := ar.Claims.IDToken.Get(oidc.SubjectIdentifierClaim); ok {
-			if !subRequest.Match(auth.Subject()) {
+			sub := auth.Subject()
+			if ar.SubjectMapper != nil {
+				sub = ar.SubjectMapper(sub)
+			}
+			if !subRequest.Match(sub) {
 				err = ar.NewError(oidc.ErrorCodeOAuth2AccessDenied, "sub claim request mismatch")
 				goto done
 			}
@@ -206,6 +319,7 @@ func (p *Provider) AuthorizeResponse(rw http.ResponseWriter, req *http.Request,
 	}
 
 	ctx = identity.NewContext(req.Context(), auth)
+	tracing.SpanFromContext(ctx).SetAttributes(tracing.String("client_id", ar.ClientID), tracing.String("response_type", ar.RawResponseType))
 
 	// Create session.
 	session, err = p.updateOrCreateSession(rw, req, ar, auth)
@@ -217,7 +331,7 @@ func (p *Provider) AuthorizeResponse(rw http.ResponseWriter, req *http.Request,
 
 	// Create code when requested.
 	if _, ok := ar.ResponseTypes[oidc.ResponseTypeCode]; ok {
-		codeString, err = p.codeManager.Create(&code.Record{
+		codeString, err = p.createCode(ctx, &code.Record{
 			AuthenticationRequest: ar,
 			Auth:                  auth,
 			Session:               session,
@@ -229,7 +343,8 @@ func (p *Provider) AuthorizeResponse(rw http.ResponseWriter, req *http.Request,
 
 	// Create access token when requested.
 	if _, ok := ar.ResponseTypes[oidc.ResponseTypeToken]; ok {
-		accessTokenString, err = p.makeAccessToken(ctx, ar.ClientID, auth, nil)
+		registration, _ := p.clients.Get(ctx, ar.ClientID)
+		accessTokenString, err = p.makeAccessToken(ctx, ar.ClientID, auth, nil, nil, p.makeTokenBindingClaims(req, p.getTokenBinding(registration)))
 		if err != nil {
 			goto done
 		}
@@ -238,7 +353,13 @@ func (p *Provider) AuthorizeResponse(rw http.ResponseWriter, req *http.Request,
 	// Create ID token when requested and granted.
 	if authorizedScopes[oidc.ScopeOpenID] {
 		if _, ok := ar.ResponseTypes[oidc.ResponseTypeIDToken]; ok {
-			idTokenString, err = p.makeIDToken(ctx, ar, auth, session, accessTokenString, codeString, nil)
+			// NOTE: Sign with the alg registered by the client, so the at_hash and
+			// c_hash claims are computed with the hash the client expects.
+			var signingMethod jwt.SigningMethod
+			if registration, _ := p.clients.Get(ctx, ar.ClientID); registration != nil {
+				signingMethod = jwt.GetSigningMethod(registration.RawIDTokenSignedResponseAlg)
+			}
+			idTokenString, err = p.makeIDToken(ctx, ar, auth, session, accessTokenString, codeString, signingMethod)
 			if err != nil {
 				goto done
 			}
@@ -255,12 +376,24 @@ done:
 		p.logger.WithError(err).Errorln("failed to set browser state cookie")
 	}
 
+	if err != nil && ar.Prompts[oidc.PromptNone] {
+		// Never show any interactive pages with prompt=none, but return the
+		// accociated error to the client instead.
+		// https://openid.net/specs/openid-connect-core-1_0.html#AuthError
+		switch err.(type) {
+		case *identity.LoginRequiredError:
+			err = ar.NewError(oidc.ErrorCodeOIDCLoginRequired, "prompt=none request")
+		case *identity.RedirectError:
+			err = ar.NewError(oidc.ErrorCodeOIDCInteractionRequired, "prompt=none request")
+		}
+	}
+
 	if err != nil {
 		switch err.(type) {
 		case *payload.AuthenticationError:
-			p.Found(rw, ar.RedirectURI, err, ar.UseFragment)
+			p.WriteAuthorizationResponse(rw, req, ar, p.describeError(req.Context(), err))
 		case *payload.AuthenticationBadRequest:
-			p.ErrorPage(rw, http.StatusBadRequest, err.Error(), err.(*payload.AuthenticationBadRequest).Description())
+			p.ClientErrorPage(rw, req, ar.ClientID, http.StatusBadRequest, err.Error(), p.describeError(req.Context(), err).(*payload.AuthenticationBadRequest).Description())
 		case *identity.RedirectError:
 			p.Found(rw, err.(*identity.RedirectError).RedirectURI(), nil, false)
 		case *identity.LoginRequiredError:
@@ -269,10 +402,14 @@ done:
 			// do nothing
 		case *konnectoidc.OAuth2Error:
 			err = ar.NewError(err.Error(), err.(*konnectoidc.OAuth2Error).Description())
-			p.Found(rw, ar.RedirectURI, err, ar.UseFragment)
+			p.WriteAuthorizationResponse(rw, req, ar, p.describeError(req.Context(), err))
 		default:
+			// NOTE: All errors which are not bad requests happen after the client
+			// and its redirect_uri were validated, so return them to the client
+			// together with the request's state.
 			p.logger.WithFields(utils.ErrorAsFields(err)).Errorln("authorize request failed")
-			p.ErrorPage(rw, http.StatusInternalServerError, err.Error(), "well sorry, but there was a problem")
+			err = ar.NewError(oidc.ErrorCodeOAuth2ServerError, "well sorry, but there was a problem")
+			p.WriteAuthorizationResponse(rw, req, ar, p.describeError(req.Context(), err))
 		}
 
 		return
@@ -305,7 +442,9 @@ done:
 		response.IDToken = idTokenString
 	}
 
-	p.Found(rw, ar.RedirectURI, response, ar.UseFragment)
+	p.auditTokensIssued(req, auditEndpointAuthorize, ar, auth, session, "", accessTokenString, idTokenString, "")
+
+	p.WriteAuthorizationResponse(rw, req, ar, response)
 }
 
 // TokenHandler implements the HTTP token endpoint for OpenID
@@ -320,11 +459,22 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 	var accessTokenString string
 	var idTokenString string
 	var refreshTokenString string
+	var refreshTokenFamily string
+	var refreshTokenID string
+	var rotateRefreshToken bool
 	var approvedScopes map[string]bool
 	var authorizedScopes map[string]bool
 	var clientDetails *clients.Details
+	var clientCertificate *x509.Certificate
+	var confirmation *konnect.ConfirmationClaims
+	var binding *konnect.TokenBindingClaims
 	signinMethod := p.signingMethodDefault
 
+	start := time.Now()
+	defer func() {
+		p.observeTokenRequest(start, signinMethod)
+	}()
+
 	rw.Header().Set("Cache-Control", "no-store")
 	rw.Header().Set("Pragma", "no-cache")
 
@@ -344,33 +494,51 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		goto done
 	}
-	tr, err = payload.DecodeTokenRequest(req, p.metadata)
+	err = p.requestLimits.Check(req.Form)
+	if err != nil {
+		goto done
+	}
+	tr, err = payload.DecodeTokenRequest(req, p.getMetadata())
 	if err != nil {
 		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		goto done
 	}
+	tracing.SpanFromContext(req.Context()).SetAttributes(tracing.String("client_id", tr.ClientID), tracing.String("grant_type", tr.GrantType))
 
-	err = tr.Validate(func(token *jwt.Token) (interface{}, error) {
+	err = tr.Validate(p.strictKeyfunc(req, "refresh_token", func(token *jwt.Token) (interface{}, error) {
 		// Validator for incoming refresh tokens, looks up key.
 		return p.validateJWT(token)
-	}, &konnect.RefreshTokenClaims{})
+	}), &konnect.RefreshTokenClaims{})
 	if err != nil {
 		goto done
 	}
 
 	// Additional validations according to https://tools.ietf.org/html/rfc6749#section-4.1.3
-	clientDetails, err = p.clients.Lookup(req.Context(), tr.ClientID, tr.ClientSecret, tr.RedirectURI, "", false)
+	clientDetails, clientCertificate, err = p.authenticateClient(req, tr.ClientID, tr.ClientSecret, tr.ClientAssertion, tr.ClientAuthMethod(), tr.RedirectURI)
 	if err != nil {
-		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2AccessDenied, err.Error())
+		goto done
+	}
+	tr.ClientID = clientDetails.ID
+	if !clientAllowsGrantType(clientDetails, tr.GrantType) {
+		err = konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2UnauthorizedClient, "grant_type not allowed for client")
 		goto done
 	}
 	if clientDetails != nil && clientDetails.Registration != nil {
 		signinMethod = jwt.GetSigningMethod(clientDetails.Registration.RawIDTokenSignedResponseAlg)
+		if clientDetails.Registration.TLSClientCertificateBoundAccessTokens && clientCertificate != nil {
+			// Bind access token to client certificate according to https://tools.ietf.org/html/rfc8705#section-3
+			confirmation = &konnect.ConfirmationClaims{
+				X5tS256: utils.CertificateThumbprintS256(clientCertificate),
+			}
+		}
+		binding = p.makeTokenBindingClaims(req, p.getTokenBinding(clientDetails.Registration))
 	}
 
+	rotateRefreshToken = p.rotatesRefreshTokens(clientDetails)
+
 	switch tr.GrantType {
 	case oidc.GrantTypeAuthorizationCode:
-		codeRecord, codeRecordFound := p.codeManager.Pop(tr.Code)
+		codeRecord, codeRecordFound := p.popCode(req.Context(), tr.Code)
 		if !codeRecordFound {
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "code not found")
 			goto done
@@ -419,15 +587,30 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 
 		// TODO(longsleep): Compare standard claims issuer.
 
-		userID, sessionRef := p.getUserIDAndSessionRefFromClaims(&claims.StandardClaims, claims.IdentityClaims)
+		// Ensure that bound refresh tokens are used in the same context.
+		err = p.validateTokenBinding(req, "refresh_token", claims.Binding)
+		if err != nil {
+			goto done
+		}
+
+		// Ensure that the refresh token was not revoked.
+		err = p.validateRefreshTokenNotRevoked(claims)
+		if err != nil {
+			goto done
+		}
+
+		userID, sessionRef := p.getUserIDAndSessionRefFromClaims(claims.Audience, claims.IdentityClaims)
 		if userID == "" {
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "missing data in kc.identity claim")
 			goto done
 		}
 
-		ctx := konnect.NewClaimsContext(req.Context(), claims)
+		ctx := identity.NewClientIDContext(konnect.NewClaimsContext(req.Context(), claims), tr.ClientID)
 
-		currentIdentityManager, err := p.getIdentityManagerFromClaims(claims.IdentityProvider, claims.IdentityClaims)
+		// NOTE: Declared without := to not shadow err, which would drop all
+		// errors below.
+		var currentIdentityManager identity.Manager
+		currentIdentityManager, err = p.getIdentityManagerFromClaims(claims.IdentityProvider, claims.IdentityClaims)
 		if err != nil {
 			goto done
 		}
@@ -444,8 +627,21 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 				approvedScopes[scope] = true
 			}
 		}
+		// NOTE: Refresh tokens are only issued when offline_access was
+		// granted, reject refresh tokens where this approval is gone.
+		if !approvedScopes[oidc.ScopeOfflineAccess] {
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "offline_access not granted")
+			goto done
+		}
 
-		if len(tr.Scopes) > 0 {
+		// NOTE: Ignored unknown scopes must not widen the request to all
+		// approved scopes.
+		withRequestedScopes := len(tr.Scopes) > 0
+		err = p.applyUnknownScopeBehavior(tr.Scopes)
+		if err != nil {
+			goto done
+		}
+		if withRequestedScopes {
 			// Make sure all requested scopes are granted and limit authorized
 			// scopes to the requested scopes.
 			authorizedScopes = make(map[string]bool)
@@ -476,18 +672,53 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 		// Add authorized claims from request.
 		auth.AuthorizeClaims(claims.ApprovedClaimsRequest)
 
+		if rotateRefreshToken {
+			// Refresh token rotation with reuse detection according to
+			// https://tools.ietf.org/html/draft-ietf-oauth-security-topics-13#section-4.12
+			refreshTokenFamily, refreshTokenID, err = p.rotateRefreshToken(ctx, req, claims, tr.RawRefreshToken)
+			if err != nil {
+				goto done
+			}
+		}
+
+		// Keep the session the refresh token was issued in.
+		if claims.SessionID != "" {
+			session = &payload.Session{
+				ID: claims.SessionID,
+			}
+		}
+
 		// Create fake request for token generation.
 		ar = &payload.AuthenticationRequest{
 			ClientID: claims.Audience,
 		}
 
+	case konnectoidc.GrantTypeClientCredentials:
+		// Client credentials grant according to https://tools.ietf.org/html/rfc6749#section-4.4
+		// NOTE: Dynamic clients are not configured by the operator, thus they
+		// never get tokens without user.
+		if clientDetails == nil || clientDetails.Registration == nil || clientDetails.Registration.IsPublic() || clientDetails.Registration.Dynamic {
+			err = konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2UnauthorizedClient, "client_credentials requires a registered confidential client")
+			goto done
+		}
+
+		// NOTE: Tokens without user have the client as subject and only hold
+		// scopes which are allowed for the client.
+		authorizedScopes = clientCredentialsScopes(tr.Scopes, clientDetails.Registration.AllowedScopes)
+		auth = identity.NewAuthRecord(nil, tr.ClientID, authorizedScopes, nil, nil)
+
+		// Create fake request for token generation.
+		ar = &payload.AuthenticationRequest{
+			ClientID: tr.ClientID,
+		}
+
 	default:
 		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2UnsupportedGrantType, "grant_type value not implemented")
 		goto done
 	}
 
 	// Create access token.
-	accessTokenString, err = p.makeAccessToken(req.Context(), ar.ClientID, auth, signinMethod)
+	accessTokenString, err = p.makeAccessToken(req.Context(), ar.ClientID, auth, signinMethod, confirmation, binding)
 	if err != nil {
 		goto done
 	}
@@ -502,9 +733,34 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		// Create refresh token when granted.
-		if authorizedScopes[oidc.ScopeOfflineAccess] {
-			refreshTokenString, err = p.makeRefreshToken(req.Context(), ar.ClientID, auth, nil)
+		// Create refresh token when granted and the client may use it.
+		if authorizedScopes[oidc.ScopeOfflineAccess] && clientAllowsGrantType(clientDetails, oidc.GrantTypeRefreshToken) {
+			if rotateRefreshToken {
+				refreshTokenFamily, refreshTokenID, err = p.createRefreshTokenFamily(req.Context())
+				if err != nil {
+					goto done
+				}
+			}
+			refreshTokenString, err = p.makeRefreshToken(req.Context(), ar.ClientID, auth, session, nil, refreshTokenFamily, refreshTokenID, binding)
+			if err != nil {
+				goto done
+			}
+		}
+
+	case oidc.GrantTypeRefreshToken:
+		// Create ID token when granted, it has the sid of the session the
+		// refresh token was issued in.
+		// https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokenResponse
+		if authorizedScopes[oidc.ScopeOpenID] {
+			idTokenString, err = p.makeIDToken(req.Context(), ar, auth, session, accessTokenString, "", signinMethod)
+			if err != nil {
+				goto done
+			}
+		}
+
+		// Create successor refresh token when rotating.
+		if rotateRefreshToken {
+			refreshTokenString, err = p.makeRefreshToken(req.Context(), ar.ClientID, auth, session, nil, refreshTokenFamily, refreshTokenID, binding)
 			if err != nil {
 				goto done
 			}
@@ -513,21 +769,26 @@ func (p *Provider) TokenHandler(rw http.ResponseWriter, req *http.Request) {
 
 done:
 	if err != nil {
+		status := http.StatusBadRequest
 		switch err.(type) {
 		case *konnectoidc.OAuth2Error:
-			err = utils.WriteJSON(rw, http.StatusBadRequest, err, "")
-			if err != nil {
-				p.logger.WithError(err).Errorln("token request failed writing response")
-				return
-			}
 		default:
+			// NOTE: Internal errors are only logged, the response never
+			// contains their details.
 			p.logger.WithFields(utils.ErrorAsFields(err)).Errorln("token request failed")
-			p.ErrorPage(rw, http.StatusInternalServerError, err.Error(), "well sorry, but there was a problem")
+			status = http.StatusInternalServerError
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2ServerError, "well sorry, but there was a problem")
+		}
+		err = utils.WriteJSON(rw, status, p.describeError(req.Context(), err), "")
+		if err != nil {
+			p.logger.WithError(err).Errorln("token request failed writing response")
 		}
 
 		return
 	}
 
+	p.auditTokensIssued(req, auditEndpointToken, ar, auth, session, tr.GrantType, accessTokenString, idTokenString, refreshTokenString)
+
 	// Successful Token Response
 	// http://openid.net/specs/openid-connect-core-1_0.html#TokenResponse
 	response := &payload.TokenSuccess{}
@@ -542,6 +803,12 @@ done:
 	if refreshTokenString != "" {
 		response.RefreshToken = refreshTokenString
 	}
+	if tr.GrantType == konnectoidc.GrantTypeClientCredentials {
+		// NOTE: Granted scopes can differ from the requested scopes.
+		scopes := makeArrayFromBoolMap(authorizedScopes)
+		sort.Strings(scopes)
+		response.Scope = strings.Join(scopes, " ")
+	}
 
 	err = utils.WriteJSON(rw, http.StatusOK, response, "")
 	if err != nil {
@@ -570,8 +837,13 @@ func (p *Provider) UserInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoRequest
 
 	claims, err := p.GetAccessTokenClaimsFromRequest(req)
+	if err == nil {
+		err = p.validateAccessTokenAudience(claims)
+	}
 	if err != nil {
-		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request unauthorized")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidToken); ok {
+			logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request unauthorized")
+		}
 		konnectoidc.WriteWWWAuthenticateError(rw, http.StatusUnauthorized, err)
 		return
 	}
@@ -580,9 +852,9 @@ func (p *Provider) UserInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	var found bool
 	var requestedClaimsMap []*payload.ClaimsRequestMap
 
-	userID, sessionRef := p.getUserIDAndSessionRefFromClaims(&claims.StandardClaims, claims.IdentityClaims)
+	userID, sessionRef := p.getUserIDAndSessionRefFromClaims(claims.ClientID(), claims.IdentityClaims)
 
-	ctx := konnect.NewClaimsContext(req.Context(), claims)
+	ctx := identity.NewClientIDContext(konnect.NewClaimsContext(req.Context(), claims), claims.ClientID())
 
 	currentIdentityManager, err := p.getIdentityManagerFromClaims(claims.IdentityProvider, claims.IdentityClaims)
 	if err != nil {
@@ -611,93 +883,37 @@ func (p *Provider) UserInfoHandler(rw http.ResponseWriter, req *http.Request) {
 
 done:
 	if err != nil {
-		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request invalid token")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidToken); ok {
+			logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request invalid token")
+		}
 		konnectoidc.WriteWWWAuthenticateError(rw, http.StatusUnauthorized, konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, err.Error()))
 		return
 	}
 
-	publicSubject, err := p.PublicSubjectFromAuth(auth)
-	if err != nil {
-		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request failed to create subject")
-		p.ErrorPage(rw, http.StatusInternalServerError, "", err.Error())
-		return
-	}
-
-	response := &konnect.UserInfoResponse{
-		UserInfoResponse: &payload.UserInfoResponse{
-			UserInfoClaims: konnectoidc.UserInfoClaims{
-				Subject: publicSubject,
-			},
-			ProfileClaims: konnectoidc.NewProfileClaims(auth.Claims(oidc.ScopeProfile)[0]),
-			EmailClaims:   konnectoidc.NewEmailClaims(auth.Claims(oidc.ScopeEmail)[0]),
-		},
-	}
-
-	// Helper to receive user from auth, but only once.
-	withUser := func() func() identity.User {
-		var u identity.User
-		var fetched bool
-		return func() identity.User {
-			if !fetched {
-				fetched = true
-				u = auth.User()
-			}
-			return u
-		}
-	}()
-	authorizedScopes := auth.AuthorizedScopes()
-	var user identity.User
-
-	// Include additional Konnect specific claims when corresponding scopes are authorized.
-	if ok, _ := authorizedScopes[konnect.ScopeID]; ok {
-		user = withUser()
-		if userWithID, ok := user.(identity.UserWithID); ok {
-			claims := &konnect.IDClaims{
-				KCID: userWithID.ID(),
-			}
-			if userWithUsername, ok := user.(identity.UserWithUsername); ok {
-				claims.KCIDUsername = userWithUsername.Username()
-			}
-			if claims.KCIDUsername == "" {
-				claims.KCIDUsername = user.Subject()
-			}
-
-			response.IDClaims = claims
-		}
-	}
-	if ok, _ := authorizedScopes[konnect.ScopeUniqueUserID]; ok {
-		user = withUser()
-		if userWithUniqueID, ok := user.(identity.UserWithUniqueID); ok {
-			claims := &konnect.UniqueUserIDClaims{
-				KCUniqueUserID: userWithUniqueID.UniqueID(),
-			}
-
-			response.UniqueUserIDClaims = claims
-		}
+	var requestedClaims *payload.ClaimsRequestMap
+	if len(requestedClaimsMap) > 0 {
+		requestedClaims = requestedClaimsMap[0]
 	}
-
-	// Create a map so additional user specific claims can be added.
-	responseAsMap, err := payload.ToMap(response)
+	responseAsMap, err := p.makeUserInfoClaims(ctx, auth, claims.ClientID(), requestedClaims)
 	if err != nil {
-		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request failed to encode claims")
+		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request failed to create claims")
 		p.ErrorPage(rw, http.StatusInternalServerError, "", err.Error())
 		return
 	}
-
-	// Inject extra claims.
-	extraClaims := auth.Claims("")[0]
-	if extraClaims != nil {
-		if extraClaimsMap, ok := extraClaims.(jwt.MapClaims); ok {
-			for claim, value := range extraClaimsMap {
-				responseAsMap[claim] = value
+	if len(requestedClaimsMap) > 0 {
+		if err = checkEssentialClaims(requestedClaimsMap[0], responseAsMap); err != nil {
+			if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2AccessDenied); ok {
+				logger.WithFields(utils.ErrorAsFields(err)).Debugln("userinfo request essential claims not available")
 			}
+			konnectoidc.WriteWWWAuthenticateError(rw, http.StatusForbidden, err)
+			return
 		}
 	}
 
 	// Support returning signed user info if the registered client requested it
 	// as specified in https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse and
 	// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
-	registration, _ := p.clients.Get(req.Context(), claims.Audience)
+	registration, _ := p.clients.Get(req.Context(), claims.ClientID())
 	if registration != nil {
 		if registration.RawUserInfoSignedResponseAlg != "" {
 			// Get alg.
@@ -731,44 +947,82 @@ func (p *Provider) EndSessionHandler(rw http.ResponseWriter, req *http.Request)
 	var err error
 	var session *payload.Session
 	var currentIdentityManager identity.Manager
+	var frontchannelLogoutURIs []string
 
 	addResponseHeaders(rw.Header())
 
 	// Validate request.
 	err = req.ParseForm()
 	if err != nil {
-		p.logger.WithError(err).Errorln("endsession request invalid form data")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Errorln("endsession request invalid form data")
+		}
 		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		return
 	}
 
-	esr, err := payload.DecodeEndSessionRequest(req, p.metadata)
+	esr, err := payload.DecodeEndSessionRequest(req, p.getMetadata())
 	if err != nil {
-		p.logger.WithError(err).Errorln("endsession request invalid request data")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Errorln("endsession request invalid request data")
+		}
 		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		return
 	}
-	err = esr.Validate(func(token *jwt.Token) (interface{}, error) {
+	err = esr.Validate(p.strictKeyfunc(req, "id_token_hint", signing.TypedKeyfunc(func(token *jwt.Token) (interface{}, error) {
 		// Validator for incoming IDToken hints, looks up key.
 		return p.validateJWT(token)
-	})
+	}, jwtType)))
 	if err != nil {
 		goto done
 	}
+	if esr.IDTokenHint != nil {
+		esr.SubjectMapper = p.subjectMapper(req.Context(), esr.ClientID)
+	}
+	if esr.PostLogoutRedirectURI != nil && esr.PostLogoutRedirectURI.String() != "" {
+		// Never redirect to post logout redirect URIs which are not registered
+		// for the client the id_token_hint was issued to.
+		if esr.IDTokenHint == nil && (!p.Config.AllowEndSessionWithoutIDTokenHint || esr.ClientID == "") {
+			err = esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint required with post_logout_redirect_uri")
+			goto done
+		}
+		_, err = p.clients.LookupForEndSession(req.Context(), esr.ClientID, esr.PostLogoutRedirectURI, utils.OriginFromRequestHeaders(req.Header))
+		if err != nil {
+			if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+				logger.WithError(err).Debugln("endsession request with invalid post_logout_redirect_uri")
+			}
+			err = esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "post_logout_redirect_uri not registered")
+			goto done
+		}
+	}
 
 	// Get our session.
 	session, err = p.getSession(req)
 	if err != nil {
 		goto done
 	}
+	if session != nil && esr.SessionID() != "" && session.ID != esr.SessionID() {
+		// The id_token_hint was issued for another session, never end the
+		// current one in its place.
+		err = esr.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "id_token_hint does not match session")
+		goto done
+	}
 
 	currentIdentityManager, err = p.getIdentityManagerFromSession(session)
 	if err != nil {
 		goto done
 	}
 
+	// Collect front-channel logout URIs of the clients in the session.
+	frontchannelLogoutURIs = p.getFrontchannelLogoutURIs(req.Context(), p.getEndSessionSession(session, esr))
+
 	// Authorization unauthenticates end user.
 	err = currentIdentityManager.EndSession(req.Context(), rw, req, esr)
+	switch err.(type) {
+	case nil, *identity.RedirectError, *identity.IsHandledError:
+		// NOTE: Identity managers signal ended sessions with redirects.
+		p.auditLogout(req, esr, session)
+	}
 	if err != nil {
 		goto done
 	}
@@ -777,15 +1031,19 @@ done:
 	if err != nil {
 		switch err.(type) {
 		case *payload.AuthenticationBadRequest:
-			p.ErrorPage(rw, http.StatusBadRequest, err.Error(), err.(*payload.AuthenticationBadRequest).Description())
+			p.ClientErrorPage(rw, req, esr.ClientID, http.StatusBadRequest, err.Error(), err.(*payload.AuthenticationBadRequest).Description())
 		case *identity.RedirectError:
-			p.Found(rw, err.(*identity.RedirectError).RedirectURI(), nil, false)
+			if len(frontchannelLogoutURIs) > 0 {
+				p.FrontchannelLogoutPage(rw, req, esr.ClientID, session, frontchannelLogoutURIs, err.(*identity.RedirectError).RedirectURI(), nil)
+			} else {
+				p.Found(rw, err.(*identity.RedirectError).RedirectURI(), nil, false)
+			}
 		case *identity.IsHandledError:
 			// do nothing
 		case *konnectoidc.OAuth2Error:
 			err = esr.NewError(err.Error(), err.(*konnectoidc.OAuth2Error).Description())
 			if esr.PostLogoutRedirectURI == nil || esr.PostLogoutRedirectURI.String() == "" {
-				p.ErrorPage(rw, http.StatusForbidden, err.Error(), "oauth2 error")
+				p.ClientErrorPage(rw, req, esr.ClientID, http.StatusForbidden, err.Error(), "oauth2 error")
 			} else {
 				p.Found(rw, esr.PostLogoutRedirectURI, err, false)
 			}
@@ -802,7 +1060,11 @@ done:
 		State: esr.State,
 	}
 
-	if esr.PostLogoutRedirectURI == nil || esr.PostLogoutRedirectURI.String() == "" {
+	if len(frontchannelLogoutURIs) > 0 {
+		// NOTE: Front-channel logout requires the user agent to load the
+		// logout URIs, with or without post_logout_redirect_uri.
+		p.FrontchannelLogoutPage(rw, req, esr.ClientID, session, frontchannelLogoutURIs, esr.PostLogoutRedirectURI, response)
+	} else if esr.PostLogoutRedirectURI == nil || esr.PostLogoutRedirectURI.String() == "" {
 		err = utils.WriteJSON(rw, http.StatusOK, response, "")
 		if err != nil {
 			p.logger.WithError(err).Errorln("endsession request failed writing response")
@@ -834,6 +1096,73 @@ func (p *Provider) CheckSessionIframeHandler(rw http.ResponseWriter, req *http.R
 	checkSessionIframeTemplate.Execute(rw, data)
 }
 
+// RevocationHandler implements the HTTP token revocation endpoint for OAuth
+// 2.0 as specified at https://tools.ietf.org/html/rfc7009.
+func (p *Provider) RevocationHandler(rw http.ResponseWriter, req *http.Request) {
+	var err error
+	var rr *payload.RevocationRequest
+	var clientDetails *clients.Details
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+
+	// Validate request method
+	switch req.Method {
+	case http.MethodPost:
+		// breaks
+	default:
+		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "request must be sent with POST")
+		goto done
+	}
+
+	err = req.ParseForm()
+	if err != nil {
+		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
+		goto done
+	}
+	err = p.requestLimits.Check(req.Form)
+	if err != nil {
+		goto done
+	}
+	rr, err = payload.DecodeRevocationRequest(req)
+	if err != nil {
+		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
+		goto done
+	}
+	err = rr.Validate()
+	if err != nil {
+		goto done
+	}
+
+	// Client authentication according to https://tools.ietf.org/html/rfc7009#section-2.1
+	clientDetails, _, err = p.authenticateClient(req, rr.ClientID, rr.ClientSecret, rr.ClientAssertion, rr.ClientAuthMethod(), &url.URL{})
+	if err != nil {
+		goto done
+	}
+
+	err = p.revokeToken(req, clientDetails.ID, rr.Token, rr.TokenTypeHint)
+
+done:
+	if err != nil {
+		status := http.StatusBadRequest
+		switch err.(type) {
+		case *konnectoidc.OAuth2Error:
+		default:
+			p.logger.WithFields(utils.ErrorAsFields(err)).Errorln("revocation request failed")
+			status = http.StatusInternalServerError
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2ServerError, "well sorry, but there was a problem")
+		}
+		err = utils.WriteJSON(rw, status, p.describeError(req.Context(), err), "")
+		if err != nil {
+			p.logger.WithError(err).Errorln("revocation request failed writing response")
+		}
+
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
 // RegistrationHandler implements the HTTP endpoint for client self registration
 // with OpenID Connect Registration 1.0 as specified at
 // https://openid.net/specs/openid-connect-registration-1_0.html#ClientRegistration
@@ -841,9 +1170,24 @@ func (p *Provider) RegistrationHandler(rw http.ResponseWriter, req *http.Request
 	req.Body = http.MaxBytesReader(rw, req.Body, registrationSizeLimit)
 	addResponseHeaders(rw.Header())
 
+	if err := p.validateRegistrationInitialAccessToken(req); err != nil {
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidToken); ok {
+			logger.WithError(err).Debugln("client registration request without valid initial access token")
+		}
+
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"%s\"", oidc.ErrorCodeOAuth2InvalidToken))
+		err = utils.WriteJSON(rw, http.StatusForbidden, konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "valid initial access token required"), "")
+		if err != nil {
+			p.logger.WithError(err).Errorln("client registration request failed writing response")
+		}
+		return
+	}
+
 	crr, err := payload.DecodeClientRegistrationRequest(req)
 	if err != nil {
-		p.logger.WithError(err).Errorln("client registration request failed to decode request data")
+		if logger, ok := p.clientErrorLogger(oidc.ErrorCodeOAuth2InvalidRequest); ok {
+			logger.WithError(err).Errorln("client registration request failed to decode request data")
+		}
 
 		p.ErrorPage(rw, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
 		return
@@ -871,6 +1215,19 @@ func (p *Provider) RegistrationHandler(rw http.ResponseWriter, req *http.Request
 	if err != nil {
 		goto done
 	}
+	// Validate requested signing algs against the signing keys.
+	if cr.RawIDTokenSignedResponseAlg == "" {
+		cr.RawIDTokenSignedResponseAlg = p.defaultClientSigningAlg()
+	}
+	err = p.ValidateClientSigningAlgs(cr)
+	if err != nil {
+		goto done
+	}
+	// Validate sector identifier, this fetches the sector_identifier_uri.
+	if validateErr := p.clients.ValidateSectorIdentifier(req.Context(), cr); validateErr != nil {
+		err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, validateErr.Error())
+		goto done
+	}
 	// Set client to dynamic. This creates the id and client secret.
 	err = cr.SetDynamic(req.Context(), p.clients.StatelessCreator)
 	if err != nil {
@@ -19,13 +19,50 @@ package provider
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/mendsley/gojwk"
+	"gopkg.in/square/go-jose.v2"
 	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/client"
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/identity"
+	"stash.kopano.io/kc/konnect/identity/clients"
+	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+	refreshManagers "stash.kopano.io/kc/konnect/oidc/refresh/managers"
+	revocationManagers "stash.kopano.io/kc/konnect/oidc/revocation/managers"
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 func TestWellKnownHandler(t *testing.T) {
@@ -93,11 +130,18 @@ func TestWellKnownHandler(t *testing.T) {
 	if len(wellKnown.ResponseTypesSupported) == 0 {
 		t.Errorf("ResponseTypesSupported must not be empty")
 	}
+	if len(wellKnown.ResponseModesSupported) == 0 {
+		t.Errorf("ResponseModesSupported must not be empty")
+	}
 
 	if len(wellKnown.SubjectTypesSupported) == 0 {
 		t.Errorf("SubjectTypesSupported must not be empty")
 	}
 
+	if len(wellKnown.GrantTypesSupported) == 0 {
+		t.Errorf("GrantTypesSupported must not be empty")
+	}
+
 	if len(wellKnown.ClaimsSupported) == 0 {
 		t.Errorf("ClaimsSupported must not be empty")
 	}
@@ -105,4 +149,2041 @@ func TestWellKnownHandler(t *testing.T) {
 	if len(wellKnown.IDTokenSigningAlgValuesSupported) == 0 {
 		t.Errorf("IDTokenSigningAlgValuesSupported must not be empty")
 	}
+
+	frontchannel := &struct {
+		FrontchannelLogoutSupported        *bool `json:"frontchannel_logout_supported"`
+		FrontchannelLogoutSessionSupported *bool `json:"frontchannel_logout_session_supported"`
+	}{}
+	if err := json.Unmarshal(body, frontchannel); err != nil {
+		t.Fatal(err)
+	}
+	if frontchannel.FrontchannelLogoutSupported == nil || !*frontchannel.FrontchannelLogoutSupported {
+		t.Errorf("frontchannel_logout_supported must be true")
+	}
+	if frontchannel.FrontchannelLogoutSessionSupported == nil || !*frontchannel.FrontchannelLogoutSessionSupported {
+		t.Errorf("frontchannel_logout_session_supported must be true")
+	}
+}
+
+func TestWellKnownHandlerWithBasePath(t *testing.T) {
+	cfg := &Config{
+		Config: &config.Config{
+			Logger: logger,
+		},
+
+		IssuerIdentifier:  "https://example.com/base",
+		WellKnownPath:     "/base/.well-known/openid-configuration",
+		JwksPath:          "/base/konnect/v1/jwks.json",
+		AuthorizationPath: "/base/konnect/v1/authorize",
+		TokenPath:         "/base/konnect/v1/token",
+		UserInfoPath:      "/base/konnect/v1/userinfo",
+
+		AdditionalWellKnownPaths: []string{
+			"/.well-known/oauth-authorization-server/base",
+			"/.well-known/openid-configuration",
+		},
+	}
+
+	p, err := NewProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.identityManager = identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser")
+	err = p.InitializeMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/base/.well-known/openid-configuration", http.StatusOK},
+		{"/.well-known/oauth-authorization-server/base", http.StatusOK},
+		{"/.well-known/openid-configuration", http.StatusOK},
+		{"/.well-known/oauth-authorization-server", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		rr := httptest.NewRecorder()
+		p.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("status for %s was incorrect, got %d, want %d", test.path, rr.Code, test.status)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		wellKnown := &oidc.WellKnown{}
+		if err := json.Unmarshal(rr.Body.Bytes(), wellKnown); err != nil {
+			t.Fatal(err)
+		}
+		if wellKnown.Issuer != cfg.IssuerIdentifier {
+			t.Errorf("Issuer for %s was incorrect, got %s, want %s", test.path, wellKnown.Issuer, cfg.IssuerIdentifier)
+		}
+		if wellKnown.TokenEndpoint != "https://example.com/base/konnect/v1/token" {
+			t.Errorf("TokenEndpoint for %s was incorrect, got %s", test.path, wellKnown.TokenEndpoint)
+		}
+		if wellKnown.JwksURI != "https://example.com/base/konnect/v1/jwks.json" {
+			t.Errorf("JwksURI for %s was incorrect, got %s", test.path, wellKnown.JwksURI)
+		}
+	}
+}
+
+func TestFrontchannelLogoutPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create our server.
+	httpServer, provider, _, _ := NewTestProvider(ctx, t)
+	defer httpServer.Close()
+
+	redirectURI, _ := url.Parse("https://rp.example.com/signed-out")
+
+	req := httptest.NewRequest(http.MethodGet, "/konnect/v1/endsession", nil)
+	rr := httptest.NewRecorder()
+	provider.FrontchannelLogoutPage(rr, req, "", nil, []string{"https://rp.example.com/logout?iss=https%3A%2F%2Fkonnect&sid=123"}, redirectURI, &struct {
+		State string `url:"state"`
+	}{"xyz"})
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `<iframe src="https://rp.example.com/logout?iss=https%3A%2F%2Fkonnect&amp;sid=123" hidden></iframe>`) {
+		t.Errorf("frontchannel logout iframe missing, got %s", body)
+	}
+	if !strings.Contains(body, `data-redirect-uri="https://rp.example.com/signed-out?state=xyz"`) {
+		t.Errorf("frontchannel logout redirect uri missing, got %s", body)
+	}
+}
+
+func TestJwksHandlerWithClientValidator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Create our server.
+	httpServer, provider, _, config := NewTestProvider(ctx, t)
+	defer httpServer.Close()
+
+	validator, err := client.NewValidator(&client.Config{
+		Issuer:   config.IssuerIdentifier,
+		Audience: "unittest-client",
+		JWKSURI:  httpServer.URL + config.JwksPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeIDToken := func(iss, aud string) string {
+		tokenString, makeErr := provider.makeJWT(ctx, nil, &konnectoidc.IDTokenClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    iss,
+				Subject:   "unittestuser",
+				Audience:  aud,
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+				IssuedAt:  time.Now().Unix(),
+			},
+		})
+		if makeErr != nil {
+			t.Fatal(makeErr)
+		}
+		return tokenString
+	}
+
+	claims, err := validator.ValidateIDToken(ctx, makeIDToken(config.IssuerIdentifier, "unittest-client"))
+	if err != nil {
+		t.Fatalf("failed to validate id token: %v", err)
+	}
+	if claims.Subject != "unittestuser" {
+		t.Errorf("sub claim was incorrect, got %s, want unittestuser", claims.Subject)
+	}
+
+	if _, err = validator.ValidateIDToken(ctx, makeIDToken("https://other-issuer", "unittest-client")); err == nil {
+		t.Errorf("id token with wrong iss was validated")
+	}
+	if _, err = validator.ValidateIDToken(ctx, makeIDToken(config.IssuerIdentifier, "other-client")); err == nil {
+		t.Errorf("id token with wrong aud was validated")
+	}
+
+	auth, _, err := provider.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := provider.makeAccessToken(ctx, "unittest-client", auth, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = validator.ValidateAccessToken(ctx, accessToken); err != nil {
+		t.Errorf("failed to validate access token: %v", err)
+	}
+	if _, err = validator.ValidateIDToken(ctx, accessToken); err == nil {
+		t.Errorf("access token was validated as id token")
+	}
+}
+
+type promptTestIdentityManager struct {
+	*identityManagers.DummyIdentityManager
+
+	signedIn bool
+	authTime time.Time
+	err      error
+}
+
+func (im *promptTestIdentityManager) Authenticate(ctx context.Context, rw http.ResponseWriter, req *http.Request, ar *payload.AuthenticationRequest, next identity.Manager) (identity.AuthRecord, error) {
+	if im.err != nil {
+		return nil, im.err
+	}
+	if !im.signedIn {
+		signInURI, _ := url.Parse("https://konnect.example.com/signin")
+		return nil, identity.NewLoginRequiredError("not signed in", signInURI)
+	}
+
+	auth, err := im.DummyIdentityManager.Authenticate(ctx, rw, req, ar, next)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetAuthTime(im.authTime)
+
+	return auth, nil
+}
+
+func TestAuthorizeHandlerPromptNone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name      string
+		signedIn  bool
+		authTime  time.Time
+		maxAge    string
+		wantError string
+	}{
+		{"no session", false, time.Time{}, "", oidc.ErrorCodeOIDCLoginRequired},
+		{"stale session", true, time.Now().Add(-1 * time.Hour), "60", oidc.ErrorCodeOIDCLoginRequired},
+		{"fresh session", true, time.Now(), "60", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &promptTestIdentityManager{
+				DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+				signedIn:             tt.signedIn,
+				authTime:             tt.authTime,
+			}
+			httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+			defer httpServer.Close()
+
+			query := make(url.Values)
+			query.Set("response_type", oidc.ResponseTypeCode)
+			query.Set("scope", oidc.ScopeOpenID)
+			query.Set("client_id", "unittest-client")
+			query.Set("redirect_uri", "https://rp.example.com/cb")
+			query.Set("state", "xyz")
+			query.Set("prompt", oidc.PromptNone)
+			if tt.maxAge != "" {
+				query.Set("max_age", tt.maxAge)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+			rr := httptest.NewRecorder()
+			provider.AuthorizeHandler(rr, req)
+
+			if status := rr.Code; status != http.StatusFound {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+			}
+			location, err := url.Parse(rr.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Host != "rp.example.com" {
+				t.Fatalf("handler redirected to wrong location: %s", location)
+			}
+			response := location.Query()
+			if errorID := response.Get("error"); errorID != tt.wantError {
+				t.Errorf("handler returned wrong error: got %#v want %#v", errorID, tt.wantError)
+			}
+			if tt.wantError == "" && response.Get("code") == "" {
+				t.Errorf("handler returned no code")
+			}
+			if state := response.Get("state"); state != "xyz" {
+				t.Errorf("handler returned wrong state: got %#v want %#v", state, "xyz")
+			}
+		})
+	}
+}
+
+func TestAuthorizeHandlerClientValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name                  string
+		clientID              string
+		redirectURI           string
+		registeredClientsOnly bool
+		wantStatus            int
+	}{
+		{"registered", "unittest-client", "https://rp.example.com/cb", false, http.StatusFound},
+		{"unknown client", "unknown-client", "https://evil.example.com/cb", false, http.StatusBadRequest},
+		{"wrong redirect_uri", "unittest-client", "https://evil.example.com/cb", false, http.StatusBadRequest},
+		{"implicitly trusted", "trusted-client", "http://localhost:8777/cb", false, http.StatusFound},
+		{"implicitly trusted registered only", "trusted-client", "http://localhost:8777/cb", true, http.StatusBadRequest},
+		{"registered registered only", "unittest-client", "https://rp.example.com/cb", true, http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &promptTestIdentityManager{
+				DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+				signedIn:             true,
+				authTime:             time.Now(),
+			}
+			httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+			defer httpServer.Close()
+			cfg.RegisteredClientsOnly = tt.registeredClientsOnly
+
+			trustedURI, _ := url.Parse(cfg.IssuerIdentifier)
+			registry, err := clients.NewRegistry(ctx, trustedURI, "", 0, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = registry.Register(&clients.ClientRegistration{
+				ID:           "unittest-client",
+				RedirectURIs: []string{"https://rp.example.com/cb"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider.clients = registry
+
+			query := make(url.Values)
+			query.Set("response_type", oidc.ResponseTypeCode)
+			query.Set("scope", oidc.ScopeOpenID)
+			query.Set("client_id", tt.clientID)
+			query.Set("redirect_uri", tt.redirectURI)
+			query.Set("state", "xyz")
+			// NOTE: An unsupported prompt combination results in an error which
+			// would be sent to the redirect_uri if the client was not validated
+			// first, thus it must never be redirected for invalid clients.
+			if tt.wantStatus == http.StatusBadRequest {
+				query.Set("prompt", oidc.PromptNone+" "+oidc.PromptLogin)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+			rr := httptest.NewRecorder()
+			provider.AuthorizeHandler(rr, req)
+
+			if status := rr.Code; status != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.wantStatus)
+			}
+			if location := rr.Header().Get("Location"); tt.wantStatus != http.StatusFound && location != "" {
+				t.Errorf("handler redirected for invalid client: %s", location)
+			}
+		})
+	}
+}
+
+func TestGrantTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	im := &promptTestIdentityManager{
+		DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+		signedIn:             true,
+		authTime:             time.Now(),
+	}
+	httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+	defer httpServer.Close()
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{
+			ID:                         "code-client",
+			RedirectURIs:               []string{"https://rp.example.com/cb"},
+			GrantTypes:                 []string{oidc.GrantTypeAuthorizationCode},
+			RawTokenEndpointAuthMethod: oidc.AuthMethodNone,
+		},
+		{
+			ID:                         "implicit-client",
+			RedirectURIs:               []string{"https://rp.example.com/cb"},
+			GrantTypes:                 []string{oidc.GrantTypeImplicit},
+			RawTokenEndpointAuthMethod: oidc.AuthMethodNone,
+		},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider.clients = registry
+
+	authorizeTests := []struct {
+		clientID     string
+		responseType string
+		wantError    string
+	}{
+		{"code-client", oidc.ResponseTypeCode, ""},
+		{"code-client", oidc.ResponseTypeIDToken, konnectoidc.ErrorCodeOAuth2UnauthorizedClient},
+		{"code-client", oidc.ResponseTypeCodeIDToken, konnectoidc.ErrorCodeOAuth2UnauthorizedClient},
+		{"implicit-client", oidc.ResponseTypeIDToken, ""},
+		{"implicit-client", oidc.ResponseTypeCode, konnectoidc.ErrorCodeOAuth2UnauthorizedClient},
+	}
+	for _, test := range authorizeTests {
+		query := make(url.Values)
+		query.Set("response_type", test.responseType)
+		query.Set("scope", oidc.ScopeOpenID)
+		query.Set("client_id", test.clientID)
+		query.Set("redirect_uri", "https://rp.example.com/cb")
+		query.Set("state", "xyz")
+		query.Set("nonce", "abc")
+
+		req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		provider.AuthorizeHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusFound {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v", test.clientID, test.responseType, status, http.StatusFound)
+			continue
+		}
+		location, _ := url.Parse(rr.Header().Get("Location"))
+		values := location.Query()
+		if location.Fragment != "" {
+			values, _ = url.ParseQuery(location.Fragment)
+		}
+		if gotError := values.Get("error"); gotError != test.wantError {
+			t.Errorf("%s %s: handler returned wrong error: got %v want %v", test.clientID, test.responseType, gotError, test.wantError)
+		}
+	}
+
+	tokenTests := []struct {
+		clientID  string
+		wantError string
+	}{
+		{"code-client", oidc.ErrorCodeOAuth2InvalidGrant},
+		{"implicit-client", konnectoidc.ErrorCodeOAuth2UnauthorizedClient},
+	}
+	for _, test := range tokenTests {
+		form := url.Values{}
+		form.Set("grant_type", oidc.GrantTypeAuthorizationCode)
+		form.Set("code", "unittest")
+		form.Set("client_id", test.clientID)
+		form.Set("redirect_uri", "https://rp.example.com/cb")
+
+		req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		provider.ServeHTTP(rr, req)
+
+		var response map[string]interface{}
+		if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response["error"] != test.wantError {
+			t.Errorf("%s: handler returned wrong error: got %v want %v", test.clientID, response["error"], test.wantError)
+		}
+	}
+}
+
+func TestTokenHandlerClientCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, provider, _, cfg := NewTestProvider(ctx, t)
+	defer httpServer.Close()
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{
+			ID:                  "service-client",
+			Secret:              "service-secret",
+			GrantTypes:          []string{konnectoidc.GrantTypeClientCredentials},
+			AllowedScopes:       []string{"api/read", "api/write"},
+			AdditionalAudiences: []string{"https://api.example.com"},
+		},
+		{
+			ID:           "default-client",
+			Secret:       "default-secret",
+			RedirectURIs: []string{"https://rp.example.com/cb"},
+		},
+		{
+			ID:                         "public-client",
+			GrantTypes:                 []string{konnectoidc.GrantTypeClientCredentials},
+			RawTokenEndpointAuthMethod: oidc.AuthMethodNone,
+		},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider.clients = registry
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+		scope        string
+		wantError    string
+		wantScope    string
+	}{
+		{"requested scopes", "service-client", "service-secret", "api/read other", "", "api/read"},
+		{"allowed scopes", "service-client", "service-secret", "", "", "api/read api/write"},
+		{"wrong secret", "service-client", "wrong", "", konnectoidc.ErrorCodeOAuth2InvalidClient, ""},
+		{"grant not registered", "default-client", "default-secret", "", konnectoidc.ErrorCodeOAuth2UnauthorizedClient, ""},
+		{"public client", "public-client", "", "", konnectoidc.ErrorCodeOAuth2UnauthorizedClient, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Set("grant_type", konnectoidc.GrantTypeClientCredentials)
+			form.Set("client_id", tt.clientID)
+			if tt.clientSecret != "" {
+				form.Set("client_secret", tt.clientSecret)
+			}
+			if tt.scope != "" {
+				form.Set("scope", tt.scope)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			provider.ServeHTTP(rr, req)
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantError != "" {
+				if response["error"] != tt.wantError {
+					t.Errorf("handler returned wrong error: got %v want %v", response["error"], tt.wantError)
+				}
+				return
+			}
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v: %v", status, http.StatusOK, response)
+			}
+			if response["scope"] != tt.wantScope {
+				t.Errorf("handler returned wrong scope: got %v want %v", response["scope"], tt.wantScope)
+			}
+			if _, ok := response["id_token"]; ok {
+				t.Errorf("handler returned id_token")
+			}
+			if _, ok := response["refresh_token"]; ok {
+				t.Errorf("handler returned refresh_token")
+			}
+
+			claims := jwt.MapClaims{}
+			if _, _, err := new(jwt.Parser).ParseUnverified(response["access_token"].(string), claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims["sub"] != tt.clientID {
+				t.Errorf("access token has wrong sub: got %v want %v", claims["sub"], tt.clientID)
+			}
+			if aud, _ := claims["aud"].([]interface{}); len(aud) != 2 || aud[1] != "https://api.example.com" {
+				t.Errorf("access token has wrong aud: %v", claims["aud"])
+			}
+			if _, ok := claims["kc.identity"]; ok && claims["kc.identity"] != nil {
+				t.Errorf("access token has identity claims: %v", claims["kc.identity"])
+			}
+		})
+	}
+}
+
+func TestAuthorizeHandlerResponseMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := []struct {
+		name         string
+		responseType string
+		responseMode string
+		wantStatus   int
+		wantFragment bool
+		wantError    string
+	}{
+		{"default", oidc.ResponseTypeCode, "", http.StatusFound, false, ""},
+		{"query", oidc.ResponseTypeCode, oidc.ResponseModeQuery, http.StatusFound, false, ""},
+		{"fragment", oidc.ResponseTypeCode, oidc.ResponseModeFragment, http.StatusFound, true, ""},
+		{"form_post", oidc.ResponseTypeCode, konnectoidc.ResponseModeFormPost, http.StatusOK, false, ""},
+		{"hybrid default", oidc.ResponseTypeCodeIDToken, "", http.StatusFound, true, ""},
+		{"hybrid query", oidc.ResponseTypeCodeIDToken, oidc.ResponseModeQuery, http.StatusFound, false, konnectoidc.ErrorCodeOAuth2UnsupportedResponseMode},
+		{"unsupported", oidc.ResponseTypeCode, "web_message", http.StatusFound, false, konnectoidc.ErrorCodeOAuth2UnsupportedResponseMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &promptTestIdentityManager{
+				DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+				signedIn:             true,
+				authTime:             time.Now(),
+			}
+			httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+			defer httpServer.Close()
+
+			query := make(url.Values)
+			query.Set("response_type", tt.responseType)
+			query.Set("scope", oidc.ScopeOpenID)
+			query.Set("client_id", "unittest-client")
+			query.Set("redirect_uri", "https://rp.example.com/cb")
+			query.Set("state", "xyz")
+			query.Set("nonce", "abc")
+			query.Set("prompt", oidc.PromptNone)
+			if tt.responseMode != "" {
+				query.Set("response_mode", tt.responseMode)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+			rr := httptest.NewRecorder()
+			provider.AuthorizeHandler(rr, req)
+
+			if status := rr.Code; status != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.wantStatus)
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				body := rr.Body.String()
+				if !strings.Contains(body, `action="https://rp.example.com/cb"`) {
+					t.Errorf("form post response has wrong action: %s", body)
+				}
+				if !strings.Contains(body, `name="code"`) || !strings.Contains(body, `name="state" value="xyz"`) {
+					t.Errorf("form post response is missing parameters: %s", body)
+				}
+				if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'nonce-") {
+					t.Errorf("form post response has wrong Content-Security-Policy: %s", csp)
+				}
+				return
+			}
+
+			location, err := url.Parse(rr.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Host != "rp.example.com" {
+				t.Fatalf("handler redirected to wrong location: %s", location)
+			}
+			response := location.Query()
+			if tt.wantFragment {
+				if location.RawQuery != "" {
+					t.Errorf("handler returned query for fragment response: %s", location)
+				}
+				response, err = url.ParseQuery(location.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if location.Fragment != "" {
+				t.Errorf("handler returned fragment for query response: %s", location)
+			}
+			if errorID := response.Get("error"); errorID != tt.wantError {
+				t.Errorf("handler returned wrong error: got %#v want %#v", errorID, tt.wantError)
+			}
+			if tt.wantError == "" && response.Get("code") == "" {
+				t.Errorf("handler returned no code")
+			}
+			if state := response.Get("state"); state != "xyz" {
+				t.Errorf("handler returned wrong state: got %#v want %#v", state, "xyz")
+			}
+		})
+	}
+}
+
+func TestAuthorizeHandlerState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	largeState := strings.Repeat("s", 1024)
+
+	tests := []struct {
+		name         string
+		responseType string
+		responseMode string
+		state        string
+		signedIn     bool
+		err          error
+		wantError    string
+		wantState    string
+	}{
+		{"query", oidc.ResponseTypeCode, "", largeState, true, nil, "", largeState},
+		{"fragment", oidc.ResponseTypeCodeIDToken, "", largeState, true, nil, "", largeState},
+		{"form_post", oidc.ResponseTypeCode, konnectoidc.ResponseModeFormPost, largeState, true, nil, "", largeState},
+		{"query error", oidc.ResponseTypeCode, "", largeState, false, nil, oidc.ErrorCodeOIDCLoginRequired, largeState},
+		{"fragment error", oidc.ResponseTypeCodeIDToken, "", largeState, false, nil, oidc.ErrorCodeOIDCLoginRequired, largeState},
+		{"form_post error", oidc.ResponseTypeCode, konnectoidc.ResponseModeFormPost, largeState, false, nil, oidc.ErrorCodeOIDCLoginRequired, largeState},
+		{"server error", oidc.ResponseTypeCode, "", "xyz", true, fmt.Errorf("unittest failure"), oidc.ErrorCodeOAuth2ServerError, "xyz"},
+		{"scopes limit", oidc.ResponseTypeCode, "", "xyz", true, nil, oidc.ErrorCodeOAuth2InvalidRequest, "xyz"},
+		{"state limit", oidc.ResponseTypeCode, "", largeState + "s", true, nil, oidc.ErrorCodeOAuth2InvalidRequest, ""},
+		{"state limit form_post", oidc.ResponseTypeCode, konnectoidc.ResponseModeFormPost, largeState + "s", true, nil, oidc.ErrorCodeOAuth2InvalidRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &promptTestIdentityManager{
+				DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+				signedIn:             tt.signedIn,
+				authTime:             time.Now(),
+				err:                  tt.err,
+			}
+			httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+			defer httpServer.Close()
+			provider.requestLimits = &payload.RequestLimits{
+				MaxStateLength: len(largeState),
+			}
+
+			query := make(url.Values)
+			query.Set("response_type", tt.responseType)
+			query.Set("scope", oidc.ScopeOpenID)
+			query.Set("client_id", "unittest-client")
+			query.Set("redirect_uri", "https://rp.example.com/cb")
+			query.Set("state", tt.state)
+			query.Set("nonce", "abc")
+			query.Set("prompt", oidc.PromptNone)
+			if tt.responseMode != "" {
+				query.Set("response_mode", tt.responseMode)
+			}
+			if tt.name == "scopes limit" {
+				// Scopes set by request objects are only limited after decoding.
+				provider.requestLimits.MaxScopes = 1
+				request, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+					"scope":         oidc.ScopeOpenID + " " + oidc.ScopeProfile,
+					"response_type": tt.responseType,
+					"client_id":     "unittest-client",
+				}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				query.Set("request", request)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+			rr := httptest.NewRecorder()
+			provider.AuthorizeHandler(rr, req)
+
+			var response url.Values
+			if tt.responseMode == konnectoidc.ResponseModeFormPost {
+				if status := rr.Code; status != http.StatusOK {
+					t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+				}
+				response = parseFormPostResponse(t, rr.Body.String())
+			} else {
+				if status := rr.Code; status != http.StatusFound {
+					t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+				}
+				location, err := url.Parse(rr.Header().Get("Location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				response = location.Query()
+				if location.Fragment != "" {
+					response, err = url.ParseQuery(location.Fragment)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if errorID := response.Get("error"); errorID != tt.wantError {
+				t.Errorf("handler returned wrong error: got %#v want %#v", errorID, tt.wantError)
+			}
+			if state := response.Get("state"); state != tt.wantState {
+				t.Errorf("handler returned wrong state: got %d bytes want %d bytes", len(state), len(tt.wantState))
+			}
+		})
+	}
+}
+
+var formPostResponseInputPattern = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)">`)
+
+func parseFormPostResponse(t *testing.T, body string) url.Values {
+	values := make(url.Values)
+	for _, match := range formPostResponseInputPattern.FindAllStringSubmatch(body, -1) {
+		values.Add(html.UnescapeString(match[1]), html.UnescapeString(match[2]))
+	}
+	if len(values) == 0 {
+		t.Fatalf("form post response has no parameters: %s", body)
+	}
+
+	return values
+}
+
+func newClientAssertionTestProvider(ctx context.Context, t *testing.T) (*Provider, *Config, *ecdsa.PrivateKey) {
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := gojwk.PublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:                         "assertion-client",
+		RedirectURIs:               []string{"https://client.example.com/cb"},
+		RawTokenEndpointAuthMethod: konnectoidc.AuthMethodPrivateKeyJWT,
+		JWKS: &gojwk.Key{
+			Keys: []*gojwk.Key{jwk},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	return p, cfg, key
+}
+
+func makeClientAssertion(t *testing.T, signingMethod jwt.SigningMethod, key interface{}, audience string) string {
+	claims := jwt.MapClaims{
+		"iss": "assertion-client",
+		"sub": "assertion-client",
+		"aud": []string{audience},
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": "unittest",
+	}
+	assertion, err := jwt.NewWithClaims(signingMethod, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return assertion
+}
+
+func TestValidateClientAssertion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, _, key := newClientAssertionTestProvider(ctx, t)
+	tokenEndpoint := p.metadata.TokenEndpoint
+
+	tests := []struct {
+		name      string
+		assertion string
+		valid     bool
+	}{
+		{"es256", makeClientAssertion(t, jwt.SigningMethodES256, key, tokenEndpoint), true},
+		{"none", makeClientAssertion(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, tokenEndpoint), false},
+		{"hs256", makeClientAssertion(t, jwt.SigningMethodHS256, []byte("secret"), tokenEndpoint), false},
+		{"aud", makeClientAssertion(t, jwt.SigningMethodES256, key, "https://other.example.com/token"), false},
+	}
+
+	for _, test := range tests {
+		registration, err := p.validateClientAssertion(httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil), "assertion-client", test.assertion)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			} else if registration.ID != "assertion-client" {
+				t.Errorf("%s: wrong registration: %v", test.name, registration.ID)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+			continue
+		}
+		if oauth2Err, ok := err.(*konnectoidc.OAuth2Error); !ok || oauth2Err.ErrorID != konnectoidc.ErrorCodeOAuth2InvalidClient {
+			t.Errorf("%s: expected invalid_client error, got %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateLoginHintToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, _, key := newClientAssertionTestProvider(ctx, t)
+	if err := p.clients.Register(&clients.ClientRegistration{
+		ID:           "secret-client",
+		Secret:       "secret",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(signingMethod jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(signingMethod, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	encrypt := func(secret string, plaintext []byte) string {
+		sum := sha256.Sum256([]byte(secret))
+		encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: sum[:]}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := encrypter.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := encrypted.CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	tests := []struct {
+		name     string
+		clientID string
+		token    string
+		hint     string
+	}{
+		{"signed", "assertion-client", sign(jwt.SigningMethodES256, key, jwt.MapClaims{"iss": "assertion-client", "aud": p.issuerIdentifier, "exp": exp, "email": "jane@example.com"}), "jane@example.com"},
+		{"signed expired", "assertion-client", sign(jwt.SigningMethodES256, key, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), "login_hint": "jane"}), ""},
+		{"signed hs256", "assertion-client", sign(jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"login_hint": "jane"}), ""},
+		{"signed other client", "secret-client", sign(jwt.SigningMethodES256, key, jwt.MapClaims{"login_hint": "jane"}), ""},
+		{"signed aud", "assertion-client", sign(jwt.SigningMethodES256, key, jwt.MapClaims{"aud": []string{"https://other.example.com"}, "login_hint": "jane"}), ""},
+		{"encrypted", "secret-client", encrypt("secret", []byte(`{"iss":"secret-client","login_hint":"jane"}`)), "jane"},
+		{"encrypted wrong secret", "secret-client", encrypt("other", []byte(`{"login_hint":"jane"}`)), ""},
+		{"encrypted iss", "secret-client", encrypt("secret", []byte(`{"iss":"assertion-client","login_hint":"jane"}`)), ""},
+	}
+
+	for _, test := range tests {
+		ar := &payload.AuthenticationRequest{
+			ClientID:          test.clientID,
+			LoginHint:         "plain",
+			RawLoginHintToken: test.token,
+		}
+		p.applyLoginHintToken(httptest.NewRequest(http.MethodGet, "/konnect/v1/authorize", nil), ar)
+		want := test.hint
+		if want == "" {
+			want = "plain"
+		}
+		if ar.LoginHint != want {
+			t.Errorf("%s: wrong login hint: got %v want %v", test.name, ar.LoginHint, want)
+		}
+	}
+}
+
+func TestTokenHandlerRejectsClientAssertionAlgNone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, cfg, _ := newClientAssertionTestProvider(ctx, t)
+
+	form := url.Values{}
+	form.Set("grant_type", oidc.GrantTypeAuthorizationCode)
+	form.Set("code", "unittest")
+	form.Set("client_id", "assertion-client")
+	form.Set("client_assertion_type", konnectoidc.ClientAssertionTypeJWTBearer)
+	form.Set("client_assertion", makeClientAssertion(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, p.metadata.TokenEndpoint))
+
+	req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["error"] != konnectoidc.ErrorCodeOAuth2InvalidClient {
+		t.Errorf("handler returned wrong error: got %v want %v", response["error"], konnectoidc.ErrorCodeOAuth2InvalidClient)
+	}
+}
+
+func TestTokenHandlerTokenEndpointAuthMethod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, cfg, key := newClientAssertionTestProvider(ctx, t)
+	for _, registration := range []*clients.ClientRegistration{
+		{ID: "basic-client", Secret: "secret", RedirectURIs: []string{"https://client.example.com/cb"}, RawTokenEndpointAuthMethod: oidc.AuthMethodClientSecretBasic},
+		{ID: "post-client", Secret: "secret", RedirectURIs: []string{"https://client.example.com/cb"}, RawTokenEndpointAuthMethod: konnectoidc.AuthMethodClientSecretPost},
+		{ID: "public-client", RedirectURIs: []string{"https://client.example.com/cb"}, RawTokenEndpointAuthMethod: oidc.AuthMethodNone},
+		{ID: "unset-client", Secret: "secret", RedirectURIs: []string{"https://client.example.com/cb"}},
+	} {
+		if err := p.clients.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		basic    bool
+		secret   string
+		jwt      bool
+		want     string
+	}{
+		{"basic with basic", "basic-client", true, "secret", false, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"basic with post", "basic-client", false, "secret", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"basic with wrong secret", "basic-client", true, "wrong", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"post with post", "post-client", false, "secret", false, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"post with basic", "post-client", true, "secret", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"none without secret", "public-client", false, "", false, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"none with secret", "public-client", false, "secret", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"none with basic", "public-client", true, "secret", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"unset with basic", "unset-client", true, "secret", false, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"unset with post", "unset-client", false, "secret", false, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"private_key_jwt with secret", "assertion-client", true, "secret", false, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"private_key_jwt with assertion", "assertion-client", false, "", true, oidc.ErrorCodeOAuth2InvalidGrant},
+	}
+
+	for _, test := range tests {
+		form := url.Values{}
+		form.Set("grant_type", oidc.GrantTypeAuthorizationCode)
+		form.Set("code", "unittest")
+		form.Set("client_id", test.clientID)
+		if test.secret != "" && !test.basic {
+			form.Set("client_secret", test.secret)
+		}
+		if test.jwt {
+			form.Set("client_assertion_type", konnectoidc.ClientAssertionTypeJWTBearer)
+			form.Set("client_assertion", makeClientAssertion(t, jwt.SigningMethodES256, key, p.metadata.TokenEndpoint))
+		}
+
+		req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.basic {
+			req.SetBasicAuth(test.clientID, test.secret)
+		}
+		rr := httptest.NewRecorder()
+		p.ServeHTTP(rr, req)
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response["error"] != test.want {
+			t.Errorf("%s: handler returned wrong error: got %v (%v) want %v", test.name, response["error"], response["error_description"], test.want)
+		}
+	}
+}
+
+func TestTokenHandlerTLSClientAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	newCertificate := func(commonName string) *x509.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	cert := newCertificate("client")
+	other := newCertificate("other")
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{ID: "tls-client", RedirectURIs: []string{"https://client.example.com/cb"}, RawTokenEndpointAuthMethod: konnectoidc.AuthMethodTLSClientAuth, TLSClientAuthSubjectDN: cert.Subject.String()},
+		{ID: "self-signed-client", RedirectURIs: []string{"https://client.example.com/cb"}, RawTokenEndpointAuthMethod: konnectoidc.AuthMethodSelfSignedTLSClientAuth, TLSClientAuthThumbprint: utils.CertificateThumbprintS256(cert)},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+
+	for _, test := range []struct {
+		name     string
+		clientID string
+		peer     *x509.Certificate
+		want     string
+	}{
+		{"tls_client_auth with certificate", "tls-client", cert, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"tls_client_auth with wrong certificate", "tls-client", other, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"tls_client_auth without certificate", "tls-client", nil, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"self_signed_tls_client_auth with certificate", "self-signed-client", cert, oidc.ErrorCodeOAuth2InvalidGrant},
+		{"self_signed_tls_client_auth with wrong certificate", "self-signed-client", other, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"self_signed_tls_client_auth without certificate", "self-signed-client", nil, konnectoidc.ErrorCodeOAuth2InvalidClient},
+	} {
+		form := url.Values{}
+		form.Set("grant_type", oidc.GrantTypeAuthorizationCode)
+		form.Set("code", "unittest")
+		form.Set("client_id", test.clientID)
+
+		req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.peer}}
+		}
+		rr := httptest.NewRecorder()
+		p.ServeHTTP(rr, req)
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response["error"] != test.want {
+			t.Errorf("%s: handler returned wrong error: got %v (%v) want %v", test.name, response["error"], response["error_description"], test.want)
+		}
+	}
+}
+
+func TestTokenHandlerErrorURI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+	p.errorURIBase = "https://docs.example.com/errors/"
+
+	form := url.Values{}
+	form.Set("grant_type", "unittest")
+
+	req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(konnect.NewRequestIDContext(req.Context(), "unittest-request"))
+	rr := httptest.NewRecorder()
+	p.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["error_uri"] != "https://docs.example.com/errors/"+oidc.ErrorCodeOAuth2UnsupportedGrantType {
+		t.Errorf("handler returned wrong error_uri: got %v", response["error_uri"])
+	}
+	if description, _ := response["error_description"].(string); !strings.HasSuffix(description, "(request unittest-request)") {
+		t.Errorf("handler returned error_description without request id: got %v", description)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+	p.requestLimits = &payload.RequestLimits{
+		MaxScopes:            3,
+		MaxScopeLength:       64,
+		MaxClaimsLength:      32,
+		MaxRedirectURILength: 64,
+	}
+
+	for _, test := range []struct {
+		name   string
+		key    string
+		value  string
+		reason string
+	}{
+		{"scopes", "scope", "openid profile email offline_access", "too many scopes"},
+		{"scope length", "scope", "openid " + strings.Repeat("s", 64), "scope too long"},
+		{"claims", "claims", `{"id_token":{"` + strings.Repeat("c", 32) + `":null}}`, "claims too long"},
+		{"redirect_uri", "redirect_uri", "https://rp.example.com/" + strings.Repeat("r", 64), "redirect_uri too long"},
+	} {
+		query := url.Values{}
+		query.Set("response_type", oidc.ResponseTypeCode)
+		query.Set("scope", oidc.ScopeOpenID)
+		query.Set("client_id", "unittest-client")
+		query.Set("redirect_uri", "https://rp.example.com/cb")
+		query.Set(test.key, test.value)
+
+		req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		p.AuthorizeHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: authorize handler returned wrong status code: got %v want %v", test.name, status, http.StatusBadRequest)
+		}
+		if !strings.Contains(rr.Body.String(), test.reason) {
+			t.Errorf("%s: authorize handler returned wrong error: %v", test.name, rr.Body.String())
+		}
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", oidc.GrantTypeRefreshToken)
+	form.Set("refresh_token", "unittest")
+	form.Set("scope", "openid profile email offline_access")
+
+	req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	p.TokenHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("token handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["error"] != oidc.ErrorCodeOAuth2InvalidRequest || response["error_description"] != "too many scopes" {
+		t.Errorf("token handler returned wrong error: %v", response)
+	}
+}
+
+func TestAuthorizeHandlerRequestURI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+	p.Config.AllowRequestURI = true
+
+	for _, test := range []struct {
+		name    string
+		request string
+		code    string
+	}{
+		{"unregistered", "", konnectoidc.ErrorCodeOIDCInvalidRequestURI},
+		{"with request", "unittest.request.object", oidc.ErrorCodeOAuth2InvalidRequest},
+	} {
+		query := url.Values{}
+		query.Set("response_type", oidc.ResponseTypeCode)
+		query.Set("scope", oidc.ScopeOpenID)
+		query.Set("client_id", "unittest-client")
+		query.Set("redirect_uri", "https://rp.example.com/cb")
+		query.Set("request_uri", "https://rp.example.com/request.jwt")
+		if test.request != "" {
+			query.Set("request", test.request)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		p.AuthorizeHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: authorize handler returned wrong status code: got %v want %v", test.name, status, http.StatusBadRequest)
+		}
+		if !strings.Contains(rr.Body.String(), test.code) {
+			t.Errorf("%s: authorize handler returned wrong error: %v", test.name, rr.Body.String())
+		}
+	}
+
+	if err := p.InitializeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.metadata.RequestURIParameterSupported || !p.metadata.RequireRequestURIRegistration {
+		t.Errorf("unexpected request_uri metadata: %v %v", p.metadata.RequestURIParameterSupported, p.metadata.RequireRequestURIRegistration)
+	}
+}
+
+func TestAuthorizeHandlerRedirectURIScheme(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:                 "https-only-client",
+		Insecure:           true,
+		RedirectURISchemes: []string{"https"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	query := url.Values{}
+	query.Set("response_type", oidc.ResponseTypeCode)
+	query.Set("scope", oidc.ScopeOpenID)
+	query.Set("client_id", "https-only-client")
+	query.Set("redirect_uri", "myapp://cb")
+
+	req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	p.AuthorizeHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("authorize handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), oidc.ErrorCodeOAuth2InvalidRequest) {
+		t.Errorf("authorize handler returned wrong error: %v", rr.Body.String())
+	}
+}
+
+func TestAuthorizeHandlerCodeChallengeMethodPlain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:       "pkce-client",
+		Insecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	query := url.Values{}
+	query.Set("response_type", oidc.ResponseTypeCode)
+	query.Set("scope", oidc.ScopeOpenID)
+	query.Set("client_id", "pkce-client")
+	query.Set("redirect_uri", "https://app.example.com/cb")
+	query.Set("code_challenge", "challenge-which-is-also-the-verifier-for-plain")
+	query.Set("code_challenge_method", oidc.PlainCodeChallengeMethod)
+
+	req := httptest.NewRequest(http.MethodGet, cfg.AuthorizationPath+"?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	p.AuthorizeHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("authorize handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), oidc.ErrorCodeOAuth2InvalidRequest) {
+		t.Errorf("authorize handler returned wrong error: %v", rr.Body.String())
+	}
+}
+
+func TestWebFingerHandler(t *testing.T) {
+	h, err := NewWebFingerHandler("https://konnect.example.com", []string{"acct:*@example.com"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query  string
+		status int
+		links  int
+	}{
+		{"resource=acct:alice@example.com", http.StatusOK, 1},
+		{"resource=acct:alice@example.com&rel=" + url.QueryEscape(konnectoidc.WebFingerIssuerRel), http.StatusOK, 1},
+		{"resource=acct:alice@example.com&rel=unittest", http.StatusOK, 0},
+		{"resource=acct:alice@other.example.org", http.StatusNotFound, 0},
+		{"", http.StatusBadRequest, 0},
+	} {
+		req := httptest.NewRequest(http.MethodGet, WebFingerPath+"?"+test.query, nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%v: handler returned wrong status code: got %v want %v", test.query, status, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var response WebFingerResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Links) != test.links {
+			t.Errorf("%v: handler returned wrong number of links: got %v want %v", test.query, len(response.Links), test.links)
+		}
+		if test.links > 0 && response.Links[0].Href != "https://konnect.example.com" {
+			t.Errorf("%v: handler returned wrong issuer: got %v", test.query, response.Links[0].Href)
+		}
+	}
+}
+
+func TestEndSessionHandlerPostLogoutRedirectURI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:                     "logout-client",
+		RedirectURIs:           []string{"https://client.example.com/cb"},
+		PostLogoutRedirectURIs: []string{"https://client.example.com/logged-out"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeIDTokenHint := func(audience string, expiresAt time.Time, sid string) string {
+		claims := &konnectoidc.IDTokenClaims{
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    cfg.IssuerIdentifier,
+				Subject:   auth.Subject(),
+				Audience:  audience,
+				ExpiresAt: expiresAt.Unix(),
+			},
+		}
+		if sid != "" {
+			claims.SessionClaims = &konnectoidc.SessionClaims{
+				SessionID: sid,
+			}
+		}
+		idTokenHint, signErr := p.makeJWT(ctx, nil, claims)
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		return idTokenHint
+	}
+	idTokenHint := makeIDTokenHint("logout-client", time.Now().Add(time.Minute), "")
+	expiredIDTokenHint := makeIDTokenHint("logout-client", time.Now().Add(-time.Hour), "")
+	otherSessionIDTokenHint := makeIDTokenHint("logout-client", time.Now().Add(time.Minute), "other-session")
+
+	p.sessionCookieName = "unittest-session"
+	session := &payload.Session{
+		Version: sessionVersion,
+		ID:      "current-session",
+		Sub:     auth.Subject(),
+	}
+	serializedSession, err := p.serializeSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, test := range []struct {
+		postLogoutRedirectURI string
+		idTokenHint           string
+		clientID              string
+		allowWithoutHint      bool
+		withSession           bool
+		status                int
+	}{
+		{"https://client.example.com/logged-out", idTokenHint, "", false, false, http.StatusFound},
+		{"https://client.example.com/logged-out", expiredIDTokenHint, "", false, false, http.StatusFound},
+		{"https://client.example.com/logged-out", idTokenHint, "logout-client", false, false, http.StatusFound},
+		{"https://client.example.com/logged-out", idTokenHint, "other-client", false, false, http.StatusBadRequest},
+		{"https://client.example.com/cb", idTokenHint, "", false, false, http.StatusBadRequest},
+		{"https://evil.example.com/logged-out", idTokenHint, "", false, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out?next=https://evil.example.com", idTokenHint, "", false, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", "", "", false, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", "", "logout-client", false, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", "", "logout-client", true, false, http.StatusFound},
+		{"https://evil.example.com/logged-out", "", "logout-client", true, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", "", "", true, false, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", idTokenHint, "", false, true, http.StatusFound},
+		{"https://client.example.com/logged-out", otherSessionIDTokenHint, "", false, true, http.StatusBadRequest},
+		{"https://client.example.com/logged-out", otherSessionIDTokenHint, "", false, false, http.StatusFound},
+	} {
+		name := fmt.Sprintf("%d %s", idx, test.postLogoutRedirectURI)
+		p.Config.AllowEndSessionWithoutIDTokenHint = test.allowWithoutHint
+
+		query := url.Values{}
+		query.Set("post_logout_redirect_uri", test.postLogoutRedirectURI)
+		if test.idTokenHint != "" {
+			query.Set("id_token_hint", test.idTokenHint)
+		}
+		if test.clientID != "" {
+			query.Set("client_id", test.clientID)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/endsession?"+query.Encode(), nil)
+		if test.withSession {
+			req.AddCookie(&http.Cookie{Name: p.sessionCookieName, Value: serializedSession})
+		}
+		rr := httptest.NewRecorder()
+		p.EndSessionHandler(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", name, status, test.status)
+		}
+		location := rr.Header().Get("Location")
+		if test.status == http.StatusFound {
+			if !strings.HasPrefix(location, test.postLogoutRedirectURI) {
+				t.Errorf("%s: handler redirected to wrong location: %v", name, location)
+			}
+		} else if location != "" {
+			t.Errorf("%s: handler redirected to unregistered location: %v", name, location)
+		}
+	}
+
+	// Front-channel logout page is shown without post_logout_redirect_uri.
+	err = registry.Register(&clients.ClientRegistration{
+		ID:                                "frontchannel-client",
+		RedirectURIs:                      []string{"https://frontchannel.example.com/cb"},
+		FrontchannelLogoutURI:             "https://frontchannel.example.com/logout",
+		FrontchannelLogoutSessionRequired: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/konnect/v1/endsession?id_token_hint="+makeIDTokenHint("frontchannel-client", time.Now().Add(time.Minute), "current-session"), nil)
+	rr := httptest.NewRecorder()
+	p.EndSessionHandler(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || rr.Header().Get("Location") != "" {
+		t.Errorf("frontchannel logout without post_logout_redirect_uri returned wrong status: %v %v", rr.Code, rr.Header().Get("Location"))
+	}
+	if !strings.Contains(body, `<iframe src="https://frontchannel.example.com/logout?iss=`) || !strings.Contains(body, `sid=current-session`) {
+		t.Errorf("frontchannel logout iframe missing, got %s", body)
+	}
+	if !strings.Contains(body, "You have been signed out.") || strings.Contains(body, `http-equiv="refresh"`) {
+		t.Errorf("frontchannel logout page without post_logout_redirect_uri must not redirect, got %s", body)
+	}
+}
+
+func TestRegistrationHandlerInitialAccessToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.registrationInitialAccessToken = "unittest-initial-token"
+	p.registrationInitialAccessTokenKeys = map[string]crypto.PublicKey{
+		"provisioner": key.Public(),
+	}
+
+	makeInitialAccessToken := func(kid string, audience string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"aud": audience,
+			"exp": time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header[oidc.JWTHeaderKeyID] = kid
+		tokenString, signErr := token.SignedString(key)
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		return tokenString
+	}
+
+	for _, test := range []struct {
+		name          string
+		authorization string
+		allowed       bool
+	}{
+		{"missing", "", false},
+		{"wrong", "Bearer unittest-wrong-token", false},
+		{"basic", "Basic dW5pdHRlc3Q6dW5pdHRlc3Q=", false},
+		{"token", "Bearer unittest-initial-token", true},
+		{"jwt", "Bearer " + makeInitialAccessToken("provisioner", cfg.IssuerIdentifier), true},
+		{"jwt-kid", "Bearer " + makeInitialAccessToken("other", cfg.IssuerIdentifier), false},
+		{"jwt-aud", "Bearer " + makeInitialAccessToken("provisioner", "https://other.example.com"), false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/konnect/v1/register", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rr := httptest.NewRecorder()
+		p.RegistrationHandler(rr, req)
+
+		if test.allowed && rr.Code == http.StatusForbidden {
+			t.Errorf("%s: handler rejected valid initial access token", test.name)
+		} else if !test.allowed && rr.Code != http.StatusForbidden {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, rr.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestUserInfoHandlerRequireAudience(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+	p.Config.UserInfoRequireAudience = true
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeAccessToken := func(audience interface{}) string {
+		accessToken, signErr := p.makeJWT(ctx, nil, jwt.MapClaims{
+			"iss":                         cfg.IssuerIdentifier,
+			"sub":                         auth.Subject(),
+			"aud":                         audience,
+			"azp":                         "unittest-client",
+			"exp":                         time.Now().Add(time.Minute).Unix(),
+			konnect.IsAccessTokenClaim:    true,
+			konnect.AuthorizedScopesClaim: []string{oidc.ScopeOpenID},
+		})
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		return accessToken
+	}
+
+	for _, test := range []struct {
+		name     string
+		audience interface{}
+		allowed  bool
+	}{
+		{"string", cfg.IssuerIdentifier, true},
+		{"array", []string{"unittest-client", cfg.IssuerIdentifier}, true},
+		{"client", "unittest-client", false},
+		{"other", []string{"unittest-client", "https://other.example.com"}, false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+makeAccessToken(test.audience))
+		rr := httptest.NewRecorder()
+		p.UserInfoHandler(rr, req)
+
+		header := rr.Header().Get("WWW-Authenticate")
+		if test.allowed {
+			// NOTE: The dummy identity manager does not provide kc.identity
+			// claims, so only ensure that the audience was accepted.
+			if strings.Contains(header, "audience mismatch") {
+				t.Errorf("%s: handler rejected valid audience: %v", test.name, header)
+			}
+			continue
+		}
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, rr.Code, http.StatusUnauthorized)
+		}
+		if !strings.HasPrefix(header, "Bearer error=\"invalid_token\"") {
+			t.Errorf("%s: handler returned wrong WWW-Authenticate header: %v", test.name, header)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, provider, _, _ := NewTestProvider(ctx, t)
+	defer httpServer.Close()
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:           "branded-client",
+		Name:         "Branded <App>",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.clients = registry
+
+	// Built-in pages without templates directory.
+	req := httptest.NewRequest(http.MethodGet, "/konnect/v1/authorize", nil)
+	rr := httptest.NewRecorder()
+	provider.ClientErrorPage(rr, req, "branded-client", http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, "missing parameter")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "400 invalid_request - missing parameter") {
+		t.Errorf("unexpected built-in error page: %v %v", rr.Code, rr.Body.String())
+	}
+
+	templatesPath, err := ioutil.TempDir("", "konnect-templates-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templatesPath)
+	err = ioutil.WriteFile(filepath.Join(templatesPath, TemplateNameError), []byte(`<p>{{.StatusCode}} {{.Error}}: {{.ErrorDescription}} ({{.ClientName}})</p>`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(templatesPath, TemplateNameFormPostResponse), []byte(`<form action="{{.RedirectURI}}">{{.ClientName}}</form><script nonce="{{.Nonce}}"></script>`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.templates, err = loadTemplates(templatesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	provider.ClientErrorPage(rr, req, "branded-client", http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest, "missing <parameter>")
+	if body := rr.Body.String(); rr.Code != http.StatusBadRequest || body != "<p>400 invalid_request: missing &lt;parameter&gt; (Branded &lt;App&gt;)</p>" {
+		t.Errorf("unexpected error page: %v %v", rr.Code, body)
+	}
+
+	rr = httptest.NewRecorder()
+	provider.ClientErrorPage(rr, req, "unknown-client", http.StatusNotFound, "", "")
+	if body := rr.Body.String(); body != "<p>404 Not Found:  ()</p>" {
+		t.Errorf("unexpected error page for unknown client: %v", body)
+	}
+
+	uri, _ := url.Parse("https://client.example.com/cb")
+	rr = httptest.NewRecorder()
+	provider.FormPostResponsePage(rr, req, "branded-client", uri, &struct {
+		State string `url:"state"`
+	}{"xyz"})
+	if body := rr.Body.String(); !strings.HasPrefix(body, `<form action="https://client.example.com/cb">Branded &lt;App&gt;</form>`) {
+		t.Errorf("unexpected form post response page: %v", body)
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "style-src 'self'") {
+		t.Errorf("unexpected form post response page csp: %v", csp)
+	}
+
+	// Pages without template keep using the built-in template.
+	rr = httptest.NewRecorder()
+	provider.FrontchannelLogoutPage(rr, req, "branded-client", nil, []string{"https://client.example.com/logout"}, uri, nil)
+	if body := rr.Body.String(); !strings.Contains(body, "<title>Signing out</title>") {
+		t.Errorf("unexpected frontchannel logout page: %v", body)
+	}
+}
+
+func TestRevocationHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, provider, _, _ := NewTestProvider(ctx, t)
+	defer httpServer.Close()
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{
+			ID:           "revoke-client",
+			Secret:       "revoke-secret",
+			RedirectURIs: []string{"https://rp.example.com/cb"},
+		},
+		{
+			ID:           "other-client",
+			Secret:       "other-secret",
+			RedirectURIs: []string{"https://rp.example.com/cb"},
+		},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider.clients = registry
+	provider.refreshManager = refreshManagers.NewMemoryMapManager(ctx, 0, 0)
+	provider.revocationManager = revocationManagers.NewMemoryMapManager(ctx, 0)
+	provider.revocationPath = "/konnect/v1/revoke"
+	provider.accessTokenDuration = time.Hour
+	provider.refreshTokenDuration = time.Hour
+
+	auth, _, err := provider.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := provider.MakeAccessToken(ctx, "revoke-client", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, refreshTokenID, err := provider.createRefreshTokenFamily(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := provider.makeRefreshToken(ctx, "revoke-client", auth, nil, provider.signingMethodDefault, family, refreshTokenID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := func(method string, clientID string, clientSecret string, token string, tokenTypeHint string) (int, string) {
+		form := url.Values{}
+		form.Set("token", token)
+		if tokenTypeHint != "" {
+			form.Set("token_type_hint", tokenTypeHint)
+		}
+		req := httptest.NewRequest(method, provider.revocationPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clientID, clientSecret)
+		rr := httptest.NewRecorder()
+		provider.ServeHTTP(rr, req)
+
+		var response map[string]interface{}
+		if rr.Code != http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			errorID, _ := response["error"].(string)
+			return rr.Code, errorID
+		}
+		return rr.Code, ""
+	}
+	accessTokenError := func() error {
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		_, err := provider.GetAccessTokenClaimsFromRequest(req)
+		return err
+	}
+
+	for _, test := range []struct {
+		name          string
+		method        string
+		clientID      string
+		clientSecret  string
+		token         string
+		expectedCode  int
+		expectedError string
+	}{
+		{"get", http.MethodGet, "revoke-client", "revoke-secret", accessToken, http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest},
+		{"missing token", http.MethodPost, "revoke-client", "revoke-secret", "", http.StatusBadRequest, oidc.ErrorCodeOAuth2InvalidRequest},
+		{"wrong secret", http.MethodPost, "revoke-client", "wrong", accessToken, http.StatusBadRequest, konnectoidc.ErrorCodeOAuth2InvalidClient},
+		{"invalid token", http.MethodPost, "revoke-client", "revoke-secret", "invalid", http.StatusOK, ""},
+		{"other client", http.MethodPost, "other-client", "other-secret", accessToken, http.StatusOK, ""},
+	} {
+		code, errorID := revoke(test.method, test.clientID, test.clientSecret, test.token, "")
+		if code != test.expectedCode || errorID != test.expectedError {
+			t.Errorf("%s: handler returned %d/%v, expected %d/%v", test.name, code, errorID, test.expectedCode, test.expectedError)
+		}
+	}
+	if err = accessTokenError(); err != nil {
+		t.Fatalf("access token rejected before revocation: %v", err)
+	}
+
+	if code, errorID := revoke(http.MethodPost, "revoke-client", "revoke-secret", accessToken, ""); code != http.StatusOK {
+		t.Fatalf("access token revocation failed: %d/%v", code, errorID)
+	}
+	if oauth2Err, ok := accessTokenError().(*konnectoidc.OAuth2Error); !ok || oauth2Err.ErrorID != oidc.ErrorCodeOAuth2InvalidToken {
+		t.Errorf("revoked access token not rejected: %v", oauth2Err)
+	}
+
+	if code, errorID := revoke(http.MethodPost, "revoke-client", "revoke-secret", refreshToken, konnectoidc.TokenTypeHintRefreshToken); code != http.StatusOK {
+		t.Fatalf("refresh token revocation failed: %d/%v", code, errorID)
+	}
+	if revoked, _ := provider.revocationManager.IsRevoked(refreshTokenID); !revoked {
+		t.Error("refresh token not on denylist")
+	}
+	if _, err = provider.refreshManager.Rotate(family, refreshTokenID, "next", time.Now().Add(time.Hour)); err != refresh.ErrUnknownFamily {
+		t.Errorf("refresh token family not revoked: %v", err)
+	}
+
+	// Access tokens cannot be revoked without revoked tokens store.
+	provider.revocationManager = nil
+	if code, errorID := revoke(http.MethodPost, "revoke-client", "revoke-secret", accessToken, ""); code != http.StatusBadRequest || errorID != konnectoidc.ErrorCodeOAuth2UnsupportedTokenType {
+		t.Errorf("access token revocation without store returned %d/%v", code, errorID)
+	}
+
+	rr := httptest.NewRecorder()
+	provider.WellKnownHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	var wellKnown map[string]interface{}
+	if err = json.Unmarshal(rr.Body.Bytes(), &wellKnown); err != nil {
+		t.Fatal(err)
+	}
+	if wellKnown["revocation_endpoint"] != "http://localhost:8777/konnect/v1/revoke" {
+		t.Errorf("wrong revocation_endpoint: %v", wellKnown["revocation_endpoint"])
+	}
+}
+
+type refreshTestUser struct {
+	sub string
+}
+
+func (u *refreshTestUser) Subject() string {
+	return u.sub
+}
+
+func (u *refreshTestUser) Raw() string {
+	return u.sub
+}
+
+func (u *refreshTestUser) Claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		konnect.IdentifiedUserIDClaim: u.sub,
+	}
+}
+
+// refreshTestIdentityManager returns users with identity claims, so that
+// refresh tokens can be refreshed again.
+type refreshTestIdentityManager struct {
+	*identityManagers.DummyIdentityManager
+}
+
+func (im *refreshTestIdentityManager) Fetch(ctx context.Context, userID string, sessionRef *string, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) (identity.AuthRecord, bool, error) {
+	auth, found, err := im.DummyIdentityManager.Fetch(ctx, userID, sessionRef, scopes, requestedClaimsMaps)
+	if found && err == nil {
+		auth.SetUser(&refreshTestUser{userID})
+	}
+
+	return auth, found, err
+}
+
+func TestTokenHandlerRefreshTokenSessionID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	im := &refreshTestIdentityManager{
+		DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{
+			ScopesSupported: []string{oidc.ScopeOfflineAccess},
+		}, "unittestuser"),
+	}
+	httpServer, provider, _, cfg := NewTestProviderWithIdentityManager(ctx, t, im)
+	defer httpServer.Close()
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.Register(&clients.ClientRegistration{
+		ID:           "refresh-client",
+		Secret:       "refresh-secret",
+		RedirectURIs: []string{"https://rp.example.com/cb"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	provider.clients = registry
+	provider.refreshTokenRotation = RefreshTokenRotationAll
+	provider.refreshManager = refreshManagers.NewMemoryMapManager(ctx, 0, 0)
+	provider.refreshTokenDuration = time.Hour
+
+	auth, _, err := provider.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.AuthorizeScopes(map[string]bool{
+		oidc.ScopeOpenID:        true,
+		oidc.ScopeOfflineAccess: true,
+	})
+	family, refreshTokenID, err := provider.createRefreshTokenFamily(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := provider.makeRefreshToken(ctx, "refresh-client", auth, &payload.Session{ID: "unittest-sid"}, nil, family, refreshTokenID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parseUnverified := func(token string, claims jwt.Claims) {
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each refresh must keep the sid, also with rotated refresh tokens.
+	for i := 0; i < 2; i++ {
+		form := url.Values{}
+		form.Set("grant_type", oidc.GrantTypeRefreshToken)
+		form.Set("refresh_token", refreshToken)
+
+		req := httptest.NewRequest(http.MethodPost, cfg.TokenPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("refresh-client", "refresh-secret")
+		rr := httptest.NewRecorder()
+		provider.TokenHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("token handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+		}
+		var response payload.TokenSuccess
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.IDToken == "" || response.RefreshToken == "" {
+			t.Fatalf("token handler returned no id_token or refresh_token: %s", rr.Body.String())
+		}
+
+		idTokenClaims := &konnectoidc.IDTokenClaims{}
+		parseUnverified(response.IDToken, idTokenClaims)
+		if idTokenClaims.SessionClaims == nil || idTokenClaims.SessionID != "unittest-sid" {
+			t.Errorf("refreshed id_token has wrong sid: %#v", idTokenClaims.SessionClaims)
+		}
+		refreshTokenClaims := &konnect.RefreshTokenClaims{}
+		parseUnverified(response.RefreshToken, refreshTokenClaims)
+		if refreshTokenClaims.SessionID != "unittest-sid" {
+			t.Errorf("rotated refresh_token has wrong sid: %#v", refreshTokenClaims.SessionID)
+		}
+
+		refreshToken = response.RefreshToken
+	}
+}
+
+func TestKeysAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	nextKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseSigner := func(data []byte) (string, crypto.Signer, error) {
+		switch string(data) {
+		case "next":
+			return "", nextKey, nil
+		case "next-with-kid":
+			return "other", nextKey, nil
+		case "ec":
+			return "", ecKey, nil
+		}
+		return "", nil, errors.New("invalid key data")
+	}
+
+	router := mux.NewRouter()
+	NewKeysAdminHandler("/admin/keys", p, "unittest-admin-token", parseSigner, logger).AddRoutes(ctx, router)
+
+	for _, test := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+		status map[string]string
+	}{
+		{"no token", http.MethodGet, "/admin/keys", "", "", http.StatusUnauthorized, nil},
+		{"wrong token", http.MethodGet, "/admin/keys", "wrong", "", http.StatusUnauthorized, nil},
+		{"list", http.MethodGet, "/admin/keys", "unittest-admin-token", "", http.StatusOK, map[string]string{"default": KeyStatusActive}},
+		{"invalid key", http.MethodPut, "/admin/keys/next", "unittest-admin-token", "garbage", http.StatusBadRequest, nil},
+		{"kid mismatch", http.MethodPut, "/admin/keys/next", "unittest-admin-token", "next-with-kid", http.StatusBadRequest, nil},
+		{"wrong key type", http.MethodPut, "/admin/keys/next", "unittest-admin-token", "ec", http.StatusBadRequest, nil},
+		{"promote unknown", http.MethodPost, "/admin/keys/next/promote", "unittest-admin-token", "", http.StatusNotFound, nil},
+		{"add", http.MethodPut, "/admin/keys/next", "unittest-admin-token", "next", http.StatusOK, map[string]string{"default": KeyStatusActive, "next": KeyStatusPending}},
+		{"add existing", http.MethodPut, "/admin/keys/next", "unittest-admin-token", "next", http.StatusConflict, nil},
+		{"promote", http.MethodPost, "/admin/keys/next/promote", "unittest-admin-token", "", http.StatusOK, map[string]string{"default": KeyStatusInactive, "next": KeyStatusActive}},
+		{"promote active", http.MethodPost, "/admin/keys/next/promote", "unittest-admin-token", "", http.StatusConflict, nil},
+		{"retire active", http.MethodDelete, "/admin/keys/next", "unittest-admin-token", "", http.StatusConflict, nil},
+		{"retire", http.MethodDelete, "/admin/keys/default", "unittest-admin-token", "", http.StatusOK, map[string]string{"default": KeyStatusRetired, "next": KeyStatusActive}},
+		{"retire unknown", http.MethodDelete, "/admin/keys/unknown", "unittest-admin-token", "", http.StatusNotFound, nil},
+		{"add retired", http.MethodPut, "/admin/keys/default", "unittest-admin-token", "next", http.StatusConflict, nil},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.code {
+			t.Errorf("%s: got status %v want %v: %v", test.name, rr.Code, test.code, rr.Body.String())
+			continue
+		}
+		if test.status == nil {
+			continue
+		}
+		var response struct {
+			Keys []*KeyInfo `json:"keys"`
+		}
+		if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		status := make(map[string]string)
+		for _, key := range response.Keys {
+			status[key.ID] = key.Status
+		}
+		if !reflect.DeepEqual(status, test.status) {
+			t.Errorf("%s: got keys %v want %v", test.name, status, test.status)
+		}
+	}
 }
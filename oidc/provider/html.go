@@ -185,3 +185,80 @@ c.u(b.B());c.u(n.substr(0,64-(d.f[1]+8&63)));c.c(d.f[0]<<3|d.f[0]>>>28);c.c(d.f[
 </body>
 </html>
 `))
+
+var frontchannelLogoutTemplate = template.Must(template.New("frontchannel-logout.html").Parse(`
+<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+{{if .RedirectURI}}<meta http-equiv="refresh" content="{{.Timeout}};url={{.RedirectURI}}">
+{{end}}<title>Signing out</title>
+</head>
+<body data-redirect-uri="{{.RedirectURI}}" data-timeout="{{.Timeout}}">
+{{if not .RedirectURI}}<p>You have been signed out.</p>
+{{end}}{{range .URIs}}<iframe src="{{.}}" hidden></iframe>
+{{end}}<script type="text/javascript" nonce={{.Nonce}}>
+(function() {
+	'use strict';
+
+	var redirectURI = document.body.getAttribute('data-redirect-uri');
+	var timeout = parseInt(document.body.getAttribute('data-timeout'), 10) * 1000;
+	var frames = document.getElementsByTagName('iframe');
+	var pending = frames.length;
+	var done = false;
+
+	function redirect() {
+		if (done) {
+			return;
+		}
+		done = true;
+		if (redirectURI) {
+			window.location.replace(redirectURI);
+		}
+	}
+
+	function loaded() {
+		pending--;
+		if (pending <= 0) {
+			redirect();
+		}
+	}
+
+	for (var i = 0; i < frames.length; i++) {
+		frames[i].addEventListener('load', loaded, false);
+		frames[i].addEventListener('error', loaded, false);
+	}
+	if (pending <= 0) {
+		redirect();
+	}
+	window.setTimeout(redirect, timeout);
+})();
+</script>
+</body>
+</html>
+`))
+
+var formPostResponseTemplate = template.Must(template.New("form-post-response.html").Parse(`
+<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Submit this form</title>
+</head>
+<body>
+<form method="post" action="{{.RedirectURI}}">
+{{range $name, $values := .Values}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<noscript>
+  <button type="submit">Continue</button>
+</noscript>
+</form>
+<script type="text/javascript" nonce={{.Nonce}}>
+(function() {
+	'use strict';
+
+	document.forms[0].submit();
+})();
+</script>
+</body>
+</html>
+`))
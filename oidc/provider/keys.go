@@ -0,0 +1,205 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+
+	"stash.kopano.io/kc/konnect/signing"
+)
+
+// Key status values as tracked by the provider for each key id.
+const (
+	// KeyStatusPending marks signing keys which are published for validation
+	// but not yet used for signing.
+	KeyStatusPending = "pending"
+	// KeyStatusActive marks keys which are used for signing.
+	KeyStatusActive = "active"
+	// KeyStatusInactive marks keys which are not used for signing, but are
+	// still published and accepted for validation.
+	KeyStatusInactive = "inactive"
+	// KeyStatusRetired marks keys which have been dropped and are no longer
+	// accepted for validation.
+	KeyStatusRetired = "retired"
+)
+
+// Key management errors.
+var (
+	ErrKeyUnknown       = errors.New("unknown key")
+	ErrKeyExists        = errors.New("key already exists")
+	ErrKeyInvalidStatus = errors.New("operation not allowed with key status")
+)
+
+// KeyInfo describes a key known to the provider.
+type KeyInfo struct {
+	ID     string `json:"kid"`
+	Status string `json:"status"`
+}
+
+// AddPendingSigningKey adds the provided signer with the provided id as
+// pending signing key. Pending keys are published and accepted for validation
+// but not used for signing until promoted with PromoteSigningKey.
+func (p *Provider) AddPendingSigningKey(id string, key crypto.Signer) error {
+	if id == "" {
+		return errors.New("key id must not be empty")
+	}
+
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	if _, exists := p.validationKeys[id]; exists || p.retiredKeys[id] {
+		return ErrKeyExists
+	}
+	if p.signingMethodDefault == nil {
+		return errors.New("no signing method")
+	}
+	if !signerMatchesSigningMethod(key, p.signingMethodDefault) {
+		return fmt.Errorf("key type %T does not match signing method %v", key, p.signingMethodDefault.Alg())
+	}
+
+	p.pendingSigners[id] = key
+	p.setValidationKey(id, key.Public())
+
+	p.logger.WithField("id", id).Infoln("added pending provider signing key")
+
+	return nil
+}
+
+// PromoteSigningKey makes the pending signing key with the provided id the
+// active signing key. The previously active signing key of the same type stays
+// published and accepted for validation until retired with RetireKey.
+func (p *Provider) PromoteSigningKey(id string) error {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	key, ok := p.pendingSigners[id]
+	if !ok {
+		if _, exists := p.validationKeys[id]; exists || p.retiredKeys[id] {
+			return ErrKeyInvalidStatus
+		}
+		return ErrKeyUnknown
+	}
+
+	err := p.setSigningKey(id, key)
+	if err != nil {
+		return err
+	}
+	delete(p.pendingSigners, id)
+
+	p.logger.WithField("id", id).Infoln("promoted provider signing key")
+
+	return nil
+}
+
+// RetireKey drops the key with the provided id. Retired keys are no longer
+// published nor accepted for validation. Active signing keys cannot be
+// retired.
+func (p *Provider) RetireKey(id string) error {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	switch p.keyStatus(id) {
+	case KeyStatusPending, KeyStatusInactive:
+		// Breaks.
+	case "":
+		return ErrKeyUnknown
+	default:
+		return ErrKeyInvalidStatus
+	}
+
+	delete(p.pendingSigners, id)
+	delete(p.validationKeys, id)
+	p.retiredKeys[id] = true
+
+	p.logger.WithField("id", id).Infoln("retired provider key")
+
+	return nil
+}
+
+// Keys returns information about all keys known to the accociated provider,
+// sorted by key id.
+func (p *Provider) Keys() []*KeyInfo {
+	p.keysMutex.RLock()
+	defer p.keysMutex.RUnlock()
+
+	ids := make([]string, 0, len(p.validationKeys)+len(p.retiredKeys))
+	for id := range p.validationKeys {
+		ids = append(ids, id)
+	}
+	for id := range p.retiredKeys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := make([]*KeyInfo, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, &KeyInfo{
+			ID:     id,
+			Status: p.keyStatus(id),
+		})
+	}
+
+	return keys
+}
+
+// keyStatus returns the status of the key with the provided id or an empty
+// string if the key is unknown. The caller must hold keysMutex.
+func (p *Provider) keyStatus(id string) string {
+	if p.retiredKeys[id] {
+		return KeyStatusRetired
+	}
+	if _, ok := p.pendingSigners[id]; ok {
+		return KeyStatusPending
+	}
+	for _, sk := range p.signingKeys {
+		if sk.ID == id {
+			return KeyStatusActive
+		}
+	}
+	if _, ok := p.validationKeys[id]; ok {
+		return KeyStatusInactive
+	}
+
+	return ""
+}
+
+// signerMatchesSigningMethod returns true if the provided signer can be used
+// to sign with the provided signing method.
+func signerMatchesSigningMethod(key crypto.Signer, signingMethod jwt.SigningMethod) bool {
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodECDSA:
+		_, ok := key.Public().(*ecdsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.Public().(*rsa.PublicKey)
+		return ok
+	case *signing.SigningMethodEdwardsCurve:
+		_, ok := key.Public().(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/square/go-jose.v2"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identity/clients"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// loginHintTokenKeySizes are the key sizes in bytes of the content
+// encryption algorithms supported for directly encrypted login_hint_token
+// values.
+var loginHintTokenKeySizes = map[jose.ContentEncryption]int{
+	jose.A128GCM:       16,
+	jose.A192GCM:       24,
+	jose.A256GCM:       32,
+	jose.A128CBC_HS256: 32,
+	jose.A192CBC_HS384: 48,
+	jose.A256CBC_HS512: 64,
+}
+
+// applyLoginHintToken validates the login_hint_token of the provided
+// authentication request and replaces its login hint with the hint of the
+// token. Invalid or expired tokens are ignored, keeping the plain login hint.
+func (p *Provider) applyLoginHintToken(req *http.Request, ar *payload.AuthenticationRequest) {
+	if ar.RawLoginHintToken == "" {
+		return
+	}
+
+	claims, err := p.validateLoginHintToken(req, ar.ClientID, ar.RawLoginHintToken)
+	if err != nil {
+		p.logger.WithError(err).WithField("client_id", ar.ClientID).Debugln("authorize request ignored invalid login_hint_token")
+		return
+	}
+	if hint := claims.Hint(); hint != "" {
+		ar.LoginHint = hint
+	}
+}
+
+// validateLoginHintToken validates the provided login_hint_token of the client
+// with the provided client ID and returns its claims. The token is either a
+// JWT signed with a registered key of the client, or a JWE encrypted with a
+// key derived from the client's secret using the dir algorithm. The JWE may
+// contain a signed JWT, or the claims directly.
+func (p *Provider) validateLoginHintToken(req *http.Request, clientID string, tokenString string) (*payload.LoginHintTokenClaims, error) {
+	ctx := req.Context()
+	registration, _ := p.clients.Get(ctx, clientID)
+	if registration == nil {
+		return nil, errors.New("unknown client")
+	}
+
+	if strings.Count(tokenString, ".") == 4 {
+		plaintext, err := decryptLoginHintToken(registration, tokenString)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Count(string(plaintext), ".") != 2 {
+			// NOTE: Directly encrypted claims are authenticated by the
+			// symmetric key derived from the client's secret.
+			claims := &payload.LoginHintTokenClaims{}
+			if err = json.Unmarshal(plaintext, claims); err != nil {
+				return nil, fmt.Errorf("failed to decode login_hint_token claims: %v", err)
+			}
+			if err = p.validateLoginHintTokenClaims(clientID, claims); err != nil {
+				return nil, err
+			}
+			return claims, nil
+		}
+		tokenString = string(plaintext)
+	}
+
+	parser := &jwt.Parser{
+		ValidMethods: p.clientAssertionSigningAlgs,
+	}
+	token, err := parser.ParseWithClaims(tokenString, &payload.LoginHintTokenClaims{}, p.strictKeyfunc(req, "login_hint_token", func(token *jwt.Token) (interface{}, error) {
+		if !p.isClientAssertionSigningAlgAllowed(token.Method.Alg()) {
+			return nil, errors.New("token alg not allowed")
+		}
+		secureClient, err := p.clients.Secure(ctx, registration, token.Header[oidc.JWTHeaderKeyID])
+		if err != nil {
+			return nil, err
+		}
+		return secureClient.PublicKey, nil
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("invalid login_hint_token: %v", err)
+	}
+
+	claims := token.Claims.(*payload.LoginHintTokenClaims)
+	if err = p.validateLoginHintTokenClaims(clientID, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// validateLoginHintTokenClaims validates the expiry of the provided
+// login_hint_token claims and their issuer and audience if set. The issuer
+// must be the client, the audience must include the issuer identifier.
+func (p *Provider) validateLoginHintTokenClaims(clientID string, claims *payload.LoginHintTokenClaims) error {
+	if err := claims.Valid(); err != nil {
+		return fmt.Errorf("invalid login_hint_token: %v", err)
+	}
+	if claims.Issuer != "" && claims.Issuer != clientID {
+		return errors.New("login_hint_token iss does not match client")
+	}
+	if len(claims.RawAudience) > 0 {
+		audienceOK := false
+		for _, audience := range claims.Audience() {
+			if p.isAcceptedIssuer(audience) {
+				audienceOK = true
+				break
+			}
+		}
+		if !audienceOK {
+			return errors.New("login_hint_token aud does not match issuer")
+		}
+	}
+
+	return nil
+}
+
+// decryptLoginHintToken decrypts the provided JWE login_hint_token with the
+// symmetric key derived from the provided client registration's secret.
+func decryptLoginHintToken(registration *clients.ClientRegistration, tokenString string) ([]byte, error) {
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(tokenString[:strings.Index(tokenString, ".")])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode login_hint_token header: %v", err)
+	}
+	if err = json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("failed to decode login_hint_token header: %v", err)
+	}
+	if jose.KeyAlgorithm(header.Alg) != jose.DIRECT {
+		return nil, fmt.Errorf("unsupported login_hint_token alg: %v", header.Alg)
+	}
+	size, ok := loginHintTokenKeySizes[jose.ContentEncryption(header.Enc)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported login_hint_token enc: %v", header.Enc)
+	}
+
+	key, err := registration.SymmetricKey(size)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := jose.ParseEncrypted(tokenString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse login_hint_token: %v", err)
+	}
+	plaintext, err := encrypted.Decrypt(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt login_hint_token: %v", err)
+	}
+
+	return plaintext, nil
+}
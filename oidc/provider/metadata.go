@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identity"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+// metadataExtendPrefix marks discovery metadata override values which extend
+// the computed values instead of replacing them.
+const metadataExtendPrefix = "+"
+
+// implementedClaims are claims which are always created by the provider in
+// addition to the claims supported by the identity manager.
+var implementedClaims = []string{
+	oidc.IssuerIdentifierClaim,
+	oidc.SubjectIdentifierClaim,
+	oidc.AudienceClaim,
+	oidc.ExpirationClaim,
+	oidc.IssuedAtClaim,
+	oidc.AuthTimeClaim,
+	konnectoidc.AuthenticationContextClassReferenceClaim,
+	konnectoidc.AuthenticationMethodsReferencesClaim,
+	"nonce",
+	"at_hash",
+	"c_hash",
+	"sid",
+}
+
+// implementedGrantTypes are the grant types which are supported by the
+// provider's endpoints.
+var implementedGrantTypes = []string{
+	oidc.GrantTypeAuthorizationCode,
+	oidc.GrantTypeImplicit,
+	oidc.GrantTypeRefreshToken,
+	konnectoidc.GrantTypeClientCredentials,
+}
+
+// applyMetadataOverrides returns the provided computed values with the
+// provided overrides applied. Override values are validated against the
+// provided implemented values. If implemented is nil, any non empty value is
+// accepted.
+func applyMetadataOverrides(name string, computed []string, overrides []string, implemented []string) ([]string, error) {
+	if len(overrides) == 0 {
+		return computed, nil
+	}
+
+	var allowed map[string]bool
+	if implemented != nil {
+		allowed = make(map[string]bool)
+		for _, value := range implemented {
+			allowed[value] = true
+		}
+	}
+
+	var replaced []string
+	var extended []string
+	for _, value := range overrides {
+		value = strings.TrimSpace(value)
+		extend := strings.HasPrefix(value, metadataExtendPrefix)
+		if extend {
+			value = strings.TrimSpace(strings.TrimPrefix(value, metadataExtendPrefix))
+		}
+		if value == "" || strings.ContainsAny(value, " \t") {
+			return nil, fmt.Errorf("invalid %s value: %#v", name, value)
+		}
+		if allowed != nil && !allowed[value] {
+			return nil, fmt.Errorf("unsupported %s value: %s", name, value)
+		}
+		if extend {
+			extended = append(extended, value)
+		} else {
+			replaced = append(replaced, value)
+		}
+	}
+
+	if replaced == nil {
+		replaced = computed
+	}
+
+	return uniqueStrings(append(append([]string{}, replaced...), extended...)), nil
+}
+
+// initializeMetadataOverrides applies the configured discovery metadata
+// overrides to the accociated provider's metadata document.
+func (p *Provider) initializeMetadataOverrides() error {
+	var err error
+
+	p.metadata.ClaimsSupported, err = applyMetadataOverrides("claims_supported", p.metadata.ClaimsSupported, p.Config.ClaimsSupported, uniqueStrings(append(append([]string{}, implementedClaims...), p.identityManager.ClaimsSupported(nil)...)))
+	if err != nil {
+		return err
+	}
+	p.metadata.GrantTypesSupported, err = applyMetadataOverrides("grant_types_supported", p.metadata.GrantTypesSupported, p.Config.GrantTypesSupported, implementedGrantTypes)
+	if err != nil {
+		return err
+	}
+	// NOTE: Only ACR values with ACR policy of the identity manager are
+	// enforced, others are opaque to konnect and passed along to authorities
+	// as is, thus they must be allowed explicitly.
+	implementedACRValues := []string{}
+	if acrValuesManager, ok := p.identityManager.(identity.ManagerWithACRValues); ok {
+		implementedACRValues = append(implementedACRValues, acrValuesManager.ACRValuesSupported()...)
+	}
+	if p.Config.AllowOpaqueACRValues {
+		implementedACRValues = nil
+	}
+	p.metadata.ACRValuesSupported, err = applyMetadataOverrides("acr_values_supported", p.metadata.ACRValuesSupported, p.Config.ACRValuesSupported, implementedACRValues)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identity"
+	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+func TestInitializeMetadataOverrides(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProviderWithIdentityManager(ctx, t, &acrValuesIdentityManager{
+		Manager: identityManagers.NewDummyIdentityManager(
+			&identity.Config{},
+			"unittestuser",
+		),
+		acrValues: []string{"urn:example:mfa"},
+	})
+
+	tests := []struct {
+		name        string
+		claims      []string
+		grantTypes  []string
+		acrValues   []string
+		allowOpaque bool
+		err         bool
+	}{
+		{"implemented claim", []string{"+" + konnectoidc.AuthenticationContextClassReferenceClaim}, nil, nil, false, false},
+		{"unknown claim", []string{"+unittest"}, nil, nil, false, true},
+		{"implemented grant type", nil, []string{oidc.GrantTypeAuthorizationCode}, nil, false, false},
+		{"unknown grant type", nil, []string{"urn:example:unittest"}, nil, false, true},
+		{"acr with policy", nil, nil, []string{"urn:example:mfa"}, false, false},
+		{"acr without policy", nil, nil, []string{"+urn:example:extra"}, false, true},
+		{"acr without policy replaced", nil, nil, []string{"urn:example:extra"}, false, true},
+		{"opaque acr", nil, nil, []string{"+urn:example:extra"}, true, false},
+	}
+
+	for _, test := range tests {
+		p.Config.ClaimsSupported = test.claims
+		p.Config.GrantTypesSupported = test.grantTypes
+		p.Config.ACRValuesSupported = test.acrValues
+		p.Config.AllowOpaqueACRValues = test.allowOpaque
+
+		err := p.InitializeMetadata()
+		if test.err && err == nil {
+			t.Errorf("%s: expected error, got none", test.name)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestInitializeMetadataACROverridesWithoutPolicies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	p.Config.ACRValuesSupported = []string{"urn:example:mfa"}
+	if err := p.InitializeMetadata(); err == nil {
+		t.Errorf("expected error for acr_values_supported override without acr policies, got none")
+	}
+
+	p.Config.AllowOpaqueACRValues = true
+	if err := p.InitializeMetadata(); err != nil {
+		t.Errorf("unexpected error for opaque acr_values_supported override: %v", err)
+	}
+	if len(p.metadata.ACRValuesSupported) != 1 || p.metadata.ACRValuesSupported[0] != "urn:example:mfa" {
+		t.Errorf("wrong acr_values_supported: %v", p.metadata.ACRValuesSupported)
+	}
+}
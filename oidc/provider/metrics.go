@@ -0,0 +1,101 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"stash.kopano.io/kc/konnect/tracing"
+)
+
+const metricsSubsystem = "provider"
+
+var (
+	tokenSigningDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "konnect",
+			Subsystem: metricsSubsystem,
+			Name:      "token_signing_duration_seconds",
+			Help:      "Duration of JWT signing operations in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+		},
+		[]string{"alg"},
+	)
+	tokenRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "konnect",
+			Subsystem: metricsSubsystem,
+			Name:      "token_request_duration_seconds",
+			Help:      "Duration of token endpoint requests in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"alg"},
+	)
+)
+
+// registerMetrics registers the provider metrics with the provided prometheus
+// registerer. It is safe to call multiple times with the same registerer.
+func registerMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		tokenSigningDuration,
+		tokenRequestDuration,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// signedString signs the provided token with the provided key while recording
+// the duration of the signing operation and tracing it.
+func signedString(ctx context.Context, sk *SigningKey, typ string, claims jwt.Claims) (string, error) {
+	_, span := tracing.Start(ctx, "jwt.sign", tracing.String("alg", sk.SigningMethod.Alg()), tracing.String("kid", sk.ID))
+	start := time.Now()
+	defer func() {
+		tokenSigningDuration.WithLabelValues(sk.SigningMethod.Alg()).Observe(time.Since(start).Seconds())
+		span.End()
+	}()
+
+	signed, err := sk.sign(typ, claims)
+	span.SetError(err)
+
+	return signed, err
+}
+
+// observeTokenRequest records the duration of a token endpoint request which
+// started at the provided time and issued tokens with the provided signing
+// method.
+func (p *Provider) observeTokenRequest(start time.Time, signingMethod jwt.SigningMethod) {
+	if signingMethod == nil {
+		signingMethod = p.signingMethodDefault
+	}
+	alg := ""
+	if signingMethod != nil {
+		alg = signingMethod.Alg()
+	}
+
+	tokenRequestDuration.WithLabelValues(alg).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/konnect/identity"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Claims preview errors.
+var (
+	ErrPreviewUnknownClient = errors.New("unknown client")
+	ErrPreviewUnknownUser   = errors.New("user not found")
+)
+
+// ClaimsPreview holds the claims which the accociated Provider would place
+// into tokens and userinfo responses.
+type ClaimsPreview struct {
+	AuthorizedScopes []string               `json:"authorized_scopes"`
+	IDToken          jwt.Claims             `json:"id_token"`
+	AccessToken      jwt.Claims             `json:"access_token,omitempty"`
+	UserInfo         map[string]interface{} `json:"userinfo"`
+}
+
+// PreviewClaims returns the claims the accociated Provider would issue to the
+// client with the provided client ID for the user with the provided user ID of
+// the provider's identity manager, if that user approved all of the provided
+// scopes. If withAccessToken is false, the claims of an ID token which is
+// issued without access token are returned. No tokens are created, the claims
+// are assembled with the same code as for the real tokens.
+func (p *Provider) PreviewClaims(ctx context.Context, clientID string, userID string, scopes map[string]bool, withAccessToken bool) (*ClaimsPreview, error) {
+	if _, ok := p.clients.Get(ctx, clientID); !ok {
+		return nil, ErrPreviewUnknownClient
+	}
+
+	auth, found, err := p.identityManager.Fetch(identity.NewClientIDContext(ctx, clientID), userID, nil, scopes, nil)
+	if err != nil {
+		p.logger.WithFields(utils.ErrorAsFields(err)).Debugln("claims preview identity manager fetch failed")
+		found = false
+	}
+	if !found {
+		return nil, ErrPreviewUnknownUser
+	}
+
+	preview := &ClaimsPreview{
+		AuthorizedScopes: makeArrayFromBoolMap(auth.AuthorizedScopes()),
+	}
+	sort.Strings(preview.AuthorizedScopes)
+
+	ar := &payload.AuthenticationRequest{
+		ClientID: clientID,
+		Scopes:   scopes,
+	}
+	idTokenClaims, idTokenAuth, err := p.makeIDTokenClaims(ctx, ar, auth, nil, withAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	preview.IDToken, err = finalizeIDTokenClaims(idTokenClaims, idTokenAuth, p.scopeClaimsInIDToken("", withAccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if withAccessToken {
+		preview.AccessToken = p.makeAccessTokenClaims(ctx, clientID, auth, nil)
+	}
+
+	preview.UserInfo, err = p.makeUserInfoClaims(ctx, auth, clientID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return preview, nil
+}
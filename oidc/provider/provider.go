@@ -23,16 +23,21 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/go-querystring/query"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 	"stash.kopano.io/kgol/oidc-go"
+	"stash.kopano.io/kgol/rndm"
 
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identity"
@@ -41,6 +46,9 @@ import (
 	"stash.kopano.io/kc/konnect/managers"
 	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/code"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+	"stash.kopano.io/kc/konnect/oidc/revocation"
 	"stash.kopano.io/kc/konnect/signing"
 	"stash.kopano.io/kc/konnect/utils"
 )
@@ -50,7 +58,11 @@ type Provider struct {
 	Config *Config
 
 	issuerIdentifier string
+	issuerPath       string
 	metadata         *oidc.WellKnown
+	metadataMutex    sync.RWMutex
+
+	additionalIssuerIdentifiers []string
 
 	wellKnownPath          string
 	jwksPath               string
@@ -60,10 +72,15 @@ type Provider struct {
 	endSessionPath         string
 	checkSessionIframePath string
 	registrationPath       string
+	revocationPath         string
+
+	additionalWellKnownPaths map[string]bool
 
 	identityManager   identity.Manager
 	guestManager      identity.Manager
 	codeManager       code.Manager
+	refreshManager    refresh.Manager
+	revocationManager revocation.Manager
 	encryptionManager *identityManagers.EncryptionManager
 	clients           *clients.Registry
 
@@ -71,6 +88,15 @@ type Provider struct {
 	signingMethodDefault jwt.SigningMethod
 	validationKeys       map[string]crypto.PublicKey
 
+	keysMutex      sync.RWMutex
+	pendingSigners map[string]crypto.Signer
+	retiredKeys    map[string]bool
+
+	clientAssertionSigningAlgs []string
+
+	registrationInitialAccessToken     string
+	registrationInitialAccessTokenKeys map[string]crypto.PublicKey
+
 	browserStateCookiePath string
 	browserStateCookieName string
 
@@ -81,6 +107,26 @@ type Provider struct {
 	idTokenDuration      time.Duration
 	refreshTokenDuration time.Duration
 
+	accessTokenType string
+
+	refreshTokenRotation string
+
+	tokenBinding *clients.TokenBinding
+
+	errorURIBase string
+
+	clientErrorLogSampler *clientErrorLogSampler
+
+	requestLimits *payload.RequestLimits
+
+	unknownScopeBehavior string
+
+	claimsInIDToken   string
+	claimsPlacement   map[string]string
+	accessTokenClaims map[string][]string
+
+	templates map[string]*template.Template
+
 	logger logrus.FieldLogger
 }
 
@@ -98,10 +144,19 @@ func NewProvider(c *Config) (*Provider, error) {
 		endSessionPath:         c.EndSessionPath,
 		checkSessionIframePath: c.CheckSessionIframePath,
 		registrationPath:       c.RegistrationPath,
+		revocationPath:         c.RevocationPath,
+
+		additionalIssuerIdentifiers: c.AdditionalIssuerIdentifiers,
+
+		registrationInitialAccessToken:     c.RegistrationInitialAccessToken,
+		registrationInitialAccessTokenKeys: c.RegistrationInitialAccessTokenKeys,
 
 		signingKeys:    make(map[jwt.SigningMethod]*SigningKey),
 		validationKeys: make(map[string]crypto.PublicKey),
 
+		pendingSigners: make(map[string]crypto.Signer),
+		retiredKeys:    make(map[string]bool),
+
 		browserStateCookiePath: c.BrowserStateCookiePath,
 		browserStateCookieName: c.BrowserStateCookieName,
 
@@ -112,9 +167,114 @@ func NewProvider(c *Config) (*Provider, error) {
 		idTokenDuration:      c.IDTokenDuration,
 		refreshTokenDuration: c.RefreshTokenDuration,
 
+		accessTokenType: c.AccessTokenType,
+
+		refreshTokenRotation: c.RefreshTokenRotation,
+
+		tokenBinding: c.TokenBinding,
+
+		errorURIBase: c.ErrorURIBase,
+
+		clientErrorLogSampler: newClientErrorLogSampler(c.ClientErrorLogLimit, clientErrorLogInterval),
+
+		requestLimits: c.RequestLimits,
+
+		unknownScopeBehavior: c.UnknownScopeBehavior,
+
+		claimsInIDToken:   c.ClaimsInIDToken,
+		claimsPlacement:   c.ClaimsPlacement,
+		accessTokenClaims: c.AccessTokenClaims,
+
 		logger: c.Config.Logger,
 	}
 
+	if c.Config.WithMetrics {
+		if err := registerMetrics(c.Config.Registerer()); err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %v", err)
+		}
+	}
+
+	switch p.accessTokenType {
+	case "":
+		p.accessTokenType = AccessTokenTypeATJWT
+	case AccessTokenTypeJWT, AccessTokenTypeATJWT:
+	default:
+		return nil, fmt.Errorf("unknown access token type: %v", p.accessTokenType)
+	}
+
+	switch p.refreshTokenRotation {
+	case "":
+		p.refreshTokenRotation = RefreshTokenRotationNone
+	case RefreshTokenRotationNone, RefreshTokenRotationPublic, RefreshTokenRotationAll:
+	default:
+		return nil, fmt.Errorf("unknown refresh token rotation mode: %v", p.refreshTokenRotation)
+	}
+
+	if p.tokenBinding != nil {
+		if err := p.tokenBinding.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.requestLimits == nil {
+		p.requestLimits = payload.NewDefaultRequestLimits()
+	}
+
+	if issURI, err := url.Parse(p.issuerIdentifier); err == nil {
+		p.issuerPath = strings.TrimSuffix(issURI.EscapedPath(), "/")
+	}
+
+	if len(c.AdditionalWellKnownPaths) > 0 {
+		p.additionalWellKnownPaths = make(map[string]bool)
+		for _, path := range c.AdditionalWellKnownPaths {
+			if path != p.wellKnownPath {
+				p.additionalWellKnownPaths[path] = true
+			}
+		}
+	}
+
+	switch p.unknownScopeBehavior {
+	case "":
+		p.unknownScopeBehavior = UnknownScopeBehaviorPassthrough
+	case UnknownScopeBehaviorPassthrough, UnknownScopeBehaviorIgnore, UnknownScopeBehaviorError:
+	default:
+		return nil, fmt.Errorf("invalid unknown scope behavior: %v", p.unknownScopeBehavior)
+	}
+
+	switch p.claimsInIDToken {
+	case "":
+		p.claimsInIDToken = ClaimsInIDTokenMinimal
+	case ClaimsInIDTokenMinimal, ClaimsInIDTokenFull:
+	default:
+		return nil, fmt.Errorf("invalid claims in id token policy: %v", p.claimsInIDToken)
+	}
+	if err := ValidateClaimsPlacement(p.claimsPlacement); err != nil {
+		return nil, err
+	}
+	if err := ValidateAccessTokenClaims(p.accessTokenClaims); err != nil {
+		return nil, err
+	}
+
+	if p.errorURIBase != "" {
+		if u, err := url.Parse(p.errorURIBase); err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("invalid error uri base: %v", p.errorURIBase)
+		}
+	}
+	if c.ClientErrorLogLimit < 0 {
+		return nil, fmt.Errorf("invalid client error log limit: %d", c.ClientErrorLogLimit)
+	}
+
+	var err error
+	p.clientAssertionSigningAlgs, err = makeClientAssertionSigningAlgs(c.ClientAssertionSigningAlgs)
+	if err != nil {
+		return nil, err
+	}
+
+	p.templates, err = loadTemplates(c.TemplatesPath)
+	if err != nil {
+		return nil, err
+	}
+
 	return p, nil
 }
 
@@ -124,6 +284,12 @@ func (p *Provider) RegisterManagers(mgrs *managers.Managers) error {
 	p.codeManager = mgrs.Must("code").(code.Manager)
 	p.encryptionManager = mgrs.Must("encryption").(*identityManagers.EncryptionManager)
 	p.clients = mgrs.Must("clients").(*clients.Registry)
+	if p.refreshTokenRotation != RefreshTokenRotationNone {
+		p.refreshManager = mgrs.Must("refresh").(refresh.Manager)
+	}
+	if revocationManager, _ := mgrs.Get("revocation"); revocationManager != nil {
+		p.revocationManager = revocationManager.(revocation.Manager)
+	}
 
 	// Register callback to cleanup our cookie whenever the identity is unset or
 	// set.
@@ -163,7 +329,7 @@ func (p *Provider) RegisterManagers(mgrs *managers.Managers) error {
 		// NOTE(longsleep): This is hackish. Find a better way to propagate our
 		// provides JWT stuff to the client registry.
 		p.clients.StatelessCreator = p.makeJWT
-		p.clients.StatelessValidator = p.validateJWT
+		p.clients.StatelessValidator = p.strictKeyfunc(nil, "dynamic_client_id", p.validateJWT)
 	}
 
 	return nil
@@ -173,6 +339,11 @@ func (p *Provider) makeIssURL(path string) string {
 	if path == "" {
 		return ""
 	}
+	if p.issuerPath != "" && strings.HasPrefix(path, p.issuerPath+"/") {
+		// NOTE: Paths which already start with the path of the issuer (when the
+		// base path matches it) are joined with its origin to not duplicate it.
+		return fmt.Sprintf("%s%s", strings.TrimSuffix(strings.TrimSuffix(p.issuerIdentifier, "/"), p.issuerPath), path)
+	}
 	return fmt.Sprintf("%s%s", p.issuerIdentifier, path)
 }
 
@@ -189,18 +360,26 @@ func (p *Provider) SetSigningMethod(signingMethod jwt.SigningMethod) error {
 // provided id as key id. The public key of the provided signer is also added
 // as validation key with the same key id.
 func (p *Provider) SetSigningKey(id string, key crypto.Signer) error {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	return p.setSigningKey(id, key)
+}
+
+func (p *Provider) setSigningKey(id string, key crypto.Signer) error {
 	var signingMethod jwt.SigningMethod
 
-	// Auto select signingMethod based on the signer.
-	switch s := key.(type) {
-	case *rsa.PrivateKey:
+	// Auto select signingMethod based on the signer's public key, so any
+	// signer implementation can be used.
+	switch s := key.Public().(type) {
+	case *rsa.PublicKey:
 		signingMethod = jwt.SigningMethodPS256
-	case *ecdsa.PrivateKey:
+	case *ecdsa.PublicKey:
 		signingMethod = jwt.SigningMethodES256
-	case ed25519.PrivateKey:
+	case ed25519.PublicKey:
 		signingMethod = signing.SigningMethodEdDSA
 	default:
-		return fmt.Errorf("unsupported signer type: %v", s)
+		return fmt.Errorf("unsupported signer public key type: %T", s)
 	}
 
 	if p.signingMethodDefault == nil {
@@ -215,94 +394,32 @@ func (p *Provider) SetSigningKey(id string, key crypto.Signer) error {
 		"method": fmt.Sprintf("%T", signingMethod),
 	}).Infoln("set provider signing key")
 
+	prepareSigner(key)
+
 	switch signingMethod.(type) {
 	case *jwt.SigningMethodECDSA:
 		// Add all other supported ECDSA signing methods as well.
-		p.signingKeys[jwt.SigningMethodES256] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodES256,
-		}
-		p.signingKeys[jwt.SigningMethodES384] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodES384,
-		}
-		p.signingKeys[jwt.SigningMethodES512] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodES512,
-		}
+		p.signingKeys[jwt.SigningMethodES256] = newSigningKey(id, key, jwt.SigningMethodES256)
+		p.signingKeys[jwt.SigningMethodES384] = newSigningKey(id, key, jwt.SigningMethodES384)
+		p.signingKeys[jwt.SigningMethodES512] = newSigningKey(id, key, jwt.SigningMethodES512)
 	case *jwt.SigningMethodRSA:
 		// Add all supported RSA and RSAPSS signing methods as well.
-		p.signingKeys[jwt.SigningMethodRS256] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS256,
-		}
-		p.signingKeys[jwt.SigningMethodRS384] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS384,
-		}
-		p.signingKeys[jwt.SigningMethodRS512] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS512,
-		}
-		p.signingKeys[jwt.SigningMethodPS256] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS256,
-		}
-		p.signingKeys[jwt.SigningMethodPS384] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS384,
-		}
-		p.signingKeys[jwt.SigningMethodPS512] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS512,
-		}
+		p.signingKeys[jwt.SigningMethodRS256] = newSigningKey(id, key, jwt.SigningMethodRS256)
+		p.signingKeys[jwt.SigningMethodRS384] = newSigningKey(id, key, jwt.SigningMethodRS384)
+		p.signingKeys[jwt.SigningMethodRS512] = newSigningKey(id, key, jwt.SigningMethodRS512)
+		p.signingKeys[jwt.SigningMethodPS256] = newSigningKey(id, key, jwt.SigningMethodPS256)
+		p.signingKeys[jwt.SigningMethodPS384] = newSigningKey(id, key, jwt.SigningMethodPS384)
+		p.signingKeys[jwt.SigningMethodPS512] = newSigningKey(id, key, jwt.SigningMethodPS512)
 	case *jwt.SigningMethodRSAPSS:
 		// Add all supported RSA and RSAPSS signing methods as well.
-		p.signingKeys[jwt.SigningMethodRS256] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS256,
-		}
-		p.signingKeys[jwt.SigningMethodRS384] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS384,
-		}
-		p.signingKeys[jwt.SigningMethodRS512] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodRS512,
-		}
-		p.signingKeys[jwt.SigningMethodPS256] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS256,
-		}
-		p.signingKeys[jwt.SigningMethodPS384] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS384,
-		}
-		p.signingKeys[jwt.SigningMethodPS512] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: jwt.SigningMethodPS512,
-		}
+		p.signingKeys[jwt.SigningMethodRS256] = newSigningKey(id, key, jwt.SigningMethodRS256)
+		p.signingKeys[jwt.SigningMethodRS384] = newSigningKey(id, key, jwt.SigningMethodRS384)
+		p.signingKeys[jwt.SigningMethodRS512] = newSigningKey(id, key, jwt.SigningMethodRS512)
+		p.signingKeys[jwt.SigningMethodPS256] = newSigningKey(id, key, jwt.SigningMethodPS256)
+		p.signingKeys[jwt.SigningMethodPS384] = newSigningKey(id, key, jwt.SigningMethodPS384)
+		p.signingKeys[jwt.SigningMethodPS512] = newSigningKey(id, key, jwt.SigningMethodPS512)
 	case *signing.SigningMethodEdwardsCurve:
-		p.signingKeys[signingMethod] = &SigningKey{
-			ID:            id,
-			PrivateKey:    key,
-			SigningMethod: signingMethod,
-		}
+		p.signingKeys[signingMethod] = newSigningKey(id, key, signingMethod)
 	default:
 		return fmt.Errorf("unsupported signing method type")
 	}
@@ -311,7 +428,7 @@ func (p *Provider) SetSigningKey(id string, key crypto.Signer) error {
 		return fmt.Errorf("unsupported signing method")
 	}
 
-	p.SetValidationKey(id, key.Public())
+	p.setValidationKey(id, key.Public())
 
 	return nil
 }
@@ -327,13 +444,23 @@ func (p *Provider) getSigningKey(signingMethod jwt.SigningMethod) (*SigningKey,
 		signingMethod = p.signingMethodDefault
 	}
 
+	p.keysMutex.RLock()
 	sk, ok := p.signingKeys[signingMethod]
+	p.keysMutex.RUnlock()
+
 	return sk, ok
 }
 
 // SetValidationKey sets the provider public key as validation key for token
 // validation for tokens with the provided key.
 func (p *Provider) SetValidationKey(id string, key crypto.PublicKey) error {
+	p.keysMutex.Lock()
+	defer p.keysMutex.Unlock()
+
+	return p.setValidationKey(id, key)
+}
+
+func (p *Provider) setValidationKey(id string, key crypto.PublicKey) error {
 	p.logger.WithFields(logrus.Fields{
 		"type": fmt.Sprintf("%T", key),
 		"id":   id,
@@ -350,7 +477,10 @@ func (p *Provider) GetValidationKey(id string) (crypto.PublicKey, bool) {
 }
 
 func (p *Provider) getValidationKey(id string) (crypto.PublicKey, bool) {
+	p.keysMutex.RLock()
 	vk, ok := p.validationKeys[id]
+	p.keysMutex.RUnlock()
+
 	return vk, ok
 }
 
@@ -376,9 +506,16 @@ func (p *Provider) InitializeMetadata() error {
 			oidc.ResponseTypeCodeIDToken,
 			oidc.ResponseTypeCodeIDTokenToken,
 		},
+		ResponseModesSupported: []string{
+			oidc.ResponseModeQuery,
+			oidc.ResponseModeFragment,
+			konnectoidc.ResponseModeFormPost,
+		},
 		SubjectTypesSupported: []string{
 			oidc.SubjectIDPublic,
+			konnectoidc.SubjectIDPairwise,
 		},
+		GrantTypesSupported:      append([]string{}, implementedGrantTypes...),
 		ClaimsParameterSupported: true,
 		ClaimsSupported: uniqueStrings(append([]string{
 			oidc.IssuerIdentifierClaim,
@@ -388,40 +525,81 @@ func (p *Provider) InitializeMetadata() error {
 			oidc.IssuedAtClaim,
 		}, p.identityManager.ClaimsSupported(nil)...)),
 		RequestParameterSupported:    true,
-		RequestURIParameterSupported: false,
+		RequestURIParameterSupported: p.Config.AllowRequestURI,
+	}
+	if p.metadata.RequestURIParameterSupported {
+		// NOTE: request_uri values are never fetched unless registered.
+		p.metadata.RequireRequestURIRegistration = true
 	}
 
 	p.metadata.IDTokenSigningAlgValuesSupported = make([]string, 0)
+	p.keysMutex.RLock()
 	for alg := range p.signingKeys {
 		p.metadata.IDTokenSigningAlgValuesSupported = append(p.metadata.IDTokenSigningAlgValuesSupported, alg.Alg())
 	}
+	p.keysMutex.RUnlock()
+	sort.Strings(p.metadata.IDTokenSigningAlgValuesSupported)
 	p.metadata.UserInfoSigningAlgValuesSupported = p.metadata.IDTokenSigningAlgValuesSupported
-	p.metadata.RequestObjectSigningAlgValuesSupported = []string{
-		jwt.SigningMethodES256.Alg(),
-		jwt.SigningMethodES384.Alg(),
-		jwt.SigningMethodES512.Alg(),
-		jwt.SigningMethodRS256.Alg(),
-		jwt.SigningMethodRS384.Alg(),
-		jwt.SigningMethodRS512.Alg(),
-		jwt.SigningMethodPS256.Alg(),
-		jwt.SigningMethodPS384.Alg(),
-		jwt.SigningMethodPS512.Alg(),
-		jwt.SigningMethodNone.Alg(),
-		signing.SigningMethodEdDSA.Alg(),
-	}
+	p.metadata.IDTokenEncryptionAlgValuesSupported = clients.IDTokenEncryptionAlgs
+	p.metadata.IDTokenEncryptionEncValuesSupported = clients.IDTokenEncryptionEncs
+	// NOTE: Unsigned request objects are allowed, thus none is always
+	// supported for request objects.
+	p.metadata.RequestObjectSigningAlgValuesSupported = append(append([]string{}, p.clientAssertionSigningAlgs...), jwt.SigningMethodNone.Alg())
 	p.metadata.TokenEndpointAuthMethodsSupported = []string{
 		oidc.AuthMethodClientSecretBasic,
+		konnectoidc.AuthMethodClientSecretPost,
 		oidc.AuthMethodNone,
+		konnectoidc.AuthMethodTLSClientAuth,
+		konnectoidc.AuthMethodSelfSignedTLSClientAuth,
+		konnectoidc.AuthMethodPrivateKeyJWT,
+	}
+	p.metadata.TokenEndpointAuthSigningAlgValuesSupported = p.clientAssertionSigningAlgs
+	if acrValuesManager, ok := p.identityManager.(identity.ManagerWithACRValues); ok {
+		if acrValues := acrValuesManager.ACRValuesSupported(); len(acrValues) > 0 {
+			p.metadata.ACRValuesSupported = acrValues
+		}
+	}
+	if displayValuesManager, ok := p.identityManager.(identity.ManagerWithDisplayValues); ok {
+		p.metadata.DisplayValuesSupported = displayValuesManager.DisplayValuesSupported()
+	}
+
+	err := p.initializeMetadataOverrides()
+	if err != nil {
+		return fmt.Errorf("invalid metadata override: %v", err)
 	}
-	p.metadata.TokenEndpointAuthSigningAlgValuesSupported = p.metadata.IDTokenSigningAlgValuesSupported
 
 	return nil
 }
 
+// RefreshScopesSupported updates the scopes supported in the accociated
+// providers meta data document from its identity manager. Call this whenever
+// the scopes of the identity manager changed.
+func (p *Provider) RefreshScopesSupported() {
+	p.metadataMutex.Lock()
+	defer p.metadataMutex.Unlock()
+
+	// NOTE: The document is replaced, since requests might still use the
+	// current document.
+	metadata := *p.metadata
+	metadata.ScopesSupported = uniqueStrings(append([]string{
+		oidc.ScopeOpenID,
+	}, p.identityManager.ScopesSupported(nil)...))
+	p.metadata = &metadata
+}
+
+// getMetadata returns the current meta data document of the accociated
+// provider.
+func (p *Provider) getMetadata() *oidc.WellKnown {
+	p.metadataMutex.RLock()
+	defer p.metadataMutex.RUnlock()
+
+	return p.metadata
+}
+
 // ServerHTTP implements the http.HandlerFunc interface.
 func (p *Provider) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	switch path := req.URL.Path; {
-	case path == p.wellKnownPath:
+	case path == p.wellKnownPath, p.additionalWellKnownPaths[path]:
 		cors.Default().ServeHTTP(rw, req, p.WellKnownHandler)
 	case path == p.jwksPath:
 		cors.Default().ServeHTTP(rw, req, p.JwksHandler)
@@ -438,6 +616,8 @@ func (p *Provider) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.CheckSessionIframeHandler(rw, req)
 	case path == p.registrationPath:
 		p.RegistrationHandler(rw, req)
+	case path == p.revocationPath:
+		cors.Default().ServeHTTP(rw, req, p.RevocationHandler)
 	default:
 		http.NotFound(rw, req)
 	}
@@ -445,7 +625,45 @@ func (p *Provider) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 // ErrorPage writes a HTML error page to the provided ResponseWriter.
 func (p *Provider) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
-	utils.WriteErrorPage(rw, code, title, message)
+	p.writeErrorPage(rw, code, title, message, "")
+}
+
+// ClientErrorPage writes a HTML error page to the provided ResponseWriter for
+// an error of a request of the client with the provided id.
+func (p *Provider) ClientErrorPage(rw http.ResponseWriter, req *http.Request, clientID string, code int, title string, message string) {
+	p.writeErrorPage(rw, code, title, message, p.getClientName(req, clientID))
+}
+
+func (p *Provider) writeErrorPage(rw http.ResponseWriter, code int, title string, message string, clientName string) {
+	t, ok := p.getTemplate(TemplateNameError, nil)
+	if !ok {
+		utils.WriteErrorPage(rw, code, title, message)
+		return
+	}
+
+	nonce := rndm.GenerateRandomString(32)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("Content-Security-Policy", getTemplateContentSecurityPolicy(nonce, true, ""))
+	rw.WriteHeader(code)
+
+	data := &errorPageData{
+		StatusCode:       code,
+		Status:           http.StatusText(code),
+		Error:            title,
+		ErrorDescription: message,
+		ClientName:       clientName,
+		Nonce:            nonce,
+	}
+	if data.Error == "" {
+		data.Error = data.Status
+	}
+	err := t.Execute(rw, data)
+	if err != nil {
+		p.logger.WithError(err).Debugln("failed to write to response")
+	}
 }
 
 // Found writes a HTTP 302 to the provided ResponseWriter with the appropriate
@@ -459,11 +677,116 @@ func (p *Provider) Found(rw http.ResponseWriter, uri *url.URL, params interface{
 	}
 }
 
+// WriteAuthorizationResponse writes the provided authorization response parameters to
+// the provided ResponseWriter using the response mode of the provided
+// authentication request.
+func (p *Provider) WriteAuthorizationResponse(rw http.ResponseWriter, req *http.Request, ar *payload.AuthenticationRequest, params interface{}) {
+	if ar.UseFormPost {
+		p.FormPostResponsePage(rw, req, ar.ClientID, ar.RedirectURI, params)
+		return
+	}
+
+	p.Found(rw, ar.RedirectURI, params, ar.UseFragment)
+}
+
+// FormPostResponsePage writes a HTML page to the provided ResponseWriter which
+// auto-submits the provided parameters with POST to the provided uri as
+// specified at https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+// for the client with the provided id.
+func (p *Provider) FormPostResponsePage(rw http.ResponseWriter, req *http.Request, clientID string, uri *url.URL, params interface{}) {
+	values, err := query.Values(params)
+	if err != nil {
+		p.logger.WithError(err).Debugln("failed to encode form post response")
+		p.ErrorPage(rw, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	t, loaded := p.getTemplate(TemplateNameFormPostResponse, formPostResponseTemplate)
+	nonce := rndm.GenerateRandomString(32)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("Pragma", "no-cache")
+	rw.Header().Set("X-XSS-Protection", "1; mode=block")
+	rw.Header().Set("Content-Security-Policy", getTemplateContentSecurityPolicy(nonce, loaded, ""))
+
+	data := struct {
+		RedirectURI string
+		Values      url.Values
+		ClientName  string
+		Nonce       string
+	}{
+		RedirectURI: uri.String(),
+		Values:      values,
+		ClientName:  p.getClientName(req, clientID),
+		Nonce:       nonce,
+	}
+	err = t.Execute(rw, data)
+	if err != nil {
+		p.logger.WithError(err).Debugln("failed to write to response")
+	}
+}
+
+// FrontchannelLogoutPage writes a HTML page to the provided ResponseWriter
+// which loads the provided front-channel logout URIs in iframes and then
+// redirects to the URL created from the other parameters. Without URL, the
+// page stays after the iframes have been loaded. The front-channel
+// clients are removed from the provided session. The client with the provided
+// id is the client which requested the logout, if any.
+func (p *Provider) FrontchannelLogoutPage(rw http.ResponseWriter, req *http.Request, clientID string, session *payload.Session, uris []string, uri *url.URL, params interface{}) {
+	var redirectURI string
+	var err error
+	if uri != nil && uri.String() != "" {
+		redirectURI, err = utils.MakeRedirectURL(uri, params, false)
+		if err != nil {
+			p.logger.WithError(err).Debugln("failed to create frontchannel logout redirect URL")
+			p.ErrorPage(rw, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+	}
+
+	if session != nil {
+		session.Clients = nil
+		serialized, serializeErr := p.serializeSession(session)
+		if serializeErr == nil {
+			serializeErr = p.setSessionCookie(rw, serialized)
+		}
+		if serializeErr != nil {
+			p.logger.WithError(serializeErr).Warnln("failed to update session after frontchannel logout")
+		}
+	}
+
+	t, loaded := p.getTemplate(TemplateNameFrontchannelLogout, frontchannelLogoutTemplate)
+	nonce := rndm.GenerateRandomString(32)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("X-XSS-Protection", "1; mode=block")
+	rw.Header().Set("Content-Security-Policy", getTemplateContentSecurityPolicy(nonce, loaded, "frame-src *"))
+
+	data := struct {
+		URIs        []string
+		RedirectURI string
+		Timeout     int
+		ClientName  string
+		Nonce       string
+	}{
+		URIs:        uris,
+		RedirectURI: redirectURI,
+		Timeout:     frontchannelLogoutTimeoutSeconds,
+		ClientName:  p.getClientName(req, clientID),
+		Nonce:       nonce,
+	}
+	err = t.Execute(rw, data)
+	if err != nil {
+		p.logger.WithError(err).Debugln("failed to write to response")
+	}
+}
+
 // LoginRequiredPage writes a HTTP 30 to the provided ResponseWrite with the
 // URL of the provided request (set to the scheme and host of issuer) as
 // continue parameter.
 func (p *Provider) LoginRequiredPage(rw http.ResponseWriter, req *http.Request, uri *url.URL) {
-	issURI, _ := url.Parse(p.issuerIdentifier)
+	issURI := p.getIssuerURLForRequest(req)
 
 	trusted, _ := utils.IsRequestFromTrustedSource(req, p.Config.Config.TrustedProxyIPs, p.Config.Config.TrustedProxyNets)
 
@@ -481,27 +804,70 @@ func (p *Provider) LoginRequiredPage(rw http.ResponseWriter, req *http.Request,
 	p.Found(rw, uri, nil, false)
 }
 
+// getIssuerURLForRequest returns the URL of the accepted issuer identifier
+// which matches the scheme and host of the provided request. The scheme of
+// requests from trusted proxies is read from the configured header. If no
+// additional issuer identifier matches, the issuer identifier is returned.
+func (p *Provider) getIssuerURLForRequest(req *http.Request) *url.URL {
+	issURI, _ := url.Parse(p.issuerIdentifier)
+	if len(p.additionalIssuerIdentifiers) == 0 {
+		return issURI
+	}
+
+	scheme := utils.SchemeFromRequest(req, p.Config.Config.TrustedProxyProtoHeader, p.Config.Config.TrustedProxyIPs, p.Config.Config.TrustedProxyNets)
+	for _, additional := range p.additionalIssuerIdentifiers {
+		if additionalURI, err := url.Parse(additional); err == nil && additionalURI.Scheme == scheme && additionalURI.Host == req.Host {
+			return additionalURI
+		}
+	}
+
+	return issURI
+}
+
 // GetAccessTokenClaimsFromRequest reads incoming request, validates the
 // access token and returns the validated claims.
 func (p *Provider) GetAccessTokenClaimsFromRequest(req *http.Request) (*konnect.AccessTokenClaims, error) {
 	var err error
 	var claims *konnect.AccessTokenClaims
 
-	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
-	switch auth[0] {
-	case oidc.TokenTypeBearer:
-		if len(auth) != 2 {
+	token, ok := utils.BearerTokenFromRequest(req)
+	switch {
+	case ok:
+		if token == "" {
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "Invalid Bearer authorization header format")
 			break
 		}
 		claims = &konnect.AccessTokenClaims{}
-		_, err = jwt.ParseWithClaims(auth[1], claims, func(token *jwt.Token) (interface{}, error) {
+		// NOTE: Only tokens of the configured access token type are accepted,
+		// so that ID tokens cannot be used as access tokens.
+		_, err = jwt.ParseWithClaims(token, claims, p.strictKeyfunc(req, "access_token", signing.TypedKeyfunc(func(token *jwt.Token) (interface{}, error) {
 			// Validator for incoming access tokens, looks up key.
 			return p.validateJWT(token)
-		})
+		}, p.accessTokenType)))
 		if err != nil {
 			// Wrap as OAuth2 error.
 			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, err.Error())
+			break
+		}
+		if claims.Confirmation != nil && claims.Confirmation.X5tS256 != "" {
+			// Certificate bound access token, ensure that the request was made
+			// with the same certificate as specified at https://tools.ietf.org/html/rfc8705#section-3.
+			cert, _ := p.getClientCertificate(req)
+			if cert == nil || utils.CertificateThumbprintS256(cert) != claims.Confirmation.X5tS256 {
+				err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "certificate mismatch")
+				break
+			}
+		}
+		// Ensure that bound access tokens are used in the same context.
+		err = p.validateTokenBinding(req, "access_token", claims.Binding)
+		if err != nil {
+			break
+		}
+		// Ensure that the access token was not revoked.
+		if revoked, revokedErr := p.isTokenRevoked(claims.Id); revokedErr != nil {
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "failed to check token revocation")
+		} else if revoked {
+			err = konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "access token revoked")
 		}
 
 	default:
@@ -510,3 +876,20 @@ func (p *Provider) GetAccessTokenClaimsFromRequest(req *http.Request) (*konnect.
 
 	return claims, err
 }
+
+// validateAccessTokenAudience checks the aud claim of the provided access
+// token claims if the accociated provider is configured to require its issuer
+// identifier as audience for access tokens.
+func (p *Provider) validateAccessTokenAudience(claims *konnect.AccessTokenClaims) error {
+	if !p.Config.UserInfoRequireAudience {
+		return nil
+	}
+
+	for _, audience := range claims.AudienceList {
+		if p.isAcceptedIssuer(audience) {
+			return nil
+		}
+	}
+
+	return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidToken, "access token audience mismatch")
+}
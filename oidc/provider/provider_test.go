@@ -20,22 +20,50 @@ package provider
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/mendsley/gojwk"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/square/go-jose.v2"
+	"stash.kopano.io/kgol/oidc-go"
 
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/audit"
 	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/encryption"
 	"stash.kopano.io/kc/konnect/managers"
 
 	"stash.kopano.io/kc/konnect/identity"
 	"stash.kopano.io/kc/konnect/identity/clients"
 	identityManagers "stash.kopano.io/kc/konnect/identity/managers"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	codeManagers "stash.kopano.io/kc/konnect/oidc/code/managers"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+	refreshManagers "stash.kopano.io/kc/konnect/oidc/refresh/managers"
+	"stash.kopano.io/kc/konnect/signing"
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 var logger = &logrus.Logger{
@@ -61,16 +89,31 @@ func init() {
 	rsaPrivateKey, _ = x509.ParsePKCS1PrivateKey(block.Bytes)
 }
 
-func NewTestProvider(ctx context.Context, t *testing.T) (*httptest.Server, *Provider, http.Handler, *Config) {
-	mgrs := managers.New()
-	mgrs.Set("identity", identityManagers.NewDummyIdentityManager(
+func NewTestProvider(ctx context.Context, t testing.TB) (*httptest.Server, *Provider, http.Handler, *Config) {
+	return NewTestProviderWithIdentityManager(ctx, t, identityManagers.NewDummyIdentityManager(
 		&identity.Config{},
 		"unittestuser",
 	))
-	mgrs.Set("code", codeManagers.NewMemoryMapManager(ctx))
-	encryptionManager, _ := identityManagers.NewEncryptionManager(nil)
+}
+
+func NewTestProviderWithIdentityManager(ctx context.Context, t testing.TB, identityManager identity.Manager) (*httptest.Server, *Provider, http.Handler, *Config) {
+	mgrs := managers.New()
+	mgrs.Set("identity", identityManager)
+	mgrs.Set("code", codeManagers.NewMemoryMapManager(ctx, 0, 0))
+	encryptionManager, _ := identityManagers.NewEncryptionManager(&[encryption.KeySize]byte{})
 	mgrs.Set("encryption", encryptionManager)
-	mgrs.Set("clients", &clients.Registry{})
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:           "unittest-client",
+		RedirectURIs: []string{"https://rp.example.com/cb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgrs.Set("clients", registry)
 
 	cfg := &Config{
 		Config: &config.Config{
@@ -111,3 +154,1826 @@ func TestNewTestProvider(t *testing.T) {
 	defer cancel()
 	NewTestProvider(ctx, t)
 }
+
+func TestApplyMetadataOverrides(t *testing.T) {
+	computed := []string{"a", "b"}
+	implemented := []string{"a", "b", "c"}
+
+	tests := []struct {
+		overrides []string
+		expected  []string
+		err       bool
+	}{
+		{nil, []string{"a", "b"}, false},
+		{[]string{"c"}, []string{"c"}, false},
+		{[]string{"+c"}, []string{"a", "b", "c"}, false},
+		{[]string{"a", "+c"}, []string{"a", "c"}, false},
+		{[]string{"d"}, nil, true},
+		{[]string{"+d"}, nil, true},
+		{[]string{"+"}, nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := applyMetadataOverrides("test", computed, test.overrides, implemented)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for %v, got none", test.overrides)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", test.overrides, err)
+			continue
+		}
+		if strings.Join(result, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("result for %v was incorrect, got %v, want %v", test.overrides, result, test.expected)
+		}
+	}
+}
+
+func TestEncryptIDToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := gojwk.PublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk.Use = "enc"
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*clients.ClientRegistration{
+		{
+			ID:           "encrypted-client",
+			RedirectURIs: []string{"https://client.example.com/cb"},
+			JWKS: &gojwk.Key{
+				Keys: []*gojwk.Key{jwk},
+			},
+			RawIDTokenEncryptedResponseAlg: "RSA-OAEP",
+			RawIDTokenEncryptedResponseEnc: "A256GCM",
+		},
+		{
+			ID:           "plain-client",
+			RedirectURIs: []string{"https://client.example.com/cb"},
+		},
+	} {
+		if err = client.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err = registry.Register(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+
+	signed := "eyJhbGciOiJSUzI1NiJ9.e30.c2lnbmF0dXJl"
+
+	result, err := p.encryptIDToken(ctx, "plain-client", signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != signed {
+		t.Errorf("id token for plain client must not be encrypted")
+	}
+
+	result, err = p.encryptIDToken(ctx, "encrypted-client", signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := jose.ParseEncrypted(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Header.Algorithm != "RSA-OAEP" || encrypted.Header.ExtraHeaders[jose.HeaderContentType] != "JWT" {
+		t.Errorf("unexpected encryption header: %v", encrypted.Header)
+	}
+	decrypted, err := encrypted.Decrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != signed {
+		t.Errorf("decrypted id token mismatch, got %v", string(decrypted))
+	}
+}
+
+func TestAuthorizedParty(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*clients.ClientRegistration{
+		{
+			ID:           "single-client",
+			RedirectURIs: []string{"https://client.example.com/cb"},
+		},
+		{
+			ID:                  "api-client",
+			RedirectURIs:        []string{"https://client.example.com/cb"},
+			AccessTokenAudience: "https://api.example.com",
+		},
+		{
+			ID:                  "multi-client",
+			RedirectURIs:        []string{"https://client.example.com/cb"},
+			AdditionalAudiences: []string{"https://api.example.com", "multi-client"},
+		},
+	} {
+		if err = registry.Register(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(claims interface{}) map[string]interface{} {
+		b, encodeErr := json.Marshal(claims)
+		if encodeErr != nil {
+			t.Fatal(encodeErr)
+		}
+		m := make(map[string]interface{})
+		if encodeErr = json.Unmarshal(b, &m); encodeErr != nil {
+			t.Fatal(encodeErr)
+		}
+		return m
+	}
+
+	for _, test := range []struct {
+		clientID            string
+		accessTokenAudience interface{}
+		accessTokenAZP      interface{}
+		idTokenAudience     interface{}
+		idTokenAZP          interface{}
+	}{
+		{"single-client", "single-client", nil, "single-client", nil},
+		{"api-client", "https://api.example.com", "api-client", "api-client", nil},
+		{"multi-client", []interface{}{"multi-client", "https://api.example.com"}, "multi-client", []interface{}{"multi-client", "https://api.example.com"}, "multi-client"},
+	} {
+		accessToken := encode(p.makeAccessTokenClaims(ctx, test.clientID, auth, nil))
+		if !reflect.DeepEqual(accessToken["aud"], test.accessTokenAudience) {
+			t.Errorf("%s: wrong access token aud: got %v want %v", test.clientID, accessToken["aud"], test.accessTokenAudience)
+		}
+		if accessToken["azp"] != test.accessTokenAZP {
+			t.Errorf("%s: wrong access token azp: got %v want %v", test.clientID, accessToken["azp"], test.accessTokenAZP)
+		}
+
+		idTokenClaims, _, err := p.makeIDTokenClaims(ctx, &payload.AuthenticationRequest{ClientID: test.clientID}, auth, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idToken := encode(idTokenClaims)
+		if !reflect.DeepEqual(idToken["aud"], test.idTokenAudience) {
+			t.Errorf("%s: wrong id token aud: got %v want %v", test.clientID, idToken["aud"], test.idTokenAudience)
+		}
+		if idToken["azp"] != test.idTokenAZP {
+			t.Errorf("%s: wrong id token azp: got %v want %v", test.clientID, idToken["azp"], test.idTokenAZP)
+		}
+
+		var decoded konnectoidc.IDTokenClaims
+		b, _ := json.Marshal(idToken)
+		if err = json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Audience != test.clientID || decoded.AuthorizedParty != idTokenClaims.AuthorizedParty {
+			t.Errorf("%s: decoded id token mismatch: %v", test.clientID, decoded)
+		}
+	}
+}
+
+func TestStaticClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &clients.ClientRegistration{
+		ID:           "static-claims-client",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+		StaticClaims: map[string]interface{}{
+			"tenant_id": "tenant-a",
+			"email":     "static@example.com",
+		},
+	}
+	if err = client.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.Register(client); err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(p.makeAccessTokenClaims(ctx, client.ID, auth, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken := make(map[string]interface{})
+	if err = json.Unmarshal(b, &accessToken); err != nil {
+		t.Fatal(err)
+	}
+	if accessToken["tenant_id"] != "tenant-a" {
+		t.Errorf("access token is missing static claim: %v", accessToken)
+	}
+	if accessToken["sub"] != auth.Subject() {
+		t.Errorf("access token sub was changed: %v", accessToken["sub"])
+	}
+
+	idTokenClaims, _, err := p.makeIDTokenClaims(ctx, &payload.AuthenticationRequest{ClientID: client.ID}, auth, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idTokenClaims.EmailClaims = &konnectoidc.EmailClaims{Email: "user@example.com"}
+	claims, err := p.addStaticClaims(ctx, idTokenClaims, client.ID, auth.Subject())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idToken := claims.(jwt.MapClaims)
+	if idToken["tenant_id"] != "tenant-a" {
+		t.Errorf("id token is missing static claim: %v", idToken)
+	}
+	if idToken["email"] != "user@example.com" {
+		t.Errorf("id token claim was replaced by static claim: %v", idToken["email"])
+	}
+	if idToken["aud"] != client.ID {
+		t.Errorf("id token aud was changed: %v", idToken["aud"])
+	}
+
+	// Clients without static claims are unchanged.
+	claims, err = p.addStaticClaims(ctx, idTokenClaims, "other-client", "other-subject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims != jwt.Claims(idTokenClaims) {
+		t.Errorf("id token claims were changed without static claims")
+	}
+}
+
+func TestValidateJWTIssuer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, cfg := NewTestProvider(ctx, t)
+	p.additionalIssuerIdentifiers = []string{"https://old.example.com"}
+
+	for _, test := range []struct {
+		iss   string
+		valid bool
+	}{
+		{cfg.IssuerIdentifier, true},
+		{"https://old.example.com", true},
+		{"https://other.example.com", false},
+	} {
+		tokenString, err := p.makeJWT(ctx, nil, &konnect.AccessTokenClaims{
+			IsAccessToken: true,
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    test.iss,
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = jwt.ParseWithClaims(tokenString, &konnect.AccessTokenClaims{}, p.validateJWT)
+		if test.valid && err != nil {
+			t.Errorf("iss %v: unexpected error: %v", test.iss, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("iss %v: expected error, got none", test.iss)
+		}
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	p.refreshTokenRotation = RefreshTokenRotationAll
+	p.refreshManager = refreshManagers.NewMemoryMapManager(ctx, 0, 0)
+	p.refreshTokenDuration = time.Hour
+
+	family, id, err := p.createRefreshTokenFamily(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &konnect.RefreshTokenClaims{Family: family, StandardClaims: jwt.StandardClaims{Id: id}}
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+
+	family, next, err := p.rotateRefreshToken(ctx, req, first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if family != first.Family || next == id {
+		t.Fatalf("unexpected rotation result: %v %v", family, next)
+	}
+	second := &konnect.RefreshTokenClaims{Family: family, StandardClaims: jwt.StandardClaims{Id: next}}
+
+	// Reusing the first token must fail and revoke the family.
+	if _, _, err = p.rotateRefreshToken(ctx, req, first, ""); !isOAuth2ErrorWithDescription(err, "refresh token reused") {
+		t.Errorf("expected reuse error, got %v", err)
+	}
+	if _, _, err = p.rotateRefreshToken(ctx, req, second, ""); !isOAuth2ErrorWithDescription(err, "refresh token revoked") {
+		t.Errorf("expected revoked error, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenWithReuseGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	p.refreshTokenRotation = RefreshTokenRotationAll
+	p.refreshManager = refreshManagers.NewMemoryMapManager(ctx, 0, time.Minute)
+	p.refreshTokenDuration = time.Hour
+
+	family, id, err := p.createRefreshTokenFamily(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &konnect.RefreshTokenClaims{Family: family, StandardClaims: jwt.StandardClaims{Id: id}}
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+
+	_, next, err := p.rotateRefreshToken(ctx, req, first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reusing the previous token within the grace window must succeed and
+	// return the current token of the family.
+	_, again, err := p.rotateRefreshToken(ctx, req, first, "")
+	if err != nil {
+		t.Fatalf("expected reuse within grace window to succeed, got %v", err)
+	}
+	if again != next {
+		t.Errorf("expected current token %v, got %v", next, again)
+	}
+
+	second := &konnect.RefreshTokenClaims{Family: family, StandardClaims: jwt.StandardClaims{Id: next}}
+	if _, _, err = p.rotateRefreshToken(ctx, req, second, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first token is no longer the previous token, so reusing it must
+	// still revoke the family.
+	if _, _, err = p.rotateRefreshToken(ctx, req, first, ""); !isOAuth2ErrorWithDescription(err, "refresh token reused") {
+		t.Errorf("expected reuse error, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenLegacy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	p.refreshTokenRotation = RefreshTokenRotationAll
+	p.refreshManager = refreshManagers.NewMemoryMapManager(ctx, 0, 0)
+	p.refreshTokenDuration = time.Hour
+
+	received, closeReceiver := setTestAuditReceiver(ctx, t, p)
+	defer closeReceiver()
+
+	// Refresh tokens without family are rotated once into a new family.
+	legacy := &konnect.RefreshTokenClaims{StandardClaims: jwt.StandardClaims{Audience: "testclient", Subject: "unittestuser"}}
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+	family, id, err := p.rotateRefreshToken(ctx, req, legacy, "legacy-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if family == "" || id == "" {
+		t.Fatalf("legacy token was not rotated into a family: %v %v", family, id)
+	}
+	if _, _, err = p.rotateRefreshToken(ctx, req, legacy, "other-legacy-token"); err != nil {
+		t.Errorf("other legacy token was rejected: %v", err)
+	}
+
+	// Using the same legacy token again is reuse.
+	if _, _, err = p.rotateRefreshToken(ctx, req, legacy, "legacy-token"); !isOAuth2ErrorWithDescription(err, "refresh token reused") {
+		t.Errorf("expected reuse error, got %v", err)
+	}
+	select {
+	case event := <-received:
+		if event.Type != audit.EventTypeRefreshTokenReused || event.ClientID != "testclient" || event.Subject != "unittestuser" || event.Endpoint != auditEndpointToken {
+			t.Errorf("wrong event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reuse event was not delivered")
+	}
+
+	// The family the legacy token was rotated into is valid.
+	next := &konnect.RefreshTokenClaims{Family: family, StandardClaims: jwt.StandardClaims{Id: id}}
+	if _, _, err = p.rotateRefreshToken(ctx, req, next, ""); err != nil {
+		t.Errorf("successor of legacy token was rejected: %v", err)
+	}
+}
+
+func TestValidateClientSigningAlgs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name          string
+		idTokenAlg    string
+		userInfoAlg   string
+		withECKey     bool
+		valid         bool
+		defaultAlg    string
+		withoutRSAKey bool
+	}{
+		{"default", "", "", false, true, "RS256", false},
+		{"rsa", "PS384", "RS256", false, true, "RS256", false},
+		{"ecdsa without key", "ES256", "", false, false, "RS256", false},
+		{"userinfo ecdsa without key", "", "ES256", false, false, "RS256", false},
+		{"unknown", "XX256", "", false, false, "RS256", false},
+		{"ecdsa", "ES256", "ES384", true, true, "RS256", false},
+		{"ecdsa only", "ES256", "", true, true, "ES256", true},
+		{"rsa without key", "RS256", "", true, false, "ES256", true},
+	} {
+		if test.withoutRSAKey {
+			p.signingKeys = make(map[jwt.SigningMethod]*SigningKey)
+			p.signingMethodDefault = jwt.SigningMethodES256
+		}
+		if test.withECKey {
+			if err = p.SetSigningKey("ec", ecKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = p.ValidateClientSigningAlgs(&clients.ClientRegistration{
+			ID:                           "client",
+			RawIDTokenSignedResponseAlg:  test.idTokenAlg,
+			RawUserInfoSignedResponseAlg: test.userInfoAlg,
+		})
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid {
+			if _, ok := err.(*konnectoidc.OAuth2Error); !ok {
+				t.Errorf("%s: expected oauth2 error, got %v", test.name, err)
+			}
+		}
+		if alg := p.defaultClientSigningAlg(); alg != test.defaultAlg {
+			t.Errorf("%s: wrong default alg: got %v want %v", test.name, alg, test.defaultAlg)
+		}
+	}
+}
+
+func isOAuth2ErrorWithDescription(err error, description string) bool {
+	oauth2Error, ok := err.(*konnectoidc.OAuth2Error)
+	return ok && oauth2Error.ErrorDescription == description
+}
+
+func TestNewProviderWithMetricsRegisterer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	for i := 0; i < 2; i++ {
+		_, err := NewProvider(&Config{
+			Config: &config.Config{
+				WithMetrics:       true,
+				MetricsRegisterer: registry,
+				Logger:            logger,
+			},
+
+			IssuerIdentifier: "http://localhost:8777",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokenSigningDuration.WithLabelValues("unittest").Observe(0)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() == "konnect_provider_token_signing_duration_seconds" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("metrics not registered with provided registerer")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	nextKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedKeyID := func() string {
+		token, signErr := p.makeJWT(ctx, nil, jwt.MapClaims{})
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		parsed, _, parseErr := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if parseErr != nil {
+			t.Fatal(parseErr)
+		}
+		kid, _ := parsed.Header["kid"].(string)
+		return kid
+	}
+	status := func(id string) string {
+		for _, key := range p.Keys() {
+			if key.ID == id {
+				return key.Status
+			}
+		}
+		return ""
+	}
+
+	if err = p.AddPendingSigningKey("next", ecKey); err == nil {
+		t.Errorf("pending key with mismatching key type was accepted")
+	}
+	if err = p.AddPendingSigningKey("next", nextKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.AddPendingSigningKey("next", nextKey); err != ErrKeyExists {
+		t.Errorf("adding existing key returned wrong error: %v", err)
+	}
+	if s := status("next"); s != KeyStatusPending {
+		t.Errorf("pending key has wrong status: %v", s)
+	}
+	if _, ok := p.GetValidationKey("next"); !ok {
+		t.Errorf("pending key is not a validation key")
+	}
+	if kid := signedKeyID(); kid != "default" {
+		t.Errorf("token signed with wrong key: %v", kid)
+	}
+
+	if err = p.PromoteSigningKey("default"); err != ErrKeyInvalidStatus {
+		t.Errorf("promoting active key returned wrong error: %v", err)
+	}
+	if err = p.PromoteSigningKey("unknown"); err != ErrKeyUnknown {
+		t.Errorf("promoting unknown key returned wrong error: %v", err)
+	}
+	if err = p.PromoteSigningKey("next"); err != nil {
+		t.Fatal(err)
+	}
+	if kid := signedKeyID(); kid != "next" {
+		t.Errorf("token signed with wrong key after promotion: %v", kid)
+	}
+	if s := status("default"); s != KeyStatusInactive {
+		t.Errorf("previous key has wrong status: %v", s)
+	}
+
+	if err = p.RetireKey("next"); err != ErrKeyInvalidStatus {
+		t.Errorf("retiring active key returned wrong error: %v", err)
+	}
+	if err = p.RetireKey("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.GetValidationKey("default"); ok {
+		t.Errorf("retired key is still a validation key")
+	}
+	if s := status("default"); s != KeyStatusRetired {
+		t.Errorf("retired key has wrong status: %v", s)
+	}
+	if err = p.AddPendingSigningKey("default", nextKey); err != ErrKeyExists {
+		t.Errorf("adding retired key returned wrong error: %v", err)
+	}
+}
+
+// opaqueSigner hides the type of the wrapped signer, like signers backed by
+// hardware security modules.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestOpaqueSigningKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SetSigningKey("rsa", &opaqueSigner{rsaKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SetSigningKey("ec", &opaqueSigner{ecKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signingMethod := range []jwt.SigningMethod{jwt.SigningMethodRS256, jwt.SigningMethodPS256, jwt.SigningMethodES256} {
+		tokenString, signErr := p.makeJWT(ctx, signingMethod, jwt.MapClaims{})
+		if signErr != nil {
+			t.Fatalf("%s: %v", signingMethod.Alg(), signErr)
+		}
+		_, parseErr := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			key, _ := p.GetValidationKey(kid)
+			return key, nil
+		})
+		if parseErr != nil {
+			t.Errorf("%s: token signed with opaque signer is invalid: %v", signingMethod.Alg(), parseErr)
+		}
+	}
+}
+
+func TestPreviewClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:           "preview-client",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	scopes := map[string]bool{
+		"openid": true,
+		"email":  true,
+	}
+
+	if _, err = p.PreviewClaims(ctx, "other-client", "unittestuser", scopes, true); err != ErrPreviewUnknownClient {
+		t.Errorf("expected unknown client error, got %v", err)
+	}
+	if _, err = p.PreviewClaims(ctx, "preview-client", "otheruser", scopes, true); err != ErrPreviewUnknownUser {
+		t.Errorf("expected unknown user error, got %v", err)
+	}
+
+	preview, err := p.PreviewClaims(ctx, "preview-client", "unittestuser", scopes, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.AccessToken == nil {
+		t.Fatal("preview without access token claims")
+	}
+	idTokenClaims, ok := preview.IDToken.(*konnectoidc.IDTokenClaims)
+	if !ok {
+		t.Fatalf("unexpected id token claims type: %T", preview.IDToken)
+	}
+	if idTokenClaims.Audience != "preview-client" {
+		t.Errorf("wrong id token aud: %v", idTokenClaims.Audience)
+	}
+	if sub, _ := preview.UserInfo["sub"].(string); sub == "" || sub != idTokenClaims.Subject {
+		t.Errorf("userinfo sub does not match id token sub: %v", preview.UserInfo["sub"])
+	}
+	if _, ok := preview.UserInfo["email"]; !ok {
+		t.Errorf("userinfo without email claim: %v", preview.UserInfo)
+	}
+}
+
+type fetchTestUser struct{}
+
+func (u *fetchTestUser) Subject() string {
+	return "unittestuser"
+}
+
+func (u *fetchTestUser) Raw() string {
+	return "unittestuser"
+}
+
+func (u *fetchTestUser) Claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		konnect.IdentifiedUserIDClaim: "unittestuser",
+	}
+}
+
+// fetchTestIdentityManager is a DummyIdentityManager which sets the user of
+// fetched auth records, so claims of ID tokens can be assembled.
+type fetchTestIdentityManager struct {
+	*identityManagers.DummyIdentityManager
+}
+
+func (im *fetchTestIdentityManager) Fetch(ctx context.Context, userID string, sessionRef *string, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) (identity.AuthRecord, bool, error) {
+	auth, found, err := im.DummyIdentityManager.Fetch(ctx, userID, sessionRef, scopes, requestedClaimsMaps)
+	if found {
+		auth.SetUser(&fetchTestUser{})
+	}
+
+	return auth, found, err
+}
+
+func TestClaimsPlacement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProviderWithIdentityManager(ctx, t, &fetchTestIdentityManager{
+		DummyIdentityManager: identityManagers.NewDummyIdentityManager(&identity.Config{}, "unittestuser"),
+	})
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:           "preview-client",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	scopes := map[string]bool{
+		oidc.ScopeOpenID: true,
+		oidc.ScopeEmail:  true,
+	}
+
+	for _, test := range []struct {
+		name            string
+		claimsInIDToken string
+		claimsPlacement map[string]string
+		withAccessToken bool
+		inIDToken       bool
+		inUserInfo      bool
+	}{
+		{"minimal", ClaimsInIDTokenMinimal, nil, true, false, true},
+		{"minimal without access token", ClaimsInIDTokenMinimal, nil, false, true, true},
+		{"full", ClaimsInIDTokenFull, nil, true, true, true},
+		{"full with userinfo placement", ClaimsInIDTokenFull, map[string]string{oidc.ScopeEmail: ClaimsPlacementUserInfo}, true, false, true},
+		{"minimal with id_token placement", ClaimsInIDTokenMinimal, map[string]string{oidc.ScopeEmail: ClaimsPlacementIDToken}, true, true, false},
+		{"minimal with both placement", ClaimsInIDTokenMinimal, map[string]string{oidc.ScopeEmail: ClaimsPlacementBoth}, true, true, true},
+	} {
+		p.claimsInIDToken = test.claimsInIDToken
+		p.claimsPlacement = test.claimsPlacement
+
+		preview, previewErr := p.PreviewClaims(ctx, "preview-client", "unittestuser", scopes, test.withAccessToken)
+		if previewErr != nil {
+			t.Fatalf("%s: %v", test.name, previewErr)
+		}
+		idToken, mapErr := payload.ToMap(preview.IDToken)
+		if mapErr != nil {
+			t.Fatal(mapErr)
+		}
+		if _, ok := idToken[oidc.EmailClaim]; ok != test.inIDToken {
+			t.Errorf("%s: wrong email claim in id token: %v", test.name, idToken)
+		}
+		for _, claim := range []string{oidc.EmailClaim, oidc.EmailVerifiedClaim} {
+			if _, ok := preview.UserInfo[claim]; ok != test.inUserInfo {
+				t.Errorf("%s: wrong %s claim in userinfo: %v", test.name, claim, preview.UserInfo)
+			}
+		}
+	}
+
+	if err = ValidateClaimsPlacement(map[string]string{oidc.ScopeEmail: "access_token"}); err == nil {
+		t.Errorf("invalid claims placement accepted")
+	}
+	if err = ValidateClaimsPlacement(map[string]string{"custom": ClaimsPlacementBoth}); err == nil {
+		t.Errorf("claims placement for unsupported scope accepted")
+	}
+}
+
+type clientEmailScopeClaimsResolver struct{}
+
+func (r *clientEmailScopeClaimsResolver) ResolveScopeClaims(ctx context.Context, user identity.User, clientID string, scopes map[string]bool, requestedClaimsMaps []*payload.ClaimsRequestMap) map[string]jwt.Claims {
+	if !scopes[oidc.ScopeEmail] {
+		return nil
+	}
+	return map[string]jwt.Claims{
+		oidc.ScopeEmail: &konnectoidc.EmailClaims{
+			Email: user.Subject() + "@" + clientID,
+		},
+	}
+}
+
+func TestScopeClaimsResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProviderWithIdentityManager(ctx, t, identityManagers.NewDummyIdentityManager(
+		&identity.Config{
+			ScopeClaimsResolver: &clientEmailScopeClaimsResolver{},
+		},
+		"unittestuser",
+	))
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.Register(&clients.ClientRegistration{
+		ID:           "resolver-client",
+		RedirectURIs: []string{"https://client.example.com/cb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.clients = registry
+
+	preview, err := p.PreviewClaims(ctx, "resolver-client", "unittestuser", map[string]bool{
+		"openid": true,
+		"email":  true,
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email, _ := preview.UserInfo["email"].(string); !strings.HasSuffix(email, "@resolver-client") {
+		t.Errorf("userinfo email not resolved by scope claims resolver: %v", preview.UserInfo)
+	}
+}
+
+func TestApplyUnknownScopeBehavior(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	for _, test := range []struct {
+		behavior string
+		scopes   map[string]bool
+		err      bool
+	}{
+		{UnknownScopeBehaviorPassthrough, map[string]bool{"openid": true, "profile": true, "unknown": true}, false},
+		{UnknownScopeBehaviorIgnore, map[string]bool{"openid": true, "profile": true}, false},
+		{UnknownScopeBehaviorError, nil, true},
+	} {
+		p.unknownScopeBehavior = test.behavior
+		scopes := map[string]bool{"openid": true, "profile": true, "unknown": true}
+
+		err := p.applyUnknownScopeBehavior(scopes)
+		if test.err {
+			if !isOAuth2ErrorWithDescription(err, "unknown scope: unknown") {
+				t.Errorf("%s: expected invalid_scope error, got %v", test.behavior, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.behavior, err)
+		}
+		if !reflect.DeepEqual(scopes, test.scopes) {
+			t.Errorf("%s: unexpected scopes: %v", test.behavior, scopes)
+		}
+	}
+}
+
+func TestIDTokenAMR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	for _, test := range []struct {
+		amr      []string
+		expected interface{}
+	}{
+		{[]string{"mfa"}, []interface{}{"mfa"}},
+		{nil, nil},
+	} {
+		auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth.SetAMR(test.amr)
+
+		idTokenClaims, _, err := p.makeIDTokenClaims(ctx, &payload.AuthenticationRequest{ClientID: "testclient"}, auth, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(idTokenClaims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idToken := make(map[string]interface{})
+		if err = json.Unmarshal(b, &idToken); err != nil {
+			t.Fatal(err)
+		}
+		if amr, ok := idToken["amr"]; !reflect.DeepEqual(amr, test.expected) || (test.expected == nil && ok) {
+			t.Errorf("wrong id token amr: got %#v want %#v", amr, test.expected)
+		}
+	}
+}
+
+func TestIDTokenHashes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: The default test RSA key is too small for the larger hashes.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeys := make(map[elliptic.Curve]*ecdsa.PrivateKey)
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if ecKeys[curve], err = ecdsa.GenerateKey(curve, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leftmostHash := func(value string, hash crypto.Hash) string {
+		h := hash.New()
+		h.Write([]byte(value))
+		sum := h.Sum(nil)
+		return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	}
+
+	accessTokenString := "unittest-access-token"
+	codeString := "unittest-code"
+	for _, test := range []struct {
+		key           crypto.Signer
+		signingMethod jwt.SigningMethod
+		hash          crypto.Hash
+	}{
+		{rsaKey, jwt.SigningMethodRS256, crypto.SHA256},
+		{rsaKey, jwt.SigningMethodRS384, crypto.SHA384},
+		{rsaKey, jwt.SigningMethodRS512, crypto.SHA512},
+		{rsaKey, jwt.SigningMethodPS256, crypto.SHA256},
+		{rsaKey, jwt.SigningMethodPS384, crypto.SHA384},
+		{rsaKey, jwt.SigningMethodPS512, crypto.SHA512},
+		{ecKeys[elliptic.P256()], jwt.SigningMethodES256, crypto.SHA256},
+		{ecKeys[elliptic.P384()], jwt.SigningMethodES384, crypto.SHA384},
+		{ecKeys[elliptic.P521()], jwt.SigningMethodES512, crypto.SHA512},
+		{edKey, signing.SigningMethodEdDSA, crypto.SHA512},
+	} {
+		alg := test.signingMethod.Alg()
+		if err = p.SetSigningKey("default", test.key); err != nil {
+			t.Fatal(err)
+		}
+
+		var idTokenString string
+		idTokenString, err = p.makeIDToken(ctx, &payload.AuthenticationRequest{ClientID: "testclient"}, auth, nil, accessTokenString, codeString, test.signingMethod)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		claims := jwt.MapClaims{}
+		var token *jwt.Token
+		token, _, err = new(jwt.Parser).ParseUnverified(idTokenString, claims)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if token.Header["alg"] != alg {
+			t.Errorf("%s: wrong id token alg: got %v", alg, token.Header["alg"])
+		}
+		if expected := leftmostHash(accessTokenString, test.hash); claims["at_hash"] != expected {
+			t.Errorf("%s: wrong at_hash: got %v want %v", alg, claims["at_hash"], expected)
+		}
+		if expected := leftmostHash(codeString, test.hash); claims["c_hash"] != expected {
+			t.Errorf("%s: wrong c_hash: got %v want %v", alg, claims["c_hash"], expected)
+		}
+
+		// NOTE: c_hash is only added when a code is issued together with the ID
+		// token.
+		idTokenString, err = p.makeIDToken(ctx, &payload.AuthenticationRequest{ClientID: "testclient"}, auth, nil, accessTokenString, "", test.signingMethod)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		claims = jwt.MapClaims{}
+		if _, _, err = new(jwt.Parser).ParseUnverified(idTokenString, claims); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if _, ok := claims["c_hash"]; ok {
+			t.Errorf("%s: unexpected c_hash without code", alg)
+		}
+	}
+}
+
+func TestTokenTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typ := func(tokenString string) interface{} {
+		token, _, parseErr := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+		if parseErr != nil {
+			t.Fatal(parseErr)
+		}
+		return token.Header["typ"]
+	}
+
+	if p.accessTokenType != AccessTokenTypeATJWT {
+		t.Errorf("wrong default access token type: got %v", p.accessTokenType)
+	}
+	for _, accessTokenType := range []string{AccessTokenTypeATJWT, AccessTokenTypeJWT} {
+		p.accessTokenType = accessTokenType
+
+		accessTokenString, tokenErr := p.makeAccessToken(ctx, "testclient", auth, nil, nil, nil)
+		if tokenErr != nil {
+			t.Fatal(tokenErr)
+		}
+		if typ(accessTokenString) != accessTokenType {
+			t.Errorf("wrong access token typ: got %v want %v", typ(accessTokenString), accessTokenType)
+		}
+
+		idTokenString, tokenErr := p.makeIDToken(ctx, &payload.AuthenticationRequest{ClientID: "testclient"}, auth, nil, accessTokenString, "", nil)
+		if tokenErr != nil {
+			t.Fatal(tokenErr)
+		}
+		if typ(idTokenString) != "JWT" {
+			t.Errorf("wrong id token typ with access token type %v: got %v", accessTokenType, typ(idTokenString))
+		}
+	}
+
+	// Only tokens of the configured access token type are access tokens.
+	p.accessTokenType = AccessTokenTypeATJWT
+	bearer := func(tokenString string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "https://konnect.example.com/konnect/v1/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return req
+	}
+	accessTokenString, err := p.makeAccessToken(ctx, "testclient", auth, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.GetAccessTokenClaimsFromRequest(bearer(accessTokenString)); err != nil {
+		t.Errorf("access token was rejected: %v", err)
+	}
+	untypedAccessTokenString, err := p.makeJWT(ctx, nil, p.makeAccessTokenClaims(ctx, "testclient", auth, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.GetAccessTokenClaimsFromRequest(bearer(untypedAccessTokenString)); err == nil {
+		t.Error("access token with typ JWT was accepted with access token type at+jwt")
+	}
+}
+
+// setTestAuditReceiver sets a new audit webhook for the provided provider and
+// returns the channel receiving its events together with a function which
+// removes the webhook again.
+func setTestAuditReceiver(ctx context.Context, t *testing.T, p *Provider) (chan *audit.Event, func()) {
+	received := make(chan *audit.Event, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		event := &audit.Event{}
+		if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+			t.Errorf("failed to decode event: %v", err)
+		}
+		received <- event
+	}))
+
+	webhook, err := audit.NewWebhook(receiver.URL, []byte("unittest-secret"), nil, logger)
+	if err != nil {
+		receiver.Close()
+		t.Fatal(err)
+	}
+	go webhook.Run(ctx)
+	p.Config.Config.AuditWebhook = webhook
+
+	return received, func() {
+		p.Config.Config.AuditWebhook = nil
+		receiver.Close()
+	}
+}
+
+func TestAuditTokensIssued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	received, closeReceiver := setTestAuditReceiver(ctx, t, p)
+	defer closeReceiver()
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, map[string]bool{oidc.ScopeOpenID: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &payload.AuthenticationRequest{ClientID: "testclient"}
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+
+	// NOTE: Nothing is emitted when no token was issued.
+	p.auditTokensIssued(req, auditEndpointToken, ar, auth, nil, oidc.GrantTypeAuthorizationCode, "", "", "")
+	p.auditTokensIssued(req, auditEndpointToken, ar, auth, &payload.Session{ID: "unittest-session"}, oidc.GrantTypeAuthorizationCode, "access-token", "id-token", "")
+
+	select {
+	case event := <-received:
+		if event.Type != audit.EventTypeTokenIssued || event.ClientID != "testclient" || event.Subject != auth.Subject() || event.SessionID != "unittest-session" || event.GrantType != oidc.GrantTypeAuthorizationCode {
+			t.Errorf("wrong event: %#v", event)
+		}
+		if !reflect.DeepEqual(event.Tokens, []string{audit.TokenAccessToken, audit.TokenIDToken}) {
+			t.Errorf("wrong event tokens: %v", event.Tokens)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	select {
+	case event := <-received:
+		t.Errorf("unexpected event: %#v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGetAccessTokenClaimsRejectsAlgConfusion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	received, closeReceiver := setTestAuditReceiver(ctx, t, p)
+	defer closeReceiver()
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := p.MakeAccessToken(ctx, "testclient", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Forge tokens with the claims of the valid token, using the public key
+	// of the provider as HMAC secret or no signature at all.
+	claims := jwt.MapClaims{}
+	if _, _, err = new(jwt.Parser).ParseUnverified(accessToken, claims); err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaPrivateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+	forge := func(signingMethod jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(signingMethod, claims)
+		token.Header["kid"] = "default"
+		forged, forgeErr := token.SignedString(key)
+		if forgeErr != nil {
+			t.Fatal(forgeErr)
+		}
+		return forged
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", accessToken, true},
+		{"hs256 with public key pem", forge(jwt.SigningMethodHS256, publicKeyPEM), false},
+		{"hs256 with public key der", forge(jwt.SigningMethodHS256, publicKeyBytes), false},
+		{"none", forge(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		_, err := p.GetAccessTokenClaimsFromRequest(req)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if oauth2Err, ok := err.(*konnectoidc.OAuth2Error); !ok || oauth2Err.ErrorID != oidc.ErrorCodeOAuth2InvalidToken {
+			t.Errorf("%s: expected invalid_token error, got %v", test.name, err)
+		}
+		select {
+		case event := <-received:
+			if event.Type != audit.EventTypeTokenRejected || event.Reason != auditReasonDisallowedAlg || !reflect.DeepEqual(event.Tokens, []string{"access_token"}) || event.RemoteAddr == "" {
+				t.Errorf("%s: wrong event: %#v", test.name, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: rejected event was not delivered", test.name)
+		}
+	}
+}
+
+func TestTokenBinding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	p.tokenBinding = &clients.TokenBinding{IP: true, UserAgent: true}
+
+	received, closeReceiver := setTestAuditReceiver(ctx, t, p)
+	defer closeReceiver()
+
+	newRequest := func(remoteAddr string, userAgent string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/userinfo", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("User-Agent", userAgent)
+		return req
+	}
+
+	if binding := p.makeTokenBindingClaims(newRequest("[2001:db8::1]:1234", "test-agent"), p.getTokenBinding(nil)); binding.IPNet != "2001:db8::/64" {
+		t.Errorf("unexpected ipv6 token binding network: %v", binding.IPNet)
+	}
+	if binding := p.makeTokenBindingClaims(newRequest("192.0.2.10:1234", "test-agent"), p.getTokenBinding(&clients.ClientRegistration{TokenBinding: &clients.TokenBinding{}})); binding != nil {
+		t.Errorf("client token binding did not replace global token binding: %v", binding)
+	}
+
+	binding := p.makeTokenBindingClaims(newRequest("192.0.2.10:1234", "test-agent"), p.getTokenBinding(nil))
+	if binding == nil || binding.IPNet != "192.0.2.0/24" || binding.UserAgentHash == "" {
+		t.Fatalf("unexpected token binding claims: %v", binding)
+	}
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := p.makeAccessToken(ctx, "testclient", auth, nil, nil, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		userAgent  string
+		reason     string
+	}{
+		{"same context", "192.0.2.10:1234", "test-agent", ""},
+		{"same network", "192.0.2.77:4321", "test-agent", ""},
+		{"other network", "198.51.100.10:1234", "test-agent", "token_binding_mismatch_ip"},
+		{"other user agent", "192.0.2.10:1234", "other-agent", "token_binding_mismatch_user_agent"},
+	} {
+		req := newRequest(test.remoteAddr, test.userAgent)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		_, err := p.GetAccessTokenClaimsFromRequest(req)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if !isOAuth2ErrorWithDescription(err, "token binding mismatch") {
+			t.Errorf("%s: expected token binding mismatch error, got %v", test.name, err)
+		}
+		select {
+		case event := <-received:
+			if event.Type != audit.EventTypeTokenRejected || event.Reason != test.reason || !reflect.DeepEqual(event.Tokens, []string{"access_token"}) {
+				t.Errorf("%s: wrong event: %#v", test.name, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: rejected event was not delivered", test.name)
+		}
+	}
+}
+
+func TestCertificateBoundAccessToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	p.Config.Config.ClientCertificateHeader = "X-SSL-Client-Cert"
+	trustedProxyIP := net.ParseIP("192.0.2.1")
+	p.Config.Config.TrustedProxyIPs = []*net.IP{&trustedProxyIP}
+
+	newCertificate := func(commonName string) *x509.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	cert := newCertificate("client")
+	other := newCertificate("client")
+	certPEM := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+
+	auth, _, err := p.identityManager.Fetch(ctx, "unittestuser", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := p.makeAccessToken(ctx, "testclient", auth, nil, &konnect.ConfirmationClaims{
+		X5tS256: utils.CertificateThumbprintS256(cert),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		peer       *x509.Certificate
+		header     string
+		valid      bool
+	}{
+		{"same certificate", "198.51.100.10:1234", cert, "", true},
+		{"other certificate", "198.51.100.10:1234", other, "", false},
+		{"no certificate", "198.51.100.10:1234", nil, "", false},
+		{"forwarded by trusted proxy", "192.0.2.1:1234", nil, certPEM, true},
+		{"forwarded by untrusted peer", "198.51.100.10:1234", nil, certPEM, false},
+		{"invalid forwarded certificate", "192.0.2.1:1234", nil, "-----BEGIN%20CERTIFICATE-----", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/konnect/v1/userinfo", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		if test.peer != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.peer}}
+		}
+		if test.header != "" {
+			req.Header.Set("X-SSL-Client-Cert", test.header)
+		}
+
+		_, err := p.GetAccessTokenClaimsFromRequest(req)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if !isOAuth2ErrorWithDescription(err, "certificate mismatch") {
+			t.Errorf("%s: expected certificate mismatch error, got %v", test.name, err)
+		}
+	}
+}
+
+// acrValuesIdentityManager adds supported acr values to the wrapped identity
+// manager.
+type acrValuesIdentityManager struct {
+	identity.Manager
+
+	acrValues []string
+}
+
+func (im *acrValuesIdentityManager) ACRValuesSupported() []string {
+	return im.acrValues
+}
+
+func TestACRValuesSupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+	if p.metadata.ACRValuesSupported != nil {
+		t.Errorf("unexpected acr_values_supported without acr values: %v", p.metadata.ACRValuesSupported)
+	}
+
+	_, p, _, _ = NewTestProviderWithIdentityManager(ctx, t, &acrValuesIdentityManager{
+		Manager: identityManagers.NewDummyIdentityManager(
+			&identity.Config{},
+			"unittestuser",
+		),
+		acrValues: []string{"urn:example:mfa", "urn:example:pwd"},
+	})
+	if !reflect.DeepEqual(p.metadata.ACRValuesSupported, []string{"urn:example:mfa", "urn:example:pwd"}) {
+		t.Errorf("wrong acr_values_supported: %v", p.metadata.ACRValuesSupported)
+	}
+
+	p.Config.ACRValuesSupported = []string{"+urn:example:extra"}
+	p.Config.AllowOpaqueACRValues = true
+	if err := p.InitializeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.metadata.ACRValuesSupported, []string{"urn:example:mfa", "urn:example:pwd", "urn:example:extra"}) {
+		t.Errorf("wrong extended acr_values_supported: %v", p.metadata.ACRValuesSupported)
+	}
+}
+
+// scopesIdentityManager replaces the supported scopes of the wrapped identity
+// manager.
+type scopesIdentityManager struct {
+	identity.Manager
+
+	scopes []string
+}
+
+func (im *scopesIdentityManager) ScopesSupported(scopes map[string]bool) []string {
+	return im.scopes
+}
+
+func TestRefreshScopesSupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	im := &scopesIdentityManager{
+		Manager: identityManagers.NewDummyIdentityManager(
+			&identity.Config{},
+			"unittestuser",
+		),
+		scopes: []string{"scope-a"},
+	}
+	_, p, _, _ := NewTestProviderWithIdentityManager(ctx, t, im)
+	metadata := p.getMetadata()
+	if !reflect.DeepEqual(metadata.ScopesSupported, []string{oidc.ScopeOpenID, "scope-a"}) {
+		t.Errorf("wrong scopes_supported: %v", metadata.ScopesSupported)
+	}
+
+	im.scopes = []string{"scope-b", oidc.ScopeOpenID}
+	p.RefreshScopesSupported()
+	if !reflect.DeepEqual(p.getMetadata().ScopesSupported, []string{oidc.ScopeOpenID, "scope-b"}) {
+		t.Errorf("wrong refreshed scopes_supported: %v", p.getMetadata().ScopesSupported)
+	}
+	if !reflect.DeepEqual(metadata.ScopesSupported, []string{oidc.ScopeOpenID, "scope-a"}) {
+		t.Errorf("refresh modified the previous metadata document: %v", metadata.ScopesSupported)
+	}
+
+	rr := httptest.NewRecorder()
+	p.WellKnownHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+	var wellKnown struct {
+		ScopesSupported []string `json:"scopes_supported"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &wellKnown); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(wellKnown.ScopesSupported, []string{oidc.ScopeOpenID, "scope-b"}) {
+		t.Errorf("wrong discovered scopes_supported: %v", wellKnown.ScopesSupported)
+	}
+}
+
+func TestMakeJWTMatchesJWTGo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	claims := jwt.MapClaims{
+		"sub": "unittestuser",
+		"aud": "testclient",
+	}
+	// NOTE: RS256 signatures are deterministic, so tokens can be compared.
+	tokenString, err := p.makeJWT(ctx, jwt.SigningMethodRS256, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header[oidc.JWTHeaderKeyID] = "default"
+	expected, err := token.SignedString(rsaPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenString != expected {
+		t.Errorf("token differs from jwt-go token: got %s want %s", tokenString, expected)
+	}
+}
+
+func BenchmarkMakeJWT(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// jwkKey is like an RSA key loaded from a JWK without dp, dq and qi.
+	rsaKey := rsaPrivateKey.(*rsa.PrivateKey)
+	jwkKey := &rsa.PrivateKey{
+		PublicKey: rsaKey.PublicKey,
+		D:         rsaKey.D,
+		Primes:    rsaKey.Primes,
+	}
+
+	claims := jwt.MapClaims{
+		"iss": "http://localhost:8777",
+		"sub": "unittestuser",
+		"aud": "testclient",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for _, test := range []struct {
+		name          string
+		key           crypto.Signer
+		signingMethod jwt.SigningMethod
+	}{
+		{"PS256", rsaPrivateKey, jwt.SigningMethodPS256},
+		{"RS256", rsaPrivateKey, jwt.SigningMethodRS256},
+		{"PS256-JWK", jwkKey, jwt.SigningMethodPS256},
+		{"ES256", ecKey, jwt.SigningMethodES256},
+	} {
+		_, p, _, _ := NewTestProvider(ctx, b)
+		if err = p.SetSigningKey(test.name, test.key); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, signErr := p.makeJWT(ctx, test.signingMethod, claims); signErr != nil {
+						b.Fatal(signErr)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestClientErrorLogSampler(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	sampler := newClientErrorLogSampler(2, time.Minute)
+	sampler.now = func() time.Time {
+		return now
+	}
+
+	sample := func(code string, expectedOK bool, expectedSuppressed uint64) {
+		t.Helper()
+		ok, suppressed := sampler.Sample(code)
+		if ok != expectedOK || suppressed != expectedSuppressed {
+			t.Errorf("sample %s returned %v/%d, expected %v/%d", code, ok, suppressed, expectedOK, expectedSuppressed)
+		}
+	}
+
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, true, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, true, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, false, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, false, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidToken, true, 0)
+
+	now = now.Add(30 * time.Second)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, false, 0)
+
+	now = now.Add(30 * time.Second)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, true, 3)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, true, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, false, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidToken, true, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidToken, true, 0)
+	sample(oidc.ErrorCodeOAuth2InvalidToken, false, 0)
+
+	// Suppressed logs are flushed when the interval rolls over, also for
+	// codes without further errors.
+	if flushed := sampler.Flush(); len(flushed) != 0 {
+		t.Errorf("flush within interval returned %v", flushed)
+	}
+	now = now.Add(time.Minute)
+	flushed := sampler.Flush()
+	if len(flushed) != 2 || flushed[oidc.ErrorCodeOAuth2InvalidRequest] != 1 || flushed[oidc.ErrorCodeOAuth2InvalidToken] != 1 {
+		t.Errorf("flush after interval returned %v", flushed)
+	}
+	if flushed = sampler.Flush(); len(flushed) != 0 {
+		t.Errorf("flush returned suppressed logs twice: %v", flushed)
+	}
+	sample(oidc.ErrorCodeOAuth2InvalidRequest, true, 0)
+
+	var unlimited *clientErrorLogSampler
+	for i := 0; i < 5; i++ {
+		if ok, _ := unlimited.Sample(oidc.ErrorCodeOAuth2InvalidRequest); !ok {
+			t.Fatal("nil sampler must allow all logs")
+		}
+	}
+	if ok, _ := newClientErrorLogSampler(0, time.Minute).Sample(oidc.ErrorCodeOAuth2InvalidRequest); !ok {
+		t.Error("sampler without limit must allow all logs")
+	}
+}
+
+func TestSubjectFromAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{ID: "public-client", Insecure: true, RedirectURIs: []string{"https://a.example.com/cb"}},
+		{ID: "pairwise-client", Insecure: true, SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://a.example.com/cb"}},
+		{ID: "pairwise-client-same-sector", Insecure: true, SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://a.example.com/other"}},
+		{ID: "pairwise-client-other-sector", Insecure: true, SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://b.example.com/cb"}},
+		{ID: "pairwise-client-sector-uri", Insecure: true, SubjectType: konnectoidc.SubjectIDPairwise, SectorIdentifierURI: "https://a.example.com/sector.json", RedirectURIs: []string{"https://c.example.com/cb"}},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+
+	auth := identity.NewAuthRecord(nil, "public-sub", nil, nil, nil)
+	auth.SetUser(&refreshTestUser{"raw-sub"})
+	rawAuth := identity.NewAuthRecord(nil, "public-sub", map[string]bool{konnect.ScopeRawSubject: true}, nil, nil)
+	rawAuth.SetUser(&refreshTestUser{"raw-sub"})
+
+	subjects := make(map[string]string)
+	for _, clientID := range []string{"unknown-client", "public-client", "pairwise-client", "pairwise-client-same-sector", "pairwise-client-other-sector", "pairwise-client-sector-uri"} {
+		sub, err := p.SubjectFromAuth(ctx, auth, clientID)
+		if err != nil {
+			t.Fatalf("%s: %v", clientID, err)
+		}
+		subjects[clientID] = sub
+
+		if rawSub, _ := p.SubjectFromAuth(ctx, rawAuth, clientID); rawSub != "raw-sub" {
+			t.Errorf("%s: got raw subject %#v want %#v", clientID, rawSub, "raw-sub")
+		}
+
+		if mapper := p.subjectMapper(ctx, clientID); mapper != nil {
+			if mapped := mapper("public-sub"); mapped != sub {
+				t.Errorf("%s: subject mapper returned %#v want %#v", clientID, mapped, sub)
+			}
+		} else if sub != "public-sub" {
+			t.Errorf("%s: missing subject mapper for pairwise subject", clientID)
+		}
+	}
+
+	if subjects["unknown-client"] != "public-sub" || subjects["public-client"] != "public-sub" {
+		t.Errorf("public clients got wrong subjects: %v", subjects)
+	}
+	if sub := subjects["pairwise-client"]; sub == "public-sub" || !strings.HasSuffix(sub, "@konnect") {
+		t.Errorf("pairwise client got wrong subject: %v", sub)
+	}
+	if subjects["pairwise-client"] != subjects["pairwise-client-same-sector"] || subjects["pairwise-client"] != subjects["pairwise-client-sector-uri"] {
+		t.Errorf("pairwise clients of the same sector got different subjects: %v", subjects)
+	}
+	if subjects["pairwise-client"] == subjects["pairwise-client-other-sector"] {
+		t.Errorf("pairwise clients of different sectors got the same subject: %v", subjects)
+	}
+}
+
+func TestValidateAuthorizeClientRawSubject(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, registration := range []*clients.ClientRegistration{
+		{ID: "trusted-client", Trusted: true, Insecure: true},
+		{ID: "untrusted-client", Insecure: true, SubjectType: konnectoidc.SubjectIDPairwise, RedirectURIs: []string{"https://a.example.com/cb"}},
+	} {
+		if err = registry.Register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+
+	for _, test := range []struct {
+		clientID string
+		expected bool
+	}{
+		{"trusted-client", true},
+		{"untrusted-client", false},
+	} {
+		values := url.Values{}
+		values.Set("response_type", oidc.ResponseTypeCode)
+		values.Set("scope", oidc.ScopeOpenID+" "+konnect.ScopeRawSubject)
+		values.Set("client_id", test.clientID)
+		values.Set("redirect_uri", "https://a.example.com/cb")
+		ar, err := payload.NewAuthenticationRequest(values, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = p.validateAuthorizeClient(ctx, ar); err != nil {
+			t.Fatalf("%s: %v", test.clientID, err)
+		}
+		if ok, _ := ar.Scopes[konnect.ScopeRawSubject]; ok != test.expected {
+			t.Errorf("%s: got raw subject scope %v want %v", test.clientID, ok, test.expected)
+		}
+		if ok, _ := ar.Scopes[oidc.ScopeOpenID]; !ok {
+			t.Errorf("%s: openid scope was removed", test.clientID)
+		}
+	}
+}
+
+type accessTokenClaimsTestUser struct{}
+
+func (u *accessTokenClaimsTestUser) Subject() string {
+	return "unittestuser"
+}
+
+func (u *accessTokenClaimsTestUser) Raw() string {
+	return "unittestuser"
+}
+
+func (u *accessTokenClaimsTestUser) Claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		konnect.IdentifiedUserIDClaim: "unittestuser",
+		"tenant":                      "tenant-a",
+		"roles":                       []interface{}{"admin"},
+		"email":                       "user@example.com",
+	}
+}
+
+func TestAccessTokenExtraClaims(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, p, _, _ := NewTestProvider(ctx, t)
+
+	registry, err := clients.NewRegistry(ctx, nil, "", 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*clients.ClientRegistration{
+		{ID: "plain-client", RedirectURIs: []string{"https://client.example.com/cb"}},
+		{ID: "claims-client", RedirectURIs: []string{"https://client.example.com/cb"}, AccessTokenClaims: []string{"email"}},
+	} {
+		if err = registry.Register(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.clients = registry
+	p.accessTokenClaims = map[string][]string{
+		"tenant-scope": {"tenant", "roles", "missing"},
+	}
+
+	for _, test := range []struct {
+		name     string
+		clientID string
+		scopes   map[string]bool
+		expected []string
+		missing  []string
+	}{
+		{"default", "plain-client", map[string]bool{oidc.ScopeOpenID: true}, nil, []string{"tenant", "roles", "email", "missing"}},
+		{"scope", "plain-client", map[string]bool{oidc.ScopeOpenID: true, "tenant-scope": true}, []string{"tenant", "roles"}, []string{"email", "missing"}},
+		{"client", "claims-client", map[string]bool{oidc.ScopeOpenID: true}, []string{"email"}, []string{"tenant", "roles"}},
+		{"scope and client", "claims-client", map[string]bool{oidc.ScopeOpenID: true, "tenant-scope": true}, []string{"tenant", "roles", "email"}, []string{"missing"}},
+	} {
+		auth := identity.NewAuthRecord(p.identityManager, "unittestuser", test.scopes, nil, nil)
+		auth.SetUser(&accessTokenClaimsTestUser{})
+
+		b, err := json.Marshal(p.makeAccessTokenClaims(ctx, test.clientID, auth, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessToken := make(map[string]interface{})
+		if err = json.Unmarshal(b, &accessToken); err != nil {
+			t.Fatal(err)
+		}
+		for _, claim := range test.expected {
+			if _, ok := accessToken[claim]; !ok {
+				t.Errorf("%s: access token is missing claim %v: %v", test.name, claim, accessToken)
+			}
+		}
+		for _, claim := range test.missing {
+			if _, ok := accessToken[claim]; ok {
+				t.Errorf("%s: access token has unexpected claim %v: %v", test.name, claim, accessToken)
+			}
+		}
+	}
+}
+
+func TestValidateAccessTokenClaims(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		claims map[string][]string
+		valid  bool
+	}{
+		{"none", nil, true},
+		{"valid", map[string][]string{"profile": {"tenant", "roles"}}, true},
+		{"reserved", map[string][]string{"profile": {"tenant", "iss"}}, false},
+		{"reserved prefix", map[string][]string{"profile": {"kc.identity"}}, false},
+	} {
+		if valid := ValidateAccessTokenClaims(test.claims) == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v", test.name, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"context"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/payload"
+)
+
+// validateRedirectURIScheme checks the redirect_uri of the provided
+// authentication request against the redirect URI schemes allowed in the
+// registration of its client. Disallowed schemes result in an invalid_request
+// error which is never sent to the redirect_uri.
+func (p *Provider) validateRedirectURIScheme(ctx context.Context, ar *payload.AuthenticationRequest) error {
+	registration, _ := p.clients.Get(ctx, ar.ClientID)
+	if registration == nil || ar.RedirectURI == nil {
+		return nil
+	}
+
+	if err := registration.ValidateRedirectURIScheme(ar.RedirectURI); err != nil {
+		return ar.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
+	}
+
+	return nil
+}
+
+// validateAuthorizeGrantTypes checks the response types of the provided
+// authentication request against the grant types allowed in the registration
+// of its client. The code response type requires the authorization_code grant
+// type, the token and id_token response types require the implicit grant type.
+func (p *Provider) validateAuthorizeGrantTypes(ctx context.Context, ar *payload.AuthenticationRequest) error {
+	registration, _ := p.clients.Get(ctx, ar.ClientID)
+	if registration == nil {
+		return nil
+	}
+
+	if ar.ResponseTypes[oidc.ResponseTypeCode] && !registration.AllowsGrantType(oidc.GrantTypeAuthorizationCode) {
+		return ar.NewError(konnectoidc.ErrorCodeOAuth2UnauthorizedClient, "authorization_code grant type not allowed for client")
+	}
+	if (ar.ResponseTypes[oidc.ResponseTypeToken] || ar.ResponseTypes[oidc.ResponseTypeIDToken]) && !registration.AllowsGrantType(oidc.GrantTypeImplicit) {
+		return ar.NewError(konnectoidc.ErrorCodeOAuth2UnauthorizedClient, "implicit grant type not allowed for client")
+	}
+
+	return nil
+}
+
+// validateAuthorizeClient checks the client_id and redirect_uri of the
+// provided authentication request against the client registry before anything
+// else, so that errors are never sent to a redirect_uri which is not valid for
+// the client. With RegisteredClientsOnly, clients must also be registered and
+// unregistered clients which are implicitly trusted are rejected. The raw
+// subject scope is removed for clients which are not trusted, since it would
+// bypass pairwise subjects.
+func (p *Provider) validateAuthorizeClient(ctx context.Context, ar *payload.AuthenticationRequest) error {
+	if ar.ClientID == "" {
+		return ar.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "missing client_id")
+	}
+	if ar.RedirectURI == nil || ar.RedirectURI.Host == "" || ar.RedirectURI.Scheme == "" {
+		return ar.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "invalid or missing redirect_uri")
+	}
+
+	clientDetails, err := p.clients.Lookup(ctx, ar.ClientID, "", ar.RedirectURI, "", true)
+	if err != nil {
+		p.logger.WithError(err).WithField("client_id", ar.ClientID).Debugln("authorize request for invalid client")
+		return ar.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, err.Error())
+	}
+	if p.Config.RegisteredClientsOnly && clientDetails.Registration == nil {
+		p.logger.WithField("client_id", ar.ClientID).Debugln("authorize request for unregistered client")
+		return ar.NewBadRequest(oidc.ErrorCodeOAuth2InvalidRequest, "unregistered client_id")
+	}
+	if ok, _ := ar.Scopes[konnect.ScopeRawSubject]; ok && !clientDetails.Trusted {
+		p.logger.WithField("client_id", ar.ClientID).Debugln("ignored raw subject scope for untrusted client")
+		delete(ar.Scopes, konnect.ScopeRawSubject)
+	}
+
+	return nil
+}
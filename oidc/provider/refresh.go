@@ -0,0 +1,117 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"stash.kopano.io/kgol/oidc-go"
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/identity/clients"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+	"stash.kopano.io/kc/konnect/tracing"
+)
+
+// rotatesRefreshTokens returns true if refresh tokens issued to the provided
+// client are one-time-use and rotated on every refresh.
+func (p *Provider) rotatesRefreshTokens(clientDetails *clients.Details) bool {
+	switch p.refreshTokenRotation {
+	case RefreshTokenRotationAll:
+		return true
+	case RefreshTokenRotationPublic:
+		if clientDetails == nil || clientDetails.Registration == nil {
+			return true
+		}
+		return clientDetails.Registration.IsPublic()
+	}
+
+	return false
+}
+
+// createRefreshTokenFamily creates a new refresh token family and returns its
+// id together with the id of the first refresh token of the family.
+func (p *Provider) createRefreshTokenFamily(ctx context.Context) (string, string, error) {
+	_, span := tracing.Start(ctx, "refresh.create")
+	defer span.End()
+
+	id := rndm.GenerateRandomString(24)
+	family, err := p.refreshManager.Create(id, time.Now().Add(p.refreshTokenDuration))
+	span.SetError(err)
+	if err != nil {
+		return "", "", err
+	}
+
+	return family, id, nil
+}
+
+// legacyRefreshTokenID returns the id of the provided refresh token which has
+// no family, since such tokens were issued without jti.
+func legacyRefreshTokenID(rawToken string) string {
+	h := sha256.Sum256([]byte(rawToken))
+
+	return hex.EncodeToString(h[:])
+}
+
+// rotateRefreshToken invalidates the provided refresh token with the provided
+// claims and returns the family and id for its successor. Refresh tokens
+// without family, issued before rotation was enabled, are rotated once into a
+// new family. When an already rotated refresh token is presented, its whole
+// family is revoked unless it is the previous token presented within the
+// reuse grace window of the refresh token family manager.
+func (p *Provider) rotateRefreshToken(ctx context.Context, req *http.Request, claims *konnect.RefreshTokenClaims, rawToken string) (string, string, error) {
+	if claims.Family == "" {
+		_, span := tracing.Start(ctx, "refresh.consume")
+		err := p.refreshManager.Consume(legacyRefreshTokenID(rawToken), time.Now().Add(p.refreshTokenDuration))
+		span.SetError(err)
+		span.End()
+		switch err {
+		case nil:
+			return p.createRefreshTokenFamily(ctx)
+		case refresh.ErrReused:
+			p.auditRefreshTokenReused(req, claims)
+			return "", "", konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "refresh token reused")
+		default:
+			return "", "", err
+		}
+	}
+
+	_, span := tracing.Start(ctx, "refresh.rotate")
+	defer span.End()
+
+	next := rndm.GenerateRandomString(24)
+	next, err := p.refreshManager.Rotate(claims.Family, claims.Id, next, time.Now().Add(p.refreshTokenDuration))
+	span.SetError(err)
+	switch err {
+	case nil:
+		return claims.Family, next, nil
+	case refresh.ErrReused:
+		p.auditRefreshTokenReused(req, claims)
+		return "", "", konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "refresh token reused")
+	case refresh.ErrUnknownFamily:
+		return "", "", konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "refresh token revoked")
+	default:
+		return "", "", err
+	}
+}
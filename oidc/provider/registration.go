@@ -0,0 +1,92 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/oidc/payload"
+
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// requiresRegistrationInitialAccessToken returns true if the accociated
+// provider requires an initial access token for dynamic client registration.
+func (p *Provider) requiresRegistrationInitialAccessToken() bool {
+	return p.registrationInitialAccessToken != "" || len(p.registrationInitialAccessTokenKeys) > 0
+}
+
+// validateRegistrationInitialAccessToken validates the initial access token
+// of the provided dynamic client registration request as specified in
+// https://tools.ietf.org/html/rfc7591#section-3. The token is accepted if it
+// either matches the configured initial access token or is a JWT signed with
+// one of the configured initial access token keys.
+func (p *Provider) validateRegistrationInitialAccessToken(req *http.Request) error {
+	if !p.requiresRegistrationInitialAccessToken() {
+		return nil
+	}
+
+	token, ok := utils.BearerTokenFromRequest(req)
+	if !ok || token == "" {
+		return errors.New("bearer authorization required")
+	}
+
+	if p.registrationInitialAccessToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.registrationInitialAccessToken)) == 1 {
+		return nil
+	}
+	if len(p.registrationInitialAccessTokenKeys) == 0 {
+		return errors.New("initial access token mismatch")
+	}
+
+	parser := &jwt.Parser{
+		ValidMethods: p.clientAssertionSigningAlgs,
+	}
+	parsed, err := parser.ParseWithClaims(token, &payload.ClientAssertionClaims{}, p.strictKeyfunc(req, "initial_access_token", func(token *jwt.Token) (interface{}, error) {
+		if kid, ok := token.Header[oidc.JWTHeaderKeyID].(string); ok {
+			if key, ok := p.registrationInitialAccessTokenKeys[kid]; ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown kid: %v", kid)
+		}
+		if len(p.registrationInitialAccessTokenKeys) == 1 {
+			for _, key := range p.registrationInitialAccessTokenKeys {
+				return key, nil
+			}
+		}
+		return nil, errors.New("no kid header")
+	}))
+	if err != nil {
+		return fmt.Errorf("invalid initial access token: %v", err)
+	}
+
+	// The issuer or the registration endpoint URL must be included in the
+	// audience.
+	for _, audience := range parsed.Claims.(*payload.ClientAssertionClaims).Audience() {
+		if audience == p.getMetadata().RegistrationEndpoint || audience == p.issuerIdentifier {
+			return nil
+		}
+	}
+
+	return errors.New("initial access token aud mismatch")
+}
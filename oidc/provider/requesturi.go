@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"net/http"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+)
+
+// resolveRequestURI fetches the request object referenced by the request_uri
+// of the provided authorize request as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#RequestUriParameter
+// and replaces the request_uri form value with it as request form value.
+// Returned errors are OAuth2 errors.
+func (p *Provider) resolveRequestURI(req *http.Request) error {
+	requestURI := req.Form.Get("request_uri")
+	if req.Form.Get("request") != "" {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidRequest, "request and request_uri must not be used together")
+	}
+
+	clientID := req.Form.Get("client_id")
+	registration, _ := p.clients.Get(req.Context(), clientID)
+	if registration == nil || !registration.HasRequestURI(requestURI) {
+		return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOIDCInvalidRequestURI, "request_uri is not registered for client")
+	}
+
+	request, err := p.clients.FetchRequestObject(req.Context(), registration, requestURI, p.requestLimits.MaxRequestLength)
+	if err != nil {
+		p.logger.WithError(err).WithField("client_id", clientID).Debugln("authorize request failed to fetch request_uri")
+		return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOIDCInvalidRequestURI, "failed to fetch request_uri")
+	}
+
+	req.Form.Set("request", request)
+	req.Form.Del("request_uri")
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/tracing"
+)
+
+// revokedTokenLeeway is added to the expiration of revoked tokens, so they
+// stay revoked until they are rejected as expired, also by instances with a
+// clock which is slightly behind.
+const revokedTokenLeeway = time.Minute
+
+// isTokenRevoked returns true if the token with the provided jti was revoked.
+// Tokens are never revoked if the accociated provider has no revocation
+// manager.
+func (p *Provider) isTokenRevoked(id string) (bool, error) {
+	if p.revocationManager == nil || id == "" {
+		return false, nil
+	}
+
+	revoked, err := p.revocationManager.IsRevoked(id)
+	if err != nil {
+		p.logger.WithError(err).WithField("jti", id).Errorln("failed to check token revocation")
+	}
+
+	return revoked, err
+}
+
+// revokeToken revokes the provided access or refresh token if it was issued
+// to the client with the provided client ID. The provided token type hint
+// selects the token type which is tried first. Invalid tokens and tokens of
+// other clients are ignored as specified at
+// https://tools.ietf.org/html/rfc7009#section-2.2.
+func (p *Provider) revokeToken(req *http.Request, clientID string, tokenString string, tokenTypeHint string) error {
+	_, span := tracing.Start(req.Context(), "revocation.revoke")
+	defer span.End()
+
+	accessTokenClaims := &konnect.AccessTokenClaims{}
+	refreshTokenClaims := &konnect.RefreshTokenClaims{}
+	candidates := []jwt.Claims{accessTokenClaims, refreshTokenClaims}
+	if tokenTypeHint == konnectoidc.TokenTypeHintRefreshToken {
+		candidates = []jwt.Claims{refreshTokenClaims, accessTokenClaims}
+	}
+
+	var claims jwt.Claims
+	for _, candidate := range candidates {
+		_, err := jwt.ParseWithClaims(tokenString, candidate, p.strictKeyfunc(req, "revocation_token", func(token *jwt.Token) (interface{}, error) {
+			// Validator for tokens to revoke, looks up key.
+			return p.validateJWT(token)
+		}))
+		if err == nil {
+			claims = candidate
+			break
+		}
+	}
+
+	logger := p.logger.WithField("client_id", clientID)
+
+	var err error
+	switch claims.(type) {
+	case *konnect.AccessTokenClaims:
+		if accessTokenClaims.ClientID() != clientID {
+			logger.Debugln("revocation request for access token of other client")
+			return nil
+		}
+		if p.revocationManager == nil {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2UnsupportedTokenType, "access tokens cannot be revoked")
+		}
+		err = p.revocationManager.Revoke(accessTokenClaims.Id, time.Unix(accessTokenClaims.ExpiresAt, 0).Add(revokedTokenLeeway))
+		logger = logger.WithFields(logrus.Fields{
+			"sub": accessTokenClaims.Subject,
+			"jti": accessTokenClaims.Id,
+		})
+
+	case *konnect.RefreshTokenClaims:
+		if refreshTokenClaims.Audience != clientID {
+			logger.Debugln("revocation request for refresh token of other client")
+			return nil
+		}
+		if p.revocationManager == nil && (refreshTokenClaims.Family == "" || p.refreshManager == nil) {
+			return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2UnsupportedTokenType, "refresh token cannot be revoked")
+		}
+		if refreshTokenClaims.Family != "" && p.refreshManager != nil {
+			p.refreshManager.Revoke(refreshTokenClaims.Family)
+		}
+		if p.revocationManager != nil {
+			err = p.revocationManager.Revoke(refreshTokenClaims.Id, time.Unix(refreshTokenClaims.ExpiresAt, 0).Add(revokedTokenLeeway))
+		}
+		logger = logger.WithFields(logrus.Fields{
+			"sub":    refreshTokenClaims.Subject,
+			"jti":    refreshTokenClaims.Id,
+			"family": refreshTokenClaims.Family,
+		})
+
+	default:
+		logger.Debugln("revocation request with invalid token")
+		return nil
+	}
+	span.SetError(err)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugln("revoked token")
+	return nil
+}
+
+// validateRefreshTokenNotRevoked returns an invalid_grant error if the refresh
+// token with the provided claims was revoked.
+func (p *Provider) validateRefreshTokenNotRevoked(claims *konnect.RefreshTokenClaims) error {
+	revoked, err := p.isTokenRevoked(claims.Id)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2InvalidGrant, "refresh token revoked")
+	}
+
+	return nil
+}
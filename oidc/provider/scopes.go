@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/identity/clients"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// isSupportedScope returns true if the provided scope is supported by the
+// accociated provider's identity or guest manager.
+func (p *Provider) isSupportedScope(scope string) bool {
+	if scope == oidc.ScopeOpenID {
+		return true
+	}
+	if utils.ContainsString(p.identityManager.ScopesSupported(nil), scope) {
+		return true
+	}
+	if p.guestManager != nil {
+		if scope == konnect.ScopeGuestOK || utils.ContainsString(p.guestManager.ScopesSupported(nil), scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyUnknownScopeBehavior handles the scopes of the provided scopes mapping
+// which are not supported according to the accociated provider's unknown
+// scope behavior. Unsupported scopes are either left as is, removed from the
+// provided mapping or result in an invalid_scope error.
+func (p *Provider) applyUnknownScopeBehavior(scopes map[string]bool) error {
+	if p.unknownScopeBehavior == UnknownScopeBehaviorPassthrough {
+		return nil
+	}
+
+	var unknown []string
+	for scope := range scopes {
+		if !p.isSupportedScope(scope) {
+			unknown = append(unknown, scope)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	if p.unknownScopeBehavior == UnknownScopeBehaviorError {
+		sort.Strings(unknown)
+		return konnectoidc.NewOAuth2Error(konnectoidc.ErrorCodeOAuth2InvalidScope, fmt.Sprintf("unknown scope: %s", strings.Join(unknown, " ")))
+	}
+
+	for _, scope := range unknown {
+		delete(scopes, scope)
+	}
+	p.logger.WithField("scopes", unknown).Debugln("ignored unknown scopes")
+
+	return nil
+}
+
+// claimsPlacementScopes are the scopes for which the placement of their
+// released claims can be configured.
+var claimsPlacementScopes = []string{oidc.ScopeProfile, oidc.ScopeEmail}
+
+// ValidateClaimsPlacement returns an error if the provided claims placement
+// mapping contains unsupported scopes or placements.
+func ValidateClaimsPlacement(claimsPlacement map[string]string) error {
+	for scope, placement := range claimsPlacement {
+		if !utils.ContainsString(claimsPlacementScopes, scope) {
+			return fmt.Errorf("unsupported claims placement scope: %v", scope)
+		}
+		switch placement {
+		case ClaimsPlacementIDToken, ClaimsPlacementUserInfo, ClaimsPlacementBoth:
+		default:
+			return fmt.Errorf("invalid claims placement for scope %v: %v", scope, placement)
+		}
+	}
+
+	return nil
+}
+
+// ValidateAccessTokenClaims returns an error if the provided mapping of scopes
+// to claims which are added to access tokens contains reserved claims.
+func ValidateAccessTokenClaims(accessTokenClaims map[string][]string) error {
+	for scope, claims := range accessTokenClaims {
+		for _, claim := range claims {
+			if clients.IsReservedAccessTokenClaim(claim) {
+				return fmt.Errorf("access token claims for scope %v must not contain reserved claim %v", scope, claim)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scopesAccessTokenClaims returns the names of the claims which are added to
+// access tokens for the provided authorized scopes.
+func (p *Provider) scopesAccessTokenClaims(authorizedScopes map[string]bool) []string {
+	if len(p.accessTokenClaims) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, scope := range makeArrayFromBoolMap(authorizedScopes) {
+		names = append(names, p.accessTokenClaims[scope]...)
+	}
+
+	return names
+}
+
+// scopeClaimsInIDToken returns true if the claims released for the provided
+// scope are included in ID tokens, with withAccessToken signaling if an access
+// token is issued together with the ID token. Claims without scope are selected
+// with the empty scope and always follow the accociated provider's claims in
+// ID token policy.
+func (p *Provider) scopeClaimsInIDToken(scope string, withAccessToken bool) bool {
+	switch p.claimsPlacement[scope] {
+	case ClaimsPlacementIDToken, ClaimsPlacementBoth:
+		return true
+	case ClaimsPlacementUserInfo:
+		return false
+	}
+
+	return !withAccessToken || p.claimsInIDToken == ClaimsInIDTokenFull
+}
+
+// scopeClaimsInUserInfo returns true if the claims released for the provided
+// scope are included in userinfo responses.
+func (p *Provider) scopeClaimsInUserInfo(scope string) bool {
+	return p.claimsPlacement[scope] != ClaimsPlacementIDToken
+}
+
+// clientCredentialsScopes returns the scopes granted with the client
+// credentials grant, which are the requested scopes limited to the provided
+// allowed scopes. If no scopes are requested, all allowed scopes are granted.
+func clientCredentialsScopes(requested map[string]bool, allowed []string) map[string]bool {
+	scopes := make(map[string]bool)
+	for _, scope := range allowed {
+		if len(requested) == 0 || requested[scope] {
+			scopes[scope] = true
+		}
+	}
+
+	return scopes
+}
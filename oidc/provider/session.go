@@ -19,11 +19,14 @@ package provider
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/gob"
 	"net/http"
+	"net/url"
 
 	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
 	"stash.kopano.io/kgol/rndm"
 
 	"stash.kopano.io/kc/konnect"
@@ -51,15 +54,18 @@ func (p *Provider) updateOrCreateSession(rw http.ResponseWriter, req *http.Reque
 	session := ar.Session
 	if session != nil && session.Version == sessionVersion && session.Sub == auth.Subject() {
 		// Existing session with same sub.
-		return session, nil
-	}
-
-	// Create new session.
-	session = &payload.Session{
-		Version:  sessionVersion,
-		ID:       rndm.GenerateRandomString(32),
-		Sub:      auth.Subject(),
-		Provider: auth.Manager().Name(),
+		if !p.addSessionFrontchannelClient(req.Context(), session, ar.ClientID) {
+			return session, nil
+		}
+	} else {
+		// Create new session.
+		session = &payload.Session{
+			Version:  sessionVersion,
+			ID:       rndm.GenerateRandomString(32),
+			Sub:      auth.Subject(),
+			Provider: auth.Manager().Name(),
+		}
+		p.addSessionFrontchannelClient(req.Context(), session, ar.ClientID)
 	}
 
 	serialized, err := p.serializeSession(session)
@@ -71,6 +77,74 @@ func (p *Provider) updateOrCreateSession(rw http.ResponseWriter, req *http.Reque
 	return session, err
 }
 
+// addSessionFrontchannelClient adds the provided client ID to the provided
+// session if the client is registered with a front-channel logout URI. Returns
+// true if the session was modified.
+func (p *Provider) addSessionFrontchannelClient(ctx context.Context, session *payload.Session, clientID string) bool {
+	registration, _ := p.clients.Get(ctx, clientID)
+	if registration == nil || registration.FrontchannelLogoutURI == "" {
+		return false
+	}
+	for _, id := range session.Clients {
+		if id == clientID {
+			return false
+		}
+	}
+	session.Clients = append(session.Clients, clientID)
+
+	return true
+}
+
+// getEndSessionSession returns the provided session or if nil, the session
+// identified by the sid of the provided request's id_token_hint, with the
+// client the id_token_hint was issued to. This allows front-channel logout
+// without session cookie, for example in embedded contexts. The returned
+// session must not be stored.
+func (p *Provider) getEndSessionSession(session *payload.Session, esr *payload.EndSessionRequest) *payload.Session {
+	if session != nil {
+		return session
+	}
+	sid := esr.SessionID()
+	if sid == "" {
+		return nil
+	}
+
+	return &payload.Session{
+		ID:      sid,
+		Clients: []string{esr.ClientID},
+	}
+}
+
+// getFrontchannelLogoutURIs returns the front-channel logout URIs of all the
+// clients of the provided session as specified at
+// https://openid.net/specs/openid-connect-frontchannel-1_0.html#OPLogout
+func (p *Provider) getFrontchannelLogoutURIs(ctx context.Context, session *payload.Session) []string {
+	if session == nil {
+		return nil
+	}
+
+	var uris []string
+	for _, clientID := range session.Clients {
+		registration, _ := p.clients.Get(ctx, clientID)
+		if registration == nil || registration.FrontchannelLogoutURI == "" {
+			continue
+		}
+		uri, err := url.Parse(registration.FrontchannelLogoutURI)
+		if err != nil {
+			continue
+		}
+		if registration.FrontchannelLogoutSessionRequired {
+			query := uri.Query()
+			query.Set(oidc.IssuerIdentifierClaim, p.issuerIdentifier)
+			query.Set("sid", session.ID)
+			uri.RawQuery = query.Encode()
+		}
+		uris = append(uris, uri.String())
+	}
+
+	return uris
+}
+
 func (p *Provider) serializeSession(session *payload.Session) (string, error) {
 	var b bytes.Buffer
 	enc := gob.NewEncoder(&b)
@@ -111,8 +185,8 @@ func (p *Provider) unserializeSession(value string) (*payload.Session, error) {
 	return &session, nil
 }
 
-func (p *Provider) getUserIDAndSessionRefFromClaims(claims *jwt.StandardClaims, identityClaims jwt.MapClaims) (string, *string) {
-	if claims == nil || identityClaims == nil {
+func (p *Provider) getUserIDAndSessionRefFromClaims(clientID string, identityClaims jwt.MapClaims) (string, *string) {
+	if identityClaims == nil {
 		return "", nil
 	}
 
@@ -128,5 +202,5 @@ func (p *Provider) getUserIDAndSessionRefFromClaims(claims *jwt.StandardClaims,
 	// NOTE(longsleep): Return the userID from claims and generate a session ref
 	// for it. Session refs use the userClaim if available and set by the
 	// underlaying backend.
-	return userIDClaim, identity.GetSessionRef(p.identityManager.Name(), claims.Audience, userClaim)
+	return userIDClaim, identity.GetSessionRef(p.identityManager.Name(), clientID, userClaim)
 }
@@ -19,13 +19,127 @@ package provider
 
 import (
 	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
 
 	"github.com/dgrijalva/jwt-go"
+	"stash.kopano.io/kgol/oidc-go"
+
+	"stash.kopano.io/kc/konnect/identity/clients"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/signing"
 )
 
+// jwtType is the typ header of all signed tokens except access tokens.
+const jwtType = AccessTokenTypeJWT
+
 // A SigningKey bundles a signer with meta data and a signign method.
 type SigningKey struct {
 	ID            string
 	PrivateKey    crypto.Signer
 	SigningMethod jwt.SigningMethod
+
+	// headers are the encoded JWT headers of tokens signed with the
+	// accociated key by typ, prepared once since they are the same for all
+	// tokens of a type.
+	headers map[string]string
+}
+
+// newSigningKey returns a SigningKey for the provided signer which signs with
+// the provided signing method.
+func newSigningKey(id string, key crypto.Signer, signingMethod jwt.SigningMethod) *SigningKey {
+	sk := &SigningKey{
+		ID:            id,
+		PrivateKey:    key,
+		SigningMethod: signing.SigningMethodForSigner(signingMethod, key),
+
+		headers: make(map[string]string),
+	}
+
+	// NOTE: Header fields are the same as set by jwt.NewWithClaims, so signed
+	// tokens of type JWT are unchanged.
+	for _, typ := range []string{jwtType, AccessTokenTypeATJWT} {
+		header, _ := json.Marshal(map[string]interface{}{
+			"typ":               typ,
+			oidc.JWTHeaderAlg:   sk.SigningMethod.Alg(),
+			oidc.JWTHeaderKeyID: id,
+		})
+		sk.headers[typ] = jwt.EncodeSegment(header)
+	}
+
+	return sk
+}
+
+// sign returns a JWT of the provided typ with the provided claims, signed
+// with the accociated signing key.
+func (sk *SigningKey) sign(typ string, claims jwt.Claims) (string, error) {
+	header, ok := sk.headers[typ]
+	if !ok {
+		return "", fmt.Errorf("unsupported token type: %v", typ)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingString := header + "." + jwt.EncodeSegment(claimsJSON)
+
+	signature, err := sk.SigningMethod.Sign(signingString, sk.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return signingString + "." + signature, nil
+}
+
+// prepareSigner precomputes the CRT values of RSA private keys which do not
+// have them yet, for example keys loaded from JWK without dp, dq and qi, since
+// signing without them is several times slower.
+func prepareSigner(key crypto.Signer) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok && rsaKey.Precomputed.Dp == nil {
+		rsaKey.Precompute()
+	}
+}
+
+// ValidateClientSigningAlgs returns an invalid_client_metadata error if the
+// provided client registration requests an ID token or userinfo signing alg
+// for which the accociated provider has no signing key. Clients without
+// requested alg are signed for with the default signing method.
+func (p *Provider) ValidateClientSigningAlgs(cr *clients.ClientRegistration) error {
+	for _, requested := range []struct {
+		name string
+		alg  string
+	}{
+		{"id_token_signed_response_alg", cr.RawIDTokenSignedResponseAlg},
+		{"userinfo_signed_response_alg", cr.RawUserInfoSignedResponseAlg},
+	} {
+		if requested.alg == "" {
+			continue
+		}
+		signingMethod := jwt.GetSigningMethod(requested.alg)
+		if signingMethod == nil {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, fmt.Sprintf("unknown %s", requested.name))
+		}
+		if _, ok := p.getSigningKey(signingMethod); !ok {
+			return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOIDCInvalidClientMetadata, fmt.Sprintf("%s %s is not supported", requested.name, requested.alg))
+		}
+	}
+
+	return nil
+}
+
+// defaultClientSigningAlg returns the ID token signing alg for dynamically
+// registered clients which request none. This is RS256 as specified at
+// https://openid.net/specs/openid-connect-registration-1_0.html#ClientMetadata
+// if the accociated provider has a key for it, and the alg of the default
+// signing method otherwise.
+func (p *Provider) defaultClientSigningAlg() string {
+	if _, ok := p.getSigningKey(jwt.SigningMethodRS256); ok {
+		return jwt.SigningMethodRS256.Alg()
+	}
+	if p.signingMethodDefault != nil {
+		return p.signingMethodDefault.Alg()
+	}
+
+	return ""
 }
@@ -18,10 +18,15 @@
 package provider
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 
+	"golang.org/x/crypto/blake2b"
+
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identity"
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 )
 
 // PublicSubjectFromAuth creates the provideds auth Subject value with the
@@ -41,3 +46,68 @@ func (p *Provider) PublicSubjectFromAuth(auth identity.AuthRecord) (string, erro
 
 	return auth.Subject(), nil
 }
+
+// SubjectFromAuth creates the provided auth Subject value for the provided
+// client ID with the accociated provider. For clients registered with pairwise
+// subject type, a pairwise subject is returned. Otherwise this is the same as
+// PublicSubjectFromAuth.
+func (p *Provider) SubjectFromAuth(ctx context.Context, auth identity.AuthRecord, clientID string) (string, error) {
+	publicSubject, err := p.PublicSubjectFromAuth(auth)
+	if err != nil {
+		return "", err
+	}
+	if ok, _ := auth.AuthorizedScopes()[konnect.ScopeRawSubject]; ok {
+		// Raw subject is always returned as is.
+		return publicSubject, nil
+	}
+
+	return p.subjectForClient(ctx, publicSubject, clientID)
+}
+
+// subjectForClient returns the provided public subject mapped for the client
+// with the provided client ID.
+func (p *Provider) subjectForClient(ctx context.Context, publicSubject string, clientID string) (string, error) {
+	registration, _ := p.clients.Get(ctx, clientID)
+	if registration == nil || !registration.UsesPairwiseSubject() {
+		return publicSubject, nil
+	}
+
+	return pairwiseSubject(publicSubject, registration.SectorIdentifier())
+}
+
+func pairwiseSubject(publicSubject string, sectorIdentifier string) (string, error) {
+	// Hash the public subject together with the sector identifier with a
+	// konnect specific salt for pairwise subjects.
+	hasher, err := blake2b.New512([]byte(konnectoidc.KonnectIDTokenPairwiseSubjectSaltV1))
+	if err != nil {
+		return "", err
+	}
+
+	hasher.Write([]byte(sectorIdentifier))
+	hasher.Write([]byte(" "))
+	hasher.Write([]byte(publicSubject))
+
+	// NOTE: Use the same URL safe encoding as for public subjects, so both
+	// are indistinguishable for clients.
+	s := base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+	return s + "@konnect", nil
+}
+
+// subjectMapper returns a function which maps public subjects to the subject
+// known by the client with the provided client ID. Returns nil if the client
+// uses public subjects.
+func (p *Provider) subjectMapper(ctx context.Context, clientID string) func(string) string {
+	registration, _ := p.clients.Get(ctx, clientID)
+	if registration == nil || !registration.UsesPairwiseSubject() {
+		return nil
+	}
+	sectorIdentifier := registration.SectorIdentifier()
+
+	return func(publicSubject string) string {
+		sub, err := pairwiseSubject(publicSubject, sectorIdentifier)
+		if err != nil {
+			return ""
+		}
+		return sub
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package provider
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Names of the server rendered pages which can be replaced by templates with
+// the same file name in the configured templates directory.
+const (
+	TemplateNameError              = "error.html"
+	TemplateNameFormPostResponse   = "form-post-response.html"
+	TemplateNameFrontchannelLogout = "frontchannel-logout.html"
+)
+
+// templateNames are the names of all server rendered pages which can be
+// replaced by templates.
+var templateNames = []string{
+	TemplateNameError,
+	TemplateNameFormPostResponse,
+	TemplateNameFrontchannelLogout,
+}
+
+// errorPageData is the data provided to error page templates.
+type errorPageData struct {
+	StatusCode       int
+	Status           string
+	Error            string
+	ErrorDescription string
+	ClientName       string
+	Nonce            string
+}
+
+// loadTemplates loads the templates found in the provided directory, which
+// replace the built-in templates of the server rendered page with the same
+// name. Pages without template in the directory use the built-in template.
+func loadTemplates(templatesPath string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if templatesPath == "" {
+		return templates, nil
+	}
+
+	for _, name := range templateNames {
+		fn := filepath.Join(templatesPath, name)
+		if _, err := os.Stat(fn); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to access template %v: %v", name, err)
+		}
+		t, err := template.New(name).ParseFiles(fn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %v: %v", name, err)
+		}
+		templates[name] = t
+	}
+
+	return templates, nil
+}
+
+// getTemplate returns the template for the server rendered page with the
+// provided name, which is the loaded template if any and the provided built-in
+// template otherwise. The returned bool is true if the template was loaded.
+func (p *Provider) getTemplate(name string, builtin *template.Template) (*template.Template, bool) {
+	if t, ok := p.templates[name]; ok {
+		return t, true
+	}
+
+	return builtin, false
+}
+
+// getTemplateContentSecurityPolicy returns the Content-Security-Policy header
+// value for server rendered pages, adding the provided directives to the
+// policy for scripts with the provided nonce. Loaded templates are also allowed
+// to use styles and images from the same origin and inline styles with the
+// nonce.
+func getTemplateContentSecurityPolicy(nonce string, loaded bool, directives string) string {
+	csp := fmt.Sprintf("default-src 'none'; script-src 'nonce-%s'", nonce)
+	if loaded {
+		csp += fmt.Sprintf("; style-src 'self' 'nonce-%s'; img-src 'self' data:", nonce)
+	}
+	if directives != "" {
+		csp += "; " + directives
+	}
+
+	return csp
+}
+
+// getClientName returns the registered name of the client with the provided
+// id for display in server rendered pages. Returns empty string for unknown
+// clients, so request values never end up in pages.
+func (p *Provider) getClientName(req *http.Request, clientID string) string {
+	if clientID == "" || p.clients == nil {
+		return ""
+	}
+
+	registration, ok := p.clients.Get(req.Context(), clientID)
+	if !ok || registration == nil {
+		return ""
+	}
+
+	return registration.Name
+}
@@ -20,30 +20,45 @@ package provider
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
 	"stash.kopano.io/kgol/oidc-go"
 	"stash.kopano.io/kgol/rndm"
 
 	"stash.kopano.io/kc/konnect"
 	"stash.kopano.io/kc/konnect/identity"
+	"stash.kopano.io/kc/konnect/identity/clients"
 	konnectoidc "stash.kopano.io/kc/konnect/oidc"
 	"stash.kopano.io/kc/konnect/oidc/payload"
+	"stash.kopano.io/kc/konnect/signing"
 	"stash.kopano.io/kc/konnect/utils"
 )
 
 // MakeAccessToken implements the oidc.AccessTokenProvider interface.
 func (p *Provider) MakeAccessToken(ctx context.Context, audience string, auth identity.AuthRecord) (string, error) {
-	return p.makeAccessToken(ctx, audience, auth, nil)
+	return p.makeAccessToken(ctx, audience, auth, nil, nil, nil)
 }
 
-func (p *Provider) makeAccessToken(ctx context.Context, audience string, auth identity.AuthRecord, signingMethod jwt.SigningMethod) (string, error) {
+func (p *Provider) makeAccessToken(ctx context.Context, audience string, auth identity.AuthRecord, signingMethod jwt.SigningMethod, confirmation *konnect.ConfirmationClaims, binding *konnect.TokenBindingClaims) (string, error) {
 	sk, ok := p.getSigningKey(signingMethod)
 	if !ok {
 		return "", fmt.Errorf("no signing key")
 	}
 
+	accessTokenClaims := p.makeAccessTokenClaims(ctx, audience, auth, confirmation)
+	accessTokenClaims.Binding = binding
+
+	return signedString(ctx, sk, p.accessTokenType, accessTokenClaims)
+}
+
+// makeAccessTokenClaims returns the claims of access tokens issued to the
+// provided audience for the provided auth.
+func (p *Provider) makeAccessTokenClaims(ctx context.Context, audience string, auth identity.AuthRecord, confirmation *konnect.ConfirmationClaims) konnect.AccessTokenClaims {
 	authorizedScopes := auth.AuthorizedScopes()
 	authorizedScopesList := makeArrayFromBoolMap(authorizedScopes)
 
@@ -59,6 +74,7 @@ func (p *Provider) makeAccessToken(ctx context.Context, audience string, auth id
 			IssuedAt:  time.Now().Unix(),
 			Id:        rndm.GenerateRandomString(24),
 		},
+		Confirmation: confirmation,
 	}
 
 	user := auth.User()
@@ -69,23 +85,117 @@ func (p *Provider) makeAccessToken(ctx context.Context, audience string, auth id
 		accessTokenClaims.IdentityProvider = auth.Manager().Name()
 	}
 
-	accessToken := jwt.NewWithClaims(sk.SigningMethod, accessTokenClaims)
-	accessToken.Header[oidc.JWTHeaderKeyID] = sk.ID
+	extraClaimNames := p.scopesAccessTokenClaims(authorizedScopes)
+	if registration, _ := p.clients.Get(ctx, audience); registration != nil {
+		if registration.AccessTokenAudience != "" && registration.AccessTokenAudience != audience {
+			accessTokenClaims.Audience = registration.AccessTokenAudience
+		}
+		if len(registration.AdditionalAudiences) > 0 {
+			accessTokenClaims.AudienceList = uniqueStrings(append([]string{accessTokenClaims.Audience}, registration.AdditionalAudiences...))
+		}
+		extraClaimNames = append(extraClaimNames, registration.AccessTokenClaims...)
+	}
+	if len(extraClaimNames) > 0 && user != nil {
+		accessTokenClaims.ExtraClaims = getAccessTokenExtraClaims(user, authorizedScopes, uniqueStrings(extraClaimNames))
+	}
+	if staticClaims := p.clients.StaticClaims(ctx, audience, auth.Subject()); staticClaims != nil {
+		// NOTE: Claims of the user take precedence over static claims.
+		if accessTokenClaims.ExtraClaims == nil {
+			accessTokenClaims.ExtraClaims = make(map[string]interface{})
+		}
+		for claim, value := range staticClaims {
+			if _, exists := accessTokenClaims.ExtraClaims[claim]; !exists {
+				accessTokenClaims.ExtraClaims[claim] = value
+			}
+		}
+	}
+	if accessTokenClaims.Audience != audience || len(accessTokenClaims.AudienceList) > 1 {
+		// NOTE: Keep the client ID as authorized party, so it is still
+		// known whom the access token was issued to.
+		accessTokenClaims.AuthorizedParty = audience
+	}
 
-	return accessToken.SignedString(sk.PrivateKey)
+	return accessTokenClaims
 }
 
 func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRequest, auth identity.AuthRecord, session *payload.Session, accessTokenString string, codeString string, signingMethod jwt.SigningMethod) (string, error) {
 	sk, ok := p.getSigningKey(signingMethod)
 	if !ok {
+		if signingMethod != nil {
+			return "", fmt.Errorf("no signing key for alg %v", signingMethod.Alg())
+		}
 		return "", fmt.Errorf("no signing key")
 	}
 
-	publicSubject, err := p.PublicSubjectFromAuth(auth)
+	withAccessToken := accessTokenString != ""
+	var requestedClaims *payload.ClaimsRequestMap
+	if authorizedClaimsRequest := auth.AuthorizedClaims(); authorizedClaimsRequest != nil {
+		requestedClaims = authorizedClaimsRequest.IDToken
+	}
+	idTokenClaims, auth, err := p.makeIDTokenClaims(ctx, ar, auth, session, withAccessToken)
 	if err != nil {
 		return "", err
 	}
 
+	if withAccessToken {
+		// Add left-most hash of access token.
+		// http://openid.net/specs/openid-connect-core-1_0.html#ImplicitIDToken
+		hash, hashErr := oidc.HashFromSigningMethod(sk.SigningMethod.Alg())
+		if hashErr != nil {
+			return "", hashErr
+		}
+
+		idTokenClaims.AccessTokenHash = oidc.LeftmostHash([]byte(accessTokenString), hash).String()
+	}
+	if codeString != "" {
+		// Add left-most hash of code.
+		// http://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+		hash, hashErr := oidc.HashFromSigningMethod(sk.SigningMethod.Alg())
+		if hashErr != nil {
+			return "", hashErr
+		}
+
+		idTokenClaims.CodeHash = oidc.LeftmostHash([]byte(codeString), hash).String()
+	}
+
+	finalIDTokenClaims, err := finalizeIDTokenClaims(idTokenClaims, auth, p.scopeClaimsInIDToken("", withAccessToken), requestedClaims)
+	if err != nil {
+		return "", err
+	}
+	finalIDTokenClaims, err = p.addStaticClaims(ctx, finalIDTokenClaims, ar.ClientID, auth.Subject())
+	if err != nil {
+		return "", err
+	}
+	if requestedClaims != nil {
+		finalIDTokenClaimsMap, mapErr := payload.ToMap(finalIDTokenClaims)
+		if mapErr != nil {
+			return "", mapErr
+		}
+		if err = checkEssentialClaims(requestedClaims, finalIDTokenClaimsMap); err != nil {
+			return "", err
+		}
+	}
+
+	// Create signed token.
+	idTokenString, err := signedString(ctx, sk, jwtType, finalIDTokenClaims)
+	if err != nil {
+		return "", err
+	}
+
+	return p.encryptIDToken(ctx, ar.ClientID, idTokenString)
+}
+
+// makeIDTokenClaims returns the claims of ID tokens issued for the provided
+// authentication request and auth, without hashes of access token and code.
+// If the provided auth was fetched again from its identity manager to include
+// requested user data, the fresh auth is returned instead of the provided
+// auth.
+func (p *Provider) makeIDTokenClaims(ctx context.Context, ar *payload.AuthenticationRequest, auth identity.AuthRecord, session *payload.Session, withAccessToken bool) (*konnectoidc.IDTokenClaims, identity.AuthRecord, error) {
+	publicSubject, err := p.SubjectFromAuth(ctx, auth, ar.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	idTokenClaims := &konnectoidc.IDTokenClaims{
 		Nonce: ar.Nonce,
 		StandardClaims: jwt.StandardClaims{
@@ -94,9 +204,20 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 			Audience:  ar.ClientID,
 			ExpiresAt: time.Now().Add(p.idTokenDuration).Unix(),
 			IssuedAt:  time.Now().Unix(),
+			Id:        rndm.GenerateRandomString(24),
 		},
 	}
 
+	if registration, _ := p.clients.Get(ctx, ar.ClientID); registration != nil && len(registration.AdditionalAudiences) > 0 {
+		idTokenClaims.AudienceList = uniqueStrings(append([]string{ar.ClientID}, registration.AdditionalAudiences...))
+		if len(idTokenClaims.AudienceList) > 1 {
+			// ID tokens with multiple audiences must identify the client as
+			// authorized party as specified at
+			// https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+			idTokenClaims.AuthorizedParty = ar.ClientID
+		}
+	}
+
 	if session != nil {
 		// Include session data in ID token.
 		idTokenClaims.SessionClaims = &konnectoidc.SessionClaims{
@@ -105,11 +226,13 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 	}
 
 	// Include requested scope data in ID token when no access token is
-	// generated.
+	// generated, or as configured by the claims in ID token policy and claims
+	// placement.
 	authorizedClaimsRequest := auth.AuthorizedClaims()
+	withProfileClaims := ar.Scopes[oidc.ScopeProfile] && p.scopeClaimsInIDToken(oidc.ScopeProfile, withAccessToken)
+	withEmailClaims := ar.Scopes[oidc.ScopeEmail] && p.scopeClaimsInIDToken(oidc.ScopeEmail, withAccessToken)
+	withExtraClaims := p.scopeClaimsInIDToken("", withAccessToken)
 
-	withAccessToken := accessTokenString != ""
-	withCode := codeString != ""
 	withAuthTime := ar.MaxAge > 0
 	withIDTokenClaimsRequest := authorizedClaimsRequest != nil && authorizedClaimsRequest.IDToken != nil
 
@@ -121,10 +244,10 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 		}
 	}
 
-	if !withAccessToken || withIDTokenClaimsRequest {
+	if withProfileClaims || withEmailClaims || withExtraClaims || withIDTokenClaimsRequest {
 		user := auth.User()
 		if user == nil {
-			return "", fmt.Errorf("no user")
+			return nil, nil, fmt.Errorf("no user")
 		}
 
 		var userID string
@@ -135,7 +258,7 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 			}
 		}
 		if userID == "" {
-			return "", fmt.Errorf("no id claim in user identity claims")
+			return nil, nil, fmt.Errorf("no id claim in user identity claims")
 		}
 
 		var sessionRef *string
@@ -150,44 +273,24 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 			requestedScopesMap = authorizedClaimsRequest.IDToken.ScopesMap(nil)
 		}
 
-		freshAuth, found, fetchErr := auth.Manager().Fetch(ctx, userID, sessionRef, auth.AuthorizedScopes(), requestedClaimsMap)
+		freshAuth, found, fetchErr := auth.Manager().Fetch(identity.NewClientIDContext(ctx, ar.ClientID), userID, sessionRef, auth.AuthorizedScopes(), requestedClaimsMap)
 		if fetchErr != nil {
 			p.logger.WithFields(utils.ErrorAsFields(fetchErr)).Errorln("identity manager fetch failed")
 			found = false
 		}
 		if !found {
-			return "", fmt.Errorf("user not found")
+			return nil, nil, fmt.Errorf("user not found")
 		}
 
-		if (!withAccessToken && ar.Scopes[oidc.ScopeProfile]) || requestedScopesMap[oidc.ScopeProfile] {
+		if withProfileClaims || requestedScopesMap[oidc.ScopeProfile] {
 			idTokenClaims.ProfileClaims = konnectoidc.NewProfileClaims(freshAuth.Claims(oidc.ScopeProfile)[0])
 		}
-		if (!withAccessToken && ar.Scopes[oidc.ScopeEmail]) || requestedScopesMap[oidc.ScopeEmail] {
+		if withEmailClaims || requestedScopesMap[oidc.ScopeEmail] {
 			idTokenClaims.EmailClaims = konnectoidc.NewEmailClaims(freshAuth.Claims(oidc.ScopeEmail)[0])
 		}
 
 		auth = freshAuth
 	}
-	if withAccessToken {
-		// Add left-most hash of access token.
-		// http://openid.net/specs/openid-connect-core-1_0.html#ImplicitIDToken
-		hash, hashErr := oidc.HashFromSigningMethod(sk.SigningMethod.Alg())
-		if hashErr != nil {
-			return "", hashErr
-		}
-
-		idTokenClaims.AccessTokenHash = oidc.LeftmostHash([]byte(accessTokenString), hash).String()
-	}
-	if withCode {
-		// Add left-most hash of code.
-		// http://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
-		hash, hashErr := oidc.HashFromSigningMethod(sk.SigningMethod.Alg())
-		if hashErr != nil {
-			return "", hashErr
-		}
-
-		idTokenClaims.CodeHash = oidc.LeftmostHash([]byte(codeString), hash).String()
-	}
 	if withAuthTime {
 		// Add AuthTime.
 		if loggedOn, logonAt := auth.LoggedOn(); loggedOn {
@@ -197,15 +300,27 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 			idTokenClaims.AuthTime = time.Now().Unix()
 		}
 	}
+	// Add the authentication context class reference which was satisfied and
+	// the authentication methods which were used, if known.
+	idTokenClaims.ACR = auth.ACR()
+	idTokenClaims.AMR = auth.AMR()
+
+	return idTokenClaims, auth, nil
+}
 
+// finalizeIDTokenClaims returns the provided ID token claims extended with
+// the extra non-standard claims of the provided auth if withExtraClaims is
+// true. Otherwise only the extra claims which are contained in the provided
+// requested claims are added.
+func finalizeIDTokenClaims(idTokenClaims *konnectoidc.IDTokenClaims, auth identity.AuthRecord, withExtraClaims bool, requestedClaims *payload.ClaimsRequestMap) (jwt.Claims, error) {
 	// Support extra non-standard claims in ID token.
 	var finalIDTokenClaims jwt.Claims = idTokenClaims
-	if !withAccessToken {
+	if withExtraClaims || requestedClaims != nil {
 		// Include requested scope data in ID token when no access token is
 		// generated - additional custom user specific claims.
 		idTokenClaimsMap, err := payload.ToMap(idTokenClaims)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		// Inject extra claims.
@@ -213,6 +328,13 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 		if extraClaims != nil {
 			if extraClaimsMap, ok := extraClaims.(jwt.MapClaims); ok {
 				for claim, value := range extraClaimsMap {
+					if !withExtraClaims {
+						// Only release what was requested for the ID token,
+						// everything else is available via userinfo.
+						if _, requested := requestedClaims.Get(claim); !requested {
+							continue
+						}
+					}
 					idTokenClaimsMap[claim] = value
 				}
 			}
@@ -221,14 +343,68 @@ func (p *Provider) makeIDToken(ctx context.Context, ar *payload.AuthenticationRe
 		finalIDTokenClaims = jwt.MapClaims(idTokenClaimsMap)
 	}
 
-	// Create signed token.
-	idToken := jwt.NewWithClaims(sk.SigningMethod, finalIDTokenClaims)
-	idToken.Header[oidc.JWTHeaderKeyID] = sk.ID
+	return finalIDTokenClaims, nil
+}
+
+// addStaticClaims returns the provided claims extended with the static claims
+// of the client with the provided client ID and the provided subject. Claims
+// which are already set are never replaced.
+func (p *Provider) addStaticClaims(ctx context.Context, claims jwt.Claims, clientID string, subject string) (jwt.Claims, error) {
+	staticClaims := p.clients.StaticClaims(ctx, clientID, subject)
+	if staticClaims == nil {
+		return claims, nil
+	}
+
+	claimsMap, err := payload.ToMap(claims)
+	if err != nil {
+		return nil, err
+	}
+	for claim, value := range staticClaims {
+		if _, exists := claimsMap[claim]; !exists {
+			claimsMap[claim] = value
+		}
+	}
 
-	return idToken.SignedString(sk.PrivateKey)
+	return jwt.MapClaims(claimsMap), nil
 }
 
-func (p *Provider) makeRefreshToken(ctx context.Context, audience string, auth identity.AuthRecord, signingMethod jwt.SigningMethod) (string, error) {
+// encryptIDToken returns the provided signed ID token as nested JWT encrypted
+// to the client with the provided client ID, if that client registered for
+// encrypted ID tokens as specified at
+// https://openid.net/specs/openid-connect-core-1_0.html#Encryption. Otherwise
+// the signed ID token is returned unchanged.
+func (p *Provider) encryptIDToken(ctx context.Context, clientID string, idTokenString string) (string, error) {
+	registration, _ := p.clients.Get(ctx, clientID)
+	if registration == nil {
+		return idTokenString, nil
+	}
+	alg, enc, ok := registration.IDTokenEncryption()
+	if !ok {
+		return idTokenString, nil
+	}
+
+	key, err := p.clients.EncryptionKey(ctx, registration, alg)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client encryption key: %v", err)
+	}
+
+	encrypter, err := jose.NewEncrypter(enc, jose.Recipient{
+		Algorithm: alg,
+		Key:       key.Key,
+		KeyID:     key.KeyID,
+	}, (&jose.EncrypterOptions{}).WithContentType("JWT"))
+	if err != nil {
+		return "", fmt.Errorf("failed to create id token encrypter: %v", err)
+	}
+	encrypted, err := encrypter.Encrypt([]byte(idTokenString))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt id token: %v", err)
+	}
+
+	return encrypted.CompactSerialize()
+}
+
+func (p *Provider) makeRefreshToken(ctx context.Context, audience string, auth identity.AuthRecord, session *payload.Session, signingMethod jwt.SigningMethod, family string, id string, binding *konnect.TokenBindingClaims) (string, error) {
 	sk, ok := p.getSigningKey(signingMethod)
 	if !ok {
 		return "", fmt.Errorf("no signing key")
@@ -253,15 +429,23 @@ func (p *Provider) makeRefreshToken(ctx context.Context, audience string, auth i
 		ApprovedScopesList:    approvedScopesList,
 		ApprovedClaimsRequest: auth.AuthorizedClaims(),
 		Ref:                   ref,
+		Family:                family,
+		Binding:               binding,
 		StandardClaims: jwt.StandardClaims{
 			Issuer:    p.issuerIdentifier,
 			Subject:   auth.Subject(),
 			Audience:  audience,
 			ExpiresAt: time.Now().Add(p.refreshTokenDuration).Unix(),
 			IssuedAt:  time.Now().Unix(),
-			Id:        rndm.GenerateRandomString(24),
+			Id:        id,
 		},
 	}
+	if refreshTokenClaims.Id == "" {
+		refreshTokenClaims.Id = rndm.GenerateRandomString(24)
+	}
+	if session != nil {
+		refreshTokenClaims.SessionID = session.ID
+	}
 
 	user := auth.User()
 	if user != nil {
@@ -271,10 +455,7 @@ func (p *Provider) makeRefreshToken(ctx context.Context, audience string, auth i
 		refreshTokenClaims.IdentityProvider = auth.Manager().Name()
 	}
 
-	refreshToken := jwt.NewWithClaims(sk.SigningMethod, refreshTokenClaims)
-	refreshToken.Header[oidc.JWTHeaderKeyID] = sk.ID
-
-	return refreshToken.SignedString(sk.PrivateKey)
+	return signedString(ctx, sk, jwtType, refreshTokenClaims)
 }
 
 func (p *Provider) makeJWT(ctx context.Context, signingMethod jwt.SigningMethod, claims jwt.Claims) (string, error) {
@@ -283,10 +464,7 @@ func (p *Provider) makeJWT(ctx context.Context, signingMethod jwt.SigningMethod,
 		return "", fmt.Errorf("no signing key")
 	}
 
-	token := jwt.NewWithClaims(sk.SigningMethod, claims)
-	token.Header[oidc.JWTHeaderKeyID] = sk.ID
-
-	return token.SignedString(sk.PrivateKey)
+	return signedString(ctx, sk, jwtType, claims)
 }
 
 func (p *Provider) validateJWT(token *jwt.Token) (interface{}, error) {
@@ -317,5 +495,200 @@ func (p *Provider) validateJWT(token *jwt.Token) (interface{}, error) {
 	if !ok {
 		return nil, fmt.Errorf("Unknown kid")
 	}
+	if iss, ok := issuerFromClaims(token.Claims); ok && !p.isAcceptedIssuer(iss) {
+		return nil, fmt.Errorf("Unexpected iss value")
+	}
 	return key, nil
 }
+
+// strictKeyfunc returns the provided keyfunc wrapped with
+// signing.StrictKeyfunc to pin the alg of tokens to the type of their key.
+// Rejected tokens are logged and audited together with the provided kind and
+// request, which can be nil when there is no request.
+func (p *Provider) strictKeyfunc(req *http.Request, kind string, keyfunc jwt.Keyfunc) jwt.Keyfunc {
+	return signing.StrictKeyfunc(keyfunc, func(token *jwt.Token, err error) {
+		p.logger.WithError(err).WithFields(logrus.Fields{
+			"kind": kind,
+			"alg":  token.Header[oidc.JWTHeaderAlg],
+			"kid":  token.Header[oidc.JWTHeaderKeyID],
+		}).Warnln("audit: rejected jwt with disallowed alg or header")
+		p.auditTokenRejected(req, kind, auditReasonDisallowedAlg)
+	})
+}
+
+// isAcceptedIssuer returns true if the provided issuer identifier is either
+// the accociated provider's issuer identifier or one of its additional issuer
+// identifiers.
+func (p *Provider) isAcceptedIssuer(iss string) bool {
+	if iss == p.issuerIdentifier {
+		return true
+	}
+	for _, additional := range p.additionalIssuerIdentifiers {
+		if iss == additional {
+			return true
+		}
+	}
+
+	return false
+}
+
+// issuerFromClaims returns the iss claim value of the provided claims for all
+// token types which are issued by the provider.
+func issuerFromClaims(claims jwt.Claims) (string, bool) {
+	switch c := claims.(type) {
+	case *konnect.AccessTokenClaims:
+		return c.Issuer, true
+	case *konnect.RefreshTokenClaims:
+		return c.Issuer, true
+	case *konnectoidc.IDTokenClaims:
+		return c.Issuer, true
+	}
+
+	return "", false
+}
+
+// getAccessTokenExtraClaims returns the values of the provided claim names as
+// found in the claims of the provided user. Scoped claims take precedence.
+// Reserved access token claims are never returned.
+func getAccessTokenExtraClaims(user identity.PublicUser, authorizedScopes map[string]bool, names []string) map[string]interface{} {
+	var sources []jwt.MapClaims
+	if userWithScopedClaims, ok := user.(identity.UserWithScopedClaims); ok {
+		if scopedClaims := userWithScopedClaims.ScopedClaims(authorizedScopes); scopedClaims != nil {
+			sources = append(sources, scopedClaims)
+		}
+	}
+	if userWithClaims, ok := user.(identity.UserWithClaims); ok {
+		if claims := userWithClaims.Claims(); claims != nil {
+			sources = append(sources, claims)
+		}
+	}
+
+	extraClaims := make(map[string]interface{})
+	for _, name := range names {
+		if clients.IsReservedAccessTokenClaim(name) {
+			continue
+		}
+		for _, source := range sources {
+			if value, ok := source[name]; ok {
+				extraClaims[name] = value
+				break
+			}
+		}
+	}
+
+	return extraClaims
+}
+
+// checkEssentialClaims returns an access denied error if any of the claims
+// requested as essential by the provided requested claims is not contained
+// in the provided claims.
+func checkEssentialClaims(requestedClaims *payload.ClaimsRequestMap, claims map[string]interface{}) error {
+	if requestedClaims == nil {
+		return nil
+	}
+	if missing := requestedClaims.MissingEssential(claims); len(missing) > 0 {
+		return konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2AccessDenied, fmt.Sprintf("essential claims not available: %s", strings.Join(missing, " ")))
+	}
+
+	return nil
+}
+
+// makeUserInfoClaims returns the claims of userinfo responses to the client
+// with the provided client ID for the provided auth.
+func (p *Provider) makeUserInfoClaims(ctx context.Context, auth identity.AuthRecord, clientID string, requestedClaims *payload.ClaimsRequestMap) (map[string]interface{}, error) {
+	publicSubject, err := p.SubjectFromAuth(ctx, auth, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &konnect.UserInfoResponse{
+		UserInfoResponse: &payload.UserInfoResponse{
+			UserInfoClaims: konnectoidc.UserInfoClaims{
+				Subject: publicSubject,
+			},
+			ProfileClaims: konnectoidc.NewProfileClaims(auth.Claims(oidc.ScopeProfile)[0]),
+			EmailClaims:   konnectoidc.NewEmailClaims(auth.Claims(oidc.ScopeEmail)[0]),
+		},
+	}
+
+	// Helper to receive user from auth, but only once.
+	withUser := func() func() identity.User {
+		var u identity.User
+		var fetched bool
+		return func() identity.User {
+			if !fetched {
+				fetched = true
+				u = auth.User()
+			}
+			return u
+		}
+	}()
+	authorizedScopes := auth.AuthorizedScopes()
+	var user identity.User
+
+	// Include additional Konnect specific claims when corresponding scopes are authorized.
+	if ok, _ := authorizedScopes[konnect.ScopeID]; ok {
+		user = withUser()
+		if userWithID, ok := user.(identity.UserWithID); ok {
+			claims := &konnect.IDClaims{
+				KCID: userWithID.ID(),
+			}
+			if userWithUsername, ok := user.(identity.UserWithUsername); ok {
+				claims.KCIDUsername = userWithUsername.Username()
+			}
+			if claims.KCIDUsername == "" {
+				claims.KCIDUsername = user.Subject()
+			}
+
+			response.IDClaims = claims
+		}
+	}
+	if ok, _ := authorizedScopes[konnect.ScopeUniqueUserID]; ok {
+		user = withUser()
+		if userWithUniqueID, ok := user.(identity.UserWithUniqueID); ok {
+			claims := &konnect.UniqueUserIDClaims{
+				KCUniqueUserID: userWithUniqueID.UniqueID(),
+			}
+
+			response.UniqueUserIDClaims = claims
+		}
+	}
+
+	// Create a map so additional user specific claims can be added.
+	responseAsMap, err := payload.ToMap(response)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inject extra claims.
+	extraClaims := auth.Claims("")[0]
+	if extraClaims != nil {
+		if extraClaimsMap, ok := extraClaims.(jwt.MapClaims); ok {
+			for claim, value := range extraClaimsMap {
+				responseAsMap[claim] = value
+			}
+		}
+	}
+
+	// Remove the claims of scopes which are placed into ID tokens only, unless
+	// they were requested for userinfo.
+	for _, scope := range claimsPlacementScopes {
+		if p.scopeClaimsInUserInfo(scope) {
+			continue
+		}
+		scopeClaimsMap, mapErr := payload.ToMap(auth.Claims(scope)[0])
+		if mapErr != nil {
+			return nil, mapErr
+		}
+		for claim := range scopeClaimsMap {
+			if requestedClaims != nil {
+				if _, requested := requestedClaims.Get(claim); requested {
+					continue
+				}
+			}
+			delete(responseAsMap, claim)
+		}
+	}
+
+	return responseAsMap, nil
+}
@@ -18,10 +18,13 @@
 package provider
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/url"
 	"time"
+
+	"stash.kopano.io/kc/konnect/utils"
 )
 
 var (
@@ -66,6 +69,18 @@ func getRequestURL(req *http.Request, isTrustedSource bool) *url.URL {
 	return u
 }
 
+func (p *Provider) getClientCertificate(req *http.Request) (*x509.Certificate, error) {
+	header := p.Config.Config.ClientCertificateHeader
+	if header != "" {
+		// Only accept forwarded client certificates from trusted proxies.
+		if trusted, _ := utils.IsRequestFromTrustedSource(req, p.Config.Config.TrustedProxyIPs, p.Config.Config.TrustedProxyNets); !trusted {
+			header = ""
+		}
+	}
+
+	return utils.ClientCertificateFromRequest(req, header)
+}
+
 func addResponseHeaders(header http.Header) {
 	header.Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	header.Set("Pragma", "no-cache")
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// WebFingerPath is the path of the WebFinger endpoint as specified at
+// https://tools.ietf.org/html/rfc7033#section-10.1.
+const WebFingerPath = "/.well-known/webfinger"
+
+// WebFingerHandler is a http handler which serves the WebFinger endpoint for
+// OpenID Connect issuer discovery as specified at
+// https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.
+type WebFingerHandler struct {
+	issuerIdentifier string
+	resources        []string
+
+	logger logrus.FieldLogger
+}
+
+// WebFingerLink is a link of a JSON Resource Descriptor as specified at
+// https://tools.ietf.org/html/rfc7033#section-4.4.4.
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// WebFingerResponse is a JSON Resource Descriptor as specified at
+// https://tools.ietf.org/html/rfc7033#section-4.4.
+type WebFingerResponse struct {
+	Subject string           `json:"subject"`
+	Links   []*WebFingerLink `json:"links"`
+}
+
+// NewWebFingerHandler creates a new WebFingerHandler which answers with the
+// provided issuer identifier for resources matching any of the provided
+// patterns. Patterns use the syntax of path.Match, for example
+// acct:*@example.com.
+func NewWebFingerHandler(issuerIdentifier string, resources []string, logger logrus.FieldLogger) (*WebFingerHandler, error) {
+	for _, resource := range resources {
+		if _, err := path.Match(resource, ""); err != nil {
+			return nil, fmt.Errorf("invalid webfinger resource pattern %v: %v", resource, err)
+		}
+	}
+
+	return &WebFingerHandler{
+		issuerIdentifier: issuerIdentifier,
+		resources:        resources,
+
+		logger: logger,
+	}, nil
+}
+
+// AddRoutes add the accociated WebFingerHandler's URL routes to the provided
+// router with the provided context.Context.
+func (h *WebFingerHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(WebFingerPath, h).Methods(http.MethodGet)
+}
+
+// matchResource returns true if the provided resource matches any of the
+// resource patterns of the accociated WebFingerHandler.
+func (h *WebFingerHandler) matchResource(resource string) bool {
+	for _, pattern := range h.resources {
+		if ok, _ := path.Match(pattern, resource); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *WebFingerHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// WebFinger resources are public, https://tools.ietf.org/html/rfc7033#section-5
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := req.URL.Query()
+	resource := query.Get("resource")
+	if resource == "" {
+		http.Error(rw, "missing resource parameter", http.StatusBadRequest)
+		return
+	}
+	if !h.matchResource(resource) {
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	response := &WebFingerResponse{
+		Subject: resource,
+		Links:   []*WebFingerLink{},
+	}
+	// Links are filtered by the requested rel values if any, https://tools.ietf.org/html/rfc7033#section-4.3
+	rels := query["rel"]
+	if len(rels) == 0 || utils.ContainsString(rels, konnectoidc.WebFingerIssuerRel) {
+		response.Links = append(response.Links, &WebFingerLink{
+			Rel:  konnectoidc.WebFingerIssuerRel,
+			Href: h.issuerIdentifier,
+		})
+	}
+
+	err := utils.WriteJSON(rw, http.StatusOK, response, "application/jrd+json")
+	if err != nil {
+		h.logger.WithError(err).Errorln("webfinger request failed writing response")
+	}
+}
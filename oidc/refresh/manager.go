@@ -0,0 +1,43 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package refresh
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned by refresh token family managers.
+var (
+	ErrUnknownFamily = errors.New("unknown refresh token family")
+	ErrReused        = errors.New("refresh token reused")
+)
+
+// Manager is a interface defining a refresh token family manager. A family
+// tracks the lineage of rotated refresh tokens, only the most recent token of
+// a family is valid. Rotate returns the id of the successor of the rotated
+// token, which is not the provided next id when the previous token of the
+// family is rotated again within the reuse grace window of the manager.
+// Consume marks a token which has no family as used, returning ErrReused if
+// it was used before.
+type Manager interface {
+	Create(id string, expiresAt time.Time) (string, error)
+	Rotate(family string, id string, next string, expiresAt time.Time) (string, error)
+	Consume(id string, expiresAt time.Time) error
+	Revoke(family string)
+}
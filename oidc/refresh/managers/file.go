@@ -0,0 +1,296 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+)
+
+// Durations used by file managers to lock records.
+const (
+	fileLockTimeout = 5 * time.Second
+	fileLockStale   = time.Minute
+)
+
+// fileManager provides the api for refresh token families kept as files in a
+// folder, so they survive restarts. Records are locked with lock files while
+// they are changed, thus the folder can be shared between multiple instances.
+type fileManager struct {
+	path       string
+	reuseGrace time.Duration
+}
+
+type fileRecord struct {
+	Current   string `json:"cur,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+
+	Previous  string `json:"prev,omitempty"`
+	RotatedAt int64  `json:"rotated,omitempty"`
+
+	Consumed bool `json:"consumed,omitempty"`
+}
+
+// NewFileManager creates a new refresh token family manager which keeps
+// families as files in the folder at the provided path, creating the folder
+// if it does not exist. Files of expired families are removed periodically
+// until the provided context is done. The provided reuse grace duration is
+// used like with NewMemoryMapManager.
+func NewFileManager(ctx context.Context, path string, reuseGrace time.Duration) (refresh.Manager, error) {
+	if path == "" {
+		return nil, fmt.Errorf("refresh token store path is empty")
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create refresh token store folder: %v", err)
+	}
+
+	rm := &fileManager{
+		path:       path,
+		reuseGrace: reuseGrace,
+	}
+
+	// Cleanup function.
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rm.purgeExpired()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rm, nil
+}
+
+// filename returns the file name of the provided key. The key is hashed, so
+// it is safe to be used as file name.
+func (rm *fileManager) filename(key string) string {
+	h := sha256.Sum256([]byte(key))
+
+	return filepath.Join(rm.path, hex.EncodeToString(h[:])+".json")
+}
+
+// purgeExpired removes the files of all expired and unreadable records and
+// stale temporary and lock files.
+func (rm *fileManager) purgeExpired() {
+	filenames, _ := filepath.Glob(filepath.Join(rm.path, "*.json"))
+	now := time.Now()
+	for _, filename := range filenames {
+		record, err := rm.read(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || now.After(time.Unix(record.ExpiresAt, 0)) {
+			os.Remove(filename)
+		}
+	}
+	// Remove temporary files left behind by interrupted writes and locks left
+	// behind by crashed instances.
+	stale, _ := filepath.Glob(filepath.Join(rm.path, ".refresh-*"))
+	locks, _ := filepath.Glob(filepath.Join(rm.path, "*.json.lock"))
+	for _, filename := range append(stale, locks...) {
+		if fi, err := os.Stat(filename); err == nil && now.Sub(fi.ModTime()) > fileLockStale {
+			os.Remove(filename)
+		}
+	}
+}
+
+func (rm *fileManager) read(filename string) (*fileRecord, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var record fileRecord
+	if err = json.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (rm *fileManager) write(filename string, record *fileRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and rename, so readers never see
+	// partially written files.
+	f, err := ioutil.TempFile(rm.path, ".refresh-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// lock creates the lock file of the provided record file name, waiting until
+// it is released by others. Locks older than fileLockStale are taken over,
+// since their holder is gone. Returns a function which releases the lock.
+func (rm *fileManager) lock(filename string) (func(), error) {
+	lockname := filename + ".lock"
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		f, err := os.OpenFile(lockname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() {
+				os.Remove(lockname)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, statErr := os.Stat(lockname); statErr == nil && time.Since(fi.ModTime()) > fileLockStale {
+			os.Remove(lockname)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("refresh token store record is locked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Create creates a new refresh token family with the provided token id as its
+// current token and returns the family id.
+func (rm *fileManager) Create(id string, expiresAt time.Time) (string, error) {
+	family := rndm.GenerateRandomString(24)
+
+	err := rm.write(rm.filename(family), &fileRecord{
+		Current:   id,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return family, nil
+}
+
+// Rotate implements the refresh.Manager interface like the memory map
+// manager does.
+func (rm *fileManager) Rotate(family string, id string, next string, expiresAt time.Time) (string, error) {
+	filename := rm.filename(family)
+	unlock, err := rm.lock(filename)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	now := time.Now()
+	stored, err := rm.read(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", refresh.ErrUnknownFamily
+		}
+		return "", err
+	}
+	if stored.Consumed || now.After(time.Unix(stored.ExpiresAt, 0)) {
+		os.Remove(filename)
+		return "", refresh.ErrUnknownFamily
+	}
+
+	record := &familyRecord{
+		key:       family,
+		current:   stored.Current,
+		expiresAt: time.Unix(stored.ExpiresAt, 0),
+		previous:  stored.Previous,
+		rotatedAt: time.Unix(0, stored.RotatedAt),
+	}
+	successor, err := rotateFamilyRecord(record, id, next, expiresAt, now, rm.reuseGrace)
+	switch err {
+	case nil:
+		if successor != next {
+			// Grace window reuse, the family is unchanged.
+			return successor, nil
+		}
+	case refresh.ErrReused:
+		os.Remove(filename)
+		return "", err
+	default:
+		return "", err
+	}
+
+	err = rm.write(filename, &fileRecord{
+		Current:   record.current,
+		ExpiresAt: record.expiresAt.Unix(),
+		Previous:  record.previous,
+		RotatedAt: record.rotatedAt.UnixNano(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return successor, nil
+}
+
+// Consume marks the provided token id as used until the provided expiration
+// time. Returns refresh.ErrReused if the token id was used before.
+func (rm *fileManager) Consume(id string, expiresAt time.Time) error {
+	filename := rm.filename(consumedKey(id))
+	unlock, err := rm.lock(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stored, err := rm.read(filename)
+	if err == nil && !time.Now().After(time.Unix(stored.ExpiresAt, 0)) {
+		return refresh.ErrReused
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return rm.write(filename, &fileRecord{
+		ExpiresAt: expiresAt.Unix(),
+		Consumed:  true,
+	})
+}
+
+// Revoke removes the provided family, invalidating all of its tokens.
+func (rm *fileManager) Revoke(family string) {
+	os.Remove(rm.filename(family))
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileManagerRotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir("", "konnect-refresh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rm, err := NewFileManager(ctx, tempDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testManagerRotate(t, "file", rm)
+
+	rm, err = NewFileManager(ctx, tempDir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testManagerReuseGrace(t, "file", rm)
+
+	// Families survive a new manager on the same folder, including the
+	// grace window.
+	expiresAt := time.Now().Add(time.Hour)
+	family, _ := rm.Create("first", expiresAt)
+	if _, err = rm.Rotate(family, "first", "second", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewFileManager(ctx, tempDir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, err := restarted.Rotate(family, "first", "other", expiresAt); err != nil || next != "second" {
+		t.Errorf("grace window did not survive restart: %v %v", next, err)
+	}
+	if next, err := restarted.Rotate(family, "second", "third", expiresAt); err != nil || next != "third" {
+		t.Errorf("family did not survive restart: %v %v", next, err)
+	}
+}
+
+func TestFileManagerLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tempDir, err := ioutil.TempDir("", "konnect-refresh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rm, err := NewFileManager(ctx, tempDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := rm.(*fileManager)
+	expiresAt := time.Now().Add(time.Hour)
+	family, _ := rm.Create("first", expiresAt)
+
+	// Stale locks of crashed instances are taken over.
+	lockname := fm.filename(family) + ".lock"
+	if err = ioutil.WriteFile(lockname, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * fileLockStale)
+	if err = os.Chtimes(lockname, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rm.Rotate(family, "first", "second", expiresAt); err != nil {
+		t.Errorf("rotation with stale lock failed: %v", err)
+	}
+	if _, err = os.Stat(lockname); !os.IsNotExist(err) {
+		t.Errorf("lock was not released: %v", err)
+	}
+
+	// Concurrent rotations of the same token are serialized, exactly one
+	// of them succeeds.
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, rotateErr := rm.Rotate(family, "second", "third", expiresAt)
+			results <- rotateErr
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one successful concurrent rotation, got %d", succeeded)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"time"
+
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+)
+
+// consumedKey returns the key under which the provided used token id without
+// family is kept. Keys of families never contain a colon.
+func consumedKey(id string) string {
+	return "consumed:" + id
+}
+
+// rotateFamilyRecord rotates the provided non expired record from the
+// provided token id to the provided next token id at the provided time and
+// returns the successor token id. Within the provided reuse grace duration
+// after a rotation, the previous token returns the current token id without
+// changing the record. Any other token returns refresh.ErrReused, the caller
+// must then revoke the family.
+func rotateFamilyRecord(record *familyRecord, id string, next string, expiresAt time.Time, now time.Time, reuseGrace time.Duration) (string, error) {
+	if record.current != id {
+		if reuseGrace > 0 && record.previous == id && now.Sub(record.rotatedAt) <= reuseGrace {
+			// NOTE: Concurrent or retried refreshes with the previous token
+			// get a successor with the id of the current token, so all of
+			// them stay valid together.
+			return record.current, nil
+		}
+		// NOTE: A previous token of the family was presented again, this
+		// indicates that the token got stolen thus the family is revoked.
+		return "", refresh.ErrReused
+	}
+
+	record.previous = id
+	record.rotatedAt = now
+	record.current = next
+	record.expiresAt = expiresAt
+
+	return next, nil
+}
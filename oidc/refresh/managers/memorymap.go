@@ -0,0 +1,234 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+)
+
+// Defaults used by memory map managers.
+const (
+	DefaultMaxRecords = 100000
+)
+
+// memoryMapManager provides the api and state for refresh token families
+// kept in memory. Its methods are safe to call from multiple Go routines.
+type memoryMapManager struct {
+	mutex sync.Mutex
+
+	table map[string]*list.Element
+	queue *list.List
+
+	maxRecords int
+	reuseGrace time.Duration
+}
+
+type familyRecord struct {
+	key       string
+	current   string
+	expiresAt time.Time
+
+	previous  string
+	rotatedAt time.Time
+
+	consumed bool
+}
+
+// NewMemoryMapManager creates a new refresh token family manager which holds
+// at most the provided number of families. If zero is provided, the default is
+// used. Within the provided reuse grace duration after a rotation, the
+// previous token of a family can be rotated again, to tolerate concurrent
+// and retried refreshes. Zero disables the grace window.
+func NewMemoryMapManager(ctx context.Context, maxRecords int, reuseGrace time.Duration) refresh.Manager {
+	if maxRecords <= 0 {
+		maxRecords = DefaultMaxRecords
+	}
+
+	rm := &memoryMapManager{
+		table: make(map[string]*list.Element),
+		queue: list.New(),
+
+		maxRecords: maxRecords,
+		reuseGrace: reuseGrace,
+	}
+
+	// Cleanup function.
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rm.mutex.Lock()
+				rm.purgeExpired()
+				rm.mutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rm
+}
+
+// purgeExpired removes all expired records, oldest first. The accociated
+// manager's mutex must be held when calling.
+func (rm *memoryMapManager) purgeExpired() {
+	now := time.Now()
+	for {
+		element := rm.queue.Front()
+		if element == nil {
+			return
+		}
+		record := element.Value.(*familyRecord)
+		if !now.After(record.expiresAt) {
+			// NOTE: Records are queued in order of their last change, and
+			// all of them are valid for the same duration, thus all
+			// remaining records are not expired.
+			return
+		}
+		rm.queue.Remove(element)
+		delete(rm.table, record.key)
+	}
+}
+
+// add adds the provided record to the accociated manager. If the table is
+// full, expired records are removed and then the oldest records, so that new
+// records can always be added. The accociated manager's mutex must be held
+// when calling.
+func (rm *memoryMapManager) add(record *familyRecord) {
+	if len(rm.table) >= rm.maxRecords {
+		rm.purgeExpired()
+		for len(rm.table) >= rm.maxRecords {
+			element := rm.queue.Front()
+			rm.queue.Remove(element)
+			delete(rm.table, element.Value.(*familyRecord).key)
+		}
+	}
+	rm.table[record.key] = rm.queue.PushBack(record)
+}
+
+// Create creates a new refresh token family with the provided token id as its
+// current token and returns the family id. If the table is full, the oldest
+// families are removed, revoking their tokens.
+func (rm *memoryMapManager) Create(id string, expiresAt time.Time) (string, error) {
+	family := rndm.GenerateRandomString(24)
+
+	rm.mutex.Lock()
+	rm.add(&familyRecord{
+		key:       family,
+		current:   id,
+		expiresAt: expiresAt,
+	})
+	rm.mutex.Unlock()
+
+	return family, nil
+}
+
+// Rotate replaces the provided token id of the provided family with the
+// provided next token id and returns the next token id. If the provided token
+// id is the previous token of the family and was rotated within the reuse
+// grace duration, the family is left unchanged and its current token id is
+// returned instead. If the provided token id is any other token of the
+// family, the whole family is revoked and refresh.ErrReused is returned.
+// Returns refresh.ErrUnknownFamily if the family is not found, expired or
+// revoked.
+func (rm *memoryMapManager) Rotate(family string, id string, next string, expiresAt time.Time) (string, error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	now := time.Now()
+	element, found := rm.table[family]
+	if !found {
+		return "", refresh.ErrUnknownFamily
+	}
+	record := element.Value.(*familyRecord)
+	if record.consumed || now.After(record.expiresAt) {
+		rm.queue.Remove(element)
+		delete(rm.table, family)
+		return "", refresh.ErrUnknownFamily
+	}
+	next, err := rotateFamilyRecord(record, id, next, expiresAt, now, rm.reuseGrace)
+	switch err {
+	case nil:
+		rm.queue.MoveToBack(element)
+	case refresh.ErrReused:
+		rm.queue.Remove(element)
+		delete(rm.table, family)
+	}
+
+	return next, err
+}
+
+// Consume marks the provided token id as used until the provided expiration
+// time. Returns refresh.ErrReused if the token id was used before.
+func (rm *memoryMapManager) Consume(id string, expiresAt time.Time) error {
+	key := consumedKey(id)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if element, found := rm.table[key]; found {
+		if !time.Now().After(element.Value.(*familyRecord).expiresAt) {
+			return refresh.ErrReused
+		}
+		rm.queue.Remove(element)
+		delete(rm.table, key)
+	}
+	rm.add(&familyRecord{
+		key:       key,
+		expiresAt: expiresAt,
+		consumed:  true,
+	})
+
+	return nil
+}
+
+// Revoke removes the provided family, invalidating all of its tokens.
+func (rm *memoryMapManager) Revoke(family string) {
+	rm.mutex.Lock()
+	if element, found := rm.table[family]; found {
+		rm.queue.Remove(element)
+		delete(rm.table, family)
+	}
+	rm.mutex.Unlock()
+}
+
+// Count returns the number of families which are not expired.
+func (rm *memoryMapManager) Count() int {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, element := range rm.table {
+		record := element.Value.(*familyRecord)
+		if !record.consumed && !now.After(record.expiresAt) {
+			count++
+		}
+	}
+
+	return count
+}
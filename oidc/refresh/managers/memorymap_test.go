@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/konnect/oidc/refresh"
+)
+
+// testManagerRotate tests the rotation, reuse detection and consumption of
+// the provided refresh token family manager, which has no grace window.
+func testManagerRotate(t *testing.T, name string, rm refresh.Manager) {
+	expiresAt := time.Now().Add(time.Hour)
+
+	family, err := rm.Create("first", expiresAt)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if next, err := rm.Rotate(family, "first", "second", expiresAt); err != nil || next != "second" {
+		t.Fatalf("%s: rotation failed: %v %v", name, next, err)
+	}
+	if _, err = rm.Rotate(family, "first", "third", expiresAt); err != refresh.ErrReused {
+		t.Errorf("%s: expected reuse error, got %v", name, err)
+	}
+	if _, err = rm.Rotate(family, "second", "third", expiresAt); err != refresh.ErrUnknownFamily {
+		t.Errorf("%s: expected unknown family after reuse, got %v", name, err)
+	}
+	if _, err = rm.Rotate("unknown", "first", "second", expiresAt); err != refresh.ErrUnknownFamily {
+		t.Errorf("%s: expected unknown family, got %v", name, err)
+	}
+
+	family, _ = rm.Create("first", expiresAt)
+	rm.Revoke(family)
+	if _, err = rm.Rotate(family, "first", "second", expiresAt); err != refresh.ErrUnknownFamily {
+		t.Errorf("%s: expected unknown family after revoke, got %v", name, err)
+	}
+
+	if err = rm.Consume("legacy", expiresAt); err != nil {
+		t.Errorf("%s: consume failed: %v", name, err)
+	}
+	if err = rm.Consume("legacy", expiresAt); err != refresh.ErrReused {
+		t.Errorf("%s: expected reuse error on second consume, got %v", name, err)
+	}
+	if _, err = rm.Rotate(consumedKey("legacy"), "", "next", expiresAt); err != refresh.ErrUnknownFamily {
+		t.Errorf("%s: consumed token was rotated like a family: %v", name, err)
+	}
+}
+
+// testManagerReuseGrace tests the provided refresh token family manager,
+// which has a grace window of one minute.
+func testManagerReuseGrace(t *testing.T, name string, rm refresh.Manager) {
+	expiresAt := time.Now().Add(time.Hour)
+
+	family, err := rm.Create("first", expiresAt)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if _, err = rm.Rotate(family, "first", "second", expiresAt); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if next, err := rm.Rotate(family, "first", "other", expiresAt); err != nil || next != "second" {
+		t.Errorf("%s: expected current token within grace window, got %v %v", name, next, err)
+	}
+	if next, err := rm.Rotate(family, "second", "third", expiresAt); err != nil || next != "third" {
+		t.Errorf("%s: rotation after grace reuse failed: %v %v", name, next, err)
+	}
+	if _, err = rm.Rotate(family, "first", "other", expiresAt); err != refresh.ErrReused {
+		t.Errorf("%s: expected reuse error, got %v", name, err)
+	}
+}
+
+func TestMemoryMapManagerRotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testManagerRotate(t, "memory", NewMemoryMapManager(ctx, 0, 0))
+	testManagerReuseGrace(t, "memory", NewMemoryMapManager(ctx, 0, time.Minute))
+}
+
+func TestMemoryMapManagerMaxRecords(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm := NewMemoryMapManager(ctx, 2, 0).(*memoryMapManager)
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, _ := rm.Create("a", expiresAt)
+	second, _ := rm.Create("b", expiresAt)
+	// Rotating moves the family to the back of the queue.
+	if _, err := rm.Rotate(first, "a", "a2", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	third, err := rm.Create("c", expiresAt)
+	if err != nil {
+		t.Fatalf("create failed with full table: %v", err)
+	}
+
+	if len(rm.table) != 2 || rm.queue.Len() != 2 {
+		t.Fatalf("manager not bounded: got %d records", len(rm.table))
+	}
+	if _, err = rm.Rotate(second, "b", "b2", expiresAt); err != refresh.ErrUnknownFamily {
+		t.Errorf("oldest family was not evicted: %v", err)
+	}
+	for _, family := range []string{first, third} {
+		if _, ok := rm.table[family]; !ok {
+			t.Errorf("recent family %v was evicted", family)
+		}
+	}
+	if count := rm.Count(); count != 2 {
+		t.Errorf("unexpected count: %d", count)
+	}
+}
+
+func TestMemoryMapManagerExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rm := NewMemoryMapManager(ctx, 0, 0).(*memoryMapManager)
+	expired, _ := rm.Create("a", time.Now().Add(-time.Second))
+	valid, _ := rm.Create("b", time.Now().Add(time.Hour))
+
+	if _, err := rm.Rotate(expired, "a", "a2", time.Now().Add(time.Hour)); err != refresh.ErrUnknownFamily {
+		t.Errorf("expected unknown family for expired family, got %v", err)
+	}
+	rm.Consume("legacy", time.Now().Add(time.Hour))
+	if count := rm.Count(); count != 1 {
+		t.Errorf("unexpected count: %d", count)
+	}
+	rm.table[valid].Value.(*familyRecord).expiresAt = time.Now().Add(-time.Second)
+	rm.purgeExpired()
+	if _, ok := rm.table[valid]; ok {
+		t.Errorf("expired family was not purged")
+	}
+	if _, ok := rm.table[consumedKey("legacy")]; !ok {
+		t.Errorf("consumed token was purged before expiry")
+	}
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package revocation
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned by revoked token managers.
+var (
+	ErrTooManyRecords = errors.New("too many revoked token records")
+)
+
+// Manager is a interface defining a revoked token manager. It keeps a
+// denylist of the jti of revoked tokens until the tokens expire.
+type Manager interface {
+	Revoke(id string, expiresAt time.Time) error
+	IsRevoked(id string) (bool, error)
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stash.kopano.io/kc/konnect/oidc/revocation"
+)
+
+// fileManager provides the api for revoked tokens kept as files in a folder.
+// The folder can be shared between multiple instances.
+type fileManager struct {
+	path string
+}
+
+type fileRecord struct {
+	ExpiresAt int64 `json:"exp"`
+}
+
+// NewFileManager creates a new revoked token manager which keeps revoked
+// tokens as files in the folder at the provided path, creating the folder if
+// it does not exist. Files of expired tokens are removed periodically until
+// the provided context is done.
+func NewFileManager(ctx context.Context, path string) (revocation.Manager, error) {
+	if path == "" {
+		return nil, fmt.Errorf("revoked tokens store path is empty")
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create revoked tokens store folder: %v", err)
+	}
+
+	rm := &fileManager{
+		path: path,
+	}
+
+	// Cleanup function.
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rm.purgeExpired()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rm, nil
+}
+
+// filename returns the file name of the provided token id. The id is hashed,
+// so it is safe to be used as file name.
+func (rm *fileManager) filename(id string) string {
+	h := sha256.Sum256([]byte(id))
+
+	return filepath.Join(rm.path, hex.EncodeToString(h[:])+".json")
+}
+
+// purgeExpired removes the files of all expired and unreadable records.
+func (rm *fileManager) purgeExpired() {
+	filenames, _ := filepath.Glob(filepath.Join(rm.path, "*.json"))
+	now := time.Now()
+	for _, filename := range filenames {
+		record, err := rm.read(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || now.After(time.Unix(record.ExpiresAt, 0)) {
+			os.Remove(filename)
+		}
+	}
+	// Remove temporary files left behind by interrupted writes.
+	stale, _ := filepath.Glob(filepath.Join(rm.path, ".revoked-*"))
+	for _, filename := range stale {
+		if fi, err := os.Stat(filename); err == nil && now.Sub(fi.ModTime()) > time.Minute {
+			os.Remove(filename)
+		}
+	}
+}
+
+func (rm *fileManager) read(filename string) (*fileRecord, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var record fileRecord
+	if err = json.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Revoke adds the provided token id to the denylist until the provided
+// expiration time.
+func (rm *fileManager) Revoke(id string, expiresAt time.Time) error {
+	b, err := json.Marshal(&fileRecord{
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first and rename, so readers never see
+	// partially written files.
+	f, err := ioutil.TempFile(rm.path, ".revoked-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), rm.filename(id))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// IsRevoked returns true if the provided token id is on the denylist and has
+// not expired.
+func (rm *fileManager) IsRevoked(id string) (bool, error) {
+	record, err := rm.read(rm.filename(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !time.Now().After(time.Unix(record.ExpiresAt, 0)), nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package managers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"stash.kopano.io/kc/konnect/oidc/revocation"
+)
+
+// Defaults used by memory map managers.
+const (
+	DefaultMaxRecords = 100000
+)
+
+// memoryMapManager provides the api and state for revoked tokens kept in
+// memory. Its methods are safe to call from multiple Go routines.
+type memoryMapManager struct {
+	mutex sync.RWMutex
+
+	table map[string]time.Time
+
+	maxRecords int
+}
+
+// NewMemoryMapManager creates a new revoked token manager which holds at most
+// the provided number of revoked tokens. If zero is provided, the default is
+// used.
+func NewMemoryMapManager(ctx context.Context, maxRecords int) revocation.Manager {
+	if maxRecords <= 0 {
+		maxRecords = DefaultMaxRecords
+	}
+
+	rm := &memoryMapManager{
+		table: make(map[string]time.Time),
+
+		maxRecords: maxRecords,
+	}
+
+	// Cleanup function.
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rm.mutex.Lock()
+				rm.purgeExpired()
+				rm.mutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rm
+}
+
+// purgeExpired removes all expired records. The accociated manager's mutex
+// must be held when calling.
+func (rm *memoryMapManager) purgeExpired() {
+	now := time.Now()
+	for id, expiresAt := range rm.table {
+		if now.After(expiresAt) {
+			delete(rm.table, id)
+		}
+	}
+}
+
+// Revoke adds the provided token id to the denylist until the provided
+// expiration time. Returns revocation.ErrTooManyRecords if the table is full.
+func (rm *memoryMapManager) Revoke(id string, expiresAt time.Time) error {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if _, found := rm.table[id]; !found && len(rm.table) >= rm.maxRecords {
+		rm.purgeExpired()
+		if len(rm.table) >= rm.maxRecords {
+			return revocation.ErrTooManyRecords
+		}
+	}
+	rm.table[id] = expiresAt
+
+	return nil
+}
+
+// IsRevoked returns true if the provided token id is on the denylist and has
+// not expired.
+func (rm *memoryMapManager) IsRevoked(id string) (bool, error) {
+	rm.mutex.RLock()
+	expiresAt, found := rm.table[id]
+	rm.mutex.RUnlock()
+
+	return found && !time.Now().After(expiresAt), nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// fdAddrPrefix is the prefix of listen addresses which are inherited listening
+// file descriptors, for example passed by systemd socket activation.
+const fdAddrPrefix = "fd:"
+
+// SystemdListenAddr is the listen address which is replaced by all listening
+// sockets passed by systemd socket activation.
+const SystemdListenAddr = "systemd"
+
+// listenFDsStart is the first file descriptor passed with socket activation,
+// as defined by sd_listen_fds(3).
+const listenFDsStart = 3
+
+// SystemdListenAddrs returns the listen addresses of all listening sockets
+// which were passed to the current process by systemd socket activation with
+// LISTEN_FDS and LISTEN_PID, or nil if none were passed.
+func SystemdListenAddrs() []string {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	addrs := make([]string, n)
+	for idx := range addrs {
+		addrs[idx] = fdAddrPrefix + strconv.Itoa(listenFDsStart+idx)
+	}
+
+	return addrs
+}
+
+// listenFD returns a listener for the inherited listening socket with the
+// provided file descriptor number.
+func listenFD(fdString string) (net.Listener, error) {
+	fd, err := strconv.Atoi(fdString)
+	if err != nil || fd < listenFDsStart {
+		return nil, fmt.Errorf("invalid listen file descriptor: %v", fdString)
+	}
+
+	f := os.NewFile(uintptr(fd), fdAddrPrefix+fdString)
+	if f == nil {
+		return nil, fmt.Errorf("invalid listen file descriptor: %v", fdString)
+	}
+	// NOTE: The listener uses a duplicate of the file descriptor, so the
+	// original can be closed.
+	defer f.Close()
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on file descriptor %v: %v", fdString, err)
+	}
+
+	return listener, nil
+}
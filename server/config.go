@@ -19,7 +19,9 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -32,6 +34,37 @@ type Config struct {
 
 	Handler http.Handler
 	Routes  []WithRoutes
+
+	// Maintenance controls maintenance mode. If nil, a new Maintenance is
+	// created by the server.
+	Maintenance *Maintenance
+
+	// Limiter limits the number of concurrently served requests. If nil,
+	// requests are not limited.
+	Limiter *Limiter
+
+	// SecurityHeaders are added to all responses. If nil, no security headers
+	// are added except the ones set by handlers.
+	SecurityHeaders *SecurityHeaders
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// EnableH2C enables serving HTTP/2 cleartext (h2c) requests with prior
+	// knowledge or upgrade in addition to HTTP/1.
+	EnableH2C bool
+
+	// Listeners are already listening listeners which are served in addition
+	// to the listen addresses, for example when the address must be known
+	// before the server is created.
+	Listeners []net.Listener
+
+	// AuxiliaryServers are additional HTTP servers, for example for metrics
+	// or profiling, which are listening on their own address and are served
+	// and shut down together with the server.
+	AuxiliaryServers []*http.Server
 }
 
 // WithRoutes provide http routing withing a context.
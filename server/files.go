@@ -0,0 +1,176 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Well known file paths.
+const (
+	// FaviconPath is the path at which browsers request the favicon of a
+	// host when a page does not reference one.
+	FaviconPath = "/favicon.ico"
+
+	// SecurityTxtPath is the path of the security.txt file as specified at
+	// https://tools.ietf.org/html/rfc9116#section-3.
+	SecurityTxtPath = "/.well-known/security.txt"
+)
+
+const securityTxtContentType = "text/plain; charset=utf-8"
+
+// FilesHandler is a http handler which serves files loaded at startup at
+// their configured paths.
+type FilesHandler struct {
+	files map[string]*servedFile
+}
+
+type servedFile struct {
+	name        string
+	contentType string
+	modTime     time.Time
+	content     []byte
+}
+
+// NewFilesHandler creates a new FilesHandler without files.
+func NewFilesHandler() *FilesHandler {
+	return &FilesHandler{
+		files: make(map[string]*servedFile),
+	}
+}
+
+// AddFile loads the file with the provided filename and serves it at the
+// provided paths. The content type is detected from the file name extension
+// or content.
+func (h *FilesHandler) AddFile(fn string, paths ...string) error {
+	file, err := loadServedFile(fn)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		h.files[p] = file
+	}
+	return nil
+}
+
+// AddSecurityTxt loads the security.txt file with the provided filename and
+// serves it at SecurityTxtPath. The file must contain the fields which are
+// required by https://tools.ietf.org/html/rfc9116#section-2.5.
+func (h *FilesHandler) AddSecurityTxt(fn string) error {
+	file, err := loadServedFile(fn)
+	if err != nil {
+		return err
+	}
+	if err = validateSecurityTxt(file.content); err != nil {
+		return fmt.Errorf("invalid security.txt %v: %v", fn, err)
+	}
+	file.contentType = securityTxtContentType
+
+	h.files[SecurityTxtPath] = file
+	return nil
+}
+
+func loadServedFile(fn string) (*servedFile, error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%v is a directory", fn)
+	}
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &servedFile{
+		name:    filepath.Base(fn),
+		modTime: info.ModTime(),
+		content: content,
+	}, nil
+}
+
+// Len returns the number of paths served by the accociated FilesHandler.
+func (h *FilesHandler) Len() int {
+	return len(h.files)
+}
+
+// AddRoutes add the accociated FilesHandler's URL routes to the provided
+// router with the provided context.Context.
+func (h *FilesHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	for p := range h.files {
+		router.Handle(p, h).Methods(http.MethodGet, http.MethodHead)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *FilesHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	file, ok := h.files[req.URL.Path]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	if file.contentType != "" {
+		rw.Header().Set("Content-Type", file.contentType)
+	}
+	http.ServeContent(rw, req, file.name, file.modTime, bytes.NewReader(file.content))
+}
+
+// validateSecurityTxt checks that the provided security.txt content has the
+// Contact and Expires fields which are required by
+// https://tools.ietf.org/html/rfc9116#section-2.5.
+func validateSecurityTxt(content []byte) error {
+	found := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		found[strings.ToLower(strings.TrimSpace(parts[0]))] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, field := range []string{"Contact", "Expires"} {
+		if !found[strings.ToLower(field)] {
+			return fmt.Errorf("missing required %v field", field)
+		}
+	}
+
+	return nil
+}
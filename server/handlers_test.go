@@ -19,9 +19,21 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/config"
 )
 
 func TestHealthCheckHandler(t *testing.T) {
@@ -47,3 +59,265 @@ func TestHealthCheckHandler(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 }
+
+func TestMaintenanceMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, _, router, _ := newTestServer(ctx, t)
+	defer httpServer.Close()
+
+	maintenance := NewMaintenance()
+	handler := maintenance.WithMaintenance(router)
+
+	maintenance.Set(true)
+
+	for _, path := range []string{"/konnect/v1/token", "/konnect/v1/authorize"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusServiceUnavailable {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", path, status, http.StatusServiceUnavailable)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: handler returned no Retry-After header", path)
+		}
+		if !strings.Contains(rr.Body.String(), "temporarily_unavailable") {
+			t.Errorf("%s: handler returned unexpected body: %v", path, rr.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/health-check", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("health-check returned wrong status code in maintenance mode: got %v want %v", status, http.StatusOK)
+	}
+
+	if maintenance.Toggle() {
+		t.Errorf("toggle must disable maintenance mode")
+	}
+	req = httptest.NewRequest(http.MethodGet, "/konnect/v1/token", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status == http.StatusServiceUnavailable {
+		t.Errorf("handler must not return %v when maintenance mode is disabled", status)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1, 10*time.Millisecond)
+	limiter.Limit("/konnect/v1/token")
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := limiter.WithLimit(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/konnect/v1/token" && req.Header.Get("X-Block") != "" {
+			close(started)
+			<-release
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+		req.Header.Set("X-Block", "1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code when limit is reached: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("handler returned no Retry-After header")
+	}
+	if !strings.Contains(rr.Body.String(), "temporarily_unavailable") {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+
+	// NOTE: Paths which are not limited are always served.
+	req = httptest.NewRequest(http.MethodGet, "/health-check", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("health-check returned wrong status code when limit is reached: got %v want %v", status, http.StatusOK)
+	}
+
+	close(release)
+	<-done
+
+	req = httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code after slot was released: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	proxyIP := net.ParseIP("192.0.2.1")
+	cfg := &config.Config{
+		TrustedProxyIPs:         []*net.IP{&proxyIP},
+		TrustedProxyProtoHeader: "X-Forwarded-Proto",
+	}
+
+	securityHeaders := NewSecurityHeaders()
+	securityHeaders.ContentTypeOptions = ""
+	handler := securityHeaders.WithSecurityHeaders(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/iframe" {
+			rw.Header().Set("Content-Security-Policy", "default-src 'none'")
+			rw.Header().Set("Referrer-Policy", "origin")
+		}
+		rw.Write([]byte("ok"))
+	}), cfg)
+
+	for _, test := range []struct {
+		path    string
+		proto   string
+		headers map[string]string
+	}{
+		{"/", "", map[string]string{
+			"Strict-Transport-Security": "",
+			"X-Content-Type-Options":    "",
+			"X-Frame-Options":           DefaultFrameOptions,
+			"Content-Security-Policy":   DefaultContentSecurityPolicy,
+			"Referrer-Policy":           DefaultReferrerPolicy,
+		}},
+		{"/", "https", map[string]string{
+			"Strict-Transport-Security": DefaultStrictTransportSecurity,
+		}},
+		{"/iframe", "https", map[string]string{
+			"Strict-Transport-Security": DefaultStrictTransportSecurity,
+			"X-Frame-Options":           "",
+			"Content-Security-Policy":   "default-src 'none'",
+			"Referrer-Policy":           "origin",
+		}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		for name, expected := range test.headers {
+			if value := rr.Header().Get(name); value != expected {
+				t.Errorf("%s %s returned wrong %s header: got %#v want %#v", test.path, test.proto, name, value, expected)
+			}
+		}
+	}
+}
+
+func TestFilesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "konnect-server-files-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	faviconFn := filepath.Join(dir, "favicon.ico")
+	if err = ioutil.WriteFile(faviconFn, []byte("icon"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	securityTxtFn := filepath.Join(dir, "security.txt")
+	if err = ioutil.WriteFile(securityTxtFn, []byte("# Comment\nContact: mailto:security@example.com\nExpires: 2030-01-01T00:00:00.000Z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalidSecurityTxtFn := filepath.Join(dir, "invalid-security.txt")
+	if err = ioutil.WriteFile(invalidSecurityTxtFn, []byte("Contact: mailto:security@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := NewFilesHandler()
+	if err = files.AddFile(faviconFn, FaviconPath, "/signin/v1/static/favicon.ico"); err != nil {
+		t.Fatal(err)
+	}
+	if err = files.AddSecurityTxt(invalidSecurityTxtFn); err == nil || !strings.Contains(err.Error(), "Expires") {
+		t.Errorf("expected missing Expires error, got %v", err)
+	}
+	if err = files.AddSecurityTxt(securityTxtFn); err != nil {
+		t.Fatal(err)
+	}
+	if err = files.AddFile(dir, "/dir"); err == nil {
+		t.Errorf("expected error for directory")
+	}
+
+	router := mux.NewRouter()
+	files.AddRoutes(context.Background(), router)
+
+	for _, test := range []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+	}{
+		{FaviconPath, http.StatusOK, "image/", "icon"},
+		{"/signin/v1/static/favicon.ico", http.StatusOK, "image/", "icon"},
+		{SecurityTxtPath, http.StatusOK, "text/plain; charset=utf-8", "Contact: mailto:security@example.com"},
+		{"/dir", http.StatusNotFound, "", ""},
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rr.Code != test.status {
+			t.Errorf("%v: wrong status code: got %v want %v", test.path, rr.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+			t.Errorf("%v: wrong content type: got %v want %v", test.path, contentType, test.contentType)
+		}
+		if !strings.Contains(rr.Body.String(), test.body) {
+			t.Errorf("%v: wrong body: %v", test.path, rr.Body.String())
+		}
+	}
+}
+
+func TestStatusAdminHandler(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	status := NewStatusAdminHandler("/admin/status", "secret", logger)
+	status.AddSource("clients", func(ctx context.Context) interface{} {
+		return map[string]int{"registered": 2}
+	})
+
+	router := mux.NewRouter()
+	status.AddRoutes(context.Background(), router)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code without token: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"version", "started_at", "uptime_seconds"} {
+		if _, ok := response[key]; !ok {
+			t.Errorf("response has no %v", key)
+		}
+	}
+	if clients, _ := response["clients"].(map[string]interface{}); clients["registered"] != float64(2) {
+		t.Errorf("response has wrong clients status: %v", response["clients"])
+	}
+}
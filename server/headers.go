@@ -0,0 +1,125 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"net/http"
+
+	"stash.kopano.io/kc/konnect/config"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// Security header defaults, used when not configured otherwise.
+const (
+	DefaultStrictTransportSecurity = "max-age=31536000"
+	DefaultContentTypeOptions      = "nosniff"
+	DefaultFrameOptions            = "DENY"
+	DefaultContentSecurityPolicy   = "default-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+	DefaultReferrerPolicy          = "no-referrer"
+)
+
+// SecurityHeaders defines the security headers which are added to responses,
+// unless the handler of the response has set them already. Empty values
+// disable the accociated header.
+type SecurityHeaders struct {
+	// StrictTransportSecurity is only sent with responses to requests which
+	// were made with https, either directly or through a trusted proxy.
+	StrictTransportSecurity string
+	ContentTypeOptions      string
+
+	// FrameOptions is only sent together with ContentSecurityPolicy, since
+	// handlers which set their own policy, like the session iframe which must
+	// be embeddable, decide about framing themselves.
+	FrameOptions          string
+	ContentSecurityPolicy string
+
+	ReferrerPolicy string
+}
+
+// NewSecurityHeaders creates a new SecurityHeaders with the default values.
+func NewSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		StrictTransportSecurity: DefaultStrictTransportSecurity,
+		ContentTypeOptions:      DefaultContentTypeOptions,
+
+		FrameOptions:          DefaultFrameOptions,
+		ContentSecurityPolicy: DefaultContentSecurityPolicy,
+
+		ReferrerPolicy: DefaultReferrerPolicy,
+	}
+}
+
+// WithSecurityHeaders wraps the provided handler, adding the accociated
+// security headers to all responses. The provided config defines the trusted
+// proxies whose forwarded scheme is used to find https requests.
+func (h *SecurityHeaders) WithSecurityHeaders(next http.Handler, cfg *config.Config) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&securityHeadersResponseWriter{
+			ResponseWriter: rw,
+
+			headers: h,
+			https:   utils.SchemeFromRequest(req, cfg.TrustedProxyProtoHeader, cfg.TrustedProxyIPs, cfg.TrustedProxyNets) == "https",
+		}, req)
+	})
+}
+
+// apply adds the accociated security headers to the provided header, keeping
+// headers which are set already.
+func (h *SecurityHeaders) apply(header http.Header, https bool) {
+	setDefault := func(name, value string) {
+		if value != "" && header.Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+
+	if https {
+		setDefault("Strict-Transport-Security", h.StrictTransportSecurity)
+	}
+	setDefault("X-Content-Type-Options", h.ContentTypeOptions)
+	if h.ContentSecurityPolicy != "" && header.Get("Content-Security-Policy") == "" {
+		header.Set("Content-Security-Policy", h.ContentSecurityPolicy)
+		setDefault("X-Frame-Options", h.FrameOptions)
+	}
+	setDefault("Referrer-Policy", h.ReferrerPolicy)
+}
+
+// securityHeadersResponseWriter is a http.ResponseWriter which adds security
+// headers right before the response header is written.
+type securityHeadersResponseWriter struct {
+	http.ResponseWriter
+
+	headers     *SecurityHeaders
+	https       bool
+	wroteHeader bool
+}
+
+func (w *securityHeadersResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.headers.apply(w.ResponseWriter.Header(), w.https)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityHeadersResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
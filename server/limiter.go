@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// DefaultLimiterQueueTimeout is the duration requests wait for a free slot
+// before they are rejected, if not configured otherwise.
+const DefaultLimiterQueueTimeout = 500 * time.Millisecond
+
+const limiterErrorDescription = "too many concurrent requests, please try again later"
+
+// Limiter limits the number of concurrently served requests for limited
+// paths. Requests which do not get a free slot within the queue timeout are
+// answered with 503 Service Unavailable.
+type Limiter struct {
+	slots chan struct{}
+
+	QueueTimeout time.Duration
+
+	limited map[string]bool
+}
+
+// NewLimiter creates a new Limiter which serves at most the provided number
+// of requests concurrently, waiting up to the provided queue timeout for a
+// free slot.
+func NewLimiter(maxConcurrentRequests int, queueTimeout time.Duration) *Limiter {
+	return &Limiter{
+		slots: make(chan struct{}, maxConcurrentRequests),
+
+		QueueTimeout: queueTimeout,
+
+		limited: make(map[string]bool),
+	}
+}
+
+// Limit adds the provided path to the paths which are limited. Call this
+// before starting to serve requests.
+func (l *Limiter) Limit(path string) {
+	l.limited[path] = true
+}
+
+// InFlight returns the number of limited requests which are currently served
+// and the maximum number of concurrently served limited requests.
+func (l *Limiter) InFlight() (int, int) {
+	return len(l.slots), cap(l.slots)
+}
+
+// WithLimit wraps the provided handler, limiting the number of concurrently
+// served requests for all limited paths. Requests for all other paths are
+// passed through as is.
+func (l *Limiter) WithLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !l.limited[req.URL.Path] {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			// NOTE: Only start a timer when no slot is free right away.
+			timer := time.NewTimer(l.QueueTimeout)
+			select {
+			case l.slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				rw.Header().Set("Cache-Control", "no-store")
+				rw.Header().Set("Retry-After", "1")
+				utils.WriteJSON(rw, http.StatusServiceUnavailable, konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, limiterErrorDescription), "")
+				return
+			case <-req.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		defer func() {
+			<-l.slots
+		}()
+
+		next.ServeHTTP(rw, req)
+	})
+}
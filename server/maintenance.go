@@ -0,0 +1,180 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/oidc-go"
+
+	konnectoidc "stash.kopano.io/kc/konnect/oidc"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// DefaultMaintenanceRetryAfter is the Retry-After duration which is sent with
+// responses while in maintenance mode, if not configured otherwise.
+const DefaultMaintenanceRetryAfter = 2 * time.Minute
+
+const maintenanceErrorDescription = "the service is down for maintenance, please try again later"
+
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Maintenance</title></head>
+<body><h1>%s</h1><p>The service is down for maintenance, please try again later.</p></body>
+</html>
+`
+
+// Maintenance holds the maintenance mode state. While maintenance mode is
+// enabled, all requests except health checks and exempted paths are answered
+// with 503 Service Unavailable.
+type Maintenance struct {
+	enabled int32
+
+	RetryAfter time.Duration
+
+	exempt map[string]bool
+}
+
+// NewMaintenance creates a new Maintenance with maintenance mode disabled.
+func NewMaintenance() *Maintenance {
+	return &Maintenance{
+		RetryAfter: DefaultMaintenanceRetryAfter,
+
+		exempt: map[string]bool{
+			"/health-check": true,
+		},
+	}
+}
+
+// Enabled returns true if maintenance mode is enabled.
+func (m *Maintenance) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set enables or disables maintenance mode.
+func (m *Maintenance) Set(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&m.enabled, value)
+}
+
+// Toggle switches maintenance mode and returns the new state.
+func (m *Maintenance) Toggle() bool {
+	for {
+		current := atomic.LoadInt32(&m.enabled)
+		if atomic.CompareAndSwapInt32(&m.enabled, current, 1-current) {
+			return current == 0
+		}
+	}
+}
+
+// Exempt excludes the provided path from maintenance mode. Call this before
+// starting to serve requests.
+func (m *Maintenance) Exempt(path string) {
+	m.exempt[path] = true
+}
+
+// WithMaintenance wraps the provided handler, answering all requests which are
+// not exempted with 503 Service Unavailable while maintenance mode is enabled.
+func (m *Maintenance) WithMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !m.Enabled() || m.exempt[req.URL.Path] {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64(m.RetryAfter.Seconds()), 10))
+
+		if strings.Contains(req.Header.Get("Accept"), "text/html") {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(rw, maintenancePage, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+
+		utils.WriteJSON(rw, http.StatusServiceUnavailable, konnectoidc.NewOAuth2Error(oidc.ErrorCodeOAuth2TemporarilyUnavailable, maintenanceErrorDescription), "")
+	})
+}
+
+// MaintenanceAdminHandler is a http handler to show and change the maintenance
+// mode state, protected by a bearer token.
+type MaintenanceAdminHandler struct {
+	path        string
+	maintenance *Maintenance
+	token       []byte
+
+	logger logrus.FieldLogger
+}
+
+// NewMaintenanceAdminHandler creates a new MaintenanceAdminHandler for the
+// provided maintenance at the provided path, requiring the provided bearer
+// token. The path is exempted from maintenance mode, so it can be disabled
+// again.
+func NewMaintenanceAdminHandler(path string, maintenance *Maintenance, token string, logger logrus.FieldLogger) *MaintenanceAdminHandler {
+	maintenance.Exempt(path)
+
+	return &MaintenanceAdminHandler{
+		path:        path,
+		maintenance: maintenance,
+		token:       []byte(token),
+
+		logger: logger,
+	}
+}
+
+// AddRoutes add the accociated MaintenanceAdminHandler's URL routes to the
+// provided router with the provided context.Context.
+func (h *MaintenanceAdminHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(h.path, h).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+}
+
+// ServeHTTP implements the http.Handler interface. GET returns the current
+// state, PUT enables and DELETE disables maintenance mode.
+func (h *MaintenanceAdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !utils.RequireBearerToken(rw, req, h.token) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		h.maintenance.Set(true)
+		h.logger.Warnln("maintenance mode enabled via admin endpoint")
+	case http.MethodDelete:
+		h.maintenance.Set(false)
+		h.logger.Infoln("maintenance mode disabled via admin endpoint")
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	err := utils.WriteJSON(rw, http.StatusOK, map[string]bool{
+		"maintenance": h.maintenance.Enabled(),
+	}, "")
+	if err != nil {
+		h.logger.WithError(err).Errorln("maintenance admin request failed writing response")
+	}
+}
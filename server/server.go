@@ -19,10 +19,13 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,14 +33,46 @@ import (
 	"github.com/longsleep/go-metrics/loggedwriter"
 	"github.com/longsleep/go-metrics/timing"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/konnect"
+	"stash.kopano.io/kc/konnect/tracing"
+	"stash.kopano.io/kc/konnect/utils"
+)
+
+// unixAddrPrefix is the prefix of listen addresses which are Unix domain
+// socket paths.
+const unixAddrPrefix = "unix:"
+
+// Server timeout defaults, used when not configured.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = 60 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
 )
 
 // Server is our HTTP server implementation.
 type Server struct {
 	Config *Config
 
-	listenAddr string
-	logger     logrus.FieldLogger
+	listenAddrs []string
+	logger      logrus.FieldLogger
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	maintenance     *Maintenance
+	limiter         *Limiter
+	securityHeaders *SecurityHeaders
+
+	enableH2C bool
+
+	auxiliaryServers []*http.Server
 
 	requestLog bool
 }
@@ -47,12 +82,41 @@ func NewServer(c *Config) (*Server, error) {
 	s := &Server{
 		Config: c,
 
-		listenAddr: c.Config.ListenAddr,
-		logger:     c.Config.Logger,
+		listenAddrs: c.Config.ListenAddrs,
+		logger:      c.Config.Logger,
+
+		readHeaderTimeout: c.ReadHeaderTimeout,
+		readTimeout:       c.ReadTimeout,
+		writeTimeout:      c.WriteTimeout,
+		idleTimeout:       c.IdleTimeout,
+
+		maintenance:     c.Maintenance,
+		limiter:         c.Limiter,
+		securityHeaders: c.SecurityHeaders,
+
+		enableH2C: c.EnableH2C,
+
+		auxiliaryServers: c.AuxiliaryServers,
 
 		requestLog: os.Getenv("KOPANO_DEBUG_SERVER_REQUEST_LOG") == "1",
 	}
 
+	if s.readHeaderTimeout == 0 {
+		s.readHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if s.readTimeout == 0 {
+		s.readTimeout = DefaultReadTimeout
+	}
+	if s.writeTimeout == 0 {
+		s.writeTimeout = DefaultWriteTimeout
+	}
+	if s.idleTimeout == 0 {
+		s.idleTimeout = DefaultIdleTimeout
+	}
+	if s.maintenance == nil {
+		s.maintenance = NewMaintenance()
+	}
+
 	return s, nil
 }
 
@@ -65,26 +129,44 @@ func (s *Server) AddContext(parent context.Context, next http.Handler) http.Hand
 		ctx, cancel := context.WithCancel(parent)
 
 		if s.requestLog {
+			// Add request ID, to correlate logged requests with responses.
+			requestID := rndm.GenerateRandomString(16)
+			ctx = konnect.NewRequestIDContext(ctx, requestID)
+			rw.Header().Set("X-Request-Id", requestID)
+
 			loggedWriter := metrics.NewLoggedResponseWriter(rw)
 			// Create per request context.
 			ctx = timing.NewContext(ctx, func(duration time.Duration) {
 				// This is the stop callback, called when complete with duration.
 				durationMs := float64(duration) / float64(time.Millisecond)
 				// Log request.
+				remote := utils.ClientIPFromRequest(req, s.Config.Config.TrustedProxyClientIPHeader, s.Config.Config.TrustedProxyIPs, s.Config.Config.TrustedProxyNets)
 				s.logger.WithFields(logrus.Fields{
 					"status":     loggedWriter.Status(),
 					"method":     req.Method,
 					"path":       req.URL.Path,
-					"remote":     req.RemoteAddr,
+					"remote":     remote,
 					"duration":   durationMs,
 					"referer":    req.Referer(),
 					"user-agent": req.UserAgent(),
 					"origin":     req.Header.Get("Origin"),
-				}).Debug("HTTP request complete")
+					"request_id": requestID,
+				}).WithFields(s.Config.Config.GeoIP.Fields(remote)).Debug("HTTP request complete")
 			})
 			rw = loggedWriter
 		}
 
+		// Trace the request.
+		ctx, span := s.Config.Config.Tracer.StartServer(ctx, req)
+		if span != nil {
+			tracedWriter := metrics.NewLoggedResponseWriter(rw)
+			defer func() {
+				span.SetAttributes(tracing.Int("http.status_code", tracedWriter.Status()))
+				span.End()
+			}()
+			rw = tracedWriter
+		}
+
 		// Run the request.
 		next.ServeHTTP(rw, req.WithContext(ctx))
 
@@ -117,51 +199,156 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	logger := s.logger
 
-	errCh := make(chan error, 2)
+	errCh := make(chan error, 1+len(s.listenAddrs)+len(s.auxiliaryServers))
 	exitCh := make(chan bool, 1)
 	signalCh := make(chan os.Signal)
 
 	router := mux.NewRouter()
 	s.AddRoutes(serveCtx, router)
 
+	var handler http.Handler = router
+	if s.limiter != nil {
+		handler = s.limiter.WithLimit(handler)
+	}
+	handler = s.maintenance.WithMaintenance(handler)
+	if s.securityHeaders != nil {
+		handler = s.securityHeaders.WithSecurityHeaders(handler, s.Config.Config)
+	}
+
 	// HTTP listener.
 	srv := &http.Server{
-		Handler: s.AddContext(serveCtx, router),
+		Handler: s.AddContext(serveCtx, handler),
+
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
 	}
+	if s.enableH2C {
+		// Serve HTTP/2 without TLS, HTTP/1 requests are passed through as is.
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{
+			IdleTimeout: s.idleTimeout,
+		})
+	}
+
+	logger.WithFields(logrus.Fields{
+		"listenAddrs":       s.listenAddrs,
+		"readHeaderTimeout": s.readHeaderTimeout,
+		"readTimeout":       s.readTimeout,
+		"writeTimeout":      s.writeTimeout,
+		"idleTimeout":       s.idleTimeout,
+		"h2c":               s.enableH2C,
+	}).Infoln("starting http listener")
 
-	logger.WithField("listenAddr", s.listenAddr).Infoln("starting http listener")
-	listener, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
-		return err
+	// All listeners must be listening before serving starts.
+	if len(s.listenAddrs) == 0 && len(s.Config.Listeners) == 0 {
+		return errors.New("no listen address")
+	}
+	var err error
+	listeners := append([]net.Listener{}, s.Config.Listeners...)
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, listenAddr := range s.listenAddrs {
+		listener, listenErr := listen(listenAddr)
+		if listenErr != nil {
+			closeListeners()
+			return listenErr
+		}
+		listeners = append(listeners, listener)
 	}
-	logger.Infoln("ready to handle requests")
 
-	go func() {
-		serveErr := srv.Serve(listener)
-		if serveErr != nil {
-			errCh <- serveErr
+	// Auxiliary HTTP listeners.
+	auxiliaryListeners := make([]net.Listener, 0, len(s.auxiliaryServers))
+	for _, auxiliarySrv := range s.auxiliaryServers {
+		logger.WithField("listenAddr", auxiliarySrv.Addr).Infoln("starting auxiliary http listener")
+		auxiliaryListener, listenErr := listen(auxiliarySrv.Addr)
+		if listenErr != nil {
+			closeListeners()
+			for _, l := range auxiliaryListeners {
+				l.Close()
+			}
+			return listenErr
 		}
+		auxiliaryListeners = append(auxiliaryListeners, auxiliaryListener)
+	}
+	logger.Infoln("ready to handle requests")
+
+	for idx, auxiliarySrv := range s.auxiliaryServers {
+		go func(auxiliarySrv *http.Server, auxiliaryListener net.Listener) {
+			serveErr := auxiliarySrv.Serve(auxiliaryListener)
+			if serveErr != nil && serveErr != http.ErrServerClosed {
+				errCh <- serveErr
+			}
 
-		logger.Debugln("http listener stopped")
+			logger.WithField("listenAddr", auxiliarySrv.Addr).Debugln("auxiliary http listener stopped")
+		}(auxiliarySrv, auxiliaryListeners[idx])
+	}
+
+	var listenersWg sync.WaitGroup
+	for _, listener := range listeners {
+		listenersWg.Add(1)
+		go func(listener net.Listener) {
+			defer listenersWg.Done()
+			serveErr := srv.Serve(listener)
+			if serveErr != nil {
+				errCh <- serveErr
+			}
+
+			logger.WithField("listenAddr", listener.Addr().String()).Debugln("http listener stopped")
+		}(listener)
+	}
+	go func() {
+		listenersWg.Wait()
 		close(exitCh)
 	}()
 
+	// Toggle maintenance mode on SIGUSR1.
+	maintenanceCh := make(chan os.Signal, 1)
+	signal.Notify(maintenanceCh, syscall.SIGUSR1)
+	defer signal.Stop(maintenanceCh)
+	go func() {
+		for {
+			select {
+			case <-maintenanceCh:
+				if s.maintenance.Toggle() {
+					logger.Warnln("maintenance mode enabled")
+				} else {
+					logger.Infoln("maintenance mode disabled")
+				}
+			case <-serveCtx.Done():
+				return
+			}
+		}
+	}()
+
 	// Wait for exit or error.
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
 	select {
 	case err = <-errCh:
 		// breaks
 	case reason := <-signalCh:
 		logger.WithField("signal", reason).Warnln("received signal")
 		// breaks
+	case <-ctx.Done():
+		logger.Infoln("context done")
+		// breaks
 	}
 
 	// Shutdown, server will stop to accept new connections, requires Go 1.8+.
 	logger.Infoln("clean server shutdown start")
-	shutDownCtx, shutDownCtxCancel := context.WithTimeout(ctx, 10*time.Second)
+	shutDownCtx, shutDownCtxCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	if shutdownErr := srv.Shutdown(shutDownCtx); shutdownErr != nil {
 		logger.WithError(shutdownErr).Warn("clean server shutdown failed")
 	}
+	for _, auxiliarySrv := range s.auxiliaryServers {
+		if shutdownErr := auxiliarySrv.Shutdown(shutDownCtx); shutdownErr != nil {
+			logger.WithError(shutdownErr).WithField("listenAddr", auxiliarySrv.Addr).Warn("clean auxiliary server shutdown failed")
+		}
+	}
 
 	// Cancel our own context, wait on managers.
 	serveCtxCancel()
@@ -187,3 +374,17 @@ func (s *Server) Serve(ctx context.Context) error {
 	return err
 
 }
+
+// listen announces on the provided address. Addresses with unix: prefix are
+// Unix domain socket paths, addresses with fd: prefix are inherited listening
+// file descriptors and all others are TCP addresses.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return net.Listen("unix", strings.TrimPrefix(addr, unixAddrPrefix))
+	}
+	if strings.HasPrefix(addr, fdAddrPrefix) {
+		return listenFD(strings.TrimPrefix(addr, fdAddrPrefix))
+	}
+
+	return net.Listen("tcp", addr)
+}
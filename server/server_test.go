@@ -19,10 +19,18 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -48,7 +56,7 @@ func newTestServer(ctx context.Context, t *testing.T) (*httptest.Server, *Server
 		&identity.Config{},
 		"unittestuser",
 	))
-	mgrs.Set("code", codeManagers.NewMemoryMapManager(ctx))
+	mgrs.Set("code", codeManagers.NewMemoryMapManager(ctx, 0, 0))
 	encryptionManager, _ := identityManagers.NewEncryptionManager(nil)
 	mgrs.Set("encryption", encryptionManager)
 	mgrs.Set("clients", &clients.Registry{})
@@ -98,3 +106,309 @@ func TestNewTestServer(t *testing.T) {
 	defer cancel()
 	newTestServer(ctx, t)
 }
+
+func TestServeAuxiliaryServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	shutdown := make(chan bool, 1)
+	auxiliarySrv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		}),
+	}
+	auxiliarySrv.RegisterOnShutdown(func() {
+		shutdown <- true
+	})
+
+	server, err := NewServer(&Config{
+		Config: &config.Config{
+			ListenAddrs: []string{"127.0.0.1:0"},
+			Logger:      logger,
+		},
+
+		AuxiliaryServers: []*http.Server{auxiliarySrv},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ctx)
+	}()
+
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		if response, err = http.Get("http://" + addr + "/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("auxiliary server not reachable: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected auxiliary server status: %d", response.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err = <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after context was cancelled")
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		t.Error("auxiliary server was not shut down")
+	}
+}
+
+func TestServeAuxiliaryServerListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server, err := NewServer(&Config{
+		Config: &config.Config{
+			ListenAddrs: []string{"127.0.0.1:0"},
+			Logger:      logger,
+		},
+
+		AuxiliaryServers: []*http.Server{{Addr: listener.Addr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = server.Serve(context.Background()); err == nil {
+		t.Fatal("expected error when auxiliary listen address is in use")
+	}
+}
+
+func TestServeMultipleListenAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dir, err := ioutil.TempDir("", "konnect-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "konnectd.sock")
+
+	server, err := NewServer(&Config{
+		Config: &config.Config{
+			ListenAddrs: []string{addr, "unix:" + socketPath},
+			Logger:      logger,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ctx)
+	}()
+
+	clients := map[string]*http.Client{
+		addr: http.DefaultClient,
+		socketPath: {
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+	for name, client := range clients {
+		var response *http.Response
+		for i := 0; i < 50; i++ {
+			if response, err = client.Get("http://" + addr + "/health-check"); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("listener %s not reachable: %v", name, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status from listener %s: %d", name, response.StatusCode)
+		}
+	}
+
+	cancel()
+	select {
+	case err = <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after context was cancelled")
+	}
+	if _, err = os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestServeInheritedListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	// NOTE: File returns a duplicate of the listening socket, like the file
+	// descriptors inherited with socket activation.
+	f, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	// NOTE: The listener takes ownership of the file descriptor, so pass a
+	// duplicate which is not closed again with f.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		Config: &config.Config{
+			ListenAddrs: []string{fmt.Sprintf("fd:%d", fd)},
+			Logger:      logger,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ctx)
+	}()
+
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		if response, err = http.Get("http://" + addr + "/health-check"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("inherited listener not reachable: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status from inherited listener: %d", response.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err = <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after context was cancelled")
+	}
+
+	for _, fdString := range []string{"", "x", "2"} {
+		if _, err = listenFD(fdString); err == nil {
+			t.Errorf("invalid file descriptor %#v accepted", fdString)
+		}
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	server, err := NewServer(&Config{
+		Config: &config.Config{
+			Logger: logger,
+		},
+		Listeners: []net.Listener{listener},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ctx)
+	}()
+
+	response, err := http.Get("http://" + addr + "/health-check")
+	if err != nil {
+		t.Fatalf("listener not reachable: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status from listener: %d", response.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err = <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			t.Errorf("unexpected serve error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after context was cancelled")
+	}
+}
+
+func TestSystemdListenAddrs(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if addrs := SystemdListenAddrs(); addrs != nil {
+		t.Errorf("sockets of other process returned: %v", addrs)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	if addrs := SystemdListenAddrs(); !reflect.DeepEqual(addrs, []string{"fd:3", "fd:4"}) {
+		t.Errorf("wrong systemd listen addrs: %v", addrs)
+	}
+
+	os.Setenv("LISTEN_FDS", "0")
+	if addrs := SystemdListenAddrs(); addrs != nil {
+		t.Errorf("listen addrs without sockets: %v", addrs)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/konnect/utils"
+	"stash.kopano.io/kc/konnect/version"
+)
+
+// StatusSource returns the status of a component at the time of the call for
+// the status admin endpoint. The returned value is encoded as JSON.
+type StatusSource func(ctx context.Context) interface{}
+
+// StatusAdminHandler is a http handler which shows the status of the
+// registered components as JSON, protected by a bearer token. It does not
+// depend on metrics being enabled.
+type StatusAdminHandler struct {
+	path      string
+	token     []byte
+	startedAt time.Time
+
+	mutex   sync.RWMutex
+	sources map[string]StatusSource
+
+	logger logrus.FieldLogger
+}
+
+// NewStatusAdminHandler creates a new StatusAdminHandler at the provided path,
+// requiring the provided bearer token. Uptime is reported since the time of
+// creation.
+func NewStatusAdminHandler(path string, token string, logger logrus.FieldLogger) *StatusAdminHandler {
+	return &StatusAdminHandler{
+		path:      path,
+		token:     []byte(token),
+		startedAt: time.Now(),
+
+		sources: make(map[string]StatusSource),
+
+		logger: logger,
+	}
+}
+
+// AddSource adds the provided source, its status is reported with the
+// provided name. Sources with the same name replace each other.
+func (h *StatusAdminHandler) AddSource(name string, source StatusSource) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sources[name] = source
+}
+
+// AddRoutes add the accociated StatusAdminHandler's URL routes to the provided
+// router with the provided context.Context.
+func (h *StatusAdminHandler) AddRoutes(ctx context.Context, router *mux.Router) {
+	router.Handle(h.path, h).Methods(http.MethodGet)
+}
+
+// Status returns the status of the accociated StatusAdminHandler's sources
+// together with the version and uptime.
+func (h *StatusAdminHandler) Status(ctx context.Context) map[string]interface{} {
+	now := time.Now()
+	status := map[string]interface{}{
+		"version":        version.Version,
+		"started_at":     h.startedAt.UTC(),
+		"uptime_seconds": int64(now.Sub(h.startedAt).Seconds()),
+	}
+
+	h.mutex.RLock()
+	names := make([]string, 0, len(h.sources))
+	for name := range h.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]StatusSource, len(names))
+	for idx, name := range names {
+		sources[idx] = h.sources[name]
+	}
+	h.mutex.RUnlock()
+
+	for idx, name := range names {
+		status[name] = sources[idx](ctx)
+	}
+
+	return status
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *StatusAdminHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !utils.RequireBearerToken(rw, req, h.token) {
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	err := utils.WriteJSON(rw, http.StatusOK, h.Status(req.Context()), "")
+	if err != nil {
+		h.logger.WithError(err).Errorln("status admin request failed writing response")
+	}
+}
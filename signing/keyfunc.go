@@ -0,0 +1,175 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// JWTHeaderCritical is the JWT header listing extensions which must be
+// understood as specified at https://tools.ietf.org/html/rfc7515#section-4.1.11.
+const JWTHeaderCritical = "crit"
+
+// JWTHeaderType is the JWT header declaring the media type of the token as
+// specified at https://tools.ietf.org/html/rfc7515#section-4.1.9.
+const JWTHeaderType = "typ"
+
+// Errors returned for tokens rejected by keyfuncs created with StrictKeyfunc.
+var (
+	ErrSigningMethodNone        = errors.New("alg none is not allowed")
+	ErrSigningMethodSymmetric   = errors.New("symmetric alg is not allowed")
+	ErrSigningMethodKeyMismatch = errors.New("alg does not match key type")
+	ErrCriticalHeader           = errors.New("crit header is not supported")
+)
+
+// ErrTokenType is returned by keyfuncs created with TypedKeyfunc for tokens
+// with a typ header which is not allowed.
+var ErrTokenType = errors.New("typ is not allowed")
+
+// IsStrictKeyfuncError returns true if the provided error is one of the errors
+// returned for tokens rejected by keyfuncs created with StrictKeyfunc,
+// including the jwt.ValidationError wrapping it.
+func IsStrictKeyfuncError(err error) bool {
+	if ve, ok := err.(*jwt.ValidationError); ok {
+		err = ve.Inner
+	}
+	switch err {
+	case ErrSigningMethodNone, ErrSigningMethodSymmetric, ErrSigningMethodKeyMismatch, ErrCriticalHeader:
+		return true
+	}
+
+	return false
+}
+
+// StrictKeyfunc returns a jwt.Keyfunc which pins the signing method of tokens
+// to the type of the key returned by the provided keyfunc. Tokens with
+// symmetric alg, with crit header or with an alg which does not belong to the
+// algorithm family of the key are rejected. Tokens with alg none are rejected
+// unless the provided keyfunc explicitly returns
+// jwt.UnsafeAllowNoneSignatureType for them. If onReject is not nil, it is
+// called for each token which gets rejected this way, for example to audit
+// such attempts.
+func StrictKeyfunc(keyfunc jwt.Keyfunc, onReject func(token *jwt.Token, err error)) jwt.Keyfunc {
+	reject := func(token *jwt.Token, err error) (interface{}, error) {
+		if onReject != nil {
+			onReject(token, err)
+		}
+		return nil, err
+	}
+
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Header[JWTHeaderCritical]; ok {
+			return reject(token, ErrCriticalHeader)
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return reject(token, ErrSigningMethodSymmetric)
+		}
+
+		key, err := keyfunc(token)
+		if token.Method == jwt.SigningMethodNone {
+			if err != nil || key != jwt.UnsafeAllowNoneSignatureType {
+				return reject(token, ErrSigningMethodNone)
+			}
+			return key, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err = ValidateSigningMethodForKey(token.Method, key); err != nil {
+			return reject(token, err)
+		}
+
+		return key, nil
+	}
+}
+
+// TypedKeyfunc returns a jwt.Keyfunc which rejects tokens with ErrTokenType
+// unless their typ header is one of the provided types, before calling the
+// provided keyfunc. Types are compared case insensitively and with optional
+// application/ prefix as specified at
+// https://tools.ietf.org/html/rfc7515#section-4.1.9. An empty type allows
+// tokens without typ header.
+func TypedKeyfunc(keyfunc jwt.Keyfunc, types ...string) jwt.Keyfunc {
+	allowed := make(map[string]bool)
+	for _, typ := range types {
+		allowed[normalizeTokenType(typ)] = true
+	}
+
+	return func(token *jwt.Token) (interface{}, error) {
+		typ, _ := token.Header[JWTHeaderType].(string)
+		if !allowed[normalizeTokenType(typ)] {
+			return nil, ErrTokenType
+		}
+
+		return keyfunc(token)
+	}
+}
+
+func normalizeTokenType(typ string) string {
+	typ = strings.ToLower(typ)
+	return strings.TrimPrefix(typ, "application/")
+}
+
+// ValidateSigningMethodForKey returns an error if the provided signing method
+// does not belong to the algorithm family of the provided public key. ECDSA
+// signing methods must also match the curve of the key. Keys of other types
+// never match.
+func ValidateSigningMethodForKey(method jwt.SigningMethod, key interface{}) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return nil
+		}
+
+	case *ecdsa.PublicKey:
+		if m, ok := method.(*jwt.SigningMethodECDSA); ok {
+			if ecdsaCurveForSigningMethod(m) == k.Curve {
+				return nil
+			}
+		}
+
+	case ed25519.PublicKey:
+		if _, ok := method.(*SigningMethodEdwardsCurve); ok {
+			return nil
+		}
+
+	}
+
+	return ErrSigningMethodKeyMismatch
+}
+
+func ecdsaCurveForSigningMethod(method *jwt.SigningMethodECDSA) elliptic.Curve {
+	switch method {
+	case jwt.SigningMethodES256:
+		return elliptic.P256()
+	case jwt.SigningMethodES384:
+		return elliptic.P384()
+	case jwt.SigningMethodES512:
+		return elliptic.P521()
+	}
+
+	return nil
+}
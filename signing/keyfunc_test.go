@@ -0,0 +1,146 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestStrictKeyfunc(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaP384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519PublicKey, ed25519PrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(signingMethod jwt.SigningMethod, key interface{}, header map[string]interface{}) string {
+		token := jwt.NewWithClaims(signingMethod, jwt.MapClaims{"sub": "unittest"})
+		for k, v := range header {
+			token.Header[k] = v
+		}
+		signed, signErr := token.SignedString(key)
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		return signed
+	}
+
+	for _, test := range []struct {
+		name         string
+		token        string
+		verification interface{}
+		err          error
+	}{
+		{"rs256", sign(jwt.SigningMethodRS256, rsaKey, nil), rsaKey.Public(), nil},
+		{"ps256", sign(jwt.SigningMethodPS256, rsaKey, nil), rsaKey.Public(), nil},
+		{"es256", sign(jwt.SigningMethodES256, ecdsaKey, nil), ecdsaKey.Public(), nil},
+		{"eddsa", sign(SigningMethodEdDSA, ed25519PrivateKey, nil), ed25519PublicKey, nil},
+		{"hs256 with rsa public key bytes", sign(jwt.SigningMethodHS256, rsaPublicKeyBytes, nil), rsaPublicKeyBytes, ErrSigningMethodSymmetric},
+		{"hs256 with rsa public key", sign(jwt.SigningMethodHS256, rsaPublicKeyBytes, nil), rsaKey.Public(), ErrSigningMethodSymmetric},
+		{"none", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, nil), rsaKey.Public(), ErrSigningMethodNone},
+		{"none allowed", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, nil), jwt.UnsafeAllowNoneSignatureType, nil},
+		{"rs256 with ecdsa key", sign(jwt.SigningMethodRS256, rsaKey, nil), ecdsaKey.Public(), ErrSigningMethodKeyMismatch},
+		{"es256 with rsa key", sign(jwt.SigningMethodES256, ecdsaKey, nil), rsaKey.Public(), ErrSigningMethodKeyMismatch},
+		{"es256 with p384 key", sign(jwt.SigningMethodES256, ecdsaKey, nil), ecdsaP384Key.Public(), ErrSigningMethodKeyMismatch},
+		{"rs256 with key bytes", sign(jwt.SigningMethodRS256, rsaKey, nil), rsaPublicKeyBytes, ErrSigningMethodKeyMismatch},
+		{"crit", sign(jwt.SigningMethodRS256, rsaKey, map[string]interface{}{"crit": []string{"exp"}}), rsaKey.Public(), ErrCriticalHeader},
+	} {
+		var rejected error
+		keyfunc := StrictKeyfunc(func(token *jwt.Token) (interface{}, error) {
+			return test.verification, nil
+		}, func(token *jwt.Token, err error) {
+			rejected = err
+		})
+
+		_, err := jwt.Parse(test.token, keyfunc)
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			if rejected != nil {
+				t.Errorf("%s: unexpected reject: %v", test.name, rejected)
+			}
+			continue
+		}
+		if !IsStrictKeyfuncError(err) {
+			t.Errorf("%s: expected strict keyfunc error, got %v", test.name, err)
+		}
+		if rejected != test.err {
+			t.Errorf("%s: wrong reject: got %v want %v", test.name, rejected, test.err)
+		}
+	}
+}
+
+func TestTypedKeyfunc(t *testing.T) {
+	keyfunc := TypedKeyfunc(func(token *jwt.Token) (interface{}, error) {
+		return "key", nil
+	}, "JWT", "")
+
+	for _, test := range []struct {
+		typ interface{}
+		ok  bool
+	}{
+		{"JWT", true},
+		{"jwt", true},
+		{"application/jwt", true},
+		{nil, true},
+		{"at+jwt", false},
+		{"application/at+jwt", false},
+		{42, true},
+	} {
+		token := &jwt.Token{Header: map[string]interface{}{}}
+		if test.typ != nil {
+			token.Header["typ"] = test.typ
+		}
+		key, err := keyfunc(token)
+		if test.ok != (err == nil) {
+			t.Errorf("typ %v: unexpected result: %v", test.typ, err)
+		}
+		if !test.ok && (err != ErrTokenType || key != nil) {
+			t.Errorf("typ %v: unexpected rejection: %v %v", test.typ, key, err)
+		}
+	}
+
+	if _, err := TypedKeyfunc(func(token *jwt.Token) (interface{}, error) {
+		return "key", nil
+	}, "at+jwt")(&jwt.Token{Header: map[string]interface{}{}}); err != ErrTokenType {
+		t.Errorf("token without typ was accepted: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package pkcs11 provides crypto.Signer implementations for private keys
+// which are kept in PKCS#11 modules like hardware security modules, so that
+// the private key material never leaves the module.
+//
+// Support for PKCS#11 requires cgo and is only compiled in when building with
+// the pkcs11 build tag.
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URIScheme is the scheme prefix of PKCS#11 URIs as specified in
+// https://tools.ietf.org/html/rfc7512.
+const URIScheme = "pkcs11:"
+
+// ErrNotSupported is returned when PKCS#11 support is not compiled in.
+var ErrNotSupported = errors.New("pkcs11 support is not available in this build")
+
+// URI holds the attributes of a PKCS#11 URI which are used to find a token
+// and a private key object on it.
+type URI struct {
+	Token        string
+	Manufacturer string
+	Model        string
+	Serial       string
+	SlotID       *uint
+
+	Object string
+	ID     []byte
+
+	ModulePath string
+	PIN        string
+}
+
+// ParseURI parses the provided PKCS#11 URI. Only private key objects are
+// supported and at least one of the object or id attributes must be set.
+func ParseURI(value string) (*URI, error) {
+	if !strings.HasPrefix(value, URIScheme) {
+		return nil, fmt.Errorf("pkcs11 URI must start with %s", URIScheme)
+	}
+	value = strings.TrimPrefix(value, URIScheme)
+
+	u := &URI{}
+	path, query := value, ""
+	if idx := strings.Index(value, "?"); idx >= 0 {
+		path, query = value[:idx], value[idx+1:]
+	}
+
+	for _, attr := range splitAttributes(path, ";") {
+		name, v, err := parseAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "token":
+			u.Token = v
+		case "manufacturer":
+			u.Manufacturer = v
+		case "model":
+			u.Model = v
+		case "serial":
+			u.Serial = v
+		case "slot-id":
+			slotID, parseErr := strconv.ParseUint(v, 10, 0)
+			if parseErr != nil {
+				return nil, fmt.Errorf("invalid pkcs11 URI slot-id value: %v", v)
+			}
+			id := uint(slotID)
+			u.SlotID = &id
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		case "type":
+			if v != "private" {
+				return nil, fmt.Errorf("unsupported pkcs11 URI object type: %v", v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pkcs11 URI attribute: %v", name)
+		}
+	}
+
+	for _, attr := range splitAttributes(query, "&") {
+		name, v, err := parseAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.PIN = v
+		default:
+			return nil, fmt.Errorf("unsupported pkcs11 URI query attribute: %v", name)
+		}
+	}
+
+	if u.Object == "" && len(u.ID) == 0 {
+		return nil, errors.New("pkcs11 URI requires object or id attribute")
+	}
+
+	return u, nil
+}
+
+// matchesToken returns true if the provided token information matches the
+// token attributes of the accociated URI.
+func (u *URI) matchesToken(slotID uint, label, manufacturer, model, serial string) bool {
+	switch {
+	case u.SlotID != nil && *u.SlotID != slotID:
+		return false
+	case u.Token != "" && u.Token != label:
+		return false
+	case u.Manufacturer != "" && u.Manufacturer != manufacturer:
+		return false
+	case u.Model != "" && u.Model != model:
+		return false
+	case u.Serial != "" && u.Serial != serial:
+		return false
+	}
+
+	return true
+}
+
+func splitAttributes(value string, separator string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, separator)
+}
+
+func parseAttribute(attr string) (string, string, error) {
+	parts := strings.SplitN(attr, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid pkcs11 URI attribute: %v", attr)
+	}
+	value, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid pkcs11 URI attribute value: %v", err)
+	}
+
+	return parts[0], value, nil
+}
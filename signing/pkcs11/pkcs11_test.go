@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package pkcs11
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseURI(t *testing.T) {
+	u, err := ParseURI("pkcs11:token=My%20Token;serial=42;slot-id=3;object=signing-key;id=%01%02;type=private?module-path=/usr/lib/pkcs11.so&pin-value=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Token != "My Token" || u.Serial != "42" || u.SlotID == nil || *u.SlotID != 3 || u.Object != "signing-key" || !bytes.Equal(u.ID, []byte{1, 2}) {
+		t.Errorf("unexpected path attributes: %+v", u)
+	}
+	if u.ModulePath != "/usr/lib/pkcs11.so" || u.PIN != "1234" {
+		t.Errorf("unexpected query attributes: %+v", u)
+	}
+	if !u.matchesToken(3, "My Token", "", "", "42") || u.matchesToken(4, "My Token", "", "", "42") || u.matchesToken(3, "Other", "", "", "42") {
+		t.Errorf("unexpected token match result")
+	}
+
+	for _, invalid := range []string{
+		"file:/key.pem",
+		"pkcs11:token=konnect",
+		"pkcs11:object=key;type=public",
+		"pkcs11:object=key;unknown=value",
+		"pkcs11:object=key;slot-id=x",
+		"pkcs11:object=key?pin-source=/pin",
+		"pkcs11:object",
+		"pkcs11:object=%zz",
+	} {
+		if _, err := ParseURI(invalid); err == nil {
+			t.Errorf("invalid URI was accepted: %v", invalid)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+//go:build pkcs11 && cgo && !windows
+// +build pkcs11,cgo,!windows
+
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// hashPrefixes are the DER encoded DigestInfo prefixes required for PKCS #1
+// v1.5 signatures with CKM_RSA_PKCS, see
+// https://tools.ietf.org/html/rfc8017#section-9.2.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pssHashes maps hashes to the PKCS#11 hash and MGF types used for RSA PSS
+// signatures.
+var pssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// namedCurves maps the DER encoded CKA_EC_PARAMS of supported curves to the
+// curves.
+var namedCurves = map[string]elliptic.Curve{
+	string(mustMarshalOID(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})): elliptic.P256(),
+	string(mustMarshalOID(asn1.ObjectIdentifier{1, 3, 132, 0, 34})):          elliptic.P384(),
+	string(mustMarshalOID(asn1.ObjectIdentifier{1, 3, 132, 0, 35})):          elliptic.P521(),
+}
+
+// recoverableErrors are the PKCS#11 return values after which the session
+// is opened again, for example when the token was removed and inserted again
+// or the module restarted and dropped its sessions.
+var recoverableErrors = map[pkcs11.Error]bool{
+	pkcs11.CKR_DEVICE_ERROR:           true,
+	pkcs11.CKR_DEVICE_REMOVED:         true,
+	pkcs11.CKR_KEY_HANDLE_INVALID:     true,
+	pkcs11.CKR_OBJECT_HANDLE_INVALID:  true,
+	pkcs11.CKR_SESSION_CLOSED:         true,
+	pkcs11.CKR_SESSION_HANDLE_INVALID: true,
+	pkcs11.CKR_TOKEN_NOT_PRESENT:      true,
+	pkcs11.CKR_USER_NOT_LOGGED_IN:     true,
+}
+
+// modules holds the loaded PKCS#11 modules by path. Modules are initialized
+// once and kept loaded for the lifetime of the process.
+var (
+	modules      = make(map[string]*pkcs11.Ctx)
+	modulesMutex sync.Mutex
+)
+
+// signer implements crypto.Signer with a private key in a PKCS#11 module.
+type signer struct {
+	sync.Mutex
+
+	ctx *pkcs11.Ctx
+	uri *URI
+	pin string
+
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	open    bool
+
+	public crypto.PublicKey
+}
+
+// NewSigner returns a crypto.Signer for the private key referenced by the
+// provided PKCS#11 URI. The provided module path and PIN are used unless the
+// URI contains module-path or pin-value attributes.
+func NewSigner(uri string, modulePath string, pin string) (crypto.Signer, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.ModulePath != "" {
+		modulePath = u.ModulePath
+	}
+	if u.PIN != "" {
+		pin = u.PIN
+	}
+	if modulePath == "" {
+		return nil, errors.New("pkcs11 module path is required")
+	}
+
+	ctx, err := loadModule(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &signer{
+		ctx: ctx,
+		uri: u,
+		pin: pin,
+	}
+	public, err := s.openSession()
+	if err != nil {
+		return nil, err
+	}
+	s.public = public
+
+	return s, nil
+}
+
+// Public implements the crypto.Signer interface.
+func (s *signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements the crypto.Signer interface. RSA keys support PKCS #1 v1.5
+// and PSS signatures, ECDSA signatures are returned ASN.1 encoded.
+func (s *signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if len(digest) != hash.Size() {
+		return nil, errors.New("pkcs11: digest length does not match hash function")
+	}
+
+	var mechanism *pkcs11.Mechanism
+	data := digest
+
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			pssHash, ok := pssHashes[hash]
+			if !ok {
+				return nil, fmt.Errorf("pkcs11: unsupported hash function: %v", hash)
+			}
+			saltLength := pssOpts.SaltLength
+			if saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = hash.Size()
+			}
+			if saltLength <= 0 {
+				return nil, errors.New("pkcs11: explicit PSS salt length is required")
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(pssHash[0], pssHash[1], uint(saltLength)))
+		} else {
+			prefix, ok := hashPrefixes[hash]
+			if !ok {
+				return nil, fmt.Errorf("pkcs11: unsupported hash function: %v", hash)
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, errors.New("pkcs11: unsupported key type")
+	}
+
+	signature, err := s.sign(mechanism, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns the concatenated r and s values.
+		if len(signature) == 0 || len(signature)%2 != 0 {
+			return nil, errors.New("pkcs11: invalid ECDSA signature length")
+		}
+		half := len(signature) / 2
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			new(big.Int).SetBytes(signature[:half]),
+			new(big.Int).SetBytes(signature[half:]),
+		})
+	}
+
+	return signature, nil
+}
+
+// sign signs the provided data with the provided mechanism. When the session
+// is lost, it is opened again once and the signing is retried.
+func (s *signer) sign(mechanism *pkcs11.Mechanism, data []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if !s.open {
+			if err = s.reopenSession(); err != nil {
+				return nil, err
+			}
+		}
+
+		var signature []byte
+		if err = s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key); err == nil {
+			signature, err = s.ctx.Sign(s.session, data)
+		}
+		if err == nil {
+			return signature, nil
+		}
+		if !isRecoverable(err) {
+			break
+		}
+
+		s.closeSession()
+	}
+
+	return nil, wrapError("C_Sign", err)
+}
+
+// openSession opens a session on the token matching the URI of the
+// accociated signer, logs in and finds the private key. It returns the
+// public key of the private key.
+func (s *signer) openSession() (crypto.PublicKey, error) {
+	slot, err := findSlot(s.ctx, s.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, wrapError("C_OpenSession", err)
+	}
+	s.session = session
+	s.open = true
+
+	public, err := s.initialize()
+	if err != nil {
+		s.closeSession()
+		return nil, err
+	}
+
+	return public, nil
+}
+
+// reopenSession opens a new session and ensures that it still references
+// the key which was found when the accociated signer was created.
+func (s *signer) reopenSession() error {
+	public, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	if !publicKeysEqual(public, s.public) {
+		s.closeSession()
+		return errors.New("pkcs11: key changed after session was opened again")
+	}
+
+	return nil
+}
+
+// closeSession closes the session of the accociated signer, ignoring errors
+// since the session might already be gone.
+func (s *signer) closeSession() {
+	s.ctx.CloseSession(s.session)
+	s.open = false
+}
+
+// initialize logs in with the PIN and finds the private key and its public
+// key for the URI of the accociated signer.
+func (s *signer) initialize() (crypto.PublicKey, error) {
+	if s.pin != "" {
+		if err := s.ctx.Login(s.session, pkcs11.CKU_USER, s.pin); err != nil && !isError(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, wrapError("C_Login", err)
+		}
+	}
+
+	var err error
+	s.key, err = s.findObject(pkcs11.CKO_PRIVATE_KEY, s.uri.ID, s.uri.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	keyType, err := s.getAttribute(s.key, pkcs11.CKA_KEY_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(keyType, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA).Value):
+		modulus, err := s.getAttribute(s.key, pkcs11.CKA_MODULUS)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := s.getAttribute(s.key, pkcs11.CKA_PUBLIC_EXPONENT)
+		if err != nil {
+			return nil, err
+		}
+		e := new(big.Int).SetBytes(exponent)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("pkcs11: unsupported RSA public exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(e.Int64()),
+		}, nil
+
+	case bytes.Equal(keyType, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC).Value):
+		// The EC point is only available on the public key object.
+		id, err := s.getAttribute(s.key, pkcs11.CKA_ID)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, id, "")
+		if err != nil {
+			return nil, err
+		}
+		params, err := s.getAttribute(publicKey, pkcs11.CKA_EC_PARAMS)
+		if err != nil {
+			return nil, err
+		}
+		curve, ok := namedCurves[string(params)]
+		if !ok {
+			return nil, errors.New("pkcs11: unsupported EC curve")
+		}
+		point, err := s.getAttribute(publicKey, pkcs11.CKA_EC_POINT)
+		if err != nil {
+			return nil, err
+		}
+		// CKA_EC_POINT is a DER encoded octet string, but some modules
+		// return the raw point.
+		var raw []byte
+		if rest, unmarshalErr := asn1.Unmarshal(point, &raw); unmarshalErr == nil && len(rest) == 0 {
+			point = raw
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("pkcs11: invalid EC point")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     x,
+			Y:     y,
+		}, nil
+
+	default:
+		return nil, errors.New("pkcs11: unsupported key type")
+	}
+}
+
+// findObject returns the single object of the provided class matching the
+// provided id and label.
+func (s *signer) findObject(class uint, id []byte, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	}
+	if len(id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+	if label != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, wrapError("C_FindObjectsInit", err)
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, wrapError("C_FindObjects", err)
+	}
+	switch len(objects) {
+	case 0:
+		return 0, errors.New("pkcs11: no matching key found")
+	case 1:
+		return objects[0], nil
+	default:
+		return 0, errors.New("pkcs11: multiple matching keys found")
+	}
+}
+
+// getAttribute returns the value of the attribute with the provided type of
+// the provided object.
+func (s *signer) getAttribute(object pkcs11.ObjectHandle, attributeType uint) ([]byte, error) {
+	attributes, err := s.ctx.GetAttributeValue(s.session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(attributeType, nil),
+	})
+	if err != nil {
+		return nil, wrapError("C_GetAttributeValue", err)
+	}
+	if len(attributes) != 1 {
+		return nil, errors.New("pkcs11: attribute not found")
+	}
+
+	return attributes[0].Value, nil
+}
+
+// loadModule loads and initializes the PKCS#11 module at the provided path
+// unless already loaded.
+func loadModule(path string) (*pkcs11.Ctx, error) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	if ctx, ok := modules[path]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: failed to load module %v", path)
+	}
+	if err := ctx.Initialize(); err != nil && !isError(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, wrapError("C_Initialize", err)
+	}
+	modules[path] = ctx
+
+	return ctx, nil
+}
+
+// findSlot returns the slot with the initialized token matching the provided
+// URI.
+func findSlot(ctx *pkcs11.Ctx, u *URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, wrapError("C_GetSlotList", err)
+	}
+	if len(slots) == 0 {
+		return 0, errors.New("pkcs11: no token found")
+	}
+
+	var matches []uint
+	for _, slot := range slots {
+		info, infoErr := ctx.GetTokenInfo(slot)
+		if infoErr != nil {
+			return 0, wrapError("C_GetTokenInfo", infoErr)
+		}
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			continue
+		}
+		if u.matchesToken(slot,
+			trimPadded(info.Label),
+			trimPadded(info.ManufacturerID),
+			trimPadded(info.Model),
+			trimPadded(info.SerialNumber),
+		) {
+			matches = append(matches, slot)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, errors.New("pkcs11: no matching token found")
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, errors.New("pkcs11: multiple matching tokens found, set token or slot-id attribute")
+	}
+}
+
+// isRecoverable returns true if the provided error is a PKCS#11 error after
+// which opening a new session might succeed.
+func isRecoverable(err error) bool {
+	rv, ok := err.(pkcs11.Error)
+	return ok && recoverableErrors[rv]
+}
+
+func isError(err error, rv pkcs11.Error) bool {
+	e, ok := err.(pkcs11.Error)
+	return ok && e == rv
+}
+
+func wrapError(name string, err error) error {
+	if rv, ok := err.(pkcs11.Error); ok {
+		return fmt.Errorf("pkcs11: %s failed: %v (0x%x)", name, rv, uint(rv))
+	}
+	return fmt.Errorf("pkcs11: %s failed: %v", name, err)
+}
+
+// publicKeysEqual returns true if the provided public keys are the same RSA
+// or ECDSA key.
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	switch ka := a.(type) {
+	case *rsa.PublicKey:
+		kb, ok := b.(*rsa.PublicKey)
+		return ok && ka.E == kb.E && ka.N.Cmp(kb.N) == 0
+	case *ecdsa.PublicKey:
+		kb, ok := b.(*ecdsa.PublicKey)
+		return ok && ka.Curve == kb.Curve && ka.X.Cmp(kb.X) == 0 && ka.Y.Cmp(kb.Y) == 0
+	default:
+		return false
+	}
+}
+
+func trimPadded(value string) string {
+	return strings.TrimRight(value, " \x00")
+}
+
+func mustMarshalOID(oid asn1.ObjectIdentifier) []byte {
+	b, err := asn1.Marshal(oid)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
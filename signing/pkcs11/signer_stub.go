@@ -0,0 +1,31 @@
+//go:build !pkcs11 || !cgo || windows
+// +build !pkcs11 !cgo windows
+
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package pkcs11
+
+import (
+	"crypto"
+)
+
+// NewSigner returns ErrNotSupported, since konnect was built without PKCS#11
+// support.
+func NewSigner(uri string, modulePath string, pin string) (crypto.Signer, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,92 @@
+//go:build pkcs11 && cgo && !windows
+// +build pkcs11,cgo,!windows
+
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestIsRecoverable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"session handle invalid", pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID), true},
+		{"session closed", pkcs11.Error(pkcs11.CKR_SESSION_CLOSED), true},
+		{"device removed", pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), true},
+		{"token not present", pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT), true},
+		{"user not logged in", pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN), true},
+		{"key handle invalid", pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID), true},
+		{"mechanism invalid", pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID), false},
+		{"pin incorrect", pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), false},
+		{"other error", errors.New("other"), false},
+	}
+
+	for _, test := range tests {
+		if recoverable := isRecoverable(test.err); recoverable != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, recoverable, test.expected)
+		}
+	}
+}
+
+func TestPublicKeysEqual(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaCopy := &rsa.PublicKey{N: rsaKey.N, E: rsaKey.E}
+	ecdsaCopy := &ecdsa.PublicKey{Curve: elliptic.P256(), X: ecdsaKey.X, Y: ecdsaKey.Y}
+
+	tests := []struct {
+		name     string
+		a, b     interface{}
+		expected bool
+	}{
+		{"same rsa key", &rsaKey.PublicKey, rsaCopy, true},
+		{"other rsa key", &rsaKey.PublicKey, &otherRSAKey.PublicKey, false},
+		{"same ecdsa key", &ecdsaKey.PublicKey, ecdsaCopy, true},
+		{"rsa and ecdsa key", &rsaKey.PublicKey, &ecdsaKey.PublicKey, false},
+		{"unsupported key", "key", "key", false},
+	}
+
+	for _, test := range tests {
+		if equal := publicKeysEqual(test.a, test.b); equal != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, equal, test.expected)
+		}
+	}
+}
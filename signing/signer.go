@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SignerSigningMethod wraps a jwt.SigningMethod to sign with any crypto.Signer
+// with a matching public key, for example with keys which are kept in a
+// hardware security module. Verification is done by the wrapped signing
+// method.
+type SignerSigningMethod struct {
+	jwt.SigningMethod
+}
+
+// SigningMethodForSigner returns the provided signing method if it can sign
+// with the provided signer directly, otherwise the provided signing method is
+// returned wrapped as SignerSigningMethod.
+func SigningMethodForSigner(signingMethod jwt.SigningMethod, signer crypto.Signer) jwt.SigningMethod {
+	native := false
+	switch signingMethod.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, native = signer.(*rsa.PrivateKey)
+	case *jwt.SigningMethodECDSA:
+		_, native = signer.(*ecdsa.PrivateKey)
+	case *SigningMethodEdwardsCurve:
+		_, native = signer.(ed25519.PrivateKey)
+	}
+	if native {
+		return signingMethod
+	}
+
+	return &SignerSigningMethod{signingMethod}
+}
+
+// Sign implements the jwt.SigningMethod interface.
+func (m *SignerSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	var opts crypto.SignerOpts
+	switch sm := m.SigningMethod.(type) {
+	case *jwt.SigningMethodRSAPSS:
+		// NOTE: Use the hash size as salt length, since not all hardware
+		// supports PSS with the maximum salt length.
+		opts = &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       sm.Hash,
+		}
+	case *jwt.SigningMethodRSA:
+		opts = sm.Hash
+	case *jwt.SigningMethodECDSA:
+		opts = sm.Hash
+	case *SigningMethodEdwardsCurve:
+		opts = crypto.Hash(0)
+	default:
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	digest := []byte(signingString)
+	if hash := opts.HashFunc(); hash != 0 {
+		if !hash.Available() {
+			return "", jwt.ErrHashUnavailable
+		}
+		hasher := hash.New()
+		hasher.Write(digest)
+		digest = hasher.Sum(nil)
+	}
+
+	sig, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if sm, ok := m.SigningMethod.(*jwt.SigningMethodECDSA); ok {
+		// Signers return ASN.1 encoded ECDSA signatures, but JWS requires the
+		// concatenated fixed size values, see
+		// https://tools.ietf.org/html/rfc7518#section-3.4.
+		sig, err = ecdsaSignatureToJWS(sig, sm.KeySize)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return jwt.EncodeSegment(sig), nil
+}
+
+// ecdsaSignatureToJWS converts the provided ASN.1 encoded ECDSA signature to
+// the JWS format with the provided key size.
+func ecdsaSignatureToJWS(sig []byte, keySize int) ([]byte, error) {
+	var values struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &values)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("ecdsa: trailing data after signature")
+	}
+
+	r := values.R.Bytes()
+	s := values.S.Bytes()
+	if len(r) > keySize || len(s) > keySize {
+		return nil, errors.New("ecdsa: signature does not match key size")
+	}
+	out := make([]byte, 2*keySize)
+	copy(out[keySize-len(r):keySize], r)
+	copy(out[2*keySize-len(s):], s)
+
+	return out, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// opaqueSigner hides the type of the wrapped signer, like signers backed by
+// hardware security modules.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestSignerSigningMethod(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecKey384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecKey521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, test := range []struct {
+		signingMethod jwt.SigningMethod
+		key           crypto.Signer
+	}{
+		{jwt.SigningMethodRS256, rsaKey},
+		{jwt.SigningMethodRS512, rsaKey},
+		{jwt.SigningMethodPS256, rsaKey},
+		{jwt.SigningMethodPS384, rsaKey},
+		{jwt.SigningMethodES256, ecKey256},
+		{jwt.SigningMethodES384, ecKey384},
+		{jwt.SigningMethodES512, ecKey521},
+		{SigningMethodEdDSA, edKey},
+	} {
+		if SigningMethodForSigner(test.signingMethod, test.key) != test.signingMethod {
+			t.Errorf("%s: native signer was wrapped", test.signingMethod.Alg())
+		}
+
+		signer := &opaqueSigner{test.key}
+		signingMethod := SigningMethodForSigner(test.signingMethod, signer)
+		if _, ok := signingMethod.(*SignerSigningMethod); !ok {
+			t.Fatalf("%s: opaque signer was not wrapped", test.signingMethod.Alg())
+		}
+
+		tokenString, err := jwt.NewWithClaims(signingMethod, jwt.StandardClaims{Subject: "test"}).SignedString(signer)
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", test.signingMethod.Alg(), err)
+		}
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if token.Method != test.signingMethod {
+				t.Errorf("%s: unexpected signing method: %v", test.signingMethod.Alg(), token.Header["alg"])
+			}
+			return test.key.Public(), nil
+		})
+		if err != nil || !token.Valid {
+			t.Errorf("%s: failed to verify: %v", test.signingMethod.Alg(), err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Sampler names as specified for the OTEL_TRACES_SAMPLER environment variable
+// at https://opentelemetry.io/docs/specs/otel/configuration/sdk-environment-variables/.
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+// A Sampler decides which traces get spans. Root spans are sampled by the
+// trace ID ratio, spans with a remote parent follow the sampled flag of the
+// parent if the Sampler is parent based. A nil Sampler samples like
+// parentbased_always_on.
+type Sampler struct {
+	parentBased bool
+	bound       uint64
+}
+
+// NewSampler creates a new Sampler with the provided name and argument as
+// used by OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG. The argument is the
+// sampling probability of the trace ID ratio samplers and defaults to 1.
+func NewSampler(name string, arg string) (*Sampler, error) {
+	ratio := 1.0
+	if arg != "" && (name == SamplerTraceIDRatio || name == SamplerParentBasedTraceIDRatio) {
+		var err error
+		ratio, err = strconv.ParseFloat(arg, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid sampler ratio, must be between 0 and 1: %v", arg)
+		}
+	}
+
+	s := &Sampler{}
+	switch name {
+	case "", SamplerParentBasedAlwaysOn:
+		s.parentBased = true
+	case SamplerAlwaysOn:
+	case SamplerAlwaysOff:
+		ratio = 0
+	case SamplerTraceIDRatio:
+	case SamplerParentBasedAlwaysOff:
+		s.parentBased = true
+		ratio = 0
+	case SamplerParentBasedTraceIDRatio:
+		s.parentBased = true
+	default:
+		return nil, fmt.Errorf("unsupported sampler: %v", name)
+	}
+
+	// NOTE: Same bound as the OpenTelemetry SDKs use, so all services of a
+	// trace with the same ratio come to the same decision.
+	if ratio >= 1 {
+		s.bound = 1 << 63
+	} else {
+		s.bound = uint64(ratio * (1 << 63))
+	}
+
+	return s, nil
+}
+
+// shouldSample returns true if a span with the provided trace ID should be
+// sampled. The remote parent state is only considered if remote is true.
+func (s *Sampler) shouldSample(traceID [16]byte, remote bool, remoteSampled bool) bool {
+	if s == nil {
+		return !remote || remoteSampled
+	}
+	if remote && s.parentBased {
+		return remoteSampled
+	}
+	if s.bound >= 1<<63 {
+		return true
+	}
+
+	return binary.BigEndian.Uint64(traceID[8:16])>>1 < s.bound
+}
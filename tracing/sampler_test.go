@@ -0,0 +1,74 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"testing"
+)
+
+func TestNewSampler(t *testing.T) {
+	low := [16]byte{8: 0x00, 9: 0x01}
+	high := [16]byte{8: 0xff, 9: 0xff}
+
+	tests := []struct {
+		name    string
+		sampler string
+		arg     string
+		err     bool
+
+		root          [2]bool // For low and high trace ID.
+		remoteSampled bool
+		remoteDropped bool
+	}{
+		{"default", "", "", false, [2]bool{true, true}, true, false},
+		{"always on", SamplerAlwaysOn, "", false, [2]bool{true, true}, true, true},
+		{"always off", SamplerAlwaysOff, "", false, [2]bool{false, false}, false, false},
+		{"ratio", SamplerTraceIDRatio, "0.5", false, [2]bool{true, false}, false, true},
+		{"ratio zero", SamplerTraceIDRatio, "0", false, [2]bool{false, false}, false, false},
+		{"parent based off", SamplerParentBasedAlwaysOff, "", false, [2]bool{false, false}, true, false},
+		{"parent based ratio", SamplerParentBasedTraceIDRatio, "0.5", false, [2]bool{true, false}, true, false},
+		{"invalid ratio", SamplerTraceIDRatio, "2", true, [2]bool{}, false, false},
+		{"unsupported", "jaeger_remote", "", true, [2]bool{}, false, false},
+	}
+
+	for _, test := range tests {
+		sampler, err := NewSampler(test.sampler, test.arg)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if sampled := sampler.shouldSample(low, false, false); sampled != test.root[0] {
+			t.Errorf("%s: low root sampled %v, expected %v", test.name, sampled, test.root[0])
+		}
+		if sampled := sampler.shouldSample(high, false, false); sampled != test.root[1] {
+			t.Errorf("%s: high root sampled %v, expected %v", test.name, sampled, test.root[1])
+		}
+		if sampled := sampler.shouldSample(high, true, true); sampled != test.remoteSampled {
+			t.Errorf("%s: sampled remote parent sampled %v, expected %v", test.name, sampled, test.remoteSampled)
+		}
+		if sampled := sampler.shouldSample(low, true, false); sampled != test.remoteDropped {
+			t.Errorf("%s: not sampled remote parent sampled %v, expected %v", test.name, sampled, test.remoteDropped)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultServiceName is the service.name resource attribute of exported spans
+// if not configured otherwise.
+const DefaultServiceName = "konnectd"
+
+// instrumentationScope is the name of the instrumentation scope of exported
+// spans.
+const instrumentationScope = "stash.kopano.io/kc/konnect"
+
+// Export settings.
+const (
+	exportQueueSize = 2048
+	exportBatchSize = 512
+	exportInterval  = 5 * time.Second
+	exportTimeout   = 10 * time.Second
+)
+
+// A Tracer creates spans and exports them in batches to an OpenTelemetry
+// collector using OTLP/HTTP with JSON encoding. All methods are safe to be
+// called on a nil Tracer, which creates no spans.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+
+	client  *http.Client
+	queue   chan *Span
+	sampler *Sampler
+
+	logger logrus.FieldLogger
+}
+
+// NewTracer creates a new Tracer which exports spans to the OTLP/HTTP
+// collector at the provided endpoint URL. If the endpoint has no path, the
+// default OTLP traces path is used. The provided client is used for export
+// requests, if nil a default client is used. The provided sampler decides
+// which traces get spans, if nil all traces which are not propagated as not
+// sampled get spans.
+func NewTracer(endpoint string, serviceName string, client *http.Client, sampler *Sampler, logger logrus.FieldLogger) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint, must be a http or https URL: %v", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	if client == nil {
+		client = &http.Client{
+			Timeout: exportTimeout,
+		}
+	}
+
+	return &Tracer{
+		endpoint:    u.String(),
+		serviceName: serviceName,
+
+		client:  client,
+		queue:   make(chan *Span, exportQueueSize),
+		sampler: sampler,
+
+		logger: logger,
+	}, nil
+}
+
+// Run exports ended spans in batches until the provided context is done,
+// then exports the remaining spans and returns.
+func (t *Tracer) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(batch); err != nil {
+			t.logger.WithError(err).WithField("spans", len(batch)).Warnln("failed to export trace spans")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= exportBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *Tracer) newSpan(name string, kind SpanKind, attributes []Attribute) *Span {
+	span := &Span{
+		tracer: t,
+
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+	rand.Read(span.spanID[:])
+
+	return span
+}
+
+// export queues the provided ended span for export. Spans are dropped if
+// the queue is full, to never block the caller.
+func (t *Tracer) export(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		t.logger.Debugln("trace span export queue full, span dropped")
+	}
+}
+
+// send exports the provided spans to the accociated collector.
+func (t *Tracer) send(spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// OTLP JSON encoding as specified at
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func newOTLPAttribute(attribute Attribute) otlpAttribute {
+	var value map[string]interface{}
+	switch v := attribute.Value.(type) {
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		value = map[string]interface{}{"boolValue": v}
+	case string:
+		value = map[string]interface{}{"stringValue": v}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+	}
+
+	return otlpAttribute{attribute.Key, value}
+}
+
+func (t *Tracer) encode(spans []*Span) *otlpTraces {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mutex.Lock()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parentSpanID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentSpanID[:])
+		}
+		for _, attribute := range span.attributes {
+			s.Attributes = append(s.Attributes, newOTLPAttribute(attribute))
+		}
+		if span.failed {
+			s.Status = &otlpStatus{
+				Code:    2, // Error.
+				Message: strings.TrimSpace(span.errorString),
+			}
+		}
+		span.mutex.Unlock()
+		encoded = append(encoded, s)
+	}
+
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newOTLPAttribute(String("service.name", t.serviceName))},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: instrumentationScope},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
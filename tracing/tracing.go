@@ -0,0 +1,332 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package tracing provides minimal distributed tracing with spans propagated
+// using W3C Trace Context headers and exported to an OpenTelemetry collector.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the HTTP header which propagates trace context as
+// specified at https://www.w3.org/TR/trace-context/#traceparent-header.
+const TraceparentHeader = "traceparent"
+
+// SpanKind describes the relationship of a Span to its parent and children.
+type SpanKind int
+
+// Span kinds as defined by OpenTelemetry.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// An Attribute is a key value pair describing a Span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string Attribute.
+func String(key string, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an integer Attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// Bool returns a boolean Attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+// A Span is a timed operation of a trace. All methods are safe to be called
+// on a nil Span, which does nothing.
+type Span struct {
+	tracer *Tracer
+
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+
+	name  string
+	kind  SpanKind
+	start time.Time
+
+	mutex       sync.Mutex
+	end         time.Time
+	attributes  []Attribute
+	errorString string
+	failed      bool
+}
+
+// SetAttributes adds the provided attributes to the associated Span.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.attributes = append(s.attributes, attributes...)
+	s.mutex.Unlock()
+}
+
+// SetError marks the associated Span as failed with the provided error. A nil
+// error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.failed = true
+	s.errorString = err.Error()
+	s.mutex.Unlock()
+}
+
+// End completes the associated Span and hands it to the exporter. Calling End
+// more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mutex.Unlock()
+
+	if !ended {
+		s.tracer.export(s)
+	}
+}
+
+// Traceparent returns the W3C traceparent header value of the associated
+// Span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+type contextKey int
+
+const (
+	tracerContextKey contextKey = iota
+	spanContextKey
+)
+
+// NewContext returns a copy of the provided context with the provided Tracer,
+// used by Start to create root spans.
+func NewContext(ctx context.Context, tracer *Tracer) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, tracerContextKey, tracer)
+}
+
+// SpanFromContext returns the current Span of the provided context if any.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey).(*Span)
+	return span
+}
+
+// Start creates a new internal Span with the provided name and attributes.
+// The span is a child of the current span of the provided context, or a root
+// span if the context has a Tracer but no span. Otherwise no span is created
+// and the returned Span is nil. The returned context holds the new span.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	return start(ctx, name, SpanKindInternal, attributes)
+}
+
+func start(ctx context.Context, name string, kind SpanKind, attributes []Attribute) (context.Context, *Span) {
+	var span *Span
+	if parent := SpanFromContext(ctx); parent != nil {
+		span = parent.tracer.newSpan(name, kind, attributes)
+		span.traceID = parent.traceID
+		span.parentSpanID = parent.spanID
+	} else if tracer, _ := ctx.Value(tracerContextKey).(*Tracer); tracer != nil {
+		var traceID [16]byte
+		rand.Read(traceID[:])
+		if !tracer.sampler.shouldSample(traceID, false, false) {
+			return withoutTracer(ctx), nil
+		}
+		span = tracer.newSpan(name, kind, attributes)
+		span.traceID = traceID
+	} else {
+		return ctx, nil
+	}
+
+	return context.WithValue(ctx, spanContextKey, span), span
+}
+
+// withoutTracer returns a copy of the provided context without Tracer, so
+// that no spans are created for a trace which is not sampled.
+func withoutTracer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tracerContextKey, (*Tracer)(nil))
+}
+
+// StartServer creates a new server Span for the provided incoming request
+// which continues the trace of the request's traceparent header if valid.
+// Requests which are not sampled by the Sampler of the accociated Tracer get
+// no span.
+func (t *Tracer) StartServer(ctx context.Context, req *http.Request) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	traceID, parentSpanID, sampled, ok := parseTraceparent(req.Header.Get(TraceparentHeader))
+	if !ok {
+		rand.Read(traceID[:])
+	}
+	if !t.sampler.shouldSample(traceID, ok, sampled) {
+		return withoutTracer(ctx), nil
+	}
+
+	ctx = NewContext(ctx, t)
+	span := t.newSpan("HTTP "+req.Method, SpanKindServer, []Attribute{
+		String("http.method", req.Method),
+		String("http.target", req.URL.Path),
+	})
+	span.traceID = traceID
+	if ok {
+		span.parentSpanID = parentSpanID
+	}
+
+	return context.WithValue(ctx, spanContextKey, span), span
+}
+
+// parseTraceparent parses the provided W3C traceparent header value.
+func parseTraceparent(value string) (traceID [16]byte, spanID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return
+	}
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return
+	}
+
+	return traceID, spanID, flags[0]&0x01 == 0x01, true
+}
+
+// Transport returns a http.RoundTripper which creates a client span for each
+// request made with a context holding a span or tracer and propagates it to
+// the server with the traceparent header. The span ends when the response
+// body was read or closed. If base is nil, http.DefaultTransport is used.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, span := start(req.Context(), "HTTP "+req.Method, SpanKindClient, []Attribute{
+		String("http.method", req.Method),
+		String("http.host", req.URL.Host),
+		String("http.target", req.URL.Path),
+	})
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	// Requests must not be modified by round trippers, thus clone.
+	propagated := req.WithContext(req.Context())
+	propagated.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		propagated.Header[key] = values
+	}
+	propagated.Header.Set(TraceparentHeader, span.Traceparent())
+
+	response, err := t.base.RoundTrip(propagated)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(Int("http.status_code", response.StatusCode))
+	if response.Body == nil {
+		span.End()
+		return response, nil
+	}
+
+	// NOTE: The span covers reading the body, since the request is not
+	// complete before.
+	response.Body = &spanBody{response.Body, span}
+
+	return response, nil
+}
+
+// spanBody ends the accociated span when the wrapped response body was read
+// completely, failed or was closed.
+type spanBody struct {
+	io.ReadCloser
+	span *Span
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		if err != io.EOF {
+			b.span.SetError(err)
+		}
+		b.span.End()
+	}
+
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+
+	return err
+}
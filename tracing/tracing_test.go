@@ -0,0 +1,198 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-xbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		_, _, sampled, ok := parseTraceparent(test.value)
+		if ok != test.ok || sampled != test.sampled {
+			t.Errorf("parseTraceparent(%#v) = sampled %v ok %v, expected sampled %v ok %v", test.value, sampled, ok, test.sampled, test.ok)
+		}
+	}
+}
+
+func TestSpansAndExport(t *testing.T) {
+	received := make(chan *otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export path: %v", req.URL.Path)
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(req.Body).Decode(&traces); err != nil {
+			t.Errorf("failed to decode export: %v", err)
+		}
+		received <- &traces
+	}))
+	defer collector.Close()
+
+	tracer, err := NewTracer(collector.URL, "", nil, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/konnect/v1/token", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, server := tracer.StartServer(context.Background(), req)
+	if server == nil {
+		t.Fatal("expected server span")
+	}
+	if SpanFromContext(ctx) != server {
+		t.Error("expected server span in context")
+	}
+	_, child := Start(ctx, "jwt.sign", String("alg", "ES256"))
+	if child == nil {
+		t.Fatal("expected child span")
+	}
+	if child.traceID != server.traceID || child.parentSpanID != server.spanID {
+		t.Error("child span is not a child of the server span")
+	}
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End()
+	server.End()
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracer.Run(runCtx)
+
+	traces := <-received
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export: %#v", traces)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "jwt.sign" || spans[0].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected child span: %#v", spans[0])
+	}
+	if spans[0].Status == nil || spans[0].Status.Code != 2 {
+		t.Errorf("expected child span error status: %#v", spans[0].Status)
+	}
+	if spans[1].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected server span parent: %v", spans[1].ParentSpanID)
+	}
+}
+
+func TestStartServerNotSampled(t *testing.T) {
+	tracer, err := NewTracer("http://127.0.0.1:4318", "", nil, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	ctx, span := tracer.StartServer(context.Background(), req)
+	if span != nil {
+		t.Error("expected no span for unsampled request")
+	}
+	if _, child := Start(ctx, "child"); child != nil {
+		t.Error("expected no child span for unsampled request")
+	}
+}
+
+func TestStartNotSampled(t *testing.T) {
+	sampler, err := NewSampler(SamplerAlwaysOff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer, err := NewTracer("http://127.0.0.1:4318", "", nil, sampler, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := Start(NewContext(context.Background(), tracer), "root")
+	if span != nil {
+		t.Error("expected no root span for unsampled trace")
+	}
+	if _, child := Start(ctx, "child"); child != nil {
+		t.Error("expected no child span for unsampled trace")
+	}
+}
+
+func TestTransportEndsSpanAfterBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(TraceparentHeader) == "" {
+			t.Error("expected traceparent header")
+		}
+		rw.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	tracer, err := NewTracer("http://127.0.0.1:4318", "", nil, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := Start(NewContext(context.Background(), tracer), "root")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	response, err := Transport(nil).RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.queue) != 0 {
+		t.Error("expected client span to not have ended before the body was read")
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("unexpected body: %v %v", string(body), err)
+	}
+	if len(tracer.queue) != 1 {
+		t.Fatalf("expected client span to have ended after the body was read, got %d spans", len(tracer.queue))
+	}
+	response.Body.Close()
+	if len(tracer.queue) != 1 {
+		t.Errorf("expected client span to end once, got %d spans", len(tracer.queue))
+	}
+
+	span := <-tracer.queue
+	if span.kind != SpanKindClient || span.parentSpanID != root.spanID {
+		t.Errorf("unexpected client span: %#v", span)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// BearerTokenFromRequest returns the token of the Authorization header of the
+// provided request as specified at https://tools.ietf.org/html/rfc6750#section-2.1.
+// The returned bool is true if the header uses the Bearer scheme, which is
+// matched case insensitively, the returned token might be empty even then.
+func BearerTokenFromRequest(req *http.Request) (string, bool) {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if !strings.EqualFold(auth[0], "Bearer") {
+		return "", false
+	}
+	if len(auth) != 2 {
+		return "", true
+	}
+
+	return strings.TrimSpace(auth[1]), true
+}
+
+// RequireBearerToken returns true if the provided request has the provided
+// token as Bearer token, compared in constant time. Otherwise it writes an
+// unauthorized response to the provided ResponseWriter and returns false.
+// Requests are always rejected if the provided token is empty.
+func RequireBearerToken(rw http.ResponseWriter, req *http.Request, token []byte) bool {
+	if len(token) > 0 {
+		if value, ok := BearerTokenFromRequest(req); ok && subtle.ConstantTimeCompare([]byte(value), token) == 1 {
+			return true
+		}
+	}
+
+	rw.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
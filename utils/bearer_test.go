@@ -0,0 +1,81 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerTokenFromRequest(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"", "", false},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"Bearer secret", "secret", true},
+		{"bearer secret", "secret", true},
+		{"BEARER secret ", "secret", true},
+		{"Bearer", "", true},
+		{"Bearersecret", "", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		token, ok := BearerTokenFromRequest(req)
+		if token != test.token || ok != test.ok {
+			t.Errorf("header %#v: got %#v %v, want %#v %v", test.header, token, ok, test.token, test.ok)
+		}
+	}
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	for _, test := range []struct {
+		token    string
+		header   string
+		expected bool
+	}{
+		{"secret", "Bearer secret", true},
+		{"secret", "bearer secret", true},
+		{"secret", "Bearer wrong", false},
+		{"secret", "Bearer secre", false},
+		{"secret", "Basic secret", false},
+		{"secret", "", false},
+		{"", "Bearer ", false},
+		{"", "", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rr := httptest.NewRecorder()
+		if ok := RequireBearerToken(rr, req, []byte(test.token)); ok != test.expected {
+			t.Errorf("token %#v with header %#v: got %v want %v", test.token, test.header, ok, test.expected)
+		}
+		if test.expected {
+			continue
+		}
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %#v with header %#v: wrong response %d %v", test.token, test.header, rr.Code, rr.Header())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ClientCertificateFromRequest returns the TLS client certificate of the
+// provided request. If the request has no TLS peer certificates and the
+// provided header is not empty, the certificate is read from that header as
+// forwarded by a TLS terminating proxy. The header value can either be an URL
+// escaped PEM or a base64 encoded DER certificate. Returns nil without error
+// if no certificate was found.
+func ClientCertificateFromRequest(req *http.Request, header string) (*x509.Certificate, error) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0], nil
+	}
+
+	if header == "" {
+		return nil, nil
+	}
+	value := req.Header.Get(header)
+	if value == "" {
+		return nil, nil
+	}
+
+	var der []byte
+	if unescaped, err := url.QueryUnescape(value); err == nil && strings.HasPrefix(unescaped, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(unescaped))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("invalid client certificate PEM data")
+		}
+		der = block.Bytes
+	} else {
+		der, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, errors.New("invalid client certificate data")
+		}
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// CertificateThumbprintS256 returns the base64url encoded SHA-256 thumbprint
+// of the provided certificate as used in x5t#S256 values.
+func CertificateThumbprintS256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ReadCertificatesPEM returns the PEM encoded certificates referenced by the
+// provided value. Values starting with a PEM header are used as is, other
+// values are read like ReadSecret with file: as default scheme. Returns error
+// if the data contains no valid certificate.
+func ReadCertificatesPEM(value string) ([]byte, error) {
+	var data []byte
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		data = []byte(value)
+	} else {
+		var err error
+		data, err = ReadSecret(value, SecretSchemeFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return nil, errors.New("no valid PEM encoded certificates found")
+	}
+
+	return data, nil
+}
+
+// NewCertPoolFromPEM returns a new x509.CertPool with the system roots and the
+// certificates of the provided PEM encoded data.
+func NewCertPoolFromPEM(data []byte) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid PEM encoded certificates found")
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(tb testing.TB, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestClientCertificateFromRequest(t *testing.T) {
+	peer := newTestCertificate(t, "peer")
+	forwarded := newTestCertificate(t, "forwarded")
+	forwardedPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: forwarded.Raw}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: forwarded.Raw}))
+
+	for _, test := range []struct {
+		name     string
+		tls      bool
+		header   string
+		value    string
+		expected *x509.Certificate
+		valid    bool
+	}{
+		{"none", false, "X-SSL-Client-Cert", "", nil, true},
+		{"peer", true, "", "", peer, true},
+		{"peer before header", true, "X-SSL-Client-Cert", url.QueryEscape(forwardedPEM), peer, true},
+		{"header disabled", false, "", url.QueryEscape(forwardedPEM), nil, true},
+		{"escaped pem", false, "X-SSL-Client-Cert", url.QueryEscape(forwardedPEM), forwarded, true},
+		{"base64 der", false, "X-SSL-Client-Cert", base64.StdEncoding.EncodeToString(forwarded.Raw), forwarded, true},
+		{"truncated pem", false, "X-SSL-Client-Cert", url.QueryEscape(forwardedPEM[:40]), nil, false},
+		{"wrong pem type", false, "X-SSL-Client-Cert", url.QueryEscape(keyPEM), nil, false},
+		{"invalid base64", false, "X-SSL-Client-Cert", "not base64!", nil, false},
+		{"invalid der", false, "X-SSL-Client-Cert", base64.StdEncoding.EncodeToString([]byte("not a certificate")), nil, false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "https://konnect.example.com/konnect/v1/token", nil)
+		if test.tls {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{peer}}
+		}
+		if test.value != "" {
+			req.Header.Set("X-SSL-Client-Cert", test.value)
+		}
+
+		cert, err := ClientCertificateFromRequest(req, test.header)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected error, got certificate %v", test.name, cert)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if test.expected == nil {
+			if cert != nil {
+				t.Errorf("%s: expected no certificate, got %v", test.name, cert.Subject)
+			}
+			continue
+		}
+		if cert == nil || !cert.Equal(test.expected) {
+			t.Errorf("%s: got wrong certificate", test.name)
+		}
+	}
+}
+
+func TestCertificateThumbprintS256(t *testing.T) {
+	cert := newTestCertificate(t, "thumbprint")
+	other := newTestCertificate(t, "thumbprint")
+
+	sum := sha256.Sum256(cert.Raw)
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	if thumbprint := CertificateThumbprintS256(cert); thumbprint != expected {
+		t.Errorf("got thumbprint %v want %v", thumbprint, expected)
+	}
+	if CertificateThumbprintS256(cert) == CertificateThumbprintS256(other) {
+		t.Error("different certificates have the same thumbprint")
+	}
+}
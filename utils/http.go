@@ -19,12 +19,18 @@ package utils
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"syscall"
 	"time"
 
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 	"golang.org/x/net/http2"
 
+	"stash.kopano.io/kc/konnect/tracing"
 	"stash.kopano.io/kc/konnect/version"
 )
 
@@ -67,6 +73,131 @@ func HTTPTransportWithTLSClientConfig(tlsClientConfig *tls.Config) *http.Transpo
 	return transport
 }
 
+// HTTPClientConfig defines the tunable settings of http.Clients created with
+// NewHTTPClient. Zero values use the defaults of
+// HTTPTransportWithTLSClientConfig.
+type HTTPClientConfig struct {
+	// Timeout limits the time of a whole request including reading the
+	// response body.
+	Timeout time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// Proxy, if set, is used for all requests instead of the proxies set with
+	// the HTTP_PROXY and HTTPS_PROXY environment variables. Hosts matched by
+	// the NO_PROXY environment variable are always connected directly.
+	// WithoutProxy disables proxies completely.
+	Proxy        *url.URL
+	WithoutProxy bool
+
+	// DialControl, if set, is called for every connection after the address
+	// to dial has been resolved, before the connection is established. An
+	// error aborts the connection.
+	DialControl func(network, address string, c syscall.RawConn) error
+
+	// RequestLogger, if set, logs all requests at RequestLogLevel with
+	// the hook returned by NewHTTPRequestLogHook.
+	RequestLogger   logrus.FieldLogger
+	RequestLogLevel logrus.Level
+}
+
+// NewHTTPClient creates a new http.Client with the settings of the provided
+// config using the provided tls.Config. If config is nil, defaults are used.
+func NewHTTPClient(config *HTTPClientConfig, tlsClientConfig *tls.Config) *http.Client {
+	if config == nil {
+		config = &HTTPClientConfig{}
+	}
+
+	transport := HTTPTransportWithTLSClientConfig(tlsClientConfig)
+	if config.DialTimeout > 0 || config.DialControl != nil {
+		dialTimeout := config.DialTimeout
+		if dialTimeout <= 0 {
+			dialTimeout = defaultHTTPTimeout
+		}
+		transport.DialContext = (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: defaultHTTPKeepAlive,
+			DualStack: true,
+			Control:   config.DialControl,
+		}).DialContext
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.WithoutProxy {
+		transport.Proxy = nil
+	} else if config.Proxy != nil {
+		transport.Proxy = HTTPProxyFunc(config.Proxy)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if config.RequestLogger != nil {
+		roundTripper = NewHTTPHookTransport(roundTripper, NewHTTPRequestLogHook(config.RequestLogger, config.RequestLogLevel))
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: tracing.Transport(roundTripper),
+	}
+}
+
+// HTTPProxyFunc returns a proxy function for http.Transport, which uses the
+// provided proxy for all requests except for the hosts matched by the NO_PROXY
+// environment variable. TLS connections to the requested hosts are tunneled
+// through the proxy with CONNECT, so the requested hosts are verified end to
+// end regardless of the proxy.
+func HTTPProxyFunc(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	config.HTTPProxy = proxyURL.String()
+	config.HTTPSProxy = proxyURL.String()
+	proxyFunc := config.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// ParseHTTPProxyURL parses the provided value as proxy URL for HTTPProxyFunc.
+func ParseHTTPProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy host is empty")
+	}
+
+	return proxyURL, nil
+}
+
 // DefaultTLSConfig returns a new tls.Config.
 func DefaultTLSConfig() *tls.Config {
 	return &tls.Config{
@@ -85,12 +216,12 @@ func InsecureSkipVerifyTLSConfig() *tls.Config {
 // DefaultHTTPClient is a http.Client with a timeout set.
 var DefaultHTTPClient = &http.Client{
 	Timeout:   defaultHTTPTimeout,
-	Transport: HTTPTransportWithTLSClientConfig(DefaultTLSConfig()),
+	Transport: tracing.Transport(HTTPTransportWithTLSClientConfig(DefaultTLSConfig())),
 }
 
 // InsecureHTTPClient is a http.Client with a timeout set and with TLS
 // varification disabled.
 var InsecureHTTPClient = &http.Client{
 	Timeout:   defaultHTTPTimeout,
-	Transport: HTTPTransportWithTLSClientConfig(InsecureSkipVerifyTLSConfig()),
+	Transport: tracing.Transport(HTTPTransportWithTLSClientConfig(InsecureSkipVerifyTLSConfig())),
 }
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedValue is the value logged instead of sensitive values.
+const redactedValue = "REDACTED"
+
+// redactedHTTPHeaders are the request headers whose values are never logged.
+var redactedHTTPHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+}
+
+// redactedURLQueryParameters are the URL query parameters whose values are
+// never logged.
+var redactedURLQueryParameters = map[string]bool{
+	"access_token":     true,
+	"client_assertion": true,
+	"client_secret":    true,
+	"code":             true,
+	"code_verifier":    true,
+	"id_token":         true,
+	"id_token_hint":    true,
+	"password":         true,
+	"refresh_token":    true,
+	"token":            true,
+}
+
+// HTTPRequestHook is called for each outbound HTTP request made through a
+// transport created with NewHTTPHookTransport, after the request finished.
+// Either the response or the error is set. Hooks must not read or close the
+// response body.
+type HTTPRequestHook func(req *http.Request, res *http.Response, err error, duration time.Duration)
+
+type httpHookTransport struct {
+	base http.RoundTripper
+	hook HTTPRequestHook
+}
+
+// NewHTTPHookTransport returns a http.RoundTripper which sends requests with
+// the provided base http.RoundTripper and calls the provided hook for each
+// of them.
+func NewHTTPHookTransport(base http.RoundTripper, hook HTTPRequestHook) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &httpHookTransport{
+		base: base,
+		hook: hook,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *httpHookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	t.hook(req, res, err, time.Since(start))
+
+	return res, err
+}
+
+// NewHTTPRequestLogHook returns a HTTPRequestHook which logs the method,
+// URL, headers, status and duration of requests with the provided logger at
+// the provided level. Only debug and info levels are supported, all other
+// levels log at info level. Bodies are not logged and sensitive header and
+// URL query parameter values are redacted.
+func NewHTTPRequestLogHook(logger logrus.FieldLogger, level logrus.Level) HTTPRequestHook {
+	return func(req *http.Request, res *http.Response, err error, duration time.Duration) {
+		entry := logger.WithFields(logrus.Fields{
+			"method":   req.Method,
+			"url":      RedactURL(req.URL),
+			"headers":  redactHTTPHeader(req.Header),
+			"duration": duration,
+		})
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			entry = entry.WithField("status", res.StatusCode)
+		}
+
+		if level == logrus.DebugLevel {
+			entry.Debugln("outbound http request")
+		} else {
+			entry.Infoln("outbound http request")
+		}
+	}
+}
+
+// RedactURL returns the string form of the provided URL with its password
+// and the values of sensitive query parameters redacted.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	redacted := *u
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), redactedValue)
+		}
+	}
+	if redacted.RawQuery != "" {
+		query := redacted.Query()
+		for key, values := range query {
+			if redactedURLQueryParameters[strings.ToLower(key)] {
+				for idx := range values {
+					values[idx] = redactedValue
+				}
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+
+	return redacted.String()
+}
+
+// redactHTTPHeader returns a copy of the provided http.Header with the values
+// of sensitive headers redacted.
+func redactHTTPHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for key, values := range header {
+		redacted[key] = values
+	}
+	for _, key := range redactedHTTPHeaders {
+		if _, ok := redacted[key]; ok {
+			redacted[key] = []string{redactedValue}
+		}
+	}
+
+	return redacted
+}
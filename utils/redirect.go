@@ -32,12 +32,31 @@ import (
 // asFragment is true, the provided params are added as URL fragment, otherwise
 // they replace the query. If params is nil, the provided uri is taken as is.
 func WriteRedirect(rw http.ResponseWriter, code int, uri *url.URL, params interface{}, asFragment bool) error {
+	uriString, err := MakeRedirectURL(uri, params, asFragment)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Location", uriString)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+
+	rw.WriteHeader(code)
+
+	return nil
+}
+
+// MakeRedirectURL creates a URL string out of the provided uri and params. If
+// asFragment is true, the provided params are added as URL fragment, otherwise
+// they are merged into the query, replacing existing query parameters with the
+// same name. If params is nil, the provided uri is taken as is.
+func MakeRedirectURL(uri *url.URL, params interface{}, asFragment bool) (string, error) {
 	uriString := uri.String()
 
 	if params != nil {
 		queryString, err := query.Values(params)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		seperator := "#"
@@ -45,6 +64,12 @@ func WriteRedirect(rw http.ResponseWriter, code int, uri *url.URL, params interf
 			seperator = "?"
 		}
 
+		if !asFragment && uri.RawQuery != "" {
+			// Merge with the query of the target URL, keeping its parameters
+			// unless they are replaced by the provided params.
+			uriString = mergeRedirectURLQuery(uri, queryString)
+		}
+
 		if strings.Contains(uriString, seperator) {
 			// Avoid generating invalid URLs if the seperator is already part
 			// of the target URL - instead append it in the most likely way.
@@ -54,11 +79,29 @@ func WriteRedirect(rw http.ResponseWriter, code int, uri *url.URL, params interf
 		uriString = fmt.Sprintf("%s%s%s", uriString, seperator, queryStringEncoded)
 	}
 
-	rw.Header().Set("Location", uriString)
-	rw.Header().Set("Cache-Control", "no-store")
-	rw.Header().Set("Pragma", "no-cache")
+	return uriString, nil
+}
 
-	rw.WriteHeader(code)
+// mergeRedirectURLQuery returns the provided uri as string with all query
+// parameters removed which are contained in the provided values.
+func mergeRedirectURLQuery(uri *url.URL, values url.Values) string {
+	var kept []string
+	for _, part := range strings.Split(uri.RawQuery, "&") {
+		key := strings.SplitN(part, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if _, ok := values[key]; ok || part == "" {
+			continue
+		}
+		kept = append(kept, part)
+	}
 
-	return nil
+	merged := *uri
+	merged.RawQuery = strings.Join(kept, "&")
+	if merged.RawQuery == "" {
+		merged.ForceQuery = false
+	}
+
+	return merged.String()
 }
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secret value schemes supported by ReadSecret.
+const (
+	SecretSchemeEnv    = "env:"
+	SecretSchemeFile   = "file:"
+	SecretSchemeInline = "inline:"
+)
+
+// SecretScheme returns the scheme prefix of the provided secret value or an
+// empty string if the value does not start with a supported scheme.
+func SecretScheme(value string) string {
+	for _, scheme := range []string{SecretSchemeEnv, SecretSchemeFile, SecretSchemeInline} {
+		if strings.HasPrefix(value, scheme) {
+			return scheme
+		}
+	}
+
+	return ""
+}
+
+// ReadSecret returns the secret referenced by the provided value. Values
+// prefixed with env: are read from the named environment variable, values
+// prefixed with file: are read from the named file and values prefixed with
+// inline: are used as is. Values without a supported scheme prefix are
+// handled with the provided default scheme.
+func ReadSecret(value string, defaultScheme string) ([]byte, error) {
+	scheme := SecretScheme(value)
+	if scheme == "" {
+		scheme = defaultScheme
+	} else {
+		value = strings.TrimPrefix(value, scheme)
+	}
+
+	switch scheme {
+	case SecretSchemeEnv:
+		if value == "" {
+			return nil, fmt.Errorf("missing environment variable name")
+		}
+		secret, ok := os.LookupEnv(value)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", value)
+		}
+		return []byte(secret), nil
+	case SecretSchemeFile:
+		if value == "" {
+			return nil, fmt.Errorf("missing file name")
+		}
+		return ioutil.ReadFile(value)
+	case SecretSchemeInline:
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("unsupported secret scheme: %#v", scheme)
+	}
+}
+
+// ReadSecretString returns the secret referenced by the provided value like
+// ReadSecret as string, with trailing line breaks removed as commonly found
+// in secret files.
+func ReadSecretString(value string, defaultScheme string) (string, error) {
+	secret, err := ReadSecret(value, defaultScheme)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// SecretSource returns a description of the source of the provided secret
+// value which is safe to log, since inline values are not included.
+func SecretSource(value string, defaultScheme string) string {
+	scheme := SecretScheme(value)
+	if scheme == "" {
+		scheme = defaultScheme
+		value = scheme + value
+	}
+	if scheme == SecretSchemeInline {
+		return strings.TrimSuffix(SecretSchemeInline, ":")
+	}
+
+	return value
+}
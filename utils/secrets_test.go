@@ -0,0 +1,101 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretScheme(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"plain", ""},
+		{"env:NAME", SecretSchemeEnv},
+		{"file:/etc/secret", SecretSchemeFile},
+		{"inline:value", SecretSchemeInline},
+		{"other:value", ""},
+		{"ENV:NAME", ""},
+	} {
+		if scheme := SecretScheme(test.value); scheme != test.expected {
+			t.Errorf("%#v: got %#v want %#v", test.value, scheme, test.expected)
+		}
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "konnect-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	secretFile := filepath.Join(tempDir, "secret")
+	if err = ioutil.WriteFile(secretFile, []byte("file-secret\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("KONNECT_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("KONNECT_TEST_SECRET")
+	os.Unsetenv("KONNECT_TEST_SECRET_UNSET")
+
+	for _, test := range []struct {
+		name          string
+		value         string
+		defaultScheme string
+		expected      string
+		source        string
+		valid         bool
+	}{
+		{"env", "env:KONNECT_TEST_SECRET", SecretSchemeInline, "env-secret", "env:KONNECT_TEST_SECRET", true},
+		{"env default", "KONNECT_TEST_SECRET", SecretSchemeEnv, "env-secret", "env:KONNECT_TEST_SECRET", true},
+		{"env unset", "env:KONNECT_TEST_SECRET_UNSET", SecretSchemeInline, "", "env:KONNECT_TEST_SECRET_UNSET", false},
+		{"env empty", "env:", SecretSchemeInline, "", "env:", false},
+		{"file", "file:" + secretFile, SecretSchemeInline, "file-secret", "file:" + secretFile, true},
+		{"file default", secretFile, SecretSchemeFile, "file-secret", "file:" + secretFile, true},
+		{"file missing", "file:" + filepath.Join(tempDir, "missing"), SecretSchemeInline, "", "file:" + filepath.Join(tempDir, "missing"), false},
+		{"file empty", "file:", SecretSchemeInline, "", "file:", false},
+		{"inline", "inline:value", SecretSchemeFile, "value", "inline", true},
+		{"inline default", "value", SecretSchemeInline, "value", "inline", true},
+		{"inline with scheme", "inline:env:value", SecretSchemeFile, "env:value", "inline", true},
+		{"unsupported default", "value", "", "", "value", false},
+	} {
+		secret, err := ReadSecretString(test.value, test.defaultScheme)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: got valid %v want %v: %v", test.name, valid, test.valid, err)
+		}
+		if secret != test.expected {
+			t.Errorf("%s: got secret %#v want %#v", test.name, secret, test.expected)
+		}
+		if source := SecretSource(test.value, test.defaultScheme); source != test.source {
+			t.Errorf("%s: got source %#v want %#v", test.name, source, test.source)
+		}
+	}
+
+	raw, err := ReadSecret("file:"+secretFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "file-secret\r\n" {
+		t.Errorf("ReadSecret must not trim secrets: %#v", string(raw))
+	}
+}
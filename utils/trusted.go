@@ -20,6 +20,14 @@ package utils
 import (
 	"net"
 	"net/http"
+	"strings"
+)
+
+// Default headers which are read from trusted proxies to find the client IP
+// and the scheme of the original request.
+const (
+	DefaultTrustedProxyClientIPHeader = "X-Forwarded-For"
+	DefaultTrustedProxyProtoHeader    = "X-Forwarded-Proto"
 )
 
 // IsRequestFromTrustedSource checks if the provided requests remote address is
@@ -32,17 +40,81 @@ func IsRequestFromTrustedSource(req *http.Request, ips []*net.IP, nets []*net.IP
 
 	ip := net.ParseIP(ipString)
 
+	return isTrustedIP(ip, ips, nets), nil
+}
+
+// isTrustedIP checks if the provided ip is either one of the provided ips or
+// in one of the provided networks.
+func isTrustedIP(ip net.IP, ips []*net.IP, nets []*net.IPNet) bool {
 	for _, checkIP := range ips {
 		if checkIP.Equal(ip) {
-			return true, nil
+			return true
 		}
 	}
-
 	for _, checkNet := range nets {
 		if checkNet.Contains(ip) {
-			return true, nil
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIPFromRequest returns the IP address of the client of the provided
+// request. The provided header is only read if the request was received from
+// one of the provided trusted proxy ips or networks. The header value is a
+// comma separated list, which is examined from the right, skipping trusted
+// proxies.
+func ClientIPFromRequest(req *http.Request, header string, ips []*net.IP, nets []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if header == "" {
+		return remote
+	}
+	if trusted, _ := IsRequestFromTrustedSource(req, ips, nets); !trusted {
+		return remote
+	}
+
+	values := strings.Split(strings.Join(req.Header[http.CanonicalHeaderKey(header)], ","), ",")
+	for idx := len(values) - 1; idx >= 0; idx-- {
+		value := strings.TrimSpace(values[idx])
+		ip := net.ParseIP(value)
+		if ip == nil {
+			// Stop at invalid values, since everything further left cannot be
+			// trusted.
+			break
 		}
+		remote = value
+		if !isTrustedIP(ip, ips, nets) {
+			break
+		}
+	}
+
+	return remote
+}
+
+// SchemeFromRequest returns the scheme of the provided request. The provided
+// header is only read if the request was received from one of the provided
+// trusted proxy ips or networks.
+func SchemeFromRequest(req *http.Request, header string, ips []*net.IP, nets []*net.IPNet) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if header == "" {
+		return scheme
+	}
+	if trusted, _ := IsRequestFromTrustedSource(req, ips, nets); !trusted {
+		return scheme
+	}
+
+	value := strings.ToLower(strings.TrimSpace(strings.SplitN(req.Header.Get(header), ",", 2)[0]))
+	switch value {
+	case "http", "https":
+		scheme = value
 	}
 
-	return false, nil
+	return scheme
 }
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2017-2019 Kopano and its licensors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package utils
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestTrustedProxies(tb testing.TB) ([]*net.IP, []*net.IPNet) {
+	ip := net.ParseIP("192.0.2.1")
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8:1::/48"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		nets = append(nets, network)
+	}
+
+	return []*net.IP{&ip}, nets
+}
+
+func TestClientIPFromRequest(t *testing.T) {
+	ips, nets := newTestTrustedProxies(t)
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		header     string
+		values     []string
+		expected   string
+	}{
+		{"no header configured", "192.0.2.1:1234", "", []string{"203.0.113.5"}, "192.0.2.1"},
+		{"untrusted peer", "198.51.100.7:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5"}, "198.51.100.7"},
+		{"trusted peer without header", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, nil, "192.0.2.1"},
+		{"trusted peer", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5"}, "203.0.113.5"},
+		{"trusted network peer", "10.9.8.7:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5"}, "203.0.113.5"},
+		{"custom header", "192.0.2.1:1234", "X-Real-IP", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"multiple hops", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5, 10.1.1.1, 10.2.2.2"}, "203.0.113.5"},
+		{"spoofed hop", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"198.51.100.99, 203.0.113.5, 10.1.1.1"}, "203.0.113.5"},
+		{"multiple header lines", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5", "10.1.1.1"}, "203.0.113.5"},
+		{"invalid hop", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5, unknown, 10.1.1.1"}, "10.1.1.1"},
+		{"only trusted hops", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+		{"ipv6 peer", "[2001:db8:1::1]:1234", DefaultTrustedProxyClientIPHeader, []string{"2001:db8:ffff::5"}, "2001:db8:ffff::5"},
+		{"ipv6 hops", "192.0.2.1:1234", DefaultTrustedProxyClientIPHeader, []string{"2001:db8:ffff::5, 2001:db8:1::2"}, "2001:db8:ffff::5"},
+		{"untrusted ipv6 peer", "[2001:db8:2::1]:1234", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5"}, "2001:db8:2::1"},
+		{"remote address without port", "192.0.2.1", DefaultTrustedProxyClientIPHeader, []string{"203.0.113.5"}, "192.0.2.1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, value := range test.values {
+			req.Header.Add(DefaultTrustedProxyClientIPHeader, value)
+			req.Header.Add("X-Real-IP", value)
+		}
+
+		if ip := ClientIPFromRequest(req, test.header, ips, nets); ip != test.expected {
+			t.Errorf("%s: got client ip %v want %v", test.name, ip, test.expected)
+		}
+	}
+}
+
+func TestSchemeFromRequest(t *testing.T) {
+	ips, nets := newTestTrustedProxies(t)
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		header     string
+		value      string
+		expected   string
+	}{
+		{"plain", "198.51.100.7:1234", false, DefaultTrustedProxyProtoHeader, "", "http"},
+		{"tls", "198.51.100.7:1234", true, DefaultTrustedProxyProtoHeader, "", "https"},
+		{"no header configured", "192.0.2.1:1234", false, "", "https", "http"},
+		{"untrusted peer", "198.51.100.7:1234", false, DefaultTrustedProxyProtoHeader, "https", "http"},
+		{"untrusted peer with tls", "198.51.100.7:1234", true, DefaultTrustedProxyProtoHeader, "http", "https"},
+		{"trusted peer", "192.0.2.1:1234", false, DefaultTrustedProxyProtoHeader, "https", "https"},
+		{"trusted peer with tls", "192.0.2.1:1234", true, DefaultTrustedProxyProtoHeader, "http", "http"},
+		{"upper case", "192.0.2.1:1234", false, DefaultTrustedProxyProtoHeader, " HTTPS ", "https"},
+		{"multiple hops", "192.0.2.1:1234", false, DefaultTrustedProxyProtoHeader, "https, http", "https"},
+		{"unsupported scheme", "192.0.2.1:1234", false, DefaultTrustedProxyProtoHeader, "ftp", "http"},
+		{"ipv6 peer", "[2001:db8:1::1]:1234", false, DefaultTrustedProxyProtoHeader, "https", "https"},
+		{"untrusted ipv6 peer", "[2001:db8:2::1]:1234", false, DefaultTrustedProxyProtoHeader, "https", "http"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if test.value != "" {
+			req.Header.Set(DefaultTrustedProxyProtoHeader, test.value)
+		}
+
+		if scheme := SchemeFromRequest(req, test.header, ips, nets); scheme != test.expected {
+			t.Errorf("%s: got scheme %v want %v", test.name, scheme, test.expected)
+		}
+	}
+}
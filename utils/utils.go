@@ -16,3 +16,15 @@
  */
 
 package utils
+
+// ContainsString returns true if the provided values contain the provided
+// value.
+func ContainsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}